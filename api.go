@@ -0,0 +1,162 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultAdminAPIPrefix = "/waf/api"
+
+// apiHandler handles a request to an admin API route.
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// registerAPIRoutes builds the admin API route table keyed by "METHOD /path".
+func (m *Middleware) registerAPIRoutes() map[string]apiHandler {
+	return map[string]apiHandler{
+		"GET /profile":               m.handleProfileRequest,
+		"POST /profile/reset":        m.handleProfileResetRequest,
+		"POST /metrics/reset":        m.handleMetricsResetRequest,
+		"GET /top":                   m.handleTopRequest,
+		"GET /status":                m.handleStatusRequest,
+		"GET /events":                m.handleEventsRequest,
+		"POST /events/export":        m.handleEventsExportRequest,
+		"GET /bans":                  m.handleBansRequest,
+		"GET /blacklist/check":       m.handleBlacklistCheckRequest,
+		"GET /explain/{txid}":        m.handleExplainRequest,
+		"POST /bans":                 m.handleBanCreateRequest,
+		"DELETE /bans":               m.handleBanDeleteRequest,
+		"GET /lockdown":              m.handleLockdownRequest,
+		"POST /lockdown":             m.handleLockdownEnableRequest,
+		"DELETE /lockdown":           m.handleLockdownDisableRequest,
+		"GET /rules/canary":          m.handleRuleCanaryRequest,
+		"POST /rules/canary/promote": m.handleRuleCanaryPromoteRequest,
+		"GET /rules/coverage":        m.handleRuleCoverageRequest,
+		"GET /false-positives":       m.handleFalsePositivesRequest,
+		"POST /false-positives":      m.handleFalsePositiveReportRequest,
+		"DELETE /false-positives":    m.handleFalsePositivesResetRequest,
+		"GET /learning":              m.handleLearningRequest,
+		"GET /learning/policy":       m.handleLearningPolicyRequest,
+		"GET /state":                 m.handleStateExportRequest,
+		"POST /state":                m.handleStateImportRequest,
+	}
+}
+
+// isAdminAPIRequest checks if the request targets the admin API.
+func (m *Middleware) isAdminAPIRequest(r *http.Request) bool {
+	if m.AdminAPI == "" {
+		return false
+	}
+	return r.URL.Path == m.AdminAPI || strings.HasPrefix(r.URL.Path, m.AdminAPI+"/")
+}
+
+// handleAdminAPIRequest dispatches an admin API request to its route handler.
+func (m *Middleware) handleAdminAPIRequest(w http.ResponseWriter, r *http.Request) error {
+	route := strings.TrimPrefix(r.URL.Path, m.AdminAPI)
+	m.logger.Debug("Handling admin API request", zap.String("method", r.Method), zap.String("route", route))
+
+	handler, ok := m.apiRoutes[r.Method+" "+route]
+	if ok {
+		return handler(w, r)
+	}
+	otherMethod := false
+	for key, handler := range m.apiRoutes {
+		method, pattern, _ := strings.Cut(key, " ")
+		name, value, ok := matchAPIRoute(pattern, route)
+		if !ok {
+			continue
+		}
+		if method != r.Method {
+			otherMethod = true
+			continue
+		}
+		if name != "" {
+			r.SetPathValue(name, value)
+		}
+		return handler(w, r)
+	}
+	if otherMethod {
+		return writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	return writeJSONError(w, http.StatusNotFound, "unknown admin API route")
+}
+
+// matchAPIRoute matches a route against a route pattern, whose last segment may be a
+// {name} wildcard standing for one path segment. It returns the wildcard name and value.
+func matchAPIRoute(pattern, route string) (string, string, bool) {
+	prefix, wildcard, ok := strings.Cut(pattern, "{")
+	if !ok {
+		return "", "", pattern == route
+	}
+	value, ok := strings.CutPrefix(route, prefix)
+	if !ok || value == "" || strings.Contains(value, "/") {
+		return "", "", false
+	}
+	return strings.TrimSuffix(wildcard, "}"), value, true
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("failed to marshal JSON response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write JSON response: %v", err)
+	}
+	return nil
+}
+
+// writeJSONError writes an error message as a JSON response.
+func writeJSONError(w http.ResponseWriter, statusCode int, message string) error {
+	return writeJSON(w, statusCode, map[string]string{"error": message})
+}
+
+// queryInt returns a positive integer query parameter, or def if absent or invalid.
+func queryInt(r *http.Request, name string, def int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// handleProfileRequest returns the slowest rules since start or since the last reset.
+func (m *Middleware) handleProfileRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.latencyTracker == nil {
+		return writeJSONError(w, http.StatusConflict, "rule profiling requires latency_metrics to be enabled")
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "total"
+	}
+	if sortBy != "total" && sortBy != "avg" && sortBy != "p99" {
+		return writeJSONError(w, http.StatusBadRequest, "sort must be one of: total, avg, p99")
+	}
+	since := m.latencyTracker.Since()
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"since":          since.Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(since).Seconds()),
+		"sort":           sortBy,
+		"phases":         m.latencyTracker.PhaseSummaries(),
+		"rules":          m.latencyTracker.Profile(sortBy, queryInt(r, "limit", 20)),
+	})
+}
+
+// handleProfileResetRequest clears the profiling data.
+func (m *Middleware) handleProfileResetRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.latencyTracker == nil {
+		return writeJSONError(w, http.StatusConflict, "rule profiling requires latency_metrics to be enabled")
+	}
+	m.latencyTracker.Reset()
+	m.logger.Info("Rule profiling data reset", zap.String("remote_addr", r.RemoteAddr))
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+}
@@ -0,0 +1,71 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAdminAPIRequest(t *testing.T) {
+	m := newAPITestMiddleware()
+	assert.True(t, m.isAdminAPIRequest(httptest.NewRequest("GET", "/waf/api/profile", nil)))
+	assert.False(t, m.isAdminAPIRequest(httptest.NewRequest("GET", "/waf/apiary", nil)))
+
+	m.AdminAPI = ""
+	assert.False(t, m.isAdminAPIRequest(httptest.NewRequest("GET", "/waf/api/profile", nil)))
+}
+
+func TestHandleAdminAPIRequest_Routing(t *testing.T) {
+	m := newAPITestMiddleware()
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/nope", nil)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/profile/reset", nil)))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandleProfileRequest(t *testing.T) {
+	m := newAPITestMiddleware()
+	m.latencyTracker.ObserveRule("fast", time.Microsecond)
+	m.latencyTracker.ObserveRule("slow", 5*time.Millisecond)
+	m.latencyTracker.ObserveRule("slow", 5*time.Millisecond)
+	m.latencyTracker.RecordMatch("slow")
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/profile?limit=1", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Rules []RuleProfile `json:"rules"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Rules, 1)
+	assert.Equal(t, "slow", resp.Rules[0].RuleID)
+	assert.Equal(t, int64(2), resp.Rules[0].Evaluations)
+	assert.Equal(t, int64(1), resp.Rules[0].Matches)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/profile?sort=median", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/profile/reset", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, m.latencyTracker.Profile("total", 0))
+}
+
+func TestHandleProfileRequest_Disabled(t *testing.T) {
+	m := newAPITestMiddleware()
+	m.latencyTracker = nil
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/profile", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -0,0 +1,350 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBanWindow   = time.Minute
+	defaultBanDuration = time.Hour
+	banRuleID          = "ban_rule"
+	strikePruneEvery   = time.Minute
+)
+
+// BanConfig configures dynamic bans of clients that keep getting blocked.
+type BanConfig struct {
+	Threshold     int                   `json:"threshold,omitempty"`      // Blocks within Window that trigger a ban, 0 disables auto-bans
+	Window        time.Duration         `json:"window,omitempty"`         // Default 1m
+	Duration      time.Duration         `json:"duration,omitempty"`       // Default 1h
+	HoneypotRules []string              `json:"honeypot_rules,omitempty"` // Rule IDs that ban on the first match
+	Propagation   *BanPropagationConfig `json:"propagation,omitempty"`    // Share bans with peers over Redis or NATS
+}
+
+// Ban is a temporary block of a client.
+type Ban struct {
+	Key     string    `json:"key"` // Client IP, prefixed with "<host>|" for tenant-scoped bans
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Origin  string    `json:"origin"` // Node that issued the ban
+}
+
+// strikeWindow counts the blocks of a client within a fixed window.
+type strikeWindow struct {
+	start time.Time
+	count int
+}
+
+// BanList holds the active bans and the recent blocks of every client.
+type BanList struct {
+	config BanConfig
+	origin string // ID of this node, attached to the bans it issues
+
+	mu        sync.Mutex
+	bans      map[string]Ban
+	strikes   map[string]*strikeWindow
+	lastPrune time.Time
+}
+
+// NewBanList creates a BanList, applying defaults to the config.
+func NewBanList(config BanConfig) *BanList {
+	if config.Window <= 0 {
+		config.Window = defaultBanWindow
+	}
+	if config.Duration <= 0 {
+		config.Duration = defaultBanDuration
+	}
+	return &BanList{
+		config:  config,
+		origin:  uuid.New().String(),
+		bans:    make(map[string]Ban),
+		strikes: make(map[string]*strikeWindow),
+	}
+}
+
+// Add stores a ban, replacing any ban of the same key.
+func (bl *BanList) Add(ban Ban) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans[ban.Key] = ban
+	delete(bl.strikes, ban.Key)
+}
+
+// Remove lifts the ban of a key and reports whether it existed.
+func (bl *BanList) Remove(key string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	_, ok := bl.bans[key]
+	delete(bl.bans, key)
+	return ok
+}
+
+// Banned reports whether a key has an active ban at now.
+func (bl *BanList) Banned(key string, now time.Time) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	ban, ok := bl.bans[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(ban.Expires) {
+		delete(bl.bans, key)
+		return false
+	}
+	return true
+}
+
+// Get returns the active ban of a key at now.
+func (bl *BanList) Get(key string, now time.Time) (Ban, bool) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	ban, ok := bl.bans[key]
+	if !ok || !now.Before(ban.Expires) {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// List returns the active bans, soonest expiry first.
+func (bl *BanList) List(now time.Time) []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bans := make([]Ban, 0, len(bl.bans))
+	for key, ban := range bl.bans {
+		if !now.Before(ban.Expires) {
+			delete(bl.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Expires.Equal(bans[j].Expires) {
+			return bans[i].Expires.Before(bans[j].Expires)
+		}
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// Strike counts a block of key and reports whether it reached the threshold.
+func (bl *BanList) Strike(key string, now time.Time) bool {
+	if bl.config.Threshold <= 0 {
+		return false
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.pruneLocked(now)
+
+	sw, ok := bl.strikes[key]
+	if !ok || now.Sub(sw.start) >= bl.config.Window {
+		sw = &strikeWindow{start: now}
+		bl.strikes[key] = sw
+	}
+	sw.count++
+	if sw.count < bl.config.Threshold {
+		return false
+	}
+	delete(bl.strikes, key)
+	return true
+}
+
+// pruneLocked drops expired bans and stale strike windows. The caller must hold bl.mu.
+func (bl *BanList) pruneLocked(now time.Time) {
+	if now.Sub(bl.lastPrune) < strikePruneEvery {
+		return
+	}
+	bl.lastPrune = now
+	for key, sw := range bl.strikes {
+		if now.Sub(sw.start) >= bl.config.Window {
+			delete(bl.strikes, key)
+		}
+	}
+	for key, ban := range bl.bans {
+		if !now.Before(ban.Expires) {
+			delete(bl.bans, key)
+		}
+	}
+}
+
+// isHoneypotRule reports whether a rule bans on its first match.
+func (bl *BanList) isHoneypotRule(ruleID string) bool {
+	for _, id := range bl.config.HoneypotRules {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned reports whether the client of a request is banned, either for the
+// request's tenant or globally.
+func (m *Middleware) isBanned(r *http.Request) bool {
+	if m.banList == nil {
+		return false
+	}
+	ip := extractIP(r.RemoteAddr)
+	now := time.Now()
+	if m.banList.Banned(ip, now) {
+		return true
+	}
+	if key := m.scopedKey(r, ip); key != ip {
+		return m.banList.Banned(key, now)
+	}
+	return false
+}
+
+// recordViolation bans the client of a blocked request when it matched a
+// honeypot rule or reached the block threshold.
+func (m *Middleware) recordViolation(r *http.Request, ruleID string) {
+	if m.banList == nil || ruleID == banRuleID {
+		return
+	}
+	key := m.scopedKey(r, extractIP(r.RemoteAddr))
+	var reason string
+	switch {
+	case m.banList.isHoneypotRule(ruleID):
+		reason = fmt.Sprintf("honeypot rule %s matched", ruleID)
+	case m.banList.Strike(key, time.Now()):
+		reason = fmt.Sprintf("%d blocks within %s", m.banList.config.Threshold, m.banList.config.Window)
+	default:
+		return
+	}
+	ban := m.banClient(key, reason, 0)
+	if m.hasEventConsumers() {
+		ev := m.newBlockEvent(r, &WAFState{}, http.StatusForbidden, ban.Reason, ruleID)
+		ev.Kind = EventKindBan
+		ev.Severity = "HIGH"
+		m.publishEvent(ev)
+	}
+}
+
+// banClient bans a key on this node and publishes the ban to peers.
+func (m *Middleware) banClient(key, reason string, duration time.Duration) Ban {
+	if duration <= 0 {
+		duration = m.banList.config.Duration
+	}
+	now := time.Now()
+	ban := Ban{Key: key, Reason: reason, Created: now, Expires: now.Add(duration), Origin: m.banList.origin}
+	m.banList.Add(ban)
+	m.logger.Warn("Client banned",
+		zap.String("key", key),
+		zap.String("reason", reason),
+		zap.Time("expires", ban.Expires),
+	)
+	m.publishBan(BanMessage{Action: banActionBan, Ban: ban})
+	return ban
+}
+
+// unbanClient lifts a ban on this node and publishes the removal to peers.
+func (m *Middleware) unbanClient(key string) bool {
+	removed := m.banList.Remove(key)
+	m.publishBan(BanMessage{Action: banActionUnban, Ban: Ban{Key: key, Origin: m.banList.origin}})
+	return removed
+}
+
+// publishBan sends a ban message to the propagation channel and the cluster.
+func (m *Middleware) publishBan(msg BanMessage) {
+	if m.banPropagator != nil {
+		m.banPropagator.Publish(msg)
+	}
+	if m.cluster != nil {
+		m.cluster.Broadcast(clusterMessage{Bans: []BanMessage{msg}})
+	}
+}
+
+// applyPeerBan applies a ban or unban received from another node.
+func (m *Middleware) applyPeerBan(msg BanMessage) {
+	if m.banList == nil || msg.Ban.Origin == m.banList.origin || msg.Ban.Key == "" {
+		return
+	}
+	switch msg.Action {
+	case banActionBan:
+		if !time.Now().Before(msg.Ban.Expires) {
+			return
+		}
+		m.banList.Add(msg.Ban)
+		m.logger.Info("Peer ban applied", zap.String("key", msg.Ban.Key), zap.String("origin", msg.Ban.Origin), zap.Time("expires", msg.Ban.Expires))
+	case banActionUnban:
+		m.banList.Remove(msg.Ban.Key)
+		m.logger.Info("Peer unban applied", zap.String("key", msg.Ban.Key), zap.String("origin", msg.Ban.Origin))
+	}
+}
+
+// banKey returns the ban key named by the ip and optional host parameters.
+func banKey(ip, host string) string {
+	if host == "" {
+		return ip
+	}
+	return tenantHost(host) + "|" + ip
+}
+
+// handleBansRequest lists the active bans.
+func (m *Middleware) handleBansRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.banList == nil {
+		return writeJSONError(w, http.StatusConflict, "bans require the ban directive")
+	}
+	bans := m.banList.List(time.Now())
+	return writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(bans), "bans": bans})
+}
+
+// banRequest is the body of POST /bans.
+type banRequest struct {
+	IP       string `json:"ip"`
+	Host     string `json:"host,omitempty"`     // Limit the ban to one tenant
+	Duration string `json:"duration,omitempty"` // Go duration, the configured duration if empty
+	Reason   string `json:"reason,omitempty"`
+}
+
+// handleBanCreateRequest bans a client on request of an operator.
+func (m *Middleware) handleBanCreateRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.banList == nil {
+		return writeJSONError(w, http.StatusConflict, "bans require the ban directive")
+	}
+	var req banRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+	}
+	if req.IP == "" {
+		return writeJSONError(w, http.StatusBadRequest, "ip is required")
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return writeJSONError(w, http.StatusBadRequest, "duration must be a positive duration such as 30m")
+		}
+		duration = d
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "banned via admin API"
+	}
+	ban := m.banClient(banKey(req.IP, req.Host), reason, duration)
+	return writeJSON(w, http.StatusCreated, ban)
+}
+
+// handleBanDeleteRequest lifts the ban named by the ip and host query parameters.
+func (m *Middleware) handleBanDeleteRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.banList == nil {
+		return writeJSONError(w, http.StatusConflict, "bans require the ban directive")
+	}
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		return writeJSONError(w, http.StatusBadRequest, "ip is required")
+	}
+	key := banKey(ip, r.URL.Query().Get("host"))
+	if !m.unbanClient(key) {
+		return writeJSONError(w, http.StatusNotFound, "no active ban for "+key)
+	}
+	m.logger.Info("Client unbanned via admin API", zap.String("key", key), zap.String("remote_addr", r.RemoteAddr))
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "unbanned", "key": key})
+}
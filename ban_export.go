@@ -0,0 +1,199 @@
+package caddywaf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Supported ban export formats
+const (
+	BanExportNftables = "nftables"
+	BanExportIPSet    = "ipset"
+)
+
+const (
+	defaultBanExportInterval = 10 * time.Second
+	defaultBanExportSet      = "caddy_waf_banned"
+	defaultBanExportTable    = "inet filter"
+	banExportReloadTimeout   = 30 * time.Second
+)
+
+// BanExportConfig mirrors the active bans into an nftables or ipset set file, loaded into
+// the kernel by a reload command, so that banned clients are dropped before reaching Caddy.
+type BanExportConfig struct {
+	Format      string        `json:"format"`                 // nftables or ipset
+	File        string        `json:"file"`                   // Set file, replaced atomically
+	Set         string        `json:"set,omitempty"`          // Set name, suffixed with _v4 and _v6, default caddy_waf_banned
+	Table       string        `json:"table,omitempty"`        // nftables family and table of the sets, default "inet filter"
+	Reload      []string      `json:"reload,omitempty"`       // Command loading the file, run when it changes
+	Interval    time.Duration `json:"interval,omitempty"`     // Time between two syncs, default 10s
+	MinDuration time.Duration `json:"min_duration,omitempty"` // Only export bans lasting at least this long
+}
+
+// BanExporter periodically writes the active bans to the set file.
+type BanExporter struct {
+	logger *zap.Logger
+	config BanExportConfig
+	bans   *BanList
+
+	mu        sync.Mutex
+	signature string // Bans of the last file written
+	written   bool
+
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewBanExporter validates the config and applies its defaults.
+func NewBanExporter(logger *zap.Logger, config BanExportConfig, bans *BanList) (*BanExporter, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	config.Format = strings.ToLower(config.Format)
+	if config.Format != BanExportNftables && config.Format != BanExportIPSet {
+		return nil, fmt.Errorf("unsupported ban_export format '%s', must be nftables or ipset", config.Format)
+	}
+	if config.File == "" {
+		return nil, fmt.Errorf("ban_export requires a file")
+	}
+	if config.Set == "" {
+		config.Set = defaultBanExportSet
+	}
+	if config.Table == "" {
+		config.Table = defaultBanExportTable
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultBanExportInterval
+	}
+	return &BanExporter{logger: logger, config: config, bans: bans, stop: make(chan struct{})}, nil
+}
+
+// Start syncs the set file now, then every interval.
+func (be *BanExporter) Start() {
+	be.wg.Add(1)
+	go be.syncLoop()
+}
+
+// Stop stops syncing. The set file is left in place, its entries expiring with the bans.
+func (be *BanExporter) Stop() {
+	be.stopOnce.Do(func() {
+		close(be.stop)
+		be.wg.Wait()
+	})
+}
+
+func (be *BanExporter) syncLoop() {
+	defer be.wg.Done()
+	ticker := time.NewTicker(be.config.Interval)
+	defer ticker.Stop()
+
+	be.syncAndLog(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			be.syncAndLog(time.Now())
+		case <-be.stop:
+			return
+		}
+	}
+}
+
+func (be *BanExporter) syncAndLog(now time.Time) {
+	if err := be.Sync(now); err != nil {
+		be.logger.Error("Failed to export bans", zap.String("file", be.config.File), zap.Error(err))
+	}
+}
+
+// Sync writes the set file and runs the reload command if the exported bans changed since
+// the last write.
+func (be *BanExporter) Sync(now time.Time) error {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	bans := be.exportedBans(now)
+	var signature strings.Builder
+	for _, ban := range bans {
+		fmt.Fprintf(&signature, "%s %d\n", ban.Key, ban.Expires.Unix())
+	}
+	if be.written && signature.String() == be.signature {
+		return nil
+	}
+
+	if err := writeFileAtomic(be.config.File, []byte(be.render(bans, now))); err != nil {
+		return err
+	}
+	be.signature, be.written = signature.String(), true
+	if len(be.config.Reload) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), banExportReloadTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, be.config.Reload[0], be.config.Reload[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ban_export reload failed: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+	be.logger.Debug("Bans exported", zap.String("file", be.config.File), zap.Int("bans", len(bans)))
+	return nil
+}
+
+// exportedBans returns the active global bans of IP addresses lasting at least
+// MinDuration, sorted by key. Tenant-scoped bans can't be enforced by the kernel.
+func (be *BanExporter) exportedBans(now time.Time) []Ban {
+	var bans []Ban
+	for _, ban := range be.bans.List(now) {
+		if net.ParseIP(ban.Key) == nil || ban.Expires.Sub(ban.Created) < be.config.MinDuration {
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Key < bans[j].Key })
+	return bans
+}
+
+// render returns the set file of the bans, for nft -f or ipset restore -exist. Both
+// formats create the IPv4 and IPv6 sets if needed, flush them and add the bans with their
+// remaining time as timeout, so the file replaces the sets when loaded.
+func (be *BanExporter) render(bans []Ban, now time.Time) string {
+	v4, v6 := be.config.Set+"_v4", be.config.Set+"_v6"
+	var sb strings.Builder
+	sb.WriteString("# Generated by caddy-waf from its active bans, do not edit\n")
+	if be.config.Format == BanExportIPSet {
+		fmt.Fprintf(&sb, "create %s hash:ip family inet timeout 0\n", v4)
+		fmt.Fprintf(&sb, "create %s hash:ip family inet6 timeout 0\n", v6)
+		fmt.Fprintf(&sb, "flush %s\nflush %s\n", v4, v6)
+		for _, ban := range bans {
+			set := v6
+			if net.ParseIP(ban.Key).To4() != nil {
+				set = v4
+			}
+			fmt.Fprintf(&sb, "add %s %s timeout %d\n", set, ban.Key, banTimeout(ban, now))
+		}
+		return sb.String()
+	}
+
+	table := be.config.Table
+	fmt.Fprintf(&sb, "add set %s %s { type ipv4_addr; flags timeout; }\n", table, v4)
+	fmt.Fprintf(&sb, "add set %s %s { type ipv6_addr; flags timeout; }\n", table, v6)
+	fmt.Fprintf(&sb, "flush set %s %s\nflush set %s %s\n", table, v4, table, v6)
+	for _, ban := range bans {
+		set := v6
+		if net.ParseIP(ban.Key).To4() != nil {
+			set = v4
+		}
+		fmt.Fprintf(&sb, "add element %s %s { %s timeout %ds }\n", table, set, ban.Key, banTimeout(ban, now))
+	}
+	return sb.String()
+}
+
+// banTimeout returns the remaining seconds of a ban, at least 1.
+func banTimeout(ban Ban, now time.Time) int64 {
+	return max(int64(ban.Expires.Sub(now).Seconds()), 1)
+}
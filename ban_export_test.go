@@ -0,0 +1,99 @@
+package caddywaf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestBanExporter(t *testing.T, config BanExportConfig) (*BanExporter, *BanList) {
+	bans := NewBanList(BanConfig{})
+	be, err := NewBanExporter(zap.NewNop(), config, bans)
+	require.NoError(t, err)
+	return be, bans
+}
+
+func TestBanExporter_Nftables(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bans.nft")
+	reloads := filepath.Join(dir, "reloads")
+	be, bans := newTestBanExporter(t, BanExportConfig{
+		Format:      "NFTables",
+		File:        file,
+		Reload:      []string{"sh", "-c", "echo reload >> " + reloads},
+		MinDuration: time.Hour,
+	})
+	assert.Equal(t, defaultBanExportSet, be.config.Set)
+	assert.Equal(t, defaultBanExportTable, be.config.Table)
+
+	now := time.Now()
+	bans.Add(Ban{Key: "203.0.113.7", Created: now, Expires: now.Add(2 * time.Hour)})
+	bans.Add(Ban{Key: "2001:db8::1", Created: now, Expires: now.Add(time.Hour)})
+	bans.Add(Ban{Key: "198.51.100.1", Created: now, Expires: now.Add(time.Minute)})         // Too short
+	bans.Add(Ban{Key: "shop.example|192.0.2.1", Created: now, Expires: now.Add(time.Hour)}) // Tenant-scoped
+	require.NoError(t, be.Sync(now))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, `# Generated by caddy-waf from its active bans, do not edit
+add set inet filter caddy_waf_banned_v4 { type ipv4_addr; flags timeout; }
+add set inet filter caddy_waf_banned_v6 { type ipv6_addr; flags timeout; }
+flush set inet filter caddy_waf_banned_v4
+flush set inet filter caddy_waf_banned_v6
+add element inet filter caddy_waf_banned_v6 { 2001:db8::1 timeout 3600s }
+add element inet filter caddy_waf_banned_v4 { 203.0.113.7 timeout 7200s }
+`, string(data))
+
+	// Unchanged bans are not written again
+	require.NoError(t, be.Sync(now.Add(time.Minute)))
+	bans.Remove("203.0.113.7")
+	require.NoError(t, be.Sync(now.Add(time.Minute)))
+	data, err = os.ReadFile(reloads)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "reload"))
+	data, err = os.ReadFile(file)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "203.0.113.7")
+	assert.Contains(t, string(data), "{ 2001:db8::1 timeout 3540s }")
+}
+
+func TestBanExporter_IPSet(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.ipset")
+	be, bans := newTestBanExporter(t, BanExportConfig{Format: BanExportIPSet, File: file, Set: "waf"})
+	now := time.Now()
+	bans.Add(Ban{Key: "203.0.113.7", Created: now, Expires: now.Add(90 * time.Second)})
+	require.NoError(t, be.Sync(now))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, `# Generated by caddy-waf from its active bans, do not edit
+create waf_v4 hash:ip family inet timeout 0
+create waf_v6 hash:ip family inet6 timeout 0
+flush waf_v4
+flush waf_v6
+add waf_v4 203.0.113.7 timeout 90
+`, string(data))
+}
+
+func TestBanExporter_Errors(t *testing.T) {
+	_, err := NewBanExporter(zap.NewNop(), BanExportConfig{Format: "iptables", File: "bans"}, NewBanList(BanConfig{}))
+	assert.Error(t, err)
+	_, err = NewBanExporter(zap.NewNop(), BanExportConfig{Format: BanExportIPSet}, NewBanList(BanConfig{}))
+	assert.Error(t, err)
+
+	be, _ := newTestBanExporter(t, BanExportConfig{Format: BanExportIPSet, File: filepath.Join(t.TempDir(), "bans"), Reload: []string{"false"}})
+	assert.Error(t, be.Sync(time.Now()), "failed reload")
+
+	be, _ = newTestBanExporter(t, BanExportConfig{Format: BanExportIPSet, File: filepath.Join(t.TempDir(), "missing", "bans")})
+	assert.Error(t, be.Sync(time.Now()))
+
+	be.Start()
+	be.Stop()
+	be.Stop()
+}
@@ -0,0 +1,458 @@
+package caddywaf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Supported ban propagation transports
+const (
+	BanPropagationRedis = "redis"
+	BanPropagationNATS  = "nats"
+)
+
+const (
+	defaultBanChannel       = "caddy-waf-bans"
+	banPropagationQueueSize = 256
+	banPropagationTimeout   = 5 * time.Second
+	banPropagationRetry     = 5 * time.Second
+)
+
+// Ban message actions
+const (
+	banActionBan   = "ban"
+	banActionUnban = "unban"
+)
+
+// BanPropagationConfig configures the pub/sub channel shared by peer nodes.
+type BanPropagationConfig struct {
+	Type     string `json:"type"`               // redis or nats
+	Address  string `json:"address"`            // host:port of the server
+	Channel  string `json:"channel,omitempty"`  // Redis channel or NATS subject
+	Password string `json:"password,omitempty"` // Redis AUTH password or NATS auth token
+}
+
+// BanMessage is published for every ban or unban issued by a node.
+type BanMessage struct {
+	Action string `json:"action"` // ban or unban
+	Ban    Ban    `json:"ban"`
+}
+
+// pubsubConn is a connection to a pub/sub server.
+type pubsubConn interface {
+	publish(channel string, payload []byte) error
+	subscribe(channel string) error
+	receive() ([]byte, error) // Blocks until a message arrives on the subscribed channel
+	Close() error
+}
+
+// PubSub publishes payloads to a Redis channel or NATS subject and delivers
+// the payloads published by other nodes, reconnecting after failures.
+type PubSub struct {
+	logger *zap.Logger
+	config BanPropagationConfig
+	dial   func() (pubsubConn, error)
+
+	queue  chan []byte
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	subConn pubsubConn
+}
+
+// NewPubSub creates a PubSub for the configured transport.
+func NewPubSub(logger *zap.Logger, config BanPropagationConfig) (*PubSub, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("%s pub/sub requires an address", config.Type)
+	}
+	if config.Channel == "" {
+		config.Channel = defaultBanChannel
+	}
+	ps := &PubSub{
+		logger: logger,
+		config: config,
+		queue:  make(chan []byte, banPropagationQueueSize),
+	}
+	switch config.Type {
+	case BanPropagationRedis:
+		ps.dial = func() (pubsubConn, error) { return dialRedis(config.Address, config.Password) }
+	case BanPropagationNATS:
+		ps.dial = func() (pubsubConn, error) { return dialNATS(config.Address, config.Password) }
+	default:
+		return nil, fmt.Errorf("unsupported pub/sub type '%s', must be redis or nats", config.Type)
+	}
+	ps.ctx, ps.cancel = context.WithCancel(context.Background())
+	return ps, nil
+}
+
+// Start runs the publisher and the subscriber, which calls handle for every received payload.
+func (ps *PubSub) Start(handle func(payload []byte)) {
+	ps.wg.Add(2)
+	go ps.publishLoop()
+	go ps.subscribeLoop(handle)
+}
+
+// Publish queues a payload. Payloads are dropped when the queue is full.
+func (ps *PubSub) Publish(payload []byte) bool {
+	select {
+	case ps.queue <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop closes the connections and waits for the loops to exit.
+func (ps *PubSub) Stop() {
+	ps.cancel()
+	ps.mu.Lock()
+	if ps.subConn != nil {
+		ps.subConn.Close()
+	}
+	ps.mu.Unlock()
+	ps.wg.Wait()
+}
+
+// publishLoop sends queued payloads over a lazily (re)established connection.
+func (ps *PubSub) publishLoop() {
+	defer ps.wg.Done()
+	var conn pubsubConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case payload := <-ps.queue:
+			if conn == nil {
+				var err error
+				if conn, err = ps.dial(); err != nil {
+					ps.logger.Error("Failed to connect to pub/sub server", zap.String("address", ps.config.Address), zap.Error(err))
+					conn = nil
+					continue
+				}
+			}
+			if err := conn.publish(ps.config.Channel, payload); err != nil {
+				ps.logger.Error("Failed to publish to pub/sub server", zap.String("channel", ps.config.Channel), zap.Error(err))
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// subscribeLoop receives payloads, reconnecting after errors.
+func (ps *PubSub) subscribeLoop(handle func(payload []byte)) {
+	defer ps.wg.Done()
+	for ps.ctx.Err() == nil {
+		if err := ps.subscribeOnce(handle); err != nil && ps.ctx.Err() == nil {
+			ps.logger.Error("Pub/sub subscription failed", zap.String("address", ps.config.Address), zap.Error(err))
+		}
+		select {
+		case <-ps.ctx.Done():
+		case <-time.After(banPropagationRetry):
+		}
+	}
+}
+
+// subscribeOnce subscribes and handles payloads until the connection fails.
+func (ps *PubSub) subscribeOnce(handle func(payload []byte)) error {
+	conn, err := ps.dial()
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	if ps.ctx.Err() != nil {
+		ps.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	ps.subConn = conn
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		ps.subConn = nil
+		ps.mu.Unlock()
+		conn.Close()
+	}()
+
+	if err := conn.subscribe(ps.config.Channel); err != nil {
+		return err
+	}
+	ps.logger.Info("Subscribed to pub/sub channel", zap.String("type", ps.config.Type), zap.String("channel", ps.config.Channel))
+	for {
+		payload, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		handle(payload)
+	}
+}
+
+// BanPropagator publishes local bans and applies the bans of peers.
+type BanPropagator struct {
+	*PubSub
+}
+
+// NewBanPropagator creates a BanPropagator for the configured transport.
+func NewBanPropagator(logger *zap.Logger, config BanPropagationConfig) (*BanPropagator, error) {
+	ps, err := NewPubSub(logger, config)
+	if err != nil {
+		return nil, err
+	}
+	return &BanPropagator{PubSub: ps}, nil
+}
+
+// Start subscribes to the channel and calls apply for every ban message.
+func (bp *BanPropagator) Start(apply func(BanMessage)) {
+	bp.PubSub.Start(func(payload []byte) {
+		var msg BanMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			bp.logger.Warn("Ignoring invalid ban message", zap.Error(err))
+			return
+		}
+		apply(msg)
+	})
+}
+
+// Publish queues a ban message for the peers.
+func (bp *BanPropagator) Publish(msg BanMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		bp.logger.Error("Failed to marshal ban message", zap.Error(err))
+		return
+	}
+	if !bp.PubSub.Publish(payload) {
+		bp.logger.Warn("Ban propagation queue full, dropping message", zap.String("key", msg.Ban.Key))
+	}
+}
+
+// redisConn speaks the subset of RESP needed for PUBLISH and SUBSCRIBE.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(address, password string) (pubsubConn, error) {
+	rc, err := connectRedis(address, password)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// connectRedis dials a Redis server and authenticates with the password, if any.
+func connectRedis(address, password string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", address, banPropagationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := rc.command("AUTH", password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+	return rc, nil
+}
+
+// command sends a command and reads its reply.
+func (rc *redisConn) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	rc.conn.SetDeadline(time.Now().Add(banPropagationTimeout))
+	defer rc.conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// read parses a single RESP value.
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply: %q", line)
+}
+
+func (rc *redisConn) publish(channel string, payload []byte) error {
+	_, err := rc.command("PUBLISH", channel, string(payload))
+	return err
+}
+
+func (rc *redisConn) subscribe(channel string) error {
+	_, err := rc.command("SUBSCRIBE", channel)
+	return err
+}
+
+func (rc *redisConn) receive() ([]byte, error) {
+	for {
+		reply, err := rc.read()
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		if payload, ok := items[2].([]byte); ok {
+			return payload, nil
+		}
+	}
+}
+
+func (rc *redisConn) Close() error {
+	return rc.conn.Close()
+}
+
+// natsConn speaks the subset of the NATS client protocol needed for PUB and SUB.
+type natsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+func dialNATS(address, token string) (pubsubConn, error) {
+	conn, err := net.DialTimeout("tcp", address, banPropagationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	nc := &natsConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(banPropagationTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	info, err := nc.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(info))
+	}
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "caddy-waf"}
+	if token != "" {
+		connect["auth_token"] = token
+	}
+	options, _ := json.Marshal(connect)
+	if err := nc.write("CONNECT " + string(options) + "\r\nPING\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := nc.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply = strings.TrimSpace(reply); reply != "PONG" {
+		conn.Close()
+		return nil, fmt.Errorf("NATS connect failed: %s", reply)
+	}
+	return nc, nil
+}
+
+func (nc *natsConn) write(s string) error {
+	nc.wmu.Lock()
+	defer nc.wmu.Unlock()
+	_, err := io.WriteString(nc.conn, s)
+	return err
+}
+
+func (nc *natsConn) publish(subject string, payload []byte) error {
+	return nc.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload))
+}
+
+func (nc *natsConn) subscribe(subject string) error {
+	return nc.write(fmt.Sprintf("SUB %s 1\r\n", subject))
+}
+
+func (nc *natsConn) receive() ([]byte, error) {
+	for {
+		line, err := nc.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if err := nc.write("PONG\r\n"); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, fmt.Errorf("NATS error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid NATS message header: %q", line)
+			}
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(nc.r, buf); err != nil {
+				return nil, err
+			}
+			return buf[:n], nil
+		}
+	}
+}
+
+func (nc *natsConn) Close() error {
+	return nc.conn.Close()
+}
@@ -0,0 +1,107 @@
+package caddywaf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func serveNATS(b *fakeBroker, conn net.Conn) {
+	_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			if i := strings.Index(line, `"auth_token":"`); i >= 0 {
+				rest := line[i+len(`"auth_token":"`):]
+				b.setAuth(rest[:strings.Index(rest, `"`)])
+			}
+		case "PING":
+			_, _ = io.WriteString(conn, "PONG\r\n")
+		case "SUB":
+			b.addSubscriber(conn)
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			subject := fields[1]
+			b.broadcast(func(p string) string {
+				return fmt.Sprintf("MSG %s 1 %d\r\n%s\r\n", subject, len(p), p)
+			}, string(buf[:size]))
+		}
+	}
+}
+
+func TestBanPropagator_PeersApplyBans(t *testing.T) {
+	for name, serve := range map[string]func(*fakeBroker, net.Conn){
+		BanPropagationRedis: serveRedis,
+		BanPropagationNATS:  serveNATS,
+	} {
+		t.Run(name, func(t *testing.T) {
+			broker := newFakeBroker(t, serve)
+			config := BanPropagationConfig{Type: name, Address: broker.ln.Addr().String(), Password: "secret"}
+
+			newNode := func() *Middleware {
+				m := newBanTestMiddleware(BanConfig{})
+				bp, err := NewBanPropagator(zap.NewNop(), config)
+				require.NoError(t, err)
+				m.banPropagator = bp
+				bp.Start(m.applyPeerBan)
+				t.Cleanup(bp.Stop)
+				return m
+			}
+			a, b := newNode(), newNode()
+
+			// Wait for both subscriptions before publishing
+			require.Eventually(t, func() bool {
+				broker.mu.Lock()
+				defer broker.mu.Unlock()
+				return len(broker.subs) == 2
+			}, 3*time.Second, 10*time.Millisecond)
+
+			a.banClient("10.0.0.1", "test", time.Hour)
+			require.Eventually(t, func() bool {
+				return b.banList.Banned("10.0.0.1", time.Now())
+			}, 3*time.Second, 10*time.Millisecond)
+
+			a.unbanClient("10.0.0.1")
+			require.Eventually(t, func() bool {
+				return !b.banList.Banned("10.0.0.1", time.Now())
+			}, 3*time.Second, 10*time.Millisecond)
+
+			broker.mu.Lock()
+			assert.Equal(t, "secret", broker.auth)
+			broker.mu.Unlock()
+		})
+	}
+}
+
+func TestNewBanPropagator_Validation(t *testing.T) {
+	_, err := NewBanPropagator(nil, BanPropagationConfig{Type: "kafka", Address: "127.0.0.1:9092"})
+	assert.Error(t, err)
+	_, err = NewBanPropagator(nil, BanPropagationConfig{Type: BanPropagationRedis})
+	assert.Error(t, err)
+
+	bp, err := NewBanPropagator(nil, BanPropagationConfig{Type: BanPropagationNATS, Address: "127.0.0.1:4222"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultBanChannel, bp.config.Channel)
+}
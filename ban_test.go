@@ -0,0 +1,159 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList_Strike(t *testing.T) {
+	bl := NewBanList(BanConfig{Threshold: 3, Window: time.Minute})
+	now := time.Now()
+
+	assert.False(t, bl.Strike("1.1.1.1", now))
+	assert.False(t, bl.Strike("1.1.1.1", now.Add(time.Second)))
+	assert.True(t, bl.Strike("1.1.1.1", now.Add(2*time.Second)))
+
+	// A new window starts the count over
+	assert.False(t, bl.Strike("2.2.2.2", now))
+	assert.False(t, bl.Strike("2.2.2.2", now.Add(time.Second)))
+	assert.False(t, bl.Strike("2.2.2.2", now.Add(2*time.Minute)))
+
+	assert.False(t, NewBanList(BanConfig{}).Strike("1.1.1.1", now), "threshold 0 disables auto-bans")
+}
+
+func TestBanList_Expiry(t *testing.T) {
+	bl := NewBanList(BanConfig{})
+	now := time.Now()
+	bl.Add(Ban{Key: "1.1.1.1", Expires: now.Add(time.Minute)})
+	bl.Add(Ban{Key: "2.2.2.2", Expires: now.Add(time.Hour)})
+
+	assert.True(t, bl.Banned("1.1.1.1", now))
+	assert.Len(t, bl.List(now), 2)
+	assert.Equal(t, "1.1.1.1", bl.List(now)[0].Key)
+
+	assert.False(t, bl.Banned("1.1.1.1", now.Add(2*time.Minute)))
+	assert.Len(t, bl.List(now.Add(2*time.Minute)), 1)
+
+	assert.True(t, bl.Remove("2.2.2.2"))
+	assert.False(t, bl.Remove("2.2.2.2"))
+}
+
+func TestRecordViolation(t *testing.T) {
+	m := newBanTestMiddleware(BanConfig{Threshold: 2, HoneypotRules: []string{"trap"}})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	m.recordViolation(r, "sqli")
+	assert.False(t, m.isBanned(r))
+	m.recordViolation(r, "sqli")
+	assert.True(t, m.isBanned(r))
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.RemoteAddr = "10.0.0.2:1234"
+	m.recordViolation(r2, "trap")
+	assert.True(t, m.isBanned(r2), "honeypot rules ban on the first match")
+
+	r3 := httptest.NewRequest("GET", "/", nil)
+	r3.RemoteAddr = "10.0.0.3:1234"
+	m.recordViolation(r3, banRuleID)
+	m.recordViolation(r3, banRuleID)
+	assert.False(t, m.isBanned(r3), "blocks caused by bans don't count")
+}
+
+func TestIsBanned_Tenants(t *testing.T) {
+	m := newBanTestMiddleware(BanConfig{Threshold: 1})
+	m.TenantByHost = true
+	m.tenants = NewTenantRegistry()
+
+	a := httptest.NewRequest("GET", "http://a.example.com/", nil)
+	a.RemoteAddr = "10.0.0.1:1234"
+	b := httptest.NewRequest("GET", "http://b.example.com/", nil)
+	b.RemoteAddr = "10.0.0.1:1234"
+
+	m.recordViolation(a, "sqli")
+	assert.True(t, m.isBanned(a))
+	assert.False(t, m.isBanned(b), "auto-bans are scoped to the tenant")
+
+	m.banClient("10.0.0.1", "global", time.Minute)
+	assert.True(t, m.isBanned(b), "bans without a host apply to every tenant")
+}
+
+func TestApplyPeerBan(t *testing.T) {
+	m := newBanTestMiddleware(BanConfig{})
+	now := time.Now()
+
+	m.applyPeerBan(BanMessage{Action: banActionBan, Ban: Ban{Key: "1.1.1.1", Expires: now.Add(time.Hour), Origin: m.banList.origin}})
+	assert.False(t, m.banList.Banned("1.1.1.1", now), "own messages are ignored")
+
+	m.applyPeerBan(BanMessage{Action: banActionBan, Ban: Ban{Key: "1.1.1.1", Expires: now.Add(-time.Minute), Origin: "peer"}})
+	assert.False(t, m.banList.Banned("1.1.1.1", now), "expired bans are ignored")
+
+	m.applyPeerBan(BanMessage{Action: banActionBan, Ban: Ban{Key: "1.1.1.1", Expires: now.Add(time.Hour), Origin: "peer"}})
+	assert.True(t, m.banList.Banned("1.1.1.1", now))
+
+	m.applyPeerBan(BanMessage{Action: banActionUnban, Ban: Ban{Key: "1.1.1.1", Origin: "peer"}})
+	assert.False(t, m.banList.Banned("1.1.1.1", now))
+}
+
+func TestHandleBansRequests(t *testing.T) {
+	m := newBanTestMiddleware(BanConfig{})
+
+	w := httptest.NewRecorder()
+	body := `{"ip": "10.0.0.9", "host": "API.example.com:443", "duration": "30m", "reason": "scanner"}`
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/bans", strings.NewReader(body))))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var ban Ban
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ban))
+	assert.Equal(t, "api.example.com|10.0.0.9", ban.Key)
+	assert.Equal(t, "scanner", ban.Reason)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), ban.Expires, time.Minute)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/bans", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/bans?ip=10.0.0.9&host=api.example.com", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/bans?ip=10.0.0.9&host=api.example.com", nil)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	for _, body := range []string{`{}`, `not json`, `{"ip": "1.1.1.1", "duration": "forever"}`} {
+		w = httptest.NewRecorder()
+		require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/bans", strings.NewReader(body))))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestHandleBansRequest_Disabled(t *testing.T) {
+	m := newAPITestMiddleware()
+	w := httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/bans", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestHandlePhase_BannedClient(t *testing.T) {
+	m := newBanTestMiddleware(BanConfig{})
+	m.ipBlacklist = iptrie.NewTrie()
+	m.dnsBlacklist = map[string]struct{}{}
+	m.banClient("10.0.0.1", "test", time.Minute)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, r, 1, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,358 @@
+package caddywaf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	defaultBenchmarkRemoteAddr = "192.0.2.1:1234"
+	maxBenchmarkLineSize       = 16 << 20
+)
+
+func init() {
+	fs := flag.NewFlagSet("waf-bench", flag.ExitOnError)
+	fs.String("config", "Caddyfile", "Configuration file containing the waf handler")
+	fs.String("adapter", "", "Name of config adapter to apply")
+	fs.String("corpus", "", "NDJSON file of captured requests to replay")
+	fs.Int("iterations", 1, "Number of times the corpus is replayed")
+	fs.Int("concurrency", 1, "Number of requests evaluated in parallel")
+	fs.Int("top", 20, "Number of most expensive rules to report")
+	fs.Bool("json", false, "Print the report as JSON")
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "waf-bench",
+		Usage: "--corpus <file> [--config <path>] [--adapter <name>] [--iterations <n>] [--concurrency <n>] [--top <n>] [--json]",
+		Short: "Replays captured requests through the WAF and reports its cost",
+		Long: `
+Loads the first waf handler of the configuration and replays a corpus of
+captured requests through it, without starting a server. Reports throughput,
+per-phase latency and the evaluation cost of each rule.
+
+The corpus is a file with one JSON request per line:
+
+	{"method": "GET", "url": "https://example.com/search?q=1", "headers": {"User-Agent": ["curl/8.0"]}, "body": "", "remote_addr": "203.0.113.7:4312"}
+
+Notifiers, email alerts, SIEM output, the event store, the cluster, ban
+propagation and GeoIP downloads are disabled while benchmarking.`,
+		Flags: fs,
+		Func:  cmdWAFBench,
+	})
+}
+
+// BenchmarkRequest is a captured request of a benchmark corpus.
+type BenchmarkRequest struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	RemoteAddr string              `json:"remote_addr,omitempty"` // Default 192.0.2.1:1234
+}
+
+// BenchmarkOptions controls how a corpus is replayed.
+type BenchmarkOptions struct {
+	Iterations  int // Default 1
+	Concurrency int // Default 1
+	TopRules    int // Rules in the report, 0 for all
+}
+
+// BenchmarkReport is the result of a benchmark run.
+type BenchmarkReport struct {
+	Requests       int64                     `json:"requests"`
+	Blocked        int64                     `json:"blocked"`
+	DurationMs     float64                   `json:"duration_ms"`
+	RequestsPerSec float64                   `json:"requests_per_sec"`
+	Latency        LatencySummary            `json:"latency"` // Whole request inspection
+	Phases         map[string]LatencySummary `json:"phases"`
+	Rules          []RuleProfile             `json:"rules"` // Most expensive first
+}
+
+// LoadBenchmarkCorpus reads a corpus with one JSON request per line. Empty lines are skipped.
+func LoadBenchmarkCorpus(r io.Reader) ([]BenchmarkRequest, error) {
+	var corpus []BenchmarkRequest
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBenchmarkLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var req BenchmarkRequest
+		if err := json.Unmarshal([]byte(text), &req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if req.Method == "" {
+			req.Method = http.MethodGet
+		}
+		if req.RemoteAddr == "" {
+			req.RemoteAddr = defaultBenchmarkRemoteAddr
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("line %d: url must be absolute: %q", line, req.URL)
+		}
+		corpus = append(corpus, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("corpus contains no requests")
+	}
+	return corpus, nil
+}
+
+// newHTTPRequest builds a fresh request, since bodies are consumed during inspection.
+func (br BenchmarkRequest) newHTTPRequest() *http.Request {
+	r := httptest.NewRequest(br.Method, br.URL, strings.NewReader(br.Body))
+	for name, values := range br.Headers {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+	}
+	r.RemoteAddr = br.RemoteAddr
+	return r
+}
+
+// RunBenchmark replays the corpus through the middleware and reports its cost.
+// Latency tracking is enabled for the run, resetting any previous measurements.
+func (m *Middleware) RunBenchmark(ctx context.Context, corpus []BenchmarkRequest, opts BenchmarkOptions) (*BenchmarkReport, error) {
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("corpus contains no requests")
+	}
+	if opts.Iterations <= 0 {
+		opts.Iterations = 1
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if m.latencyTracker == nil {
+		m.latencyTracker = NewLatencyTracker()
+	} else {
+		m.latencyTracker.Reset()
+	}
+
+	var (
+		requests, blocked atomic.Int64
+		latency           LatencyHistogram
+		next              atomic.Int64
+		wg                sync.WaitGroup
+		firstErr          error
+		errOnce           sync.Once
+	)
+	total := int64(len(corpus) * opts.Iterations)
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := next.Add(1) - 1
+				if n >= total {
+					return
+				}
+				r := corpus[n%int64(len(corpus))].newHTTPRequest().WithContext(ctx)
+				passed := false
+				handler := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+					passed = true
+					w.WriteHeader(http.StatusOK)
+					return nil
+				})
+				reqStart := time.Now()
+				err := m.ServeHTTP(httptest.NewRecorder(), r, handler)
+				latency.Observe(time.Since(reqStart))
+				if err != nil {
+					errOnce.Do(func() { firstErr = fmt.Errorf("request %d: %w", n, err) })
+					return
+				}
+				requests.Add(1)
+				if !passed {
+					blocked.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &BenchmarkReport{
+		Requests:   requests.Load(),
+		Blocked:    blocked.Load(),
+		DurationMs: float64(elapsed) / float64(time.Millisecond),
+		Latency:    latency.Summary(),
+		Phases:     m.latencyTracker.PhaseSummaries(),
+		Rules:      m.latencyTracker.Profile("total", opts.TopRules),
+	}
+	if elapsed > 0 {
+		report.RequestsPerSec = float64(report.Requests) / elapsed.Seconds()
+	}
+	return report, nil
+}
+
+// newBenchmarkMiddleware provisions a WAF handler from its JSON config for offline use.
+// Features that send data elsewhere are disabled.
+func newBenchmarkMiddleware(ctx context.Context, raw json.RawMessage) (*Middleware, error) {
+	m := &Middleware{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("invalid waf handler config: %w", err)
+	}
+	m.LogFilePath = os.DevNull
+	m.LogSeverity = "error"
+	m.Notifiers = nil
+	m.EmailAlert = nil
+	m.SIEMOutput = nil
+	m.EventStore = nil
+	m.Cluster = nil
+	m.GeoIPUpdate = nil
+	if m.Bans != nil {
+		m.Bans.Propagation = nil
+	}
+	if err := m.Provision(caddy.Context{Context: ctx}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// findWAFHandler returns the config of the first waf handler in an adapted Caddy config.
+func findWAFHandler(config []byte) (json.RawMessage, error) {
+	var root interface{}
+	if err := json.Unmarshal(config, &root); err != nil {
+		return nil, err
+	}
+	var found interface{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		if found != nil {
+			return
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if v["handler"] == "waf" {
+				found = v
+				return
+			}
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				walk(v[key])
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(root)
+	if found == nil {
+		return nil, fmt.Errorf("no waf handler found in config")
+	}
+	return json.Marshal(found)
+}
+
+// cmdWAFBench implements the waf-bench command.
+func cmdWAFBench(fl caddycmd.Flags) (int, error) {
+	corpusPath := fl.String("corpus")
+	if corpusPath == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--corpus is required")
+	}
+	config, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	raw, err := findWAFHandler(config)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	f, err := os.Open(corpusPath)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	corpus, err := LoadBenchmarkCorpus(f)
+	f.Close()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("failed to load corpus %s: %w", corpusPath, err)
+	}
+
+	ctx := context.Background()
+	m, err := newBenchmarkMiddleware(ctx, raw)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("failed to provision waf handler: %w", err)
+	}
+	defer func() { _ = m.Shutdown(ctx) }()
+
+	report, err := m.RunBenchmark(ctx, corpus, BenchmarkOptions{
+		Iterations:  fl.Int("iterations"),
+		Concurrency: fl.Int("concurrency"),
+		TopRules:    fl.Int("top"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return caddy.ExitCodeSuccess, enc.Encode(report)
+	}
+	return caddy.ExitCodeSuccess, report.WriteText(os.Stdout)
+}
+
+// WriteText prints the report as aligned tables.
+func (r *BenchmarkReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "requests\t%d\t\n", r.Requests)
+	fmt.Fprintf(tw, "blocked\t%d\t\n", r.Blocked)
+	fmt.Fprintf(tw, "duration\t%.1f ms\t\n", r.DurationMs)
+	fmt.Fprintf(tw, "throughput\t%.0f req/s\t\n", r.RequestsPerSec)
+	fmt.Fprintf(tw, "latency avg/p50/p95/p99\t%.1f / %.1f / %.1f / %.1f us\t\n", r.Latency.AvgUs, r.Latency.P50Us, r.Latency.P95Us, r.Latency.P99Us)
+
+	fmt.Fprintln(tw, "\t\t")
+	fmt.Fprintln(tw, "phase\tcount\tavg us\tp95 us\tp99 us\ttotal ms\t")
+	phases := make([]string, 0, len(r.Phases))
+	for phase := range r.Phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		s := r.Phases[phase]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t\n", phase, s.Count, s.AvgUs, s.P95Us, s.P99Us, s.TotalMs)
+	}
+
+	fmt.Fprintln(tw, "\t\t")
+	fmt.Fprintln(tw, "rule\tevaluations\tmatches\tavg us\tp99 us\ttotal ms\t")
+	for _, p := range r.Rules {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%.1f\t\n", p.RuleID, p.Evaluations, p.Matches, p.AvgUs, p.P99Us, p.TotalMs)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,95 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBenchmarkCorpus(t *testing.T) {
+	corpus, err := LoadBenchmarkCorpus(strings.NewReader(`
+{"url": "http://example.com/"}
+{"method": "POST", "url": "http://example.com/login", "headers": {"Content-Type": ["application/x-www-form-urlencoded"]}, "body": "user=a", "remote_addr": "203.0.113.7:4312"}
+`))
+	require.NoError(t, err)
+	require.Len(t, corpus, 2)
+	assert.Equal(t, "GET", corpus[0].Method)
+	assert.Equal(t, defaultBenchmarkRemoteAddr, corpus[0].RemoteAddr)
+
+	r := corpus[1].newHTTPRequest()
+	assert.Equal(t, "POST", r.Method)
+	assert.Equal(t, "example.com", r.Host)
+	assert.Equal(t, "203.0.113.7:4312", r.RemoteAddr)
+	assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+
+	for _, input := range []string{"", "not json", `{"url": "/relative"}`} {
+		_, err := LoadBenchmarkCorpus(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+	_, err = LoadBenchmarkCorpus(strings.NewReader("{\"url\": \"http://a/\"}\n{"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestFindWAFHandler(t *testing.T) {
+	config := []byte(`{"apps": {"http": {"servers": {"srv0": {"routes": [{"handle": [
+		{"handler": "subroute", "routes": [{"handle": [{"handler": "waf", "anomaly_threshold": 7}]}]}
+	]}]}}}}}`)
+	raw, err := findWAFHandler(config)
+	require.NoError(t, err)
+	var m Middleware
+	require.NoError(t, json.Unmarshal(raw, &m))
+	assert.Equal(t, 7, m.AnomalyThreshold)
+
+	_, err = findWAFHandler([]byte(`{"apps": {}}`))
+	assert.Error(t, err)
+}
+
+func TestRunBenchmark(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`[
+		{"id": "sqli", "phase": 2, "pattern": "(?i)union.+select", "targets": ["URI"], "severity": "CRITICAL", "score": 10, "mode": "block"},
+		{"id": "ua", "phase": 1, "pattern": "sqlmap", "targets": ["HEADERS:User-Agent"], "severity": "LOW", "score": 1, "mode": "log"}
+	]`), 0o644))
+	raw, _ := json.Marshal(map[string]interface{}{
+		"handler":           "waf",
+		"rule_files":        []string{rulesPath},
+		"anomaly_threshold": 5,
+		"notifiers":         []NotifierConfig{{Type: "slack", WebhookURL: "http://127.0.0.1:1/hook"}},
+	})
+
+	m, err := newBenchmarkMiddleware(context.Background(), raw)
+	require.NoError(t, err)
+	defer func() { _ = m.Shutdown(context.Background()) }()
+	assert.Nil(t, m.notificationManager, "notifiers are disabled while benchmarking")
+
+	corpus, err := LoadBenchmarkCorpus(strings.NewReader(`
+{"url": "http://example.com/"}
+{"url": "http://example.com/?id=1%20UNION%20SELECT%20password"}
+`))
+	require.NoError(t, err)
+
+	report, err := m.RunBenchmark(context.Background(), corpus, BenchmarkOptions{Iterations: 5, Concurrency: 4})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), report.Requests)
+	assert.Equal(t, int64(5), report.Blocked)
+	assert.Equal(t, int64(10), report.Latency.Count)
+	assert.Equal(t, int64(10), report.Phases["1"].Count)
+	require.NotEmpty(t, report.Rules)
+	var ruleIDs []string
+	for _, p := range report.Rules {
+		ruleIDs = append(ruleIDs, p.RuleID)
+	}
+	assert.Contains(t, ruleIDs, "sqli")
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf))
+	assert.Contains(t, buf.String(), "throughput")
+	assert.Contains(t, buf.String(), "sqli")
+}
@@ -3,18 +3,24 @@ package caddywaf
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/oschwald/maxminddb-golang"
+	"github.com/phemmer/go-iptrie"
 	"go.uber.org/zap"
 )
 
 // BlacklistLoader handles loading IP and DNS blacklists from files.
 type BlacklistLoader struct {
 	logger *zap.Logger
+
+	ipv4Prefix int // Prefix length blocked by single IPv4 addresses, zero for the default
+	ipv6Prefix int // Prefix length blocked by single IPv6 addresses, zero for the default
 }
 
 // NewBlacklistLoader creates a new BlacklistLoader with the provided logger.
@@ -25,6 +31,16 @@ func NewBlacklistLoader(logger *zap.Logger) *BlacklistLoader {
 	return &BlacklistLoader{logger: logger}
 }
 
+// WithIPPrefixes sets the prefix lengths blocked by single addresses in IP blacklists,
+// where zero keeps the default of /32 for IPv4 and /64 for IPv6.
+func (bl *BlacklistLoader) WithIPPrefixes(ipv4, ipv6 int) error {
+	if err := validateIPBlacklistPrefixes(ipv4, ipv6); err != nil {
+		return err
+	}
+	bl.ipv4Prefix, bl.ipv6Prefix = ipv4, ipv6
+	return nil
+}
+
 // LoadDNSBlacklistFromFile loads DNS entries from a file into the provided map.
 func (bl *BlacklistLoader) LoadDNSBlacklistFromFile(path string, dnsBlacklist map[string]struct{}) error {
 	bl.logger.Debug("Loading DNS blacklist", zap.String("path", path))
@@ -36,10 +52,26 @@ func (bl *BlacklistLoader) LoadDNSBlacklistFromFile(path string, dnsBlacklist ma
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	validEntries := 0
-	totalLines := 0
+	validEntries, totalLines, err := readDNSBlacklistEntries(file, func(domain string) {
+		dnsBlacklist[domain] = struct{}{}
+	})
+	if err != nil {
+		bl.logger.Error("Error reading DNS blacklist file", zap.String("path", path), zap.Error(err))
+		return fmt.Errorf("error reading DNS blacklist file: %w", err)
+	}
 
+	bl.logger.Info("DNS blacklist loaded",
+		zap.String("path", path),
+		zap.Int("valid_entries", validEntries),
+		zap.Int("total_lines", totalLines),
+	)
+	return nil
+}
+
+// readDNSBlacklistEntries calls add with each normalized domain of a DNS blacklist,
+// skipping empty lines and comments.
+func readDNSBlacklistEntries(r io.Reader, add func(domain string)) (validEntries, totalLines int, err error) {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		totalLines++
 		line := scanner.Text()
@@ -47,39 +79,71 @@ func (bl *BlacklistLoader) LoadDNSBlacklistFromFile(path string, dnsBlacklist ma
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue // Skip empty lines and comments
 		}
-		dnsBlacklist[line] = struct{}{}
+		add(line)
 		validEntries++
 	}
+	return validEntries, totalLines, scanner.Err()
+}
 
-	if err := scanner.Err(); err != nil {
-		bl.logger.Error("Error reading DNS blacklist file", zap.String("path", path), zap.Error(err))
-		return fmt.Errorf("error reading DNS blacklist file: %w", err)
-	}
-
-	bl.logger.Info("DNS blacklist loaded",
-		zap.String("path", path),
-		zap.Int("valid_entries", validEntries),
-		zap.Int("total_lines", totalLines),
-	)
-	return nil
+// ipBlacklistVerdict is a cached IP blacklist lookup, valid only for the blacklist it was made
+// against and until the entry blocking the IP expires.
+type ipBlacklistVerdict struct {
+	blacklist   *iptrie.Trie
+	blacklisted bool
+	annotation  *ipBlacklistAnnotation
 }
 
 func (m *Middleware) isIPBlacklisted(addr string) bool {
+	blacklisted, _ := m.ipBlacklistHit(addr)
+	return blacklisted
+}
+
+// ipBlacklistHit reports whether an address is blacklisted, with the reason given to the
+// blacklist entry, if any, and counts the hits.
+func (m *Middleware) ipBlacklistHit(addr string) (bool, string) {
 	ip := extractIP(addr)
 
 	if m.ipBlacklist == nil {
 		m.logger.Error("blacklist", zap.String("IP blacklist", "is nil"))
 	}
 
-	if m.ipBlacklist.Contains(netip.MustParseAddr(ip)) {
+	if blacklisted, annotation := m.ipBlacklistContains(ip); blacklisted {
 		m.muIPBlacklistMetrics.Lock()                            // Acquire lock before accessing shared counter
 		m.IPBlacklistBlockCount++                                // Increment the counter
 		m.muIPBlacklistMetrics.Unlock()                          // Release lock after accessing counter
 		m.logger.Debug("IP blacklist hit", zap.String("ip", ip)) // Keep existing debug log
-		return true                                              // Indicate that the IP is blacklisted
+		if annotation != nil {
+			return true, annotation.Reason
+		}
+		return true, "" // Indicate that the IP is blacklisted
 	}
 
-	return false // Indicate that the IP is NOT blacklisted
+	return false, "" // Indicate that the IP is NOT blacklisted
+}
+
+// ipBlacklistContains looks an IP up in the blacklist, through the lookup cache when enabled,
+// returning the annotation of the entry blocking it. Reloading the blacklist replaces the trie,
+// which invalidates the verdicts made against the old one.
+func (m *Middleware) ipBlacklistContains(ip string) (bool, *ipBlacklistAnnotation) {
+	blacklist := m.ipBlacklist
+	now := time.Now()
+	if m.ipBlacklistCache != nil {
+		if verdict, ok := m.ipBlacklistCache.Get(ip); ok && verdict.blacklist == blacklist &&
+			(verdict.annotation == nil || !verdict.annotation.expired(now)) {
+			return verdict.blacklisted, verdict.annotation
+		}
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Not an IP, such as a forged X-Forwarded-For value: not blacklisted, nor cached
+		m.logger.Debug("Invalid IP for the blacklist lookup", zap.String("ip", ip), zap.Error(err))
+		return false, nil
+	}
+	blacklisted, annotation := ipBlacklistLookup(blacklist, addr, now)
+	if m.ipBlacklistCache != nil {
+		m.ipBlacklistCache.Set(ip, ipBlacklistVerdict{blacklist: blacklist, blacklisted: blacklisted, annotation: annotation})
+	}
+	return blacklisted, annotation
 }
 
 // isCountryInList checks if the IP's country is in the provided list using the GeoIP database.
@@ -101,7 +165,19 @@ func (m *Middleware) isDNSBlacklisted(host string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if _, exists := m.dnsBlacklist[normalizedHost]; exists {
+	if m.dnsBlacklistIndex != nil {
+		blacklisted, err := m.dnsBlacklistIndex.Contains(normalizedHost)
+		if err != nil {
+			m.logger.Error("DNS blacklist index lookup failed", zap.String("host", host), zap.Error(err))
+		}
+		if blacklisted {
+			m.muDNSBlacklistMetrics.Lock()
+			m.DNSBlacklistBlockCount++
+			m.muDNSBlacklistMetrics.Unlock()
+			m.logger.Debug("DNS blacklist hit", zap.String("host", host), zap.String("blacklisted_domain", normalizedHost))
+			return true
+		}
+	} else if _, exists := m.dnsBlacklist[normalizedHost]; exists {
 		m.muDNSBlacklistMetrics.Lock() // Acquire lock before accessing shared counter
 		m.DNSBlacklistBlockCount++
 		m.muDNSBlacklistMetrics.Unlock() // Release lock after accessing counter
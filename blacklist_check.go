@@ -0,0 +1,119 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+)
+
+// Sources listing an IP, as reported by GET /blacklist/check
+const (
+	BlacklistSourceFile = "file" // ip_blacklist_file
+	BlacklistSourceTor  = "tor"  // Tor exit node, from the tor directive or an ip_type feed
+	BlacklistSourceFeed = "feed" // ip_type feed
+	BlacklistSourceBan  = "ban"  // Dynamic ban
+)
+
+// BlacklistMatch is a source listing an IP.
+type BlacklistMatch struct {
+	Source     string     `json:"source"`
+	Blocks     bool       `json:"blocks"`           // Whether the source blocks the IP itself, feeds only classify it for rules
+	Prefix     string     `json:"prefix,omitempty"` // Most specific prefix listing the IP
+	Type       string     `json:"type,omitempty"`   // IP type of the feed
+	Key        string     `json:"key,omitempty"`    // Key of the ban
+	Reason     string     `json:"reason,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"` // Time left before the entry expires
+}
+
+// BlacklistCheck explains whether an IP is blocked, and by which sources.
+type BlacklistCheck struct {
+	IP      string           `json:"ip"`
+	Blocked bool             `json:"blocked"`
+	Matches []BlacklistMatch `json:"matches"`
+}
+
+// trieMatch returns the most specific prefix of a trie holding an address.
+func trieMatch(trie *iptrie.Trie, addr netip.Addr) netip.Prefix {
+	networks := trie.ContainingNetworks(addr)
+	if len(networks) == 0 {
+		return netip.Prefix{}
+	}
+	prefix := networks[len(networks)-1]
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
+
+// expiring sets the expiry and remaining time of a match.
+func (bm *BlacklistMatch) expiring(expires, now time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	bm.Expires = &expires
+	bm.TTLSeconds = int64(expires.Sub(now).Seconds())
+}
+
+// checkBlacklists explains whether an IP is blocked by the IP blacklist, a dynamic ban,
+// globally or for the given host, and whether the ip_type feeds list it. Lookups don't
+// count as blacklist hits.
+func (m *Middleware) checkBlacklists(addr netip.Addr, host string, now time.Time) BlacklistCheck {
+	check := BlacklistCheck{IP: addr.String(), Matches: []BlacklistMatch{}}
+	ip := addr.String()
+
+	if m.ipBlacklist != nil {
+		if blacklisted, annotation := ipBlacklistLookup(m.ipBlacklist, addr, now); blacklisted {
+			match := BlacklistMatch{Source: BlacklistSourceFile, Blocks: true, Prefix: trieMatch(m.ipBlacklist, addr).String()}
+			if m.Tor.isExitNode(ip) {
+				match.Source = BlacklistSourceTor
+			}
+			if annotation != nil {
+				match.Reason = annotation.Reason
+				match.expiring(annotation.Expires, now)
+			}
+			check.Matches = append(check.Matches, match)
+		}
+	}
+
+	if m.banList != nil {
+		keys := []string{ip}
+		if host != "" {
+			keys = append(keys, banKey(ip, host))
+		}
+		for _, key := range keys {
+			if ban, ok := m.banList.Get(key, now); ok {
+				match := BlacklistMatch{Source: BlacklistSourceBan, Blocks: true, Key: ban.Key, Reason: ban.Reason}
+				match.expiring(ban.Expires, now)
+				check.Matches = append(check.Matches, match)
+			}
+		}
+	}
+
+	if m.IPType != nil {
+		if ipType, prefix, ok := m.IPType.listing(addr, now); ok {
+			source := BlacklistSourceFeed
+			if ipType == IPTypeTor {
+				source = BlacklistSourceTor
+			}
+			check.Matches = append(check.Matches, BlacklistMatch{Source: source, Prefix: prefix.String(), Type: ipType})
+		}
+	}
+
+	for _, match := range check.Matches {
+		check.Blocked = check.Blocked || match.Blocks
+	}
+	return check
+}
+
+// handleBlacklistCheckRequest explains whether the IP of the ip parameter is blocked, and
+// by which sources, with the bans scoped to the optional host parameter.
+func (m *Middleware) handleBlacklistCheckRequest(w http.ResponseWriter, r *http.Request) error {
+	addr, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+	if err != nil || addr.Zone() != "" {
+		return writeJSONError(w, http.StatusBadRequest, "ip must be an IPv4 or IPv6 address")
+	}
+	return writeJSON(w, http.StatusOK, m.checkBlacklists(addr.Unmap(), r.URL.Query().Get("host"), time.Now()))
+}
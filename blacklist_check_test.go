@@ -0,0 +1,103 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCheckBlacklists(t *testing.T) {
+	bl := NewBlacklistLoader(zap.NewNop())
+	blacklist, _, err := bl.readIPBlacklist(strings.NewReader(strings.Join([]string{
+		"198.51.100.0/24",
+		`203.0.113.7 reason="credential stuffing" expires=2999-01-01`,
+		"192.0.2.66",
+	}, "\n")), "test")
+	require.NoError(t, err)
+	vpn, _, err := bl.readIPBlacklist(strings.NewReader("100.64.0.0/10\n"), "vpn feed")
+	require.NoError(t, err)
+
+	m := newAPITestMiddleware()
+	m.ipBlacklist = blacklist
+	m.banList = NewBanList(BanConfig{})
+	m.IPType = &IPTypeConfig{tries: map[string]*iptrie.Trie{IPTypeVPN: vpn}}
+	m.Tor.exitNodes.Store(map[string]struct{}{"192.0.2.66": {}})
+	now := time.Now()
+
+	check := m.checkBlacklists(netip.MustParseAddr("198.51.100.9"), "", now)
+	assert.True(t, check.Blocked)
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, BlacklistMatch{Source: BlacklistSourceFile, Blocks: true, Prefix: "198.51.100.0/24"}, check.Matches[0])
+
+	check = m.checkBlacklists(netip.MustParseAddr("203.0.113.7"), "", now)
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, "203.0.113.7/32", check.Matches[0].Prefix)
+	assert.Equal(t, "credential stuffing", check.Matches[0].Reason)
+	require.NotNil(t, check.Matches[0].Expires)
+	assert.Positive(t, check.Matches[0].TTLSeconds)
+
+	check = m.checkBlacklists(netip.MustParseAddr("192.0.2.66"), "", now)
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, BlacklistSourceTor, check.Matches[0].Source, "exit nodes of the Tor list are reported as Tor")
+
+	check = m.checkBlacklists(netip.MustParseAddr("100.64.1.1"), "", now)
+	assert.False(t, check.Blocked, "feeds only classify IPs")
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, BlacklistMatch{Source: BlacklistSourceFeed, Prefix: "100.64.0.0/10", Type: IPTypeVPN}, check.Matches[0])
+
+	check = m.checkBlacklists(netip.MustParseAddr("192.0.2.1"), "", now)
+	assert.False(t, check.Blocked)
+	assert.Empty(t, check.Matches)
+}
+
+func TestCheckBlacklists_Bans(t *testing.T) {
+	m := newAPITestMiddleware()
+	m.banList = NewBanList(BanConfig{})
+	now := time.Now()
+	m.banList.Add(Ban{Key: "192.0.2.1", Reason: "20 blocks within 1m0s", Created: now, Expires: now.Add(time.Hour)})
+	m.banList.Add(Ban{Key: banKey("192.0.2.2", "shop.example.com"), Reason: "honeypot", Created: now, Expires: now.Add(time.Minute)})
+
+	check := m.checkBlacklists(netip.MustParseAddr("192.0.2.1"), "", now)
+	assert.True(t, check.Blocked)
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, BlacklistSourceBan, check.Matches[0].Source)
+	assert.Equal(t, "20 blocks within 1m0s", check.Matches[0].Reason)
+	assert.Equal(t, int64(3600), check.Matches[0].TTLSeconds)
+
+	assert.Empty(t, m.checkBlacklists(netip.MustParseAddr("192.0.2.2"), "", now).Matches, "tenant bans need the host")
+	check = m.checkBlacklists(netip.MustParseAddr("192.0.2.2"), "shop.example.com", now)
+	require.Len(t, check.Matches, 1)
+	assert.Equal(t, "shop.example.com|192.0.2.2", check.Matches[0].Key)
+
+	assert.Empty(t, m.checkBlacklists(netip.MustParseAddr("192.0.2.1"), "", now.Add(2*time.Hour)).Matches, "expired bans don't match")
+}
+
+func TestHandleBlacklistCheckRequest(t *testing.T) {
+	blacklist, _, err := NewBlacklistLoader(zap.NewNop()).readIPBlacklist(strings.NewReader("198.51.100.0/24\n"), "test")
+	require.NoError(t, err)
+	m := newAPITestMiddleware()
+	m.ipBlacklist = blacklist
+
+	w := httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/blacklist/check?ip=::ffff:198.51.100.9", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var check BlacklistCheck
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &check))
+	assert.Equal(t, "198.51.100.9", check.IP)
+	assert.True(t, check.Blocked)
+	assert.Len(t, check.Matches, 1)
+	assert.Equal(t, int64(0), m.IPBlacklistBlockCount, "checks are not counted as hits")
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/blacklist/check?ip=nope", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
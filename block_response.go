@@ -0,0 +1,219 @@
+package caddywaf
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// BlockResponseData is the data of a templated custom_response body, such as
+// {{.TransactionID}} to show a support reference code on the block page.
+type BlockResponseData struct {
+	RuleID        string    // Rule or check that blocked the request
+	TransactionID string    // Log ID of the request
+	ClientIP      string    // Client IP address
+	Reason        string    // Block reason
+	StatusCode    int       // Status code of the response
+	Method        string    // Request method
+	Host          string    // Request host
+	Path          string    // Request path
+	Timestamp     time.Time // Time of the block
+}
+
+// responseTemplate is a parsed text/template or html/template.
+type responseTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// parseResponseTemplate parses a body as a template when it contains actions. HTML bodies
+// use html/template, so the request values are escaped.
+func parseResponseTemplate(name, body, contentType string) (responseTemplate, error) {
+	if !strings.Contains(body, "{{") {
+		return nil, nil
+	}
+	if strings.Contains(strings.ToLower(contentType), "html") {
+		return htmltemplate.New(name).Option("missingkey=error").Parse(body)
+	}
+	return texttemplate.New(name).Option("missingkey=error").Parse(body)
+}
+
+// compile parses the body as a template when it contains actions.
+func (c *CustomBlockResponse) compile() error {
+	tmpl, err := parseResponseTemplate(fmt.Sprintf("custom_response_%d", c.StatusCode), c.Body, c.Headers["Content-Type"])
+	if err != nil {
+		return fmt.Errorf("invalid custom_response %d body template: %w", c.StatusCode, err)
+	}
+	c.template = tmpl
+	return nil
+}
+
+// responseFileContentType returns the content type of a response file given without one,
+// after its extension, HTML by default.
+func responseFileContentType(path string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+	return "text/html; charset=utf-8"
+}
+
+// load reads the body of a response from its file, if any, and parses its template.
+func (c *CustomBlockResponse) load() error {
+	if c.File != "" {
+		content, err := os.ReadFile(c.File)
+		if err != nil {
+			return fmt.Errorf("could not read custom response file '%s': %w", c.File, err)
+		}
+		c.Body = string(content)
+	}
+	if err := c.compile(); err != nil {
+		return err
+	}
+	return c.loadLanguages()
+}
+
+// loadCustomResponses reads the bodies of the custom responses from their files and
+// parses their templates.
+func (m *Middleware) loadCustomResponses() error {
+	m.customResponseMu.Lock()
+	defer m.customResponseMu.Unlock()
+	for statusCode, resp := range m.CustomResponses {
+		if err := resp.load(); err != nil {
+			return err
+		}
+		m.CustomResponses[statusCode] = resp
+	}
+	return nil
+}
+
+// customResponse returns the custom response for a status code.
+func (m *Middleware) customResponse(statusCode int) (CustomBlockResponse, bool) {
+	m.customResponseMu.RLock()
+	defer m.customResponseMu.RUnlock()
+	resp, ok := m.CustomResponses[statusCode]
+	return resp, ok
+}
+
+// reloadCustomResponseFile reloads the responses read from a file. On error the previous
+// bodies are kept.
+func (m *Middleware) reloadCustomResponseFile(path string) error {
+	m.customResponseMu.Lock()
+	defer m.customResponseMu.Unlock()
+	for statusCode, resp := range m.CustomResponses {
+		if !slices.ContainsFunc(resp.files(), func(file string) bool { return filepath.Clean(file) == path }) {
+			continue
+		}
+		if err := resp.load(); err != nil {
+			return err
+		}
+		m.CustomResponses[statusCode] = resp
+		m.logger.Info("Custom response reloaded", zap.Int("status_code", statusCode), zap.String("file", path))
+	}
+	return nil
+}
+
+// customResponseReloadDebounce groups the writes of an editor saving a response file.
+const customResponseReloadDebounce = 500 * time.Millisecond
+
+// watchCustomResponses reloads the custom responses when their files are written or
+// replaced. The directories are watched, since editors and deployments often rename a new
+// file over the old one.
+func (m *Middleware) watchCustomResponses() {
+	files := make(map[string]struct{})
+	for _, resp := range m.CustomResponses {
+		for _, file := range resp.files() {
+			files[filepath.Clean(file)] = struct{}{}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		m.logger.Error("Failed to start custom response watcher", zap.Error(err))
+		return
+	}
+	for path := range files {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			m.logger.Error("Failed to watch custom response file", zap.String("file", path), zap.Error(err))
+			m.recordWatch(path, false, false, err)
+			continue
+		}
+		m.recordWatch(path, true, false, nil)
+	}
+	m.customResponseWatchStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		defer watcher.Close()
+		pending := make(map[string]struct{})
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event := <-watcher.Events:
+				path := filepath.Clean(event.Name)
+				if _, ok := files[path]; ok && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					pending[path] = struct{}{}
+					debounce = time.After(customResponseReloadDebounce)
+				}
+			case <-debounce:
+				debounce = nil
+				for path := range pending {
+					err := m.reloadCustomResponseFile(path)
+					if err != nil {
+						m.logger.Error("Failed to reload custom response", zap.String("file", path), zap.Error(err))
+					}
+					m.recordWatch(path, true, true, err)
+				}
+				clear(pending)
+			case err := <-watcher.Errors:
+				m.logger.Error("Custom response watcher error", zap.Error(err))
+			case <-stop:
+				return
+			}
+		}
+	}(m.customResponseWatchStop)
+}
+
+// blockResponseData returns the template data of a blocked request.
+func blockResponseData(r *http.Request, state *WAFState) BlockResponseData {
+	return BlockResponseData{
+		RuleID:        state.blockRuleID,
+		TransactionID: getLogID(r.Context()),
+		ClientIP:      extractIP(r.RemoteAddr),
+		Reason:        state.blockReason,
+		StatusCode:    state.StatusCode,
+		Method:        r.Method,
+		Host:          r.Host,
+		Path:          r.URL.Path,
+		Timestamp:     time.Now(),
+	}
+}
+
+// renderBody returns the body of the response, rendering its template for the request.
+// A template that fails to render falls back to the raw body.
+func (m *Middleware) renderBody(resp CustomBlockResponse, r *http.Request, state *WAFState) []byte {
+	if resp.template == nil {
+		return []byte(resp.Body)
+	}
+	var buf bytes.Buffer
+	if err := resp.template.Execute(&buf, blockResponseData(r, state)); err != nil {
+		m.logger.Error("Failed to render custom response template",
+			zap.Int("status_code", resp.StatusCode),
+			zap.String("log_id", getLogID(r.Context())),
+			zap.Error(err),
+		)
+		return []byte(resp.Body)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,106 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlockRequest_TemplatedResponse(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		CustomResponses: map[int]CustomBlockResponse{
+			http.StatusForbidden: {StatusCode: http.StatusForbidden, Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"reference": "{{.TransactionID}}", "rule": "{{.RuleID}}", "ip": "{{.ClientIP}}", "reason": "{{.Reason}}", "status": {{.StatusCode}}}`},
+		},
+	}
+	require.NoError(t, m.loadCustomResponses())
+	req := testRequest("GET", "/login", "", "")
+	req.RemoteAddr = "203.0.113.7:1234"
+
+	w := httptest.NewRecorder()
+	m.blockRequest(w, req, &WAFState{}, http.StatusForbidden, "path_blacklist", "path_blacklist_rule")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "the custom headers are sent")
+	assert.JSONEq(t, `{"reference": "test", "rule": "path_blacklist_rule", "ip": "203.0.113.7", "reason": "path_blacklist", "status": 403}`, w.Body.String())
+}
+
+func TestBlockRequest_HTMLTemplateEscapes(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		CustomResponses: map[int]CustomBlockResponse{
+			http.StatusForbidden: {StatusCode: http.StatusForbidden, Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"}, Body: `<p>Blocked: {{.Path}}</p>`},
+		},
+	}
+	require.NoError(t, m.loadCustomResponses())
+	w := httptest.NewRecorder()
+	m.blockRequest(w, testRequest("GET", "/%3Cscript%3E", "", ""), &WAFState{}, http.StatusForbidden, "path_blacklist", "path_blacklist_rule")
+	assert.Equal(t, "<p>Blocked: /&lt;script&gt;</p>", w.Body.String())
+}
+
+func TestBlockRequest_StaticAndDefaultResponses(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		CustomResponses: map[int]CustomBlockResponse{
+			http.StatusForbidden: {StatusCode: http.StatusForbidden, Headers: map[string]string{"Content-Type": "text/plain"}, Body: "Access denied"},
+		},
+	}
+	require.NoError(t, m.loadCustomResponses())
+	assert.Nil(t, m.CustomResponses[http.StatusForbidden].template, "bodies without actions are not templates")
+
+	w := httptest.NewRecorder()
+	m.blockRequest(w, testRequest("GET", "/", "", ""), &WAFState{}, http.StatusForbidden, "ban", "ban")
+	assert.Equal(t, "Access denied", w.Body.String())
+
+	w = httptest.NewRecorder()
+	m.blockRequest(w, testRequest("GET", "/", "", ""), &WAFState{}, http.StatusTooManyRequests, "rate_limit", "rate_limit_rule")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "Request blocked by WAF. Reason: rate_limit", w.Body.String(), "statuses without a custom response get the default message")
+}
+
+func TestWatchCustomResponses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.html")
+	require.NoError(t, os.WriteFile(path, []byte("<p>Blocked</p>"), 0o644))
+	m := &Middleware{
+		logger: zap.NewNop(),
+		CustomResponses: map[int]CustomBlockResponse{
+			http.StatusForbidden: {StatusCode: http.StatusForbidden, Headers: map[string]string{"Content-Type": responseFileContentType(path)}, File: path},
+		},
+	}
+	require.NoError(t, m.loadCustomResponses())
+	m.watchCustomResponses()
+	require.NotNil(t, m.customResponseWatchStop)
+	defer close(m.customResponseWatchStop)
+
+	body := func() string {
+		w := httptest.NewRecorder()
+		m.blockRequest(w, testRequest("GET", "/", "", ""), &WAFState{}, http.StatusForbidden, "ban", "ban")
+		return w.Body.String()
+	}
+	assert.Equal(t, "<p>Blocked</p>", body())
+
+	require.NoError(t, os.WriteFile(path, []byte("<p>Reference {{.TransactionID}}</p>"), 0o644))
+	assert.Eventually(t, func() bool { return body() == "<p>Reference test</p>" }, 5*time.Second, 50*time.Millisecond)
+
+	// An invalid template keeps the previous body
+	require.NoError(t, os.WriteFile(path, []byte("<p>{{.TransactionID</p>"), 0o644))
+	assert.Eventually(t, func() bool {
+		status := m.watchStatus(path)
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		return status.lastError != ""
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "<p>Reference test</p>", body())
+}
+
+func TestResponseFileContentType(t *testing.T) {
+	assert.Equal(t, "text/html; charset=utf-8", responseFileContentType("/etc/caddy/blocked.html"))
+	assert.Equal(t, "application/json", responseFileContentType("/etc/caddy/blocked.json"))
+	assert.Equal(t, "text/html; charset=utf-8", responseFileContentType("/etc/caddy/blocked"))
+}
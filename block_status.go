@@ -0,0 +1,82 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Block categories of block_status
+const (
+	BlockCategoryBlacklist = "blacklist"  // IP, DNS, path and certificate blacklists, dynamic bans
+	BlockCategoryRateLimit = "rate_limit" // rate_limit, cost_limit, concurrency_limit, quota and lockdown
+	BlockCategoryGeo       = "geo"        // Country blocking
+	BlockCategoryRule      = "rule"       // Rules with the block action
+	BlockCategoryAnomaly   = "anomaly"    // Anomaly threshold exceeded
+)
+
+// blockCategories maps the block reasons to their category.
+var blockCategories = map[string]string{
+	"ip_blacklist":               BlockCategoryBlacklist,
+	"dns_blacklist":              BlockCategoryBlacklist,
+	"path_blacklist":             BlockCategoryBlacklist,
+	"cert_blacklist":             BlockCategoryBlacklist,
+	"ban":                        BlockCategoryBlacklist,
+	"rate_limit":                 BlockCategoryRateLimit,
+	"cost_limit":                 BlockCategoryRateLimit,
+	"concurrency_limit":          BlockCategoryRateLimit,
+	"quota":                      BlockCategoryRateLimit,
+	"lockdown":                   BlockCategoryRateLimit,
+	"country_block":              BlockCategoryGeo,
+	"Rule action is 'block'":     BlockCategoryRule,
+	"Anomaly threshold exceeded": BlockCategoryAnomaly,
+}
+
+// BlockStatusConfig replaces the status codes of blocked requests: the 403 of the checks
+// without a status of their own by Default, and the status of a category by its override.
+type BlockStatusConfig struct {
+	Default    int            `json:"default,omitempty"`    // Replaces 403, kept if zero
+	Categories map[string]int `json:"categories,omitempty"` // Status by block category
+}
+
+// validateBlockStatus checks that a status code can answer a blocked request.
+func validateBlockStatus(code int) error {
+	if code < 400 || code > 599 {
+		return fmt.Errorf("invalid block status %d, must be between 400 and 599", code)
+	}
+	return nil
+}
+
+// validate checks the status codes and categories.
+func (c *BlockStatusConfig) validate() error {
+	if c.Default != 0 {
+		if err := validateBlockStatus(c.Default); err != nil {
+			return err
+		}
+	}
+	for category, code := range c.Categories {
+		switch category {
+		case BlockCategoryBlacklist, BlockCategoryRateLimit, BlockCategoryGeo, BlockCategoryRule, BlockCategoryAnomaly:
+		default:
+			return fmt.Errorf("unknown block_status category %s", category)
+		}
+		if err := validateBlockStatus(code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockStatus returns the status code answering a request blocked for reason, statusCode
+// being the status chosen by the check.
+func (m *Middleware) blockStatus(reason string, statusCode int) int {
+	if m.BlockStatus == nil {
+		return statusCode
+	}
+	if code, ok := m.BlockStatus.Categories[blockCategories[reason]]; ok {
+		return code
+	}
+	if statusCode == http.StatusForbidden && m.BlockStatus.Default != 0 {
+		return m.BlockStatus.Default
+	}
+	return statusCode
+}
@@ -0,0 +1,56 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlockStatus(t *testing.T) {
+	m := &Middleware{}
+	assert.Equal(t, http.StatusForbidden, m.blockStatus("ip_blacklist", http.StatusForbidden), "statuses are kept without block_status")
+
+	m.BlockStatus = &BlockStatusConfig{
+		Default:    http.StatusNotAcceptable,
+		Categories: map[string]int{BlockCategoryGeo: http.StatusUnavailableForLegalReasons, BlockCategoryBlacklist: http.StatusForbidden},
+	}
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, m.blockStatus("country_block", http.StatusForbidden))
+	assert.Equal(t, http.StatusForbidden, m.blockStatus("ban", http.StatusForbidden), "category overrides win over the default")
+	assert.Equal(t, http.StatusNotAcceptable, m.blockStatus("ssrf", http.StatusForbidden))
+	assert.Equal(t, http.StatusTooManyRequests, m.blockStatus("rate_limit", http.StatusTooManyRequests), "statuses other than 403 are kept")
+	assert.Equal(t, http.StatusConflict, m.blockStatus("replay", http.StatusConflict))
+
+	m.BlockStatus.Categories[BlockCategoryRateLimit] = http.StatusServiceUnavailable
+	assert.Equal(t, http.StatusServiceUnavailable, m.blockStatus("quota", http.StatusTooManyRequests))
+}
+
+func TestBlockStatusConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&BlockStatusConfig{Default: 418, Categories: map[string]int{BlockCategoryRule: 406}}).validate())
+	assert.Error(t, (&BlockStatusConfig{Default: 200}).validate())
+	assert.Error(t, (&BlockStatusConfig{Categories: map[string]int{"bots": 403}}).validate())
+	assert.Error(t, (&BlockStatusConfig{Categories: map[string]int{BlockCategoryGeo: 302}}).validate())
+}
+
+func TestBlockRequest_BlockStatus(t *testing.T) {
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		AnomalyThreshold: 10,
+		Rules: map[int][]Rule{
+			2: {{ID: "teapot", Targets: []string{"URL_PARAM:q"}, Phase: 2, Score: 1, Action: "block", regex: regexp.MustCompile(`tea`)}},
+		},
+		ruleCache:             NewRuleCache(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		BlockStatus:           &BlockStatusConfig{Default: http.StatusTeapot},
+	}
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, testRequest("GET", "/?q=tea", "", ""), 2, state)
+	require.True(t, state.Blocked)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, http.StatusTeapot, state.StatusCode)
+}
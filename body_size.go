@@ -0,0 +1,136 @@
+package caddywaf
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const bodySizeRuleID = "body_size_rule"
+
+// BodySizeLimit caps the size of the request bodies of some content types on a path, such
+// as 1 MB for JSON on /api and 100 MB for multipart uploads on /upload.
+type BodySizeLimit struct {
+	MaxSize      int64    `json:"max_size"`                // Bytes allowed
+	Path         string   `json:"path,omitempty"`          // Exact path, or a prefix ending in *, default all paths
+	ContentTypes []string `json:"content_types,omitempty"` // Request media types, such as application/json or multipart/*, default all
+	ContentType  string   `json:"content_type,omitempty"`  // Content type of the 413 response body
+	Body         string   `json:"body,omitempty"`          // 413 response body
+}
+
+// provision validates the limit and normalizes its content types.
+func (l *BodySizeLimit) provision() error {
+	if l.MaxSize <= 0 {
+		return fmt.Errorf("invalid max_body_size %d, must be positive", l.MaxSize)
+	}
+	if l.Path != "" && !strings.HasPrefix(l.Path, "/") {
+		return fmt.Errorf("max_body_size path must start with /: %s", l.Path)
+	}
+	for i, contentType := range l.ContentTypes {
+		l.ContentTypes[i] = strings.ToLower(contentType)
+	}
+	return nil
+}
+
+// matches reports whether the limit applies to a request.
+func (l *BodySizeLimit) matches(r *http.Request) bool {
+	if prefix, ok := strings.CutSuffix(l.Path, "*"); ok {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	} else if l.Path != "" && r.URL.Path != l.Path {
+		return false
+	}
+	if len(l.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range l.ContentTypes {
+		if prefix, ok := strings.CutSuffix(contentType, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// bodySizeLimitFor returns the first body size limit applying to the request, or nil.
+func (m *Middleware) bodySizeLimitFor(r *http.Request) *BodySizeLimit {
+	for i := range m.BodySizeLimits {
+		if m.BodySizeLimits[i].matches(r) {
+			return &m.BodySizeLimits[i]
+		}
+	}
+	return nil
+}
+
+// checkBodySize blocks in phase 1 the requests whose Content-Length is over the body size
+// limit applying to them. Bodies of unknown length are capped to the limit instead, the
+// requests running past it being blocked by checkStreamedBodySize. It reports whether the
+// request was blocked.
+func (m *Middleware) checkBodySize(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	limit := m.bodySizeLimitFor(r)
+	if limit == nil || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	if r.ContentLength > limit.MaxSize {
+		m.blockBodySize(w, r, state, limit, r.ContentLength)
+		return true
+	}
+	if r.ContentLength < 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit.MaxSize)
+		state.bodySizeLimit = limit
+	}
+	return false
+}
+
+// checkStreamedBodySize reads in phase 2 the body of unknown length capped by checkBodySize,
+// blocking the request when it runs past the limit. It reports whether the request was
+// blocked.
+func (m *Middleware) checkStreamedBodySize(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	limit := state.bodySizeLimit
+	if limit == nil {
+		return false
+	}
+	var maxBytesErr *http.MaxBytesError
+	if _, err := m.extractTarget(TargetBody, r, nil, state); !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	m.blockBodySize(w, r, state, limit, -1)
+	return true
+}
+
+// blockBodySize blocks a request over its body size limit with 413 and the configured
+// response. size is -1 when the body has no Content-Length.
+func (m *Middleware) blockBodySize(w http.ResponseWriter, r *http.Request, state *WAFState, limit *BodySizeLimit, size int64) {
+	m.bodySizeHits.Add(1)
+	fields := []zap.Field{
+		zap.String("message", "Request blocked for its body size"),
+		zap.Int64("max_body_size", limit.MaxSize),
+		zap.Int64("content_length", size),
+		zap.String("content_type", r.Header.Get("Content-Type")),
+	}
+	if limit.Body == "" {
+		m.blockRequest(w, r, state, http.StatusRequestEntityTooLarge, "body_size", bodySizeRuleID, fields...)
+		return
+	}
+
+	m.recordBlock(r, state, http.StatusRequestEntityTooLarge, "body_size", bodySizeRuleID, fields...)
+	if limit.ContentType != "" {
+		w.Header().Set("Content-Type", limit.ContentType)
+	}
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if _, err := w.Write([]byte(limit.Body)); err != nil {
+		m.logger.Error("Failed to write body size block response", zap.Error(err))
+	}
+}
@@ -0,0 +1,104 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func bodySizeRequest(target, contentType, body string) *http.Request {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func TestBodySizeLimitFor(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		BodySizeLimits: []BodySizeLimit{
+			{MaxSize: 16, Path: "/api/*", ContentTypes: []string{"application/JSON"}, ContentType: "application/json", Body: `{"error": "body too large"}`},
+			{MaxSize: 64, Path: "/upload", ContentTypes: []string{"multipart/*"}},
+		},
+	}
+	for i := range m.BodySizeLimits {
+		require.NoError(t, m.BodySizeLimits[i].provision())
+	}
+	assert.Equal(t, &m.BodySizeLimits[0], m.bodySizeLimitFor(bodySizeRequest("/api/users", "application/json; charset=utf-8", "")))
+	assert.Equal(t, &m.BodySizeLimits[1], m.bodySizeLimitFor(bodySizeRequest("/upload", "multipart/form-data; boundary=x", "")))
+	assert.Nil(t, m.bodySizeLimitFor(bodySizeRequest("/upload/more", "multipart/form-data; boundary=x", "")))
+	assert.Nil(t, m.bodySizeLimitFor(bodySizeRequest("/api/users", "text/plain", "")))
+	assert.Nil(t, m.bodySizeLimitFor(bodySizeRequest("/api/users", "", "")))
+
+	m.BodySizeLimits = append(m.BodySizeLimits, BodySizeLimit{MaxSize: 8})
+	assert.Equal(t, int64(8), m.bodySizeLimitFor(bodySizeRequest("/", "", "")).MaxSize, "a limit without path or content types applies to all requests")
+
+	assert.Error(t, (&BodySizeLimit{}).provision())
+	assert.Error(t, (&BodySizeLimit{MaxSize: 1, Path: "api"}).provision())
+}
+
+func TestCheckBodySize(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		BodySizeLimits: []BodySizeLimit{
+			{MaxSize: 16, Path: "/api/*", ContentTypes: []string{"application/JSON"}, ContentType: "application/json", Body: `{"error": "body too large"}`},
+			{MaxSize: 64, Path: "/upload", ContentTypes: []string{"multipart/*"}},
+		},
+	}
+	for i := range m.BodySizeLimits {
+		require.NoError(t, m.BodySizeLimits[i].provision())
+	}
+	assert.False(t, m.checkBodySize(httptest.NewRecorder(), bodySizeRequest("/api/users", "application/json", `{"name": "a"}`), &WAFState{}))
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkBodySize(w, bodySizeRequest("/api/users", "application/json", `{"name": "a long name"}`), state))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error": "body too large"}`, w.Body.String())
+	assert.Equal(t, bodySizeRuleID, state.blockRuleID)
+
+	w = httptest.NewRecorder()
+	assert.True(t, m.checkBodySize(w, bodySizeRequest("/upload", "multipart/form-data; boundary=x", strings.Repeat("x", 65)), &WAFState{}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, int64(2), m.bodySizeHits.Load())
+}
+
+func TestCheckStreamedBodySize(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		BodySizeLimits:        []BodySizeLimit{{MaxSize: 64, Path: "/upload", ContentTypes: []string{"multipart/*"}}},
+	}
+	require.NoError(t, m.BodySizeLimits[0].provision())
+	streamed := func(body string) *http.Request {
+		req := bodySizeRequest("/upload", "multipart/form-data; boundary=x", "")
+		req.Body = io.NopCloser(strings.NewReader(body))
+		req.ContentLength = -1
+		return req
+	}
+
+	req := streamed(strings.Repeat("x", 64))
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.False(t, m.checkBodySize(w, req, state), "the length of a streamed body is unknown in phase 1")
+	assert.False(t, m.checkStreamedBodySize(w, req, state))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 64, "a body within the limit reaches the upstream handler")
+
+	req = streamed(strings.Repeat("x", 65))
+	w = httptest.NewRecorder()
+	state = &WAFState{}
+	assert.False(t, m.checkBodySize(w, req, state))
+	assert.True(t, m.checkStreamedBodySize(w, req, state))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, int64(1), m.bodySizeHits.Load())
+}
@@ -0,0 +1,192 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	botScoreRuleID = "bot_score_rule"
+	maxBotScore    = 100
+)
+
+// botSignal is an indication that a request comes from automation. Its weight is added to
+// the bot score when detect reports it present; negative weights vouch for a human.
+type botSignal struct {
+	name   string
+	weight int
+	detect func(m *Middleware, r *http.Request, state *WAFState) bool
+}
+
+// automationUserAgents are User-Agent substrings of HTTP libraries, command-line tools,
+// headless browsers and crawlers, lowercased.
+var automationUserAgents = []string{
+	"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "httpx", "go-http-client",
+	"java/", "okhttp", "apache-httpclient", "libwww-perl", "node-fetch", "axios/", "undici",
+	"scrapy", "headlesschrome", "phantomjs", "selenium", "puppeteer", "playwright",
+	"bot", "crawler", "spider", "scan",
+}
+
+// botSignals are the signals combined into the bot score, in evaluation order.
+var botSignals = []botSignal{
+	{name: "missing_user_agent", weight: 40, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		return strings.TrimSpace(r.UserAgent()) == ""
+	}},
+	{name: "automation_user_agent", weight: 40, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		return isAutomationUserAgent(r.UserAgent())
+	}},
+	{name: "missing_accept", weight: 10, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		return r.Header.Get("Accept") == ""
+	}},
+	{name: "browser_header_anomaly", weight: 20, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		// Browsers always send these; HTTP libraries faking a browser User-Agent often don't
+		return strings.HasPrefix(r.UserAgent(), "Mozilla/") &&
+			(r.Header.Get("Accept-Language") == "" || r.Header.Get("Accept-Encoding") == "")
+	}},
+	{name: "client_hints_mismatch", weight: 30, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		return clientHintsMismatch(r)
+	}},
+	{name: "missing_fetch_metadata", weight: 10, detect: func(_ *Middleware, r *http.Request, _ *WAFState) bool {
+		return missingFetchMetadata(r)
+	}},
+	{name: "datacenter_ip", weight: 20, detect: func(m *Middleware, r *http.Request, state *WAFState) bool {
+		return m.ipType(r, state) == IPTypeDatacenter
+	}},
+	{name: "vpn_ip", weight: 20, detect: func(m *Middleware, r *http.Request, state *WAFState) bool {
+		return m.ipType(r, state) == IPTypeVPN
+	}},
+	{name: "tor_ip", weight: 30, detect: func(m *Middleware, r *http.Request, state *WAFState) bool {
+		return m.ipType(r, state) == IPTypeTor
+	}},
+	{name: "challenge_passed", weight: -50, detect: func(m *Middleware, r *http.Request, _ *WAFState) bool {
+		return m.challengePassed(r)
+	}},
+}
+
+// isAutomationUserAgent reports whether a User-Agent belongs to automation rather than a browser.
+func isAutomationUserAgent(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, marker := range automationUserAgents {
+		if strings.Contains(userAgent, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// BotScoreConfig tunes the weights of the bot signals and acts on requests whose bot
+// score reaches a threshold. The BOT_SCORE and BOT_SIGNALS targets are available to rules
+// without it.
+type BotScoreConfig struct {
+	Weights   map[string]int `json:"weights,omitempty"`   // Weights overriding the defaults by signal name
+	Threshold int            `json:"threshold,omitempty"` // Bot score acted on, 0 to only expose the targets
+	Action    string         `json:"action,omitempty"`    // challenge (default), block or score
+	Score     int            `json:"score,omitempty"`     // Score added with the score action, default 5
+}
+
+// provision validates the config and applies the defaults.
+func (c *BotScoreConfig) provision() error {
+	for name := range c.Weights {
+		if !isBotSignal(name) {
+			return fmt.Errorf("unknown bot signal: %s", name)
+		}
+	}
+	if c.Threshold < 0 || c.Threshold > maxBotScore {
+		return fmt.Errorf("invalid bot_score threshold %d, must be between 0 and %d", c.Threshold, maxBotScore)
+	}
+	switch c.Action {
+	case "":
+		c.Action = credentialActionChallenge
+	case credentialActionChallenge, detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid bot_score action: %s, must be challenge, block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	return nil
+}
+
+// isBotSignal reports whether name is a known bot signal.
+func isBotSignal(name string) bool {
+	for _, signal := range botSignals {
+		if signal.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// botScore returns the bot score of the request, from 0 to 100, and the signals present.
+// Both are memoized as the BOT_SCORE and BOT_SIGNALS targets.
+func (m *Middleware) botScore(r *http.Request, state *WAFState) (int, string) {
+	if cached, ok := state.targets[TargetBotScore]; ok {
+		score, _ := strconv.Atoi(cached.value)
+		return score, state.targets[TargetBotSignals].value
+	}
+
+	score := 0
+	var present []string
+	for _, signal := range botSignals {
+		if !signal.detect(m, r, state) {
+			continue
+		}
+		weight := signal.weight
+		if m.BotScore != nil {
+			if w, ok := m.BotScore.Weights[signal.name]; ok {
+				weight = w
+			}
+		}
+		score += weight
+		present = append(present, signal.name)
+	}
+	score = min(max(score, 0), maxBotScore)
+	signals := strings.Join(present, ",")
+
+	if state.targets == nil {
+		state.targets = make(map[string]extractedTarget)
+	}
+	state.targets[TargetBotScore] = extractedTarget{value: strconv.Itoa(score)}
+	state.targets[TargetBotSignals] = extractedTarget{value: signals}
+	return score, signals
+}
+
+// botTarget returns the value of the BOT_SCORE and BOT_SIGNALS targets, reporting whether
+// target is one of them.
+func (m *Middleware) botTarget(target string, r *http.Request, state *WAFState) (string, bool) {
+	switch strings.ToUpper(target) {
+	case TargetBotScore:
+		score, _ := m.botScore(r, state)
+		return strconv.Itoa(score), true
+	case TargetBotSignals:
+		_, signals := m.botScore(r, state)
+		return signals, true
+	}
+	return "", false
+}
+
+// checkBotScore acts on requests whose bot score reaches the threshold. It reports whether
+// the request was blocked or challenged.
+func (m *Middleware) checkBotScore(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.BotScore
+	if config == nil || config.Threshold <= 0 {
+		return false
+	}
+	score, signals := m.botScore(r, state)
+	if score < config.Threshold {
+		return false
+	}
+
+	m.botScoreHits.Add(1)
+	m.incrementRuleHitCount(RuleID(botScoreRuleID))
+	state.MatchedRules = append(state.MatchedRules, botScoreRuleID)
+	if config.Action == credentialActionChallenge {
+		return m.challenge(w, r, state, "bot score "+strconv.Itoa(score), botScoreRuleID)
+	}
+	return m.applyDetection(w, r, state, config.Action, config.Score, http.StatusForbidden, "bot_score", botScoreRuleID,
+		"Bot score threshold reached", zap.Int("bot_score", score), zap.String("signals", signals))
+}
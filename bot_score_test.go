@@ -0,0 +1,96 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBotScore(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+
+	score, signals := m.botScore(browserRequest(), &WAFState{})
+	assert.Zero(t, score)
+	assert.Empty(t, signals)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "python-requests/2.31")
+	score, signals = m.botScore(req, &WAFState{})
+	assert.Equal(t, 50, score)
+	assert.Equal(t, "automation_user_agent,missing_accept", signals)
+
+	req = browserRequest()
+	req.Header.Del("Accept-Language")
+	score, signals = m.botScore(req, &WAFState{})
+	assert.Equal(t, 20, score)
+	assert.Equal(t, "browser_header_anomaly", signals)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	score, _ = m.botScore(req, &WAFState{})
+	assert.Equal(t, 50, score, "missing User-Agent and Accept")
+
+	m.BotScore = &BotScoreConfig{Weights: map[string]int{"missing_user_agent": 100}}
+	score, _ = m.botScore(req, &WAFState{})
+	assert.Equal(t, maxBotScore, score, "capped at 100")
+}
+
+func TestBotScore_ChallengePassed(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), Challenge: &ChallengeConfig{Difficulty: 4}}
+	require.NoError(t, m.Challenge.provision())
+
+	req := browserRequest()
+	req.Header.Del("Accept-Language")
+	seed := m.Challenge.seed("192.0.2.1", time.Now().Add(time.Hour))
+	req.AddCookie(&http.Cookie{Name: m.Challenge.CookieName, Value: solveChallenge(seed, m.Challenge.Difficulty)})
+	score, signals := m.botScore(req, &WAFState{})
+	assert.Zero(t, score, "negative weights vouch for a human")
+	assert.Equal(t, "browser_header_anomaly,challenge_passed", signals)
+}
+
+func TestBotScoreTargets(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	state := &WAFState{}
+
+	value, err := m.extractTarget(TargetBotScore, req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "50", value)
+	value, err = m.extractTarget("bot_signals", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "automation_user_agent,missing_accept", value)
+}
+
+func TestCheckBotScore(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), BotScore: &BotScoreConfig{Threshold: 50, Action: detectionActionBlock}}
+	require.NoError(t, m.BotScore.provision())
+
+	w := httptest.NewRecorder()
+	assert.False(t, m.checkBotScore(w, browserRequest(), &WAFState{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "Scrapy/2.11")
+	state := &WAFState{}
+	assert.True(t, m.checkBotScore(w, req, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{botScoreRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.botScoreHits.Load())
+
+	m.BotScore.Action = credentialActionChallenge
+	m.Challenge = &ChallengeConfig{Difficulty: 4}
+	require.NoError(t, m.Challenge.provision())
+	w = httptest.NewRecorder()
+	assert.True(t, m.checkBotScore(w, req, &WAFState{}))
+	assert.Contains(t, w.Body.String(), "Checking your browser")
+}
+
+func TestBotScoreConfig_ProvisionErrors(t *testing.T) {
+	assert.Error(t, (&BotScoreConfig{Weights: map[string]int{"unknown": 1}}).provision())
+	assert.Error(t, (&BotScoreConfig{Threshold: 101}).provision())
+	assert.Error(t, (&BotScoreConfig{Action: "ban"}).provision())
+}
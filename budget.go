@@ -0,0 +1,168 @@
+package caddywaf
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	budgetActionAllow = "allow" // Fail open: stop inspecting, or inspect the body prefix
+	budgetActionBlock = "block" // Fail closed: block the request
+	budgetRuleID      = "inspection_budget_rule"
+
+	budgetLimitBodyBytes = "body_bytes"
+	budgetLimitRegexTime = "regex_time"
+	budgetLimitRules     = "rules"
+)
+
+// InspectionBudget limits the inspection work spent on a single request.
+type InspectionBudget struct {
+	MaxBodyBytes int64         `json:"max_body_bytes,omitempty"` // Request body bytes inspected
+	MaxRegexTime time.Duration `json:"max_regex_time,omitempty"` // Total regex matching time
+	MaxRules     int           `json:"max_rules,omitempty"`      // Rules evaluated across all phases
+	OnExceeded   string        `json:"on_exceeded,omitempty"`    // allow or block, default allow
+}
+
+// budgetUsage tracks the inspection work spent on a request.
+type budgetUsage struct {
+	rules     int
+	regexTime time.Duration
+	exceeded  string // Limit that was exceeded first, if any
+}
+
+// budgetStats counts the requests that exceeded each limit.
+type budgetStats struct {
+	bodyBytes atomic.Int64
+	regexTime atomic.Int64
+	rules     atomic.Int64
+}
+
+// validate checks the budget and applies defaults.
+func (b *InspectionBudget) validate() error {
+	switch b.OnExceeded {
+	case "":
+		b.OnExceeded = budgetActionAllow
+	case budgetActionAllow, budgetActionBlock:
+	default:
+		return fmt.Errorf("invalid inspection_budget on_exceeded %q, must be allow or block", b.OnExceeded)
+	}
+	if b.MaxBodyBytes < 0 || b.MaxRegexTime < 0 || b.MaxRules < 0 {
+		return fmt.Errorf("inspection_budget limits must not be negative")
+	}
+	return nil
+}
+
+// limitBody caps the request body read by BODY and JSON_PATH targets at one byte
+// over the budget, so an oversized body is detected without being read in full. It
+// reports whether the body was capped.
+func (m *Middleware) limitBody(r *http.Request) bool {
+	if m.InspectionBudget == nil || m.InspectionBudget.MaxBodyBytes <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r.Body, m.InspectionBudget.MaxBodyBytes+1), r.Body}
+	return true
+}
+
+// truncateBody cuts an extracted body to the budget, recording the overrun.
+func (m *Middleware) truncateBody(body string, state *WAFState) string {
+	if m.InspectionBudget == nil || m.InspectionBudget.MaxBodyBytes <= 0 || int64(len(body)) <= m.InspectionBudget.MaxBodyBytes {
+		return body
+	}
+	if state.budget.exceeded == "" {
+		m.recordBudgetExceeded(budgetLimitBodyBytes, state)
+	}
+	return body[:m.InspectionBudget.MaxBodyBytes]
+}
+
+// matchRule matches a rule against a value, charging the match time to the request's budget.
+// Rules with only a condition match any value.
+func (m *Middleware) matchRule(rule *Rule, value string, state *WAFState) bool {
+	if rule.MinEntropy > 0 && shannonEntropy(value) < rule.MinEntropy {
+		return false
+	}
+	if rule.regex == nil {
+		return true
+	}
+	if m.InspectionBudget == nil || m.InspectionBudget.MaxRegexTime <= 0 {
+		return rule.regex.MatchString(value)
+	}
+	start := time.Now()
+	matched := rule.regex.MatchString(value)
+	state.budget.regexTime += time.Since(start)
+	return matched
+}
+
+// withinBudget reports whether inspection of the request may go on, counting one more
+// rule evaluation if countRule is set. Once a limit is exceeded, fail-closed budgets block
+// the request, while fail-open budgets skip the remaining rules; an oversized body only
+// stops inspection when failing closed, as its prefix can still be inspected.
+func (m *Middleware) withinBudget(w http.ResponseWriter, r *http.Request, state *WAFState, countRule bool) bool {
+	b := m.InspectionBudget
+	if b == nil || state.Blocked {
+		return true
+	}
+	if state.budget.exceeded == "" {
+		switch {
+		case b.MaxRules > 0 && countRule && state.budget.rules >= b.MaxRules:
+			m.recordBudgetExceeded(budgetLimitRules, state)
+		case b.MaxRegexTime > 0 && state.budget.regexTime >= b.MaxRegexTime:
+			m.recordBudgetExceeded(budgetLimitRegexTime, state)
+		}
+	}
+	if state.budget.exceeded == "" || (state.budget.exceeded == budgetLimitBodyBytes && b.OnExceeded == budgetActionAllow) {
+		if countRule {
+			state.budget.rules++
+		}
+		return true
+	}
+
+	if b.OnExceeded == budgetActionBlock {
+		m.blockRequest(w, r, state, http.StatusForbidden, "inspection_budget", budgetRuleID,
+			zap.String("message", "Request blocked because it exceeded the inspection budget"),
+			zap.String("limit", state.budget.exceeded),
+		)
+	}
+	return false
+}
+
+// recordBudgetExceeded marks the request as over budget and logs the limit once.
+func (m *Middleware) recordBudgetExceeded(limit string, state *WAFState) {
+	state.budget.exceeded = limit
+	switch limit {
+	case budgetLimitBodyBytes:
+		m.budgetStats.bodyBytes.Add(1)
+	case budgetLimitRegexTime:
+		m.budgetStats.regexTime.Add(1)
+	case budgetLimitRules:
+		m.budgetStats.rules.Add(1)
+	}
+	m.logger.Warn("Request exceeded the inspection budget",
+		zap.String("limit", limit),
+		zap.String("action", m.InspectionBudget.OnExceeded),
+		zap.Int("rules_evaluated", state.budget.rules),
+		zap.Duration("regex_time", state.budget.regexTime),
+	)
+}
+
+// BudgetMetrics returns the number of requests that exceeded each limit.
+func (m *Middleware) BudgetMetrics() map[string]int64 {
+	return map[string]int64{
+		budgetLimitBodyBytes: m.budgetStats.bodyBytes.Load(),
+		budgetLimitRegexTime: m.budgetStats.regexTime.Load(),
+		budgetLimitRules:     m.budgetStats.rules.Load(),
+	}
+}
+
+// isBodyTarget reports whether a target reads the request body.
+func isBodyTarget(target string) bool {
+	return strings.EqualFold(target, TargetBody)
+}
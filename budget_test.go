@@ -0,0 +1,115 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInspectionBudget_Validate(t *testing.T) {
+	budget := InspectionBudget{MaxRules: 10}
+	require.NoError(t, budget.validate())
+	assert.Equal(t, budgetActionAllow, budget.OnExceeded)
+
+	assert.Error(t, (&InspectionBudget{OnExceeded: "drop"}).validate())
+	assert.Error(t, (&InspectionBudget{MaxRules: -1}).validate())
+}
+
+func TestWithinBudget_Rules(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	budget := &InspectionBudget{MaxRules: 2}
+	require.NoError(t, budget.validate())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		InspectionBudget:      budget,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	state := &WAFState{}
+	assert.True(t, m.withinBudget(httptest.NewRecorder(), r, state, true))
+	assert.True(t, m.withinBudget(httptest.NewRecorder(), r, state, true))
+	assert.False(t, m.withinBudget(httptest.NewRecorder(), r, state, true), "third rule is over budget")
+	assert.False(t, state.Blocked, "fail open skips the remaining rules")
+	assert.Equal(t, int64(1), m.BudgetMetrics()[budgetLimitRules])
+
+	budget = &InspectionBudget{MaxRules: 1, OnExceeded: budgetActionBlock}
+	require.NoError(t, budget.validate())
+	m = &Middleware{
+		logger:                zap.NewNop(),
+		InspectionBudget:      budget,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	state = &WAFState{}
+	assert.True(t, m.withinBudget(httptest.NewRecorder(), r, state, true))
+	assert.True(t, m.withinBudget(httptest.NewRecorder(), r, state, false), "only rule evaluations count")
+	assert.False(t, m.withinBudget(httptest.NewRecorder(), r, state, true))
+	assert.True(t, state.Blocked, "fail closed blocks the request")
+	assert.Equal(t, http.StatusForbidden, state.StatusCode)
+}
+
+func TestWithinBudget_RegexTime(t *testing.T) {
+	budget := &InspectionBudget{MaxRegexTime: time.Nanosecond, OnExceeded: budgetActionBlock}
+	require.NoError(t, budget.validate())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		InspectionBudget:      budget,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	rule := &Rule{ID: "slow", regex: regexp.MustCompile(`(a+)+b`)}
+	state := &WAFState{}
+
+	assert.False(t, m.matchRule(rule, strings.Repeat("a", 1000), state))
+	assert.Positive(t, state.budget.regexTime)
+	assert.False(t, m.withinBudget(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), state, true))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, int64(1), m.BudgetMetrics()[budgetLimitRegexTime])
+}
+
+func TestExtractTarget_BodyBudget(t *testing.T) {
+	body := strings.Repeat("x", 100) + "attack"
+
+	budget := &InspectionBudget{MaxBodyBytes: 100}
+	require.NoError(t, budget.validate())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		InspectionBudget:      budget,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	state := &WAFState{}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	value, err := m.extractTarget(TargetBody, r, nil, state)
+	require.NoError(t, err)
+	assert.Len(t, value, 100, "only the body prefix is inspected")
+	replayed, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(replayed), "the upstream handler still reads the whole body")
+	assert.True(t, m.withinBudget(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), state, true), "fail open keeps inspecting the prefix")
+
+	budget = &InspectionBudget{MaxBodyBytes: 100, OnExceeded: budgetActionBlock}
+	require.NoError(t, budget.validate())
+	m = &Middleware{
+		logger:                zap.NewNop(),
+		InspectionBudget:      budget,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	state = &WAFState{}
+	_, err = m.extractTarget(TargetBody, httptest.NewRequest("POST", "/", strings.NewReader(body)), nil, state)
+	require.NoError(t, err)
+	assert.False(t, m.withinBudget(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), state, false))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, int64(1), m.BudgetMetrics()[budgetLimitBodyBytes])
+
+	state = &WAFState{}
+	value, err = m.extractTarget(TargetBody, httptest.NewRequest("POST", "/", strings.NewReader("small")), nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "small", value)
+	assert.Empty(t, state.budget.exceeded)
+}
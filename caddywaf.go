@@ -20,10 +20,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/netip"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/oschwald/maxminddb-golang"
@@ -44,6 +44,7 @@ var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil) // Assicurati che anche questa sia presente se hai un metodo Validate()
 )
 
@@ -168,7 +169,17 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 	}
 
 	// Start the asynchronous logging worker
+	if m.LogOverflow != "" && !isLogOverflowPolicy(m.LogOverflow) {
+		return fmt.Errorf("invalid log_overflow policy %q", m.LogOverflow)
+	}
 	m.StartLogWorker()
+	if m.LogDedup != nil {
+		if err := m.LogDedup.provision(); err != nil {
+			return err
+		}
+		m.logDeduper = newLogDeduper(*m.LogDedup, m.logger, m.ruleSeverity)
+		m.logDeduper.Start()
+	}
 
 	// Provision Tor blocking
 	if err := m.Tor.Provision(ctx); err != nil {
@@ -178,13 +189,36 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 	// Initialize rule hits map
 	m.ruleHits = sync.Map{}
 
+	// Initialize latency tracking
+	if m.LatencyMetrics {
+		m.latencyTracker = NewLatencyTracker()
+	}
+
 	// Log the current version of the middleware
 	m.logVersion()
 
 	// Start file watchers for rule files and blacklist files
 	// Context cancellation could be added in the future to gracefully stop watchers.
 	m.startFileWatcher(m.RuleFiles)
-	m.startFileWatcher([]string{m.IPBlacklistFile, m.DNSBlacklistFile})
+	m.startFileWatcher([]string{m.IPBlacklistFile, m.DNSBlacklistFile, m.PathBlacklistFile, m.CertBlacklistFile})
+
+	// Load the timezone of the active hours and days of rules and filters
+	if m.Timezone != "" {
+		location, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", m.Timezone, err)
+		}
+		m.location = location
+	}
+	if m.RateLimit.schedule, err = compileTimeWindow(m.RateLimit.ActiveHours, m.RateLimit.ActiveDays); err != nil {
+		return fmt.Errorf("invalid rate_limit schedule: %w", err)
+	}
+	if m.CountryBlacklist.schedule, err = compileTimeWindow(m.CountryBlacklist.ActiveHours, m.CountryBlacklist.ActiveDays); err != nil {
+		return fmt.Errorf("invalid block_countries schedule: %w", err)
+	}
+	if m.CountryWhitelist.schedule, err = compileTimeWindow(m.CountryWhitelist.ActiveHours, m.CountryWhitelist.ActiveDays); err != nil {
+		return fmt.Errorf("invalid whitelist_countries schedule: %w", err)
+	}
 
 	// Configure rate limiting
 	if m.RateLimit.Requests > 0 {
@@ -210,6 +244,307 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 
 	// Initialize GeoIP stats
 	m.geoIPStats = make(map[string]int64)
+	m.geoIPBlockedByCountry = make(map[string]int64)
+
+	// Cap concurrent expensive inspections
+	if m.InspectionPool != nil {
+		pool, err := NewInspectionPool(*m.InspectionPool)
+		if err != nil {
+			return fmt.Errorf("failed to configure inspection pool: %w", err)
+		}
+		m.inspectionPool = pool
+		m.logger.Info("Inspection pool configured",
+			zap.Int("workers", pool.config.Workers),
+			zap.Duration("queue_timeout", pool.config.QueueTimeout),
+			zap.String("fallback", pool.config.Fallback),
+			zap.Int64("body_threshold", pool.config.BodyThreshold),
+		)
+	}
+
+	// Limit the inspection work spent on a single request
+	if m.InspectionBudget != nil {
+		if err := m.InspectionBudget.validate(); err != nil {
+			return err
+		}
+		m.logger.Info("Inspection budget configured",
+			zap.Int64("max_body_bytes", m.InspectionBudget.MaxBodyBytes),
+			zap.Duration("max_regex_time", m.InspectionBudget.MaxRegexTime),
+			zap.Int("max_rules", m.InspectionBudget.MaxRules),
+			zap.String("on_exceeded", m.InspectionBudget.OnExceeded),
+		)
+	}
+
+	// Compile the parameter schemas of the positive security model
+	for i := range m.ParamSchemas {
+		if err := m.ParamSchemas[i].provision(); err != nil {
+			return err
+		}
+	}
+	if m.OpenAPI != nil {
+		if err := m.OpenAPI.provision(); err != nil {
+			return err
+		}
+		m.logger.Info("OpenAPI validation configured",
+			zap.String("spec", m.OpenAPI.Spec),
+			zap.Int("paths", len(m.OpenAPI.spec.routes)),
+			zap.String("action", m.OpenAPI.Action),
+		)
+		m.startFileWatcher([]string{m.OpenAPI.Spec})
+	}
+	for i := range m.JSONSchemas {
+		if err := m.JSONSchemas[i].provision(); err != nil {
+			return err
+		}
+	}
+
+	// Track login attempts and travel, with a challenge for the configs that serve one
+	for _, config := range m.CredentialStuffing {
+		if err := config.provision(); err != nil {
+			return err
+		}
+		if config.Action == credentialActionBan && m.Bans == nil {
+			return fmt.Errorf("credential_stuffing %s: the ban action requires the ban directive", config.Path)
+		}
+		if config.Action == credentialActionChallenge && m.Challenge == nil {
+			m.Challenge = &ChallengeConfig{}
+		}
+	}
+	if m.GeoVelocity != nil {
+		if err := m.GeoVelocity.provision(); err != nil {
+			return err
+		}
+		if m.GeoVelocity.Action == credentialActionChallenge && m.Challenge == nil {
+			m.Challenge = &ChallengeConfig{}
+		}
+	}
+	if m.BotScore != nil {
+		if err := m.BotScore.provision(); err != nil {
+			return err
+		}
+		if m.BotScore.Threshold > 0 && m.BotScore.Action == credentialActionChallenge && m.Challenge == nil {
+			m.Challenge = &ChallengeConfig{}
+		}
+	}
+	if m.Reputation != nil {
+		if err := m.Reputation.provision(ctx, m.logger); err != nil {
+			return err
+		}
+		if m.Reputation.Action == credentialActionChallenge && m.Challenge == nil {
+			m.Challenge = &ChallengeConfig{}
+		}
+	}
+	if m.TokenIntrospection != nil {
+		if err := m.TokenIntrospection.provision(m.logger); err != nil {
+			return err
+		}
+	}
+	if m.Lockdown != nil {
+		if err := m.Lockdown.provision(m); err != nil {
+			return err
+		}
+		if !m.Lockdown.NoChallenge && m.Challenge == nil {
+			m.Challenge = &ChallengeConfig{}
+		}
+		m.logger.Info("Lockdown configured",
+			zap.Bool("active", m.Lockdown.active.Load()),
+			zap.Int("anomaly_threshold", m.Lockdown.AnomalyThreshold),
+			zap.Int("rate_limit", m.Lockdown.RateLimit),
+		)
+	}
+	if m.Challenge != nil {
+		if err := m.Challenge.provision(); err != nil {
+			return err
+		}
+	}
+
+	// Remember recent requests to detect replays
+	for _, config := range m.Replay {
+		if err := config.provision(); err != nil {
+			return err
+		}
+	}
+
+	// Create the custom inspectors
+	for _, config := range m.Inspectors {
+		if err := config.provision(); err != nil {
+			return err
+		}
+		m.logger.Info("Inspector enabled",
+			zap.String("name", config.Name),
+			zap.String("plugin", config.Plugin),
+			zap.Ints("phases", config.Phases),
+		)
+	}
+
+	// Validate the ICAP services
+	if m.ICAP != nil {
+		if err := m.ICAP.provision(); err != nil {
+			return err
+		}
+		m.logger.Info("ICAP scanning enabled",
+			zap.String("url", m.ICAP.URL),
+			zap.String("response_url", m.ICAP.ResponseURL),
+		)
+	}
+
+	// Validate the clamd address
+	if m.ClamAV != nil {
+		if err := m.ClamAV.provision(); err != nil {
+			return err
+		}
+		m.logger.Info("ClamAV upload scanning enabled",
+			zap.String("address", m.ClamAV.Address),
+			zap.Int64("min_size", m.ClamAV.MinSize),
+		)
+	}
+
+	if m.XXE != nil {
+		if err := m.XXE.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.RPC != nil {
+		if err := m.RPC.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.GraphQL != nil {
+		if err := m.GraphQL.provision(); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range m.RequestSigning {
+		if err := config.provision(); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range m.SignedURLs {
+		if err := config.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.Hotlink != nil {
+		if err := m.Hotlink.provision(); err != nil {
+			return err
+		}
+	}
+
+	for i := range m.BodySizeLimits {
+		if err := m.BodySizeLimits[i].provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.UploadPolicy != nil {
+		if err := m.UploadPolicy.provision(); err != nil {
+			return err
+		}
+	}
+
+	// Compile the YARA rules
+	if m.YARA != nil {
+		if err := m.YARA.provision(); err != nil {
+			return err
+		}
+		m.logger.Info("YARA rules loaded",
+			zap.String("dir", m.YARA.Dir),
+			zap.Int("rules", len(m.YARA.rules)),
+		)
+	}
+
+	// Compile the endpoint costs
+	if m.CostLimit != nil {
+		if err := m.CostLimit.provision(); err != nil {
+			return err
+		}
+	}
+
+	// Load the request budgets of API keys
+	if m.Quota != nil {
+		if err := m.Quota.provision(m.logger); err != nil {
+			return err
+		}
+		m.Quota.Start()
+		m.logger.Info("API key quotas enabled",
+			zap.String("header", m.Quota.Header),
+			zap.String("source", m.Quota.Source),
+		)
+	}
+
+	// Load the IP type feeds
+	if m.IPType != nil {
+		if err := m.IPType.provision(ctx, m.logger); err != nil {
+			return err
+		}
+		m.IPType.Start()
+		m.logger.Info("IP type classification enabled",
+			zap.Int("feeds", len(m.IPType.Feeds)),
+			zap.String("provider", m.IPType.providerName),
+		)
+	}
+
+	// Load the CDN ranges allowed to reach the origin
+	if m.CDNOrigin != nil {
+		if m.CDNOrigin.StatusCode == 0 {
+			m.CDNOrigin.StatusCode = http.StatusForbidden
+		}
+		if err := m.CDNOrigin.provision(m.logger); err != nil {
+			return err
+		}
+		m.CDNOrigin.Start()
+		m.logger.Info("Direct-to-origin requests rejected",
+			zap.Strings("providers", m.CDNOrigin.Providers),
+			zap.Int("prefixes", len(m.CDNOrigin.Prefixes())),
+		)
+	}
+
+	// Cut off request bodies that arrive too slowly
+	if m.SlowClient != nil {
+		if m.SlowClient.Grace <= 0 {
+			m.SlowClient.Grace = defaultSlowBodyGrace
+		}
+		if m.SlowClient.BanDuration > 0 && m.Bans == nil {
+			return fmt.Errorf("slow_client ban requires the ban directive")
+		}
+	}
+
+	// Buffer at most this much of each response body, streaming the rest
+	if m.ResponseBufferLimit == 0 {
+		m.ResponseBufferLimit = defaultResponseBufferLimit
+	}
+	if m.ResponseDecompressLimit == 0 {
+		m.ResponseDecompressLimit = defaultResponseDecompressLimit
+	}
+
+	// Initialize rolling request counters
+	m.requestWindows = NewRequestWindows()
+
+	// Initialize per-host tenant state
+	if m.TenantByHost {
+		m.tenants = NewTenantRegistry(m.overlayHosts()...)
+		m.logger.Info("Multi-tenant mode enabled, state is scoped by request Host")
+	}
+
+	// Download missing MaxMind databases before they are loaded, then keep them up to date
+	if m.GeoIPUpdate != nil {
+		gu, err := NewGeoIPUpdater(m.logger, *m.GeoIPUpdate)
+		if err != nil {
+			return fmt.Errorf("failed to configure GeoIP updates: %w", err)
+		}
+		gu.UpdateMissing(ctx)
+		m.geoIPUpdater = gu
+		m.geoIPUpdater.Start()
+		m.logger.Info("GeoIP database updates scheduled",
+			zap.Strings("editions", gu.config.Editions),
+			zap.Duration("interval", gu.config.Interval),
+			zap.String("cache_dir", gu.config.CacheDir),
+		)
+	}
 
 	// Configure GeoIP-based country blacklisting/whitelisting
 	if m.CountryBlacklist.Enabled || m.CountryWhitelist.Enabled {
@@ -227,14 +562,18 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 			} else {
 				m.logger.Info("GeoIP database loaded successfully", zap.String("path", geoIPPath))
 				if m.CountryBlacklist.Enabled {
-					m.CountryBlacklist.geoIP = reader
+					m.CountryBlacklist.geoIP.Store(reader)
 				}
 				if m.CountryWhitelist.Enabled {
-					m.CountryWhitelist.geoIP = reader
+					m.CountryWhitelist.geoIP.Store(reader)
 				}
+				m.watchGeoIPDatabase(geoIPPath)
 			}
 		}
 	}
+	if m.GeoVelocity != nil && m.CountryBlacklist.geoIP.Load() == nil && m.CountryWhitelist.geoIP.Load() == nil {
+		m.logger.Warn("geo_velocity needs the GeoIP database of block_countries or whitelist_countries, impossible travel detection is disabled")
+	}
 
 	// Initialize config and blacklist loaders
 	m.configLoader = NewConfigLoader(m.logger)
@@ -242,8 +581,15 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 	m.geoIPHandler = NewGeoIPHandler(m.logger)
 	m.requestValueExtractor = NewRequestValueExtractor(m.logger, m.RedactSensitiveData)
 
-	// Configure GeoIP handler
-	m.geoIPHandler.WithGeoIPCache(m.geoIPCacheTTL)
+	// Configure GeoIP handler, caching per-IP GeoIP and blacklist lookups
+	cacheSize := 0
+	if m.LookupCache != nil {
+		cacheSize = m.LookupCache.Size
+		m.geoIPCacheTTL = m.LookupCache.TTL
+	}
+	m.geoIPHandler.WithGeoIPCache(m.geoIPCacheTTL, cacheSize)
+	m.geoIPCacheTTL = m.geoIPHandler.geoIPCacheTTL
+	m.ipBlacklistCache = newLookupCache[ipBlacklistVerdict](cacheSize, m.geoIPCacheTTL)
 	m.geoIPHandler.WithGeoIPLookupFallbackBehavior(m.geoIPLookupFallbackBehavior)
 
 	// Load configuration from Caddyfile
@@ -253,17 +599,30 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// Synchronize rules and blacklists from the configuration source
+	if m.ConfigSource != nil {
+		if err := m.provisionConfigSource(ctx); err != nil {
+			return fmt.Errorf("failed to configure config source: %w", err)
+		}
+	}
+
 	// Load IP blacklist
+	if err := m.blacklistLoader.WithIPPrefixes(m.IPBlacklistIPv4Prefix, m.IPBlacklistIPv6Prefix); err != nil {
+		return err
+	}
 	if m.IPBlacklistFile != "" {
-		m.ipBlacklist = iptrie.NewTrie()
-		err = m.loadIPBlacklist(m.IPBlacklistFile, *m.ipBlacklist)
+		m.ipBlacklist, err = m.loadIPBlacklist(m.IPBlacklistFile)
 		if err != nil {
 			return fmt.Errorf("failed to load IP blacklist: %w", err)
 		}
 	}
 
-	// Load DNS blacklist
-	if m.DNSBlacklistFile != "" {
+	// Load DNS blacklist, into an on-disk index if configured
+	if m.DNSBlacklistFile != "" && m.DNSBlacklistIndex != nil {
+		if err := m.loadDNSBlacklistIndex(m.DNSBlacklistFile); err != nil {
+			return err
+		}
+	} else if m.DNSBlacklistFile != "" {
 		m.dnsBlacklist = make(map[string]struct{})
 		err = m.loadDNSBlacklist(m.DNSBlacklistFile, m.dnsBlacklist)
 		if err != nil {
@@ -271,6 +630,109 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	// Load path blacklist
+	if m.PathBlacklistFile != "" {
+		m.pathBlacklist, err = m.loadPathBlacklist(m.PathBlacklistFile)
+		if err != nil {
+			return fmt.Errorf("failed to load path blacklist: %w", err)
+		}
+	}
+
+	// Load certificate blacklist
+	if m.CertBlacklistFile != "" {
+		m.certBlacklist, err = m.loadCertBlacklist(m.CertBlacklistFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate blacklist: %w", err)
+		}
+	}
+
+	if m.FalsePositives != nil {
+		if err := m.FalsePositives.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.ParamAnomaly != nil {
+		m.ParamAnomaly.provision()
+	}
+
+	if m.DecodeLayers != nil {
+		if err := m.DecodeLayers.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.Deserialization != nil {
+		if err := m.Deserialization.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.SSRF != nil {
+		if err := m.SSRF.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.OpenRedirect != nil {
+		if err := m.OpenRedirect.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.Smuggling != nil {
+		if err := m.Smuggling.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.CRLF != nil {
+		if err := m.CRLF.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.RequestDecompress != nil {
+		if err := m.RequestDecompress.provision(); err != nil {
+			return err
+		}
+	}
+
+	if m.BlockStatus != nil {
+		if err := m.BlockStatus.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := m.loadCustomResponses(); err != nil {
+		return err
+	}
+	m.watchCustomResponses()
+
+	if m.Learning != nil {
+		m.Learning.provision(m.logger)
+		m.logger.Info("Learning mode started",
+			zap.Duration("duration", m.Learning.Duration),
+			zap.String("output", m.Learning.Output),
+		)
+	}
+
+	// Track the rules added or changed by reloads before the first load
+	if m.RuleCanary != nil {
+		rc, err := newRuleCanary(*m.RuleCanary)
+		if err != nil {
+			return err
+		}
+		m.ruleCanary = rc
+		m.ruleCanary.Start(m.checkRuleCanaries)
+	}
+
+	// Track the rule matches before the first load
+	if m.RuleCoverage != nil {
+		m.ruleCoverage = newRuleCoverage(*m.RuleCoverage)
+		m.ruleCoverage.Start(m.logRuleCoverage)
+	}
+
 	// Load WAF rules - calling the new external loadRules function
 	if len(m.RuleFiles) > 0 { // Modified condition to check for rule files before loading
 		if err := m.loadRules(m.RuleFiles); err != nil {
@@ -278,13 +740,188 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		}
 	} else {
 		m.logger.Warn("No rule files specified, WAF will run without rules.") // Log a warning instead of error
+		m.mu.Lock()
+		err := m.buildHostOverlays()
+		m.resetRuleCoverage()
+		m.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to build host overlays: %w", err)
+		}
+	}
+
+	// Watch the configuration source for changes
+	if m.configSource != nil {
+		m.configSource.Start(m.onConfigSourceChange)
+	}
+
+	// Start chat notifiers
+	if len(m.Notifiers) > 0 {
+		nm, err := NewNotificationManager(m.logger, m.Notifiers)
+		if err != nil {
+			return fmt.Errorf("failed to configure notifiers: %w", err)
+		}
+		m.notificationManager = nm
+		m.notificationManager.Start()
+		m.logger.Info("Notifiers configured", zap.Int("count", len(m.Notifiers)))
+	}
+
+	// Configure email alerts
+	if m.EmailAlert != nil {
+		ea, err := NewEmailAlerter(m.logger, *m.EmailAlert)
+		if err != nil {
+			return fmt.Errorf("failed to configure email alerts: %w", err)
+		}
+		m.emailAlerter = ea
+		m.logger.Info("Email alerts configured", zap.String("smtp_server", m.EmailAlert.SMTPServer))
+	}
+
+	// Open the CEF/LEEF output
+	if m.SIEMOutput != nil {
+		sw, err := NewSIEMWriter(m.logger, *m.SIEMOutput)
+		if err != nil {
+			return fmt.Errorf("failed to configure SIEM output: %w", err)
+		}
+		m.siemWriter = sw
+		m.logger.Info("SIEM output configured", zap.String("format", m.SIEMOutput.Format), zap.String("output", m.SIEMOutput.Output))
+	}
+
+	// Open the fail2ban output
+	if m.Fail2banOutput != "" {
+		fw, err := NewFail2banWriter(m.logger, m.Fail2banOutput)
+		if err != nil {
+			return fmt.Errorf("failed to configure fail2ban output: %w", err)
+		}
+		m.fail2banWriter = fw
+		m.logger.Info("fail2ban output configured", zap.String("output", m.Fail2banOutput))
+	}
+
+	// Open the blocked-event store
+	if m.EventStore != nil {
+		es, err := NewEventStore(m.logger, *m.EventStore)
+		if err != nil {
+			return fmt.Errorf("failed to configure event store: %w", err)
+		}
+		m.eventStore = es
+		m.eventStore.Start()
+		m.logger.Info("Event store configured", zap.String("path", m.EventStore.Path), zap.Duration("retention", es.config.Retention))
 	}
 
+	// Enable dynamic bans and their propagation to peers
+	if m.Bans != nil {
+		m.banList = NewBanList(*m.Bans)
+		if m.Bans.Propagation != nil {
+			bp, err := NewBanPropagator(m.logger, *m.Bans.Propagation)
+			if err != nil {
+				return fmt.Errorf("failed to configure ban propagation: %w", err)
+			}
+			m.banPropagator = bp
+			m.banPropagator.Start(m.applyPeerBan)
+		}
+		m.logger.Info("Dynamic bans enabled",
+			zap.Int("threshold", m.banList.config.Threshold),
+			zap.Duration("window", m.banList.config.Window),
+			zap.Duration("duration", m.banList.config.Duration),
+			zap.Bool("propagation", m.banPropagator != nil),
+		)
+	}
+
+	// Mirror the bans into an nftables or ipset set
+	if m.BanExport != nil {
+		if m.banList == nil {
+			return fmt.Errorf("ban_export requires the ban directive")
+		}
+		be, err := NewBanExporter(m.logger, *m.BanExport, m.banList)
+		if err != nil {
+			return fmt.Errorf("failed to configure ban export: %w", err)
+		}
+		m.banExporter = be
+		m.banExporter.Start()
+		m.logger.Info("Ban export configured", zap.String("format", be.config.Format), zap.String("file", be.config.File))
+	}
+
+	// Join the cluster
+	if m.Cluster != nil {
+		c, err := NewCluster(m.logger, *m.Cluster)
+		if err != nil {
+			return fmt.Errorf("failed to configure cluster: %w", err)
+		}
+		m.cluster = c
+		if m.banList != nil {
+			m.banList.origin = c.config.Node
+		}
+		if m.rateLimiter != nil {
+			m.rateLimiter.enableDeltas()
+		}
+		m.cluster.Start(m.collectClusterState, m.applyClusterMessage)
+		m.logger.Info("Cluster synchronization enabled",
+			zap.String("node", c.config.Node),
+			zap.Strings("peers", c.config.Peers),
+			zap.Bool("backend", c.pubsub != nil),
+			zap.Duration("sync_interval", c.config.SyncInterval),
+		)
+	}
+
+	// Prepare endpoint authentication
+	if m.EndpointAuth != nil {
+		if err := m.EndpointAuth.provision(); err != nil {
+			return fmt.Errorf("failed to configure endpoint authentication: %w", err)
+		}
+		m.logger.Info("Endpoint authentication enabled",
+			zap.Bool("token", m.EndpointAuth.Token != ""),
+			zap.Bool("basic_auth", m.EndpointAuth.Username != ""),
+			zap.Strings("allowed_ips", m.EndpointAuth.AllowedIPs),
+		)
+	}
+
+	// Keep the traces of the recent blocked requests
+	if m.Explain != nil {
+		m.transactions = newTransactionLog(m.Explain.Size)
+	}
+
+	// Register admin API routes, which change bans, lockdown, metrics and state: refuse to
+	// expose them to anyone reaching the path
+	if m.AdminAPI != "" {
+		if m.EndpointAuth == nil {
+			return fmt.Errorf("admin_api requires endpoint_auth")
+		}
+		m.apiRoutes = m.registerAPIRoutes()
+		m.offenderTracker = NewOffenderTracker()
+		m.logger.Info("Admin API enabled", zap.String("prefix", m.AdminAPI))
+	}
+
+	// Export the statistics periodically
+	if m.StatsExport != nil {
+		if m.offenderTracker == nil {
+			m.offenderTracker = NewOffenderTracker()
+		}
+		se, err := NewStatsExporter(m.logger, *m.StatsExport, m.statsSnapshot)
+		if err != nil {
+			return fmt.Errorf("failed to configure stats export: %w", err)
+		}
+		m.statsExporter = se
+		m.statsExporter.Start()
+		m.logger.Info("Stats export configured", zap.String("output", se.config.Output), zap.Duration("interval", se.config.Interval))
+	}
+
+	// Restore the rule hits last, so that a failed provisioning leaves them to the running instance
+	m.restoreRuleHits()
+
 	m.logger.Info("WAF middleware provisioned successfully")
 	return nil
 }
 
+// Shutdown tears the middleware down outside of Caddy, as Cleanup does.
 func (m *Middleware) Shutdown(ctx context.Context) error {
+	return m.Cleanup()
+}
+
+// Cleanup stops the background workers and closes the connections and files of the
+// middleware when Caddy stops or replaces the configuration, and saves the rule hits.
+// Caddy also calls it after a failed Provision, so each resource may be missing.
+func (m *Middleware) Cleanup() error {
+	if m.logger == nil {
+		return nil
+	}
 	m.logger.Info("Starting WAF middleware shutdown procedures")
 	m.isShuttingDown = true
 
@@ -297,6 +934,116 @@ func (m *Middleware) Shutdown(ctx context.Context) error {
 		m.logger.Debug("Rate limiter is nil, no cleanup signaling needed.")
 	}
 
+	// Stop ending rule canaries, which alert through the notification dispatcher
+	if m.ruleCanary != nil {
+		m.ruleCanary.Stop()
+	}
+	if m.ruleCoverage != nil {
+		m.ruleCoverage.Stop()
+	}
+
+	// Stop the notification dispatcher
+	if m.notificationManager != nil {
+		m.logger.Debug("Stopping notification dispatcher...")
+		m.notificationManager.Stop()
+		m.notificationManager = nil
+	}
+
+	// Close the SIEM output
+	if m.siemWriter != nil {
+		if err := m.siemWriter.Close(); err != nil {
+			m.logger.Error("Error closing SIEM output", zap.Error(err))
+		}
+		m.siemWriter = nil
+	}
+
+	// Close the fail2ban output
+	if m.fail2banWriter != nil {
+		if err := m.fail2banWriter.Close(); err != nil {
+			m.logger.Error("Error closing fail2ban output", zap.Error(err))
+		}
+		m.fail2banWriter = nil
+	}
+
+	// Stop reloading the API key quotas
+	if m.Quota != nil {
+		m.Quota.Stop()
+	}
+
+	// Stop reloading the IP type feeds
+	if m.IPType != nil {
+		m.IPType.Stop()
+	}
+
+	// Close the connections of the shared replay stores
+	for _, config := range m.Replay {
+		if config.Redis != nil {
+			config.Redis.close()
+		}
+	}
+
+	// Stop the lockdown rate limiter cleanup
+	if m.Lockdown != nil {
+		m.Lockdown.stop()
+	}
+	if m.Learning != nil {
+		m.Learning.stop()
+	}
+
+	// Stop reloading the CDN ranges
+	if m.CDNOrigin != nil {
+		m.CDNOrigin.Stop()
+	}
+
+	// Stop watching the configuration source
+	if m.configSource != nil {
+		m.configSource.Stop()
+		m.configSource = nil
+	}
+
+	// Leave the cluster
+	if m.cluster != nil {
+		m.cluster.Stop()
+		m.cluster = nil
+	}
+
+	// Stop propagating bans
+	if m.banPropagator != nil {
+		m.banPropagator.Stop()
+		m.banPropagator = nil
+	}
+	if m.banExporter != nil {
+		m.banExporter.Stop()
+		m.banExporter = nil
+	}
+
+	// Export the statistics one last time
+	if m.statsExporter != nil {
+		m.statsExporter.Stop()
+		m.statsExporter = nil
+	}
+
+	// Flush and close the event store
+	if m.eventStore != nil {
+		if err := m.eventStore.Close(); err != nil {
+			m.logger.Error("Error closing event store", zap.Error(err))
+		}
+		m.eventStore = nil
+	}
+
+	// Close the DNS blacklist index
+	if m.dnsBlacklistIndex != nil {
+		if err := m.dnsBlacklistIndex.Close(); err != nil {
+			m.logger.Error("Error closing DNS blacklist index", zap.Error(err))
+		}
+		m.dnsBlacklistIndex = nil
+	}
+
+	// Log the last aggregated rule entries
+	if m.logDeduper != nil {
+		m.logDeduper.Stop()
+	}
+
 	// Stop the asynchronous logging worker
 	m.logger.Debug("Stopping logging worker...")
 	m.StopLogWorker()
@@ -304,36 +1051,50 @@ func (m *Middleware) Shutdown(ctx context.Context) error {
 
 	var firstError error
 
-	// Close GeoIP databases
-	if m.CountryBlacklist.geoIP != nil {
-		m.logger.Debug("Closing country blacklist GeoIP database...")
-		if err := m.CountryBlacklist.geoIP.Close(); err != nil {
-			m.logger.Error("Error encountered while closing country blacklist GeoIP database", zap.Error(err))
-			firstError = fmt.Errorf("error closing country blacklist GeoIP: %w", err)
-		} else {
-			m.logger.Debug("Country blacklist GeoIP database closed successfully.")
-		}
-		m.CountryBlacklist.geoIP = nil
-	} else {
-		m.logger.Debug("Country blacklist GeoIP database was not open, skipping close.")
+	// Stop the GeoIP database updates
+	if m.geoIPUpdater != nil {
+		m.geoIPUpdater.Stop()
+		m.geoIPUpdater = nil
 	}
 
-	if m.CountryWhitelist.geoIP != nil {
-		m.logger.Debug("Closing country whitelist GeoIP database...")
-		if err := m.CountryWhitelist.geoIP.Close(); err != nil {
-			m.logger.Error("Error encountered while closing country whitelist GeoIP database", zap.Error(err))
+	// Stop watching the GeoIP database
+	if m.geoIPWatchStop != nil {
+		close(m.geoIPWatchStop)
+		m.geoIPWatchStop = nil
+	}
+
+	// Stop watching the custom response files
+	if m.customResponseWatchStop != nil {
+		close(m.customResponseWatchStop)
+		m.customResponseWatchStop = nil
+	}
+
+	// Close the GeoIP database, shared by the country filters
+	blacklistGeoIP := m.CountryBlacklist.geoIP.Swap(nil)
+	whitelistGeoIP := m.CountryWhitelist.geoIP.Swap(nil)
+	if whitelistGeoIP == blacklistGeoIP {
+		whitelistGeoIP = nil
+	}
+	for _, reader := range []*maxminddb.Reader{blacklistGeoIP, whitelistGeoIP} {
+		if reader == nil {
+			continue
+		}
+		m.logger.Debug("Closing GeoIP database...")
+		if err := reader.Close(); err != nil {
+			m.logger.Error("Error encountered while closing GeoIP database", zap.Error(err))
 			if firstError == nil {
-				firstError = fmt.Errorf("error closing country whitelist GeoIP: %w", err)
+				firstError = fmt.Errorf("error closing GeoIP database: %w", err)
 			}
-		} else {
-			m.logger.Debug("Country whitelist GeoIP database closed successfully.")
 		}
-		m.CountryWhitelist.geoIP = nil
-	} else {
-		m.logger.Debug("Country whitelist GeoIP database was not open, skipping close.")
 	}
 
-	// Log rule hit statistics
+	// Save and log rule hit statistics
+	if err := m.saveRuleHits(); err != nil {
+		m.logger.Error("Error saving rule hits", zap.Error(err))
+		if firstError == nil {
+			firstError = err
+		}
+	}
 	m.logger.Info("Rule Hit Statistics:")
 	m.ruleHits.Range(func(key, value interface{}) bool {
 		ruleID, ok := key.(RuleID)
@@ -381,6 +1142,7 @@ func (m *Middleware) startFileWatcher(filePaths []string) {
 			watcher, err := fsnotify.NewWatcher()
 			if err != nil {
 				m.logger.Error("Failed to start file watcher", zap.Error(err))
+				m.recordWatch(file, false, false, err)
 				return
 			}
 			defer watcher.Close()
@@ -388,8 +1150,10 @@ func (m *Middleware) startFileWatcher(filePaths []string) {
 			err = watcher.Add(file)
 			if err != nil {
 				m.logger.Error("Failed to watch file", zap.String("file", file), zap.Error(err))
+				m.recordWatch(file, false, false, err)
 				return
 			}
+			m.recordWatch(file, true, false, nil)
 
 			for {
 				select {
@@ -397,11 +1161,13 @@ func (m *Middleware) startFileWatcher(filePaths []string) {
 					if event.Op&fsnotify.Write == fsnotify.Write {
 						m.logger.Info("Detected configuration change. Reloading...", zap.String("file", file))
 						if strings.Contains(file, "rule") {
-							if err := m.ReloadRules(); err != nil {
+							err := m.ReloadRules()
+							if err != nil {
 								m.logger.Error("Failed to reload rules after change", zap.String("file", file), zap.Error(err))
 							} else {
 								m.logger.Info("Rules reloaded successfully", zap.String("file", file))
 							}
+							m.recordWatch(file, true, true, err)
 						} else {
 							err := m.ReloadConfig()
 							if err != nil {
@@ -409,10 +1175,12 @@ func (m *Middleware) startFileWatcher(filePaths []string) {
 							} else {
 								m.logger.Info("Configuration reloaded successfully")
 							}
+							m.recordWatch(file, true, true, err)
 						}
 					}
 				case err := <-watcher.Errors:
 					m.logger.Error("File watcher error", zap.Error(err))
+					m.recordWatch(file, true, false, err)
 				}
 			}
 		}(path)
@@ -420,9 +1188,7 @@ func (m *Middleware) startFileWatcher(filePaths []string) {
 }
 
 func (m *Middleware) ReloadRules() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
+	// loadRules holds m.mu while it replaces the rules
 	m.logger.Info("Reloading WAF rules")
 	// Call the external loadRules function
 	if err := m.loadRules(m.RuleFiles); err != nil {
@@ -440,14 +1206,19 @@ func (m *Middleware) ReloadConfig() error {
 
 	m.logger.Info("Reloading WAF configuration")
 	if m.IPBlacklistFile != "" {
-		newIPBlacklist := iptrie.NewTrie()
-		if err := m.loadIPBlacklist(m.IPBlacklistFile, *newIPBlacklist); err != nil {
+		newIPBlacklist, err := m.loadIPBlacklist(m.IPBlacklistFile)
+		if err != nil {
 			m.logger.Error("Failed to reload IP blacklist", zap.String("file", m.IPBlacklistFile), zap.Error(err))
 			return fmt.Errorf("failed to reload IP blacklist: %v", err)
 		}
 		m.ipBlacklist = newIPBlacklist
 	}
-	if m.DNSBlacklistFile != "" {
+	if m.DNSBlacklistFile != "" && m.DNSBlacklistIndex != nil {
+		if err := m.loadDNSBlacklistIndex(m.DNSBlacklistFile); err != nil {
+			m.logger.Error("Failed to reload DNS blacklist", zap.String("file", m.DNSBlacklistFile), zap.Error(err))
+			return fmt.Errorf("failed to reload DNS blacklist: %v", err)
+		}
+	} else if m.DNSBlacklistFile != "" {
 		newDNSBlacklist := make(map[string]struct{})
 		if err := m.loadDNSBlacklist(m.DNSBlacklistFile, newDNSBlacklist); err != nil {
 			m.logger.Error("Failed to reload DNS blacklist", zap.String("file", m.DNSBlacklistFile), zap.Error(err))
@@ -455,6 +1226,28 @@ func (m *Middleware) ReloadConfig() error {
 		}
 		m.dnsBlacklist = newDNSBlacklist
 	}
+	if m.PathBlacklistFile != "" {
+		newPathBlacklist, err := m.loadPathBlacklist(m.PathBlacklistFile)
+		if err != nil {
+			m.logger.Error("Failed to reload path blacklist", zap.String("file", m.PathBlacklistFile), zap.Error(err))
+			return fmt.Errorf("failed to reload path blacklist: %v", err)
+		}
+		m.pathBlacklist = newPathBlacklist
+	}
+	if m.CertBlacklistFile != "" {
+		newCertBlacklist, err := m.loadCertBlacklist(m.CertBlacklistFile)
+		if err != nil {
+			m.logger.Error("Failed to reload certificate blacklist", zap.String("file", m.CertBlacklistFile), zap.Error(err))
+			return fmt.Errorf("failed to reload certificate blacklist: %v", err)
+		}
+		m.certBlacklist = newCertBlacklist
+	}
+	if m.OpenAPI != nil {
+		if err := m.reloadOpenAPI(); err != nil {
+			m.logger.Error("Failed to reload OpenAPI spec", zap.String("file", m.OpenAPI.Spec), zap.Error(err))
+			return fmt.Errorf("failed to reload OpenAPI spec: %v", err)
+		}
+	}
 
 	// Call the external loadRules function
 	if err := m.loadRules(m.RuleFiles); err != nil {
@@ -466,28 +1259,20 @@ func (m *Middleware) ReloadConfig() error {
 	return nil
 }
 
-func (m *Middleware) loadIPBlacklist(path string, blacklistMap iptrie.Trie) error {
+// loadIPBlacklist loads the IP blacklist file into a new trie, recording its load statistics.
+func (m *Middleware) loadIPBlacklist(path string) (*iptrie.Trie, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		m.logger.Warn("Skipping IP blacklist load, file does not exist", zap.String("file", path))
-		return nil
+		return iptrie.NewTrie(), nil
 	}
 
-	blacklist := make(map[string]struct{})
-	err := m.blacklistLoader.LoadIPBlacklistFromFile(path, blacklist)
+	blacklist, stats, err := m.blacklistLoader.LoadIPBlacklist(path)
 	if err != nil {
-		return fmt.Errorf("failed to load IP blacklist: %w", err)
+		return nil, fmt.Errorf("failed to load IP blacklist: %w", err)
 	}
-
-	// Convert the map to CIDRTrie
-	for ip := range blacklist {
-		prefix, err := netip.ParsePrefix(appendCIDR(ip))
-		if err != nil {
-			m.logger.Warn("Skipping invalid IP in blacklist", zap.String("ip", ip), zap.Error(err))
-			continue
-		}
-		blacklistMap.Insert(prefix, nil)
-	}
-	return nil
+	m.ipBlacklistEntries.Store(int64(stats.Prefixes))
+	m.ipBlacklistLoad.Store(&stats)
+	return blacklist, nil
 }
 
 func (m *Middleware) loadDNSBlacklist(path string, blacklistMap map[string]struct{}) error {
@@ -524,16 +1309,16 @@ func (m *Middleware) getRuleHitStats() map[string]int {
 	return stats
 }
 
-func (m *Middleware) handleMetricsRequest(w http.ResponseWriter, r *http.Request) error {
-	m.logger.Debug("Handling metrics request", zap.String("path", r.URL.Path))
-	w.Header().Set("Content-Type", "application/json")
-
+// metricsSnapshot collects the counters served by the metrics endpoint.
+func (m *Middleware) metricsSnapshot() map[string]interface{} {
 	// Get rate limiter metrics
 	var rateLimiterTotalRequests int64
 	var rateLimiterBlockedRequests int64
+	rateLimiterZones := map[string]ZoneMetrics{}
 	if m.rateLimiter != nil {
 		rateLimiterTotalRequests = m.rateLimiter.GetTotalRequests()
 		rateLimiterBlockedRequests = m.rateLimiter.GetBlockedRequests()
+		rateLimiterZones = m.rateLimiter.GetZoneMetrics()
 	}
 
 	// Collect rule hits using getRuleHitStats
@@ -545,15 +1330,105 @@ func (m *Middleware) handleMetricsRequest(w http.ResponseWriter, r *http.Request
 		"blocked_requests":              m.blockedRequests,
 		"allowed_requests":              m.allowedRequests,
 		"rule_hits":                     ruleHits,
-		"rule_hits_by_phase":            m.ruleHitsByPhase,          // Include rule hits by phase
-		"geoip_blocked":                 m.geoIPBlocked,             // Add the new geoIPBlocked metric
-		"ip_blacklist_hits":             m.IPBlacklistBlockCount,    // Add IP blacklist hits metric
-		"dns_blacklist_hits":            m.DNSBlacklistBlockCount,   // Add DNS blacklist hits metric
-		"rate_limiter_requests":         rateLimiterTotalRequests,   // Add rate limiter total requests
-		"rate_limiter_blocked_requests": rateLimiterBlockedRequests, // Add rate limiter blocked requests
+		"rule_hits_by_phase":            m.ruleHitsByPhase,            // Include rule hits by phase
+		"geoip_blocked":                 m.geoIPBlocked,               // Add the new geoIPBlocked metric
+		"geoip_stats":                   m.getGeoIPStats(),            // GeoIP decisions per country
+		"ip_blacklist_hits":             m.IPBlacklistBlockCount,      // Add IP blacklist hits metric
+		"dns_blacklist_hits":            m.DNSBlacklistBlockCount,     // Add DNS blacklist hits metric
+		"path_blacklist_hits":           m.pathBlacklistHits.Load(),   // Requests blocked by the path blacklist
+		"cert_blacklist_hits":           m.certBlacklistHits.Load(),   // Requests blocked by the certificate blacklist
+		"credential_stuffing_hits":      m.stuffingHits.Load(),        // Login attempts of clients stuffing credentials
+		"challenges_issued":             m.challengesIssued.Load(),    // Challenge pages served
+		"geo_velocity_hits":             m.geoVelocityHits.Load(),     // Requests of sessions or users travelling impossibly fast
+		"slow_body_hits":                m.slowBodyHits.Load(),        // Requests cut off for trickling their body
+		"concurrency_limit_hits":        m.concurrencyHits.Load(),     // Requests over the in-flight limits
+		"replay_hits":                   m.replayHits.Load(),          // Duplicates of recently seen requests
+		"quota_exceeded":                m.quotaHits.Load(),           // Requests over the budget of their API key
+		"cost_limit_hits":               m.costLimitHits.Load(),       // Requests over the cost budget of their client
+		"bot_score_hits":                m.botScoreHits.Load(),        // Requests reaching the bot score threshold
+		"reputation_hits":               m.reputationHits.Load(),      // Requests of clients with a bad reputation
+		"inspector_hits":                m.inspectorHits.Load(),       // Requests scored or blocked by inspectors
+		"icap_hits":                     m.icapHits.Load(),            // Requests or responses blocked by the ICAP service
+		"malware_blocked":               m.malwareBlocked.Load(),      // Uploads blocked for carrying malware
+		"yara_hits":                     m.yaraHits.Load(),            // Requests matching YARA rules
+		"direct_origin_blocked":         m.directOriginBlocked.Load(), // Requests bypassing the CDN
+		"lockdown_hits":                 m.lockdownHits.Load(),        // Requests challenged or rate limited by the lockdown
+		"false_positive_reports":        m.fpReports.Load(),           // Block events reported as false positives
+		"param_anomalies":               m.paramAnomalies.Load(),      // Parameters scored for deviating from their baseline
+		"decoded_matches":               m.decodedMatches.Load(),      // Rule matches found only in a decoded layer
+		"deserialization_hits":          m.deserializationHits.Load(), // Requests carrying serialized objects
+		"ssrf_hits":                     m.ssrfHits.Load(),            // Requests with URLs pointing at internal destinations
+		"open_redirect_hits":            m.openRedirectHits.Load(),    // Requests with URLs redirecting to hosts not allowed
+		"smuggling_hits":                m.smugglingHits.Load(),       // Requests with request smuggling indicators
+		"crlf_hits":                     m.crlfHits.Load(),            // Requests with injected line breaks or null bytes
+		"request_encoding_hits":         m.requestEncodingHits.Load(), // Encoded request bodies rejected or failing to decompress
+		"upload_policy_hits":            m.uploadPolicyHits.Load(),    // Uploads breaking the upload policy
+		"body_size_hits":                m.bodySizeHits.Load(),        // Requests over their body size limit
+		"hotlink_hits":                  m.hotlinkHits.Load(),         // Requests for static files embedded by other sites
+		"signed_url_hits":               m.signedURLHits.Load(),       // Requests to protected paths without a valid URL signature
+		"request_signing_hits":          m.requestSigningHits.Load(),  // API requests unsigned, stale or with an invalid signature
+		"graphql_hits":                  m.graphQLHits.Load(),         // GraphQL introspection queries and oversized batches
+		"rpc_hits":                      m.rpcHits.Load(),             // RPC calls with oversized messages or invalid metadata
+		"xxe_hits":                      m.xxeHits.Load(),             // XML bodies with DOCTYPE, entity or expansion constructs
+		"rate_limiter_requests":         rateLimiterTotalRequests,     // Add rate limiter total requests
+		"rate_limiter_blocked_requests": rateLimiterBlockedRequests,   // Add rate limiter blocked requests
+		"rate_limiter_by_path":          rateLimiterZones,             // Rate limiter requests and blocks per configured path
+		"log_dropped_events":            m.LogDropped(),               // Log entries dropped by the log_overflow policy
 		"version":                       wafVersion,
 	}
 
+	// Include rolling request counts and rates
+	if m.requestWindows != nil {
+		metrics["windows"] = m.requestWindows.Stats(time.Now())
+	}
+
+	// Include per-tenant counters in multi-tenant mode
+	if m.tenants != nil {
+		metrics["tenants"] = m.tenants.Metrics()
+	}
+
+	// Include cluster synchronization counters
+	if m.cluster != nil {
+		metrics["cluster"] = m.cluster.Stats()
+	}
+
+	// Include inspection pool usage
+	if m.inspectionPool != nil {
+		metrics["inspection_pool"] = m.inspectionPool.Stats()
+	}
+
+	// Include the requests that exceeded their inspection budget
+	if m.InspectionBudget != nil {
+		metrics["inspection_budget"] = m.BudgetMetrics()
+	}
+
+	// Include GeoIP and IP blacklist lookup cache usage
+	if m.geoIPHandler != nil && m.geoIPHandler.geoIPCache != nil {
+		metrics["lookup_cache"] = map[string]LookupCacheStats{
+			"geoip":        m.geoIPHandler.geoIPCache.Stats(),
+			"ip_blacklist": m.ipBlacklistCache.Stats(),
+		}
+	}
+
+	// Include the requests per client IP type
+	if m.IPType != nil && m.IPType.requests != nil {
+		metrics["ip_types"] = m.IPType.Metrics()
+	}
+
+	// Include evaluation latency percentiles when enabled
+	if m.latencyTracker != nil {
+		metrics["phase_latency"] = m.latencyTracker.PhaseSummaries()
+		metrics["rule_latency"] = m.latencyTracker.RuleSummaries()
+	}
+	return metrics
+}
+
+func (m *Middleware) handleMetricsRequest(w http.ResponseWriter, r *http.Request) error {
+	m.logger.Debug("Handling metrics request", zap.String("path", r.URL.Path))
+	w.Header().Set("Content-Type", "application/json")
+
+	metrics := m.metricsSnapshot()
+
 	jsonMetrics, err := json.Marshal(metrics)
 	if err != nil {
 		m.logger.Error("Failed to marshal metrics to JSON", zap.Error(err))
@@ -575,6 +1450,66 @@ func (m *Middleware) extractValue(target string, r *http.Request, w http.Respons
 	return m.requestValueExtractor.ExtractValue(target, r, w)
 }
 
+// extractTarget returns the value of a rule target, extracting it only the first time
+// a rule of the request references it. BODY and JSON_PATH targets share a single read
+// of the request body. Response targets are only memoized once the response exists.
+func (m *Middleware) extractTarget(target string, r *http.Request, w http.ResponseWriter, state *WAFState) (string, error) {
+	if cached, ok := state.targets[target]; ok {
+		return cached.value, cached.err
+	}
+	if w == nil && strings.HasPrefix(strings.ToUpper(target), "RESPONSE_") {
+		return m.extractValue(target, r, w)
+	}
+
+	if value, ok := m.botTarget(target, r, state); ok {
+		return value, nil
+	}
+	if value, ok := m.ipTypeTarget(target, r, state); ok {
+		return value, nil
+	}
+	if value, ok := m.reputationTarget(target, r, state); ok {
+		return value, nil
+	}
+	if value, ok := m.introspectionTarget(target, r, state); ok {
+		return value, nil
+	}
+	if value, ok := varTarget(target, state); ok {
+		return value, nil
+	}
+
+	var value string
+	var err error
+	if len(target) > len(TargetJSONPathPrefix) && strings.EqualFold(target[:len(TargetJSONPathPrefix)], TargetJSONPathPrefix) {
+		var body string
+		if body, err = m.extractTarget(TargetBody, r, w, state); err == nil {
+			value, err = m.requestValueExtractor.extractJSONPath(body, target[len(TargetJSONPathPrefix):])
+		}
+	} else if protocol := rpcProtocolOf(r); isBodyTarget(target) && rpcStreamsRequest(protocol) {
+		value = "" // Reading a streamed RPC body would wait for the end of the call
+	} else if isBodyTarget(target) {
+		original := r.Body
+		limited := m.limitBody(r)
+		value, err = m.extractValue(target, r, w)
+		if limited {
+			// Past the budget, the upstream handler still gets the rest of the body
+			r.Body = newReplayBody(value, original)
+		}
+		if err == nil {
+			// The messages of RPC bodies are inspected rather than their framing
+			value, state.rpcMessageSize = decodeRPCBody(protocol, value)
+			value = m.truncateBody(value, state)
+		}
+	} else {
+		value, err = m.extractValue(target, r, w)
+	}
+
+	if state.targets == nil {
+		state.targets = make(map[string]extractedTarget)
+	}
+	state.targets[target] = extractedTarget{value: value, err: err}
+	return value, err
+}
+
 // ==================== Unimplemented Functions ====================
 
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -5,9 +5,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -49,6 +53,62 @@ func TestMiddleware_Provision(t *testing.T) {
 	assert.NotNil(t, m.Rules)
 }
 
+func TestMiddleware_Cleanup(t *testing.T) {
+	dir := t.TempDir()
+	rules := writeRuleFile(t, dir)
+
+	m := &Middleware{
+		RuleFiles:   []string{rules},
+		RateLimit:   RateLimit{Requests: 10, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true},
+		LogFilePath: filepath.Join(dir, "waf.json"),
+	}
+	require.NoError(t, m.Provision(caddy.Context{Context: context.Background()}))
+	require.NotNil(t, m.rateLimiter)
+
+	require.NoError(t, m.Cleanup())
+	select {
+	case <-m.rateLimiter.stopCleanup:
+	default:
+		t.Error("the rate limiter cleanup is still running")
+	}
+	select {
+	case <-m.logDone:
+	default:
+		t.Error("the log worker is still running")
+	}
+	assert.NotPanics(t, func() { m.logRequest(zapcore.InfoLevel, "late request", nil) }, "requests finishing after the cleanup")
+	assert.NoError(t, m.Cleanup(), "cleaned up twice")
+
+	// Caddy cleans up an instance whose provisioning failed
+	m = &Middleware{
+		RuleFiles:   []string{rules},
+		RateLimit:   RateLimit{Requests: 10, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true},
+		LogFilePath: filepath.Join(dir, "waf.json"),
+		Lockdown:    &LockdownConfig{},
+		GraphQL:     &GraphQLConfig{},
+	}
+	require.Error(t, m.Provision(caddy.Context{Context: context.Background()}))
+	assert.NotPanics(t, func() { _ = m.Cleanup() })
+}
+
+func TestMiddleware_ProvisionAdminAPI(t *testing.T) {
+	dir := t.TempDir()
+	m := &Middleware{RuleFiles: []string{writeRuleFile(t, dir)}, LogFilePath: filepath.Join(dir, "waf.json"), AdminAPI: defaultAdminAPIPrefix}
+	err := m.Provision(caddy.Context{Context: context.Background()})
+	assert.ErrorContains(t, err, "endpoint_auth", "the admin API is never left open")
+	_ = m.Cleanup()
+
+	m = &Middleware{
+		RuleFiles:    []string{writeRuleFile(t, dir)},
+		LogFilePath:  filepath.Join(dir, "waf.json"),
+		AdminAPI:     defaultAdminAPIPrefix,
+		EndpointAuth: &EndpointAuthConfig{Token: "s3cret"},
+	}
+	require.NoError(t, m.Provision(caddy.Context{Context: context.Background()}))
+	assert.NotEmpty(t, m.apiRoutes)
+	assert.NoError(t, m.Cleanup())
+}
+
 // MockGeoIPReader is a mock implementation of GeoIP reader for testing
 type MockGeoIPReader struct{}
 
@@ -146,6 +206,36 @@ func TestResponseRecorder_Write_WithCustomStatusCode(t *testing.T) {
 	assert.Equal(t, "Access Denied", rr.BodyString())
 }
 
+func TestResponseRecorder_Write_StreamsPastLimit(t *testing.T) {
+	w := httptest.NewRecorder()
+	rr := NewResponseRecorder(w)
+	rr.limit = 8
+
+	// Writes up to the limit are only buffered
+	_, err := rr.Write([]byte("Hello"))
+	assert.NoError(t, err)
+	assert.False(t, rr.Streamed())
+	assert.Empty(t, w.Body.String())
+
+	// Going past the limit flushes the buffer and streams the rest
+	n, err := rr.Write([]byte(", World!"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.True(t, rr.Streamed())
+	assert.Equal(t, "Hello, World!", w.Body.String())
+	assert.Equal(t, "Hello, W", rr.BodyString(), "only the prefix is kept for inspection")
+
+	_, err = rr.Write([]byte(" Bye."))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, World! Bye.", w.Body.String())
+
+	// Once sealed, writes to a streamed response are dropped
+	rr.seal()
+	_, err = rr.Write([]byte("blocked"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, World! Bye.", w.Body.String())
+}
+
 func TestResponseRecorder_Write_EmptyBody(t *testing.T) {
 	// Create a new ResponseRecorder
 	rr := NewResponseRecorder(httptest.NewRecorder())
@@ -0,0 +1,353 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/phemmer/go-iptrie"
+	"go.uber.org/zap"
+)
+
+// CDN providers publishing the IP ranges of their edge servers.
+const (
+	CDNCloudflare = "cloudflare"
+	CDNFastly     = "fastly"
+	CDNCloudFront = "cloudfront"
+)
+
+// cdnRangeURLs are the published range lists of the providers, replaced by tests.
+var cdnRangeURLs = map[string]string{
+	CDNCloudflare: "https://api.cloudflare.com/client/v4/ips",
+	CDNFastly:     "https://api.fastly.com/public-ip-list",
+	CDNCloudFront: "https://ip-ranges.amazonaws.com/ip-ranges.json",
+}
+
+const (
+	defaultCDNRefresh = 24 * time.Hour
+	maxCDNRangesSize  = 16 << 20
+	cdnHTTPTimeout    = time.Minute
+	cdnOriginRuleID   = "cdn_origin_rule"
+)
+
+func init() {
+	caddy.RegisterModule(&CDNIPRange{})
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner       = (*CDNIPRange)(nil)
+	_ caddy.CleanerUpper      = (*CDNIPRange)(nil)
+	_ caddyfile.Unmarshaler   = (*CDNIPRange)(nil)
+	_ caddyhttp.IPRangeSource = (*CDNIPRange)(nil)
+)
+
+// CDNRanges holds the edge IP ranges of CDN providers, downloaded from their published
+// lists and reloaded every Refresh, plus static ranges such as those of a load balancer.
+type CDNRanges struct {
+	Providers []string      `json:"providers,omitempty"` // cloudflare, fastly or cloudfront
+	Ranges    []string      `json:"ranges,omitempty"`    // Extra IPs and CIDR ranges
+	Refresh   time.Duration `json:"refresh,omitempty"`   // Reload interval of the provider lists, default 24h
+
+	logger  *zap.Logger
+	client  *http.Client
+	static  []netip.Prefix
+	current atomic.Pointer[cdnRangeSet] // Nil until loaded
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// cdnRangeSet is a loaded set of ranges, swapped as a whole on reload.
+type cdnRangeSet struct {
+	prefixes []netip.Prefix
+	trie     *iptrie.Trie
+}
+
+// provision validates the providers and ranges, applies the defaults and loads the lists.
+func (c *CDNRanges) provision(logger *zap.Logger) error {
+	if len(c.Providers) == 0 && len(c.Ranges) == 0 {
+		return fmt.Errorf("cdn ranges require a provider or a range")
+	}
+	for i, provider := range c.Providers {
+		c.Providers[i] = strings.ToLower(provider)
+		if _, ok := cdnRangeURLs[c.Providers[i]]; !ok {
+			return fmt.Errorf("unknown cdn provider: %s, must be cloudflare, fastly or cloudfront", provider)
+		}
+	}
+	c.static = c.static[:0]
+	for _, expr := range c.Ranges {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(expr)
+		if err != nil {
+			return fmt.Errorf("invalid cdn range: %w", err)
+		}
+		c.static = append(c.static, prefix)
+	}
+	if c.Refresh <= 0 {
+		c.Refresh = defaultCDNRefresh
+	}
+	c.logger = logger
+	c.client = &http.Client{Timeout: cdnHTTPTimeout}
+	return c.reload(context.Background())
+}
+
+// reload downloads every provider list, keeping the current ranges unless all succeed.
+func (c *CDNRanges) reload(ctx context.Context) error {
+	prefixes := append([]netip.Prefix(nil), c.static...)
+	for _, provider := range c.Providers {
+		fetched, err := c.fetch(ctx, provider)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the %s ip ranges: %w", provider, err)
+		}
+		c.logger.Info("CDN IP ranges loaded", zap.String("provider", provider), zap.Int("prefixes", len(fetched)))
+		prefixes = append(prefixes, fetched...)
+	}
+	trie := iptrie.NewTrie()
+	for _, prefix := range prefixes {
+		trie.Insert(prefix, struct{}{})
+	}
+	c.current.Store(&cdnRangeSet{prefixes: prefixes, trie: trie})
+	return nil
+}
+
+// fetch downloads and parses the published list of a provider.
+func (c *CDNRanges) fetch(ctx context.Context, provider string) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cdnRangeURLs[provider], nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCDNRangesSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseCDNRanges(provider, data)
+}
+
+// parseCDNRanges extracts the edge ranges from the list of a provider. A list without
+// ranges is an error, so that a truncated answer never replaces the current ranges.
+func parseCDNRanges(provider string, data []byte) ([]netip.Prefix, error) {
+	var ranges []string
+	switch provider {
+	case CDNCloudflare:
+		var list struct {
+			Result struct {
+				IPv4 []string `json:"ipv4_cidrs"`
+				IPv6 []string `json:"ipv6_cidrs"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		ranges = append(list.Result.IPv4, list.Result.IPv6...)
+	case CDNFastly:
+		var list struct {
+			IPv4 []string `json:"addresses"`
+			IPv6 []string `json:"ipv6_addresses"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		ranges = append(list.IPv4, list.IPv6...)
+	case CDNCloudFront:
+		// The AWS list covers every service, CloudFront edges are those of its CLOUDFRONT entries
+		var list struct {
+			IPv4 []struct {
+				Prefix  string `json:"ip_prefix"`
+				Service string `json:"service"`
+			} `json:"prefixes"`
+			IPv6 []struct {
+				Prefix  string `json:"ipv6_prefix"`
+				Service string `json:"service"`
+			} `json:"ipv6_prefixes"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, entry := range list.IPv4 {
+			if entry.Service == "CLOUDFRONT" {
+				ranges = append(ranges, entry.Prefix)
+			}
+		}
+		for _, entry := range list.IPv6 {
+			if entry.Service == "CLOUDFRONT" {
+				ranges = append(ranges, entry.Prefix)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown cdn provider: %s", provider)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ip ranges listed")
+	}
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", r, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Start reloads the provider lists every Refresh until Stop is called.
+func (c *CDNRanges) Start() {
+	if len(c.Providers) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.reload(ctx); err != nil && ctx.Err() == nil {
+					c.logger.Error("Failed to reload CDN IP ranges, keeping the current ranges", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reloads started by Start.
+func (c *CDNRanges) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel = nil
+}
+
+// Contains reports whether ip belongs to a CDN range.
+func (c *CDNRanges) Contains(ip netip.Addr) bool {
+	set := c.current.Load()
+	return set != nil && set.trie.Contains(ip.Unmap())
+}
+
+// Prefixes returns the current CDN ranges. The slice must not be modified.
+func (c *CDNRanges) Prefixes() []netip.Prefix {
+	if set := c.current.Load(); set != nil {
+		return set.prefixes
+	}
+	return nil
+}
+
+// CDNOriginConfig rejects the requests that reach the origin directly instead of through
+// the CDN, that is from an IP outside the CDN ranges.
+type CDNOriginConfig struct {
+	CDNRanges
+	StatusCode int `json:"status_code,omitempty"` // Status of rejected requests, default 403
+}
+
+// checkCDNOrigin blocks requests whose peer isn't a CDN edge, reporting whether it did.
+func (m *Middleware) checkCDNOrigin(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if m.CDNOrigin == nil || m.CDNOrigin.current.Load() == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(extractIP(r.RemoteAddr))
+	if err == nil && m.CDNOrigin.Contains(addr) {
+		return false
+	}
+	m.directOriginBlocked.Add(1)
+	m.blockRequest(w, r, state, m.CDNOrigin.StatusCode, "cdn_origin", cdnOriginRuleID,
+		zap.String("message", "Request blocked for bypassing the CDN"),
+	)
+	return true
+}
+
+// CDNIPRange is an IP range source for the trusted_proxies server option, listing the edge
+// ranges of CDN providers so that Caddy takes the client IP from their forwarded headers:
+//
+//	trusted_proxies cdn cloudflare fastly {
+//	    refresh 12h
+//	}
+type CDNIPRange struct {
+	CDNRanges
+}
+
+// CaddyModule returns the Caddy module information.
+func (*CDNIPRange) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.ip_sources.cdn",
+		New: func() caddy.Module { return &CDNIPRange{} },
+	}
+}
+
+// Provision loads the provider lists and starts reloading them.
+func (s *CDNIPRange) Provision(ctx caddy.Context) error {
+	if err := s.provision(ctx.Logger()); err != nil {
+		return err
+	}
+	s.Start()
+	return nil
+}
+
+// Cleanup stops reloading the provider lists.
+func (s *CDNIPRange) Cleanup() error {
+	s.Stop()
+	return nil
+}
+
+// GetIPRanges returns the current CDN ranges.
+func (s *CDNIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+	return s.Prefixes()
+}
+
+// UnmarshalCaddyfile parses cdn [<providers...>] { provider <names...>, ranges <cidrs...>,
+// refresh <duration> }.
+func (s *CDNIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Module name
+	s.Providers = append(s.Providers, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "provider":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.Providers = append(s.Providers, args...)
+		case "ranges":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.Ranges = append(s.Ranges, args...)
+		case "refresh":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			refresh, err := time.ParseDuration(d.Val())
+			if err != nil || refresh <= 0 {
+				return d.Errf("invalid cdn refresh: %s", d.Val())
+			}
+			s.Refresh = refresh
+		default:
+			return d.Errf("unrecognized cdn option: %s", option)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeCDNLists serves a published range list per provider, pointing cdnRangeURLs at it
+// for the duration of the test.
+func fakeCDNLists(t *testing.T, lists map[string]string) *atomic.Int64 {
+	t.Helper()
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		list, ok := lists[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(list))
+	}))
+	t.Cleanup(server.Close)
+
+	saved := cdnRangeURLs
+	cdnRangeURLs = map[string]string{}
+	for provider := range saved {
+		cdnRangeURLs[provider] = server.URL + "/" + provider
+	}
+	t.Cleanup(func() { cdnRangeURLs = saved })
+	return &requests
+}
+
+func TestParseCDNRanges(t *testing.T) {
+	prefixes, err := parseCDNRanges(CDNCloudflare, []byte(`{"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":["2400:cb00::/32"]},"success":true}`))
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("173.245.48.0/20"), netip.MustParsePrefix("2400:cb00::/32")}, prefixes)
+
+	prefixes, err = parseCDNRanges(CDNFastly, []byte(`{"addresses":["23.235.32.0/20"],"ipv6_addresses":["2a04:4e40::/32"]}`))
+	require.NoError(t, err)
+	assert.Len(t, prefixes, 2)
+
+	prefixes, err = parseCDNRanges(CDNCloudFront, []byte(`{"prefixes":[
+		{"ip_prefix":"3.5.140.0/22","service":"AMAZON"},
+		{"ip_prefix":"13.32.0.0/15","service":"CLOUDFRONT"}],
+		"ipv6_prefixes":[{"ipv6_prefix":"2600:9000::/28","service":"CLOUDFRONT"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("13.32.0.0/15"), netip.MustParsePrefix("2600:9000::/28")}, prefixes)
+
+	_, err = parseCDNRanges(CDNFastly, []byte(`{"addresses":[]}`))
+	assert.Error(t, err, "empty list")
+	_, err = parseCDNRanges(CDNFastly, []byte(`{"addresses":["not a range"]}`))
+	assert.Error(t, err)
+	_, err = parseCDNRanges(CDNCloudflare, []byte(`<html>`))
+	assert.Error(t, err)
+}
+
+func TestCDNRanges_Reload(t *testing.T) {
+	lists := map[string]string{
+		CDNCloudflare: `{"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":[]}}`,
+		CDNFastly:     `{"addresses":["23.235.32.0/20"],"ipv6_addresses":["2a04:4e40::/32"]}`,
+	}
+	fakeCDNLists(t, lists)
+
+	ranges := &CDNRanges{Providers: []string{"Cloudflare", CDNFastly}, Ranges: []string{"10.0.0.1"}}
+	require.NoError(t, ranges.provision(zap.NewNop()))
+	assert.Equal(t, defaultCDNRefresh, ranges.Refresh)
+	assert.Len(t, ranges.Prefixes(), 4)
+	assert.True(t, ranges.Contains(netip.MustParseAddr("173.245.50.1")))
+	assert.True(t, ranges.Contains(netip.MustParseAddr("::ffff:23.235.33.1")))
+	assert.True(t, ranges.Contains(netip.MustParseAddr("2a04:4e40::1")))
+	assert.True(t, ranges.Contains(netip.MustParseAddr("10.0.0.1")))
+	assert.False(t, ranges.Contains(netip.MustParseAddr("10.0.0.2")))
+
+	// A failing provider keeps the ranges of the last reload
+	delete(lists, CDNFastly)
+	assert.Error(t, ranges.reload(t.Context()))
+	assert.True(t, ranges.Contains(netip.MustParseAddr("23.235.33.1")))
+
+	assert.Error(t, (&CDNRanges{}).provision(zap.NewNop()))
+	assert.Error(t, (&CDNRanges{Providers: []string{"akamai"}}).provision(zap.NewNop()))
+	assert.Error(t, (&CDNRanges{Ranges: []string{"10.0.0.0/33"}}).provision(zap.NewNop()))
+	assert.Error(t, (&CDNRanges{Providers: []string{CDNCloudFront}}).provision(zap.NewNop()), "list not found")
+}
+
+func TestCheckCDNOrigin(t *testing.T) {
+	fakeCDNLists(t, map[string]string{
+		CDNCloudflare: `{"result":{"ipv4_cidrs":["173.245.48.0/20"],"ipv6_cidrs":["2400:cb00::/32"]}}`,
+	})
+	m := &Middleware{
+		logger:    zap.NewNop(),
+		CDNOrigin: &CDNOriginConfig{StatusCode: http.StatusForbidden},
+	}
+	m.CDNOrigin.Providers = []string{CDNCloudflare}
+	require.NoError(t, m.CDNOrigin.provision(zap.NewNop()))
+
+	for _, remoteAddr := range []string{"173.245.48.9:4321", "[2400:cb00::1]:443"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		assert.False(t, m.checkCDNOrigin(httptest.NewRecorder(), r, &WAFState{}), remoteAddr)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.7:4321"
+	r.Header.Set("X-Forwarded-For", "173.245.48.9") // Headers can't fake the peer
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkCDNOrigin(w, r, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, int64(1), m.directOriginBlocked.Load())
+}
+
+func TestCDNIPRange(t *testing.T) {
+	requests := fakeCDNLists(t, map[string]string{
+		CDNFastly: `{"addresses":["23.235.32.0/20"],"ipv6_addresses":[]}`,
+	})
+
+	source := &CDNIPRange{}
+	d := caddyfile.NewTestDispenser(`cdn fastly {
+		ranges 10.0.0.0/8
+		refresh 1h
+	}`)
+	require.NoError(t, source.UnmarshalCaddyfile(d))
+	assert.Equal(t, []string{CDNFastly}, source.Providers)
+	assert.Equal(t, []string{"10.0.0.0/8"}, source.Ranges)
+
+	require.NoError(t, source.provision(zap.NewNop()))
+	source.Start()
+	defer func() { assert.NoError(t, source.Cleanup()) }()
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("23.235.32.0/20")}, source.GetIPRanges(nil))
+	assert.Equal(t, int64(1), requests.Load())
+
+	for _, input := range []string{"cdn {\n refresh soon\n}", "cdn {\n ranges\n}", "cdn {\n trusted\n}"} {
+		assert.Error(t, (&CDNIPRange{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)), input)
+	}
+}
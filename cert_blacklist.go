@@ -0,0 +1,99 @@
+package caddywaf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const certBlacklistRuleID = "cert_blacklist_rule"
+
+// normalizeCertFingerprint returns a SHA-256 certificate fingerprint in lowercase hex,
+// accepting the colon-separated uppercase form printed by openssl x509 -fingerprint.
+func normalizeCertFingerprint(entry string) (string, error) {
+	fingerprint := strings.ToLower(strings.ReplaceAll(entry, ":", ""))
+	if len(fingerprint) != 64 {
+		return "", fmt.Errorf("certificate fingerprint must be a SHA-256 hash: %s", entry)
+	}
+	if _, err := hex.DecodeString(fingerprint); err != nil {
+		return "", fmt.Errorf("certificate fingerprint must be hexadecimal: %s", entry)
+	}
+	return fingerprint, nil
+}
+
+// readCertBlacklist reads a certificate fingerprint blacklist, skipping empty lines,
+// comments and invalid entries.
+func (bl *BlacklistLoader) readCertBlacklist(r io.Reader, filePath string) (map[string]struct{}, error) {
+	blacklist := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	validEntries, invalidEntries, totalLines := 0, 0, 0
+	for scanner.Scan() {
+		totalLines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // Skip empty lines and comments
+		}
+		fingerprint, err := normalizeCertFingerprint(line)
+		if err != nil {
+			bl.logger.Warn("Invalid entry in certificate blacklist file",
+				zap.String("path", filePath),
+				zap.Int("line", totalLines),
+				zap.Error(err),
+			)
+			invalidEntries++
+			continue
+		}
+		blacklist[fingerprint] = struct{}{}
+		validEntries++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading certificate blacklist file: %w", err)
+	}
+
+	bl.logger.Info("Certificate blacklist loaded",
+		zap.String("path", filePath),
+		zap.Int("valid_entries", validEntries),
+		zap.Int("invalid_entries", invalidEntries),
+		zap.Int("total_lines", totalLines),
+	)
+	return blacklist, nil
+}
+
+// loadCertBlacklist loads the certificate blacklist file. A missing file loads no blacklist.
+func (m *Middleware) loadCertBlacklist(filePath string) (map[string]struct{}, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		m.logger.Warn("Skipping certificate blacklist load, file does not exist", zap.String("file", filePath))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open certificate blacklist file: %w", err)
+	}
+	defer file.Close()
+	return m.blacklistLoader.readCertBlacklist(file, filePath)
+}
+
+// isCertBlacklisted checks if the client certificate of the request is in the certificate
+// blacklist, returning its fingerprint.
+func (m *Middleware) isCertBlacklisted(r *http.Request) (string, bool) {
+	m.mu.RLock()
+	blacklist := m.certBlacklist
+	m.mu.RUnlock()
+	cert := clientCertificate(r)
+	if blacklist == nil || cert == nil {
+		return "", false
+	}
+	fingerprint := certFingerprint(cert)
+	if _, ok := blacklist[fingerprint]; !ok {
+		return "", false
+	}
+	m.certBlacklistHits.Add(1)
+	m.logger.Debug("Certificate blacklist hit", zap.String("fingerprint", fingerprint))
+	return fingerprint, true
+}
@@ -0,0 +1,71 @@
+package caddywaf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNormalizeCertFingerprint(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	fingerprint, err := normalizeCertFingerprint(hash)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, fingerprint)
+	fingerprint, err = normalizeCertFingerprint(strings.TrimSuffix(strings.Repeat("AB:", 32), ":"))
+	assert.NoError(t, err)
+	assert.Equal(t, hash, fingerprint)
+
+	for _, entry := range []string{"abcd", strings.Repeat("zz", 32), strings.Repeat("ab", 20)} {
+		_, err := normalizeCertFingerprint(entry)
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestBlockedRequestPhase1_CertBlacklist(t *testing.T) {
+	revoked := testClientCertificate(t, "alice")
+	valid := testClientCertificate(t, "bob")
+	list := "# Compromised client certificates\n" + strings.ToUpper(certFingerprint(revoked)) + "\nnot-a-fingerprint\n"
+	path := filepath.Join(t.TempDir(), "certs.txt")
+	require.NoError(t, os.WriteFile(path, []byte(list), 0o600))
+
+	m := &Middleware{
+		logger:          zap.NewNop(),
+		blacklistLoader: NewBlacklistLoader(zap.NewNop()),
+		ipBlacklist:     iptrie.NewTrie(),
+	}
+	var err error
+	m.certBlacklist, err = m.loadCertBlacklist(path)
+	require.NoError(t, err)
+	assert.Len(t, m.certBlacklist, 1)
+
+	r := httptest.NewRequest("GET", "https://example.com/api", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked}}
+	state := &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), r, 1, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusForbidden, state.StatusCode)
+	assert.Equal(t, int64(1), m.certBlacklistHits.Load())
+
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{valid}}
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), r, 1, state)
+	assert.False(t, state.Blocked)
+
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil), 1, state)
+	assert.False(t, state.Blocked, "no client certificate")
+
+	blacklist, err := m.loadCertBlacklist(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NoError(t, err)
+	assert.Nil(t, blacklist)
+}
@@ -0,0 +1,174 @@
+package caddywaf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultChallengeCookie     = "waf_challenge"
+	defaultChallengeTTL        = time.Hour
+	defaultChallengeDifficulty = 14
+	maxChallengeDifficulty     = 24
+)
+
+// ChallengeConfig configures the JavaScript proof-of-work challenge served to suspicious
+// clients instead of a block. A client solving it gets a cookie, bound to its IP, that
+// lets its requests through until it expires.
+type ChallengeConfig struct {
+	Secret     string        `json:"secret,omitempty"`      // HMAC key of the cookies, random per start if empty
+	CookieName string        `json:"cookie_name,omitempty"` // Default waf_challenge
+	TTL        time.Duration `json:"ttl,omitempty"`         // Validity of a solved challenge, default 1h
+	Difficulty int           `json:"difficulty,omitempty"`  // Leading zero bits of the proof of work, default 14
+
+	key []byte
+}
+
+// provision applies the defaults and derives the signing key.
+func (c *ChallengeConfig) provision() error {
+	if c.CookieName == "" {
+		c.CookieName = defaultChallengeCookie
+	}
+	if strings.ContainsAny(c.CookieName, " \t\r\n\"',;=\\<>") {
+		return fmt.Errorf("invalid challenge cookie name: %s", c.CookieName)
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultChallengeTTL
+	}
+	if c.Difficulty == 0 {
+		c.Difficulty = defaultChallengeDifficulty
+	}
+	if c.Difficulty < 1 || c.Difficulty > maxChallengeDifficulty {
+		return fmt.Errorf("invalid challenge difficulty %d, must be between 1 and %d", c.Difficulty, maxChallengeDifficulty)
+	}
+	if c.Secret != "" {
+		c.key = []byte(c.Secret)
+		return nil
+	}
+	c.key = make([]byte, 32)
+	if _, err := rand.Read(c.key); err != nil {
+		return fmt.Errorf("failed to generate challenge key: %w", err)
+	}
+	return nil
+}
+
+// seed returns the signed "<expires>.<signature>" a client of ip must find a proof for.
+func (c *ChallengeConfig) seed(ip string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(ip + "|" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether a "<expires>.<signature>.<nonce>" cookie value is a solved,
+// unexpired challenge issued to ip.
+func (c *ChallengeConfig) verify(value, ip string, now time.Time) bool {
+	seed, nonce, ok := cutLast(value, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	exp, _, _ := strings.Cut(seed, ".")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	if !hmac.Equal([]byte(seed), []byte(c.seed(ip, time.Unix(expires, 0)))) {
+		return false
+	}
+	return leadingZeroBits(sha256.Sum256([]byte(value))) >= c.Difficulty
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// challengePage searches for a nonce whose SHA-256 with the seed has enough leading zero
+// bits, stores the result in the cookie and reloads the page.
+const challengePage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Checking your browser</title></head>
+<body><p>Checking your browser before continuing...</p><noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(async function () {
+	var seed = "%s", difficulty = %d, encoder = new TextEncoder();
+	for (var nonce = 0; ; nonce++) {
+		var hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(seed + "." + nonce)));
+		var zeros = 0;
+		for (var i = 0; i < hash.length; i++) {
+			if (hash[i] === 0) { zeros += 8; continue; }
+			zeros += Math.clz32(hash[i]) - 24;
+			break;
+		}
+		if (zeros >= difficulty) {
+			document.cookie = "%s=" + seed + "." + nonce + "; path=/; max-age=%d; SameSite=Lax";
+			location.reload();
+			return;
+		}
+	}
+})();
+</script></body></html>
+`
+
+// challengePassed reports whether the request carries a solved challenge.
+func (m *Middleware) challengePassed(r *http.Request) bool {
+	if m.Challenge == nil {
+		return false
+	}
+	cookie, err := r.Cookie(m.Challenge.CookieName)
+	if err != nil {
+		return false
+	}
+	return m.Challenge.verify(cookie.Value, extractIP(r.RemoteAddr), time.Now())
+}
+
+// challenge serves the challenge page unless the client already solved it. It reports
+// whether the challenge was served, which ends the request like a block.
+func (m *Middleware) challenge(w http.ResponseWriter, r *http.Request, state *WAFState, reason, ruleID string) bool {
+	if m.Challenge == nil || m.challengePassed(r) {
+		return false
+	}
+	state.Blocked = true
+	state.StatusCode = http.StatusForbidden
+	state.ResponseWritten = true
+	m.challengesIssued.Add(1)
+
+	ip := extractIP(r.RemoteAddr)
+	m.logger.Info("Challenge issued",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("rule_id", ruleID),
+		zap.String("reason", reason),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	seed := m.Challenge.seed(ip, time.Now().Add(m.Challenge.TTL))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	page := fmt.Sprintf(challengePage, seed, m.Challenge.Difficulty, m.Challenge.CookieName, int(m.Challenge.TTL.Seconds()))
+	if _, err := w.Write([]byte(page)); err != nil {
+		m.logger.Error("Failed to write challenge page", zap.Error(err))
+	}
+	return true
+}
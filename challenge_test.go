@@ -0,0 +1,66 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestChallengeConfig_Verify(t *testing.T) {
+	c := &ChallengeConfig{Secret: "s3cret", Difficulty: 8}
+	require.NoError(t, c.provision())
+	now := time.Now()
+	seed := c.seed("192.0.2.1", now.Add(time.Hour))
+	value := solveChallenge(seed, c.Difficulty)
+
+	assert.True(t, c.verify(value, "192.0.2.1", now))
+	assert.False(t, c.verify(value, "192.0.2.2", now), "cookies are bound to the client IP")
+	assert.False(t, c.verify(value, "192.0.2.1", now.Add(2*time.Hour)), "expired")
+	assert.False(t, c.verify(seed, "192.0.2.1", now))
+	assert.False(t, c.verify("garbage", "192.0.2.1", now))
+
+	other := &ChallengeConfig{Secret: "other", Difficulty: 8}
+	require.NoError(t, other.provision())
+	assert.False(t, other.verify(value, "192.0.2.1", now), "signed with another key")
+}
+
+func TestChallengeConfig_Provision(t *testing.T) {
+	c := &ChallengeConfig{}
+	require.NoError(t, c.provision())
+	assert.Equal(t, defaultChallengeCookie, c.CookieName)
+	assert.Equal(t, defaultChallengeTTL, c.TTL)
+	assert.Equal(t, defaultChallengeDifficulty, c.Difficulty)
+	assert.Len(t, c.key, 32)
+
+	assert.Error(t, (&ChallengeConfig{CookieName: "a;b"}).provision())
+	assert.Error(t, (&ChallengeConfig{Difficulty: 40}).provision())
+}
+
+func TestChallenge(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), Challenge: &ChallengeConfig{Difficulty: 4}}
+	require.NoError(t, m.Challenge.provision())
+
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.challenge(w, req, state, "test", "test_rule"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, int64(1), m.challengesIssued.Load())
+
+	page := w.Body.String()
+	start := strings.Index(page, `var seed = "`) + len(`var seed = "`)
+	seed := page[start : start+strings.Index(page[start:], `"`)]
+	req.AddCookie(&http.Cookie{Name: defaultChallengeCookie, Value: solveChallenge(seed, 4)})
+	state = &WAFState{}
+	assert.False(t, m.challenge(httptest.NewRecorder(), req, state, "test", "test_rule"), "a solved challenge lets the client through")
+	assert.False(t, state.Blocked)
+}
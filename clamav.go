@@ -0,0 +1,230 @@
+package caddywaf
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	clamAVRuleID         = "malware_rule"
+	defaultClamAVTimeout = 10 * time.Second
+	clamAVChunkSize      = 64 << 10
+)
+
+// ClamAVConfig scans the files uploaded in multipart requests with clamd, blocking the
+// requests carrying malware.
+type ClamAVConfig struct {
+	Address     string        `json:"address"`                // clamd socket: unix:/path, /path, tcp:host:port or host:port
+	MinSize     int64         `json:"min_size,omitempty"`     // Files smaller are not scanned
+	Timeout     time.Duration `json:"timeout,omitempty"`      // Time allowed per file, default 10s
+	FailClosed  bool          `json:"fail_closed,omitempty"`  // Block when clamd can't scan a file
+	StatusCode  int           `json:"status_code,omitempty"`  // Status of the block response, default 403
+	ContentType string        `json:"content_type,omitempty"` // Content type of the block response body
+	Body        string        `json:"body,omitempty"`         // Block response body, {signature} is replaced by the malware found
+
+	network string
+	address string
+	dialer  net.Dialer
+}
+
+// provision validates the config and applies the defaults.
+func (c *ClamAVConfig) provision() error {
+	network, address, err := parseClamAVAddress(c.Address)
+	if err != nil {
+		return err
+	}
+	c.network, c.address = network, address
+	if c.MinSize < 0 {
+		return fmt.Errorf("invalid clamav min_size %d", c.MinSize)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultClamAVTimeout
+	}
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusForbidden
+	}
+	if c.StatusCode < 400 || c.StatusCode > 599 {
+		return fmt.Errorf("invalid clamav status code %d, must be between 400 and 599", c.StatusCode)
+	}
+	return nil
+}
+
+// parseClamAVAddress returns the network and address of a clamd socket.
+func parseClamAVAddress(raw string) (string, string, error) {
+	switch {
+	case raw == "":
+		return "", "", fmt.Errorf("clamav requires an address")
+	case strings.HasPrefix(raw, "unix:"):
+		return "unix", strings.TrimPrefix(raw, "unix:"), nil
+	case strings.HasPrefix(raw, "/"):
+		return "unix", raw, nil
+	}
+	address := strings.TrimPrefix(raw, "tcp:")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid clamav address: %s, must be a unix socket path or host:port", raw)
+	}
+	return "tcp", address, nil
+}
+
+// scan sends data to clamd with the INSTREAM command. It returns the signature of the
+// malware found, or an empty string for clean data.
+func (c *ClamAVConfig) scan(ctx context.Context, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		chunk := data[:min(len(data), clamAVChunkSize)]
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		w.Write(size[:])
+		w.Write(chunk)
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("reading clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd replied %q", reply)
+}
+
+// checkClamAV scans the files of multipart requests in phase 2, blocking the requests
+// carrying malware. It reports whether the request was blocked.
+func (m *Middleware) checkClamAV(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.ClamAV
+	if config == nil || config.network == "" || r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	boundary := multipartBoundary(r)
+	if boundary == "" {
+		return false
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil {
+		return false
+	}
+
+	for _, file := range uploadedFiles(body, boundary) {
+		if int64(len(file.data)) < config.MinSize {
+			continue
+		}
+		signature, err := config.scan(r.Context(), file.data)
+		if err != nil {
+			m.logger.Warn("ClamAV scan failed",
+				zap.String("log_id", getLogID(r.Context())),
+				zap.String("file_name", file.name),
+				zap.Error(err),
+			)
+			if !config.FailClosed {
+				continue
+			}
+			m.blockRequest(w, r, state, http.StatusServiceUnavailable, "clamav", clamAVRuleID,
+				zap.String("message", "Request blocked as an uploaded file could not be scanned"),
+				zap.String("file_name", file.name),
+			)
+			return true
+		}
+		if signature != "" {
+			m.blockMalware(w, r, state, file.name, signature)
+			return true
+		}
+	}
+	return false
+}
+
+// uploadedFile is a file part of a multipart/form-data request.
+type uploadedFile struct {
+	name string
+	data []byte
+}
+
+// multipartBoundary returns the boundary of a multipart/form-data request, or an empty
+// string for other requests.
+func multipartBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// uploadedFiles returns the file parts of a multipart body. Of a body truncated by the
+// inspection budget, only the files before the cut are returned.
+func uploadedFiles(body, boundary string) []uploadedFile {
+	var files []uploadedFile
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return files
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return files
+		}
+		files = append(files, uploadedFile{name: part.FileName(), data: data})
+	}
+}
+
+// blockMalware blocks a request carrying malware with the configured response.
+func (m *Middleware) blockMalware(w http.ResponseWriter, r *http.Request, state *WAFState, fileName, signature string) {
+	config := m.ClamAV
+	m.malwareBlocked.Add(1)
+	m.incrementRuleHitCount(RuleID(clamAVRuleID))
+	state.MatchedRules = append(state.MatchedRules, clamAVRuleID)
+	fields := []zap.Field{
+		zap.String("message", "Request blocked for carrying malware"),
+		zap.String("file_name", fileName),
+		zap.String("signature", signature),
+	}
+	if config.Body == "" {
+		m.blockRequest(w, r, state, config.StatusCode, "malware", clamAVRuleID, fields...)
+		return
+	}
+
+	m.recordBlock(r, state, config.StatusCode, "malware", clamAVRuleID, fields...)
+	if config.ContentType != "" {
+		w.Header().Set("Content-Type", config.ContentType)
+	}
+	w.WriteHeader(config.StatusCode)
+	if _, err := w.Write([]byte(strings.ReplaceAll(config.Body, "{signature}", signature))); err != nil {
+		m.logger.Error("Failed to write malware block response", zap.Error(err))
+	}
+}
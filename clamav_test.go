@@ -0,0 +1,177 @@
+package caddywaf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeClamd answers INSTREAM commands on listener, reporting the streams containing EICAR
+// as infected. It counts the streams scanned.
+func fakeClamd(t *testing.T, listener net.Listener) *atomic.Int64 {
+	t.Cleanup(func() { listener.Close() })
+	var scanned atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var data bytes.Buffer
+				var size [4]byte
+				for {
+					if _, err := io.ReadFull(reader, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, reader, int64(n)); err != nil {
+						return
+					}
+				}
+				scanned.Add(1)
+				if strings.Contains(data.String(), "EICAR") {
+					_, _ = io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+					return
+				}
+				_, _ = io.WriteString(conn, "stream: OK\x00")
+			}()
+		}
+	}()
+	return &scanned
+}
+
+// uploadRequest builds a multipart request uploading a file with the given content.
+func uploadRequest(t *testing.T, content string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	require.NoError(t, writer.WriteField("title", "EICAR in a field is not a file"))
+	file, err := writer.CreateFormFile("file", "report.pdf")
+	require.NoError(t, err)
+	_, _ = io.WriteString(file, content)
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestClamAVConfig_Provision(t *testing.T) {
+	config := &ClamAVConfig{Address: "127.0.0.1:3310"}
+	require.NoError(t, config.provision())
+	assert.Equal(t, "tcp", config.network)
+	assert.Equal(t, defaultClamAVTimeout, config.Timeout)
+	assert.Equal(t, http.StatusForbidden, config.StatusCode)
+
+	config = &ClamAVConfig{Address: "/run/clamav/clamd.ctl"}
+	require.NoError(t, config.provision())
+	assert.Equal(t, "unix", config.network)
+
+	for _, config := range []*ClamAVConfig{
+		{},
+		{Address: "clamd"},
+		{Address: "127.0.0.1:3310", MinSize: -1},
+		{Address: "127.0.0.1:3310", StatusCode: 302},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckClamAV(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	scanned := fakeClamd(t, listener)
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ClamAV:                &ClamAVConfig{Address: "tcp:" + listener.Addr().String()},
+	}
+	require.NoError(t, m.ClamAV.provision())
+
+	assert.False(t, m.checkClamAV(httptest.NewRecorder(), uploadRequest(t, "%PDF-1.7"), &WAFState{}))
+	assert.Equal(t, int64(1), scanned.Load(), "only the file part is scanned")
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkClamAV(w, uploadRequest(t, "X5O!P%@AP EICAR"), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{clamAVRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.malwareBlocked.Load())
+
+	// Files under the minimum size and non multipart bodies are not scanned
+	m.ClamAV.MinSize = 1024
+	assert.False(t, m.checkClamAV(httptest.NewRecorder(), uploadRequest(t, "X5O!P%@AP EICAR"), &WAFState{}))
+	assert.False(t, m.checkClamAV(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("EICAR")), &WAFState{}))
+	assert.Equal(t, int64(2), scanned.Load())
+}
+
+func TestCheckClamAV_UnixSocketAndResponse(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	fakeClamd(t, listener)
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ClamAV: &ClamAVConfig{
+			Address:     "unix:" + socket,
+			StatusCode:  http.StatusUnprocessableEntity,
+			ContentType: "application/json",
+			Body:        `{"malware": "{signature}"}`,
+		},
+	}
+	require.NoError(t, m.ClamAV.provision())
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkClamAV(w, uploadRequest(t, "EICAR"), state))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"malware": "Eicar-Test-Signature"}`, w.Body.String())
+	assert.True(t, state.Blocked)
+}
+
+func TestCheckClamAV_Failure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ClamAV:                &ClamAVConfig{Address: address},
+	}
+	require.NoError(t, m.ClamAV.provision())
+	assert.False(t, m.checkClamAV(httptest.NewRecorder(), uploadRequest(t, "EICAR"), &WAFState{}), "fails open")
+
+	m.ClamAV.FailClosed = true
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkClamAV(w, uploadRequest(t, "EICAR"), &WAFState{}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(0), m.malwareBlocked.Load())
+
+	_, err = m.ClamAV.scan(context.Background(), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,370 @@
+package caddywaf
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultClusterSyncInterval = time.Second
+	defaultClusterSyncPath     = "/waf/cluster"
+	defaultClusterChannel      = "caddy-waf-cluster"
+	clusterBanSnapshotInterval = 30 * time.Second // Full ban list resend, so restarted nodes catch up
+	clusterSignatureHeader     = "X-WAF-Cluster-Signature"
+	clusterMaxClockSkew        = 30 * time.Second // Largest difference between the clocks of a sender and this node
+	clusterMaxMessageSize      = 4 << 20
+	clusterQueueSize           = 64
+)
+
+// ClusterConfig configures state synchronization between WAF nodes behind a load balancer.
+type ClusterConfig struct {
+	Node         string                `json:"node,omitempty"`          // Unique node name, defaults to the hostname
+	Peers        []string              `json:"peers,omitempty"`         // Base URLs of the other nodes
+	Backend      *BanPropagationConfig `json:"backend,omitempty"`       // Shared Redis or NATS channel, instead of peers
+	Secret       string                `json:"secret,omitempty"`        // HMAC key signing messages sent to peers
+	SyncInterval time.Duration         `json:"sync_interval,omitempty"` // Default 1s
+	SyncPath     string                `json:"sync_path,omitempty"`     // Path receiving peer messages, default /waf/cluster
+}
+
+// clusterMessage carries the state changes of a node since its previous message.
+type clusterMessage struct {
+	Node       string           `json:"node"`
+	Sent       time.Time        `json:"sent"`
+	RateLimits []RateLimitDelta `json:"rate_limits,omitempty"`
+	Bans       []BanMessage     `json:"bans,omitempty"`
+}
+
+// empty reports whether the message carries no state.
+func (msg *clusterMessage) empty() bool {
+	return len(msg.RateLimits) == 0 && len(msg.Bans) == 0
+}
+
+// ClusterStats reports the synchronization traffic of a node.
+type ClusterStats struct {
+	Node         string               `json:"node"`
+	Transport    string               `json:"transport"` // peers, redis or nats
+	Sent         int64                `json:"sent"`
+	Received     int64                `json:"received"`
+	Errors       int64                `json:"errors"`
+	LastReceived map[string]time.Time `json:"last_received"` // By peer node name
+}
+
+// Cluster exchanges rate-limit counters and bans with the other nodes.
+type Cluster struct {
+	logger *zap.Logger
+	config ClusterConfig
+	client *http.Client
+	pubsub *PubSub // nil in peers mode
+
+	queue    chan clusterMessage
+	sent     atomic.Int64
+	received atomic.Int64
+	errors   atomic.Int64
+
+	mu           sync.Mutex
+	lastReceived map[string]time.Time
+	lastSent     map[string]time.Time // Sent time of the last message applied, by node name
+	lastSnapshot time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCluster validates the config, applies defaults and creates a Cluster.
+func NewCluster(logger *zap.Logger, config ClusterConfig) (*Cluster, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if (len(config.Peers) == 0) == (config.Backend == nil) {
+		return nil, fmt.Errorf("cluster requires either peers or a backend")
+	}
+	if len(config.Peers) > 0 && config.Secret == "" {
+		return nil, fmt.Errorf("cluster peers require a secret")
+	}
+	if config.Node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cluster node name not set and hostname unavailable: %w", err)
+		}
+		config.Node = hostname
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultClusterSyncInterval
+	}
+	if config.SyncPath == "" {
+		config.SyncPath = defaultClusterSyncPath
+	}
+	for i, peer := range config.Peers {
+		config.Peers[i] = strings.TrimSuffix(peer, "/")
+	}
+
+	c := &Cluster{
+		logger:       logger,
+		config:       config,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		queue:        make(chan clusterMessage, clusterQueueSize),
+		lastReceived: make(map[string]time.Time),
+		lastSent:     make(map[string]time.Time),
+		stop:         make(chan struct{}),
+	}
+	if config.Backend != nil {
+		backend := *config.Backend
+		if backend.Channel == "" {
+			backend.Channel = defaultClusterChannel
+		}
+		ps, err := NewPubSub(logger, backend)
+		if err != nil {
+			return nil, err
+		}
+		c.pubsub = ps
+	}
+	return c, nil
+}
+
+// Start runs the sync loop, which sends the state returned by collect every
+// interval, and delivers the messages of other nodes to apply.
+func (c *Cluster) Start(collect func() clusterMessage, apply func(clusterMessage)) {
+	if c.pubsub != nil {
+		c.pubsub.Start(func(payload []byte) {
+			if err := c.receive(payload, apply); err != nil {
+				c.errors.Add(1)
+				c.logger.Warn("Ignoring invalid cluster message", zap.Error(err))
+			}
+		})
+	}
+	c.wg.Add(2)
+	go c.sendLoop()
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.config.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if msg := collect(); !msg.empty() {
+					c.Broadcast(msg)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the loops and closes the backend connections.
+func (c *Cluster) Stop() {
+	close(c.stop)
+	if c.pubsub != nil {
+		c.pubsub.Stop()
+	}
+	c.wg.Wait()
+}
+
+// Broadcast queues a message for every other node. Messages are dropped when the queue is full.
+func (c *Cluster) Broadcast(msg clusterMessage) {
+	msg.Node = c.config.Node
+	select {
+	case c.queue <- msg:
+	default:
+		c.errors.Add(1)
+		c.logger.Warn("Cluster queue full, dropping message")
+	}
+}
+
+// snapshotDue reports whether the full ban list should be resent.
+func (c *Cluster) snapshotDue(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSnapshot) < clusterBanSnapshotInterval {
+		return false
+	}
+	c.lastSnapshot = now
+	return true
+}
+
+// sendLoop delivers queued messages to the backend or to every peer.
+func (c *Cluster) sendLoop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case msg := <-c.queue:
+			msg.Sent = time.Now() // Stamped in sending order, as receivers require
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				c.logger.Error("Failed to marshal cluster message", zap.Error(err))
+				continue
+			}
+			if c.pubsub != nil {
+				if !c.pubsub.Publish(payload) {
+					c.errors.Add(1)
+					continue
+				}
+				c.sent.Add(1)
+				continue
+			}
+			var wg sync.WaitGroup
+			for _, peer := range c.config.Peers {
+				wg.Add(1)
+				go func(peer string) {
+					defer wg.Done()
+					if err := c.post(peer, payload); err != nil {
+						c.errors.Add(1)
+						c.logger.Debug("Failed to send cluster message", zap.String("peer", peer), zap.Error(err))
+						return
+					}
+					c.sent.Add(1)
+				}(peer)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// post sends a signed message to a peer.
+func (c *Cluster) post(peer string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer+c.config.SyncPath, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSignatureHeader, c.sign(payload))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("peer returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex HMAC-SHA256 of a payload.
+func (c *Cluster) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.config.Secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// receive decodes a message and applies it unless this node sent it. A node sends its
+// messages in order, so only messages sent after the last one applied from their node, and
+// within the clock skew window, are applied: a captured message can't be replayed.
+func (c *Cluster) receive(payload []byte, apply func(clusterMessage)) error {
+	var msg clusterMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	if msg.Node == "" {
+		return fmt.Errorf("cluster message without node name")
+	}
+	if msg.Node == c.config.Node {
+		return nil
+	}
+	now := time.Now()
+	if skew := now.Sub(msg.Sent); skew > clusterMaxClockSkew || skew < -clusterMaxClockSkew {
+		return fmt.Errorf("cluster message of %s sent at %s, outside the clock skew window", msg.Node, msg.Sent)
+	}
+	c.mu.Lock()
+	if !msg.Sent.After(c.lastSent[msg.Node]) {
+		c.mu.Unlock()
+		return fmt.Errorf("cluster message of %s sent at %s replayed or out of order", msg.Node, msg.Sent)
+	}
+	c.lastSent[msg.Node] = msg.Sent
+	c.lastReceived[msg.Node] = now
+	c.mu.Unlock()
+	c.received.Add(1)
+	apply(msg)
+	return nil
+}
+
+// Stats returns the synchronization counters.
+func (c *Cluster) Stats() ClusterStats {
+	transport := "peers"
+	if c.config.Backend != nil {
+		transport = c.config.Backend.Type
+	}
+	c.mu.Lock()
+	lastReceived := make(map[string]time.Time, len(c.lastReceived))
+	for node, t := range c.lastReceived {
+		lastReceived[node] = t
+	}
+	c.mu.Unlock()
+	return ClusterStats{
+		Node:         c.config.Node,
+		Transport:    transport,
+		Sent:         c.sent.Load(),
+		Received:     c.received.Load(),
+		Errors:       c.errors.Load(),
+		LastReceived: lastReceived,
+	}
+}
+
+// collectClusterState drains the local rate-limit increments and, periodically,
+// the bans issued by this node.
+func (m *Middleware) collectClusterState() clusterMessage {
+	var msg clusterMessage
+	if m.rateLimiter != nil {
+		msg.RateLimits = m.rateLimiter.drainDeltas()
+	}
+	if m.banList != nil && m.cluster.snapshotDue(time.Now()) {
+		for _, ban := range m.banList.List(time.Now()) {
+			if ban.Origin == m.banList.origin {
+				msg.Bans = append(msg.Bans, BanMessage{Action: banActionBan, Ban: ban})
+			}
+		}
+	}
+	return msg
+}
+
+// applyClusterMessage merges the state of another node.
+func (m *Middleware) applyClusterMessage(msg clusterMessage) {
+	if m.rateLimiter != nil && len(msg.RateLimits) > 0 {
+		m.rateLimiter.applyRemoteDeltas(msg.RateLimits)
+	}
+	for _, ban := range msg.Bans {
+		m.applyPeerBan(ban)
+	}
+}
+
+// isClusterRequest checks if the request is a message from a cluster peer.
+func (m *Middleware) isClusterRequest(r *http.Request) bool {
+	return m.cluster != nil && m.cluster.pubsub == nil && r.URL.Path == m.cluster.config.SyncPath
+}
+
+// handleClusterRequest verifies and applies a message posted by a peer.
+func (m *Middleware) handleClusterRequest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, clusterMaxMessageSize))
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "failed to read body")
+	}
+	signature := r.Header.Get(clusterSignatureHeader)
+	if !hmac.Equal([]byte(signature), []byte(m.cluster.sign(payload))) {
+		m.cluster.errors.Add(1)
+		m.logger.Warn("Rejected cluster message with invalid signature", zap.String("remote_addr", r.RemoteAddr))
+		return writeJSONError(w, http.StatusUnauthorized, "invalid signature")
+	}
+	if err := m.cluster.receive(payload, m.applyClusterMessage); err != nil {
+		m.cluster.errors.Add(1)
+		return writeJSONError(w, http.StatusBadRequest, "invalid cluster message")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
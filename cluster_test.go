@@ -0,0 +1,174 @@
+package caddywaf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewCluster_Validation(t *testing.T) {
+	_, err := NewCluster(nil, ClusterConfig{Node: "a"})
+	assert.Error(t, err, "peers or backend required")
+	_, err = NewCluster(nil, ClusterConfig{Node: "a", Peers: []string{"http://b"}})
+	assert.Error(t, err, "peers require a secret")
+	_, err = NewCluster(nil, ClusterConfig{Node: "a", Peers: []string{"http://b"}, Secret: "s", Backend: &BanPropagationConfig{Type: BanPropagationRedis, Address: "x:1"}})
+	assert.Error(t, err, "peers and backend are exclusive")
+
+	c, err := NewCluster(nil, ClusterConfig{Peers: []string{"http://b/"}, Secret: "s"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, c.config.Node, "node defaults to the hostname")
+	assert.Equal(t, defaultClusterSyncInterval, c.config.SyncInterval)
+	assert.Equal(t, defaultClusterSyncPath, c.config.SyncPath)
+	assert.Equal(t, "http://b", c.config.Peers[0])
+
+	c, err = NewCluster(nil, ClusterConfig{Backend: &BanPropagationConfig{Type: BanPropagationNATS, Address: "x:1"}})
+	require.NoError(t, err)
+	assert.Equal(t, defaultClusterChannel, c.pubsub.config.Channel)
+}
+
+// newClusterNode creates a middleware with a rate limiter and bans that syncs with peers.
+func newClusterNode(t *testing.T, name string) (*Middleware, *httptest.Server) {
+	m := newBanTestMiddleware(BanConfig{})
+	rl, err := NewRateLimiter(RateLimit{Requests: 4, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+	require.NoError(t, err)
+	m.rateLimiter = rl
+	m.rateLimiter.enableDeltas()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, m.isClusterRequest(r))
+		assert.NoError(t, m.handleClusterRequest(w, r))
+	}))
+	t.Cleanup(srv.Close)
+	c, err := NewCluster(zap.NewNop(), ClusterConfig{Node: name, Peers: []string{"http://unused"}, Secret: "s3cret", SyncInterval: 20 * time.Millisecond})
+	require.NoError(t, err)
+	m.cluster = c
+	m.banList.origin = name
+	return m, srv
+}
+
+func TestCluster_PeersSync(t *testing.T) {
+	a, srvA := newClusterNode(t, "a")
+	b, srvB := newClusterNode(t, "b")
+	a.cluster.config.Peers = []string{srvB.URL}
+	b.cluster.config.Peers = []string{srvA.URL}
+	a.cluster.Start(a.collectClusterState, a.applyClusterMessage)
+	b.cluster.Start(b.collectClusterState, b.applyClusterMessage)
+	t.Cleanup(a.cluster.Stop)
+	t.Cleanup(b.cluster.Stop)
+
+	// Requests spread over both nodes share one limit
+	for i := 0; i < 3; i++ {
+		assert.False(t, a.rateLimiter.isRateLimited("10.0.0.1", "/"))
+	}
+	require.Eventually(t, func() bool {
+		return b.cluster.Stats().Received > 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.False(t, b.rateLimiter.isRateLimited("10.0.0.1", "/"))
+	assert.True(t, b.rateLimiter.isRateLimited("10.0.0.1", "/"))
+
+	a.banClient("10.0.0.9", "test", time.Hour)
+	require.Eventually(t, func() bool {
+		return b.banList.Banned("10.0.0.9", time.Now())
+	}, 3*time.Second, 10*time.Millisecond)
+
+	stats := b.cluster.Stats()
+	assert.Equal(t, "b", stats.Node)
+	assert.Equal(t, "peers", stats.Transport)
+	assert.Contains(t, stats.LastReceived, "a")
+}
+
+// clusterPayload encodes a message of node b sent at a time.
+func clusterPayload(t *testing.T, sent time.Time) []byte {
+	payload, err := json.Marshal(clusterMessage{Node: "b", Sent: sent, Bans: []BanMessage{{Action: banActionBan, Ban: Ban{Key: "1.1.1.1", Origin: "b"}}}})
+	require.NoError(t, err)
+	return payload
+}
+
+func TestHandleClusterRequest_RejectsInvalidSignature(t *testing.T) {
+	m, _ := newClusterNode(t, "a")
+	payload := clusterPayload(t, time.Now())
+
+	req := httptest.NewRequest("POST", defaultClusterSyncPath, bytes.NewReader(payload))
+	req.Header.Set(clusterSignatureHeader, "deadbeef")
+	w := httptest.NewRecorder()
+	require.NoError(t, m.handleClusterRequest(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req = httptest.NewRequest("POST", defaultClusterSyncPath, bytes.NewReader(payload))
+	req.Header.Set(clusterSignatureHeader, m.cluster.sign(payload))
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleClusterRequest(w, req))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleClusterRequest(w, httptest.NewRequest("GET", defaultClusterSyncPath, nil)))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandleClusterRequest_RejectsReplays(t *testing.T) {
+	m, _ := newClusterNode(t, "a")
+	post := func(payload []byte) int {
+		req := httptest.NewRequest("POST", defaultClusterSyncPath, bytes.NewReader(payload))
+		req.Header.Set(clusterSignatureHeader, m.cluster.sign(payload))
+		w := httptest.NewRecorder()
+		require.NoError(t, m.handleClusterRequest(w, req))
+		return w.Code
+	}
+
+	now := time.Now()
+	captured := clusterPayload(t, now)
+	assert.Equal(t, http.StatusNoContent, post(captured))
+	assert.Equal(t, http.StatusBadRequest, post(captured), "replayed")
+	assert.Equal(t, http.StatusBadRequest, post(clusterPayload(t, now.Add(-time.Millisecond))), "older than the last message applied")
+	assert.Equal(t, http.StatusNoContent, post(clusterPayload(t, now.Add(time.Millisecond))))
+	assert.Equal(t, http.StatusBadRequest, post(clusterPayload(t, now.Add(time.Hour))), "outside the clock skew window")
+	assert.Equal(t, http.StatusBadRequest, post(clusterPayload(t, now.Add(-time.Hour))), "outside the clock skew window")
+	assert.Equal(t, int64(2), m.cluster.Stats().Received)
+}
+
+func TestCluster_ReceiveIgnoresOwnMessages(t *testing.T) {
+	c, err := NewCluster(nil, ClusterConfig{Node: "a", Peers: []string{"http://b"}, Secret: "s"})
+	require.NoError(t, err)
+	applied := 0
+	sent := time.Now().Format(time.RFC3339Nano)
+	require.NoError(t, c.receive([]byte(`{"node":"a","sent":"`+sent+`"}`), func(clusterMessage) { applied++ }))
+	require.NoError(t, c.receive([]byte(`{"node":"b","sent":"`+sent+`"}`), func(clusterMessage) { applied++ }))
+	assert.Error(t, c.receive([]byte(`{}`), func(clusterMessage) { applied++ }))
+	assert.Equal(t, 1, applied)
+}
+
+func TestCluster_BackendSync(t *testing.T) {
+	broker := newFakeBroker(t, serveRedis)
+	newNode := func(name string) *Middleware {
+		m := newBanTestMiddleware(BanConfig{})
+		c, err := NewCluster(zap.NewNop(), ClusterConfig{
+			Node:         name,
+			Backend:      &BanPropagationConfig{Type: BanPropagationRedis, Address: broker.ln.Addr().String()},
+			SyncInterval: 20 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		m.cluster = c
+		m.banList.origin = name
+		c.Start(m.collectClusterState, m.applyClusterMessage)
+		t.Cleanup(c.Stop)
+		return m
+	}
+	a, b := newNode("a"), newNode("b")
+	require.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.subs) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	a.banClient("10.0.0.9", "test", time.Hour)
+	require.Eventually(t, func() bool {
+		return b.banList.Banned("10.0.0.9", time.Now())
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "redis", b.cluster.Stats().Transport)
+}
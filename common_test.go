@@ -1,6 +1,39 @@
 package caddywaf
 
-import "net/http"
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
 
 const (
 	geoIPdata  = "GeoLite2-Country.mmdb"
@@ -19,3 +52,300 @@ var customResponse = map[int]CustomBlockResponse{
 		Body:       "Access Denied",
 	},
 }
+
+// writeRuleFile writes a rule file with a single rule in dir, for the tests provisioning a
+// middleware.
+func writeRuleFile(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "rules.json")
+	rules := `[{"id": "sqli", "phase": 2, "pattern": "union select", "targets": ["ARGS"], "score": 5, "action": "block"}]`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testRequest builds a request with a body of the given content type and a log ID, for the
+// tests calling the checks directly.
+func testRequest(method, target, contentType, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test"))
+}
+
+// browserRequest returns a request with the headers of a browser.
+func browserRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36")
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "en-US")
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	return req
+}
+
+// compressBody compresses body with a Content-Encoding.
+func compressBody(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		writer, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		var err error
+		writer, err = zstd.NewWriter(&buf)
+		require.NoError(t, err)
+	}
+	_, err := writer.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+// conditionMiddleware returns a middleware ready to evaluate rules and their conditions.
+func conditionMiddleware() *Middleware {
+	return &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		AnomalyThreshold:      10,
+		Rules:                 map[int][]Rule{},
+	}
+}
+
+// newAPITestMiddleware returns a middleware serving the admin API.
+func newAPITestMiddleware() *Middleware {
+	m := &Middleware{
+		logger:         zap.NewNop(),
+		AdminAPI:       defaultAdminAPIPrefix,
+		latencyTracker: NewLatencyTracker(),
+	}
+	m.apiRoutes = m.registerAPIRoutes()
+	return m
+}
+
+// newBanTestMiddleware returns a middleware serving the admin API with a ban list.
+func newBanTestMiddleware(config BanConfig) *Middleware {
+	m := newAPITestMiddleware()
+	m.banList = NewBanList(config)
+	return m
+}
+
+// newExplainMiddleware returns a middleware serving the admin API with two scoring rules.
+func newExplainMiddleware() *Middleware {
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		AnomalyThreshold: 10,
+		Rules: map[int][]Rule{
+			2: {
+				{ID: "sqli-1", Targets: []string{"URL_PARAM:id"}, Phase: 2, Score: 4, Action: "score", regex: regexp.MustCompile(`union`)},
+				{ID: "scanner-ua", Targets: []string{"USER_AGENT"}, Phase: 2, Score: 8, Action: "score", regex: regexp.MustCompile(`sqlmap`)},
+			},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		AdminAPI:              defaultAdminAPIPrefix,
+		transactions:          newTransactionLog(10),
+	}
+	m.apiRoutes = m.registerAPIRoutes()
+	return m
+}
+
+// fakeBroker is a minimal Redis or NATS server relaying published messages to subscribers.
+type fakeBroker struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	subs []net.Conn
+	auth string          // Last password or token presented by a client
+	keys map[string]bool // Redis keys set
+}
+
+// newFakeBroker starts a broker serving connections with serve, closed with the test.
+func newFakeBroker(t *testing.T, serve func(b *fakeBroker, conn net.Conn)) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(b, conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) addSubscriber(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, conn)
+}
+
+func (b *fakeBroker) broadcast(format func(payload string) string, payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		_, _ = io.WriteString(sub, format(payload))
+	}
+}
+
+// setKey sets a Redis key, reporting whether it was not set yet.
+func (b *fakeBroker) setKey(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.keys == nil {
+		b.keys = make(map[string]bool)
+	}
+	if b.keys[key] {
+		return false
+	}
+	b.keys[key] = true
+	return true
+}
+
+func (b *fakeBroker) deleteKey(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.keys, key)
+}
+
+func (b *fakeBroker) setAuth(auth string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.auth = auth
+}
+
+// serveRedis answers the Redis commands used by the ban propagation, the cluster and the
+// replay detection.
+func serveRedis(b *fakeBroker, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			header, _ := r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			b.setAuth(args[1])
+			_, _ = io.WriteString(conn, "+OK\r\n")
+		case "SUBSCRIBE":
+			_, _ = fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+			b.addSubscriber(conn)
+		case "SET": // With NX
+			if b.setKey(args[1]) {
+				_, _ = io.WriteString(conn, "+OK\r\n")
+			} else {
+				_, _ = io.WriteString(conn, "$-1\r\n")
+			}
+		case "DEL":
+			b.deleteKey(args[1])
+			_, _ = io.WriteString(conn, ":1\r\n")
+		case "PUBLISH":
+			_, _ = io.WriteString(conn, ":1\r\n")
+			channel := args[1]
+			b.broadcast(func(p string) string {
+				return fmt.Sprintf("*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(p), p)
+			}, args[2])
+		}
+	}
+}
+
+// newTestEventStore opens an event store in a temporary directory, closed with the test.
+func newTestEventStore(t *testing.T, retention time.Duration) *EventStore {
+	t.Helper()
+	es, err := NewEventStore(zap.NewNop(), EventStoreConfig{
+		Path:      filepath.Join(t.TempDir(), "events.db"),
+		Retention: retention,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { es.Close() })
+	return es
+}
+
+// solveChallenge finds the nonce a browser would, returning the cookie value.
+func solveChallenge(seed string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		value := seed + "." + strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(value))) >= difficulty {
+			return value
+		}
+	}
+}
+
+// testClientCertificate returns a self-signed client certificate.
+func testClientCertificate(t *testing.T, commonName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"billing.example.com"},
+		EmailAddresses: []string{"billing@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+		URIs:           []*url.URL{spiffe},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+// buildTestMMDB returns a minimal IPv4 MaxMind DB without data records.
+func buildTestMMDB(buildEpoch uint32) []byte {
+	str := func(s string) []byte { return append([]byte{byte(2<<5 | len(s))}, s...) }
+	u16 := func(v byte) []byte { return []byte{5<<5 | 1, v} }
+	var db []byte
+	db = append(db, 0, 0, 1, 0, 0, 1) // One node, both records point to "no data"
+	db = append(db, make([]byte, 16)...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 7<<5|9) // Metadata map with 9 entries
+	db = append(db, str("node_count")...)
+	db = append(db, 6<<5|1, 1)
+	db = append(db, str("record_size")...)
+	db = append(db, u16(24)...)
+	db = append(db, str("ip_version")...)
+	db = append(db, u16(4)...)
+	db = append(db, str("database_type")...)
+	db = append(db, str("Test")...)
+	db = append(db, str("languages")...)
+	db = append(db, 0, 4) // Empty array
+	db = append(db, str("binary_format_major_version")...)
+	db = append(db, u16(2)...)
+	db = append(db, str("binary_format_minor_version")...)
+	db = append(db, u16(0)...)
+	db = append(db, str("build_epoch")...)
+	db = append(db, 4, 2, byte(buildEpoch>>24), byte(buildEpoch>>16), byte(buildEpoch>>8), byte(buildEpoch))
+	db = append(db, str("description")...)
+	db = append(db, 7<<5)
+	return db
+}
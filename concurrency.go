@@ -0,0 +1,100 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const concurrencyRuleID = "concurrency_limit_rule"
+
+// ConcurrencyLimitConfig caps the requests a client has in flight at once, so a single
+// client can't tie up the upstream with many parallel slow requests. Unlike the rate
+// limiter it counts requests until their response is sent, not per time window.
+type ConcurrencyLimitConfig struct {
+	PerIP         int `json:"per_ip,omitempty"`         // In-flight requests per client IP, 0 for no limit
+	PerConnection int `json:"per_connection,omitempty"` // In-flight requests per connection, such as HTTP/2 streams, 0 for no limit
+
+	mu       sync.Mutex
+	inFlight map[string]int // Keyed by IP or by connection address
+}
+
+// acquire counts a request of key in flight unless key already has limit requests in
+// flight. It reports whether the request was counted.
+func (c *ConcurrencyLimitConfig) acquire(key string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight == nil {
+		c.inFlight = make(map[string]int)
+	}
+	if c.inFlight[key] >= limit {
+		return false
+	}
+	c.inFlight[key]++
+	return true
+}
+
+// release ends a request of key counted by acquire.
+func (c *ConcurrencyLimitConfig) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[key] <= 1 {
+		delete(c.inFlight, key) // Idle clients take no memory
+		return
+	}
+	c.inFlight[key]--
+}
+
+// InFlight returns the number of requests of key in flight.
+func (c *ConcurrencyLimitConfig) InFlight(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight[key]
+}
+
+// acquireConcurrency counts the request against the in-flight limits of its IP and
+// connection, blocking it with 429 when either is reached. The returned release must be
+// called once the request completes; it is only returned when the request was allowed.
+func (m *Middleware) acquireConcurrency(w http.ResponseWriter, r *http.Request, state *WAFState) (func(), bool) {
+	config := m.ConcurrencyLimit
+	if config == nil {
+		return func() {}, true
+	}
+	ipKey := "ip:" + m.scopedKey(r, extractIP(r.RemoteAddr))
+	connKey := "conn:" + r.RemoteAddr // The client port tells connections apart
+	if !config.acquire(ipKey, config.PerIP) {
+		m.rejectConcurrent(w, r, state, fmt.Sprintf("more than %d requests in flight from the IP", config.PerIP))
+		return nil, false
+	}
+	if !config.acquire(connKey, config.PerConnection) {
+		if config.PerIP > 0 {
+			config.release(ipKey)
+		}
+		m.rejectConcurrent(w, r, state, fmt.Sprintf("more than %d requests in flight on the connection", config.PerConnection))
+		return nil, false
+	}
+	return func() {
+		if config.PerIP > 0 {
+			config.release(ipKey)
+		}
+		if config.PerConnection > 0 {
+			config.release(connKey)
+		}
+	}, true
+}
+
+// rejectConcurrent blocks a request over a concurrency limit.
+func (m *Middleware) rejectConcurrent(w http.ResponseWriter, r *http.Request, state *WAFState, detection string) {
+	m.concurrencyHits.Add(1)
+	m.incrementRuleHitCount(RuleID(concurrencyRuleID))
+	state.MatchedRules = append(state.MatchedRules, concurrencyRuleID)
+	m.blockRequest(w, r, state, http.StatusTooManyRequests, "concurrency_limit", concurrencyRuleID,
+		zap.String("message", "Request blocked by concurrency limit"),
+		zap.String("detection", detection),
+	)
+}
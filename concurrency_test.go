@@ -0,0 +1,107 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConcurrencyLimit_AcquireRelease(t *testing.T) {
+	c := &ConcurrencyLimitConfig{}
+	assert.True(t, c.acquire("a", 2))
+	assert.True(t, c.acquire("a", 2))
+	assert.False(t, c.acquire("a", 2))
+	assert.True(t, c.acquire("b", 2), "keys are counted separately")
+	assert.Equal(t, 2, c.InFlight("a"))
+
+	c.release("a")
+	assert.True(t, c.acquire("a", 2))
+	c.release("a")
+	c.release("a")
+	c.release("b")
+	assert.Empty(t, c.inFlight, "idle keys are dropped")
+	assert.True(t, c.acquire("a", 0), "zero is no limit")
+}
+
+func TestAcquireConcurrency(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), ConcurrencyLimit: &ConcurrencyLimitConfig{PerIP: 2, PerConnection: 1}}
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	release1, ok := m.acquireConcurrency(httptest.NewRecorder(), request("192.0.2.1:1000"), &WAFState{})
+	require.True(t, ok)
+
+	// A second stream on the same connection is over the per-connection limit
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	_, ok = m.acquireConcurrency(w, request("192.0.2.1:1000"), state)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, []string{concurrencyRuleID}, state.MatchedRules)
+	assert.Equal(t, 1, m.ConcurrencyLimit.InFlight("ip:192.0.2.1"), "the IP slot is given back")
+
+	release2, ok := m.acquireConcurrency(httptest.NewRecorder(), request("192.0.2.1:2000"), &WAFState{})
+	require.True(t, ok)
+	_, ok = m.acquireConcurrency(httptest.NewRecorder(), request("192.0.2.1:3000"), &WAFState{})
+	assert.False(t, ok, "over the per-IP limit")
+	_, ok = m.acquireConcurrency(httptest.NewRecorder(), request("192.0.2.2:1000"), &WAFState{})
+	assert.True(t, ok, "other clients are not affected")
+
+	release1()
+	release2()
+	assert.Zero(t, m.ConcurrencyLimit.InFlight("ip:192.0.2.1"))
+	assert.Equal(t, int64(2), m.concurrencyHits.Load())
+}
+
+func TestConcurrencyLimit_ServeHTTP(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ConcurrencyLimit:      &ConcurrencyLimitConfig{PerIP: 1},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+
+	entered, proceed := make(chan struct{}), make(chan struct{})
+	slow := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		close(entered)
+		<-proceed
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	fast := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	send := func(next caddyhttp.Handler) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		w := httptest.NewRecorder()
+		require.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusOK, send(slow))
+	}()
+	<-entered
+	assert.Equal(t, http.StatusTooManyRequests, send(fast), "the slow request is still in flight")
+	close(proceed)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, send(fast), "the slot is released once the request completes")
+}
@@ -2,13 +2,18 @@ package caddywaf
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
@@ -35,6 +40,23 @@ func (cl *ConfigLoader) parseMetricsEndpoint(d *caddyfile.Dispenser, m *Middlewa
 	return nil
 }
 
+// parseRuleHitsFile parses the rule_hits_file directive.
+func (cl *ConfigLoader) parseRuleHitsFile(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.RuleHitsFile = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	cl.logger.Debug("Rule hits file configured",
+		zap.String("path", m.RuleHitsFile),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
 // parseLogPath parses the log_path directive.
 func (cl *ConfigLoader) parseLogPath(d *caddyfile.Dispenser, m *Middleware) error {
 	if !d.NextArg() {
@@ -105,6 +127,20 @@ func (cl *ConfigLoader) parseRateLimit(d *caddyfile.Dispenser, m *Middleware) er
 			rl.MatchAllPaths = matchAllPaths
 			cl.logger.Debug("Rate limit match_all_paths set", zap.Bool("match_all_paths", rl.MatchAllPaths))
 
+		case "active_hours":
+			hours, err := cl.parseActiveHours(d)
+			if err != nil {
+				return err
+			}
+			rl.ActiveHours = hours
+
+		case "active_days":
+			days, err := cl.parseActiveDays(d)
+			if err != nil {
+				return err
+			}
+			rl.ActiveDays = days
+
 		default:
 			return d.Errf("unrecognized rate_limit option: %s", option)
 		}
@@ -138,20 +174,93 @@ func (cl *ConfigLoader) UnmarshalCaddyfile(d *caddyfile.Dispenser, m *Middleware
 
 	directiveHandlers := map[string]func(d *caddyfile.Dispenser, m *Middleware) error{
 		"metrics_endpoint":      cl.parseMetricsEndpoint,
+		"rule_hits_file":        cl.parseRuleHitsFile,
 		"log_path":              cl.parseLogPath,
 		"rate_limit":            cl.parseRateLimit,
 		"block_countries":       cl.parseCountryBlockDirective(true),  // Use directive-specific helper
 		"whitelist_countries":   cl.parseCountryBlockDirective(false), // Use directive-specific helper
+		"timezone":              cl.parseTimezone,
 		"log_severity":          cl.parseLogSeverity,
 		"log_json":              cl.parseLogJSON,
 		"rule_file":             cl.parseRuleFile,
+		"rule_canary":           cl.parseRuleCanary,
+		"rule_coverage":         cl.parseRuleCoverage,
+		"false_positives":       cl.parseFalsePositives,
+		"learning":              cl.parseLearning,
+		"param_anomaly":         cl.parseParamAnomaly,
+		"decode_layers":         cl.parseDecodeLayers,
+		"deserialization":       cl.parseDeserialization,
+		"ssrf":                  cl.parseSSRF,
+		"open_redirect":         cl.parseOpenRedirect,
+		"request_smuggling":     cl.parseSmuggling,
+		"crlf_injection":        cl.parseCRLF,
+		"request_decompress":    cl.parseRequestDecompress,
 		"ip_blacklist_file":     cl.parseBlacklistFileDirective(true),  // Use directive-specific helper
 		"dns_blacklist_file":    cl.parseBlacklistFileDirective(false), // Use directive-specific helper
+		"ip_blacklist_prefix":   cl.parseIPBlacklistPrefix,
+		"path_blacklist_file":   cl.parsePathBlacklistFile,
+		"cert_blacklist_file":   cl.parseCertBlacklistFile,
 		"anomaly_threshold":     cl.parseAnomalyThreshold,
 		"custom_response":       cl.parseCustomResponse,
+		"block_status":          cl.parseBlockStatus,
 		"redact_sensitive_data": cl.parseRedactSensitiveData,
 		"tor":                   cl.parseTorBlock,
 		"log_buffer":            cl.parseLogBuffer,
+		"log_overflow":          cl.parseLogOverflow,
+		"log_dedup":             cl.parseLogDedup,
+		"notify":                cl.parseNotify,
+		"email_alert":           cl.parseEmailAlert,
+		"siem_output":           cl.parseSIEMOutput,
+		"fail2ban_output":       cl.parseFail2banOutput,
+		"tracing":               cl.parseTracing,
+		"latency_metrics":       cl.parseLatencyMetrics,
+		"admin_api":             cl.parseAdminAPI,
+		"explain":               cl.parseExplain,
+		"endpoint_auth":         cl.parseEndpointAuth,
+		"event_store":           cl.parseEventStore,
+		"tenant_by_host":        cl.parseTenantByHost,
+		"host":                  cl.parseHostOverlay,
+		"config_source":         cl.parseConfigSource,
+		"ban":                   cl.parseBan,
+		"ban_export":            cl.parseBanExport,
+		"stats_export":          cl.parseStatsExport,
+		"cluster":               cl.parseCluster,
+		"geoip_update":          cl.parseGeoIPUpdate,
+		"inspection_pool":       cl.parseInspectionPool,
+		"inspection_budget":     cl.parseInspectionBudget,
+		"response_buffer_limit": cl.parseResponseBufferLimit,
+		"response_decompress":   cl.parseResponseDecompress,
+		"lookup_cache":          cl.parseLookupCache,
+		"dns_blacklist_index":   cl.parseDNSBlacklistIndex,
+		"param_schema":          cl.parseParamSchema,
+		"openapi":               cl.parseOpenAPI,
+		"json_schema":           cl.parseJSONSchema,
+		"credential_stuffing":   cl.parseCredentialStuffing,
+		"challenge":             cl.parseChallenge,
+		"lockdown":              cl.parseLockdown,
+		"geo_velocity":          cl.parseGeoVelocity,
+		"slow_client":           cl.parseSlowClient,
+		"concurrency_limit":     cl.parseConcurrencyLimit,
+		"replay":                cl.parseReplay,
+		"quota":                 cl.parseQuota,
+		"cost_limit":            cl.parseCostLimit,
+		"bot_score":             cl.parseBotScore,
+		"ip_type":               cl.parseIPType,
+		"cdn_origin":            cl.parseCDNOrigin,
+		"reputation":            cl.parseReputation,
+		"inspector":             cl.parseInspector,
+		"icap":                  cl.parseICAP,
+		"upload_policy":         cl.parseUploadPolicy,
+		"max_body_size":         cl.parseMaxBodySize,
+		"hotlink_protection":    cl.parseHotlink,
+		"signed_url":            cl.parseSignedURL,
+		"request_signing":       cl.parseRequestSigning,
+		"token_introspection":   cl.parseTokenIntrospection,
+		"graphql":               cl.parseGraphQL,
+		"rpc":                   cl.parseRPC,
+		"xxe":                   cl.parseXXE,
+		"clamav":                cl.parseClamAV,
+		"yara_rules":            cl.parseYARARules,
 	}
 
 	for d.Next() {
@@ -195,6 +304,48 @@ func (cl *ConfigLoader) parseRuleFile(d *caddyfile.Dispenser, m *Middleware) err
 	return nil
 }
 
+// parseBlockStatus parses the block_status directive: block_status [<default>]
+// [{ <category> <status> }].
+func (cl *ConfigLoader) parseBlockStatus(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &BlockStatusConfig{}
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		return d.ArgErr()
+	}
+	if len(args) == 1 {
+		code, err := strconv.Atoi(args[0])
+		if err != nil {
+			return d.Errf("invalid block_status default '%s': %v", args[0], err)
+		}
+		config.Default = code
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		category := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		code, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("invalid block_status %s status '%s': %v", category, d.Val(), err)
+		}
+		if config.Categories == nil {
+			config.Categories = make(map[string]int)
+		}
+		config.Categories[category] = code
+	}
+	if err := config.validate(); err != nil {
+		return d.Err(err.Error())
+	}
+	m.BlockStatus = config
+	cl.logger.Debug("Block status configured",
+		zap.Int("default", config.Default),
+		zap.Any("categories", config.Categories),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
 func (cl *ConfigLoader) parseCustomResponse(d *caddyfile.Dispenser, m *Middleware) error {
 	if m.CustomResponses == nil {
 		m.CustomResponses = make(map[int]CustomBlockResponse)
@@ -228,8 +379,12 @@ func (cl *ConfigLoader) parseCustomResponse(d *caddyfile.Dispenser, m *Middlewar
 		if err != nil {
 			return err
 		}
+		if contentTypeOrFile == "file" {
+			contentTypeOrFile = responseFileContentType(filePath)
+		}
 		resp.Headers["Content-Type"] = contentTypeOrFile
 		resp.Body = content
+		resp.File = filePath
 		cl.logger.Debug("Loaded custom response from file",
 			zap.Int("status_code", statusCode),
 			zap.String("file_path", filePath),
@@ -252,6 +407,38 @@ func (cl *ConfigLoader) parseCustomResponse(d *caddyfile.Dispenser, m *Middlewar
 			zap.Int("line", d.Line()),
 		)
 	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "language":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if _, exists := resp.Languages[args[0]]; exists {
+				return d.Errf("custom_response %d language %s already defined", statusCode, args[0])
+			}
+			content, err := cl.readResponseFromFile(d, args[1])
+			if err != nil {
+				return err
+			}
+			if resp.Languages == nil {
+				resp.Languages = make(map[string]ResponseVariant)
+			}
+			resp.Languages[args[0]] = ResponseVariant{Body: content, File: args[1]}
+			cl.logger.Debug("Loaded localized custom response",
+				zap.Int("status_code", statusCode),
+				zap.String("language", args[0]),
+				zap.String("file_path", args[1]),
+				zap.String("file", d.File()),
+				zap.Int("line", d.Line()),
+			)
+		default:
+			return d.Errf("unrecognized custom_response subdirective: %s", d.Val())
+		}
+	}
+	if err := resp.load(); err != nil {
+		return d.Err(err.Error())
+	}
 	m.CustomResponses[statusCode] = resp
 	return nil
 }
@@ -278,11 +465,33 @@ func (cl *ConfigLoader) parseCountryBlockDirective(isBlock bool) func(d *caddyfi
 			target.CountryList = append(target.CountryList, country)
 		}
 
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			option := d.Val()
+			switch option {
+			case "active_hours":
+				hours, err := cl.parseActiveHours(d)
+				if err != nil {
+					return err
+				}
+				target.ActiveHours = hours
+			case "active_days":
+				days, err := cl.parseActiveDays(d)
+				if err != nil {
+					return err
+				}
+				target.ActiveDays = days
+			default:
+				return d.Errf("unrecognized %s option: %s", directiveName, option)
+			}
+		}
+
 		cl.logger.Debug("Country list configured",
 			zap.String("directive", directiveName),
 			zap.Bool("block_mode", isBlock),
 			zap.Strings("countries", target.CountryList),
 			zap.String("geoip_db_path", target.GeoIPDBPath),
+			zap.String("active_hours", target.ActiveHours),
+			zap.Strings("active_days", target.ActiveDays),
 			zap.String("file", d.File()),
 			zap.Int("line", d.Line()),
 		)
@@ -290,6 +499,27 @@ func (cl *ConfigLoader) parseCountryBlockDirective(isBlock bool) func(d *caddyfi
 	}
 }
 
+// parseTimezone sets the IANA timezone, such as Europe/Rome, of the active hours and days of
+// rules and filters.
+func (cl *ConfigLoader) parseTimezone(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	if _, err := time.LoadLocation(d.Val()); err != nil {
+		return d.Errf("invalid timezone '%s': %v", d.Val(), err)
+	}
+	m.Timezone = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	cl.logger.Debug("Timezone set",
+		zap.String("timezone", m.Timezone),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
 func (cl *ConfigLoader) parseLogSeverity(d *caddyfile.Dispenser, m *Middleware) error {
 	if !d.NextArg() {
 		return d.ArgErr()
@@ -345,6 +575,65 @@ func (cl *ConfigLoader) parseBlacklistFileDirective(isIP bool) func(d *caddyfile
 	}
 }
 
+// parseIPBlacklistPrefix parses the prefix lengths blocked by single addresses in the IP
+// blacklist: ip_blacklist_prefix [ipv4 <bits>] [ipv6 <bits>]
+func (cl *ConfigLoader) parseIPBlacklistPrefix(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args)%2 != 0 {
+		return d.ArgErr()
+	}
+	for i := 0; i < len(args); i += 2 {
+		bits, err := strconv.Atoi(args[i+1])
+		if err != nil || bits <= 0 {
+			return d.Errf("invalid ip_blacklist_prefix length for %s: %s", args[i], args[i+1])
+		}
+		switch args[i] {
+		case "ipv4":
+			m.IPBlacklistIPv4Prefix = bits
+		case "ipv6":
+			m.IPBlacklistIPv6Prefix = bits
+		default:
+			return d.Errf("unknown ip_blacklist_prefix family: %s, must be ipv4 or ipv6", args[i])
+		}
+	}
+	if err := validateIPBlacklistPrefixes(m.IPBlacklistIPv4Prefix, m.IPBlacklistIPv6Prefix); err != nil {
+		return d.Err(err.Error())
+	}
+	cl.logger.Debug("IP blacklist prefix lengths configured",
+		zap.Int("ipv4", m.IPBlacklistIPv4Prefix),
+		zap.Int("ipv6", m.IPBlacklistIPv6Prefix),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+func (cl *ConfigLoader) parsePathBlacklistFile(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.PathBlacklistFile = d.Val()
+	cl.logger.Debug("Path blacklist file set",
+		zap.String("path", m.PathBlacklistFile),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+func (cl *ConfigLoader) parseCertBlacklistFile(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.CertBlacklistFile = d.Val()
+	cl.logger.Debug("Certificate blacklist file set",
+		zap.String("path", m.CertBlacklistFile),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
 func (cl *ConfigLoader) parseAnomalyThreshold(d *caddyfile.Dispenser, m *Middleware) error {
 	threshold, err := cl.parsePositiveInteger(d, "anomaly_threshold")
 	if err != nil {
@@ -425,48 +714,3354 @@ func (cl *ConfigLoader) parseLogBuffer(d *caddyfile.Dispenser, m *Middleware) er
 	return nil
 }
 
-// --- Helper Functions ---
-
-// parsePositiveInteger parses a directive argument as a positive integer.
-func (cl *ConfigLoader) parsePositiveInteger(d *caddyfile.Dispenser, directiveName string) (int, error) {
-	if !d.NextArg() {
-		return 0, d.ArgErr()
-	}
-	valStr := d.Val()
-	val, err := strconv.Atoi(valStr)
-	if err != nil {
-		return 0, d.Errf("invalid %s value '%s': %v", directiveName, valStr, err)
+// parseLogOverflow parses the policy applied when the log buffer is full, e.g. "log_overflow block_with_timeout 50ms".
+// parseLogDedup parses the log_dedup directive: log_dedup [{ window, limit, severity
+// <severity> <limit|off>, ipv4_prefix, ipv6_prefix }].
+func (cl *ConfigLoader) parseLogDedup(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &LogDedupConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "window":
+			window, err := cl.parseDuration(d, "log_dedup window")
+			if err != nil {
+				return err
+			}
+			config.Window = window
+		case "limit":
+			limit, err := cl.parsePositiveInteger(d, "log_dedup limit")
+			if err != nil {
+				return err
+			}
+			config.Limit = limit
+		case "severity":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			severity := strings.ToUpper(args[0])
+			if _, ok := severityLevels[severity]; !ok {
+				return d.Errf("invalid log_dedup severity: %s, must be LOW, MEDIUM, HIGH or CRITICAL", args[0])
+			}
+			limit := logDedupUnlimited
+			if args[1] != "off" {
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n < 0 {
+					return d.Errf("invalid log_dedup severity limit: %s, must be a number or off", args[1])
+				}
+				limit = n
+			}
+			if config.Severities == nil {
+				config.Severities = make(map[string]int)
+			}
+			config.Severities[severity] = limit
+		case "ipv4_prefix", "ipv6_prefix":
+			bits, err := cl.parsePositiveInteger(d, "log_dedup "+option)
+			if err != nil {
+				return err
+			}
+			if option == "ipv4_prefix" {
+				if bits > 32 {
+					return d.Errf("log_dedup ipv4_prefix must be at most 32, but got '%d'", bits)
+				}
+				config.IPv4Prefix = bits
+			} else {
+				if bits > 128 {
+					return d.Errf("log_dedup ipv6_prefix must be at most 128, but got '%d'", bits)
+				}
+				config.IPv6Prefix = bits
+			}
+		default:
+			return d.Errf("unrecognized log_dedup option: %s", option)
+		}
 	}
-	if val <= 0 {
-		return 0, d.Errf("%s must be a positive integer, but got '%d'", directiveName, val)
+	m.LogDedup = config
+	cl.logger.Debug("Rule log deduplication configured",
+		zap.Duration("window", config.Window),
+		zap.Int("limit", config.Limit),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseRuleCanary parses the rule_canary block.
+func (cl *ConfigLoader) parseRuleCanary(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &RuleCanaryConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "duration":
+			duration, err := cl.parseDuration(d, "rule_canary duration")
+			if err != nil {
+				return err
+			}
+			config.Duration = duration
+		case "max_match_percent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil || percent <= 0 || percent > 100 {
+				return d.Errf("invalid rule_canary max_match_percent: %s, must be between 0 and 100", d.Val())
+			}
+			config.MaxMatchPercent = percent
+		default:
+			return d.Errf("unrecognized rule_canary option: %s", option)
+		}
 	}
-	return val, nil
+	m.RuleCanary = config
+	cl.logger.Debug("Rule canary configured",
+		zap.Duration("duration", config.Duration),
+		zap.Float64("max_match_percent", config.MaxMatchPercent),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
 }
 
-// parseDuration parses a directive argument as a time duration.
-func (cl *ConfigLoader) parseDuration(d *caddyfile.Dispenser, directiveName string) (time.Duration, error) {
-	if !d.NextArg() {
-		return 0, d.ArgErr()
+// parseRuleCoverage parses the rule_coverage block.
+func (cl *ConfigLoader) parseRuleCoverage(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &RuleCoverageConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "log_interval":
+			interval, err := cl.parseDuration(d, "rule_coverage log_interval")
+			if err != nil {
+				return err
+			}
+			if interval <= 0 {
+				return d.Errf("rule_coverage log_interval must be positive, got %s", interval)
+			}
+			config.LogInterval = interval
+		default:
+			return d.Errf("unrecognized rule_coverage option: %s", option)
+		}
 	}
-	durationStr := d.Val()
-	duration, err := time.ParseDuration(durationStr)
-	if err != nil {
-		return 0, d.Errf("invalid %s value '%s': %v", directiveName, durationStr, err)
+	m.RuleCoverage = config
+	cl.logger.Debug("Rule coverage configured", zap.Duration("log_interval", config.LogInterval), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseFalsePositives parses the false_positives block.
+func (cl *ConfigLoader) parseFalsePositives(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &FalsePositiveConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "disable_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil || rate <= 0 || rate > 100 {
+				return d.Errf("invalid false_positives disable_rate: %s, must be between 0 and 100", d.Val())
+			}
+			config.DisableRate = rate
+		case "min_reports":
+			reports, err := cl.parsePositiveInteger(d, "false_positives min_reports")
+			if err != nil {
+				return err
+			}
+			config.MinReports = reports
+		default:
+			return d.Errf("unrecognized false_positives option: %s", option)
+		}
 	}
-	return duration, nil
+	m.FalsePositives = config
+	cl.logger.Debug("False positive reports enabled",
+		zap.Float64("disable_rate", config.DisableRate),
+		zap.Int("min_reports", config.MinReports),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
 }
 
-// parseBool parses a directive argument as a boolean.
-func (cl *ConfigLoader) parseBool(d *caddyfile.Dispenser, directiveName string) (bool, error) {
-	if !d.NextArg() {
-		return false, d.ArgErr()
+// parseLearning parses the learning block.
+func (cl *ConfigLoader) parseLearning(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &LearningConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "duration":
+			duration, err := cl.parseDuration(d, "learning duration")
+			if err != nil {
+				return err
+			}
+			config.Duration = duration
+		case "output":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Output = d.Val()
+		case "max_paths":
+			paths, err := cl.parsePositiveInteger(d, "learning max_paths")
+			if err != nil {
+				return err
+			}
+			config.MaxPaths = paths
+		case "max_params":
+			params, err := cl.parsePositiveInteger(d, "learning max_params")
+			if err != nil {
+				return err
+			}
+			config.MaxParams = params
+		default:
+			return d.Errf("unrecognized learning option: %s", option)
+		}
 	}
-	boolStr := d.Val()
-	val, err := strconv.ParseBool(boolStr)
-	if err != nil {
-		return false, d.Errf("invalid %s value '%s': %v, must be 'true' or 'false'", directiveName, boolStr, err)
+	m.Learning = config
+	cl.logger.Debug("Learning mode enabled",
+		zap.Duration("duration", config.Duration),
+		zap.String("output", config.Output),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseParamAnomaly parses the param_anomaly directive and its optional block.
+func (cl *ConfigLoader) parseParamAnomaly(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ParamAnomalyConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "min_samples":
+			samples, err := cl.parsePositiveInteger(d, "param_anomaly min_samples")
+			if err != nil {
+				return err
+			}
+			config.MinSamples = samples
+		case "deviation":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			deviation, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || deviation <= 0 {
+				return d.Errf("invalid param_anomaly deviation: %s, must be a positive number", d.Val())
+			}
+			config.Deviation = deviation
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "param_anomaly score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		case "max_params":
+			params, err := cl.parsePositiveInteger(d, "param_anomaly max_params")
+			if err != nil {
+				return err
+			}
+			config.MaxParams = params
+		default:
+			return d.Errf("unrecognized param_anomaly option: %s", option)
+		}
 	}
-	return val, nil
+	m.ParamAnomaly = config
+	cl.logger.Debug("Parameter anomaly detection enabled",
+		zap.Int("min_samples", config.MinSamples),
+		zap.Float64("deviation", config.Deviation),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseDecodeLayers parses the decode_layers directive and its optional block.
+func (cl *ConfigLoader) parseDecodeLayers(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &DecodeLayersConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "depth":
+			depth, err := cl.parsePositiveInteger(d, "decode_layers depth")
+			if err != nil {
+				return err
+			}
+			config.Depth = depth
+		case "decoders":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return d.ArgErr()
+			}
+			for _, name := range names {
+				if !isDecoder(name) {
+					return d.Errf("unknown decode_layers decoder: %s, must be url, unicode, hex or base64", name)
+				}
+			}
+			config.Decoders = names
+		case "max_bytes":
+			maxBytes, err := cl.parsePositiveInteger(d, "decode_layers max_bytes")
+			if err != nil {
+				return err
+			}
+			config.MaxBytes = maxBytes
+		default:
+			return d.Errf("unrecognized decode_layers option: %s", option)
+		}
+	}
+	m.DecodeLayers = config
+	cl.logger.Debug("Multi-layer decoding enabled",
+		zap.Int("depth", config.Depth),
+		zap.Strings("decoders", config.Decoders),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseDeserialization parses the deserialization directive and its optional block.
+func (cl *ConfigLoader) parseDeserialization(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &DeserializationConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "formats":
+			formats := d.RemainingArgs()
+			if len(formats) == 0 {
+				return d.ArgErr()
+			}
+			for _, format := range formats {
+				if !isDeserializationFormat(format) {
+					return d.Errf("unknown deserialization format: %s, must be java, php or dotnet", format)
+				}
+			}
+			config.Formats = formats
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid deserialization action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "deserialization score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized deserialization option: %s", option)
+		}
+	}
+	m.Deserialization = config
+	cl.logger.Debug("Deserialization detection enabled",
+		zap.Strings("formats", config.Formats),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseXXE parses the xxe directive and its optional block.
+func (cl *ConfigLoader) parseXXE(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &XXEConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "constructs":
+			constructs := d.RemainingArgs()
+			if len(constructs) == 0 {
+				return d.ArgErr()
+			}
+			for _, construct := range constructs {
+				if !slices.Contains(xxeConstructs, construct) {
+					return d.Errf("unknown xxe construct: %s, must be doctype, entity, external_entity or expansion", construct)
+				}
+			}
+			config.Constructs = constructs
+		case "max_expansion":
+			size, err := cl.parsePositiveInteger(d, "xxe max_expansion")
+			if err != nil {
+				return err
+			}
+			config.MaxExpansion = size
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid xxe action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "xxe score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized xxe option: %s", option)
+		}
+	}
+	m.XXE = config
+	cl.logger.Debug("XXE detection enabled",
+		zap.Strings("constructs", config.Constructs),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseSSRF parses the ssrf directive and its optional block.
+func (cl *ConfigLoader) parseSSRF(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &SSRFConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid ssrf action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "ssrf score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized ssrf option: %s", option)
+		}
+	}
+	m.SSRF = config
+	cl.logger.Debug("SSRF detection enabled",
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseRequestDecompress parses the request_decompress directive and its optional block.
+func (cl *ConfigLoader) parseRequestDecompress(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &RequestDecompressConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "limit":
+			limit, err := cl.parsePositiveInteger(d, "request_decompress limit")
+			if err != nil {
+				return err
+			}
+			config.Limit = int64(limit)
+		case "max_ratio":
+			ratio, err := cl.parsePositiveInteger(d, "request_decompress max_ratio")
+			if err != nil {
+				return err
+			}
+			config.MaxRatio = ratio
+		case "reject":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Reject = true
+		case "on_unsupported":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			action := strings.ToLower(d.Val())
+			if action != requestEncodingBlock && action != requestEncodingAllow {
+				return d.Errf("invalid request_decompress on_unsupported: %s, must be block or allow", d.Val())
+			}
+			config.OnUnsupported = action
+		default:
+			return d.Errf("unrecognized request_decompress option: %s", option)
+		}
+	}
+	m.RequestDecompress = config
+	cl.logger.Debug("Request body decompression enabled",
+		zap.Int64("limit", config.Limit),
+		zap.Int("max_ratio", config.MaxRatio),
+		zap.Bool("reject", config.Reject),
+		zap.String("on_unsupported", config.OnUnsupported),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseOpenRedirect parses the open_redirect directive and its optional block.
+func (cl *ConfigLoader) parseOpenRedirect(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &OpenRedirectConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "allowed_hosts":
+			hosts := d.RemainingArgs()
+			if len(hosts) == 0 {
+				return d.ArgErr()
+			}
+			config.AllowedHosts = append(config.AllowedHosts, hosts...)
+		case "params":
+			params := d.RemainingArgs()
+			if len(params) == 0 {
+				return d.ArgErr()
+			}
+			config.Params = append(config.Params, params...)
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid open_redirect action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "open_redirect score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized open_redirect option: %s", option)
+		}
+	}
+	m.OpenRedirect = config
+	cl.logger.Debug("Open redirect detection enabled",
+		zap.Strings("allowed_hosts", config.AllowedHosts),
+		zap.Strings("params", config.Params),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseSmuggling parses the request_smuggling directive and its optional block of
+// "<check> <block|score|off> [score]" lines.
+func (cl *ConfigLoader) parseSmuggling(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &SmugglingConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !isSmugglingCheck(name) {
+			return d.Errf("unrecognized request_smuggling check: %s, must be conflicting_length, obfuscated_te, get_with_body or duplicate_length", name)
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		check := &SmugglingCheck{Action: d.Val()}
+		switch check.Action {
+		case detectionActionBlock, smugglingActionOff:
+		case detectionActionScore:
+			if d.NextArg() {
+				score, err := strconv.Atoi(d.Val())
+				if err != nil || score <= 0 {
+					return d.Errf("invalid request_smuggling score for %s: %s, must be a positive integer", name, d.Val())
+				}
+				check.Score = score
+			}
+		default:
+			return d.Errf("invalid request_smuggling action for %s: %s, must be block, score or off", name, check.Action)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if config.Checks == nil {
+			config.Checks = make(map[string]*SmugglingCheck)
+		}
+		config.Checks[name] = check
+	}
+	m.Smuggling = config
+	cl.logger.Debug("Request smuggling checks enabled",
+		zap.Int("checks", len(config.Checks)),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCRLF parses the crlf_injection directive and its optional block.
+func (cl *ConfigLoader) parseCRLF(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &CRLFConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "locations":
+			locations := d.RemainingArgs()
+			if len(locations) == 0 {
+				return d.ArgErr()
+			}
+			for _, location := range locations {
+				if !slices.Contains(crlfLocations, location) {
+					return d.Errf("unknown crlf_injection location: %s, must be path, query or headers", location)
+				}
+			}
+			config.Locations = locations
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid crlf_injection action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "crlf_injection score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized crlf_injection option: %s", option)
+		}
+	}
+	m.CRLF = config
+	cl.logger.Debug("CRLF injection detection enabled",
+		zap.Strings("locations", config.Locations),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+func (cl *ConfigLoader) parseLogOverflow(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	policy := strings.ToLower(d.Val())
+	if !isLogOverflowPolicy(policy) {
+		return d.Errf("invalid log_overflow policy: %s, must be sync, drop_oldest, drop_new or block_with_timeout", d.Val())
+	}
+	m.LogOverflow = policy
+	if d.NextArg() {
+		if policy != logOverflowBlock {
+			return d.Errf("log_overflow %s takes no timeout", policy)
+		}
+		timeout, err := time.ParseDuration(d.Val())
+		if err != nil || timeout <= 0 {
+			return d.Errf("invalid log_overflow timeout: %s", d.Val())
+		}
+		m.LogOverflowTimeout = timeout
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	cl.logger.Debug("Log overflow policy set",
+		zap.String("policy", policy),
+		zap.Duration("timeout", m.LogOverflowTimeout),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseNotify parses a notify block, e.g. "notify slack { webhook_url ... }".
+func (cl *ConfigLoader) parseNotify(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	nc := NotifierConfig{Type: strings.ToLower(d.Val())}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "webhook_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			nc.WebhookURL = d.Val()
+		case "bot_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			nc.BotToken = d.Val()
+		case "chat_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			nc.ChatID = d.Val()
+		case "template":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			nc.Template = d.Val()
+		case "min_severity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			nc.MinSeverity = strings.ToUpper(d.Val())
+		case "events":
+			nc.Events = d.RemainingArgs()
+			if len(nc.Events) == 0 {
+				return d.Err("events option requires at least one event kind")
+			}
+		case "block_rate":
+			rate, err := cl.parsePositiveInteger(d, "block_rate")
+			if err != nil {
+				return err
+			}
+			nc.BlockRate = rate
+		case "cooldown":
+			cooldown, err := cl.parseDuration(d, "cooldown")
+			if err != nil {
+				return err
+			}
+			nc.Cooldown = cooldown
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "timeout")
+			if err != nil {
+				return err
+			}
+			nc.Timeout = timeout
+		default:
+			return d.Errf("unrecognized notify option: %s", option)
+		}
+	}
+
+	if err := validateNotifierConfig(&nc); err != nil {
+		return d.Errf("invalid notify configuration: %v", err)
+	}
+
+	m.Notifiers = append(m.Notifiers, nc)
+	cl.logger.Debug("Notifier configured",
+		zap.String("type", nc.Type),
+		zap.String("min_severity", nc.MinSeverity),
+		zap.Int("block_rate", nc.BlockRate),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseEmailAlert parses the email_alert block.
+func (cl *ConfigLoader) parseEmailAlert(d *caddyfile.Dispenser, m *Middleware) error {
+	if m.EmailAlert != nil {
+		return d.Err("email_alert directive already specified")
+	}
+	ea := EmailAlertConfig{}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "smtp_server":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ea.SMTPServer = d.Val()
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ea.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ea.Password = d.Val()
+		case "from":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ea.From = d.Val()
+		case "to":
+			ea.To = d.RemainingArgs()
+			if len(ea.To) == 0 {
+				return d.Err("to option requires at least one address")
+			}
+		case "subject":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ea.Subject = d.Val()
+		case "block_threshold":
+			threshold, err := cl.parsePositiveInteger(d, "block_threshold")
+			if err != nil {
+				return err
+			}
+			ea.BlockThreshold = threshold
+		case "window":
+			window, err := cl.parseDuration(d, "window")
+			if err != nil {
+				return err
+			}
+			ea.Window = window
+		case "rule_ids":
+			ea.RuleIDs = d.RemainingArgs()
+			if len(ea.RuleIDs) == 0 {
+				return d.Err("rule_ids option requires at least one rule ID")
+			}
+		case "cooldown":
+			cooldown, err := cl.parseDuration(d, "cooldown")
+			if err != nil {
+				return err
+			}
+			ea.Cooldown = cooldown
+		default:
+			return d.Errf("unrecognized email_alert option: %s", option)
+		}
+	}
+
+	if err := validateEmailAlertConfig(&ea); err != nil {
+		return d.Errf("invalid email_alert configuration: %v", err)
+	}
+
+	m.EmailAlert = &ea
+	cl.logger.Debug("Email alert configured",
+		zap.String("smtp_server", ea.SMTPServer),
+		zap.Strings("to", ea.To),
+		zap.Int("block_threshold", ea.BlockThreshold),
+		zap.Duration("window", ea.Window),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseSIEMOutput parses the siem_output directive, e.g. "siem_output cef /var/log/waf.cef".
+func (cl *ConfigLoader) parseSIEMOutput(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	format := strings.ToLower(args[0])
+	if format != SIEMFormatCEF && format != SIEMFormatLEEF {
+		return d.Errf("invalid siem_output format '%s', must be cef or leef", args[0])
+	}
+	m.SIEMOutput = &SIEMOutputConfig{Format: format, Output: args[1]}
+	cl.logger.Debug("SIEM output configured",
+		zap.String("format", format),
+		zap.String("output", args[1]),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseFail2banOutput parses the fail2ban_output directive, e.g.
+// "fail2ban_output /var/log/caddy/waf-fail2ban.log".
+func (cl *ConfigLoader) parseFail2banOutput(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Fail2banOutput = d.Val()
+	cl.logger.Debug("fail2ban output configured",
+		zap.String("output", m.Fail2banOutput),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+func (cl *ConfigLoader) parseTracing(d *caddyfile.Dispenser, m *Middleware) error {
+	m.Tracing = true
+	cl.logger.Debug("OpenTelemetry tracing of WAF phases enabled", zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+func (cl *ConfigLoader) parseLatencyMetrics(d *caddyfile.Dispenser, m *Middleware) error {
+	m.LatencyMetrics = true
+	cl.logger.Debug("Rule evaluation latency metrics enabled", zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseAdminAPI parses the admin_api directive with an optional path prefix.
+func (cl *ConfigLoader) parseAdminAPI(d *caddyfile.Dispenser, m *Middleware) error {
+	prefix := defaultAdminAPIPrefix
+	if d.NextArg() {
+		prefix = strings.TrimSuffix(d.Val(), "/")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return d.Err("admin_api prefix must start with a leading '/'")
+	}
+	m.AdminAPI = prefix
+	cl.logger.Debug("Admin API configured", zap.String("prefix", prefix), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseExplain parses the explain directive, keeping the traces of the recent blocked
+// requests for the admin API, with an optional size block.
+func (cl *ConfigLoader) parseExplain(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ExplainConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "size":
+			size, err := cl.parsePositiveInteger(d, "explain size")
+			if err != nil {
+				return err
+			}
+			config.Size = size
+		default:
+			return d.Errf("unrecognized explain option: %s", option)
+		}
+	}
+	m.Explain = config
+	cl.logger.Debug("Explain configured", zap.Int("size", config.Size), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseEndpointAuth parses the endpoint_auth block protecting the metrics endpoint and admin API.
+func (cl *ConfigLoader) parseEndpointAuth(d *caddyfile.Dispenser, m *Middleware) error {
+	auth := &EndpointAuthConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			auth.Token = d.Val()
+		case "basic_auth":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			auth.Username, auth.Password = args[0], args[1]
+		case "allow_ip":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			auth.AllowedIPs = append(auth.AllowedIPs, args...)
+		default:
+			return d.Errf("unrecognized endpoint_auth option: %s", option)
+		}
+	}
+	if err := auth.provision(); err != nil {
+		return d.Err(err.Error())
+	}
+	m.EndpointAuth = auth
+	cl.logger.Debug("Endpoint authentication configured",
+		zap.Bool("token", auth.Token != ""),
+		zap.Bool("basic_auth", auth.Username != ""),
+		zap.Strings("allowed_ips", auth.AllowedIPs),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseEventStore parses the event_store directive: event_store <path> [{ retention, max_events, export_dir, export_interval }].
+func (cl *ConfigLoader) parseEventStore(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &EventStoreConfig{Path: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "retention":
+			retention, err := cl.parseDuration(d, "event_store retention")
+			if err != nil {
+				return err
+			}
+			config.Retention = retention
+		case "max_events":
+			maxEvents, err := cl.parsePositiveInteger(d, "event_store max_events")
+			if err != nil {
+				return err
+			}
+			config.MaxEvents = maxEvents
+		case "export_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.ExportDir = d.Val()
+		case "export_interval":
+			interval, err := cl.parseDuration(d, "event_store export_interval")
+			if err != nil {
+				return err
+			}
+			config.ExportInterval = interval
+		default:
+			return d.Errf("unrecognized event_store option: %s", option)
+		}
+	}
+	if config.ExportInterval > 0 && config.ExportDir == "" {
+		return d.Err("event_store export_interval requires export_dir")
+	}
+	m.EventStore = config
+	cl.logger.Debug("Event store configured",
+		zap.String("path", config.Path),
+		zap.Duration("retention", config.Retention),
+		zap.Int("max_events", config.MaxEvents),
+		zap.String("export_dir", config.ExportDir),
+		zap.Duration("export_interval", config.ExportInterval),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+func (cl *ConfigLoader) parseTenantByHost(d *caddyfile.Dispenser, m *Middleware) error {
+	m.TenantByHost = true
+	cl.logger.Debug("Multi-tenant mode keyed by Host enabled", zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseHostOverlay parses a host block adjusting rules and thresholds for specific hosts.
+func (cl *ConfigLoader) parseHostOverlay(d *caddyfile.Dispenser, m *Middleware) error {
+	hosts := d.RemainingArgs()
+	if len(hosts) == 0 {
+		return d.ArgErr()
+	}
+	overlay := HostOverlay{Hosts: hosts}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "anomaly_threshold":
+			threshold, err := cl.parsePositiveInteger(d, "host anomaly_threshold")
+			if err != nil {
+				return err
+			}
+			overlay.AnomalyThreshold = threshold
+		case "rule_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			overlay.RuleFiles = append(overlay.RuleFiles, d.Val())
+		case "disable_rule":
+			ids := d.RemainingArgs()
+			if len(ids) == 0 {
+				return d.ArgErr()
+			}
+			overlay.DisabledRules = append(overlay.DisabledRules, ids...)
+		default:
+			return d.Errf("unrecognized host option: %s", option)
+		}
+	}
+	m.HostOverlays = append(m.HostOverlays, overlay)
+	cl.logger.Debug("Host overlay configured",
+		zap.Strings("hosts", hosts),
+		zap.Int("anomaly_threshold", overlay.AnomalyThreshold),
+		zap.Strings("rule_files", overlay.RuleFiles),
+		zap.Strings("disabled_rules", overlay.DisabledRules),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseConfigSource parses the config_source directive: config_source <consul|etcd> <address> [{ prefix, token, cache_dir, interval }].
+func (cl *ConfigLoader) parseConfigSource(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	config := &ConfigSourceConfig{Backend: strings.ToLower(args[0]), Address: args[1]}
+	if config.Backend != ConfigSourceConsul && config.Backend != ConfigSourceEtcd {
+		return d.Errf("invalid config_source backend: %s, must be consul or etcd", args[0])
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Prefix = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Token = d.Val()
+		case "cache_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.CacheDir = d.Val()
+		case "interval":
+			interval, err := cl.parseDuration(d, "config_source interval")
+			if err != nil {
+				return err
+			}
+			config.Interval = interval
+		default:
+			return d.Errf("unrecognized config_source option: %s", option)
+		}
+	}
+	if config.CacheDir == "" {
+		return d.Err("config_source requires cache_dir")
+	}
+	m.ConfigSource = config
+	cl.logger.Debug("Config source configured",
+		zap.String("backend", config.Backend),
+		zap.String("address", config.Address),
+		zap.String("prefix", config.Prefix),
+		zap.String("cache_dir", config.CacheDir),
+		zap.Duration("interval", config.Interval),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseBan parses the ban block configuring dynamic bans and their propagation to peers.
+func (cl *ConfigLoader) parseBan(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &BanConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "threshold":
+			threshold, err := cl.parsePositiveInteger(d, "ban threshold")
+			if err != nil {
+				return err
+			}
+			config.Threshold = threshold
+		case "window":
+			window, err := cl.parseDuration(d, "ban window")
+			if err != nil {
+				return err
+			}
+			config.Window = window
+		case "duration":
+			duration, err := cl.parseDuration(d, "ban duration")
+			if err != nil {
+				return err
+			}
+			config.Duration = duration
+		case "honeypot_rule":
+			ids := d.RemainingArgs()
+			if len(ids) == 0 {
+				return d.ArgErr()
+			}
+			config.HoneypotRules = append(config.HoneypotRules, ids...)
+		case "propagate":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			transport := strings.ToLower(args[0])
+			if transport != BanPropagationRedis && transport != BanPropagationNATS {
+				return d.Errf("invalid ban propagate type: %s, must be redis or nats", args[0])
+			}
+			if config.Propagation == nil {
+				config.Propagation = &BanPropagationConfig{}
+			}
+			config.Propagation.Type, config.Propagation.Address = transport, args[1]
+			if len(args) == 3 {
+				config.Propagation.Channel = args[2]
+			}
+		case "propagate_auth":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if config.Propagation == nil {
+				config.Propagation = &BanPropagationConfig{}
+			}
+			config.Propagation.Password = d.Val()
+		default:
+			return d.Errf("unrecognized ban option: %s", option)
+		}
+	}
+	if config.Propagation != nil && config.Propagation.Type == "" {
+		return d.Err("ban propagate_auth requires propagate")
+	}
+	m.Bans = config
+	cl.logger.Debug("Dynamic bans configured",
+		zap.Int("threshold", config.Threshold),
+		zap.Duration("window", config.Window),
+		zap.Duration("duration", config.Duration),
+		zap.Strings("honeypot_rules", config.HoneypotRules),
+		zap.Bool("propagation", config.Propagation != nil),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseStatsExport parses the stats_export directive: stats_export <file|url>
+// [{ interval, top, header, timeout }].
+func (cl *ConfigLoader) parseStatsExport(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &StatsExportConfig{Output: d.Val()}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "interval":
+			interval, err := cl.parseDuration(d, "stats_export interval")
+			if err != nil {
+				return err
+			}
+			if interval < time.Minute {
+				return d.Errf("stats_export interval must be at least 1m, got %s", interval)
+			}
+			config.Interval = interval
+		case "top":
+			top, err := cl.parsePositiveInteger(d, "stats_export top")
+			if err != nil {
+				return err
+			}
+			config.Top = top
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Headers == nil {
+				config.Headers = make(map[string]string)
+			}
+			config.Headers[args[0]] = args[1]
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "stats_export timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		default:
+			return d.Errf("unrecognized stats_export option: %s", option)
+		}
+	}
+	if len(config.Headers) > 0 && !config.isURLOutput() {
+		return d.Errf("stats_export headers require an http:// or https:// URL output")
+	}
+	m.StatsExport = config
+	cl.logger.Debug("Stats export configured",
+		zap.String("output", config.Output),
+		zap.Duration("interval", config.Interval),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseBanExport parses the ban_export directive: ban_export <nftables|ipset> <file>
+// [{ set, table, reload, interval, min_duration }].
+func (cl *ConfigLoader) parseBanExport(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	config := &BanExportConfig{Format: strings.ToLower(args[0]), File: args[1]}
+	if config.Format != BanExportNftables && config.Format != BanExportIPSet {
+		return d.Errf("invalid ban_export format '%s', must be nftables or ipset", args[0])
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "set":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Set = d.Val()
+		case "table":
+			table := d.RemainingArgs()
+			if len(table) != 2 {
+				return d.ArgErr()
+			}
+			config.Table = strings.Join(table, " ")
+		case "reload":
+			config.Reload = d.RemainingArgs()
+			if len(config.Reload) == 0 {
+				return d.ArgErr()
+			}
+		case "interval":
+			interval, err := cl.parseDuration(d, "ban_export interval")
+			if err != nil {
+				return err
+			}
+			config.Interval = interval
+		case "min_duration":
+			duration, err := cl.parseDuration(d, "ban_export min_duration")
+			if err != nil {
+				return err
+			}
+			config.MinDuration = duration
+		default:
+			return d.Errf("unrecognized ban_export option: %s", option)
+		}
+	}
+	m.BanExport = config
+	cl.logger.Debug("Ban export configured",
+		zap.String("format", config.Format),
+		zap.String("output", config.File),
+		zap.Strings("reload", config.Reload),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCluster parses the cluster block synchronizing state with peers or through a shared backend.
+func (cl *ConfigLoader) parseCluster(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ClusterConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "node":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Node = d.Val()
+		case "peers":
+			peers := d.RemainingArgs()
+			if len(peers) == 0 {
+				return d.ArgErr()
+			}
+			for _, peer := range peers {
+				if !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+					return d.Errf("invalid cluster peer: %s, must be an http(s) URL", peer)
+				}
+			}
+			config.Peers = append(config.Peers, peers...)
+		case "backend":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			transport := strings.ToLower(args[0])
+			if transport != BanPropagationRedis && transport != BanPropagationNATS {
+				return d.Errf("invalid cluster backend: %s, must be redis or nats", args[0])
+			}
+			if config.Backend == nil {
+				config.Backend = &BanPropagationConfig{}
+			}
+			config.Backend.Type, config.Backend.Address = transport, args[1]
+			if len(args) == 3 {
+				config.Backend.Channel = args[2]
+			}
+		case "backend_auth":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if config.Backend == nil {
+				config.Backend = &BanPropagationConfig{}
+			}
+			config.Backend.Password = d.Val()
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Secret = d.Val()
+		case "sync_interval":
+			interval, err := cl.parseDuration(d, "cluster sync_interval")
+			if err != nil {
+				return err
+			}
+			config.SyncInterval = interval
+		case "sync_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if !strings.HasPrefix(d.Val(), "/") {
+				return d.Errf("cluster sync_path must start with '/': %s", d.Val())
+			}
+			config.SyncPath = d.Val()
+		default:
+			return d.Errf("unrecognized cluster option: %s", option)
+		}
+	}
+	if config.Backend != nil && config.Backend.Type == "" {
+		return d.Err("cluster backend_auth requires backend")
+	}
+	if (len(config.Peers) == 0) == (config.Backend == nil) {
+		return d.Err("cluster requires either peers or backend")
+	}
+	if len(config.Peers) > 0 && config.Secret == "" {
+		return d.Err("cluster peers require a secret")
+	}
+	m.Cluster = config
+	cl.logger.Debug("Cluster configured",
+		zap.String("node", config.Node),
+		zap.Strings("peers", config.Peers),
+		zap.Bool("backend", config.Backend != nil),
+		zap.Duration("sync_interval", config.SyncInterval),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseGeoIPUpdate parses the geoip_update block scheduling MaxMind database downloads.
+func (cl *ConfigLoader) parseGeoIPUpdate(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &GeoIPUpdateConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "account_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.AccountID = d.Val()
+		case "license_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.LicenseKey = d.Val()
+		case "editions":
+			editions := d.RemainingArgs()
+			if len(editions) == 0 {
+				return d.ArgErr()
+			}
+			config.Editions = append(config.Editions, editions...)
+		case "interval":
+			interval, err := cl.parseDuration(d, "geoip_update interval")
+			if err != nil {
+				return err
+			}
+			config.Interval = interval
+		case "cache_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.CacheDir = d.Val()
+		default:
+			return d.Errf("unrecognized geoip_update option: %s", option)
+		}
+	}
+	if config.AccountID == "" || config.LicenseKey == "" {
+		return d.Err("geoip_update requires account_id and license_key")
+	}
+	m.GeoIPUpdate = config
+	cl.logger.Debug("GeoIP updates configured",
+		zap.String("account_id", config.AccountID),
+		zap.Strings("editions", config.Editions),
+		zap.Duration("interval", config.Interval),
+		zap.String("cache_dir", config.CacheDir),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseInspectionPool parses the inspection_pool block capping concurrent expensive inspections.
+func (cl *ConfigLoader) parseInspectionPool(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &InspectionPoolConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "workers":
+			workers, err := cl.parsePositiveInteger(d, "inspection_pool workers")
+			if err != nil {
+				return err
+			}
+			config.Workers = workers
+		case "queue_timeout":
+			timeout, err := cl.parseDuration(d, "inspection_pool queue_timeout")
+			if err != nil {
+				return err
+			}
+			config.QueueTimeout = timeout
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fallback := strings.ToLower(d.Val())
+			if fallback != inspectionFallbackAllow && fallback != inspectionFallbackBlock {
+				return d.Errf("invalid inspection_pool fallback: %s, must be allow or block", d.Val())
+			}
+			config.Fallback = fallback
+		case "body_threshold":
+			threshold, err := cl.parsePositiveInteger(d, "inspection_pool body_threshold")
+			if err != nil {
+				return err
+			}
+			config.BodyThreshold = int64(threshold)
+		default:
+			return d.Errf("unrecognized inspection_pool option: %s", option)
+		}
+	}
+	m.InspectionPool = config
+	cl.logger.Debug("Inspection pool configured",
+		zap.Int("workers", config.Workers),
+		zap.Duration("queue_timeout", config.QueueTimeout),
+		zap.String("fallback", config.Fallback),
+		zap.Int64("body_threshold", config.BodyThreshold),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseInspectionBudget parses the inspection_budget block limiting the work spent on a request.
+func (cl *ConfigLoader) parseInspectionBudget(d *caddyfile.Dispenser, m *Middleware) error {
+	budget := &InspectionBudget{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "max_body_bytes":
+			maxBytes, err := cl.parsePositiveInteger(d, "inspection_budget max_body_bytes")
+			if err != nil {
+				return err
+			}
+			budget.MaxBodyBytes = int64(maxBytes)
+		case "max_regex_time":
+			maxTime, err := cl.parseDuration(d, "inspection_budget max_regex_time")
+			if err != nil {
+				return err
+			}
+			budget.MaxRegexTime = maxTime
+		case "max_rules":
+			maxRules, err := cl.parsePositiveInteger(d, "inspection_budget max_rules")
+			if err != nil {
+				return err
+			}
+			budget.MaxRules = maxRules
+		case "on_exceeded":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			action := strings.ToLower(d.Val())
+			if action != budgetActionAllow && action != budgetActionBlock {
+				return d.Errf("invalid inspection_budget on_exceeded: %s, must be allow or block", d.Val())
+			}
+			budget.OnExceeded = action
+		default:
+			return d.Errf("unrecognized inspection_budget option: %s", option)
+		}
+	}
+	if budget.MaxBodyBytes == 0 && budget.MaxRegexTime == 0 && budget.MaxRules == 0 {
+		return d.Err("inspection_budget requires at least one of max_body_bytes, max_regex_time or max_rules")
+	}
+	m.InspectionBudget = budget
+	cl.logger.Debug("Inspection budget configured",
+		zap.Int64("max_body_bytes", budget.MaxBodyBytes),
+		zap.Duration("max_regex_time", budget.MaxRegexTime),
+		zap.Int("max_rules", budget.MaxRules),
+		zap.String("on_exceeded", budget.OnExceeded),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseResponseBufferLimit parses the number of response body bytes buffered for inspection.
+func (cl *ConfigLoader) parseResponseBufferLimit(d *caddyfile.Dispenser, m *Middleware) error {
+	limit, err := cl.parsePositiveInteger(d, "response_buffer_limit")
+	if err != nil {
+		return err
+	}
+	m.ResponseBufferLimit = int64(limit)
+	cl.logger.Debug("Response buffer limit set", zap.Int("limit", limit), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseResponseDecompress parses the number of decompressed bytes of a compressed response
+// body inspected.
+func (cl *ConfigLoader) parseResponseDecompress(d *caddyfile.Dispenser, m *Middleware) error {
+	limit, err := cl.parsePositiveInteger(d, "response_decompress")
+	if err != nil {
+		return err
+	}
+	m.ResponseDecompressLimit = int64(limit)
+	cl.logger.Debug("Response decompress limit set", zap.Int("limit", limit), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseLookupCache parses the lookup_cache block sizing the per-IP GeoIP and blacklist lookup caches.
+func (cl *ConfigLoader) parseLookupCache(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &LookupCacheConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "size":
+			size, err := cl.parsePositiveInteger(d, "lookup_cache size")
+			if err != nil {
+				return err
+			}
+			config.Size = size
+		case "ttl":
+			ttl, err := cl.parseDuration(d, "lookup_cache ttl")
+			if err != nil {
+				return err
+			}
+			config.TTL = ttl
+		default:
+			return d.Errf("unrecognized lookup_cache option: %s", option)
+		}
+	}
+	m.LookupCache = config
+	cl.logger.Debug("Lookup cache configured",
+		zap.Int("size", config.Size),
+		zap.Duration("ttl", config.TTL),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseDNSBlacklistIndex parses the dns_blacklist_index block keeping the DNS blacklist on disk.
+func (cl *ConfigLoader) parseDNSBlacklistIndex(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &DNSBlacklistIndexConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "false_positive_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || rate <= 0 || rate >= 1 {
+				return d.Errf("invalid dns_blacklist_index false_positive_rate: %s, must be between 0 and 1", d.Val())
+			}
+			config.FalsePositiveRate = rate
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Path = d.Val()
+		default:
+			return d.Errf("unrecognized dns_blacklist_index option: %s", option)
+		}
+	}
+	m.DNSBlacklistIndex = config
+	cl.logger.Debug("DNS blacklist index configured",
+		zap.Float64("false_positive_rate", config.FalsePositiveRate),
+		zap.String("path", config.Path),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseParamSchema parses the param_schema directive:
+// param_schema <path> { methods, param <name> [type] [options], allow_unknown, action, score }.
+func (cl *ConfigLoader) parseParamSchema(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	schema := ParamSchema{Path: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "methods":
+			methods := d.RemainingArgs()
+			if len(methods) == 0 {
+				return d.ArgErr()
+			}
+			schema.Methods = append(schema.Methods, methods...)
+		case "param":
+			spec, err := cl.parseParamSpec(d)
+			if err != nil {
+				return err
+			}
+			schema.Params = append(schema.Params, spec)
+		case "allow_unknown":
+			schema.AllowUnknown = true
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			schema.Action = d.Val()
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "param_schema score")
+			if err != nil {
+				return err
+			}
+			schema.Score = score
+		default:
+			return d.Errf("unrecognized param_schema option: %s", option)
+		}
+	}
+	if err := schema.provision(); err != nil {
+		return d.Err(err.Error())
+	}
+	m.ParamSchemas = append(m.ParamSchemas, schema)
+	cl.logger.Debug("Parameter schema configured",
+		zap.String("path", schema.Path),
+		zap.Int("params", len(schema.Params)),
+		zap.String("action", schema.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseParamSpec parses a param_schema parameter:
+// param <name> [string|int|float|bool] [required] [min_length n] [max_length n] [min x] [max x] [charset c] [pattern re].
+func (cl *ConfigLoader) parseParamSpec(d *caddyfile.Dispenser) (ParamSpec, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return ParamSpec{}, d.ArgErr()
+	}
+	spec := ParamSpec{Name: args[0]}
+	args = args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "string", "int", "float", "bool":
+			spec.Type, args = args[0], args[1:]
+		}
+	}
+	for len(args) > 0 {
+		option := args[0]
+		if option == "required" {
+			spec.Required = true
+			args = args[1:]
+			continue
+		}
+		if len(args) < 2 {
+			return ParamSpec{}, d.Errf("missing value for param option: %s", option)
+		}
+		value := args[1]
+		args = args[2:]
+		switch option {
+		case "min_length", "max_length":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return ParamSpec{}, d.Errf("invalid %s value: %s", option, value)
+			}
+			if option == "min_length" {
+				spec.MinLength = n
+			} else {
+				spec.MaxLength = n
+			}
+		case "min", "max":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return ParamSpec{}, d.Errf("invalid %s value: %s", option, value)
+			}
+			if option == "min" {
+				spec.Min = &n
+			} else {
+				spec.Max = &n
+			}
+		case "charset":
+			spec.Charset = value
+		case "pattern":
+			spec.Pattern = value
+		default:
+			return ParamSpec{}, d.Errf("unrecognized param option: %s", option)
+		}
+	}
+	return spec, nil
+}
+
+// parseOpenAPI parses the openapi directive: openapi <spec> [{ base_path, action, score }].
+func (cl *ConfigLoader) parseOpenAPI(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &OpenAPIConfig{Spec: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "base_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.BasePath = d.Val()
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid openapi action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "openapi score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized openapi option: %s", option)
+		}
+	}
+	m.OpenAPI = config
+	cl.logger.Debug("OpenAPI validation configured",
+		zap.String("spec", config.Spec),
+		zap.String("base_path", config.BasePath),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseJSONSchema parses the json_schema directive:
+// json_schema <path> <schema> [{ methods, status, response <content_type> <body> }].
+func (cl *ConfigLoader) parseJSONSchema(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	config := JSONSchemaConfig{Path: args[0], Schema: args[1]}
+	if !strings.HasPrefix(config.Path, "/") {
+		return d.Errf("json_schema path must start with /: %s", config.Path)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "methods":
+			config.Methods = d.RemainingArgs()
+			if len(config.Methods) == 0 {
+				return d.ArgErr()
+			}
+		case "status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			statusCode, err := cl.parseStatusCode(d)
+			if err != nil {
+				return err
+			}
+			if statusCode < 400 {
+				return d.Errf("invalid json_schema status code %d, must be between 400 and 599", statusCode)
+			}
+			config.StatusCode = statusCode
+		case "response":
+			response := d.RemainingArgs()
+			if len(response) != 2 {
+				return d.ArgErr()
+			}
+			config.ContentType, config.Body = response[0], response[1]
+		default:
+			return d.Errf("unrecognized json_schema option: %s", option)
+		}
+	}
+	m.JSONSchemas = append(m.JSONSchemas, config)
+	cl.logger.Debug("JSON schema configured",
+		zap.String("path", config.Path),
+		zap.String("schema", config.Schema),
+		zap.Strings("methods", config.Methods),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCredentialStuffing parses the credential_stuffing directive: credential_stuffing
+// <path> <username_field> [{ methods, window, max_usernames, failure_ratio, min_attempts,
+// failure_status, action, score }].
+func (cl *ConfigLoader) parseCredentialStuffing(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return d.ArgErr()
+	}
+	config := &CredentialStuffingConfig{Path: args[0], UsernameField: args[1]}
+	if !strings.HasPrefix(config.Path, "/") {
+		return d.Errf("credential_stuffing path must start with /: %s", config.Path)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "methods":
+			config.Methods = d.RemainingArgs()
+			if len(config.Methods) == 0 {
+				return d.ArgErr()
+			}
+		case "window":
+			window, err := cl.parseDuration(d, "credential_stuffing window")
+			if err != nil {
+				return err
+			}
+			config.Window = window
+		case "max_usernames":
+			n, err := cl.parsePositiveInteger(d, "credential_stuffing max_usernames")
+			if err != nil {
+				return err
+			}
+			config.MaxUsernames = n
+		case "failure_ratio":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ratio, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				return d.Errf("invalid credential_stuffing failure_ratio: %s, must be above 0 and at most 1", d.Val())
+			}
+			config.FailureRatio = ratio
+		case "min_attempts":
+			n, err := cl.parsePositiveInteger(d, "credential_stuffing min_attempts")
+			if err != nil {
+				return err
+			}
+			config.MinAttempts = n
+		case "failure_status":
+			codes := d.RemainingArgs()
+			if len(codes) == 0 {
+				return d.ArgErr()
+			}
+			for _, code := range codes {
+				statusCode, err := strconv.Atoi(code)
+				if err != nil || statusCode < 100 || statusCode > 599 {
+					return d.Errf("invalid credential_stuffing failure_status: %s", code)
+				}
+				config.FailureStatus = append(config.FailureStatus, statusCode)
+			}
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			switch config.Action {
+			case detectionActionBlock, detectionActionScore, credentialActionChallenge, credentialActionBan:
+			default:
+				return d.Errf("invalid credential_stuffing action: %s, must be block, score, challenge or ban", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "credential_stuffing score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized credential_stuffing option: %s", option)
+		}
+	}
+	m.CredentialStuffing = append(m.CredentialStuffing, config)
+	cl.logger.Debug("Credential stuffing detection configured",
+		zap.String("path", config.Path),
+		zap.String("username_field", config.UsernameField),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseChallenge parses the challenge block: challenge [{ secret, cookie_name, ttl, difficulty }].
+func (cl *ConfigLoader) parseChallenge(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ChallengeConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Secret = d.Val()
+		case "cookie_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.CookieName = d.Val()
+		case "ttl":
+			ttl, err := cl.parseDuration(d, "challenge ttl")
+			if err != nil {
+				return err
+			}
+			config.TTL = ttl
+		case "difficulty":
+			difficulty, err := cl.parsePositiveInteger(d, "challenge difficulty")
+			if err != nil {
+				return err
+			}
+			if difficulty > maxChallengeDifficulty {
+				return d.Errf("challenge difficulty must be at most %d, but got '%d'", maxChallengeDifficulty, difficulty)
+			}
+			config.Difficulty = difficulty
+		default:
+			return d.Errf("unrecognized challenge option: %s", option)
+		}
+	}
+	m.Challenge = config
+	cl.logger.Debug("Challenge configured",
+		zap.String("cookie_name", config.CookieName),
+		zap.Duration("ttl", config.TTL),
+		zap.Int("difficulty", config.Difficulty),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseLockdown parses the lockdown directive: lockdown [on|off] { anomaly_threshold,
+// rate_limit <requests> [window], challenge <on|off> }.
+func (cl *ConfigLoader) parseLockdown(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &LockdownConfig{}
+	if d.NextArg() {
+		switch d.Val() {
+		case "on":
+			config.Enabled = true
+		case "off":
+		default:
+			return d.Errf("invalid lockdown state: %s, must be on or off", d.Val())
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "anomaly_threshold":
+			threshold, err := cl.parsePositiveInteger(d, "lockdown anomaly_threshold")
+			if err != nil {
+				return err
+			}
+			config.AnomalyThreshold = threshold
+		case "rate_limit":
+			requests, err := cl.parsePositiveInteger(d, "lockdown rate_limit")
+			if err != nil {
+				return err
+			}
+			config.RateLimit = requests
+			if d.NextArg() {
+				window, err := time.ParseDuration(d.Val())
+				if err != nil || window <= 0 {
+					return d.Errf("invalid lockdown rate_limit window: %s", d.Val())
+				}
+				config.RateWindow = window
+			}
+		case "challenge":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				config.NoChallenge = false
+			case "off":
+				config.NoChallenge = true
+			default:
+				return d.Errf("invalid lockdown challenge value: %s, must be on or off", d.Val())
+			}
+		default:
+			return d.Errf("unrecognized lockdown option: %s", option)
+		}
+	}
+	m.Lockdown = config
+	cl.logger.Debug("Lockdown configured",
+		zap.Bool("enabled", config.Enabled),
+		zap.Int("anomaly_threshold", config.AnomalyThreshold),
+		zap.Int("rate_limit", config.RateLimit),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseGeoVelocity parses the geo_velocity directive:
+// geo_velocity <key> [{ max_speed, min_distance, ttl, max_keys, action, score }].
+func (cl *ConfigLoader) parseGeoVelocity(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &GeoVelocityConfig{Key: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "max_speed", "min_distance":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			value, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || value <= 0 {
+				return d.Errf("invalid geo_velocity %s: %s, must be a positive number of km", option, d.Val())
+			}
+			if option == "max_speed" {
+				config.MaxSpeed = value
+			} else {
+				config.MinDistance = value
+			}
+		case "ttl":
+			ttl, err := cl.parseDuration(d, "geo_velocity ttl")
+			if err != nil {
+				return err
+			}
+			config.TTL = ttl
+		case "max_keys":
+			n, err := cl.parsePositiveInteger(d, "geo_velocity max_keys")
+			if err != nil {
+				return err
+			}
+			config.MaxKeys = n
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionScore && config.Action != credentialActionChallenge {
+				return d.Errf("invalid geo_velocity action: %s, must be score or challenge", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "geo_velocity score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized geo_velocity option: %s", option)
+		}
+	}
+	m.GeoVelocity = config
+	cl.logger.Debug("Impossible travel detection configured",
+		zap.String("key", config.Key),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseSlowClient parses the slow_client block: slow_client { body_timeout, min_rate, grace, ban }.
+func (cl *ConfigLoader) parseSlowClient(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &SlowClientConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "body_timeout":
+			timeout, err := cl.parseDuration(d, "slow_client body_timeout")
+			if err != nil {
+				return err
+			}
+			config.BodyTimeout = timeout
+		case "min_rate":
+			rate, err := cl.parsePositiveInteger(d, "slow_client min_rate")
+			if err != nil {
+				return err
+			}
+			config.MinRate = int64(rate)
+		case "grace":
+			grace, err := cl.parseDuration(d, "slow_client grace")
+			if err != nil {
+				return err
+			}
+			config.Grace = grace
+		case "ban":
+			duration, err := cl.parseDuration(d, "slow_client ban")
+			if err != nil {
+				return err
+			}
+			config.BanDuration = duration
+		default:
+			return d.Errf("unrecognized slow_client option: %s", option)
+		}
+	}
+	if config.BodyTimeout <= 0 && config.MinRate <= 0 {
+		return d.Err("slow_client requires body_timeout or min_rate")
+	}
+	m.SlowClient = config
+	cl.logger.Debug("Slow client protection configured",
+		zap.Duration("body_timeout", config.BodyTimeout),
+		zap.Int64("min_rate", config.MinRate),
+		zap.Duration("ban_duration", config.BanDuration),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseConcurrencyLimit parses the concurrency_limit block: concurrency_limit { per_ip, per_connection }.
+func (cl *ConfigLoader) parseConcurrencyLimit(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ConcurrencyLimitConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "per_ip":
+			limit, err := cl.parsePositiveInteger(d, "concurrency_limit per_ip")
+			if err != nil {
+				return err
+			}
+			config.PerIP = limit
+		case "per_connection":
+			limit, err := cl.parsePositiveInteger(d, "concurrency_limit per_connection")
+			if err != nil {
+				return err
+			}
+			config.PerConnection = limit
+		default:
+			return d.Errf("unrecognized concurrency_limit option: %s", option)
+		}
+	}
+	if config.PerIP <= 0 && config.PerConnection <= 0 {
+		return d.Err("concurrency_limit requires per_ip or per_connection")
+	}
+	m.ConcurrencyLimit = config
+	cl.logger.Debug("Concurrency limit configured",
+		zap.Int("per_ip", config.PerIP),
+		zap.Int("per_connection", config.PerConnection),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseReplay parses the replay directive: replay <path> [{ methods, nonce_header, ttl,
+// max_keys, action, score, require_nonce, redis <address> [<password>], redis_prefix }].
+func (cl *ConfigLoader) parseReplay(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return d.ArgErr()
+	}
+	config := &ReplayConfig{Path: args[0]}
+	if !strings.HasPrefix(config.Path, "/") {
+		return d.Errf("replay path must start with /: %s", config.Path)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "methods":
+			config.Methods = d.RemainingArgs()
+			if len(config.Methods) == 0 {
+				return d.ArgErr()
+			}
+		case "nonce_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.NonceHeader = d.Val()
+		case "ttl":
+			ttl, err := cl.parseDuration(d, "replay ttl")
+			if err != nil {
+				return err
+			}
+			config.TTL = ttl
+		case "max_keys":
+			n, err := cl.parsePositiveInteger(d, "replay max_keys")
+			if err != nil {
+				return err
+			}
+			config.MaxKeys = n
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid replay action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "replay score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		case "require_nonce":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.RequireNonce = true
+		case "redis":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			config.Redis = &ReplayRedisConfig{Address: args[0]}
+			if len(args) == 2 {
+				config.Redis.Password = args[1]
+			}
+		case "redis_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if config.Redis == nil {
+				return d.Err("replay redis_prefix requires redis")
+			}
+			config.Redis.Prefix = d.Val()
+		case "redis_fail_closed":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if config.Redis == nil {
+				return d.Err("replay redis_fail_closed requires redis")
+			}
+			config.Redis.FailClosed = true
+		default:
+			return d.Errf("unrecognized replay option: %s", option)
+		}
+	}
+	if config.RequireNonce && config.NonceHeader == "" {
+		return d.Err("replay require_nonce requires a nonce_header")
+	}
+	m.Replay = append(m.Replay, config)
+	cl.logger.Debug("Replay detection configured",
+		zap.String("path", config.Path),
+		zap.String("nonce_header", config.NonceHeader),
+		zap.Bool("require_nonce", config.RequireNonce),
+		zap.Duration("ttl", config.TTL),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseQuota parses the quota block: quota { header, source, refresh, hourly, daily }.
+func (cl *ConfigLoader) parseQuota(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &QuotaConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Header = d.Val()
+		case "source":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Source = d.Val()
+		case "refresh":
+			refresh, err := cl.parseDuration(d, "quota refresh")
+			if err != nil {
+				return err
+			}
+			config.Refresh = refresh
+		case "hourly":
+			n, err := cl.parsePositiveInteger(d, "quota hourly")
+			if err != nil {
+				return err
+			}
+			config.Hourly = int64(n)
+		case "daily":
+			n, err := cl.parsePositiveInteger(d, "quota daily")
+			if err != nil {
+				return err
+			}
+			config.Daily = int64(n)
+		default:
+			return d.Errf("unrecognized quota option: %s", option)
+		}
+	}
+	if config.Source == "" && config.Hourly <= 0 && config.Daily <= 0 {
+		return d.Err("quota requires a source or a default hourly or daily budget")
+	}
+	m.Quota = config
+	cl.logger.Debug("API key quotas configured",
+		zap.String("header", config.Header),
+		zap.String("source", config.Source),
+		zap.Int64("hourly", config.Hourly),
+		zap.Int64("daily", config.Daily),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCostLimit parses the cost_limit block: cost_limit { budget, window, default_cost,
+// cost <path_regex> <cost> }.
+func (cl *ConfigLoader) parseCostLimit(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &CostLimitConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "budget":
+			budget, err := cl.parsePositiveInteger(d, "cost_limit budget")
+			if err != nil {
+				return err
+			}
+			config.Budget = int64(budget)
+		case "window":
+			window, err := cl.parseDuration(d, "cost_limit window")
+			if err != nil {
+				return err
+			}
+			config.Window = window
+		case "default_cost":
+			cost, err := cl.parsePositiveInteger(d, "cost_limit default_cost")
+			if err != nil {
+				return err
+			}
+			config.DefaultCost = int64(cost)
+		case "cost":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			path := d.Val()
+			cost, err := parseCost(d)
+			if err != nil {
+				return err
+			}
+			config.Costs = append(config.Costs, EndpointCost{Path: path, Cost: cost})
+		default:
+			return d.Errf("unrecognized cost_limit option: %s", option)
+		}
+	}
+	if config.Budget <= 0 || config.Window <= 0 {
+		return d.Err("budget and window in cost_limit must be positive values")
+	}
+	m.CostLimit = config
+	cl.logger.Debug("Cost limit configured",
+		zap.Int64("budget", config.Budget),
+		zap.Duration("window", config.Window),
+		zap.Int("costs", len(config.Costs)),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCost parses the cost of a cost_limit path, zero making it free.
+func parseCost(d *caddyfile.Dispenser) (int64, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	cost, err := strconv.ParseInt(d.Val(), 10, 64)
+	if err != nil || cost < 0 {
+		return 0, d.Errf("invalid cost_limit cost: %s, must be a non-negative integer", d.Val())
+	}
+	return cost, nil
+}
+
+// parseBotScore parses the bot_score block: bot_score { threshold, action, score,
+// weight <signal> <weight> }.
+func (cl *ConfigLoader) parseBotScore(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &BotScoreConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "threshold":
+			threshold, err := cl.parsePositiveInteger(d, "bot_score threshold")
+			if err != nil {
+				return err
+			}
+			if threshold > maxBotScore {
+				return d.Errf("invalid bot_score threshold: %d, must be at most %d", threshold, maxBotScore)
+			}
+			config.Threshold = threshold
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			switch config.Action {
+			case credentialActionChallenge, detectionActionBlock, detectionActionScore:
+			default:
+				return d.Errf("invalid bot_score action: %s, must be challenge, block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "bot_score score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		case "weight":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if !isBotSignal(args[0]) {
+				return d.Errf("unknown bot signal: %s", args[0])
+			}
+			weight, err := strconv.Atoi(args[1])
+			if err != nil {
+				return d.Errf("invalid bot_score weight: %s", args[1])
+			}
+			if config.Weights == nil {
+				config.Weights = make(map[string]int)
+			}
+			config.Weights[args[0]] = weight
+		default:
+			return d.Errf("unrecognized bot_score option: %s", option)
+		}
+	}
+	m.BotScore = config
+	cl.logger.Debug("Bot score configured",
+		zap.Int("threshold", config.Threshold),
+		zap.String("action", config.Action),
+		zap.Any("weights", config.Weights),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseIPType parses the ip_type block: ip_type { feed <type> [source], refresh,
+// provider <name> [args] [{...}], provider_timeout, cache_ttl }.
+func (cl *ConfigLoader) parseIPType(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &IPTypeConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "feed":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			feed := IPTypeFeed{Type: strings.ToLower(args[0])}
+			if len(args) == 2 {
+				feed.Source = args[1]
+			}
+			switch feed.Type {
+			case IPTypeTor:
+			case IPTypeVPN, IPTypeDatacenter:
+				if feed.Source == "" {
+					return d.Errf("ip_type %s feed requires a source", feed.Type)
+				}
+			default:
+				return d.Errf("invalid ip_type feed type: %s, must be datacenter, vpn or tor", feed.Type)
+			}
+			config.Feeds = append(config.Feeds, feed)
+		case "refresh":
+			refresh, err := cl.parseDuration(d, "ip_type refresh")
+			if err != nil {
+				return err
+			}
+			config.Refresh = refresh
+		case "provider":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(config.ProviderRaw) > 0 {
+				return d.Err("ip_type provider already specified")
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.waf.ip_type."+name)
+			if err != nil {
+				return err
+			}
+			config.ProviderRaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+		case "provider_timeout":
+			timeout, err := cl.parseDuration(d, "ip_type provider_timeout")
+			if err != nil {
+				return err
+			}
+			config.ProviderTimeout = timeout
+		case "cache_ttl":
+			ttl, err := cl.parseDuration(d, "ip_type cache_ttl")
+			if err != nil {
+				return err
+			}
+			config.CacheTTL = ttl
+		default:
+			return d.Errf("unrecognized ip_type option: %s", option)
+		}
+	}
+	if len(config.Feeds) == 0 && len(config.ProviderRaw) == 0 {
+		return d.Err("ip_type requires a feed or a provider")
+	}
+	m.IPType = config
+	cl.logger.Debug("IP type classification configured",
+		zap.Int("feeds", len(config.Feeds)),
+		zap.Bool("provider", len(config.ProviderRaw) > 0),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseCDNOrigin parses the cdn_origin directive: cdn_origin [<providers...>] {
+// provider <names...>, ranges <cidrs...>, refresh, status }.
+func (cl *ConfigLoader) parseCDNOrigin(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &CDNOriginConfig{}
+	config.Providers = d.RemainingArgs()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "provider":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			config.Providers = append(config.Providers, args...)
+		case "ranges":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			config.Ranges = append(config.Ranges, args...)
+		case "refresh":
+			refresh, err := cl.parseDuration(d, "cdn_origin refresh")
+			if err != nil {
+				return err
+			}
+			config.Refresh = refresh
+		case "status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := cl.parseStatusCode(d)
+			if err != nil {
+				return err
+			}
+			config.StatusCode = status
+		default:
+			return d.Errf("unrecognized cdn_origin option: %s", option)
+		}
+	}
+	for i, provider := range config.Providers {
+		config.Providers[i] = strings.ToLower(provider)
+		if _, ok := cdnRangeURLs[config.Providers[i]]; !ok {
+			return d.Errf("unknown cdn_origin provider: %s, must be cloudflare, fastly or cloudfront", provider)
+		}
+	}
+	if len(config.Providers) == 0 && len(config.Ranges) == 0 {
+		return d.Err("cdn_origin requires a provider or a range")
+	}
+	m.CDNOrigin = config
+	cl.logger.Debug("Direct-to-origin rejection configured",
+		zap.Strings("providers", config.Providers),
+		zap.Strings("ranges", config.Ranges),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseReputation parses the reputation block: reputation { provider <name> [args] [{...}],
+// timeout, cache_ttl, cache_size, threshold, category <names...>, action, score }.
+func (cl *ConfigLoader) parseReputation(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ReputationConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "provider":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.waf.reputation."+name)
+			if err != nil {
+				return err
+			}
+			config.ProvidersRaw = append(config.ProvidersRaw, caddyconfig.JSONModuleObject(unm, "provider", name, nil))
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "reputation timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		case "cache_ttl":
+			ttl, err := cl.parseDuration(d, "reputation cache_ttl")
+			if err != nil {
+				return err
+			}
+			config.CacheTTL = ttl
+		case "cache_size":
+			size, err := cl.parsePositiveInteger(d, "reputation cache_size")
+			if err != nil {
+				return err
+			}
+			config.CacheSize = size
+		case "threshold":
+			threshold, err := cl.parsePositiveInteger(d, "reputation threshold")
+			if err != nil {
+				return err
+			}
+			if threshold > maxReputationScore {
+				return d.Errf("reputation threshold must be at most %d", maxReputationScore)
+			}
+			config.Threshold = threshold
+		case "category":
+			categories := d.RemainingArgs()
+			if len(categories) == 0 {
+				return d.ArgErr()
+			}
+			config.Categories = append(config.Categories, categories...)
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = strings.ToLower(d.Val())
+			switch config.Action {
+			case detectionActionBlock, detectionActionScore, credentialActionChallenge:
+			default:
+				return d.Errf("invalid reputation action: %s, must be block, score or challenge", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "reputation score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized reputation option: %s", option)
+		}
+	}
+	if len(config.ProvidersRaw) == 0 {
+		return d.Err("reputation requires a provider")
+	}
+	m.Reputation = config
+	cl.logger.Debug("IP reputation configured",
+		zap.Int("providers", len(config.ProvidersRaw)),
+		zap.Int("threshold", config.Threshold),
+		zap.Strings("categories", config.Categories),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseInspector parses the inspector directive: inspector <name> [{ plugin, phase <n...>,
+// option <key> <value>, timeout, fail_closed }].
+func (cl *ConfigLoader) parseInspector(d *caddyfile.Dispenser, m *Middleware) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return d.ArgErr()
+	}
+	config := &InspectorConfig{Name: args[0]}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "plugin":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Plugin = d.Val()
+		case "phase":
+			phases := d.RemainingArgs()
+			if len(phases) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range phases {
+				phase, err := strconv.Atoi(arg)
+				if err != nil || phase < 1 || phase > 4 {
+					return d.Errf("invalid inspector phase: %s, must be between 1 and 4", arg)
+				}
+				config.Phases = append(config.Phases, phase)
+			}
+		case "option":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if config.Options == nil {
+				config.Options = make(map[string]string)
+			}
+			config.Options[args[0]] = args[1]
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "inspector timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		case "fail_closed":
+			config.FailClosed = true
+		default:
+			return d.Errf("unrecognized inspector option: %s", option)
+		}
+	}
+	m.Inspectors = append(m.Inspectors, config)
+	cl.logger.Debug("Inspector configured",
+		zap.String("name", config.Name),
+		zap.String("plugin", config.Plugin),
+		zap.Ints("phases", config.Phases),
+		zap.Bool("fail_closed", config.FailClosed),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseICAP parses the icap directive: icap [<url>] [{ url, response_url, timeout,
+// fail_closed }].
+func (cl *ConfigLoader) parseICAP(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ICAPConfig{}
+	if d.NextArg() {
+		config.URL = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.URL = d.Val()
+		case "response_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.ResponseURL = d.Val()
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "icap timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		case "fail_closed":
+			config.FailClosed = true
+		default:
+			return d.Errf("unrecognized icap option: %s", option)
+		}
+	}
+	if config.URL == "" {
+		return d.Err("icap requires a url")
+	}
+	if _, err := parseICAPURL(config.URL); err != nil {
+		return d.Err(err.Error())
+	}
+	if config.ResponseURL != "" {
+		if _, err := parseICAPURL(config.ResponseURL); err != nil {
+			return d.Err(err.Error())
+		}
+	}
+	m.ICAP = config
+	cl.logger.Debug("ICAP scanning configured",
+		zap.String("url", config.URL),
+		zap.String("response_url", config.ResponseURL),
+		zap.Bool("fail_closed", config.FailClosed),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseClamAV parses the clamav directive: clamav <address> [{ min_size, timeout,
+// fail_closed, status, response }].
+func (cl *ConfigLoader) parseClamAV(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &ClamAVConfig{}
+	if d.NextArg() {
+		config.Address = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Address = d.Val()
+		case "min_size":
+			size, err := cl.parsePositiveInteger(d, "clamav min_size")
+			if err != nil {
+				return err
+			}
+			config.MinSize = int64(size)
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "clamav timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		case "fail_closed":
+			config.FailClosed = true
+		case "status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			statusCode, err := cl.parseStatusCode(d)
+			if err != nil {
+				return err
+			}
+			if statusCode < 400 {
+				return d.Errf("invalid clamav status code %d, must be between 400 and 599", statusCode)
+			}
+			config.StatusCode = statusCode
+		case "response":
+			response := d.RemainingArgs()
+			if len(response) != 2 {
+				return d.ArgErr()
+			}
+			config.ContentType, config.Body = response[0], response[1]
+		default:
+			return d.Errf("unrecognized clamav option: %s", option)
+		}
+	}
+	if _, _, err := parseClamAVAddress(config.Address); err != nil {
+		return d.Err(err.Error())
+	}
+	m.ClamAV = config
+	cl.logger.Debug("ClamAV upload scanning configured",
+		zap.String("address", config.Address),
+		zap.Int64("min_size", config.MinSize),
+		zap.Bool("fail_closed", config.FailClosed),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseSignedURL parses the signed_url directive:
+// signed_url <paths...> { secret, signature_param, expires_param }.
+func (cl *ConfigLoader) parseSignedURL(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &SignedURLConfig{Paths: d.RemainingArgs()}
+	if len(config.Paths) == 0 {
+		return d.ArgErr()
+	}
+	for _, path := range config.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return d.Errf("signed_url path must start with /: %s", path)
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Secret = d.Val()
+		case "signature_param":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.SignatureParam = d.Val()
+		case "expires_param":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.ExpiresParam = d.Val()
+		default:
+			return d.Errf("unrecognized signed_url option: %s", option)
+		}
+	}
+	if config.Secret == "" {
+		return d.Err("signed_url requires a secret")
+	}
+	m.SignedURLs = append(m.SignedURLs, config)
+	cl.logger.Debug("Signed URLs configured",
+		zap.Strings("paths", config.Paths),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseRequestSigning parses the request_signing directive: request_signing <paths...>
+// { key <id> <secret>, signature_header, key_id_header, timestamp_header, max_skew }.
+func (cl *ConfigLoader) parseRequestSigning(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &RequestSigningConfig{Paths: d.RemainingArgs(), Keys: make(map[string]string)}
+	if len(config.Paths) == 0 {
+		return d.ArgErr()
+	}
+	for _, path := range config.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return d.Errf("request_signing path must start with /: %s", path)
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "key":
+			key := d.RemainingArgs()
+			if len(key) != 2 {
+				return d.ArgErr()
+			}
+			config.Keys[key[0]] = key[1]
+		case "signature_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.SignatureHeader = d.Val()
+		case "key_id_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.KeyIDHeader = d.Val()
+		case "timestamp_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.TimestampHeader = d.Val()
+		case "max_skew":
+			skew, err := cl.parseDuration(d, "request_signing max_skew")
+			if err != nil {
+				return err
+			}
+			config.MaxSkew = skew
+		default:
+			return d.Errf("unrecognized request_signing option: %s", option)
+		}
+	}
+	if len(config.Keys) == 0 {
+		return d.Err("request_signing requires at least one key")
+	}
+	m.RequestSigning = append(m.RequestSigning, config)
+	cl.logger.Debug("Request signing configured",
+		zap.Strings("paths", config.Paths),
+		zap.Int("keys", len(config.Keys)),
+		zap.Duration("max_skew", config.MaxSkew),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseRPC parses the rpc directive: rpc { max_message_size <size>, max_metadata_size <size> }.
+func (cl *ConfigLoader) parseRPC(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &RPCConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "max_message_size", "max_metadata_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 || size > math.MaxInt64 {
+				return d.Errf("invalid rpc %s: %s, must be a positive size such as 4MiB", option, d.Val())
+			}
+			if option == "max_message_size" {
+				config.MaxMessageSize = int64(size)
+			} else {
+				config.MaxMetadataSize = int64(size)
+			}
+		default:
+			return d.Errf("unrecognized rpc option: %s", option)
+		}
+	}
+	m.RPC = config
+	cl.logger.Debug("RPC checks configured",
+		zap.Int64("max_message_size", config.MaxMessageSize),
+		zap.Int64("max_metadata_size", config.MaxMetadataSize),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseGraphQL parses the graphql directive: graphql [<paths...>] { block_introspection,
+// max_operations }.
+func (cl *ConfigLoader) parseGraphQL(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &GraphQLConfig{Paths: d.RemainingArgs()}
+	for _, path := range config.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return d.Errf("graphql path must start with /: %s", path)
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "block_introspection":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.BlockIntrospection = true
+		case "max_operations":
+			operations, err := cl.parsePositiveInteger(d, "graphql max_operations")
+			if err != nil {
+				return err
+			}
+			config.MaxOperations = operations
+		default:
+			return d.Errf("unrecognized graphql option: %s", option)
+		}
+	}
+	if !config.BlockIntrospection && config.MaxOperations == 0 {
+		return d.Err("graphql requires block_introspection or max_operations")
+	}
+	m.GraphQL = config
+	cl.logger.Debug("GraphQL controls configured",
+		zap.Strings("paths", config.Paths),
+		zap.Bool("block_introspection", config.BlockIntrospection),
+		zap.Int("max_operations", config.MaxOperations),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseTokenIntrospection parses the token_introspection directive: token_introspection
+// <endpoint> { client_id, client_secret, timeout, cache_ttl, cache_size }.
+func (cl *ConfigLoader) parseTokenIntrospection(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &TokenIntrospectionConfig{Endpoint: d.Val()}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "client_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.ClientID = d.Val()
+		case "client_secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.ClientSecret = d.Val()
+		case "timeout":
+			timeout, err := cl.parseDuration(d, "token_introspection timeout")
+			if err != nil {
+				return err
+			}
+			config.Timeout = timeout
+		case "cache_ttl":
+			ttl, err := cl.parseDuration(d, "token_introspection cache_ttl")
+			if err != nil {
+				return err
+			}
+			config.CacheTTL = ttl
+		case "cache_size":
+			size, err := cl.parsePositiveInteger(d, "token_introspection cache_size")
+			if err != nil {
+				return err
+			}
+			config.CacheSize = size
+		default:
+			return d.Errf("unrecognized token_introspection option: %s", option)
+		}
+	}
+	if config.ClientSecret != "" && config.ClientID == "" {
+		return d.Err("token_introspection client_secret requires a client_id")
+	}
+	m.TokenIntrospection = config
+	cl.logger.Debug("Token introspection configured",
+		zap.String("endpoint", config.Endpoint),
+		zap.String("client_id", config.ClientID),
+		zap.Duration("cache_ttl", config.CacheTTL),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseHotlink parses the hotlink_protection directive and its optional block.
+func (cl *ConfigLoader) parseHotlink(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &HotlinkConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "extensions":
+			config.Extensions = d.RemainingArgs()
+			if len(config.Extensions) == 0 {
+				return d.ArgErr()
+			}
+		case "paths":
+			config.Paths = d.RemainingArgs()
+			if len(config.Paths) == 0 {
+				return d.ArgErr()
+			}
+			for _, path := range config.Paths {
+				if !strings.HasPrefix(path, "/") {
+					return d.Errf("hotlink_protection path must start with /: %s", path)
+				}
+			}
+		case "allowed_referers":
+			config.AllowedReferers = d.RemainingArgs()
+			if len(config.AllowedReferers) == 0 {
+				return d.ArgErr()
+			}
+		case "empty_referer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.EmptyReferer = d.Val()
+			if config.EmptyReferer != hotlinkEmptyAllow && config.EmptyReferer != detectionActionBlock {
+				return d.Errf("invalid hotlink_protection empty_referer: %s, must be allow or block", config.EmptyReferer)
+			}
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			switch config.Action {
+			case detectionActionBlock:
+			case hotlinkActionRedirect:
+				if !d.NextArg() {
+					return d.Err("hotlink_protection action redirect requires a URL")
+				}
+				config.RedirectURL = d.Val()
+			default:
+				return d.Errf("invalid hotlink_protection action: %s, must be block or redirect", config.Action)
+			}
+		default:
+			return d.Errf("unrecognized hotlink_protection option: %s", option)
+		}
+	}
+	m.Hotlink = config
+	cl.logger.Debug("Hotlink protection configured",
+		zap.Strings("extensions", config.Extensions),
+		zap.Strings("paths", config.Paths),
+		zap.Strings("allowed_referers", config.AllowedReferers),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseMaxBodySize parses the max_body_size directive:
+// max_body_size <size> [{ path, content_types, response <content_type> <body> }].
+func (cl *ConfigLoader) parseMaxBodySize(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	size, err := humanize.ParseBytes(d.Val())
+	if err != nil || size == 0 || size > math.MaxInt64 {
+		return d.Errf("invalid max_body_size: %s, must be a positive size such as 1048576 or 1MiB", d.Val())
+	}
+	limit := BodySizeLimit{MaxSize: int64(size)}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit.Path = d.Val()
+			if !strings.HasPrefix(limit.Path, "/") {
+				return d.Errf("max_body_size path must start with /: %s", limit.Path)
+			}
+		case "content_types":
+			limit.ContentTypes = d.RemainingArgs()
+			if len(limit.ContentTypes) == 0 {
+				return d.ArgErr()
+			}
+		case "response":
+			response := d.RemainingArgs()
+			if len(response) != 2 {
+				return d.ArgErr()
+			}
+			limit.ContentType, limit.Body = response[0], response[1]
+		default:
+			return d.Errf("unrecognized max_body_size option: %s", option)
+		}
+	}
+	m.BodySizeLimits = append(m.BodySizeLimits, limit)
+	cl.logger.Debug("Body size limit configured",
+		zap.Int64("max_size", limit.MaxSize),
+		zap.String("path", limit.Path),
+		zap.Strings("content_types", limit.ContentTypes),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseUploadPolicy parses the upload_policy directive and its block.
+func (cl *ConfigLoader) parseUploadPolicy(d *caddyfile.Dispenser, m *Middleware) error {
+	config := &UploadPolicyConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "blocked_extensions":
+			extensions := d.RemainingArgs()
+			if len(extensions) == 0 {
+				return d.ArgErr()
+			}
+			config.BlockedExtensions = extensions
+		case "double_extensions":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.DoubleExtensions = true
+		case "filename_pattern":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, err := regexp.Compile(d.Val()); err != nil {
+				return d.Errf("invalid upload_policy filename_pattern: %v", err)
+			}
+			config.FilenamePattern = d.Val()
+		case "max_files":
+			maxFiles, err := cl.parsePositiveInteger(d, "upload_policy max_files")
+			if err != nil {
+				return err
+			}
+			config.MaxFiles = maxFiles
+		case "verify_content_type":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			config.VerifyContentType = true
+		default:
+			return d.Errf("unrecognized upload_policy option: %s", option)
+		}
+	}
+	m.UploadPolicy = config
+	cl.logger.Debug("Upload policy configured",
+		zap.Strings("blocked_extensions", config.BlockedExtensions),
+		zap.Bool("double_extensions", config.DoubleExtensions),
+		zap.String("filename_pattern", config.FilenamePattern),
+		zap.Int("max_files", config.MaxFiles),
+		zap.Bool("verify_content_type", config.VerifyContentType),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseYARARules parses the yara_rules directive: yara_rules <dir> [{ action, score }].
+func (cl *ConfigLoader) parseYARARules(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	config := &YARAConfig{Dir: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			config.Action = d.Val()
+			if config.Action != detectionActionBlock && config.Action != detectionActionScore {
+				return d.Errf("invalid yara_rules action: %s, must be block or score", config.Action)
+			}
+		case "score":
+			score, err := cl.parsePositiveInteger(d, "yara_rules score")
+			if err != nil {
+				return err
+			}
+			config.Score = score
+		default:
+			return d.Errf("unrecognized yara_rules option: %s", option)
+		}
+	}
+	m.YARA = config
+	cl.logger.Debug("YARA rules configured",
+		zap.String("dir", config.Dir),
+		zap.String("action", config.Action),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// --- Helper Functions ---
+
+// parsePositiveInteger parses a directive argument as a positive integer.
+func (cl *ConfigLoader) parsePositiveInteger(d *caddyfile.Dispenser, directiveName string) (int, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	valStr := d.Val()
+	val, err := strconv.Atoi(valStr)
+	if err != nil {
+		return 0, d.Errf("invalid %s value '%s': %v", directiveName, valStr, err)
+	}
+	if val <= 0 {
+		return 0, d.Errf("%s must be a positive integer, but got '%d'", directiveName, val)
+	}
+	return val, nil
+}
+
+// parseDuration parses a directive argument as a time duration.
+func (cl *ConfigLoader) parseDuration(d *caddyfile.Dispenser, directiveName string) (time.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	durationStr := d.Val()
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return 0, d.Errf("invalid %s value '%s': %v", directiveName, durationStr, err)
+	}
+	return duration, nil
+}
+
+// parseBool parses a directive argument as a boolean.
+func (cl *ConfigLoader) parseBool(d *caddyfile.Dispenser, directiveName string) (bool, error) {
+	if !d.NextArg() {
+		return false, d.ArgErr()
+	}
+	boolStr := d.Val()
+	val, err := strconv.ParseBool(boolStr)
+	if err != nil {
+		return false, d.Errf("invalid %s value '%s': %v, must be 'true' or 'false'", directiveName, boolStr, err)
+	}
+	return val, nil
+}
+
+// parseActiveHours parses the active_hours option of a filter, such as 22:00-06:00.
+func (cl *ConfigLoader) parseActiveHours(d *caddyfile.Dispenser) (string, error) {
+	if !d.NextArg() {
+		return "", d.ArgErr()
+	}
+	hours := d.Val()
+	if d.NextArg() {
+		return "", d.ArgErr()
+	}
+	if _, err := compileTimeWindow(hours, nil); err != nil {
+		return "", d.Err(err.Error())
+	}
+	return hours, nil
+}
+
+// parseActiveDays parses the active_days option of a filter, such as mon-fri or sat sun.
+func (cl *ConfigLoader) parseActiveDays(d *caddyfile.Dispenser) ([]string, error) {
+	days := d.RemainingArgs()
+	if len(days) == 0 {
+		return nil, d.ArgErr()
+	}
+	if _, err := compileTimeWindow("", days); err != nil {
+		return nil, d.Err(err.Error())
+	}
+	return days, nil
 }
 
 // parseStatusCode parses a directive argument as an HTTP status code.
@@ -0,0 +1,399 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Supported configuration source backends
+const (
+	ConfigSourceConsul = "consul"
+	ConfigSourceEtcd   = "etcd"
+)
+
+const (
+	defaultConfigSourcePrefix   = "waf/"
+	defaultConfigSourceInterval = 30 * time.Second
+	configSourceRetryDelay      = 5 * time.Second
+)
+
+// Keys read below the prefix, and the cache files they are written to.
+const (
+	configKeyRules        = "rules"
+	configKeyIPBlacklist  = "ip_blacklist"
+	configKeyDNSBlacklist = "dns_blacklist"
+)
+
+var configSourceFiles = map[string]string{
+	configKeyRules:        "rules.json",
+	configKeyIPBlacklist:  "ip_blacklist.txt",
+	configKeyDNSBlacklist: "dns_blacklist.txt",
+}
+
+// ConfigSourceConfig configures a Consul KV or etcd backed source for rules and blacklists.
+type ConfigSourceConfig struct {
+	Backend  string        `json:"backend"` // consul or etcd
+	Address  string        `json:"address"` // Base URL of the HTTP API, e.g. http://127.0.0.1:8500
+	Prefix   string        `json:"prefix,omitempty"`
+	Token    string        `json:"token,omitempty"`
+	CacheDir string        `json:"cache_dir"`          // Local copies of the remote values
+	Interval time.Duration `json:"interval,omitempty"` // Consul blocking wait time, etcd poll interval
+}
+
+// kvBackend fetches all values below a prefix. It returns the values keyed by
+// their name relative to the prefix and an index that changes with the data.
+type kvBackend interface {
+	fetch(ctx context.Context, lastIndex uint64) (map[string][]byte, uint64, error)
+	pollDelay() time.Duration // Wait between fetches that returned no change
+}
+
+// ConfigSource mirrors rules and blacklists from a KV store into local cache
+// files and reloads them when they change.
+type ConfigSource struct {
+	logger  *zap.Logger
+	config  ConfigSourceConfig
+	backend kvBackend
+
+	mu       sync.Mutex
+	index    uint64
+	contents map[string][]byte
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewConfigSource creates a ConfigSource for the configured backend.
+func NewConfigSource(logger *zap.Logger, config ConfigSourceConfig) (*ConfigSource, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("config source requires an address")
+	}
+	if config.CacheDir == "" {
+		return nil, fmt.Errorf("config source requires a cache_dir")
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultConfigSourcePrefix
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultConfigSourceInterval
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	client := &http.Client{Timeout: config.Interval + 10*time.Second}
+
+	var backend kvBackend
+	switch config.Backend {
+	case ConfigSourceConsul:
+		backend = &consulBackend{client: client, config: config}
+	case ConfigSourceEtcd:
+		backend = &etcdBackend{client: client, config: config}
+	default:
+		return nil, fmt.Errorf("unsupported config source backend '%s', must be consul or etcd", config.Backend)
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create config source cache_dir %s: %w", config.CacheDir, err)
+	}
+	return &ConfigSource{
+		logger:   logger,
+		config:   config,
+		backend:  backend,
+		contents: make(map[string][]byte),
+	}, nil
+}
+
+// path returns the cache file of a key.
+func (cs *ConfigSource) path(key string) string {
+	return filepath.Join(cs.config.CacheDir, configSourceFiles[key])
+}
+
+// Sync fetches the current values and writes them to the cache files. Existing
+// cache files are kept when the store is unreachable, so the WAF starts with
+// the last known configuration. It returns the keys that have a cache file.
+func (cs *ConfigSource) Sync(ctx context.Context) ([]string, error) {
+	values, index, err := cs.backend.fetch(ctx, 0)
+	if err != nil {
+		cs.logger.Warn("Config source unreachable, using cached values", zap.String("address", cs.config.Address), zap.Error(err))
+	} else {
+		cs.apply(values, index)
+	}
+
+	var available []string
+	for _, key := range []string{configKeyRules, configKeyIPBlacklist, configKeyDNSBlacklist} {
+		if fileExists(cs.path(key)) {
+			available = append(available, key)
+		}
+	}
+	if err != nil && len(available) == 0 {
+		return nil, fmt.Errorf("config source %s unreachable and no cached values: %w", cs.config.Address, err)
+	}
+	return available, nil
+}
+
+// apply writes changed values to their cache files and returns the changed keys.
+func (cs *ConfigSource) apply(values map[string][]byte, index uint64) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.index = index
+
+	var changed []string
+	for key := range configSourceFiles {
+		value, ok := values[key]
+		if !ok || bytes.Equal(cs.contents[key], value) {
+			continue
+		}
+		if err := writeFileAtomic(cs.path(key), value); err != nil {
+			cs.logger.Error("Failed to write config source cache file", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		cs.contents[key] = value
+		changed = append(changed, key)
+	}
+	return changed
+}
+
+// Start watches the store and calls onChange with the changed keys.
+func (cs *ConfigSource) Start(onChange func(keys []string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.cancel = cancel
+	cs.done = make(chan struct{})
+	go func() {
+		defer close(cs.done)
+		for {
+			cs.mu.Lock()
+			lastIndex := cs.index
+			cs.mu.Unlock()
+
+			values, index, err := cs.backend.fetch(ctx, lastIndex)
+			if ctx.Err() != nil {
+				return
+			}
+			delay := time.Duration(0)
+			if err != nil {
+				cs.logger.Error("Failed to watch config source", zap.String("address", cs.config.Address), zap.Error(err))
+				delay = configSourceRetryDelay
+			} else if changed := cs.apply(values, index); len(changed) > 0 {
+				cs.logger.Info("Config source changed", zap.Strings("keys", changed))
+				onChange(changed)
+			} else if index == lastIndex {
+				delay = cs.backend.pollDelay()
+			}
+
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the watch loop.
+func (cs *ConfigSource) Stop() {
+	if cs.cancel == nil {
+		return
+	}
+	cs.cancel()
+	<-cs.done
+}
+
+// writeFileAtomic replaces a file through a temporary file and a rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// consulBackend reads the Consul KV HTTP API, using blocking queries to watch.
+type consulBackend struct {
+	client *http.Client
+	config ConfigSourceConfig
+}
+
+// pollDelay is zero since blocking queries already wait for changes.
+func (cb *consulBackend) pollDelay() time.Duration { return 0 }
+
+func (cb *consulBackend) fetch(ctx context.Context, lastIndex uint64) (map[string][]byte, uint64, error) {
+	url := fmt.Sprintf("%s/v1/kv/%s?recurse=true", cb.config.Address, cb.config.Prefix)
+	if lastIndex > 0 {
+		url += fmt.Sprintf("&index=%d&wait=%ds", lastIndex, int(cb.config.Interval.Seconds()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cb.config.Token != "" {
+		req.Header.Set("X-Consul-Token", cb.config.Token)
+	}
+	resp, err := cb.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string][]byte{}, index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned status %s", resp.Status)
+	}
+
+	var entries []struct {
+		Key   string
+		Value []byte // Base64 in JSON, decoded by encoding/json
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+	values := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		values[strings.TrimPrefix(e.Key, cb.config.Prefix)] = e.Value
+	}
+	return values, index, nil
+}
+
+// etcdBackend reads the etcd v3 JSON gateway and polls for changes.
+type etcdBackend struct {
+	client *http.Client
+	config ConfigSourceConfig
+}
+
+// pollDelay is the poll interval, since range requests return immediately.
+func (eb *etcdBackend) pollDelay() time.Duration { return eb.config.Interval }
+
+func (eb *etcdBackend) fetch(ctx context.Context, _ uint64) (map[string][]byte, uint64, error) {
+	body, _ := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(eb.config.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd([]byte(eb.config.Prefix))),
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, eb.config.Address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if eb.config.Token != "" {
+		req.Header.Set("Authorization", eb.config.Token)
+	}
+	resp, err := eb.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("etcd returned status %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode etcd response: %w", err)
+	}
+	revision, _ := strconv.ParseUint(result.Header.Revision, 10, 64)
+	values := make(map[string][]byte, len(result.Kvs))
+	for _, kv := range result.Kvs {
+		values[strings.TrimPrefix(string(kv.Key), eb.config.Prefix)] = kv.Value
+	}
+	return values, revision, nil
+}
+
+// prefixRangeEnd returns the smallest key greater than every key with the prefix.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// provisionConfigSource performs the initial sync and points the rule and
+// blacklist settings at the cache files before they are loaded.
+func (m *Middleware) provisionConfigSource(ctx context.Context) error {
+	cs, err := NewConfigSource(m.logger, *m.ConfigSource)
+	if err != nil {
+		return err
+	}
+	available, err := cs.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range available {
+		switch key {
+		case configKeyRules:
+			m.RuleFiles = append(m.RuleFiles, cs.path(key))
+		case configKeyIPBlacklist:
+			if m.IPBlacklistFile == "" {
+				m.IPBlacklistFile = cs.path(key)
+			}
+		case configKeyDNSBlacklist:
+			if m.DNSBlacklistFile == "" {
+				m.DNSBlacklistFile = cs.path(key)
+			}
+		}
+	}
+	m.configSource = cs
+	m.logger.Info("Config source synchronized",
+		zap.String("backend", m.ConfigSource.Backend),
+		zap.String("address", m.ConfigSource.Address),
+		zap.Strings("keys", available),
+	)
+	return nil
+}
+
+// onConfigSourceChange reloads the rules or blacklists whose remote value changed.
+func (m *Middleware) onConfigSourceChange(keys []string) {
+	reloadRules, reloadConfig := false, false
+	for _, key := range keys {
+		if key == configKeyRules {
+			reloadRules = true
+		} else {
+			reloadConfig = true
+		}
+	}
+	var err error
+	switch {
+	case reloadConfig:
+		err = m.ReloadConfig() // Also reloads the rules
+	case reloadRules:
+		err = m.ReloadRules()
+	}
+	if err != nil {
+		m.logger.Error("Failed to apply config source change", zap.Strings("keys", keys), zap.Error(err))
+	}
+}
@@ -0,0 +1,204 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeKV is an in-memory key/value store with a modification index.
+type fakeKV struct {
+	mu     sync.Mutex
+	values map[string]string
+	index  uint64
+}
+
+func (kv *fakeKV) set(key, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.values[key] = value
+	kv.index++
+}
+
+func (kv *fakeKV) snapshot() (map[string]string, uint64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	values := make(map[string]string, len(kv.values))
+	for k, v := range kv.values {
+		values[k] = v
+	}
+	return values, kv.index
+}
+
+func newFakeConsul(t *testing.T, kv *fakeKV) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "acl-token", r.Header.Get("X-Consul-Token"))
+		assert.Equal(t, "/v1/kv/waf/", r.URL.Path)
+		values, index := kv.snapshot()
+		if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait > 0 {
+			// Blocking query: wait briefly for a change
+			deadline := time.Now().Add(time.Second)
+			for index <= wait && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				values, index = kv.snapshot()
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		if len(values) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var entries []map[string]interface{}
+		for k, v := range values {
+			entries = append(entries, map[string]interface{}{"Key": "waf/" + k, "Value": []byte(v)})
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newFakeEtcd(t *testing.T, kv *fakeKV) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/kv/range", r.URL.Path)
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "waf/", string(req.Key))
+		assert.Equal(t, "waf0", string(req.RangeEnd))
+		assert.Equal(t, "acl-token", r.Header.Get("Authorization"))
+		values, index := kv.snapshot()
+		var kvs []map[string]string
+		for k, v := range values {
+			kvs = append(kvs, map[string]string{
+				"key":   base64.StdEncoding.EncodeToString([]byte("waf/" + k)),
+				"value": base64.StdEncoding.EncodeToString([]byte(v)),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": strconv.FormatUint(index, 10)},
+			"kvs":    kvs,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConfigSource_ConsulSync(t *testing.T) {
+	kv := &fakeKV{values: map[string]string{"rules": `[]`, "ip_blacklist": "10.0.0.1\n"}}
+	kv.index = 7
+	srv := newFakeConsul(t, kv)
+	dir := t.TempDir()
+
+	cs, err := NewConfigSource(zap.NewNop(), ConfigSourceConfig{Backend: ConfigSourceConsul, Address: srv.URL, Token: "acl-token", CacheDir: dir})
+	require.NoError(t, err)
+	keys, err := cs.Sync(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{configKeyRules, configKeyIPBlacklist}, keys)
+
+	data, err := os.ReadFile(filepath.Join(dir, "ip_blacklist.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1\n", string(data))
+	assert.Equal(t, uint64(7), cs.index)
+}
+
+func TestConfigSource_WatchesChanges(t *testing.T) {
+	for _, backend := range []string{ConfigSourceConsul, ConfigSourceEtcd} {
+		t.Run(backend, func(t *testing.T) {
+			kv := &fakeKV{values: map[string]string{"dns_blacklist": "evil.com\n"}}
+			var srv *httptest.Server
+			if backend == ConfigSourceConsul {
+				srv = newFakeConsul(t, kv)
+			} else {
+				srv = newFakeEtcd(t, kv)
+			}
+			cs, err := NewConfigSource(zap.NewNop(), ConfigSourceConfig{
+				Backend:  backend,
+				Address:  srv.URL,
+				Token:    "acl-token",
+				CacheDir: t.TempDir(),
+				Interval: 50 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			_, err = cs.Sync(context.Background())
+			require.NoError(t, err)
+
+			changes := make(chan []string, 4)
+			cs.Start(func(keys []string) { changes <- keys })
+			defer cs.Stop()
+
+			kv.set("dns_blacklist", "evil.com\nworse.com\n")
+			select {
+			case keys := <-changes:
+				assert.Equal(t, []string{configKeyDNSBlacklist}, keys)
+			case <-time.After(3 * time.Second):
+				t.Fatal("change not detected")
+			}
+			data, err := os.ReadFile(cs.path(configKeyDNSBlacklist))
+			require.NoError(t, err)
+			assert.Equal(t, "evil.com\nworse.com\n", string(data))
+		})
+	}
+}
+
+func TestConfigSource_UnreachableUsesCache(t *testing.T) {
+	dir := t.TempDir()
+	config := ConfigSourceConfig{Backend: ConfigSourceEtcd, Address: "http://127.0.0.1:1", CacheDir: dir}
+	cs, err := NewConfigSource(zap.NewNop(), config)
+	require.NoError(t, err)
+
+	_, err = cs.Sync(context.Background())
+	assert.Error(t, err, "no cache and no store must fail")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rules.json"), []byte(`[]`), 0o600))
+	keys, err := cs.Sync(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{configKeyRules}, keys)
+}
+
+func TestNewConfigSource_Validation(t *testing.T) {
+	_, err := NewConfigSource(nil, ConfigSourceConfig{Backend: "zookeeper", Address: "http://x", CacheDir: t.TempDir()})
+	assert.Error(t, err)
+	_, err = NewConfigSource(nil, ConfigSourceConfig{Backend: ConfigSourceConsul, CacheDir: t.TempDir()})
+	assert.Error(t, err)
+	_, err = NewConfigSource(nil, ConfigSourceConfig{Backend: ConfigSourceConsul, Address: "http://x"})
+	assert.Error(t, err)
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	assert.Equal(t, []byte("waf0"), prefixRangeEnd([]byte("waf/")))
+	assert.Equal(t, []byte("b"), prefixRangeEnd([]byte{'a', 0xff}))
+	assert.Equal(t, []byte{0}, prefixRangeEnd([]byte{0xff}))
+}
+
+func TestProvisionConfigSource(t *testing.T) {
+	kv := &fakeKV{values: map[string]string{"rules": `[]`, "ip_blacklist": "10.0.0.1\n", "dns_blacklist": "evil.com\n"}}
+	srv := newFakeConsul(t, kv)
+	dir := t.TempDir()
+
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		RuleFiles:        []string{"local.json"},
+		DNSBlacklistFile: "local_dns.txt",
+		ConfigSource:     &ConfigSourceConfig{Backend: ConfigSourceConsul, Address: srv.URL, Token: "acl-token", CacheDir: dir},
+	}
+	require.NoError(t, m.provisionConfigSource(context.Background()))
+	assert.Equal(t, []string{"local.json", filepath.Join(dir, "rules.json")}, m.RuleFiles)
+	assert.Equal(t, filepath.Join(dir, "ip_blacklist.txt"), m.IPBlacklistFile)
+	assert.Equal(t, "local_dns.txt", m.DNSBlacklistFile, "explicit blacklist files are kept")
+	assert.NotNil(t, m.configSource)
+}
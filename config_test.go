@@ -2,8 +2,10 @@
 package caddywaf
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -181,6 +183,87 @@ func TestParseCustomResponse(t *testing.T) {
 	}
 }
 
+// TestParseCustomResponseTemplate tests custom_response bodies using templates.
+func TestParseCustomResponseTemplate(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	dir := t.TempDir()
+	writeBody := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		return path
+	}
+
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`custom_response 403 text/html ` + writeBody("block.html", "<p>Reference: {{.TransactionID}}</p>"))
+	d.Next()
+	if err := cl.parseCustomResponse(d, m); err != nil {
+		t.Fatalf("parseCustomResponse failed: %v", err)
+	}
+	if m.CustomResponses[403].template == nil {
+		t.Errorf("Expected the body template to be parsed")
+	}
+
+	m = &Middleware{}
+	page := writeBody("blocked.html", "<p>Blocked</p>")
+	d = caddyfile.NewTestDispenser(`custom_response 403 file ` + page)
+	d.Next()
+	if err := cl.parseCustomResponse(d, m); err != nil {
+		t.Fatalf("parseCustomResponse failed: %v", err)
+	}
+	expected := CustomBlockResponse{StatusCode: 403, Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"}, Body: "<p>Blocked</p>", File: page}
+	if !reflect.DeepEqual(m.CustomResponses[403], expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.CustomResponses[403])
+	}
+
+	m = &Middleware{}
+	french := writeBody("blocked.fr.html", "<p>Accès refusé</p>")
+	d = caddyfile.NewTestDispenser(`custom_response 403 file ` + page + ` {
+		language fr ` + french + `
+	}`)
+	d.Next()
+	if err := cl.parseCustomResponse(d, m); err != nil {
+		t.Fatalf("parseCustomResponse failed: %v", err)
+	}
+	if variant := m.CustomResponses[403].Languages["fr"]; variant.Body != "<p>Accès refusé</p>" || variant.File != french {
+		t.Errorf("Expected the fr body from %s, got %+v", french, variant)
+	}
+
+	for _, input := range []string{
+		`custom_response 403 file ` + page + ` {
+			language fr
+		}`,
+		`custom_response 403 file ` + page + ` {
+			language not_a_tag! ` + french + `
+		}`,
+		`custom_response 403 file ` + page + ` {
+			language fr ` + french + `
+			language fr ` + french + `
+		}`,
+		`custom_response 403 file ` + page + ` {
+			unknown fr
+		}`,
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCustomResponse(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+
+	for _, body := range []string{
+		"Reference: {{.TransactionID",
+		"{{end}}",
+	} {
+		d := caddyfile.NewTestDispenser(`custom_response 403 text/plain ` + writeBody("invalid.txt", body))
+		d.Next()
+		if err := cl.parseCustomResponse(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for body %q", body)
+		}
+	}
+}
+
 // TestParseCountryBlock tests the parseCountryBlock function.
 func TestParseCountryBlock(t *testing.T) {
 	logger := zap.NewNop()
@@ -343,3 +426,2535 @@ func TestUnmarshalCaddyfile_MissingRuleFile(t *testing.T) {
 		t.Fatal("Expected error for missing rule_file directive, got nil")
 	}
 }
+
+// TestParseNotify tests the parseNotify function.
+func TestParseNotify(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+        notify telegram {
+            bot_token 123:abc
+            chat_id 42
+            min_severity high
+            block_rate 50
+            cooldown 5m
+        }
+    `)
+
+	if !d.Next() {
+		t.Fatal("Failed to advance to the first directive")
+	}
+
+	err := cl.parseNotify(d, m)
+	if err != nil {
+		t.Fatalf("parseNotify failed: %v", err)
+	}
+
+	if len(m.Notifiers) != 1 {
+		t.Fatalf("Expected one notifier, got %d", len(m.Notifiers))
+	}
+	nc := m.Notifiers[0]
+	if nc.Type != NotifierTelegram || nc.BotToken != "123:abc" || nc.ChatID != "42" {
+		t.Errorf("Unexpected telegram settings: %+v", nc)
+	}
+	if nc.MinSeverity != "HIGH" || nc.BlockRate != 50 || nc.Cooldown != 5*time.Minute {
+		t.Errorf("Unexpected thresholds: %+v", nc)
+	}
+
+	d = caddyfile.NewTestDispenser(`
+        notify slack {
+            min_severity high
+        }
+    `)
+	d.Next()
+	if err := cl.parseNotify(d, m); err == nil {
+		t.Error("Expected error for slack notifier without webhook_url")
+	}
+}
+
+// TestParseEmailAlert tests the parseEmailAlert function.
+func TestParseEmailAlert(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+        email_alert {
+            smtp_server smtp.example.com:587
+            from waf@example.com
+            to ops@example.com sec@example.com
+            block_threshold 100
+            window 5m
+            rule_ids honeypot-1
+        }
+    `)
+
+	if !d.Next() {
+		t.Fatal("Failed to advance to the first directive")
+	}
+
+	if err := cl.parseEmailAlert(d, m); err != nil {
+		t.Fatalf("parseEmailAlert failed: %v", err)
+	}
+	if m.EmailAlert == nil {
+		t.Fatal("Expected email alert to be configured")
+	}
+	if m.EmailAlert.BlockThreshold != 100 || m.EmailAlert.Window != 5*time.Minute {
+		t.Errorf("Unexpected thresholds: %+v", m.EmailAlert)
+	}
+	if len(m.EmailAlert.To) != 2 || len(m.EmailAlert.RuleIDs) != 1 {
+		t.Errorf("Unexpected recipients or rule IDs: %+v", m.EmailAlert)
+	}
+}
+
+// TestParseSIEMOutput tests the parseSIEMOutput function.
+func TestParseSIEMOutput(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+        siem_output LEEF udp://127.0.0.1:514
+    `)
+
+	if !d.Next() {
+		t.Fatal("Failed to advance to the first directive")
+	}
+	if err := cl.parseSIEMOutput(d, m); err != nil {
+		t.Fatalf("parseSIEMOutput failed: %v", err)
+	}
+	if m.SIEMOutput == nil || m.SIEMOutput.Format != SIEMFormatLEEF || m.SIEMOutput.Output != "udp://127.0.0.1:514" {
+		t.Errorf("Unexpected SIEM output: %+v", m.SIEMOutput)
+	}
+
+	d = caddyfile.NewTestDispenser(`
+        siem_output syslog /tmp/out
+    `)
+	d.Next()
+	if err := cl.parseSIEMOutput(d, m); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+}
+
+// TestParseAdminAPI tests the parseAdminAPI function.
+func TestParseAdminAPI(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`admin_api`)
+	d.Next()
+	if err := cl.parseAdminAPI(d, m); err != nil {
+		t.Fatalf("parseAdminAPI failed: %v", err)
+	}
+	if m.AdminAPI != defaultAdminAPIPrefix {
+		t.Errorf("Expected default prefix, got '%s'", m.AdminAPI)
+	}
+
+	d = caddyfile.NewTestDispenser(`admin_api /internal/waf/`)
+	d.Next()
+	if err := cl.parseAdminAPI(d, m); err != nil {
+		t.Fatalf("parseAdminAPI failed: %v", err)
+	}
+	if m.AdminAPI != "/internal/waf" {
+		t.Errorf("Expected '/internal/waf', got '%s'", m.AdminAPI)
+	}
+
+	d = caddyfile.NewTestDispenser(`admin_api internal`)
+	d.Next()
+	if err := cl.parseAdminAPI(d, m); err == nil {
+		t.Error("Expected error for prefix without leading '/'")
+	}
+}
+
+func TestParseExplain(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`explain`)
+	d.Next()
+	if err := cl.parseExplain(d, m); err != nil {
+		t.Fatalf("parseExplain failed: %v", err)
+	}
+	if m.Explain == nil || m.Explain.Size != 0 {
+		t.Errorf("Expected explain with the default size, got %+v", m.Explain)
+	}
+
+	d = caddyfile.NewTestDispenser(`explain {
+		size 500
+	}`)
+	d.Next()
+	if err := cl.parseExplain(d, m); err != nil {
+		t.Fatalf("parseExplain failed: %v", err)
+	}
+	if m.Explain.Size != 500 {
+		t.Errorf("Expected size 500, got %d", m.Explain.Size)
+	}
+
+	for _, input := range []string{
+		"explain {\n size 0\n}",
+		"explain {\n size\n}",
+		"explain {\n depth 3\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseExplain(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseBlockStatus(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`block_status 406 {
+		rate_limit 429
+		geo 451
+		blacklist 403
+	}`)
+	d.Next()
+	if err := cl.parseBlockStatus(d, m); err != nil {
+		t.Fatalf("parseBlockStatus failed: %v", err)
+	}
+	expected := &BlockStatusConfig{Default: 406, Categories: map[string]int{"rate_limit": 429, "geo": 451, "blacklist": 403}}
+	if !reflect.DeepEqual(m.BlockStatus, expected) {
+		t.Errorf("Unexpected block_status config: %+v", m.BlockStatus)
+	}
+
+	for _, input := range []string{
+		"block_status 406 418",
+		"block_status forbidden",
+		"block_status 200",
+		"block_status {\n geo\n}",
+		"block_status {\n geo 301\n}",
+		"block_status {\n bots 403\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseBlockStatus(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRuleHitsFile(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`rule_hits_file /var/lib/caddy/rule_hits.json`)
+	d.Next()
+	if err := cl.parseRuleHitsFile(d, m); err != nil {
+		t.Fatalf("parseRuleHitsFile failed: %v", err)
+	}
+	if m.RuleHitsFile != "/var/lib/caddy/rule_hits.json" {
+		t.Errorf("Expected the rule hits file, got %q", m.RuleHitsFile)
+	}
+
+	for _, input := range []string{"rule_hits_file", "rule_hits_file a.json b.json"} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRuleHitsFile(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRuleCoverage(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`rule_coverage {
+		log_interval 6h
+	}`)
+	d.Next()
+	if err := cl.parseRuleCoverage(d, m); err != nil {
+		t.Fatalf("parseRuleCoverage failed: %v", err)
+	}
+	if m.RuleCoverage == nil || m.RuleCoverage.LogInterval != 6*time.Hour {
+		t.Errorf("Expected log_interval 6h, got %+v", m.RuleCoverage)
+	}
+
+	for _, input := range []string{
+		"rule_coverage {\n log_interval 0s\n}",
+		"rule_coverage {\n log_interval soon\n}",
+		"rule_coverage {\n window 1h\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRuleCoverage(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+// TestParseEndpointAuth tests the parseEndpointAuth function.
+func TestParseEndpointAuth(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`endpoint_auth {
+		token abc
+		basic_auth admin pw
+		allow_ip 127.0.0.1 10.0.0.0/8
+	}`)
+	d.Next()
+	if err := cl.parseEndpointAuth(d, m); err != nil {
+		t.Fatalf("parseEndpointAuth failed: %v", err)
+	}
+	if m.EndpointAuth == nil || m.EndpointAuth.Token != "abc" || m.EndpointAuth.Username != "admin" || m.EndpointAuth.Password != "pw" {
+		t.Errorf("Unexpected endpoint auth config: %+v", m.EndpointAuth)
+	}
+	if len(m.EndpointAuth.AllowedIPs) != 2 {
+		t.Errorf("Expected 2 allowed IPs, got %d", len(m.EndpointAuth.AllowedIPs))
+	}
+
+	d = caddyfile.NewTestDispenser(`endpoint_auth {
+		allow_ip bogus
+	}`)
+	d.Next()
+	if err := cl.parseEndpointAuth(d, &Middleware{}); err == nil {
+		t.Error("Expected error for invalid allow_ip")
+	}
+
+	d = caddyfile.NewTestDispenser(`endpoint_auth {
+		password x
+	}`)
+	d.Next()
+	if err := cl.parseEndpointAuth(d, &Middleware{}); err == nil {
+		t.Error("Expected error for unknown option")
+	}
+}
+
+// TestParseEventStore tests the parseEventStore function.
+func TestParseEventStore(t *testing.T) {
+	logger := zap.NewNop()
+	cl := NewConfigLoader(logger)
+
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`event_store /tmp/events.db {
+		retention 24h
+	}`)
+	d.Next()
+	if err := cl.parseEventStore(d, m); err != nil {
+		t.Fatalf("parseEventStore failed: %v", err)
+	}
+	if m.EventStore == nil || m.EventStore.Path != "/tmp/events.db" || m.EventStore.Retention != 24*time.Hour {
+		t.Errorf("Unexpected event store config: %+v", m.EventStore)
+	}
+
+	d = caddyfile.NewTestDispenser(`event_store /tmp/events.db {
+		max_events 1000
+		export_dir /tmp/exports
+		export_interval 1h
+	}`)
+	d.Next()
+	if err := cl.parseEventStore(d, m); err != nil {
+		t.Fatalf("parseEventStore failed: %v", err)
+	}
+	if m.EventStore.MaxEvents != 1000 || m.EventStore.ExportDir != "/tmp/exports" || m.EventStore.ExportInterval != time.Hour {
+		t.Errorf("Unexpected event store config: %+v", m.EventStore)
+	}
+
+	d = caddyfile.NewTestDispenser(`event_store /tmp/events.db {
+		export_interval 1h
+	}`)
+	d.Next()
+	if err := cl.parseEventStore(d, &Middleware{}); err == nil {
+		t.Error("Expected error for export_interval without export_dir")
+	}
+
+	d = caddyfile.NewTestDispenser(`event_store`)
+	d.Next()
+	if err := cl.parseEventStore(d, &Middleware{}); err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
+
+// TestParseTenantByHost tests the parseTenantByHost function.
+func TestParseTenantByHost(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`tenant_by_host`)
+	d.Next()
+	if err := cl.parseTenantByHost(d, m); err != nil {
+		t.Fatalf("parseTenantByHost failed: %v", err)
+	}
+	if !m.TenantByHost {
+		t.Error("Expected TenantByHost to be enabled")
+	}
+}
+
+// TestParseHostOverlay tests the parseHostOverlay function.
+func TestParseHostOverlay(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`host api.example.com *.api.example.com {
+		anomaly_threshold 5
+		rule_file api_rules.json
+		disable_rule 942100 941100
+	}`)
+	d.Next()
+	if err := cl.parseHostOverlay(d, m); err != nil {
+		t.Fatalf("parseHostOverlay failed: %v", err)
+	}
+	if len(m.HostOverlays) != 1 {
+		t.Fatalf("Expected 1 host overlay, got %d", len(m.HostOverlays))
+	}
+	overlay := m.HostOverlays[0]
+	if len(overlay.Hosts) != 2 || overlay.AnomalyThreshold != 5 || len(overlay.RuleFiles) != 1 || len(overlay.DisabledRules) != 2 {
+		t.Errorf("Unexpected host overlay: %+v", overlay)
+	}
+
+	d = caddyfile.NewTestDispenser(`host {
+		anomaly_threshold 5
+	}`)
+	d.Next()
+	if err := cl.parseHostOverlay(d, &Middleware{}); err == nil {
+		t.Error("Expected error for host block without hosts")
+	}
+}
+
+func TestParseConfigSource(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`config_source consul http://127.0.0.1:8500 {
+		prefix waf/prod/
+		token secret
+		cache_dir /var/lib/caddy/waf
+		interval 1m
+	}`)
+	d.Next()
+	if err := cl.parseConfigSource(d, m); err != nil {
+		t.Fatalf("parseConfigSource failed: %v", err)
+	}
+	expected := ConfigSourceConfig{
+		Backend:  ConfigSourceConsul,
+		Address:  "http://127.0.0.1:8500",
+		Prefix:   "waf/prod/",
+		Token:    "secret",
+		CacheDir: "/var/lib/caddy/waf",
+		Interval: time.Minute,
+	}
+	if m.ConfigSource == nil || *m.ConfigSource != expected {
+		t.Errorf("Unexpected config source: %+v", m.ConfigSource)
+	}
+
+	for _, input := range []string{
+		`config_source zookeeper http://127.0.0.1 { cache_dir /tmp }`,
+		`config_source etcd http://127.0.0.1:2379`,
+		`config_source etcd`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseConfigSource(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseBan(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`ban {
+		threshold 10
+		window 2m
+		duration 6h
+		honeypot_rule trap-1 trap-2
+		propagate redis 10.0.0.5:6379 waf-bans
+		propagate_auth secret
+	}`)
+	d.Next()
+	if err := cl.parseBan(d, m); err != nil {
+		t.Fatalf("parseBan failed: %v", err)
+	}
+	if m.Bans == nil || m.Bans.Threshold != 10 || m.Bans.Window != 2*time.Minute || m.Bans.Duration != 6*time.Hour || len(m.Bans.HoneypotRules) != 2 {
+		t.Fatalf("Unexpected ban config: %+v", m.Bans)
+	}
+	expected := BanPropagationConfig{Type: BanPropagationRedis, Address: "10.0.0.5:6379", Channel: "waf-bans", Password: "secret"}
+	if m.Bans.Propagation == nil || *m.Bans.Propagation != expected {
+		t.Errorf("Unexpected ban propagation: %+v", m.Bans.Propagation)
+	}
+
+	for _, input := range []string{
+		`ban { propagate kafka 10.0.0.5:9092 }`,
+		`ban { propagate_auth secret }`,
+		`ban { threshold 0 }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseBan(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseCluster(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`cluster {
+		node web-1
+		peers http://10.0.0.2:8080 http://10.0.0.3:8080
+		secret s3cret
+		sync_interval 2s
+		sync_path /internal/waf-sync
+	}`)
+	d.Next()
+	if err := cl.parseCluster(d, m); err != nil {
+		t.Fatalf("parseCluster failed: %v", err)
+	}
+	if m.Cluster == nil || m.Cluster.Node != "web-1" || len(m.Cluster.Peers) != 2 || m.Cluster.Secret != "s3cret" ||
+		m.Cluster.SyncInterval != 2*time.Second || m.Cluster.SyncPath != "/internal/waf-sync" {
+		t.Errorf("Unexpected cluster config: %+v", m.Cluster)
+	}
+
+	m = &Middleware{}
+	d = caddyfile.NewTestDispenser(`cluster {
+		backend nats 10.0.0.5:4222 waf.sync
+		backend_auth token
+	}`)
+	d.Next()
+	if err := cl.parseCluster(d, m); err != nil {
+		t.Fatalf("parseCluster failed: %v", err)
+	}
+	expected := BanPropagationConfig{Type: BanPropagationNATS, Address: "10.0.0.5:4222", Channel: "waf.sync", Password: "token"}
+	if m.Cluster.Backend == nil || *m.Cluster.Backend != expected {
+		t.Errorf("Unexpected cluster backend: %+v", m.Cluster.Backend)
+	}
+
+	for _, input := range []string{
+		`cluster { node web-1 }`,
+		`cluster { peers http://10.0.0.2 }`,
+		`cluster { peers 10.0.0.2 secret s }`,
+		`cluster { peers http://10.0.0.2 secret s backend redis 10.0.0.5:6379 }`,
+		`cluster { backend_auth token }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCluster(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseGeoIPUpdate(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`geoip_update {
+		account_id 12345
+		license_key abc
+		editions GeoLite2-Country GeoLite2-ASN
+		interval 12h
+		cache_dir /var/lib/waf/geoip
+	}`)
+	d.Next()
+	if err := cl.parseGeoIPUpdate(d, m); err != nil {
+		t.Fatalf("parseGeoIPUpdate failed: %v", err)
+	}
+	if m.GeoIPUpdate == nil || m.GeoIPUpdate.AccountID != "12345" || m.GeoIPUpdate.LicenseKey != "abc" ||
+		len(m.GeoIPUpdate.Editions) != 2 || m.GeoIPUpdate.Interval != 12*time.Hour || m.GeoIPUpdate.CacheDir != "/var/lib/waf/geoip" {
+		t.Errorf("Unexpected geoip_update config: %+v", m.GeoIPUpdate)
+	}
+
+	for _, input := range []string{
+		`geoip_update { license_key abc }`,
+		`geoip_update { account_id 12345 }`,
+		"geoip_update {\n account_id 12345\n license_key abc\n editions\n}",
+		`geoip_update { account_id 12345 license_key abc interval soon }`,
+		`geoip_update { account_id 12345 license_key abc mirror x }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseGeoIPUpdate(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseInspectionPool(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`inspection_pool {
+		workers 8
+		queue_timeout 50ms
+		fallback BLOCK
+		body_threshold 131072
+	}`)
+	d.Next()
+	if err := cl.parseInspectionPool(d, m); err != nil {
+		t.Fatalf("parseInspectionPool failed: %v", err)
+	}
+	expected := InspectionPoolConfig{Workers: 8, QueueTimeout: 50 * time.Millisecond, Fallback: "block", BodyThreshold: 131072}
+	if m.InspectionPool == nil || *m.InspectionPool != expected {
+		t.Errorf("Unexpected inspection_pool config: %+v", m.InspectionPool)
+	}
+
+	for _, input := range []string{
+		`inspection_pool { workers 0 }`,
+		`inspection_pool { fallback queue }`,
+		`inspection_pool { queue_timeout soon }`,
+		`inspection_pool { threads 4 }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseInspectionPool(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseInspectionBudget(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`inspection_budget {
+		max_body_bytes 1048576
+		max_regex_time 500us
+		max_rules 200
+		on_exceeded BLOCK
+	}`)
+	d.Next()
+	if err := cl.parseInspectionBudget(d, m); err != nil {
+		t.Fatalf("parseInspectionBudget failed: %v", err)
+	}
+	expected := InspectionBudget{MaxBodyBytes: 1048576, MaxRegexTime: 500 * time.Microsecond, MaxRules: 200, OnExceeded: "block"}
+	if m.InspectionBudget == nil || *m.InspectionBudget != expected {
+		t.Errorf("Unexpected inspection_budget config: %+v", m.InspectionBudget)
+	}
+
+	for _, input := range []string{
+		`inspection_budget { }`,
+		`inspection_budget { max_rules 0 }`,
+		`inspection_budget { max_regex_time slow }`,
+		`inspection_budget { max_rules 10
+		on_exceeded drop }`,
+		`inspection_budget { max_cpu 10 }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseInspectionBudget(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseResponseBufferLimit(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`response_buffer_limit 1048576`)
+	d.Next()
+	if err := cl.parseResponseBufferLimit(d, m); err != nil {
+		t.Fatalf("parseResponseBufferLimit failed: %v", err)
+	}
+	if m.ResponseBufferLimit != 1048576 {
+		t.Errorf("Expected response buffer limit 1048576, got %d", m.ResponseBufferLimit)
+	}
+
+	d = caddyfile.NewTestDispenser(`response_buffer_limit 0`)
+	d.Next()
+	if err := cl.parseResponseBufferLimit(d, &Middleware{}); err == nil {
+		t.Error("Expected error for a zero limit")
+	}
+}
+
+func TestParseResponseDecompress(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`response_decompress 1048576`)
+	d.Next()
+	if err := cl.parseResponseDecompress(d, m); err != nil {
+		t.Fatalf("parseResponseDecompress failed: %v", err)
+	}
+	if m.ResponseDecompressLimit != 1048576 {
+		t.Errorf("Expected response decompress limit 1048576, got %d", m.ResponseDecompressLimit)
+	}
+
+	d = caddyfile.NewTestDispenser(`response_decompress 0`)
+	d.Next()
+	if err := cl.parseResponseDecompress(d, &Middleware{}); err == nil {
+		t.Error("Expected error for a zero limit")
+	}
+}
+
+func TestParseLogOverflow(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`log_overflow BLOCK_WITH_TIMEOUT 50ms`)
+	d.Next()
+	if err := cl.parseLogOverflow(d, m); err != nil {
+		t.Fatalf("parseLogOverflow failed: %v", err)
+	}
+	if m.LogOverflow != logOverflowBlock || m.LogOverflowTimeout != 50*time.Millisecond {
+		t.Errorf("Unexpected log_overflow config: %s %v", m.LogOverflow, m.LogOverflowTimeout)
+	}
+
+	for _, input := range []string{
+		`log_overflow`,
+		`log_overflow drop_everything`,
+		`log_overflow drop_new 50ms`,
+		`log_overflow block_with_timeout soon`,
+		`log_overflow block_with_timeout 50ms 60ms`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseLogOverflow(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLookupCache(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`lookup_cache {
+		size 50000
+		ttl 30m
+	}`)
+	d.Next()
+	if err := cl.parseLookupCache(d, m); err != nil {
+		t.Fatalf("parseLookupCache failed: %v", err)
+	}
+	expected := LookupCacheConfig{Size: 50000, TTL: 30 * time.Minute}
+	if m.LookupCache == nil || *m.LookupCache != expected {
+		t.Errorf("Unexpected lookup_cache config: %+v", m.LookupCache)
+	}
+
+	for _, input := range []string{
+		`lookup_cache { size 0 }`,
+		`lookup_cache { ttl forever }`,
+		`lookup_cache { entries 10 }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseLookupCache(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseDNSBlacklistIndex(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`dns_blacklist_index {
+		false_positive_rate 0.001
+		path /var/cache/waf/dns.idx
+	}`)
+	d.Next()
+	if err := cl.parseDNSBlacklistIndex(d, m); err != nil {
+		t.Fatalf("parseDNSBlacklistIndex failed: %v", err)
+	}
+	expected := DNSBlacklistIndexConfig{FalsePositiveRate: 0.001, Path: "/var/cache/waf/dns.idx"}
+	if m.DNSBlacklistIndex == nil || *m.DNSBlacklistIndex != expected {
+		t.Errorf("Unexpected dns_blacklist_index config: %+v", m.DNSBlacklistIndex)
+	}
+
+	for _, input := range []string{
+		`dns_blacklist_index { false_positive_rate 1 }`,
+		`dns_blacklist_index { false_positive_rate low }`,
+		`dns_blacklist_index { shards 4 }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseDNSBlacklistIndex(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParsePathBlacklistFile(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`path_blacklist_file /etc/caddy/paths.txt`)
+	d.Next()
+	if err := cl.parsePathBlacklistFile(d, m); err != nil {
+		t.Fatalf("parsePathBlacklistFile failed: %v", err)
+	}
+	if m.PathBlacklistFile != "/etc/caddy/paths.txt" {
+		t.Errorf("Expected path blacklist file /etc/caddy/paths.txt, got %q", m.PathBlacklistFile)
+	}
+
+	d = caddyfile.NewTestDispenser(`path_blacklist_file`)
+	d.Next()
+	if err := cl.parsePathBlacklistFile(d, &Middleware{}); err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
+
+func TestParseCertBlacklistFile(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`cert_blacklist_file /etc/caddy/revoked-certs.txt`)
+	d.Next()
+	if err := cl.parseCertBlacklistFile(d, m); err != nil {
+		t.Fatalf("parseCertBlacklistFile failed: %v", err)
+	}
+	if m.CertBlacklistFile != "/etc/caddy/revoked-certs.txt" {
+		t.Errorf("Expected certificate blacklist file /etc/caddy/revoked-certs.txt, got %q", m.CertBlacklistFile)
+	}
+
+	d = caddyfile.NewTestDispenser(`cert_blacklist_file`)
+	d.Next()
+	if err := cl.parseCertBlacklistFile(d, &Middleware{}); err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
+
+func TestParseIPBlacklistPrefix(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`ip_blacklist_prefix ipv4 24 ipv6 128`)
+	d.Next()
+	if err := cl.parseIPBlacklistPrefix(d, m); err != nil {
+		t.Fatalf("parseIPBlacklistPrefix failed: %v", err)
+	}
+	if m.IPBlacklistIPv4Prefix != 24 || m.IPBlacklistIPv6Prefix != 128 {
+		t.Errorf("Expected prefix lengths 24 and 128, got %d and %d", m.IPBlacklistIPv4Prefix, m.IPBlacklistIPv6Prefix)
+	}
+
+	for _, input := range []string{
+		`ip_blacklist_prefix`,
+		`ip_blacklist_prefix ipv6`,
+		`ip_blacklist_prefix ipv6 129`,
+		`ip_blacklist_prefix ipv4 0`,
+		`ip_blacklist_prefix ipv4 x`,
+		`ip_blacklist_prefix ipv5 24`,
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseIPBlacklistPrefix(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseParamSchema(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`param_schema /api/users* {
+		methods GET POST
+		param name string required min_length 2 max_length 32 charset alnum
+		param age int min 0 max 150
+		param zip pattern \d{5}
+		allow_unknown
+		action score
+		score 3
+	}`)
+	d.Next()
+	if err := cl.parseParamSchema(d, m); err != nil {
+		t.Fatalf("parseParamSchema failed: %v", err)
+	}
+	if len(m.ParamSchemas) != 1 {
+		t.Fatalf("Expected 1 param schema, got %d", len(m.ParamSchemas))
+	}
+	schema := m.ParamSchemas[0]
+	if schema.Path != "/api/users*" || len(schema.Methods) != 2 || !schema.AllowUnknown || schema.Action != "score" || schema.Score != 3 {
+		t.Errorf("Unexpected param schema: %+v", schema)
+	}
+	if len(schema.Params) != 3 {
+		t.Fatalf("Expected 3 params, got %d", len(schema.Params))
+	}
+	name := schema.Params[0]
+	if name.Name != "name" || name.Type != "string" || !name.Required || name.MinLength != 2 || name.MaxLength != 32 || name.Charset != "alnum" {
+		t.Errorf("Unexpected name param: %+v", name)
+	}
+	age := schema.Params[1]
+	if age.Type != "int" || age.Min == nil || *age.Min != 0 || age.Max == nil || *age.Max != 150 {
+		t.Errorf("Unexpected age param: %+v", age)
+	}
+	if schema.Params[2].Type != "string" || schema.Params[2].Pattern != `\d{5}` {
+		t.Errorf("Unexpected zip param: %+v", schema.Params[2])
+	}
+
+	for _, input := range []string{
+		`param_schema`,
+		"param_schema /api {\nparam\n}",
+		"param_schema /api {\nparam id max_length\n}",
+		"param_schema /api {\nparam id length 5\n}",
+		"param_schema /api {\nparam id int min low\n}",
+		`param_schema /api { action drop }`,
+		`param_schema /api { strict }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseParamSchema(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseOpenAPI(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`openapi /etc/caddy/openapi.yaml {
+		base_path /api/v1
+		action score
+		score 4
+	}`)
+	d.Next()
+	if err := cl.parseOpenAPI(d, m); err != nil {
+		t.Fatalf("parseOpenAPI failed: %v", err)
+	}
+	expected := OpenAPIConfig{Spec: "/etc/caddy/openapi.yaml", BasePath: "/api/v1", Action: "score", Score: 4}
+	if m.OpenAPI == nil || *m.OpenAPI != expected {
+		t.Errorf("Unexpected openapi config: %+v", m.OpenAPI)
+	}
+
+	for _, input := range []string{
+		`openapi`,
+		`openapi spec.yaml { action drop }`,
+		`openapi spec.yaml { score none }`,
+		`openapi spec.yaml { strict }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseOpenAPI(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseJSONSchema(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`json_schema /api/users* /etc/caddy/user.schema.json {
+		methods POST PUT
+		status 422
+		response application/json "{\"errors\":{violations}}"
+	}`)
+	d.Next()
+	if err := cl.parseJSONSchema(d, m); err != nil {
+		t.Fatalf("parseJSONSchema failed: %v", err)
+	}
+	if len(m.JSONSchemas) != 1 {
+		t.Fatalf("Expected 1 JSON schema, got %d", len(m.JSONSchemas))
+	}
+	config := m.JSONSchemas[0]
+	if config.Path != "/api/users*" || config.Schema != "/etc/caddy/user.schema.json" {
+		t.Errorf("Unexpected path or schema: %+v", config)
+	}
+	if len(config.Methods) != 2 || config.Methods[0] != "POST" || config.Methods[1] != "PUT" {
+		t.Errorf("Unexpected methods: %v", config.Methods)
+	}
+	if config.StatusCode != 422 || config.ContentType != "application/json" || config.Body != `{"errors":{violations}}` {
+		t.Errorf("Unexpected response: %+v", config)
+	}
+
+	for _, input := range []string{
+		`json_schema /api`,
+		`json_schema api schema.json`,
+		`json_schema /api schema.json { status 302 }`,
+		"json_schema /api schema.json {\n response application/json\n}",
+		"json_schema /api schema.json {\n methods\n}",
+		`json_schema /api schema.json { strict }`,
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseJSONSchema(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseCredentialStuffing(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`credential_stuffing /login username {
+		window 5m
+		max_usernames 5
+		failure_ratio 0.9
+		min_attempts 20
+		failure_status 401 200
+		action challenge
+	}`)
+	d.Next()
+	if err := cl.parseCredentialStuffing(d, m); err != nil {
+		t.Fatalf("parseCredentialStuffing failed: %v", err)
+	}
+	if len(m.CredentialStuffing) != 1 {
+		t.Fatalf("Expected 1 credential stuffing config, got %d", len(m.CredentialStuffing))
+	}
+	config := m.CredentialStuffing[0]
+	if config.Path != "/login" || config.UsernameField != "username" || config.Window != 5*time.Minute {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if config.MaxUsernames != 5 || config.FailureRatio != 0.9 || config.MinAttempts != 20 || config.Action != "challenge" {
+		t.Errorf("Unexpected thresholds: %+v", config)
+	}
+	if len(config.FailureStatus) != 2 || config.FailureStatus[0] != 401 || config.FailureStatus[1] != 200 {
+		t.Errorf("Unexpected failure statuses: %v", config.FailureStatus)
+	}
+
+	for _, input := range []string{
+		`credential_stuffing /login`,
+		`credential_stuffing login user`,
+		"credential_stuffing /login user {\n failure_ratio 1.5\n}",
+		"credential_stuffing /login user {\n failure_status abc\n}",
+		"credential_stuffing /login user {\n action drop\n}",
+		"credential_stuffing /login user {\n lockout\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCredentialStuffing(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`challenge {
+		secret s3cret
+		cookie_name __waf
+		ttl 30m
+		difficulty 16
+	}`)
+	d.Next()
+	if err := cl.parseChallenge(d, m); err != nil {
+		t.Fatalf("parseChallenge failed: %v", err)
+	}
+	expected := ChallengeConfig{Secret: "s3cret", CookieName: "__waf", TTL: 30 * time.Minute, Difficulty: 16}
+	if m.Challenge == nil || m.Challenge.Secret != expected.Secret || m.Challenge.CookieName != expected.CookieName ||
+		m.Challenge.TTL != expected.TTL || m.Challenge.Difficulty != expected.Difficulty {
+		t.Errorf("Unexpected challenge config: %+v", m.Challenge)
+	}
+
+	for _, input := range []string{
+		"challenge {\n difficulty 30\n}",
+		"challenge {\n ttl soon\n}",
+		"challenge {\n captcha\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseChallenge(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseGeoVelocity(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`geo_velocity COOKIES:session {
+		max_speed 900
+		min_distance 300
+		ttl 12h
+		max_keys 5000
+		action challenge
+	}`)
+	d.Next()
+	if err := cl.parseGeoVelocity(d, m); err != nil {
+		t.Fatalf("parseGeoVelocity failed: %v", err)
+	}
+	expected := GeoVelocityConfig{Key: "COOKIES:session", MaxSpeed: 900, MinDistance: 300, TTL: 12 * time.Hour, MaxKeys: 5000, Action: "challenge"}
+	if m.GeoVelocity == nil || *m.GeoVelocity != expected {
+		t.Errorf("Unexpected geo_velocity config: %+v", m.GeoVelocity)
+	}
+
+	for _, input := range []string{
+		`geo_velocity`,
+		"geo_velocity COOKIES:session {\n max_speed fast\n}",
+		"geo_velocity COOKIES:session {\n action block\n}",
+		"geo_velocity COOKIES:session {\n notify\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseGeoVelocity(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseSlowClient(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`slow_client {
+		body_timeout 30s
+		min_rate 512
+		grace 10s
+		ban 10m
+	}`)
+	d.Next()
+	if err := cl.parseSlowClient(d, m); err != nil {
+		t.Fatalf("parseSlowClient failed: %v", err)
+	}
+	expected := SlowClientConfig{BodyTimeout: 30 * time.Second, MinRate: 512, Grace: 10 * time.Second, BanDuration: 10 * time.Minute}
+	if m.SlowClient == nil || *m.SlowClient != expected {
+		t.Errorf("Unexpected slow_client config: %+v", m.SlowClient)
+	}
+
+	for _, input := range []string{
+		"slow_client {\n}",
+		"slow_client {\n min_rate 0\n}",
+		"slow_client {\n body_timeout soon\n}",
+		"slow_client {\n read_header 5s\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseSlowClient(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseConcurrencyLimit(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`concurrency_limit {
+		per_ip 20
+		per_connection 10
+	}`)
+	d.Next()
+	if err := cl.parseConcurrencyLimit(d, m); err != nil {
+		t.Fatalf("parseConcurrencyLimit failed: %v", err)
+	}
+	if m.ConcurrencyLimit == nil || m.ConcurrencyLimit.PerIP != 20 || m.ConcurrencyLimit.PerConnection != 10 {
+		t.Errorf("Unexpected concurrency_limit config: %+v", m.ConcurrencyLimit)
+	}
+
+	for _, input := range []string{
+		"concurrency_limit {\n}",
+		"concurrency_limit {\n per_ip 0\n}",
+		"concurrency_limit {\n per_connection many\n}",
+		"concurrency_limit {\n total 100\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseConcurrencyLimit(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseReplay(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`replay /payments/* {
+		methods POST PUT
+		nonce_header Idempotency-Key
+		ttl 10m
+		max_keys 5000
+		action score
+		score 4
+	}`)
+	d.Next()
+	if err := cl.parseReplay(d, m); err != nil {
+		t.Fatalf("parseReplay failed: %v", err)
+	}
+	if len(m.Replay) != 1 {
+		t.Fatalf("Expected 1 replay config, got %d", len(m.Replay))
+	}
+	config := m.Replay[0]
+	if config.Path != "/payments/*" || len(config.Methods) != 2 || config.NonceHeader != "Idempotency-Key" ||
+		config.TTL != 10*time.Minute || config.MaxKeys != 5000 || config.Action != "score" || config.Score != 4 {
+		t.Errorf("Unexpected replay config: %+v", config)
+	}
+
+	d = caddyfile.NewTestDispenser(`replay /webhooks/* {
+		nonce_header X-Webhook-Id
+		require_nonce
+		redis 10.0.0.5:6379 s3cret
+		redis_prefix waf:nonces:
+		redis_fail_closed
+	}`)
+	d.Next()
+	if err := cl.parseReplay(d, m); err != nil {
+		t.Fatalf("parseReplay failed: %v", err)
+	}
+	config = m.Replay[1]
+	expectedRedis := &ReplayRedisConfig{Address: "10.0.0.5:6379", Password: "s3cret", Prefix: "waf:nonces:", FailClosed: true}
+	if !config.RequireNonce || !reflect.DeepEqual(config.Redis, expectedRedis) {
+		t.Errorf("Unexpected replay config: %+v", config)
+	}
+
+	for _, input := range []string{
+		`replay`,
+		`replay payments`,
+		"replay /payments {\n action challenge\n}",
+		"replay /payments {\n ttl later\n}",
+		"replay /payments {\n window 1m\n}",
+		"replay /webhooks {\n require_nonce\n}",
+		"replay /webhooks {\n redis_prefix waf:\n}",
+		"replay /webhooks {\n redis a:6379 b c\n}",
+		"replay /webhooks {\n redis_fail_closed\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseReplay(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`quota {
+		header Authorization
+		source https://example.com/quotas.json
+		refresh 1m
+		hourly 100
+		daily 1000
+	}`)
+	d.Next()
+	if err := cl.parseQuota(d, m); err != nil {
+		t.Fatalf("parseQuota failed: %v", err)
+	}
+	if m.Quota == nil || m.Quota.Header != "Authorization" || m.Quota.Source != "https://example.com/quotas.json" ||
+		m.Quota.Refresh != time.Minute || m.Quota.Hourly != 100 || m.Quota.Daily != 1000 {
+		t.Errorf("Unexpected quota config: %+v", m.Quota)
+	}
+
+	for _, input := range []string{
+		"quota {\n header X-Key\n}",
+		"quota {\n hourly 0\n}",
+		"quota {\n refresh often\n}",
+		"quota {\n monthly 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseQuota(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseCostLimit(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`cost_limit {
+		budget 100
+		window 1m
+		default_cost 2
+		cost ^/search 10
+		cost ^/healthz$ 0
+	}`)
+	d.Next()
+	if err := cl.parseCostLimit(d, m); err != nil {
+		t.Fatalf("parseCostLimit failed: %v", err)
+	}
+	if m.CostLimit == nil || m.CostLimit.Budget != 100 || m.CostLimit.Window != time.Minute || m.CostLimit.DefaultCost != 2 {
+		t.Fatalf("Unexpected cost_limit config: %+v", m.CostLimit)
+	}
+	expected := []EndpointCost{{Path: "^/search", Cost: 10}, {Path: "^/healthz$", Cost: 0}}
+	if !reflect.DeepEqual(m.CostLimit.Costs, expected) {
+		t.Errorf("Unexpected costs: %+v", m.CostLimit.Costs)
+	}
+
+	for _, input := range []string{
+		"cost_limit {\n window 1m\n}",
+		"cost_limit {\n budget 10\n}",
+		"cost_limit {\n budget 10\n window 1m\n cost ^/search\n}",
+		"cost_limit {\n budget 10\n window 1m\n cost ^/search -1\n}",
+		"cost_limit {\n budget 10\n window 1m\n default_cost 0\n}",
+		"cost_limit {\n requests 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCostLimit(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseBotScore(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`bot_score {
+		threshold 60
+		action block
+		weight missing_accept 25
+		weight challenge_passed -80
+	}`)
+	d.Next()
+	if err := cl.parseBotScore(d, m); err != nil {
+		t.Fatalf("parseBotScore failed: %v", err)
+	}
+	expected := &BotScoreConfig{Threshold: 60, Action: "block", Weights: map[string]int{"missing_accept": 25, "challenge_passed": -80}}
+	if !reflect.DeepEqual(m.BotScore, expected) {
+		t.Errorf("Unexpected bot_score config: %+v", m.BotScore)
+	}
+
+	for _, input := range []string{
+		"bot_score {\n threshold 101\n}",
+		"bot_score {\n action ban\n}",
+		"bot_score {\n weight tls_fingerprint 10\n}",
+		"bot_score {\n weight missing_accept high\n}",
+		"bot_score {\n signals all\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseBotScore(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseIPType(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`ip_type {
+		feed datacenter https://example.com/datacenter.txt
+		feed VPN /etc/caddy/vpn.txt
+		feed tor
+		refresh 12h
+		provider static {
+			198.51.100.1 vpn
+		}
+		provider_timeout 200ms
+		cache_ttl 30m
+	}`)
+	d.Next()
+	if err := cl.parseIPType(d, m); err != nil {
+		t.Fatalf("parseIPType failed: %v", err)
+	}
+	expected := &IPTypeConfig{
+		Feeds: []IPTypeFeed{
+			{Type: "datacenter", Source: "https://example.com/datacenter.txt"},
+			{Type: "vpn", Source: "/etc/caddy/vpn.txt"},
+			{Type: "tor"},
+		},
+		Refresh:         12 * time.Hour,
+		ProviderRaw:     json.RawMessage(`{"provider":"static","types":{"198.51.100.1":"vpn"}}`),
+		ProviderTimeout: 200 * time.Millisecond,
+		CacheTTL:        30 * time.Minute,
+	}
+	if !reflect.DeepEqual(m.IPType, expected) {
+		t.Errorf("Unexpected ip_type config: %+v", m.IPType)
+	}
+
+	for _, input := range []string{
+		"ip_type {\n}",
+		"ip_type {\n feed residential /tmp/list.txt\n}",
+		"ip_type {\n feed vpn\n}",
+		"ip_type {\n feed tor\n provider missing\n}",
+		"ip_type {\n provider static\n provider static\n}",
+		"ip_type {\n feed tor\n refresh soon\n}",
+		"ip_type {\n feed tor\n lookup dns\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseIPType(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseReputation(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`reputation {
+		provider http https://intel.example.com/ip/{ip} {
+			header Authorization "Bearer token"
+		}
+		timeout 300ms
+		cache_ttl 5m
+		cache_size 5000
+		threshold 80
+		category botnet scanner
+		action challenge
+		score 3
+	}`)
+	d.Next()
+	if err := cl.parseReputation(d, m); err != nil {
+		t.Fatalf("parseReputation failed: %v", err)
+	}
+	config := m.Reputation
+	if config == nil || len(config.ProvidersRaw) != 1 || config.Timeout != 300*time.Millisecond ||
+		config.CacheTTL != 5*time.Minute || config.CacheSize != 5000 || config.Threshold != 80 ||
+		!reflect.DeepEqual(config.Categories, []string{"botnet", "scanner"}) || config.Action != "challenge" || config.Score != 3 {
+		t.Fatalf("Unexpected reputation config: %+v", config)
+	}
+	var provider map[string]any
+	if err := json.Unmarshal(config.ProvidersRaw[0], &provider); err != nil {
+		t.Fatalf("Invalid provider config: %v", err)
+	}
+	expected := map[string]any{
+		"provider": "http",
+		"url":      "https://intel.example.com/ip/{ip}",
+		"headers":  map[string]any{"Authorization": "Bearer token"},
+	}
+	if !reflect.DeepEqual(provider, expected) {
+		t.Errorf("Unexpected provider config: %s", config.ProvidersRaw[0])
+	}
+
+	for _, input := range []string{
+		"reputation {\n}",
+		"reputation {\n provider\n}",
+		"reputation {\n provider missing\n}",
+		"reputation {\n provider http\n}",
+		"reputation {\n provider http https://intel.example.com/{ip}\n threshold 101\n}",
+		"reputation {\n provider http https://intel.example.com/{ip}\n action ban\n}",
+		"reputation {\n provider http https://intel.example.com/{ip}\n feeds all\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseReputation(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseInspector(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`inspector fraud {
+		plugin /etc/caddy/fraud.so
+		phase 1 2
+		option endpoint https://fraud.example.com
+		timeout 50ms
+		fail_closed
+	}`)
+	d.Next()
+	if err := cl.parseInspector(d, m); err != nil {
+		t.Fatalf("parseInspector failed: %v", err)
+	}
+	expected := []*InspectorConfig{{
+		Name:       "fraud",
+		Plugin:     "/etc/caddy/fraud.so",
+		Phases:     []int{1, 2},
+		Options:    map[string]string{"endpoint": "https://fraud.example.com"},
+		Timeout:    50 * time.Millisecond,
+		FailClosed: true,
+	}}
+	if !reflect.DeepEqual(m.Inspectors, expected) {
+		t.Errorf("Unexpected inspector config: %+v", m.Inspectors[0])
+	}
+
+	for _, input := range []string{
+		"inspector",
+		"inspector fraud {\n phase 5\n}",
+		"inspector fraud {\n phase\n}",
+		"inspector fraud {\n option endpoint\n}",
+		"inspector fraud {\n timeout soon\n}",
+		"inspector fraud {\n wasm /tmp/fraud.wasm\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseInspector(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseICAP(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`icap icap://av.internal/reqmod {
+		response_url icaps://dlp.internal:11344/respmod
+		timeout 2s
+		fail_closed
+	}`)
+	d.Next()
+	if err := cl.parseICAP(d, m); err != nil {
+		t.Fatalf("parseICAP failed: %v", err)
+	}
+	expected := &ICAPConfig{
+		URL:         "icap://av.internal/reqmod",
+		ResponseURL: "icaps://dlp.internal:11344/respmod",
+		Timeout:     2 * time.Second,
+		FailClosed:  true,
+	}
+	if !reflect.DeepEqual(m.ICAP, expected) {
+		t.Errorf("Unexpected icap config: %+v", m.ICAP)
+	}
+
+	for _, input := range []string{
+		"icap",
+		"icap http://av.internal/reqmod",
+		"icap {\n url icap://av.internal/reqmod\n response_url respmod\n}",
+		"icap icap://av.internal/reqmod {\n timeout soon\n}",
+		"icap icap://av.internal/reqmod {\n preview 1024\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseICAP(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseClamAV(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`clamav unix:/run/clamav/clamd.ctl {
+		min_size 1024
+		timeout 30s
+		fail_closed
+		status 422
+		response application/json "{\"error\": \"malware\", \"signature\": \"{signature}\"}"
+	}`)
+	d.Next()
+	if err := cl.parseClamAV(d, m); err != nil {
+		t.Fatalf("parseClamAV failed: %v", err)
+	}
+	expected := &ClamAVConfig{
+		Address:     "unix:/run/clamav/clamd.ctl",
+		MinSize:     1024,
+		Timeout:     30 * time.Second,
+		FailClosed:  true,
+		StatusCode:  422,
+		ContentType: "application/json",
+		Body:        `{"error": "malware", "signature": "{signature}"}`,
+	}
+	if !reflect.DeepEqual(m.ClamAV, expected) {
+		t.Errorf("Unexpected clamav config: %+v", m.ClamAV)
+	}
+
+	for _, input := range []string{
+		"clamav",
+		"clamav clamd",
+		"clamav 127.0.0.1:3310 {\n min_size -1\n}",
+		"clamav 127.0.0.1:3310 {\n status 200\n}",
+		"clamav 127.0.0.1:3310 {\n response text/plain\n}",
+		"clamav 127.0.0.1:3310 {\n max_size 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseClamAV(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRequestSigning(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`request_signing /api/payments/* /api/transfers {
+		key client-a secret-a
+		key client-b secret-b
+		signature_header X-Api-Signature
+		key_id_header X-Api-Key
+		timestamp_header X-Api-Timestamp
+		max_skew 2m
+	}`)
+	d.Next()
+	if err := cl.parseRequestSigning(d, m); err != nil {
+		t.Fatalf("parseRequestSigning failed: %v", err)
+	}
+	expected := []*RequestSigningConfig{{
+		Paths:           []string{"/api/payments/*", "/api/transfers"},
+		Keys:            map[string]string{"client-a": "secret-a", "client-b": "secret-b"},
+		SignatureHeader: "X-Api-Signature",
+		KeyIDHeader:     "X-Api-Key",
+		TimestampHeader: "X-Api-Timestamp",
+		MaxSkew:         2 * time.Minute,
+	}}
+	if !reflect.DeepEqual(m.RequestSigning, expected) {
+		t.Errorf("Unexpected request_signing config: %+v", m.RequestSigning)
+	}
+
+	for _, input := range []string{
+		"request_signing {\n key a s\n}",
+		"request_signing api {\n key a s\n}",
+		"request_signing /api/*",
+		"request_signing /api/* {\n key a\n}",
+		"request_signing /api/* {\n key a s\n max_skew soon\n}",
+		"request_signing /api/* {\n key a s\n algorithm sha1\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRequestSigning(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRPC(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`rpc {
+		max_message_size 1MiB
+		max_metadata_size 8KB
+	}`)
+	d.Next()
+	if err := cl.parseRPC(d, m); err != nil {
+		t.Fatalf("parseRPC failed: %v", err)
+	}
+	expected := &RPCConfig{MaxMessageSize: 1 << 20, MaxMetadataSize: 8000}
+	if !reflect.DeepEqual(m.RPC, expected) {
+		t.Errorf("Unexpected rpc config: %+v", m.RPC)
+	}
+
+	for _, input := range []string{
+		"rpc {\n max_message_size\n}",
+		"rpc {\n max_message_size 0\n}",
+		"rpc {\n max_metadata_size large\n}",
+		"rpc {\n max_streams 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRPC(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`graphql /graphql /api/graphql/* {
+		block_introspection
+		max_operations 5
+	}`)
+	d.Next()
+	if err := cl.parseGraphQL(d, m); err != nil {
+		t.Fatalf("parseGraphQL failed: %v", err)
+	}
+	expected := &GraphQLConfig{Paths: []string{"/graphql", "/api/graphql/*"}, BlockIntrospection: true, MaxOperations: 5}
+	if !reflect.DeepEqual(m.GraphQL, expected) {
+		t.Errorf("Unexpected graphql config: %+v", m.GraphQL)
+	}
+
+	for _, input := range []string{
+		"graphql",
+		"graphql graphql {\n block_introspection\n}",
+		"graphql {\n block_introspection on\n}",
+		"graphql {\n max_operations 0\n}",
+		"graphql {\n max_depth 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseGraphQL(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseTokenIntrospection(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`token_introspection https://auth.example.com/oauth2/introspect {
+		client_id waf
+		client_secret s3cret
+		timeout 500ms
+		cache_ttl 30s
+		cache_size 5000
+	}`)
+	d.Next()
+	if err := cl.parseTokenIntrospection(d, m); err != nil {
+		t.Fatalf("parseTokenIntrospection failed: %v", err)
+	}
+	expected := &TokenIntrospectionConfig{
+		Endpoint:     "https://auth.example.com/oauth2/introspect",
+		ClientID:     "waf",
+		ClientSecret: "s3cret",
+		Timeout:      500 * time.Millisecond,
+		CacheTTL:     30 * time.Second,
+		CacheSize:    5000,
+	}
+	if !reflect.DeepEqual(m.TokenIntrospection, expected) {
+		t.Errorf("Unexpected token_introspection config: %+v", m.TokenIntrospection)
+	}
+
+	for _, input := range []string{
+		"token_introspection",
+		"token_introspection https://a/introspect https://b/introspect",
+		"token_introspection https://auth/introspect {\n client_secret s3cret\n}",
+		"token_introspection https://auth/introspect {\n cache_ttl later\n}",
+		"token_introspection https://auth/introspect {\n cache_size 0\n}",
+		"token_introspection https://auth/introspect {\n audience api\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseTokenIntrospection(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseSignedURL(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`signed_url /downloads/* /invoices/* {
+		secret s3cret
+		signature_param sig
+		expires_param exp
+	}`)
+	d.Next()
+	if err := cl.parseSignedURL(d, m); err != nil {
+		t.Fatalf("parseSignedURL failed: %v", err)
+	}
+	expected := []*SignedURLConfig{{
+		Paths:          []string{"/downloads/*", "/invoices/*"},
+		Secret:         "s3cret",
+		SignatureParam: "sig",
+		ExpiresParam:   "exp",
+	}}
+	if !reflect.DeepEqual(m.SignedURLs, expected) {
+		t.Errorf("Unexpected signed_url config: %+v", m.SignedURLs)
+	}
+
+	for _, input := range []string{
+		"signed_url {\n secret s3cret\n}",
+		"signed_url downloads {\n secret s3cret\n}",
+		"signed_url /downloads/*",
+		"signed_url /downloads/* {\n secret\n}",
+		"signed_url /downloads/* {\n secret s3cret\n algorithm sha1\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseSignedURL(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseHotlink(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`hotlink_protection {
+		extensions jpg png mp4
+		paths /images/* /videos/*
+		allowed_referers *.partner.com news.example.org
+		empty_referer block
+		action redirect https://example.com/hotlink.html
+	}`)
+	d.Next()
+	if err := cl.parseHotlink(d, m); err != nil {
+		t.Fatalf("parseHotlink failed: %v", err)
+	}
+	expected := &HotlinkConfig{
+		Extensions:      []string{"jpg", "png", "mp4"},
+		Paths:           []string{"/images/*", "/videos/*"},
+		AllowedReferers: []string{"*.partner.com", "news.example.org"},
+		EmptyReferer:    "block",
+		Action:          "redirect",
+		RedirectURL:     "https://example.com/hotlink.html",
+	}
+	if !reflect.DeepEqual(m.Hotlink, expected) {
+		t.Errorf("Unexpected hotlink_protection config: %+v", m.Hotlink)
+	}
+
+	for _, input := range []string{
+		"hotlink_protection {\n extensions\n}",
+		"hotlink_protection {\n paths images\n}",
+		"hotlink_protection {\n allowed_referers\n}",
+		"hotlink_protection {\n empty_referer score\n}",
+		"hotlink_protection {\n action redirect\n}",
+		"hotlink_protection {\n action challenge\n}",
+		"hotlink_protection {\n status 404\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseHotlink(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseMaxBodySize(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	for _, input := range []string{
+		`max_body_size 1MiB {
+			path /api/*
+			content_types application/json application/merge-patch+json
+			response application/json "{\"error\": \"body too large\"}"
+		}`,
+		`max_body_size 100MB {
+			path /upload
+			content_types multipart/*
+		}`,
+		`max_body_size 10485760`,
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseMaxBodySize(d, m); err != nil {
+			t.Fatalf("parseMaxBodySize failed: %v", err)
+		}
+	}
+	expected := []BodySizeLimit{
+		{MaxSize: 1 << 20, Path: "/api/*", ContentTypes: []string{"application/json", "application/merge-patch+json"}, ContentType: "application/json", Body: `{"error": "body too large"}`},
+		{MaxSize: 100000000, Path: "/upload", ContentTypes: []string{"multipart/*"}},
+		{MaxSize: 10485760},
+	}
+	if !reflect.DeepEqual(m.BodySizeLimits, expected) {
+		t.Errorf("Unexpected max_body_size limits: %+v", m.BodySizeLimits)
+	}
+
+	for _, input := range []string{
+		"max_body_size",
+		"max_body_size 0",
+		"max_body_size large",
+		"max_body_size 1MB {\n path api\n}",
+		"max_body_size 1MB {\n content_types\n}",
+		"max_body_size 1MB {\n response text/plain\n}",
+		"max_body_size 1MB {\n status 400\n}",
+	} {
+		d := caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseMaxBodySize(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseUploadPolicy(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`upload_policy {
+		blocked_extensions php phtml exe
+		double_extensions
+		filename_pattern ^[A-Za-z0-9_.-]+$
+		max_files 5
+		verify_content_type
+	}`)
+	d.Next()
+	if err := cl.parseUploadPolicy(d, m); err != nil {
+		t.Fatalf("parseUploadPolicy failed: %v", err)
+	}
+	expected := &UploadPolicyConfig{
+		BlockedExtensions: []string{"php", "phtml", "exe"},
+		DoubleExtensions:  true,
+		FilenamePattern:   "^[A-Za-z0-9_.-]+$",
+		MaxFiles:          5,
+		VerifyContentType: true,
+	}
+	if !reflect.DeepEqual(m.UploadPolicy, expected) {
+		t.Errorf("Unexpected upload_policy config: %+v", m.UploadPolicy)
+	}
+
+	for _, input := range []string{
+		"upload_policy {\n blocked_extensions\n}",
+		"upload_policy {\n double_extensions yes\n}",
+		"upload_policy {\n filename_pattern [\n}",
+		"upload_policy {\n max_files 0\n}",
+		"upload_policy {\n verify_content_type no\n}",
+		"upload_policy {\n max_size 10\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseUploadPolicy(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseYARARules(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`yara_rules /etc/caddy/yara {
+		action score
+		score 4
+	}`)
+	d.Next()
+	if err := cl.parseYARARules(d, m); err != nil {
+		t.Fatalf("parseYARARules failed: %v", err)
+	}
+	expected := &YARAConfig{Dir: "/etc/caddy/yara", Action: "score", Score: 4}
+	if !reflect.DeepEqual(m.YARA, expected) {
+		t.Errorf("Unexpected yara_rules config: %+v", m.YARA)
+	}
+
+	for _, input := range []string{
+		"yara_rules",
+		"yara_rules /etc/caddy/yara {\n action drop\n}",
+		"yara_rules /etc/caddy/yara {\n score 0\n}",
+		"yara_rules /etc/caddy/yara {\n timeout 1s\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseYARARules(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseFail2banOutput(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`fail2ban_output /var/log/caddy/waf-fail2ban.log`)
+	d.Next()
+	if err := cl.parseFail2banOutput(d, m); err != nil {
+		t.Fatalf("parseFail2banOutput failed: %v", err)
+	}
+	if m.Fail2banOutput != "/var/log/caddy/waf-fail2ban.log" {
+		t.Errorf("Unexpected fail2ban output: %q", m.Fail2banOutput)
+	}
+
+	for _, input := range []string{
+		"fail2ban_output",
+		"fail2ban_output /var/log/a.log /var/log/b.log",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseFail2banOutput(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseBanExport(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`ban_export nftables /run/caddy-waf/bans.nft {
+		set waf_banned
+		table ip filter
+		reload nft -f /run/caddy-waf/bans.nft
+		interval 30s
+		min_duration 1h
+	}`)
+	d.Next()
+	if err := cl.parseBanExport(d, m); err != nil {
+		t.Fatalf("parseBanExport failed: %v", err)
+	}
+	expected := &BanExportConfig{
+		Format:      BanExportNftables,
+		File:        "/run/caddy-waf/bans.nft",
+		Set:         "waf_banned",
+		Table:       "ip filter",
+		Reload:      []string{"nft", "-f", "/run/caddy-waf/bans.nft"},
+		Interval:    30 * time.Second,
+		MinDuration: time.Hour,
+	}
+	if !reflect.DeepEqual(m.BanExport, expected) {
+		t.Errorf("Unexpected ban_export config: %+v", m.BanExport)
+	}
+
+	for _, input := range []string{
+		"ban_export nftables",
+		"ban_export iptables /run/bans",
+		"ban_export ipset /run/bans {\n table filter\n}",
+		"ban_export ipset /run/bans {\n reload\n}",
+		"ban_export ipset /run/bans {\n family inet\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseBanExport(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseStatsExport(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`stats_export https://stats.example.com/waf {
+		interval 15m
+		top 20
+		header Authorization "Bearer secret"
+		timeout 5s
+	}`)
+	d.Next()
+	if err := cl.parseStatsExport(d, m); err != nil {
+		t.Fatalf("parseStatsExport failed: %v", err)
+	}
+	expected := &StatsExportConfig{
+		Output:   "https://stats.example.com/waf",
+		Interval: 15 * time.Minute,
+		Top:      20,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		Timeout:  5 * time.Second,
+	}
+	if !reflect.DeepEqual(m.StatsExport, expected) {
+		t.Errorf("Unexpected stats_export config: %+v", m.StatsExport)
+	}
+
+	for _, input := range []string{
+		"stats_export",
+		"stats_export /var/log/a.json /var/log/b.json",
+		"stats_export /var/log/stats.json {\n interval 10s\n}",
+		"stats_export /var/log/stats.json {\n top 0\n}",
+		"stats_export /var/log/stats.json {\n header X-Token secret\n}",
+		"stats_export /var/log/stats.json {\n format csv\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseStatsExport(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseCDNOrigin(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`cdn_origin Cloudflare {
+		provider fastly cloudfront
+		ranges 10.0.0.0/8 192.0.2.1
+		refresh 12h
+		status 421
+	}`)
+	d.Next()
+	if err := cl.parseCDNOrigin(d, m); err != nil {
+		t.Fatalf("parseCDNOrigin failed: %v", err)
+	}
+	expected := &CDNOriginConfig{StatusCode: 421}
+	expected.Providers = []string{CDNCloudflare, CDNFastly, CDNCloudFront}
+	expected.Ranges = []string{"10.0.0.0/8", "192.0.2.1"}
+	expected.Refresh = 12 * time.Hour
+	if !reflect.DeepEqual(m.CDNOrigin, expected) {
+		t.Errorf("Unexpected cdn_origin config: %+v", m.CDNOrigin)
+	}
+
+	for _, input := range []string{
+		"cdn_origin",
+		"cdn_origin akamai",
+		"cdn_origin {\n ranges\n}",
+		"cdn_origin cloudflare {\n status 42\n}",
+		"cdn_origin cloudflare {\n reject_direct\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCDNOrigin(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLockdown(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`lockdown on {
+		anomaly_threshold 4
+		rate_limit 30 10s
+		challenge off
+	}`)
+	d.Next()
+	if err := cl.parseLockdown(d, m); err != nil {
+		t.Fatalf("parseLockdown failed: %v", err)
+	}
+	if !m.Lockdown.Enabled || m.Lockdown.AnomalyThreshold != 4 || m.Lockdown.RateLimit != 30 ||
+		m.Lockdown.RateWindow != 10*time.Second || !m.Lockdown.NoChallenge {
+		t.Errorf("Unexpected lockdown config: %+v", m.Lockdown)
+	}
+
+	d = caddyfile.NewTestDispenser("lockdown")
+	d.Next()
+	if err := cl.parseLockdown(d, m); err != nil {
+		t.Fatalf("parseLockdown failed: %v", err)
+	}
+	if m.Lockdown.Enabled || m.Lockdown.NoChallenge {
+		t.Errorf("Unexpected lockdown config: %+v", m.Lockdown)
+	}
+
+	for _, input := range []string{
+		"lockdown maybe",
+		"lockdown {\n anomaly_threshold 0\n}",
+		"lockdown {\n rate_limit 10 soon\n}",
+		"lockdown {\n challenge maybe\n}",
+		"lockdown {\n paranoia 4\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseLockdown(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLogDedup(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`log_dedup {
+		window 30s
+		limit 5
+		severity critical off
+		severity LOW 0
+		ipv4_prefix 16
+		ipv6_prefix 48
+	}`)
+	d.Next()
+	if err := cl.parseLogDedup(d, m); err != nil {
+		t.Fatalf("parseLogDedup failed: %v", err)
+	}
+	expected := &LogDedupConfig{
+		Window:     30 * time.Second,
+		Limit:      5,
+		Severities: map[string]int{"CRITICAL": logDedupUnlimited, "LOW": 0},
+		IPv4Prefix: 16,
+		IPv6Prefix: 48,
+	}
+	if !reflect.DeepEqual(m.LogDedup, expected) {
+		t.Errorf("Unexpected log_dedup config: %+v", m.LogDedup)
+	}
+
+	for _, input := range []string{
+		"log_dedup {\n limit 0\n}",
+		"log_dedup {\n severity URGENT 5\n}",
+		"log_dedup {\n severity HIGH\n}",
+		"log_dedup {\n severity HIGH -1\n}",
+		"log_dedup {\n ipv4_prefix 33\n}",
+		"log_dedup {\n ipv6_prefix 129\n}",
+		"log_dedup {\n per_ip true\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseLogDedup(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseTimeWindows(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`block_countries /etc/geoip/GeoLite2-Country.mmdb CN RU {
+		active_hours 18:00-09:00
+		active_days mon-fri
+	}`)
+	d.Next()
+	if err := cl.parseCountryBlockDirective(true)(d, m); err != nil {
+		t.Fatalf("parseCountryBlockDirective failed: %v", err)
+	}
+	if m.CountryBlacklist.ActiveHours != "18:00-09:00" || !reflect.DeepEqual(m.CountryBlacklist.ActiveDays, []string{"mon-fri"}) {
+		t.Errorf("Unexpected block_countries schedule: %+v", &m.CountryBlacklist)
+	}
+
+	d = caddyfile.NewTestDispenser(`rate_limit {
+		requests 10
+		window 1m
+		active_hours 00:00-06:00,22:00-24:00
+		active_days sat sun
+	}`)
+	d.Next()
+	if err := cl.parseRateLimit(d, m); err != nil {
+		t.Fatalf("parseRateLimit failed: %v", err)
+	}
+	if m.RateLimit.ActiveHours != "00:00-06:00,22:00-24:00" || !reflect.DeepEqual(m.RateLimit.ActiveDays, []string{"sat", "sun"}) {
+		t.Errorf("Unexpected rate_limit schedule: %+v", m.RateLimit)
+	}
+
+	d = caddyfile.NewTestDispenser(`timezone Europe/Rome`)
+	d.Next()
+	if err := cl.parseTimezone(d, m); err != nil {
+		t.Fatalf("parseTimezone failed: %v", err)
+	}
+	if m.Timezone != "Europe/Rome" {
+		t.Errorf("Unexpected timezone: %s", m.Timezone)
+	}
+
+	for _, input := range []string{
+		"block_countries db.mmdb CN {\n active_hours 9-17\n}",
+		"block_countries db.mmdb CN {\n active_days weekdays\n}",
+		"block_countries db.mmdb CN {\n active_days\n}",
+		"block_countries db.mmdb CN {\n active_from 09:00\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCountryBlockDirective(true)(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+	for _, input := range []string{"timezone Mars/Olympus_Mons", "timezone", "timezone UTC Local"} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseTimezone(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRuleCanary(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`rule_canary {
+		duration 30m
+		max_match_percent 0.5%
+	}`)
+	d.Next()
+	if err := cl.parseRuleCanary(d, m); err != nil {
+		t.Fatalf("parseRuleCanary failed: %v", err)
+	}
+	expected := &RuleCanaryConfig{Duration: 30 * time.Minute, MaxMatchPercent: 0.5}
+	if !reflect.DeepEqual(m.RuleCanary, expected) {
+		t.Errorf("Unexpected rule_canary config: %+v", m.RuleCanary)
+	}
+
+	for _, input := range []string{
+		"rule_canary {\n duration soon\n}",
+		"rule_canary {\n max_match_percent 0\n}",
+		"rule_canary {\n max_match_percent 150\n}",
+		"rule_canary {\n max_match_percent\n}",
+		"rule_canary {\n min_requests 100\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRuleCanary(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseFalsePositives(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`false_positives {
+		disable_rate 25%
+		min_reports 10
+	}`)
+	d.Next()
+	if err := cl.parseFalsePositives(d, m); err != nil {
+		t.Fatalf("parseFalsePositives failed: %v", err)
+	}
+	if m.FalsePositives == nil || m.FalsePositives.DisableRate != 25 || m.FalsePositives.MinReports != 10 {
+		t.Errorf("Unexpected false_positives config: %+v", m.FalsePositives)
+	}
+
+	for _, input := range []string{
+		"false_positives {\n disable_rate 0\n}",
+		"false_positives {\n disable_rate lots\n}",
+		"false_positives {\n min_reports -1\n}",
+		"false_positives {\n notify slack\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseFalsePositives(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLearning(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`learning {
+		duration 72h
+		output /var/lib/caddy/learned.caddyfile
+		max_paths 500
+		max_params 20
+	}`)
+	d.Next()
+	if err := cl.parseLearning(d, m); err != nil {
+		t.Fatalf("parseLearning failed: %v", err)
+	}
+	expected := &LearningConfig{Duration: 72 * time.Hour, Output: "/var/lib/caddy/learned.caddyfile", MaxPaths: 500, MaxParams: 20}
+	if !reflect.DeepEqual(m.Learning, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.Learning)
+	}
+
+	for _, input := range []string{
+		"learning {\n duration soon\n}",
+		"learning {\n output\n}",
+		"learning {\n max_paths 0\n}",
+		"learning {\n enforce\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseLearning(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseParamAnomaly(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`param_anomaly {
+		min_samples 500
+		deviation 3.5
+		score 4
+		max_params 2000
+	}`)
+	d.Next()
+	if err := cl.parseParamAnomaly(d, m); err != nil {
+		t.Fatalf("parseParamAnomaly failed: %v", err)
+	}
+	expected := &ParamAnomalyConfig{MinSamples: 500, Deviation: 3.5, Score: 4, MaxParams: 2000}
+	if !reflect.DeepEqual(m.ParamAnomaly, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.ParamAnomaly)
+	}
+
+	d = caddyfile.NewTestDispenser(`param_anomaly`)
+	d.Next()
+	if err := cl.parseParamAnomaly(d, m); err != nil || m.ParamAnomaly == nil {
+		t.Errorf("Expected param_anomaly without a block to be enabled, got %v", err)
+	}
+
+	for _, input := range []string{
+		"param_anomaly {\n deviation -1\n}",
+		"param_anomaly {\n min_samples many\n}",
+		"param_anomaly {\n score 0\n}",
+		"param_anomaly {\n action block\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseParamAnomaly(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseDecodeLayers(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`decode_layers {
+		depth 4
+		decoders url base64
+		max_bytes 8192
+	}`)
+	d.Next()
+	if err := cl.parseDecodeLayers(d, m); err != nil {
+		t.Fatalf("parseDecodeLayers failed: %v", err)
+	}
+	expected := &DecodeLayersConfig{Depth: 4, Decoders: []string{"url", "base64"}, MaxBytes: 8192}
+	if !reflect.DeepEqual(m.DecodeLayers, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.DecodeLayers)
+	}
+
+	for _, input := range []string{
+		"decode_layers {\n depth 0\n}",
+		"decode_layers {\n decoders rot13\n}",
+		"decode_layers {\n decoders\n}",
+		"decode_layers {\n html\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseDecodeLayers(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseDeserialization(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`deserialization {
+		formats java dotnet
+		action score
+		score 8
+	}`)
+	d.Next()
+	if err := cl.parseDeserialization(d, m); err != nil {
+		t.Fatalf("parseDeserialization failed: %v", err)
+	}
+	expected := &DeserializationConfig{Formats: []string{"java", "dotnet"}, Action: "score", Score: 8}
+	if !reflect.DeepEqual(m.Deserialization, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.Deserialization)
+	}
+
+	for _, input := range []string{
+		"deserialization {\n formats ruby\n}",
+		"deserialization {\n formats\n}",
+		"deserialization {\n action drop\n}",
+		"deserialization {\n score 0\n}",
+		"deserialization {\n python\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseDeserialization(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseXXE(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`xxe {
+		constructs external_entity expansion
+		max_expansion 4096
+		action score
+		score 7
+	}`)
+	d.Next()
+	if err := cl.parseXXE(d, m); err != nil {
+		t.Fatalf("parseXXE failed: %v", err)
+	}
+	expected := &XXEConfig{Constructs: []string{"external_entity", "expansion"}, MaxExpansion: 4096, Action: "score", Score: 7}
+	if !reflect.DeepEqual(m.XXE, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.XXE)
+	}
+
+	for _, input := range []string{
+		"xxe {\n constructs xinclude\n}",
+		"xxe {\n constructs\n}",
+		"xxe {\n max_expansion 0\n}",
+		"xxe {\n action drop\n}",
+		"xxe {\n score -1\n}",
+		"xxe {\n dtd\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseXXE(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseSSRF(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`ssrf {
+		action score
+		score 6
+	}`)
+	d.Next()
+	if err := cl.parseSSRF(d, m); err != nil {
+		t.Fatalf("parseSSRF failed: %v", err)
+	}
+	expected := &SSRFConfig{Action: "score", Score: 6}
+	if !reflect.DeepEqual(m.SSRF, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.SSRF)
+	}
+
+	d = caddyfile.NewTestDispenser("ssrf")
+	d.Next()
+	if err := cl.parseSSRF(d, m); err != nil || !reflect.DeepEqual(m.SSRF, &SSRFConfig{}) {
+		t.Errorf("Expected an empty config, got %+v, %v", m.SSRF, err)
+	}
+
+	for _, input := range []string{
+		"ssrf {\n action drop\n}",
+		"ssrf {\n action\n}",
+		"ssrf {\n score -1\n}",
+		"ssrf {\n schemes gopher\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseSSRF(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseRequestDecompress(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`request_decompress {
+		limit 1048576
+		max_ratio 50
+		on_unsupported Allow
+	}`)
+	d.Next()
+	if err := cl.parseRequestDecompress(d, m); err != nil {
+		t.Fatalf("parseRequestDecompress failed: %v", err)
+	}
+	expected := &RequestDecompressConfig{Limit: 1048576, MaxRatio: 50, OnUnsupported: requestEncodingAllow}
+	if !reflect.DeepEqual(m.RequestDecompress, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.RequestDecompress)
+	}
+
+	d = caddyfile.NewTestDispenser("request_decompress {\n reject\n}")
+	d.Next()
+	if err := cl.parseRequestDecompress(d, m); err != nil || !reflect.DeepEqual(m.RequestDecompress, &RequestDecompressConfig{Reject: true}) {
+		t.Errorf("Expected a rejecting config, got %+v, %v", m.RequestDecompress, err)
+	}
+
+	for _, input := range []string{
+		"request_decompress {\n limit 0\n}",
+		"request_decompress {\n max_ratio\n}",
+		"request_decompress {\n reject yes\n}",
+		"request_decompress {\n encodings br\n}",
+		"request_decompress {\n on_unsupported\n}",
+		"request_decompress {\n on_unsupported inspect\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseRequestDecompress(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseOpenRedirect(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`open_redirect {
+		allowed_hosts example.com *.example.com
+		allowed_hosts accounts.google.com
+		params next return_to
+		action score
+		score 6
+	}`)
+	d.Next()
+	if err := cl.parseOpenRedirect(d, m); err != nil {
+		t.Fatalf("parseOpenRedirect failed: %v", err)
+	}
+	expected := &OpenRedirectConfig{
+		AllowedHosts: []string{"example.com", "*.example.com", "accounts.google.com"},
+		Params:       []string{"next", "return_to"},
+		Action:       "score",
+		Score:        6,
+	}
+	if !reflect.DeepEqual(m.OpenRedirect, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.OpenRedirect)
+	}
+
+	for _, input := range []string{
+		"open_redirect {\n allowed_hosts\n}",
+		"open_redirect {\n params\n}",
+		"open_redirect {\n action drop\n}",
+		"open_redirect {\n score 0\n}",
+		"open_redirect {\n hosts example.com\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseOpenRedirect(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseSmuggling(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`request_smuggling {
+		conflicting_length block
+		obfuscated_te score 8
+		get_with_body score
+		duplicate_length off
+	}`)
+	d.Next()
+	if err := cl.parseSmuggling(d, m); err != nil {
+		t.Fatalf("parseSmuggling failed: %v", err)
+	}
+	expected := &SmugglingConfig{Checks: map[string]*SmugglingCheck{
+		"conflicting_length": {Action: "block"},
+		"obfuscated_te":      {Action: "score", Score: 8},
+		"get_with_body":      {Action: "score"},
+		"duplicate_length":   {Action: "off"},
+	}}
+	if !reflect.DeepEqual(m.Smuggling, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.Smuggling)
+	}
+
+	d = caddyfile.NewTestDispenser("request_smuggling")
+	d.Next()
+	if err := cl.parseSmuggling(d, m); err != nil || !reflect.DeepEqual(m.Smuggling, &SmugglingConfig{}) {
+		t.Errorf("Expected an empty config, got %+v, %v", m.Smuggling, err)
+	}
+
+	for _, input := range []string{
+		"request_smuggling {\n chunked_body block\n}",
+		"request_smuggling {\n obfuscated_te\n}",
+		"request_smuggling {\n obfuscated_te drop\n}",
+		"request_smuggling {\n obfuscated_te score 0\n}",
+		"request_smuggling {\n obfuscated_te block 5\n}",
+		"request_smuggling {\n obfuscated_te score 5 6\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseSmuggling(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseCRLF(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`crlf_injection {
+		locations path headers
+		action score
+		score 7
+	}`)
+	d.Next()
+	if err := cl.parseCRLF(d, m); err != nil {
+		t.Fatalf("parseCRLF failed: %v", err)
+	}
+	expected := &CRLFConfig{Locations: []string{"path", "headers"}, Action: "score", Score: 7}
+	if !reflect.DeepEqual(m.CRLF, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.CRLF)
+	}
+
+	for _, input := range []string{
+		"crlf_injection {\n locations body\n}",
+		"crlf_injection {\n locations\n}",
+		"crlf_injection {\n action drop\n}",
+		"crlf_injection {\n score 0\n}",
+		"crlf_injection {\n depth 2\n}",
+	} {
+		d = caddyfile.NewTestDispenser(input)
+		d.Next()
+		if err := cl.parseCRLF(d, &Middleware{}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const costLimitRuleID = "cost_limit_rule"
+
+// CostLimitConfig rate-limits clients by the accumulated cost of their requests rather
+// than their number, so that a few requests to an expensive search or report endpoint
+// weigh as much as many cheap ones.
+type CostLimitConfig struct {
+	Budget      int64          `json:"budget"`                 // Cost a client may spend per Window
+	Window      time.Duration  `json:"window"`                 // Length of the budget window
+	DefaultCost int64          `json:"default_cost,omitempty"` // Cost of requests matching no path, default 1
+	Costs       []EndpointCost `json:"costs,omitempty"`        // Costs of path patterns, the first match wins
+
+	mu        sync.Mutex
+	clients   map[string]*costWindow
+	lastPrune time.Time
+}
+
+// EndpointCost is the cost of the requests whose path matches a regular expression.
+type EndpointCost struct {
+	Path string `json:"path"`
+	Cost int64  `json:"cost"` // Zero makes the path free
+
+	regex *regexp.Regexp
+}
+
+// costWindow is the cost a client spent within a fixed window.
+type costWindow struct {
+	start time.Time
+	spent int64
+}
+
+// provision validates the config and compiles the path patterns.
+func (c *CostLimitConfig) provision() error {
+	if c.Budget <= 0 || c.Window <= 0 {
+		return fmt.Errorf("cost_limit budget and window must be positive values")
+	}
+	if c.DefaultCost <= 0 {
+		c.DefaultCost = 1
+	}
+	for i := range c.Costs {
+		if c.Costs[i].Cost < 0 {
+			return fmt.Errorf("cost_limit cost of %s must not be negative", c.Costs[i].Path)
+		}
+		regex, err := regexp.Compile(c.Costs[i].Path)
+		if err != nil {
+			return fmt.Errorf("failed to compile cost_limit path %s: %w", c.Costs[i].Path, err)
+		}
+		c.Costs[i].regex = regex
+	}
+	c.clients = make(map[string]*costWindow)
+	return nil
+}
+
+// cost returns the cost of a request to path.
+func (c *CostLimitConfig) cost(path string) int64 {
+	for _, endpoint := range c.Costs {
+		if endpoint.regex.MatchString(path) {
+			return endpoint.Cost
+		}
+	}
+	return c.DefaultCost
+}
+
+// spend charges cost to key unless it would exceed the budget of the current window. It
+// reports whether the cost was charged, and when the window of key ends.
+func (c *CostLimitConfig) spend(key string, cost int64, now time.Time) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now)
+
+	cw, ok := c.clients[key]
+	if !ok || now.Sub(cw.start) >= c.Window {
+		cw = &costWindow{start: now}
+		c.clients[key] = cw
+	}
+	reset := cw.start.Add(c.Window)
+	if cw.spent+cost > c.Budget {
+		return reset, false
+	}
+	cw.spent += cost
+	return reset, true
+}
+
+// pruneLocked drops expired windows. The caller must hold c.mu.
+func (c *CostLimitConfig) pruneLocked(now time.Time) {
+	if now.Sub(c.lastPrune) < strikePruneEvery {
+		return
+	}
+	c.lastPrune = now
+	for key, cw := range c.clients {
+		if now.Sub(cw.start) >= c.Window {
+			delete(c.clients, key)
+		}
+	}
+}
+
+// checkCostLimit charges the cost of the request to its client, blocking it with 429 once
+// the budget of the window is spent. It reports whether the request was blocked.
+func (m *Middleware) checkCostLimit(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.CostLimit
+	if config == nil || config.clients == nil {
+		return false
+	}
+	cost := config.cost(r.URL.Path)
+	if cost == 0 {
+		return false
+	}
+	now := time.Now()
+	reset, ok := config.spend(m.scopedKey(r, extractIP(r.RemoteAddr)), cost, now)
+	if ok {
+		return false
+	}
+
+	m.costLimitHits.Add(1)
+	m.incrementRuleHitCount(RuleID(costLimitRuleID))
+	state.MatchedRules = append(state.MatchedRules, costLimitRuleID)
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(reset.Sub(now).Seconds()+1), 10))
+	m.blockRequest(w, r, state, http.StatusTooManyRequests, "cost_limit", costLimitRuleID,
+		zap.String("message", "Request blocked by cost budget"),
+		zap.Int64("cost", cost),
+		zap.Int64("budget", config.Budget),
+	)
+	return true
+}
@@ -0,0 +1,70 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCostLimitConfig_Cost(t *testing.T) {
+	c := &CostLimitConfig{Budget: 10, Window: time.Minute, Costs: []EndpointCost{
+		{Path: "^/search", Cost: 5},
+		{Path: "^/healthz$", Cost: 0},
+		{Path: "^/s", Cost: 2},
+	}}
+	require.NoError(t, c.provision())
+	assert.Equal(t, int64(5), c.cost("/search/items"), "the first match wins")
+	assert.Equal(t, int64(2), c.cost("/status"))
+	assert.Equal(t, int64(0), c.cost("/healthz"))
+	assert.Equal(t, int64(1), c.cost("/"), "default cost")
+}
+
+func TestCostLimitConfig_Spend(t *testing.T) {
+	c := &CostLimitConfig{Budget: 10, Window: time.Minute}
+	require.NoError(t, c.provision())
+	now := time.Now()
+
+	_, ok := c.spend("a", 6, now)
+	assert.True(t, ok)
+	reset, ok := c.spend("a", 6, now.Add(time.Second))
+	assert.False(t, ok, "over the budget")
+	assert.Equal(t, now.Add(time.Minute), reset)
+	_, ok = c.spend("a", 4, now.Add(time.Second))
+	assert.True(t, ok, "rejected requests are not charged")
+	_, ok = c.spend("b", 10, now)
+	assert.True(t, ok, "clients have separate budgets")
+	_, ok = c.spend("a", 6, now.Add(time.Minute))
+	assert.True(t, ok, "a new window")
+}
+
+func TestCheckCostLimit(t *testing.T) {
+	config := &CostLimitConfig{Budget: 10, Window: time.Minute, Costs: []EndpointCost{{Path: "^/report", Cost: 4}}}
+	require.NoError(t, config.provision())
+	m := &Middleware{logger: zap.NewNop(), CostLimit: config}
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		m.checkCostLimit(w, req, &WAFState{})
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("/report").Code)
+	assert.Equal(t, http.StatusOK, send("/report").Code)
+	w := send("/report")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "12 is over the budget of 10")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("/home").Code, "cheap requests fit in what is left")
+	assert.Equal(t, int64(1), m.costLimitHits.Load())
+}
+
+func TestCostLimitConfig_ProvisionErrors(t *testing.T) {
+	assert.Error(t, (&CostLimitConfig{Window: time.Minute}).provision())
+	assert.Error(t, (&CostLimitConfig{Budget: 10, Window: time.Minute, Costs: []EndpointCost{{Path: "(", Cost: 1}}}).provision())
+	assert.Error(t, (&CostLimitConfig{Budget: 10, Window: time.Minute, Costs: []EndpointCost{{Path: "/", Cost: -1}}}).provision())
+}
@@ -0,0 +1,209 @@
+package caddywaf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	credentialStuffingRuleID  = "credential_stuffing_rule"
+	credentialActionChallenge = "challenge"
+	credentialActionBan       = "ban"
+
+	defaultCredentialWindow       = 10 * time.Minute
+	defaultCredentialMaxUsernames = 10
+	defaultCredentialMinAttempts  = 10
+	defaultCredentialFailureRatio = 0.8
+)
+
+// CredentialStuffingConfig detects clients trying many usernames, or failing most of their
+// logins, on a login endpoint. Such clients rotate credentials rather than IPs, so they stay
+// below rate limits.
+type CredentialStuffingConfig struct {
+	Path          string        `json:"path"`                     // Login path, exact or a prefix ending in *
+	Methods       []string      `json:"methods,omitempty"`        // Methods of login attempts, default POST
+	UsernameField string        `json:"username_field"`           // Query, form or JSON body field holding the username
+	Window        time.Duration `json:"window,omitempty"`         // Default 10m
+	MaxUsernames  int           `json:"max_usernames,omitempty"`  // Distinct usernames per client within Window, default 10
+	FailureRatio  float64       `json:"failure_ratio,omitempty"`  // Share of failed logins within Window, default 0.8
+	MinAttempts   int           `json:"min_attempts,omitempty"`   // Completed logins before FailureRatio applies, default 10
+	FailureStatus []int         `json:"failure_status,omitempty"` // Response statuses of failed logins, default 401 and 403
+	Action        string        `json:"action,omitempty"`         // block (default), score, challenge or ban
+	Score         int           `json:"score,omitempty"`          // Score added per attempt with the score action, default 5
+
+	mu        sync.Mutex
+	clients   map[string]*loginWindow
+	lastPrune time.Time
+}
+
+// loginWindow holds the login attempts of a client within a fixed window.
+type loginWindow struct {
+	start     time.Time
+	usernames map[uint64]struct{} // Hashes of the usernames, at most MaxUsernames+1
+	outcomes  int
+	failures  int
+}
+
+// provision validates the config and applies the defaults.
+func (c *CredentialStuffingConfig) provision() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("credential_stuffing path must start with /: %s", c.Path)
+	}
+	if c.UsernameField == "" {
+		return fmt.Errorf("credential_stuffing %s: username field must not be empty", c.Path)
+	}
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore, credentialActionChallenge, credentialActionBan:
+	default:
+		return fmt.Errorf("invalid credential_stuffing action: %s, must be block, score, challenge or ban", c.Action)
+	}
+	if c.FailureRatio < 0 || c.FailureRatio > 1 {
+		return fmt.Errorf("invalid credential_stuffing failure ratio %g, must be between 0 and 1", c.FailureRatio)
+	}
+	if c.FailureRatio == 0 {
+		c.FailureRatio = defaultCredentialFailureRatio
+	}
+	if c.Window <= 0 {
+		c.Window = defaultCredentialWindow
+	}
+	if c.MaxUsernames <= 0 {
+		c.MaxUsernames = defaultCredentialMaxUsernames
+	}
+	if c.MinAttempts <= 0 {
+		c.MinAttempts = defaultCredentialMinAttempts
+	}
+	if len(c.FailureStatus) == 0 {
+		c.FailureStatus = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{http.MethodPost}
+	}
+	for i := range c.Methods {
+		c.Methods[i] = strings.ToUpper(c.Methods[i])
+	}
+	c.clients = make(map[string]*loginWindow)
+	return nil
+}
+
+// matches reports whether a request is a login attempt.
+func (c *CredentialStuffingConfig) matches(r *http.Request) bool {
+	if !slices.Contains(c.Methods, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(c.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == c.Path
+}
+
+// attempt counts a login attempt of key with username, and returns why the client is
+// considered to be stuffing credentials, or an empty string.
+func (c *CredentialStuffingConfig) attempt(key, username string, now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now)
+
+	lw, ok := c.clients[key]
+	if !ok || now.Sub(lw.start) >= c.Window {
+		lw = &loginWindow{start: now, usernames: make(map[uint64]struct{})}
+		c.clients[key] = lw
+	}
+	if username = strings.ToLower(strings.TrimSpace(username)); username != "" && len(lw.usernames) <= c.MaxUsernames {
+		h := fnv.New64a()
+		h.Write([]byte(username))
+		lw.usernames[h.Sum64()] = struct{}{}
+	}
+
+	if len(lw.usernames) > c.MaxUsernames {
+		return fmt.Sprintf("more than %d usernames within %s", c.MaxUsernames, c.Window)
+	}
+	if lw.outcomes >= c.MinAttempts && float64(lw.failures) >= c.FailureRatio*float64(lw.outcomes) {
+		return fmt.Sprintf("%d of %d logins failed within %s", lw.failures, lw.outcomes, c.Window)
+	}
+	return ""
+}
+
+// outcome counts the result of a login attempt of key.
+func (c *CredentialStuffingConfig) outcome(key string, statusCode int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lw, ok := c.clients[key]
+	if !ok || now.Sub(lw.start) >= c.Window {
+		return
+	}
+	lw.outcomes++
+	if slices.Contains(c.FailureStatus, statusCode) {
+		lw.failures++
+	}
+}
+
+// pruneLocked drops stale windows. The caller must hold c.mu.
+func (c *CredentialStuffingConfig) pruneLocked(now time.Time) {
+	if now.Sub(c.lastPrune) < strikePruneEvery {
+		return
+	}
+	c.lastPrune = now
+	for key, lw := range c.clients {
+		if now.Sub(lw.start) >= c.Window {
+			delete(c.clients, key)
+		}
+	}
+}
+
+// credentialStuffingFor returns the first credential stuffing config matching the request, or nil.
+func (m *Middleware) credentialStuffingFor(r *http.Request) *CredentialStuffingConfig {
+	for _, config := range m.CredentialStuffing {
+		if config.matches(r) {
+			return config
+		}
+	}
+	return nil
+}
+
+// checkCredentialStuffing counts a login attempt and acts on clients stuffing credentials.
+// It reports whether the request was blocked or challenged.
+func (m *Middleware) checkCredentialStuffing(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.credentialStuffingFor(r)
+	if config == nil {
+		return false
+	}
+	params, _ := m.requestParams(r, state)
+	key := m.scopedKey(r, extractIP(r.RemoteAddr))
+	reason := config.attempt(key, params.Get(config.UsernameField), time.Now())
+	if reason == "" {
+		return false
+	}
+
+	m.stuffingHits.Add(1)
+	m.incrementRuleHitCount(RuleID(credentialStuffingRuleID))
+	state.MatchedRules = append(state.MatchedRules, credentialStuffingRuleID)
+	switch config.Action {
+	case credentialActionChallenge:
+		return m.challenge(w, r, state, reason, credentialStuffingRuleID)
+	case credentialActionBan:
+		m.banClient(key, "credential stuffing: "+reason, 0)
+	}
+	return m.applyDetection(w, r, state, config.Action, config.Score, http.StatusForbidden, "credential_stuffing", credentialStuffingRuleID,
+		"Credential stuffing detected", zap.String("key", key), zap.String("detection", reason))
+}
+
+// recordLoginOutcome counts the response status of a login attempt.
+func (m *Middleware) recordLoginOutcome(r *http.Request, statusCode int) {
+	config := m.credentialStuffingFor(r)
+	if config == nil {
+		return
+	}
+	config.outcome(m.scopedKey(r, extractIP(r.RemoteAddr)), statusCode, time.Now())
+}
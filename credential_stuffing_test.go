@@ -0,0 +1,118 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func loginRequest(username string) *http.Request {
+	req := testRequest(http.MethodPost, "/login", "application/x-www-form-urlencoded", "user="+username+"&password=x")
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
+func TestCredentialStuffing_DistinctUsernames(t *testing.T) {
+	c := &CredentialStuffingConfig{Path: "/login", UsernameField: "user", MaxUsernames: 3}
+	require.NoError(t, c.provision())
+	now := time.Now()
+	for _, username := range []string{"alice", "bob", "Alice ", "carol"} {
+		assert.Empty(t, c.attempt("192.0.2.1", username, now))
+	}
+	assert.NotEmpty(t, c.attempt("192.0.2.1", "dave", now))
+	assert.Empty(t, c.attempt("192.0.2.2", "dave", now), "clients are tracked separately")
+	assert.Empty(t, c.attempt("192.0.2.1", "erin", now.Add(c.Window)), "a new window starts over")
+	assert.LessOrEqual(t, len(c.clients["192.0.2.1"].usernames), c.MaxUsernames+1)
+}
+
+func TestCredentialStuffing_FailureRatio(t *testing.T) {
+	c := &CredentialStuffingConfig{Path: "/login", UsernameField: "user", MinAttempts: 4, FailureRatio: 0.75}
+	require.NoError(t, c.provision())
+	now := time.Now()
+	for _, status := range []int{http.StatusUnauthorized, http.StatusOK, http.StatusUnauthorized} {
+		assert.Empty(t, c.attempt("192.0.2.1", "alice", now))
+		c.outcome("192.0.2.1", status, now)
+	}
+	assert.Empty(t, c.attempt("192.0.2.1", "alice", now), "fewer than min_attempts outcomes")
+	c.outcome("192.0.2.1", http.StatusForbidden, now)
+	assert.NotEmpty(t, c.attempt("192.0.2.1", "alice", now), "3 of 4 logins failed")
+
+	c.outcome("192.0.2.9", http.StatusUnauthorized, now) // Outcomes without an attempt are ignored
+	assert.NotContains(t, c.clients, "192.0.2.9")
+}
+
+func TestCheckCredentialStuffing_Actions(t *testing.T) {
+	tests := []struct {
+		action  string
+		blocked bool
+		score   int
+	}{
+		{detectionActionBlock, true, 0},
+		{detectionActionScore, false, 4},
+		{credentialActionChallenge, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			c := &CredentialStuffingConfig{Path: "/login", UsernameField: "user", MaxUsernames: 1, Action: tt.action, Score: 4}
+			require.NoError(t, c.provision())
+			m := &Middleware{
+				logger:                zap.NewNop(),
+				AnomalyThreshold:      10,
+				CredentialStuffing:    []*CredentialStuffingConfig{c},
+				requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+			}
+			if tt.action == credentialActionChallenge {
+				m.Challenge = &ChallengeConfig{}
+				require.NoError(t, m.Challenge.provision())
+			}
+			assert.False(t, m.checkCredentialStuffing(httptest.NewRecorder(), loginRequest("alice"), &WAFState{}))
+
+			w := httptest.NewRecorder()
+			state := &WAFState{}
+			assert.Equal(t, tt.blocked, m.checkCredentialStuffing(w, loginRequest("bob"), state))
+			assert.Equal(t, tt.blocked, state.Blocked)
+			assert.Equal(t, tt.score, state.TotalScore)
+			assert.Equal(t, []string{credentialStuffingRuleID}, state.MatchedRules)
+			assert.Equal(t, int64(1), m.stuffingHits.Load())
+		})
+	}
+}
+
+func TestCheckCredentialStuffing_Ban(t *testing.T) {
+	c := &CredentialStuffingConfig{Path: "/login", UsernameField: "user", MaxUsernames: 2, Action: credentialActionBan}
+	require.NoError(t, c.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		AnomalyThreshold:      10,
+		CredentialStuffing:    []*CredentialStuffingConfig{c},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.banList = NewBanList(BanConfig{})
+	for i := 0; i < 3; i++ {
+		m.checkCredentialStuffing(httptest.NewRecorder(), loginRequest(fmt.Sprintf("user%d", i)), &WAFState{})
+	}
+	assert.True(t, m.isBanned(loginRequest("alice")))
+}
+
+func TestRecordLoginOutcome(t *testing.T) {
+	c := &CredentialStuffingConfig{Path: "/login", UsernameField: "user", MinAttempts: 2}
+	require.NoError(t, c.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		AnomalyThreshold:      10,
+		CredentialStuffing:    []*CredentialStuffingConfig{c},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	for i := 0; i < 2; i++ {
+		assert.False(t, m.checkCredentialStuffing(httptest.NewRecorder(), loginRequest("alice"), &WAFState{}))
+		m.recordLoginOutcome(loginRequest("alice"), http.StatusUnauthorized)
+	}
+	m.recordLoginOutcome(httptest.NewRequest(http.MethodGet, "/login", nil), http.StatusUnauthorized) // Not a login attempt
+	assert.True(t, m.checkCredentialStuffing(httptest.NewRecorder(), loginRequest("alice"), &WAFState{}))
+}
@@ -0,0 +1,163 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	crlfRuleID      = "crlf_rule"
+	crlfDecodeDepth = 3 // Layers of percent-encoding unwrapped
+)
+
+// Locations inspected by the crlf_injection directive
+const (
+	CRLFPath    = "path"
+	CRLFQuery   = "query"
+	CRLFHeaders = "headers"
+)
+
+var (
+	crlfLocations = []string{CRLFPath, CRLFQuery, CRLFHeaders}
+
+	// injectedLineRegex matches a line break, normalized to LF, starting an injected header
+	// line or ending the headers, telling injections apart from the breaks of multi-line text.
+	injectedLineRegex = regexp.MustCompile(`\n[\t ]*(?:\n|[!#$%&'*+.^_` + "`" + `|~0-9A-Za-z-]+[\t ]*:)`)
+	lineBreaks        = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+	// truncatedLineBreaks replaces the characters whose low byte is CR or LF, which servers
+	// truncating characters to a byte turn into line breaks, such as 嘍嘊.
+	truncatedLineBreaks = strings.NewReplacer("嘍", "\r", "嘊", "\n")
+)
+
+// CRLFConfig detects line breaks and null bytes injected in the path, query values and
+// header values of requests, raw or percent-encoded, as used to split responses and
+// inject headers.
+type CRLFConfig struct {
+	Locations []string `json:"locations,omitempty"` // Locations inspected, default all
+	Action    string   `json:"action,omitempty"`    // block (default) or score
+	Score     int      `json:"score,omitempty"`     // Score per location flagged, default 5
+}
+
+// provision validates the config and applies the defaults.
+func (c *CRLFConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid crlf_injection action: %s, must be block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	for _, location := range c.Locations {
+		if !slices.Contains(crlfLocations, location) {
+			return fmt.Errorf("unknown crlf_injection location: %s", location)
+		}
+	}
+	return nil
+}
+
+// inspects reports whether a location is inspected.
+func (c *CRLFConfig) inspects(location string) bool {
+	return len(c.Locations) == 0 || slices.Contains(c.Locations, location)
+}
+
+// crlfDecoded returns a raw value followed by its percent-decoded layers, with the
+// characters truncated to line breaks replaced.
+func crlfDecoded(value string) []string {
+	values := []string{truncatedLineBreaks.Replace(value)}
+	for i := 0; i < crlfDecodeDepth; i++ {
+		decoded := decodeUnicodeEscapes(decodePercent(value))
+		if decoded == value {
+			break
+		}
+		values = append(values, truncatedLineBreaks.Replace(decoded))
+		value = decoded
+	}
+	return values
+}
+
+// hasLineBreak reports whether a value, raw or decoded, holds a CR, LF or null byte.
+func hasLineBreak(value string) bool {
+	for _, decoded := range crlfDecoded(value) {
+		if strings.ContainsAny(decoded, "\r\n\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInjectedLine reports whether a value, raw or decoded, holds a null byte or a line
+// break followed by a header line or another line break. Plain line breaks, as in text
+// submitted from a textarea, pass.
+func hasInjectedLine(value string) bool {
+	for _, decoded := range crlfDecoded(value) {
+		if strings.Contains(decoded, "\x00") || injectedLineRegex.MatchString(lineBreaks.Replace(decoded)) {
+			return true
+		}
+	}
+	return false
+}
+
+// crlfFindings returns the locations of a request holding injected line breaks or null
+// bytes: any in the path, and those starting a header line in query and header values.
+func (c *CRLFConfig) crlfFindings(r *http.Request) []string {
+	var findings []string
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+	rawPath, rawQuery, _ := strings.Cut(requestURI, "?")
+	if c.inspects(CRLFPath) && hasLineBreak(rawPath) {
+		findings = append(findings, CRLFPath)
+	}
+	if c.inspects(CRLFQuery) && rawQuery != "" {
+		for _, pair := range strings.Split(rawQuery, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			if hasInjectedLine(strings.ReplaceAll(value, "+", " ")) {
+				findings = append(findings, "ARGS:"+decodePercent(name))
+				break
+			}
+		}
+	}
+	if c.inspects(CRLFHeaders) {
+		for name, values := range r.Header {
+			for _, value := range values {
+				if hasInjectedLine(value) {
+					findings = append(findings, "HEADERS:"+name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(findings)
+	return findings
+}
+
+// checkCRLF detects line breaks and null bytes injected in the request in phase 1,
+// blocking it or adding score per location flagged. It reports whether the request was
+// blocked.
+func (m *Middleware) checkCRLF(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.CRLF
+	if config == nil {
+		return false
+	}
+	findings := config.crlfFindings(r)
+	if len(findings) == 0 {
+		return false
+	}
+
+	m.crlfHits.Add(1)
+	m.incrementRuleHitCount(RuleID(crlfRuleID))
+	state.MatchedRules = append(state.MatchedRules, crlfRuleID)
+	return m.applyDetection(w, r, state, config.Action, config.Score*len(findings), http.StatusForbidden, "crlf_injection", crlfRuleID,
+		"CRLF injection detected", zap.Strings("locations", findings))
+}
@@ -0,0 +1,75 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestHasLineBreak(t *testing.T) {
+	for _, value := range []string{"/a%0d%0aSet-Cookie:x", "/a%0Ab", "/file.php%00.jpg", "/a%250d%250a", "/a%u000d", "/a%E5%98%8A", "/a\nb"} {
+		assert.True(t, hasLineBreak(value), value)
+	}
+	for _, value := range []string{"/a/b", "/100%25", "/a%20b", "/%zz"} {
+		assert.False(t, hasLineBreak(value), value)
+	}
+}
+
+func TestHasInjectedLine(t *testing.T) {
+	for _, value := range []string{
+		"x%0d%0aSet-Cookie:%20session=evil",
+		"x%0aLocation: https://evil.com",
+		"x%0d%0a%0d%0a<script>alert(1)</script>",
+		"x%250d%250aX-Injected:1",
+		"x%E5%98%8D%E5%98%8ASet-Cookie:a=b",
+		"x%00",
+	} {
+		assert.True(t, hasInjectedLine(value), value)
+	}
+	for _, value := range []string{"line one%0d%0aline two", "a%0Ab", "Mozilla/5.0 (X11; Linux x86_64)", "time: 10:30"} {
+		assert.False(t, hasInjectedLine(value), value)
+	}
+}
+
+func TestCRLFConfig_Provision(t *testing.T) {
+	config := &CRLFConfig{}
+	require.NoError(t, config.provision())
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+
+	assert.Error(t, (&CRLFConfig{Action: "drop"}).provision())
+	assert.Error(t, (&CRLFConfig{Locations: []string{"body"}}).provision())
+}
+
+func TestCheckCRLF(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	r := httptest.NewRequest("GET", "/redirect%0d%0aX:1?next=/%0d%0aSet-Cookie:a=b&comment=hi%0d%0athere", nil)
+	r.Header.Set("X-Forwarded-Host", "example.com%0d%0aX-Injected: 1")
+	assert.False(t, m.checkCRLF(httptest.NewRecorder(), r, &WAFState{}))
+
+	m.CRLF = &CRLFConfig{Action: detectionActionScore, Score: 3}
+	require.NoError(t, m.CRLF.provision())
+	state := &WAFState{}
+	assert.False(t, m.checkCRLF(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 9, state.TotalScore, "path, next and X-Forwarded-Host")
+	assert.Equal(t, []string{crlfRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.crlfHits.Load())
+	assert.Equal(t, []string{"ARGS:next", "HEADERS:X-Forwarded-Host", CRLFPath}, m.CRLF.crlfFindings(r))
+
+	m.CRLF = &CRLFConfig{Locations: []string{CRLFQuery}}
+	require.NoError(t, m.CRLF.provision())
+	assert.False(t, m.checkCRLF(httptest.NewRecorder(), httptest.NewRequest("GET", "/?comment=hi%0d%0athere", nil), &WAFState{}))
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkCRLF(w, r, &WAFState{}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,229 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDecodeDepth    = 3
+	defaultDecodeMaxBytes = 64 << 10
+	minDecodedPrintable   = 0.9 // Share of printable runes a decoded run must have to be kept
+)
+
+// Decoders unwrapping a layer of encoding
+const (
+	DecoderURL     = "url"
+	DecoderUnicode = "unicode"
+	DecoderHex     = "hex"
+	DecoderBase64  = "base64"
+)
+
+// decoders are the available decoders, in the order they are applied within a layer.
+var decoders = []struct {
+	name   string
+	decode func(string) string
+}{
+	{DecoderURL, decodePercent},
+	{DecoderUnicode, decodeUnicodeEscapes},
+	{DecoderHex, decodeHexRuns},
+	{DecoderBase64, decodeBase64Runs},
+}
+
+var (
+	unicodeEscapeRegex = regexp.MustCompile(`(?:\\u|%u)([0-9a-fA-F]{4})|\\x([0-9a-fA-F]{2})`)
+	hexRunRegex        = regexp.MustCompile(`(?:0x)?[0-9a-fA-F]{16,}`)    // Runs of at least 8 encoded bytes
+	base64RunRegex     = regexp.MustCompile(`[A-Za-z0-9+/_-]{16,}={0,2}`) // Runs of at least 12 encoded bytes
+)
+
+// DecodeLayersConfig unwraps the layers of encoding of the request target values, such
+// as a double URL-encoded or base64-wrapped payload, and matches the rules of phases 1 and
+// 2 against each decoded layer as well as the raw value.
+type DecodeLayersConfig struct {
+	Depth    int      `json:"depth,omitempty"`     // Layers unwrapped, default 3
+	Decoders []string `json:"decoders,omitempty"`  // Decoders applied, default all
+	MaxBytes int      `json:"max_bytes,omitempty"` // Longest value decoded, default 64KB
+
+	decoders []func(string) string
+}
+
+// provision applies the defaults and resolves the decoders.
+func (c *DecodeLayersConfig) provision() error {
+	if c.Depth <= 0 {
+		c.Depth = defaultDecodeDepth
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultDecodeMaxBytes
+	}
+	for _, name := range c.Decoders {
+		if !isDecoder(name) {
+			return fmt.Errorf("unknown decode_layers decoder: %s", name)
+		}
+	}
+	c.decoders = nil
+	for _, d := range decoders {
+		if len(c.Decoders) == 0 || slices.Contains(c.Decoders, d.name) {
+			c.decoders = append(c.decoders, d.decode)
+		}
+	}
+	return nil
+}
+
+// isDecoder reports whether a decoder exists.
+func isDecoder(name string) bool {
+	for _, d := range decoders {
+		if d.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layers returns the successive decoded layers of a value, each applying every decoder
+// once to the previous one, until a layer decodes to itself or the depth is reached.
+func (c *DecodeLayersConfig) layers(value string) []string {
+	if len(value) > c.MaxBytes {
+		return nil
+	}
+	var layers []string
+	for i := 0; i < c.Depth; i++ {
+		decoded := value
+		for _, decode := range c.decoders {
+			decoded = decode(decoded)
+		}
+		if decoded == value {
+			break
+		}
+		layers = append(layers, decoded)
+		value = decoded
+	}
+	return layers
+}
+
+// decodePercent decodes the valid %XX sequences of a value, leaving invalid ones as is.
+func decodePercent(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) && isHexByte(value[i+1]) && isHexByte(value[i+2]) {
+			n, _ := strconv.ParseUint(value[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// decodeUnicodeEscapes decodes \uXXXX, %uXXXX and \xXX escapes.
+func decodeUnicodeEscapes(value string) string {
+	if !strings.Contains(value, `\u`) && !strings.Contains(value, "%u") && !strings.Contains(value, `\x`) {
+		return value
+	}
+	return unicodeEscapeRegex.ReplaceAllStringFunc(value, func(escape string) string {
+		n, err := strconv.ParseUint(escape[2:], 16, 32)
+		if err != nil {
+			return escape
+		}
+		return string(rune(n))
+	})
+}
+
+// decodeHexRuns decodes the runs of at least 16 hex digits, optionally prefixed with 0x,
+// that decode to printable text.
+func decodeHexRuns(value string) string {
+	return hexRunRegex.ReplaceAllStringFunc(value, func(run string) string {
+		digits := strings.TrimPrefix(run, "0x")
+		if len(digits)%2 != 0 {
+			return run
+		}
+		decoded, err := hex.DecodeString(digits)
+		if err != nil || !isMostlyPrintable(decoded) {
+			return run
+		}
+		return string(decoded)
+	})
+}
+
+// decodeBase64Runs decodes the runs of at least 16 base64 characters, standard or URL-safe,
+// that decode to printable text.
+func decodeBase64Runs(value string) string {
+	return base64RunRegex.ReplaceAllStringFunc(value, func(run string) string {
+		trimmed := strings.TrimRight(run, "=")
+		encoding := base64.RawStdEncoding
+		if strings.ContainsAny(trimmed, "-_") {
+			encoding = base64.RawURLEncoding
+		}
+		decoded, err := encoding.DecodeString(trimmed)
+		if err != nil || !isMostlyPrintable(decoded) {
+			return run
+		}
+		return string(decoded)
+	})
+}
+
+// isMostlyPrintable reports whether decoded bytes are valid UTF-8 made mostly of printable
+// runes, telling encoded text apart from words that merely look like base64 or hex.
+func isMostlyPrintable(decoded []byte) bool {
+	if len(decoded) == 0 || !utf8.Valid(decoded) {
+		return false
+	}
+	printable, total := 0, 0
+	for _, r := range string(decoded) {
+		total++
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			printable++
+		}
+	}
+	return float64(printable) >= minDecodedPrintable*float64(total)
+}
+
+// matchRuleDecoded matches a rule against a target value and, in phases 1 and 2 with
+// decode_layers, against its decoded layers. It returns the value, raw or decoded, that
+// matched.
+func (m *Middleware) matchRuleDecoded(rule *Rule, target, value string, state *WAFState) (string, bool) {
+	if m.matchRule(rule, value, state) {
+		return value, true
+	}
+	if m.DecodeLayers == nil || rule.Phase > 2 {
+		return "", false
+	}
+	for _, layer := range m.decodedLayers(target, value, state) {
+		if m.matchRule(rule, layer, state) {
+			m.decodedMatches.Add(1)
+			m.logger.Debug("Rule matched a decoded layer",
+				zap.String("rule_id", rule.ID),
+				zap.String("target", target),
+				zap.String("decoded", layer),
+			)
+			return layer, true
+		}
+	}
+	return "", false
+}
+
+// decodedLayers returns the decoded layers of a target value, decoded once per request
+// and shared by all rules.
+func (m *Middleware) decodedLayers(target, value string, state *WAFState) []string {
+	if cached, ok := state.decoded[target]; ok && cached.value == value {
+		return cached.layers
+	}
+	layers := m.DecodeLayers.layers(value)
+	if state.decoded == nil {
+		state.decoded = make(map[string]decodedTarget)
+	}
+	state.decoded[target] = decodedTarget{value: value, layers: layers}
+	return layers
+}
@@ -0,0 +1,99 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDecoders(t *testing.T) {
+	assert.Equal(t, "<script>", decodePercent("%3Cscript%3E"))
+	assert.Equal(t, "100%", decodePercent("100%"), "invalid sequences are kept")
+	assert.Equal(t, "%zz<", decodePercent("%zz%3c"))
+
+	assert.Equal(t, "<a>", decodeUnicodeEscapes(`<a%u003E`))
+	assert.Equal(t, "'x", decodeUnicodeEscapes(`\x27x`))
+
+	assert.Equal(t, "q=union select", decodeHexRuns("q="+hex.EncodeToString([]byte("union select"))))
+	assert.Equal(t, "id=0123456789abcdef", decodeHexRuns("id=0123456789abcdef"), "binary results are kept encoded")
+
+	payload := base64.StdEncoding.EncodeToString([]byte("<script>alert(1)</script>"))
+	assert.Equal(t, "data=<script>alert(1)</script>", decodeBase64Runs("data="+payload))
+	assert.Equal(t, "internationalization", decodeBase64Runs("internationalization"), "words are not decoded")
+	urlSafe := base64.RawURLEncoding.EncodeToString([]byte("../../etc/passwd??>"))
+	assert.Equal(t, "../../etc/passwd??>", decodeBase64Runs(urlSafe))
+}
+
+func TestDecodeLayersConfig_Layers(t *testing.T) {
+	config := &DecodeLayersConfig{}
+	require.NoError(t, config.provision())
+	assert.Equal(t, defaultDecodeDepth, config.Depth)
+
+	assert.Equal(t, []string{"%3Cscript%3E", "<script>"}, config.layers("%253Cscript%253E"))
+	assert.Nil(t, config.layers("plain text"))
+
+	wrapped := base64.StdEncoding.EncodeToString([]byte("cmd=%2Fbin%2Fsh -c id"))
+	assert.Equal(t, []string{"cmd=%2Fbin%2Fsh -c id", "cmd=/bin/sh -c id"}, config.layers(wrapped))
+
+	config = &DecodeLayersConfig{Depth: 1, Decoders: []string{DecoderURL}, MaxBytes: 20}
+	require.NoError(t, config.provision())
+	assert.Equal(t, []string{"%3C"}, config.layers("%253C"))
+	assert.Equal(t, []string{"%3C"}, config.layers("%253C"))
+	assert.Nil(t, config.layers("%3C%3C%3C%3C%3C%3C%3C"), "longer than max_bytes")
+
+	assert.Error(t, (&DecodeLayersConfig{Decoders: []string{"rot13"}}).provision())
+}
+
+func TestMatchRuleDecoded(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+	rule := &Rule{ID: "xss", Phase: 2, Pattern: "(?i)<script", Targets: []string{"ARGS"}}
+	require.NoError(t, m.compileRule(rule))
+	state := &WAFState{}
+
+	_, ok := m.matchRuleDecoded(rule, "ARGS", "q=%253Cscript%253E", state)
+	assert.False(t, ok, "decoding is off")
+
+	m.DecodeLayers = &DecodeLayersConfig{}
+	require.NoError(t, m.DecodeLayers.provision())
+	matched, ok := m.matchRuleDecoded(rule, "ARGS", "q=%253Cscript%253E", state)
+	assert.True(t, ok)
+	assert.Equal(t, "q=<script>", matched)
+	assert.Equal(t, int64(1), m.decodedMatches.Load())
+
+	matched, ok = m.matchRuleDecoded(rule, "ARGS", "q=<script>", state)
+	assert.True(t, ok)
+	assert.Equal(t, "q=<script>", matched, "raw matches are not counted")
+	assert.Equal(t, int64(1), m.decodedMatches.Load())
+
+	response := &Rule{ID: "leak", Phase: 4, Pattern: "<script", Targets: []string{"RESPONSE_BODY"}}
+	require.NoError(t, m.compileRule(response))
+	_, ok = m.matchRuleDecoded(response, "RESPONSE_BODY", "%3Cscript", state)
+	assert.False(t, ok, "response phases are not decoded")
+}
+
+func TestHandlePhase_DecodeLayers(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.DecodeLayers = &DecodeLayersConfig{}
+	require.NoError(t, m.DecodeLayers.provision())
+	rule := Rule{ID: "traversal", Phase: 1, Pattern: `\.\./`, Targets: []string{"ARGS"}, Score: 10, Action: "block"}
+	require.NoError(t, m.compileRule(&rule))
+	m.Rules = map[int][]Rule{1: {rule}}
+
+	r := testRequest("GET", "/?file=%252e%252e%252fetc%252fpasswd", "", "")
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, r, 1, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, []string{"traversal"}, state.MatchedRules)
+}
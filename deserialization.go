@@ -0,0 +1,244 @@
+package caddywaf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	deserializationRuleID   = "deserialization_rule"
+	maxDeserializationBytes = 1 << 20 // Longest gzip-decompressed Java stream inspected
+)
+
+// Serialization formats detected by the deserialization directive
+const (
+	DeserializationJava   = "java"
+	DeserializationPHP    = "php"
+	DeserializationDotNet = "dotnet"
+)
+
+// deserializationDetectors are the detectors of serialized payloads, by format.
+var deserializationDetectors = []struct {
+	format string
+	detect func(string) bool
+}{
+	{DeserializationJava, isJavaSerialized},
+	{DeserializationPHP, isPHPSerialized},
+	{DeserializationDotNet, isDotNetGadget},
+}
+
+var (
+	javaStreamMagic      = "\xac\xed\x00\x05"
+	binaryFormatterMagic = "\x00\x01\x00\x00\x00\xff\xff\xff\xff"
+	phpObjectRegex       = regexp.MustCompile(`[OC]:\+?(\d+):"([^"]*)":\d+:\{`)
+	phpClassNameRegex    = regexp.MustCompile(`^[A-Za-z_\\][A-Za-z0-9_\\]*$`)
+)
+
+// dotNetGadgets are types used by the known .NET deserialization gadget chains.
+var dotNetGadgets = []string{
+	"ObjectDataProvider",
+	"TypeConfuseDelegate",
+	"TextFormattingRunProperties",
+	"ActivitySurrogateSelector",
+	"WindowsIdentity",
+	"WindowsClaimsIdentity",
+	"SessionSecurityToken",
+	"RolePrincipal",
+	"PSObject",
+	"ObjectStateFormatter",
+	"ToolboxItemContainer",
+	"System.Diagnostics.Process",
+	"System.Configuration.Install.AssemblyInstaller",
+}
+
+// DeserializationConfig detects serialized objects in the parameters, cookies, headers
+// and body of requests: Java serialization streams, PHP serialized objects, and .NET
+// ViewState, BinaryFormatter and Json.NET payloads carrying known gadgets.
+type DeserializationConfig struct {
+	Formats []string `json:"formats,omitempty"` // Formats detected, default all
+	Action  string   `json:"action,omitempty"`  // block (default) or score
+	Score   int      `json:"score,omitempty"`   // Score per format detected, default 5
+}
+
+// provision validates the config and applies the defaults.
+func (c *DeserializationConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid deserialization action: %s, must be block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	for _, format := range c.Formats {
+		if !isDeserializationFormat(format) {
+			return fmt.Errorf("unknown deserialization format: %s", format)
+		}
+	}
+	return nil
+}
+
+// isDeserializationFormat reports whether a format is detected.
+func isDeserializationFormat(format string) bool {
+	for _, d := range deserializationDetectors {
+		if d.format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// isJavaSerialized reports whether a value holds a Java serialization stream, raw, hex
+// or base64-encoded, or gzip-compressed and base64-encoded.
+func isJavaSerialized(value string) bool {
+	if strings.Contains(value, javaStreamMagic) || strings.Contains(value, "rO0AB") ||
+		strings.Contains(strings.ToLower(value), "aced0005") {
+		return true
+	}
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "H4sI") {
+		return false
+	}
+	compressed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return false
+	}
+	magic := make([]byte, len(javaStreamMagic))
+	_, err = io.ReadFull(io.LimitReader(reader, maxDeserializationBytes), magic)
+	return err == nil && string(magic) == javaStreamMagic
+}
+
+// isPHPSerialized reports whether a value holds a PHP serialized object, O: or C:, whose
+// declared class name length matches the name, raw or base64-encoded.
+func isPHPSerialized(value string) bool {
+	if hasPHPObject(value) {
+		return true
+	}
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "Tz") && !strings.HasPrefix(value, "Qz") { // O: and C: in base64
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	return err == nil && hasPHPObject(string(decoded))
+}
+
+func hasPHPObject(value string) bool {
+	for _, match := range phpObjectRegex.FindAllStringSubmatch(value, -1) {
+		length, err := strconv.Atoi(match[1])
+		if err == nil && length == len(match[2]) && phpClassNameRegex.MatchString(match[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDotNetGadget reports whether a value holds a BinaryFormatter stream, a ViewState
+// embedding one or a known gadget, or a Json.NET $type naming a known gadget.
+func isDotNetGadget(value string) bool {
+	if strings.Contains(value, "$type") && containsDotNetGadget(value) {
+		return true
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "AAEAAAD/////") { // BinaryFormatter stream in base64
+		return true
+	}
+	if !strings.HasPrefix(value, "/wE") { // LosFormatter ViewState in base64
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(decoded), binaryFormatterMagic) || containsDotNetGadget(string(decoded))
+}
+
+func containsDotNetGadget(value string) bool {
+	for _, gadget := range dotNetGadgets {
+		if strings.Contains(value, gadget) {
+			return true
+		}
+	}
+	return false
+}
+
+// deserializationInputs returns the values of the request inspected, by location: its
+// parameters, cookies, headers and body.
+func (m *Middleware) deserializationInputs(r *http.Request, state *WAFState) [][2]string {
+	var inputs [][2]string
+	params, _ := m.requestParams(r, state)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range params[name] {
+			inputs = append(inputs, [2]string{"ARGS:" + name, value})
+		}
+	}
+	for _, cookie := range r.Cookies() {
+		inputs = append(inputs, [2]string{"COOKIES:" + cookie.Name, cookie.Value})
+	}
+	for name, values := range r.Header {
+		if name == "Cookie" {
+			continue
+		}
+		for _, value := range values {
+			inputs = append(inputs, [2]string{"HEADERS:" + name, value})
+		}
+	}
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		if body, err := m.extractTarget(TargetBody, r, nil, state); err == nil && body != "" {
+			inputs = append(inputs, [2]string{TargetBody, body})
+		}
+	}
+	return inputs
+}
+
+// checkDeserialization detects serialized objects in the request in phase 2, blocking it or
+// adding score per format detected. It reports whether the request was blocked.
+func (m *Middleware) checkDeserialization(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.Deserialization
+	if config == nil {
+		return false
+	}
+	var findings []string
+	detected := make(map[string]bool)
+	for _, input := range m.deserializationInputs(r, state) {
+		for _, d := range deserializationDetectors {
+			if detected[d.format] || (len(config.Formats) > 0 && !slices.Contains(config.Formats, d.format)) {
+				continue
+			}
+			if d.detect(input[1]) {
+				detected[d.format] = true
+				findings = append(findings, d.format+" in "+input[0])
+			}
+		}
+	}
+	if len(findings) == 0 {
+		return false
+	}
+
+	m.deserializationHits.Add(1)
+	m.incrementRuleHitCount(RuleID(deserializationRuleID))
+	state.MatchedRules = append(state.MatchedRules, deserializationRuleID)
+	return m.applyDetection(w, r, state, config.Action, config.Score*len(findings), http.StatusForbidden, "deserialization", deserializationRuleID,
+		"Serialized objects detected", zap.Strings("findings", findings))
+}
@@ -0,0 +1,94 @@
+package caddywaf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIsJavaSerialized(t *testing.T) {
+	stream := "\xac\xed\x00\x05sr\x00\x11java.util.HashMap"
+	assert.True(t, isJavaSerialized(stream))
+	assert.True(t, isJavaSerialized(base64.StdEncoding.EncodeToString([]byte(stream))))
+	assert.True(t, isJavaSerialized("ACED00057372"))
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(stream))
+	require.NoError(t, gz.Close())
+	assert.True(t, isJavaSerialized(base64.StdEncoding.EncodeToString(compressed.Bytes())))
+
+	assert.False(t, isJavaSerialized("H4sInotbase64!"))
+	assert.False(t, isJavaSerialized(`{"user": "alice"}`))
+}
+
+func TestIsPHPSerialized(t *testing.T) {
+	object := `O:8:"stdClass":1:{s:4:"file";s:11:"/etc/passwd";}`
+	assert.True(t, isPHPSerialized(object))
+	assert.True(t, isPHPSerialized(`a:1:{i:0;O:+14:"Monolog\Logger":0:{}}`))
+	assert.True(t, isPHPSerialized(`C:11:"ArrayObject":21:{x:i:0;a:0:{};m:a:0:{}}`))
+	assert.True(t, isPHPSerialized(base64.StdEncoding.EncodeToString([]byte(object))))
+
+	assert.False(t, isPHPSerialized(`O:9:"stdClass":1:{}`), "the declared length doesn't match")
+	assert.False(t, isPHPSerialized(`a:2:{i:0;s:1:"a";i:1;s:1:"b";}`), "arrays carry no object")
+	assert.False(t, isPHPSerialized("Tzzz"))
+}
+
+func TestIsDotNetGadget(t *testing.T) {
+	assert.True(t, isDotNetGadget(`{"$type": "System.Windows.Data.ObjectDataProvider, PresentationFramework"}`))
+	assert.False(t, isDotNetGadget(`{"$type": "MyApp.Order, MyApp"}`))
+	assert.True(t, isDotNetGadget("AAEAAAD/////AQAAAAAAAAAMAgAAAA=="))
+
+	viewState := base64.StdEncoding.EncodeToString([]byte("\xff\x01\x32\x01" + binaryFormatterMagic + "TypeConfuseDelegate"))
+	assert.True(t, isDotNetGadget(viewState))
+	plain := base64.StdEncoding.EncodeToString([]byte("\xff\x01\x0f\x0f\x05\x0a-123456789d\x16\x02"))
+	assert.False(t, isDotNetGadget(plain), "an ordinary ViewState")
+}
+
+func TestDeserializationConfig_Provision(t *testing.T) {
+	config := &DeserializationConfig{}
+	require.NoError(t, config.provision())
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+
+	assert.Error(t, (&DeserializationConfig{Action: "drop"}).provision())
+	assert.Error(t, (&DeserializationConfig{Formats: []string{"ruby"}}).provision())
+}
+
+func TestCheckDeserialization(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	assert.False(t, m.checkDeserialization(httptest.NewRecorder(), testRequest("GET", "/", "", ""), &WAFState{}))
+
+	m.Deserialization = &DeserializationConfig{Action: detectionActionScore, Score: 4}
+	require.NoError(t, m.Deserialization.provision())
+	state := &WAFState{}
+	r := testRequest("POST", "/profile", "application/x-www-form-urlencoded", `data=O:8:"stdClass":0:{}`)
+	r.AddCookie(&http.Cookie{Name: "rememberMe", Value: "rO0ABXNyABFqYXZh"})
+	assert.False(t, m.checkDeserialization(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 8, state.TotalScore, "java and php, once each")
+	assert.Equal(t, []string{deserializationRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.deserializationHits.Load())
+
+	m.Deserialization = &DeserializationConfig{Formats: []string{DeserializationDotNet}}
+	require.NoError(t, m.Deserialization.provision())
+	assert.False(t, m.checkDeserialization(httptest.NewRecorder(), r, &WAFState{}), "only dotnet is detected")
+
+	r = testRequest("POST", "/Default.aspx", "application/x-www-form-urlencoded", "__VIEWSTATE=AAEAAAD%2F%2F%2F%2F%2FAQAAAA")
+	w := httptest.NewRecorder()
+	state = &WAFState{}
+	assert.True(t, m.checkDeserialization(w, r, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
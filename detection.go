@@ -0,0 +1,38 @@
+package caddywaf
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Actions of the checks detecting attacks outside the rules, such as ssrf or xxe
+const (
+	detectionActionBlock = "block" // Blocks the request
+	detectionActionScore = "score" // Adds score, blocking once the anomaly threshold is reached
+
+	defaultDetectionScore = 5 // Score added by a detection with the score action
+)
+
+// applyDetection applies the action of a check to a request it detected an attack in.
+// With the score action, it adds score and blocks the request once the anomaly threshold is
+// reached; with any other, it blocks the request. msg describes the detection, logged with
+// fields, and is the message of the block. It reports whether the request was blocked.
+func (m *Middleware) applyDetection(w http.ResponseWriter, r *http.Request, state *WAFState, action string, score, statusCode int, reason, ruleID, msg string, fields ...zap.Field) bool {
+	if action != detectionActionScore {
+		blockFields := append([]zap.Field{zap.String("message", msg)}, fields...)
+		m.blockRequest(w, r, state, statusCode, reason, ruleID, blockFields...)
+		return true
+	}
+
+	state.TotalScore += score
+	threshold := m.anomalyThreshold(state)
+	logFields := append([]zap.Field{zap.String("log_id", getLogID(r.Context()))}, fields...)
+	m.logger.Info(msg, append(logFields, zap.Int("total_score", state.TotalScore))...)
+	if state.TotalScore < threshold {
+		return false
+	}
+	blockFields := append(fields[:len(fields):len(fields)], zap.Int("total_score", state.TotalScore), zap.Int("anomaly_threshold", threshold))
+	m.blockRequest(w, r, state, statusCode, "Anomaly threshold exceeded", ruleID, blockFields...)
+	return true
+}
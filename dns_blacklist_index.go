@@ -0,0 +1,183 @@
+package caddywaf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+const defaultDNSBlacklistFalsePositiveRate = 0.01
+
+// DNSBlacklistIndexConfig keeps a DNS blacklist on disk behind a Bloom filter rather than in memory.
+type DNSBlacklistIndexConfig struct {
+	FalsePositiveRate float64 `json:"false_positive_rate,omitempty"` // Bloom filter false positive rate, default 0.01
+	Path              string  `json:"path,omitempty"`                // Index file, default the blacklist file with a .idx suffix
+}
+
+// bloomFilter is a Bloom filter over 64-bit hashes, deriving its k probes by double hashing.
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+}
+
+// newBloomFilter sizes a Bloom filter for n entries at the given false positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	n = max(n, 1)
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{bits: make([]uint64, (uint64(m)+63)/64), k: uint64(k)}
+}
+
+func (b *bloomFilter) add(h uint64) {
+	size := uint64(len(b.bits)) * 64
+	h1, h2 := h, h>>32|h<<32
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(h uint64) bool {
+	size := uint64(len(b.bits)) * 64
+	h1, h2 := h, h>>32|h<<32
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashDomain returns the 64-bit FNV-1a hash of a normalized domain, without allocating.
+func hashDomain(domain string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(domain); i++ {
+		h ^= uint64(domain[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// dnsBlacklistIndex answers DNS blacklist lookups from a Bloom filter in memory and a
+// sorted file of domain hashes on disk. Only lookups the filter can't rule out read the file.
+type dnsBlacklistIndex struct {
+	bloom   *bloomFilter
+	file    *os.File
+	entries int64
+}
+
+// buildDNSBlacklistIndex reads a DNS blacklist file and writes its index. Domains are kept
+// as 64-bit hashes, so memory use while building is 8 bytes per entry.
+func (bl *BlacklistLoader) buildDNSBlacklistIndex(path string, config DNSBlacklistIndexConfig) (*dnsBlacklistIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DNS blacklist file: %w", err)
+	}
+	defer file.Close()
+
+	var hashes []uint64
+	validEntries, totalLines, err := readDNSBlacklistEntries(file, func(domain string) {
+		hashes = append(hashes, hashDomain(domain))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading DNS blacklist file: %w", err)
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	rate := config.FalsePositiveRate
+	if rate <= 0 {
+		rate = defaultDNSBlacklistFalsePositiveRate
+	}
+	bloom := newBloomFilter(len(hashes), rate)
+	var index bytes.Buffer
+	index.Grow(len(hashes) * 8)
+	for _, h := range hashes {
+		bloom.add(h)
+		_ = binary.Write(&index, binary.BigEndian, h)
+	}
+
+	indexPath := config.Path
+	if indexPath == "" {
+		indexPath = path + ".idx"
+	}
+	if err := writeFileAtomic(indexPath, index.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to write DNS blacklist index: %w", err)
+	}
+	indexFile, err := os.Open(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DNS blacklist index: %w", err)
+	}
+
+	bl.logger.Info("DNS blacklist indexed",
+		zap.String("path", path),
+		zap.String("index", indexPath),
+		zap.Int("valid_entries", validEntries),
+		zap.Int("total_lines", totalLines),
+		zap.Int("bloom_filter_bytes", len(bloom.bits)*8),
+		zap.Float64("false_positive_rate", rate),
+	)
+	return &dnsBlacklistIndex{bloom: bloom, file: indexFile, entries: int64(len(hashes))}, nil
+}
+
+// Contains reports whether a normalized domain is blacklisted. Bloom filter false positives
+// are resolved by a binary search of the index file.
+func (ix *dnsBlacklistIndex) Contains(domain string) (bool, error) {
+	h := hashDomain(domain)
+	if !ix.bloom.mayContain(h) {
+		return false, nil
+	}
+	var buf [8]byte
+	lo, hi := int64(0), ix.entries
+	for lo < hi {
+		mid := int64(uint64(lo+hi) >> 1)
+		if _, err := ix.file.ReadAt(buf[:], mid*8); err != nil {
+			return false, fmt.Errorf("failed to read DNS blacklist index: %w", err)
+		}
+		switch v := binary.BigEndian.Uint64(buf[:]); {
+		case v == h:
+			return true, nil
+		case v < h:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// Len returns the number of distinct domains in the index.
+func (ix *dnsBlacklistIndex) Len() int {
+	return int(ix.entries)
+}
+
+// Close closes the index file.
+func (ix *dnsBlacklistIndex) Close() error {
+	return ix.file.Close()
+}
+
+// loadDNSBlacklistIndex indexes the DNS blacklist file and swaps the index in, closing the
+// one it replaces. Lookups hold m.mu, so callers hold it too when lookups may run concurrently.
+func (m *Middleware) loadDNSBlacklistIndex(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		m.logger.Warn("Skipping DNS blacklist load, file does not exist", zap.String("file", path))
+		return nil
+	}
+	index, err := m.blacklistLoader.buildDNSBlacklistIndex(path, *m.DNSBlacklistIndex)
+	if err != nil {
+		return fmt.Errorf("failed to load DNS blacklist: %w", err)
+	}
+	if m.dnsBlacklistIndex != nil {
+		if err := m.dnsBlacklistIndex.Close(); err != nil {
+			m.logger.Warn("Failed to close replaced DNS blacklist index", zap.Error(err))
+		}
+	}
+	m.dnsBlacklistIndex = index
+	return nil
+}
@@ -0,0 +1,82 @@
+package caddywaf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	bloom := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bloom.add(hashDomain(fmt.Sprintf("bad%d.example", i)))
+	}
+	for i := 0; i < 10000; i++ {
+		require.True(t, bloom.mayContain(hashDomain(fmt.Sprintf("bad%d.example", i))), "no false negatives")
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bloom.mayContain(hashDomain(fmt.Sprintf("good%d.example", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300, "false positive rate stays near the configured 1%")
+}
+
+func TestDNSBlacklistIndex_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns_blacklist.txt")
+	var list strings.Builder
+	list.WriteString("# comment\n\n  Evil.Example  \n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&list, "bad%d.example\n", i)
+	}
+	require.NoError(t, os.WriteFile(path, []byte(list.String()), 0o600))
+
+	bl := NewBlacklistLoader(zap.NewNop())
+	index, err := bl.buildDNSBlacklistIndex(path, DNSBlacklistIndexConfig{FalsePositiveRate: 0.001})
+	require.NoError(t, err)
+	defer index.Close()
+	assert.Equal(t, 1001, index.Len())
+	assert.FileExists(t, path+".idx")
+
+	for _, domain := range []string{"evil.example", "bad0.example", "bad999.example"} {
+		found, err := index.Contains(domain)
+		require.NoError(t, err)
+		assert.True(t, found, domain)
+	}
+	for _, domain := range []string{"good.example", "bad1000.example", ""} {
+		found, err := index.Contains(domain)
+		require.NoError(t, err)
+		assert.False(t, found, domain)
+	}
+}
+
+func TestIsDNSBlacklisted_Index(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns_blacklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("evil.example\n"), 0o600))
+	m := &Middleware{
+		logger:            zap.NewNop(),
+		blacklistLoader:   NewBlacklistLoader(zap.NewNop()),
+		DNSBlacklistIndex: &DNSBlacklistIndexConfig{Path: filepath.Join(dir, "custom.idx")},
+	}
+	require.NoError(t, m.loadDNSBlacklistIndex(path))
+	assert.FileExists(t, filepath.Join(dir, "custom.idx"))
+	assert.True(t, m.isDNSBlacklisted("EVIL.example"))
+	assert.False(t, m.isDNSBlacklisted("good.example"))
+	assert.Equal(t, int64(1), m.DNSBlacklistBlockCount)
+
+	// Reloading swaps in a new index
+	require.NoError(t, os.WriteFile(path, []byte("other.example\n"), 0o600))
+	require.NoError(t, m.loadDNSBlacklistIndex(path))
+	assert.False(t, m.isDNSBlacklisted("evil.example"))
+	assert.True(t, m.isDNSBlacklisted("other.example"))
+	require.NoError(t, m.dnsBlacklistIndex.Close())
+}
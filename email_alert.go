@@ -0,0 +1,198 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEmailAlertWindow   = 5 * time.Minute
+	defaultEmailAlertCooldown = 30 * time.Minute
+	emailDigestTopN           = 10
+)
+
+// EmailAlertConfig configures SMTP digest alerts.
+type EmailAlertConfig struct {
+	SMTPServer     string        `json:"smtp_server"` // host:port
+	Username       string        `json:"username,omitempty"`
+	Password       string        `json:"password,omitempty"`
+	From           string        `json:"from"`
+	To             []string      `json:"to"`
+	Subject        string        `json:"subject,omitempty"`
+	BlockThreshold int           `json:"block_threshold,omitempty"` // Alert when blocks within Window exceed this value
+	Window         time.Duration `json:"window,omitempty"`
+	RuleIDs        []string      `json:"rule_ids,omitempty"` // Alert on any hit of these rules (e.g. honeypots)
+	Cooldown       time.Duration `json:"cooldown,omitempty"` // Minimum time between two emails
+}
+
+// EmailAlerter collects block events and sends a digest email when a condition trips.
+type EmailAlerter struct {
+	logger   *zap.Logger
+	config   EmailAlertConfig
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+	mu       sync.Mutex
+	events   []BlockEvent
+	lastSent time.Time
+}
+
+// NewEmailAlerter creates an EmailAlerter from the given configuration.
+func NewEmailAlerter(logger *zap.Logger, config EmailAlertConfig) (*EmailAlerter, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if err := validateEmailAlertConfig(&config); err != nil {
+		return nil, err
+	}
+	return &EmailAlerter{
+		logger:   logger,
+		config:   config,
+		sendMail: smtp.SendMail,
+	}, nil
+}
+
+// validateEmailAlertConfig checks required settings and applies defaults.
+func validateEmailAlertConfig(config *EmailAlertConfig) error {
+	if config.SMTPServer == "" {
+		return fmt.Errorf("email alert requires an smtp_server")
+	}
+	if _, _, err := net.SplitHostPort(config.SMTPServer); err != nil {
+		return fmt.Errorf("invalid smtp_server '%s': %w", config.SMTPServer, err)
+	}
+	if config.From == "" || len(config.To) == 0 {
+		return fmt.Errorf("email alert requires from and at least one to address")
+	}
+	if config.BlockThreshold <= 0 && len(config.RuleIDs) == 0 {
+		return fmt.Errorf("email alert requires block_threshold or rule_ids")
+	}
+	if config.Window <= 0 {
+		config.Window = defaultEmailAlertWindow
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = defaultEmailAlertCooldown
+	}
+	if config.Subject == "" {
+		config.Subject = "caddy-waf alert"
+	}
+	return nil
+}
+
+// Record adds an event to the window and sends a digest if a condition trips.
+func (ea *EmailAlerter) Record(ev BlockEvent) {
+	ea.mu.Lock()
+	ea.events = append(ea.events, ev)
+	ea.pruneLocked(ev.Timestamp)
+
+	reason := ea.triggerLocked(ev)
+	if reason == "" || (!ea.lastSent.IsZero() && ev.Timestamp.Sub(ea.lastSent) < ea.config.Cooldown) {
+		ea.mu.Unlock()
+		return
+	}
+	ea.lastSent = ev.Timestamp
+	msg := ea.digestLocked(reason, ev.Timestamp)
+	ea.mu.Unlock()
+
+	go func() {
+		if err := ea.send(msg); err != nil {
+			ea.logger.Error("Failed to send email alert", zap.String("smtp_server", ea.config.SMTPServer), zap.Error(err))
+			return
+		}
+		ea.logger.Info("Email alert sent", zap.String("reason", reason), zap.Strings("to", ea.config.To))
+	}()
+}
+
+// pruneLocked drops events that fell out of the alert window.
+func (ea *EmailAlerter) pruneLocked(now time.Time) {
+	cutoff := now.Add(-ea.config.Window)
+	i := 0
+	for i < len(ea.events) && ea.events[i].Timestamp.Before(cutoff) {
+		i++
+	}
+	ea.events = ea.events[i:]
+}
+
+// triggerLocked returns the reason an alert should be sent, or an empty string.
+func (ea *EmailAlerter) triggerLocked(ev BlockEvent) string {
+	for _, id := range ea.config.RuleIDs {
+		if id == ev.RuleID {
+			return fmt.Sprintf("rule %s matched", ev.RuleID)
+		}
+	}
+	if ea.config.BlockThreshold > 0 && len(ea.events) > ea.config.BlockThreshold {
+		return fmt.Sprintf("%d blocks in the last %s", len(ea.events), ea.config.Window)
+	}
+	return ""
+}
+
+// digestLocked renders the email message with the top rules and IPs of the window.
+func (ea *EmailAlerter) digestLocked(reason string, now time.Time) []byte {
+	ruleCounts := make(map[string]int)
+	ipCounts := make(map[string]int)
+	for _, ev := range ea.events {
+		ruleCounts[ev.RuleID]++
+		ipCounts[ev.ClientIP]++
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Alert: %s\r\n", reason)
+	fmt.Fprintf(&body, "Time: %s\r\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&body, "Blocked requests in window (%s): %d\r\n\r\n", ea.config.Window, len(ea.events))
+	body.WriteString("Top rules:\r\n")
+	for _, kv := range topCounts(ruleCounts, emailDigestTopN) {
+		fmt.Fprintf(&body, "  %-40s %d\r\n", kv.Key, kv.Count)
+	}
+	body.WriteString("\r\nTop source IPs:\r\n")
+	for _, kv := range topCounts(ipCounts, emailDigestTopN) {
+		fmt.Fprintf(&body, "  %-40s %d\r\n", kv.Key, kv.Count)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", ea.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(ea.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s: %s\r\n", ea.config.Subject, reason)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body.String())
+	return []byte(msg.String())
+}
+
+// send delivers the message through the configured SMTP server.
+func (ea *EmailAlerter) send(msg []byte) error {
+	var auth smtp.Auth
+	if ea.config.Username != "" {
+		host, _, _ := net.SplitHostPort(ea.config.SMTPServer)
+		auth = smtp.PlainAuth("", ea.config.Username, ea.config.Password, host)
+	}
+	return ea.sendMail(ea.config.SMTPServer, auth, ea.config.From, ea.config.To, msg)
+}
+
+// keyCount is a key with its occurrence count.
+type keyCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// topCounts returns the n keys with the highest counts, ties ordered by key.
+func topCounts(counts map[string]int, n int) []keyCount {
+	result := make([]keyCount, 0, len(counts))
+	for k, c := range counts {
+		result = append(result, keyCount{Key: k, Count: c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
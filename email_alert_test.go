@@ -0,0 +1,72 @@
+package caddywaf
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestNewEmailAlerter_Validation(t *testing.T) {
+	_, err := NewEmailAlerter(zap.NewNop(), EmailAlertConfig{From: "waf@example.com", To: []string{"ops@example.com"}, BlockThreshold: 1})
+	assert.Error(t, err, "missing smtp_server should be rejected")
+
+	_, err = NewEmailAlerter(zap.NewNop(), EmailAlertConfig{SMTPServer: "localhost:25", From: "waf@example.com", To: []string{"ops@example.com"}})
+	assert.Error(t, err, "alert without any condition should be rejected")
+
+	ea, err := NewEmailAlerter(zap.NewNop(), EmailAlertConfig{SMTPServer: "localhost:25", From: "waf@example.com", To: []string{"ops@example.com"}, BlockThreshold: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultEmailAlertWindow, ea.config.Window)
+	assert.Equal(t, defaultEmailAlertCooldown, ea.config.Cooldown)
+}
+
+func TestEmailAlerter_Record(t *testing.T) {
+	sent := make(chan string, 2)
+	ea, err := NewEmailAlerter(zap.NewNop(), EmailAlertConfig{
+		SMTPServer:     "localhost:25",
+		From:           "waf@example.com",
+		To:             []string{"ops@example.com"},
+		BlockThreshold: 2,
+		RuleIDs:        []string{"honeypot"},
+	})
+	assert.NoError(t, err)
+	ea.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent <- string(msg)
+		return nil
+	}
+
+	now := time.Now()
+	ea.Record(BlockEvent{RuleID: "sqli", ClientIP: "10.0.0.1", Timestamp: now})
+	ea.Record(BlockEvent{RuleID: "sqli", ClientIP: "10.0.0.1", Timestamp: now})
+	select {
+	case <-sent:
+		t.Fatal("threshold not yet exceeded, no email expected")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ea.Record(BlockEvent{RuleID: "xss", ClientIP: "10.0.0.2", Timestamp: now})
+	select {
+	case msg := <-sent:
+		assert.True(t, strings.Contains(msg, "3 blocks in the last 5m0s"))
+		assert.True(t, strings.Contains(msg, "sqli"))
+		assert.True(t, strings.Contains(msg, "10.0.0.2"))
+	case <-time.After(time.Second):
+		t.Fatal("expected a digest email")
+	}
+
+	// Cooldown suppresses a second email, even for a honeypot hit
+	ea.Record(BlockEvent{RuleID: "honeypot", ClientIP: "10.0.0.3", Timestamp: now})
+	select {
+	case <-sent:
+		t.Fatal("cooldown should suppress the second email")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTopCounts(t *testing.T) {
+	top := topCounts(map[string]int{"a": 1, "b": 3, "c": 3, "d": 2}, 3)
+	assert.Equal(t, []keyCount{{"b", 3}, {"c", 3}, {"d", 2}}, top)
+}
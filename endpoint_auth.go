@@ -0,0 +1,111 @@
+package caddywaf
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// EndpointAuthConfig protects the metrics endpoint and the admin API.
+type EndpointAuthConfig struct {
+	Token      string   `json:"token,omitempty"` // Accepted as "Authorization: Bearer <token>"
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"` // IPs or CIDR ranges allowed to reach the endpoints
+
+	allowedNets []*net.IPNet
+}
+
+// provision parses the allowed IP ranges.
+func (c *EndpointAuthConfig) provision() error {
+	if c.Token == "" && c.Username == "" && len(c.AllowedIPs) == 0 {
+		return fmt.Errorf("endpoint_auth requires a token, basic_auth or allow_ip")
+	}
+	c.allowedNets = c.allowedNets[:0]
+	for _, entry := range c.AllowedIPs {
+		if !strings.Contains(entry, "/") {
+			entry = appendCIDR(entry)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint_auth allow_ip '%s': %w", entry, err)
+		}
+		c.allowedNets = append(c.allowedNets, ipNet)
+	}
+	return nil
+}
+
+// ipAllowed checks the client address against the allowed IP ranges.
+func (c *EndpointAuthConfig) ipAllowed(remoteAddr string) bool {
+	if len(c.allowedNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(extractIP(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range c.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialsValid checks the bearer token or basic auth credentials of the request.
+func (c *EndpointAuthConfig) credentialsValid(r *http.Request) bool {
+	if c.Token == "" && c.Username == "" {
+		return true
+	}
+	if c.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureCompare(token, c.Token) {
+			return true
+		}
+	}
+	if c.Username != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureCompare(user, c.Username) && secureCompare(pass, c.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureCompare compares two strings in constant time.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authorizeEndpoint checks access to the metrics endpoint and the admin API.
+// It writes a 403 or 401 response and returns false when access is denied.
+func (m *Middleware) authorizeEndpoint(w http.ResponseWriter, r *http.Request) bool {
+	auth := m.EndpointAuth
+	if auth == nil {
+		return true
+	}
+	if !auth.ipAllowed(r.RemoteAddr) {
+		m.logger.Warn("Endpoint access denied for client IP",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("path", r.URL.Path),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	if !auth.credentialsValid(r) {
+		m.logger.Warn("Endpoint access denied, invalid credentials",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("path", r.URL.Path),
+		)
+		if auth.Username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="caddy-waf"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="caddy-waf"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuthorizeEndpoint_Disabled(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+	w := httptest.NewRecorder()
+	assert.True(t, m.authorizeEndpoint(w, httptest.NewRequest("GET", "/metrics", nil)))
+}
+
+func TestAuthorizeEndpoint_Token(t *testing.T) {
+	auth := &EndpointAuthConfig{Token: "s3cret"}
+	require.NoError(t, auth.provision())
+	m := &Middleware{logger: zap.NewNop(), EndpointAuth: auth}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	assert.False(t, m.authorizeEndpoint(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	assert.False(t, m.authorizeEndpoint(w, req))
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	assert.True(t, m.authorizeEndpoint(w, req))
+}
+
+func TestAuthorizeEndpoint_BasicAuth(t *testing.T) {
+	auth := &EndpointAuthConfig{Username: "admin", Password: "pw"}
+	require.NoError(t, auth.provision())
+	m := &Middleware{logger: zap.NewNop(), EndpointAuth: auth}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	assert.False(t, m.authorizeEndpoint(w, req))
+	assert.Equal(t, `Basic realm="caddy-waf"`, w.Header().Get("WWW-Authenticate"))
+
+	req.SetBasicAuth("admin", "pw")
+	assert.True(t, m.authorizeEndpoint(httptest.NewRecorder(), req))
+}
+
+func TestAuthorizeEndpoint_AllowedIPs(t *testing.T) {
+	auth := &EndpointAuthConfig{Token: "s3cret", AllowedIPs: []string{"10.0.0.0/8", "192.168.1.5"}}
+	require.NoError(t, auth.provision())
+	m := &Middleware{logger: zap.NewNop(), EndpointAuth: auth}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+
+	req.RemoteAddr = "10.1.2.3:1234"
+	assert.True(t, m.authorizeEndpoint(httptest.NewRecorder(), req))
+
+	req.RemoteAddr = "192.168.1.5:1234"
+	assert.True(t, m.authorizeEndpoint(httptest.NewRecorder(), req))
+
+	req.RemoteAddr = "172.16.0.1:1234"
+	w := httptest.NewRecorder()
+	assert.False(t, m.authorizeEndpoint(w, req))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestEndpointAuthConfig_Provision(t *testing.T) {
+	assert.Error(t, (&EndpointAuthConfig{}).provision())
+	assert.Error(t, (&EndpointAuthConfig{AllowedIPs: []string{"not-an-ip"}}).provision())
+	assert.NoError(t, (&EndpointAuthConfig{AllowedIPs: []string{"::1"}}).provision())
+}
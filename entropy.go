@@ -0,0 +1,27 @@
+package caddywaf
+
+import "math"
+
+// maxEntropy is the Shannon entropy of bytes evenly distributed over all 256 values.
+const maxEntropy = 8.0
+
+// shannonEntropy returns the Shannon entropy of a value in bits per byte: about 4 for
+// English text, 6 for base64 and close to 8 for compressed or encrypted data.
+func shannonEntropy(value string) float64 {
+	if value == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(value); i++ {
+		counts[value[i]]++
+	}
+	entropy := 0.0
+	total := float64(len(value))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
@@ -0,0 +1,59 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestShannonEntropy(t *testing.T) {
+	assert.Equal(t, 0.0, shannonEntropy(""))
+	assert.Equal(t, 0.0, shannonEntropy("aaaa"))
+	assert.Equal(t, 1.0, shannonEntropy("abab"))
+	assert.Equal(t, 2.0, shannonEntropy("abcd"))
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	assert.Equal(t, maxEntropy, shannonEntropy(string(all)))
+	assert.Less(t, shannonEntropy("the quick brown fox jumps over the lazy dog"), 4.5)
+	assert.Greater(t, shannonEntropy(base64.StdEncoding.EncodeToString(all)), 5.5)
+}
+
+func TestMatchRule_MinEntropy(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+	rule := &Rule{ID: "blob", Phase: 2, Targets: []string{"ARGS"}, MinEntropy: 5}
+	assert.NoError(t, m.compileRule(rule))
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	blob := base64.StdEncoding.EncodeToString(all)
+	state := &WAFState{}
+	assert.True(t, m.matchRule(rule, blob, state))
+	assert.False(t, m.matchRule(rule, "page=1&sort=name", state))
+
+	rule = &Rule{ID: "blob-param", Phase: 2, Pattern: `^[A-Za-z0-9+/=]{64,}$`, Targets: []string{"ARGS"}, MinEntropy: 5}
+	assert.NoError(t, m.compileRule(rule))
+	assert.True(t, m.matchRule(rule, blob, state))
+	assert.False(t, m.matchRule(rule, strings.Repeat("ab", 64), state), "the pattern matches, the entropy is too low")
+	assert.False(t, m.matchRule(rule, blob+"!", state), "the entropy is high, the pattern doesn't match")
+}
+
+func TestConditionHolds_Entropy(t *testing.T) {
+	m := conditionMiddleware()
+	program, err := compileRuleCondition(`entropy(request.args["token"]) > 3.5 && entropy("") == 0.0`)
+	assert.NoError(t, err)
+	rule := &Rule{ID: "c1", Phase: 1, condition: program}
+
+	req := httptest.NewRequest("GET", "/?token=Zm9vYmFyYmF6cXV4MTIzNDU2Nzg5MA", nil)
+	assert.True(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+	req = httptest.NewRequest("GET", "/?token=aaaaaaaaaaaa", nil)
+	assert.False(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+}
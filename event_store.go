@@ -0,0 +1,577 @@
+package caddywaf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEventRetention    = 7 * 24 * time.Hour
+	defaultEventQueryLimit   = 50
+	maxEventQueryLimit       = 1000
+	eventStoreQueueSize      = 4096
+	eventStoreFlushInterval  = time.Second
+	eventStoreBatchSize      = 256
+	eventStorePruneFrequency = time.Hour
+)
+
+var eventsBucket = []byte("events")
+
+// eventStoreDBs holds the Bolt databases open, by path. Bolt locks its file exclusively, and
+// on a config reload the new instance is provisioned before the running one is cleaned up:
+// both share the database, closed when the last of them releases it.
+var eventStoreDBs = struct {
+	sync.Mutex
+	open map[string]*sharedEventDB
+}{open: make(map[string]*sharedEventDB)}
+
+// sharedEventDB is a Bolt database and the number of event stores using it.
+type sharedEventDB struct {
+	db   *bolt.DB
+	refs int
+}
+
+// acquireEventDB opens the Bolt database at path, or shares the one already open.
+func acquireEventDB(path string) (*bolt.DB, error) {
+	eventStoreDBs.Lock()
+	defer eventStoreDBs.Unlock()
+	if shared, ok := eventStoreDBs.open[path]; ok {
+		shared.refs++
+		return shared.db, nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	eventStoreDBs.open[path] = &sharedEventDB{db: db, refs: 1}
+	return db, nil
+}
+
+// releaseEventDB releases the Bolt database at path, closing it with its last user.
+func releaseEventDB(path string) error {
+	eventStoreDBs.Lock()
+	defer eventStoreDBs.Unlock()
+	shared, ok := eventStoreDBs.open[path]
+	if !ok {
+		return nil
+	}
+	if shared.refs--; shared.refs > 0 {
+		return nil
+	}
+	delete(eventStoreDBs.open, path)
+	return shared.db.Close()
+}
+
+// EventStoreConfig configures the embedded blocked-event store.
+type EventStoreConfig struct {
+	Path           string        `json:"path"`
+	Retention      time.Duration `json:"retention,omitempty"`       // Events older than this are deleted
+	MaxEvents      int           `json:"max_events,omitempty"`      // Oldest events are deleted beyond this count
+	ExportDir      string        `json:"export_dir,omitempty"`      // Directory for NDJSON.gz exports
+	ExportInterval time.Duration `json:"export_interval,omitempty"` // Export new events on this schedule
+}
+
+// StoredEvent is a blocked request as persisted in the event store.
+type StoredEvent struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	LogID      string    `json:"log_id,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Country    string    `json:"country,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RuleID     string    `json:"rule_id"`
+	Reason     string    `json:"reason,omitempty"`
+	Score      int       `json:"score"`
+	StatusCode int       `json:"status_code"`
+}
+
+// EventQuery filters a query against the event store. Zero values match everything.
+type EventQuery struct {
+	Since      time.Time
+	Until      time.Time
+	ClientIP   string
+	RuleID     string
+	LogID      string
+	PathPrefix string
+	Country    string
+	Limit      int
+	Cursor     string // ID of the last event of the previous page
+}
+
+// EventStore persists block events in a Bolt database, newest first on query.
+type EventStore struct {
+	logger    *zap.Logger
+	config    EventStoreConfig
+	db        *bolt.DB
+	queue     chan BlockEvent
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewEventStore opens (or creates) the Bolt database at config.Path.
+func NewEventStore(logger *zap.Logger, config EventStoreConfig) (*EventStore, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("event store requires a path")
+	}
+	if config.Retention <= 0 {
+		config.Retention = defaultEventRetention
+	}
+	if config.ExportInterval > 0 && config.ExportDir == "" {
+		return nil, fmt.Errorf("event store export_interval requires an export_dir")
+	}
+	if config.ExportDir != "" {
+		if err := os.MkdirAll(config.ExportDir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create event export directory %s: %w", config.ExportDir, err)
+		}
+	}
+	db, err := acquireEventDB(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event store %s: %w", config.Path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	}); err != nil {
+		releaseEventDB(config.Path)
+		return nil, fmt.Errorf("failed to initialize event store %s: %w", config.Path, err)
+	}
+	return &EventStore{
+		logger: logger,
+		config: config,
+		db:     db,
+		queue:  make(chan BlockEvent, eventStoreQueueSize),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Start launches the batch writer, the retention worker and, if scheduled, the exporter.
+func (es *EventStore) Start() {
+	es.wg.Add(2)
+	go es.writeLoop()
+	go es.pruneLoop()
+	if es.config.ExportInterval > 0 {
+		es.wg.Add(1)
+		go es.exportLoop()
+	}
+}
+
+// Close flushes pending events and releases the database, closed once no other event store
+// shares it.
+func (es *EventStore) Close() error {
+	var err error
+	es.closeOnce.Do(func() {
+		close(es.stop)
+		es.wg.Wait()
+		err = releaseEventDB(es.config.Path)
+	})
+	return err
+}
+
+// Record queues a block event for persistence. Events are dropped when the queue is full.
+func (es *EventStore) Record(ev BlockEvent) {
+	select {
+	case es.queue <- ev:
+	default:
+		es.logger.Warn("Event store queue full, dropping event", zap.String("client_ip", ev.ClientIP))
+	}
+}
+
+// writeLoop persists queued events in batches.
+func (es *EventStore) writeLoop() {
+	defer es.wg.Done()
+	ticker := time.NewTicker(eventStoreFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]BlockEvent, 0, eventStoreBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := es.write(batch); err != nil {
+			es.logger.Error("Failed to write events to event store", zap.Int("count", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-es.queue:
+			batch = append(batch, ev)
+			if len(batch) >= eventStoreBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-es.stop:
+			for {
+				select {
+				case ev := <-es.queue:
+					batch = append(batch, ev)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write stores a batch of events in a single transaction.
+func (es *EventStore) write(events []BlockEvent) error {
+	return es.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		for _, ev := range events {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := eventKey(ev.Timestamp, seq)
+			data, err := json.Marshal(storedEventFromBlockEvent(hex.EncodeToString(key), ev))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneLoop periodically applies the retention limits.
+func (es *EventStore) pruneLoop() {
+	defer es.wg.Done()
+	ticker := time.NewTicker(eventStorePruneFrequency)
+	defer ticker.Stop()
+
+	es.prune(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			es.prune(time.Now())
+		case <-es.stop:
+			return
+		}
+	}
+}
+
+// prune deletes events older than the retention period, then the oldest events
+// beyond MaxEvents, and returns how many were removed.
+func (es *EventStore) prune(now time.Time) int {
+	cutoff := eventKey(now.Add(-es.config.Retention), 0)
+	removed := 0
+	err := es.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		excess := 0
+		if es.config.MaxEvents > 0 {
+			excess = b.Stats().KeyN - es.config.MaxEvents
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && (bytes.Compare(k, cutoff) < 0 || removed < excess); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		es.logger.Error("Failed to prune event store", zap.Error(err))
+	} else if removed > 0 {
+		es.logger.Info("Pruned expired events", zap.Int("removed", removed), zap.Duration("retention", es.config.Retention))
+	}
+	return removed
+}
+
+// exportLoop exports the events recorded since the previous export on every tick.
+func (es *EventStore) exportLoop() {
+	defer es.wg.Done()
+	ticker := time.NewTicker(es.config.ExportInterval)
+	defer ticker.Stop()
+
+	since := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			if _, _, err := es.Export(since, now); err != nil {
+				es.logger.Error("Scheduled event export failed", zap.Error(err))
+				continue
+			}
+			since = now
+		case <-es.stop:
+			return
+		}
+	}
+}
+
+// Export writes the events in [since, until) as gzip-compressed NDJSON to the
+// export directory and returns the file path and the number of events written.
+func (es *EventStore) Export(since, until time.Time) (string, int, error) {
+	if es.config.ExportDir == "" {
+		return "", 0, fmt.Errorf("event store export_dir is not configured")
+	}
+	name := fmt.Sprintf("waf-events-%s.ndjson.gz", until.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(es.config.ExportDir, name)
+	tmp, err := os.CreateTemp(es.config.ExportDir, name+".*.tmp")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	count, err := es.writeNDJSON(tmp, since, until)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write export file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, fmt.Errorf("failed to finalize export file: %w", err)
+	}
+	es.logger.Info("Exported events", zap.String("path", path), zap.Int("count", count))
+	return path, count, nil
+}
+
+// writeNDJSON writes the events in [since, until) to w as gzip-compressed NDJSON, oldest first.
+func (es *EventStore) writeNDJSON(w *os.File, since, until time.Time) (int, error) {
+	gz := gzip.NewWriter(w)
+	buf := bufio.NewWriter(gz)
+	count := 0
+	err := es.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+		end := eventKey(until, 0)
+		k, v := c.First()
+		if !since.IsZero() {
+			k, v = c.Seek(eventKey(since, 0))
+		}
+		for ; k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			if _, err := buf.Write(v); err != nil {
+				return err
+			}
+			if err := buf.WriteByte('\n'); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+	return count, gz.Close()
+}
+
+// Query returns matching events newest first, and the cursor of the next page if there is one.
+func (es *EventStore) Query(q EventQuery) ([]StoredEvent, string, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultEventQueryLimit
+	}
+	if q.Limit > maxEventQueryLimit {
+		q.Limit = maxEventQueryLimit
+	}
+	var start []byte
+	if q.Cursor != "" {
+		cursor, err := hex.DecodeString(q.Cursor)
+		if err != nil || len(cursor) != 16 {
+			return nil, "", fmt.Errorf("invalid cursor")
+		}
+		start = cursor
+	}
+
+	events := make([]StoredEvent, 0, q.Limit)
+	next := ""
+	err := es.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+		var k, v []byte
+		if start != nil {
+			// Seek lands on the cursor itself or the next key after it; step back past it.
+			k, _ = c.Seek(start)
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else if !q.Until.IsZero() {
+			k, _ = c.Seek(eventKey(q.Until, ^uint64(0)))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			if !q.Since.IsZero() && eventKeyTime(k).Before(q.Since) {
+				break
+			}
+			var ev StoredEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				continue
+			}
+			if !q.matches(ev) {
+				continue
+			}
+			if len(events) == q.Limit {
+				next = events[len(events)-1].ID
+				break
+			}
+			events = append(events, ev)
+		}
+		return nil
+	})
+	return events, next, err
+}
+
+// matches applies the non-time filters of the query.
+func (q EventQuery) matches(ev StoredEvent) bool {
+	if q.ClientIP != "" && ev.ClientIP != q.ClientIP {
+		return false
+	}
+	if q.RuleID != "" && ev.RuleID != q.RuleID {
+		return false
+	}
+	if q.LogID != "" && ev.LogID != q.LogID {
+		return false
+	}
+	if q.PathPrefix != "" && !strings.HasPrefix(ev.Path, q.PathPrefix) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(ev.Country, q.Country) {
+		return false
+	}
+	return true
+}
+
+// eventKey builds a sortable key from the event time and a sequence number.
+func eventKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// eventKeyTime extracts the event time from a key.
+func eventKeyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+// storedEventFromBlockEvent converts a block event for persistence.
+func storedEventFromBlockEvent(id string, ev BlockEvent) StoredEvent {
+	return StoredEvent{
+		ID:         id,
+		Timestamp:  ev.Timestamp,
+		LogID:      ev.LogID,
+		ClientIP:   ev.ClientIP,
+		Country:    ev.Country,
+		Host:       ev.Host,
+		Method:     ev.Method,
+		Path:       ev.Path,
+		RuleID:     ev.RuleID,
+		Reason:     ev.Reason,
+		Score:      ev.Score,
+		StatusCode: ev.StatusCode,
+	}
+}
+
+// parseEventQuery builds an EventQuery from the request's query parameters.
+func parseEventQuery(r *http.Request) (EventQuery, error) {
+	values := r.URL.Query()
+	q := EventQuery{
+		ClientIP:   values.Get("ip"),
+		RuleID:     values.Get("rule"),
+		LogID:      values.Get("log_id"),
+		PathPrefix: values.Get("path"),
+		Country:    values.Get("country"),
+		Limit:      queryInt(r, "limit", defaultEventQueryLimit),
+		Cursor:     values.Get("cursor"),
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			*dst = t
+		} else if d, err := time.ParseDuration(value); err == nil {
+			*dst = time.Now().Add(-d)
+		} else {
+			return q, fmt.Errorf("%s must be an RFC3339 timestamp or a duration", name)
+		}
+	}
+	return q, nil
+}
+
+// handleEventsRequest queries the event store.
+func (m *Middleware) handleEventsRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.eventStore == nil {
+		return writeJSONError(w, http.StatusConflict, "event_store is not configured")
+	}
+	q, err := parseEventQuery(r)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, err.Error())
+	}
+	events, next, err := m.eventStore.Query(q)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, err.Error())
+	}
+	resp := map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// handleEventsExportRequest exports events to the export directory on demand.
+// The time range defaults to the whole retention period.
+func (m *Middleware) handleEventsExportRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.eventStore == nil {
+		return writeJSONError(w, http.StatusConflict, "event_store is not configured")
+	}
+	if m.eventStore.config.ExportDir == "" {
+		return writeJSONError(w, http.StatusConflict, "event_store export_dir is not configured")
+	}
+	q, err := parseEventQuery(r)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, err.Error())
+	}
+	if q.Until.IsZero() {
+		q.Until = time.Now()
+	}
+	path, count, err := m.eventStore.Export(q.Since, q.Until)
+	if err != nil {
+		m.logger.Error("On-demand event export failed", zap.Error(err))
+		return writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":  path,
+		"count": count,
+	})
+}
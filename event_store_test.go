@@ -0,0 +1,246 @@
+package caddywaf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewEventStore_RequiresPath(t *testing.T) {
+	_, err := NewEventStore(nil, EventStoreConfig{})
+	assert.Error(t, err)
+}
+
+func TestEventStore_QueryFilters(t *testing.T) {
+	es := newTestEventStore(t, time.Hour)
+	now := time.Now()
+	require.NoError(t, es.write([]BlockEvent{
+		{Timestamp: now.Add(-3 * time.Minute), ClientIP: "1.1.1.1", RuleID: "sqli", Path: "/login", Country: "RU"},
+		{Timestamp: now.Add(-2 * time.Minute), ClientIP: "2.2.2.2", RuleID: "xss", Path: "/search"},
+		{Timestamp: now.Add(-1 * time.Minute), ClientIP: "1.1.1.1", RuleID: "xss", Path: "/login/admin", Country: "RU"},
+	}))
+
+	events, next, err := es.Query(EventQuery{})
+	require.NoError(t, err)
+	assert.Len(t, events, 3)
+	assert.Empty(t, next)
+	assert.Equal(t, "/login/admin", events[0].Path, "newest event first")
+
+	events, _, _ = es.Query(EventQuery{ClientIP: "1.1.1.1"})
+	assert.Len(t, events, 2)
+
+	events, _, _ = es.Query(EventQuery{RuleID: "xss", PathPrefix: "/login"})
+	assert.Len(t, events, 1)
+
+	events, _, _ = es.Query(EventQuery{Country: "ru"})
+	assert.Len(t, events, 2)
+
+	events, _, _ = es.Query(EventQuery{Since: now.Add(-150 * time.Second)})
+	assert.Len(t, events, 2)
+
+	events, _, _ = es.Query(EventQuery{Until: now.Add(-90 * time.Second)})
+	assert.Len(t, events, 2)
+}
+
+func TestEventStore_Pagination(t *testing.T) {
+	es := newTestEventStore(t, time.Hour)
+	now := time.Now()
+	batch := make([]BlockEvent, 5)
+	for i := range batch {
+		batch[i] = BlockEvent{Timestamp: now.Add(time.Duration(i) * time.Second), ClientIP: "1.1.1.1"}
+	}
+	require.NoError(t, es.write(batch))
+
+	var seen []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		events, next, err := es.Query(EventQuery{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+		for _, ev := range events {
+			seen = append(seen, ev.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(t, seen, 5)
+
+	_, _, err := es.Query(EventQuery{Cursor: "zz"})
+	assert.Error(t, err)
+}
+
+func TestEventStore_Prune(t *testing.T) {
+	es := newTestEventStore(t, time.Hour)
+	now := time.Now()
+	require.NoError(t, es.write([]BlockEvent{
+		{Timestamp: now.Add(-2 * time.Hour), ClientIP: "old"},
+		{Timestamp: now, ClientIP: "new"},
+	}))
+
+	assert.Equal(t, 1, es.prune(now))
+	events, _, _ := es.Query(EventQuery{})
+	require.Len(t, events, 1)
+	assert.Equal(t, "new", events[0].ClientIP)
+}
+
+func TestEventStore_RecordFlushesOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	es, err := NewEventStore(zap.NewNop(), EventStoreConfig{Path: path})
+	require.NoError(t, err)
+	es.Start()
+	es.Record(BlockEvent{Timestamp: time.Now(), ClientIP: "1.1.1.1"})
+	require.NoError(t, es.Close())
+
+	es, err = NewEventStore(zap.NewNop(), EventStoreConfig{Path: path})
+	require.NoError(t, err)
+	defer es.Close()
+	events, _, _ := es.Query(EventQuery{})
+	assert.Len(t, events, 1)
+}
+
+func TestEventStore_SharedAcrossReload(t *testing.T) {
+	dir := t.TempDir()
+	rules := writeRuleFile(t, dir)
+	path := filepath.Join(dir, "events.db")
+
+	// The new configuration is provisioned while the running one still holds the database
+	running := &Middleware{RuleFiles: []string{rules}, LogFilePath: filepath.Join(dir, "waf.json"), EventStore: &EventStoreConfig{Path: path}}
+	require.NoError(t, running.Provision(caddy.Context{Context: context.Background()}))
+	current := &Middleware{RuleFiles: []string{rules}, LogFilePath: filepath.Join(dir, "waf.json"), EventStore: &EventStoreConfig{Path: path}}
+	require.NoError(t, current.Provision(caddy.Context{Context: context.Background()}))
+	require.NoError(t, running.eventStore.write([]BlockEvent{{Timestamp: time.Now(), ClientIP: "1.1.1.1"}}))
+
+	require.NoError(t, running.Cleanup())
+	require.NoError(t, current.eventStore.write([]BlockEvent{{Timestamp: time.Now(), ClientIP: "2.2.2.2"}}), "the database stays open for the new configuration")
+	events, _, err := current.eventStore.Query(EventQuery{})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	require.NoError(t, current.Cleanup())
+	es, err := NewEventStore(zap.NewNop(), EventStoreConfig{Path: path})
+	require.NoError(t, err, "the last user closed the database")
+	require.NoError(t, es.Close())
+}
+
+func TestHandleEventsRequest(t *testing.T) {
+	m := newAPITestMiddleware()
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/events", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	m.eventStore = newTestEventStore(t, time.Hour)
+	require.NoError(t, m.eventStore.write([]BlockEvent{{Timestamp: time.Now(), ClientIP: "1.1.1.1", RuleID: "sqli"}}))
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/events?rule=sqli&since=1h", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Events []StoredEvent `json:"events"`
+		Count  int           `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Count)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/events?since=yesterday", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEventStore_PruneMaxEvents(t *testing.T) {
+	es := newTestEventStore(t, time.Hour)
+	es.config.MaxEvents = 2
+	now := time.Now()
+	require.NoError(t, es.write([]BlockEvent{
+		{Timestamp: now.Add(-3 * time.Second), ClientIP: "1"},
+		{Timestamp: now.Add(-2 * time.Second), ClientIP: "2"},
+		{Timestamp: now.Add(-1 * time.Second), ClientIP: "3"},
+	}))
+
+	assert.Equal(t, 1, es.prune(now))
+	events, _, _ := es.Query(EventQuery{})
+	require.Len(t, events, 2)
+	assert.Equal(t, "3", events[0].ClientIP)
+	assert.Equal(t, "2", events[1].ClientIP)
+}
+
+func TestEventStore_Export(t *testing.T) {
+	dir := t.TempDir()
+	es, err := NewEventStore(zap.NewNop(), EventStoreConfig{
+		Path:      filepath.Join(dir, "events.db"),
+		ExportDir: filepath.Join(dir, "exports"),
+	})
+	require.NoError(t, err)
+	defer es.Close()
+
+	now := time.Now()
+	require.NoError(t, es.write([]BlockEvent{
+		{Timestamp: now.Add(-2 * time.Hour), ClientIP: "old"},
+		{Timestamp: now.Add(-time.Minute), ClientIP: "1.1.1.1", RuleID: "sqli"},
+		{Timestamp: now.Add(-time.Second), ClientIP: "2.2.2.2", RuleID: "xss"},
+	}))
+
+	path, count, err := es.Export(now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(gz)
+	var ips []string
+	for scanner.Scan() {
+		var ev StoredEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev))
+		ips = append(ips, ev.ClientIP)
+	}
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, ips, "oldest event first")
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "exports"))
+	assert.Len(t, entries, 1, "temporary file must be removed")
+}
+
+func TestEventStore_ExportRequiresDir(t *testing.T) {
+	es := newTestEventStore(t, time.Hour)
+	_, _, err := es.Export(time.Time{}, time.Now())
+	assert.Error(t, err)
+
+	_, err = NewEventStore(zap.NewNop(), EventStoreConfig{Path: filepath.Join(t.TempDir(), "e.db"), ExportInterval: time.Hour})
+	assert.Error(t, err)
+}
+
+func TestHandleEventsExportRequest(t *testing.T) {
+	dir := t.TempDir()
+	m := newAPITestMiddleware()
+	es, err := NewEventStore(zap.NewNop(), EventStoreConfig{Path: filepath.Join(dir, "events.db"), ExportDir: dir})
+	require.NoError(t, err)
+	defer es.Close()
+	m.eventStore = es
+	require.NoError(t, es.write([]BlockEvent{{Timestamp: time.Now().Add(-time.Second), ClientIP: "1.1.1.1"}}))
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/events/export", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Path  string `json:"path"`
+		Count int    `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Count)
+	assert.FileExists(t, resp.Path)
+}
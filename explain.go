@@ -0,0 +1,176 @@
+package caddywaf
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExplainSize = 256
+	explainValueLimit  = 256 // Bytes of a value kept in a trace
+)
+
+// ExplainConfig keeps the evaluation trace of the recent blocked requests, served by the
+// admin API under GET /explain/{txid}.
+type ExplainConfig struct {
+	Size int `json:"size,omitempty"` // Blocked requests kept, default 256
+}
+
+// TraceRule is a rule match of a transaction trace.
+type TraceRule struct {
+	RuleID     string   `json:"rule_id"`
+	Phase      int      `json:"phase"`
+	Targets    []string `json:"targets,omitempty"`
+	Value      string   `json:"value,omitempty"` // Value matched, truncated
+	Score      int      `json:"score"`
+	Action     string   `json:"action,omitempty"`
+	TotalScore int      `json:"total_score"` // Anomaly score after the match
+}
+
+// TraceDecision is the final decision of a transaction trace.
+type TraceDecision struct {
+	Blocked          bool   `json:"blocked"`
+	StatusCode       int    `json:"status_code"`
+	Reason           string `json:"reason"`
+	RuleID           string `json:"rule_id"`
+	TotalScore       int    `json:"total_score"`
+	AnomalyThreshold int    `json:"anomaly_threshold"`
+}
+
+// TransactionTrace is the evaluation of a blocked request: the target values extracted,
+// the rules and checks matched and the decision.
+type TransactionTrace struct {
+	LogID        string            `json:"log_id"`
+	Timestamp    time.Time         `json:"timestamp"`
+	ClientIP     string            `json:"client_ip"`
+	Method       string            `json:"method"`
+	Host         string            `json:"host"`
+	Path         string            `json:"path"`
+	Targets      map[string]string `json:"targets"`       // Target values extracted, truncated
+	MatchedRules []string          `json:"matched_rules"` // IDs of the rules and checks matched, in order
+	Rules        []TraceRule       `json:"rules"`         // Rule matches, with their scores
+	Decision     TraceDecision     `json:"decision"`
+}
+
+// transactionLog is a ring buffer of the traces of the recent blocked requests. Traces
+// are not modified once added.
+type transactionLog struct {
+	mu     sync.Mutex
+	traces []*TransactionTrace
+	next   int
+	byID   map[string]*TransactionTrace
+}
+
+// newTransactionLog creates a transaction log keeping size traces, default 256.
+func newTransactionLog(size int) *transactionLog {
+	if size <= 0 {
+		size = defaultExplainSize
+	}
+	return &transactionLog{
+		traces: make([]*TransactionTrace, size),
+		byID:   make(map[string]*TransactionTrace, size),
+	}
+}
+
+// add stores a trace, evicting the oldest when the log is full.
+func (tl *transactionLog) add(trace *TransactionTrace) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if old := tl.traces[tl.next]; old != nil {
+		delete(tl.byID, old.LogID)
+	}
+	tl.traces[tl.next] = trace
+	tl.byID[trace.LogID] = trace
+	tl.next = (tl.next + 1) % len(tl.traces)
+}
+
+// get returns the trace of a transaction, if still kept.
+func (tl *transactionLog) get(logID string) (*TransactionTrace, bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	trace, ok := tl.byID[logID]
+	return trace, ok
+}
+
+// truncateTraceValue shortens a value kept in a trace to explainValueLimit bytes.
+func truncateTraceValue(value string) string {
+	if len(value) <= explainValueLimit {
+		return value
+	}
+	return value[:explainValueLimit] + "..."
+}
+
+// traceValue returns a value kept in a trace, redacted for sensitive targets when
+// redact_sensitive_data is enabled, and truncated.
+func (m *Middleware) traceValue(value string, targets ...string) string {
+	if m.requestValueExtractor != nil {
+		for _, target := range targets {
+			if redacted := m.requestValueExtractor.redactValueIfSensitive(target, value); redacted != value {
+				return redacted
+			}
+		}
+	}
+	return truncateTraceValue(value)
+}
+
+// traceRuleMatch records a rule match in the trace of the request, when explain is enabled.
+func (m *Middleware) traceRuleMatch(rule *Rule, value string, state *WAFState) {
+	if m.transactions == nil {
+		return
+	}
+	state.trace = append(state.trace, TraceRule{
+		RuleID:     rule.ID,
+		Phase:      rule.Phase,
+		Targets:    rule.Targets,
+		Value:      m.traceValue(value, rule.Targets...),
+		Score:      rule.Score,
+		Action:     rule.Action,
+		TotalScore: state.TotalScore,
+	})
+}
+
+// recordTransaction stores the trace of a blocked request, when explain is enabled.
+func (m *Middleware) recordTransaction(r *http.Request, state *WAFState, statusCode int, reason, ruleID string) {
+	if m.transactions == nil {
+		return
+	}
+	targets := make(map[string]string, len(state.targets))
+	for target, extracted := range state.targets {
+		if extracted.err == nil {
+			targets[target] = m.traceValue(extracted.value, target)
+		}
+	}
+	m.transactions.add(&TransactionTrace{
+		LogID:        getLogID(r.Context()),
+		Timestamp:    time.Now(),
+		ClientIP:     extractIP(r.RemoteAddr),
+		Method:       r.Method,
+		Host:         r.Host,
+		Path:         r.URL.Path,
+		Targets:      targets,
+		MatchedRules: slices.Clone(state.MatchedRules),
+		Rules:        slices.Clone(state.trace),
+		Decision: TraceDecision{
+			Blocked:          true,
+			StatusCode:       statusCode,
+			Reason:           reason,
+			RuleID:           ruleID,
+			TotalScore:       state.TotalScore,
+			AnomalyThreshold: m.anomalyThreshold(state),
+		},
+	})
+}
+
+// handleExplainRequest returns the trace of a recent blocked request by its log ID.
+func (m *Middleware) handleExplainRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.transactions == nil {
+		return writeJSONError(w, http.StatusConflict, "explain requires the explain directive")
+	}
+	trace, ok := m.transactions.get(r.PathValue("txid"))
+	if !ok {
+		return writeJSONError(w, http.StatusNotFound, "no recent blocked request with this transaction ID")
+	}
+	return writeJSON(w, http.StatusOK, trace)
+}
@@ -0,0 +1,105 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTransactionLog_Evicts(t *testing.T) {
+	tl := newTransactionLog(2)
+	for _, id := range []string{"a", "b", "c"} {
+		tl.add(&TransactionTrace{LogID: id})
+	}
+	_, ok := tl.get("a")
+	assert.False(t, ok, "the oldest trace is evicted")
+	trace, ok := tl.get("c")
+	require.True(t, ok)
+	assert.Equal(t, "c", trace.LogID)
+
+	assert.Len(t, newTransactionLog(0).traces, defaultExplainSize)
+}
+
+func TestTraceValue(t *testing.T) {
+	m := &Middleware{requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), true)}
+	assert.Equal(t, "REDACTED", m.traceValue("hunter2", "ARGS:password"))
+	assert.Equal(t, "alice", m.traceValue("alice", "ARGS:user"))
+	long := m.traceValue(strings.Repeat("a", 1000), "BODY")
+	assert.Len(t, long, explainValueLimit+len("..."))
+}
+
+func TestRecordTransaction(t *testing.T) {
+	m := newExplainMiddleware()
+	req := testRequest("GET", "/items?id=1+union+select", "", "")
+	req.Header.Set("User-Agent", "sqlmap/1.7")
+	state := &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), req, 2, state)
+	require.True(t, state.Blocked)
+
+	trace, ok := m.transactions.get("test")
+	require.True(t, ok)
+	assert.Equal(t, "/items", trace.Path)
+	assert.Equal(t, "1 union select", trace.Targets["URL_PARAM:id"])
+	assert.Equal(t, []string{"sqli-1", "scanner-ua"}, trace.MatchedRules)
+	require.Len(t, trace.Rules, 2)
+	assert.Equal(t, TraceRule{RuleID: "sqli-1", Phase: 2, Targets: []string{"URL_PARAM:id"}, Value: "1 union select", Score: 4, Action: "score", TotalScore: 4}, trace.Rules[0])
+	assert.Equal(t, 12, trace.Rules[1].TotalScore)
+	assert.Equal(t, TraceDecision{Blocked: true, StatusCode: http.StatusForbidden, Reason: "Anomaly threshold exceeded", RuleID: "scanner-ua", TotalScore: 12, AnomalyThreshold: 10}, trace.Decision)
+}
+
+func TestRecordTransaction_Disabled(t *testing.T) {
+	m := newExplainMiddleware()
+	m.transactions = nil
+	req := testRequest("GET", "/items?id=1+union+select", "", "")
+	req.Header.Set("User-Agent", "sqlmap/1.7")
+	state := &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), req, 2, state)
+	assert.True(t, state.Blocked)
+	assert.Empty(t, state.trace, "rule matches are traced only with explain")
+}
+
+func TestHandleExplainRequest(t *testing.T) {
+	m := newExplainMiddleware()
+	m.transactions.add(&TransactionTrace{LogID: "0b7e2a52", Path: "/login", Decision: TraceDecision{Blocked: true, RuleID: "sqli-1"}})
+
+	w := httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/explain/0b7e2a52", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var trace TransactionTrace
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trace))
+	assert.Equal(t, "/login", trace.Path)
+	assert.Equal(t, "sqli-1", trace.Decision.RuleID)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/explain/unknown", nil)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/explain/0b7e2a52", nil)))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	m.transactions = nil
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/explain/0b7e2a52", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestMatchAPIRoute(t *testing.T) {
+	name, value, ok := matchAPIRoute("/explain/{txid}", "/explain/abc")
+	assert.True(t, ok)
+	assert.Equal(t, "txid", name)
+	assert.Equal(t, "abc", value)
+
+	_, _, ok = matchAPIRoute("/explain/{txid}", "/explain/")
+	assert.False(t, ok)
+	_, _, ok = matchAPIRoute("/explain/{txid}", "/explain/a/b")
+	assert.False(t, ok)
+	_, _, ok = matchAPIRoute("/status", "/status")
+	assert.True(t, ok)
+}
@@ -0,0 +1,99 @@
+package caddywaf
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fail2banTag prefixes the event kind on each line, as in caddy-waf[block].
+const fail2banTag = "caddy-waf"
+
+// Fail2banWriter writes block and ban events as single plain-text lines meant for
+// fail2ban filters:
+//
+//	2024-01-02T03:04:05Z caddy-waf[block]: client=10.0.0.1 status=403 rule=sqli host=example.com method=GET path=/login log_id=abc reason="Rule action is 'block'"
+//
+// The fields are always written in this order. Values other than reason are never empty
+// ("-" stands for a missing value) and never contain spaces or quotes, which are percent
+// encoded; reason is quoted with backslash escapes.
+type Fail2banWriter struct {
+	logger *zap.Logger
+	mu     sync.Mutex
+	out    io.WriteCloser
+}
+
+// NewFail2banWriter opens the output: a file path, a udp://host:port or tcp://host:port
+// collector, or a unix:/path socket.
+func NewFail2banWriter(logger *zap.Logger, output string) (*Fail2banWriter, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if output == "" {
+		return nil, fmt.Errorf("fail2ban output requires an output")
+	}
+	out, err := openEventOutput(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fail2ban output %s: %w", output, err)
+	}
+	return &Fail2banWriter{logger: logger, out: out}, nil
+}
+
+// Write writes a single event.
+func (fw *Fail2banWriter) Write(ev BlockEvent) {
+	line := formatFail2ban(ev)
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, err := io.WriteString(fw.out, line+"\n"); err != nil {
+		fw.logger.Error("Failed to write fail2ban event", zap.Error(err))
+	}
+}
+
+// Close closes the underlying output.
+func (fw *Fail2banWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.out.Close()
+}
+
+// formatFail2ban encodes an event as a fail2ban line.
+func formatFail2ban(ev BlockEvent) string {
+	kind := ev.Kind
+	if kind == "" {
+		kind = EventKindBlock
+	}
+	fields := []string{
+		"client=" + fail2banValue(ev.ClientIP),
+		"status=" + strconv.Itoa(ev.StatusCode),
+		"rule=" + fail2banValue(ev.RuleID),
+		"host=" + fail2banValue(ev.Host),
+		"method=" + fail2banValue(ev.Method),
+		"path=" + fail2banValue(ev.Path),
+		"log_id=" + fail2banValue(ev.LogID),
+		"reason=" + strconv.Quote(stripNewlines(ev.Reason)),
+	}
+	return fmt.Sprintf("%s %s[%s]: %s", ev.Timestamp.UTC().Format(time.RFC3339), fail2banTag, fail2banValue(kind), strings.Join(fields, " "))
+}
+
+// fail2banValue percent encodes the bytes of a value that would break the line into
+// fields: controls, spaces, quotes and percent signs.
+func fail2banValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == 0x7f || c == '"' || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
@@ -0,0 +1,69 @@
+package caddywaf
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFormatFail2ban(t *testing.T) {
+	assert.Equal(t,
+		`2024-01-02T03:04:05Z caddy-waf[block]: client=10.0.0.1 status=403 rule=sqli|1 host=example.com method=GET path=/a=b log_id=abc reason="Rule action is 'block'"`,
+		formatFail2ban(siemTestEvent))
+
+	ev := siemTestEvent
+	ev.Kind = EventKindBan
+	ev.Path = "/a b\"%"
+	ev.Host = ""
+	ev.Reason = "too many\nviolations \"now\""
+	line := formatFail2ban(ev)
+	assert.Contains(t, line, " caddy-waf[ban]: client=10.0.0.1 ")
+	assert.Contains(t, line, " host=- ")
+	assert.Contains(t, line, " path=/a%20b%22%25 ")
+	assert.True(t, strings.HasSuffix(line, ` reason="too many violations \"now\""`))
+
+	// The documented filter picks up the client
+	failregex := regexp.MustCompile(`caddy-waf\[(?:block|ban)\]: client=(\S+) status=`)
+	assert.Equal(t, "10.0.0.1", failregex.FindStringSubmatch(line)[1])
+}
+
+func TestFail2banWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waf-fail2ban.log")
+	fw, err := NewFail2banWriter(zap.NewNop(), path)
+	require.NoError(t, err)
+	fw.Write(siemTestEvent)
+	fw.Write(siemTestEvent)
+	require.NoError(t, fw.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "caddy-waf[block]: client=10.0.0.1 "))
+	assert.True(t, strings.HasSuffix(string(data), "\n"))
+
+	socket := filepath.Join(t.TempDir(), "fail2ban.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	fw, err = NewFail2banWriter(zap.NewNop(), "unix:"+socket)
+	require.NoError(t, err)
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	fw.Write(siemTestEvent)
+	received, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, formatFail2ban(siemTestEvent)+"\n", received)
+	require.NoError(t, fw.Close())
+
+	_, err = NewFail2banWriter(zap.NewNop(), "")
+	assert.Error(t, err)
+	_, err = NewFail2banWriter(zap.NewNop(), filepath.Join(t.TempDir(), "missing", "waf.log"))
+	assert.Error(t, err)
+}
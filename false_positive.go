@@ -0,0 +1,299 @@
+package caddywaf
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFalsePositiveMinReports = 5
+	falsePositiveSuggestionReports = 2 // Reports on a path or host suggesting its exclusion
+)
+
+// Scopes of a false positive exclusion suggestion
+const (
+	FalsePositiveScopePath = "path"
+	FalsePositiveScopeHost = "host"
+)
+
+// FalsePositiveConfig records the block events operators report as false positives, per
+// rule. It suggests exclusions for the paths and hosts reported repeatedly and, with a
+// DisableRate, disables the rules whose share of reported hits reaches it.
+type FalsePositiveConfig struct {
+	DisableRate float64 `json:"disable_rate,omitempty"` // Percentage of the hits of a rule reported disabling it, 0 never
+	MinReports  int     `json:"min_reports,omitempty"`  // Reports needed to disable a rule, default 5
+
+	mu    sync.Mutex
+	rules map[string]*falsePositiveRule
+}
+
+// falsePositiveRule is the false positive reports of a rule.
+type falsePositiveRule struct {
+	reports  int
+	paths    map[string]int
+	hosts    map[string]int
+	disabled bool
+	last     time.Time
+}
+
+// FalsePositiveReport is the JSON body of POST /false-positives. A log_id of an event in
+// the event store fills in the other fields.
+type FalsePositiveReport struct {
+	LogID  string `json:"log_id,omitempty"`
+	RuleID string `json:"rule_id,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// FalsePositiveStats is the false positive summary of a rule.
+type FalsePositiveStats struct {
+	RuleID      string                    `json:"rule_id"`
+	Reports     int                       `json:"reports"`
+	Hits        int64                     `json:"hits"`
+	Rate        float64                   `json:"rate"` // Percentage of the hits reported
+	Disabled    bool                      `json:"disabled"`
+	LastReport  time.Time                 `json:"last_report"`
+	Suggestions []FalsePositiveSuggestion `json:"suggestions,omitempty"`
+}
+
+// FalsePositiveSuggestion is an exclusion of a path or host from a rule.
+type FalsePositiveSuggestion struct {
+	Scope     string `json:"scope"`
+	Value     string `json:"value"`
+	Reports   int    `json:"reports"`
+	Exclusion string `json:"exclusion"` // Rule condition or Caddyfile host block applying it
+}
+
+// provision applies the defaults.
+func (c *FalsePositiveConfig) provision() error {
+	if c.DisableRate < 0 || c.DisableRate > 100 {
+		return fmt.Errorf("invalid false_positives disable_rate %v, must be between 0 and 100", c.DisableRate)
+	}
+	if c.MinReports <= 0 {
+		c.MinReports = defaultFalsePositiveMinReports
+	}
+	c.rules = make(map[string]*falsePositiveRule)
+	return nil
+}
+
+// report records a false positive of a rule with the given hits, reporting whether it
+// disabled the rule.
+func (c *FalsePositiveConfig) report(report FalsePositiveReport, hits int64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rule, ok := c.rules[report.RuleID]
+	if !ok {
+		rule = &falsePositiveRule{paths: make(map[string]int), hosts: make(map[string]int)}
+		c.rules[report.RuleID] = rule
+	}
+	rule.reports++
+	rule.last = now
+	if report.Path != "" {
+		rule.paths[report.Path]++
+	}
+	if report.Host != "" {
+		rule.hosts[strings.ToLower(report.Host)]++
+	}
+	if rule.disabled || c.DisableRate <= 0 || rule.reports < c.MinReports {
+		return false
+	}
+	rule.disabled = falsePositiveRate(rule.reports, hits) >= c.DisableRate
+	return rule.disabled
+}
+
+// falsePositiveRate returns the percentage of the hits of a rule reported, counting at
+// least as many hits as reports since the hits are reset with the metrics.
+func falsePositiveRate(reports int, hits int64) float64 {
+	return 100 * float64(reports) / float64(max(hits, int64(reports), 1))
+}
+
+// disabled reports whether a rule was disabled for its false positives.
+func (c *FalsePositiveConfig) disabled(ruleID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rule, ok := c.rules[ruleID]
+	return ok && rule.disabled
+}
+
+// reset forgets the reports of a rule and enables it again, reporting whether it had any.
+func (c *FalsePositiveConfig) reset(ruleID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.rules[ruleID]
+	delete(c.rules, ruleID)
+	return ok
+}
+
+// stats summarizes the reports of every rule, sorted by rate, looking the hits and
+// conditions of the rules up with hits and rule.
+func (c *FalsePositiveConfig) stats(hits func(ruleID string) int64, rule func(ruleID string) (Rule, bool)) []FalsePositiveStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make([]FalsePositiveStats, 0, len(c.rules))
+	for id, fp := range c.rules {
+		s := FalsePositiveStats{RuleID: id, Reports: fp.reports, Hits: hits(id), Disabled: fp.disabled, LastReport: fp.last}
+		s.Rate = falsePositiveRate(fp.reports, s.Hits)
+		condition := ""
+		if r, ok := rule(id); ok {
+			condition = r.Condition
+		}
+		for path, reports := range fp.paths {
+			if reports >= falsePositiveSuggestionReports {
+				s.Suggestions = append(s.Suggestions, FalsePositiveSuggestion{
+					Scope:     FalsePositiveScopePath,
+					Value:     path,
+					Reports:   reports,
+					Exclusion: pathExclusionCondition(condition, path),
+				})
+			}
+		}
+		for host, reports := range fp.hosts {
+			if reports >= falsePositiveSuggestionReports {
+				s.Suggestions = append(s.Suggestions, FalsePositiveSuggestion{
+					Scope:     FalsePositiveScopeHost,
+					Value:     host,
+					Reports:   reports,
+					Exclusion: fmt.Sprintf("host %s {\n\tdisable_rule %s\n}", host, id),
+				})
+			}
+		}
+		sort.Slice(s.Suggestions, func(i, j int) bool {
+			if s.Suggestions[i].Reports != s.Suggestions[j].Reports {
+				return s.Suggestions[i].Reports > s.Suggestions[j].Reports
+			}
+			return s.Suggestions[i].Value < s.Suggestions[j].Value
+		})
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Rate != stats[j].Rate {
+			return stats[i].Rate > stats[j].Rate
+		}
+		return stats[i].RuleID < stats[j].RuleID
+	})
+	return stats
+}
+
+// pathExclusionCondition returns the rule condition excluding a path, keeping the existing
+// condition of the rule.
+func pathExclusionCondition(condition, path string) string {
+	exclusion := "request.path != " + strconv.Quote(path)
+	if condition == "" {
+		return exclusion
+	}
+	return "(" + condition + ") && " + exclusion
+}
+
+// ruleDisabled reports whether a rule was disabled for its false positives.
+func (m *Middleware) ruleDisabled(ruleID string) bool {
+	return m.FalsePositives != nil && m.FalsePositives.disabled(ruleID)
+}
+
+// ruleHitCount returns the hits of a rule since the last metrics reset.
+func (m *Middleware) ruleHitCount(ruleID string) int64 {
+	if hits, ok := m.ruleHits.Load(RuleID(ruleID)); ok {
+		return int64(hits.(HitCount))
+	}
+	return 0
+}
+
+// findRule returns the loaded rule with an ID.
+func (m *Middleware) findRule(ruleID string) (Rule, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, rules := range m.Rules {
+		for _, rule := range rules {
+			if rule.ID == ruleID {
+				return rule, true
+			}
+		}
+	}
+	return Rule{}, false
+}
+
+// handleFalsePositiveReportRequest records a block event reported as a false positive.
+func (m *Middleware) handleFalsePositiveReportRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.FalsePositives == nil {
+		return writeJSONError(w, http.StatusConflict, "false positive reports require the false_positives directive")
+	}
+	var report FalsePositiveReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&report); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+	}
+	if report.LogID != "" && m.eventStore != nil {
+		events, _, err := m.eventStore.Query(EventQuery{LogID: report.LogID, Limit: 1})
+		if err != nil {
+			return writeJSONError(w, http.StatusInternalServerError, err.Error())
+		}
+		if len(events) == 0 && report.RuleID == "" {
+			return writeJSONError(w, http.StatusNotFound, "no stored event with log_id "+report.LogID)
+		}
+		if len(events) > 0 {
+			report.RuleID = cmp.Or(report.RuleID, events[0].RuleID)
+			report.Host = cmp.Or(report.Host, events[0].Host)
+			report.Path = cmp.Or(report.Path, events[0].Path)
+		}
+	}
+	if report.RuleID == "" {
+		return writeJSONError(w, http.StatusBadRequest, "rule_id, or the log_id of a stored event, is required")
+	}
+	if _, ok := m.findRule(report.RuleID); !ok {
+		return writeJSONError(w, http.StatusNotFound, "unknown rule "+report.RuleID)
+	}
+
+	hits := m.ruleHitCount(report.RuleID)
+	disabled := m.FalsePositives.report(report, hits, time.Now())
+	m.fpReports.Add(1)
+	m.logger.Info("False positive reported",
+		zap.String("rule_id", report.RuleID),
+		zap.String("log_id", report.LogID),
+		zap.String("host", report.Host),
+		zap.String("path", report.Path),
+		zap.String("note", report.Note),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	if disabled {
+		m.logger.Warn("Rule disabled for its false positives",
+			zap.String("rule_id", report.RuleID),
+			zap.Int64("hits", hits),
+			zap.Float64("disable_rate", m.FalsePositives.DisableRate),
+		)
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{"status": "recorded", "rule_id": report.RuleID, "rule_disabled": m.ruleDisabled(report.RuleID)})
+}
+
+// handleFalsePositivesRequest lists the false positive reports and exclusion suggestions
+// of every rule.
+func (m *Middleware) handleFalsePositivesRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.FalsePositives == nil {
+		return writeJSONError(w, http.StatusConflict, "false positive reports require the false_positives directive")
+	}
+	return writeJSON(w, http.StatusOK, m.FalsePositives.stats(m.ruleHitCount, m.findRule))
+}
+
+// handleFalsePositivesResetRequest forgets the reports of the rule of the rule_id query
+// parameter, enabling it again.
+func (m *Middleware) handleFalsePositivesResetRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.FalsePositives == nil {
+		return writeJSONError(w, http.StatusConflict, "false positive reports require the false_positives directive")
+	}
+	ruleID := r.URL.Query().Get("rule_id")
+	if ruleID == "" {
+		return writeJSONError(w, http.StatusBadRequest, "rule_id is required")
+	}
+	if !m.FalsePositives.reset(ruleID) {
+		return writeJSONError(w, http.StatusNotFound, "no false positive reports for rule "+ruleID)
+	}
+	m.logger.Info("False positive reports cleared via admin API", zap.String("rule_id", ruleID), zap.String("remote_addr", r.RemoteAddr))
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "cleared", "rule_id": ruleID})
+}
@@ -0,0 +1,105 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFalsePositiveConfig_Report(t *testing.T) {
+	config := &FalsePositiveConfig{DisableRate: 20, MinReports: 3}
+	require.NoError(t, config.provision())
+	now := time.Now()
+
+	report := FalsePositiveReport{RuleID: "942100", Host: "Shop.example.com", Path: "/search"}
+	assert.False(t, config.report(report, 10, now))
+	assert.False(t, config.report(report, 10, now), "below min_reports")
+	assert.False(t, config.report(FalsePositiveReport{RuleID: "942100", Path: "/cart"}, 100, now), "below disable_rate")
+	assert.False(t, config.disabled("942100"))
+	assert.True(t, config.report(report, 15, now), "4 of 15 hits reported")
+	assert.True(t, config.disabled("942100"))
+	assert.False(t, config.report(report, 15, now), "already disabled")
+
+	stats := config.stats(
+		func(string) int64 { return 15 },
+		func(string) (Rule, bool) { return Rule{Condition: `request.method == "GET"`}, true },
+	)
+	require.Len(t, stats, 1)
+	assert.Equal(t, 5, stats[0].Reports)
+	assert.InDelta(t, 33.3, stats[0].Rate, 0.1)
+	assert.True(t, stats[0].Disabled)
+	assert.Equal(t, []FalsePositiveSuggestion{
+		{Scope: FalsePositiveScopePath, Value: "/search", Reports: 4, Exclusion: `(request.method == "GET") && request.path != "/search"`},
+		{Scope: FalsePositiveScopeHost, Value: "shop.example.com", Reports: 4, Exclusion: "host shop.example.com {\n\tdisable_rule 942100\n}"},
+	}, stats[0].Suggestions, "/cart was reported once")
+
+	assert.True(t, config.reset("942100"))
+	assert.False(t, config.reset("942100"))
+	assert.False(t, config.disabled("942100"))
+
+	assert.Error(t, (&FalsePositiveConfig{DisableRate: 150}).provision())
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	assert.Equal(t, 10.0, falsePositiveRate(1, 10))
+	assert.Equal(t, 100.0, falsePositiveRate(3, 0), "hits reset with the metrics")
+	assert.Equal(t, 0.0, falsePositiveRate(0, 0))
+}
+
+func TestHandleFalsePositiveRequests(t *testing.T) {
+	m := newAPITestMiddleware()
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/false-positives", strings.NewReader(body))))
+		return w
+	}
+	assert.Equal(t, http.StatusConflict, post(`{"rule_id": "sqli"}`).Code)
+
+	m.FalsePositives = &FalsePositiveConfig{DisableRate: 50, MinReports: 2}
+	require.NoError(t, m.FalsePositives.provision())
+	m.Rules = map[int][]Rule{2: {{ID: "sqli", Phase: 2, Pattern: "select", Targets: []string{"ARGS"}}}}
+	m.incrementRuleHitCount("sqli")
+	m.incrementRuleHitCount("sqli")
+	m.incrementRuleHitCount("sqli")
+	m.eventStore = newTestEventStore(t, 0)
+	require.NoError(t, m.eventStore.write([]BlockEvent{{Timestamp: time.Now(), LogID: "abc", RuleID: "sqli", Host: "example.com", Path: "/search"}}))
+
+	assert.Equal(t, http.StatusBadRequest, post(`{`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(`{"note": "no rule"}`).Code)
+	assert.Equal(t, http.StatusNotFound, post(`{"log_id": "missing"}`).Code)
+	assert.Equal(t, http.StatusNotFound, post(`{"rule_id": "unknown"}`).Code)
+
+	w := post(`{"log_id": "abc", "note": "search for 'select'"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "recorded", "rule_id": "sqli", "rule_disabled": false}`, w.Body.String())
+	w = post(`{"rule_id": "sqli", "path": "/search"}`)
+	assert.JSONEq(t, `{"status": "recorded", "rule_id": "sqli", "rule_disabled": true}`, w.Body.String())
+	assert.Equal(t, int64(2), m.fpReports.Load())
+
+	r := httptest.NewRequest("GET", "/search?q=select", nil)
+	assert.False(t, m.conditionHolds(&m.Rules[2][0], httptest.NewRecorder(), r, &WAFState{}), "the disabled rule doesn't apply")
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/false-positives", nil)))
+	var stats []FalsePositiveStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(3), stats[0].Hits)
+	require.Len(t, stats[0].Suggestions, 1)
+	assert.Equal(t, `request.path != "/search"`, stats[0].Suggestions[0].Exclusion)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/false-positives?rule_id=sqli", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, m.conditionHolds(&m.Rules[2][0], httptest.NewRecorder(), r, &WAFState{}))
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/false-positives", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
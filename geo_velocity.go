@@ -0,0 +1,165 @@
+package caddywaf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	geoVelocityRuleID         = "geo_velocity_rule"
+	defaultGeoVelocityMaxKeys = 100000
+	defaultGeoVelocityTTL     = 24 * time.Hour
+	defaultGeoVelocitySpeed   = 1000 // km/h, about the speed of an airliner
+	defaultGeoVelocityMinDist = 500  // km, below this GeoIP inaccuracy dominates
+	earthRadiusKm             = 6371
+)
+
+// geoVelocityKeyPrefixes are the targets that can identify a session or user.
+var geoVelocityKeyPrefixes = []string{TargetCookiesPrefix, TargetHeadersPrefix, TargetURLParamPrefix, TargetJSONPathPrefix}
+
+// GeoVelocityConfig detects sessions or users whose requests come from countries too far
+// apart to travel between in the time elapsed, such as a stolen session cookie replayed
+// from abroad.
+type GeoVelocityConfig struct {
+	Key         string        `json:"key"`                    // Target identifying the session or user, such as COOKIES:session
+	MaxSpeed    float64       `json:"max_speed,omitempty"`    // Fastest plausible travel in km/h, default 1000
+	MinDistance float64       `json:"min_distance,omitempty"` // Shorter hops are ignored, in km, default 500
+	TTL         time.Duration `json:"ttl,omitempty"`          // How long the last location of a key is kept, default 24h
+	MaxKeys     int           `json:"max_keys,omitempty"`     // Keys tracked at most, default 100000
+	Action      string        `json:"action,omitempty"`       // score (default) or challenge
+	Score       int           `json:"score,omitempty"`        // Score added with the score action, default 5
+
+	sightings *lookupCache[geoSighting]
+}
+
+// geoSighting is where and when a key was last seen.
+type geoSighting struct {
+	country   string
+	latitude  float64
+	longitude float64
+	seen      time.Time
+}
+
+// provision validates the config and applies the defaults.
+func (c *GeoVelocityConfig) provision() error {
+	valid := false
+	for _, prefix := range geoVelocityKeyPrefixes {
+		if name, ok := strings.CutPrefix(c.Key, prefix); ok && name != "" {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid geo_velocity key %q, must be one of %s followed by a name", c.Key, strings.Join(geoVelocityKeyPrefixes, ", "))
+	}
+	switch c.Action {
+	case "":
+		c.Action = detectionActionScore
+	case detectionActionScore, credentialActionChallenge:
+	default:
+		return fmt.Errorf("invalid geo_velocity action: %s, must be score or challenge", c.Action)
+	}
+	if c.MaxSpeed <= 0 {
+		c.MaxSpeed = defaultGeoVelocitySpeed
+	}
+	if c.MinDistance <= 0 {
+		c.MinDistance = defaultGeoVelocityMinDist
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultGeoVelocityTTL
+	}
+	if c.MaxKeys <= 0 {
+		c.MaxKeys = defaultGeoVelocityMaxKeys
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	c.sightings = newLookupCache[geoSighting](c.MaxKeys, c.TTL)
+	return nil
+}
+
+// sighting returns the location of a GeoIP record: the city location when the database
+// has one, otherwise the center of the country.
+func sighting(record GeoIPRecord, now time.Time) (geoSighting, bool) {
+	s := geoSighting{country: record.Country.ISOCode, seen: now}
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		s.latitude, s.longitude = record.Location.Latitude, record.Location.Longitude
+		return s, true
+	}
+	center, ok := countryCentroids[s.country]
+	s.latitude, s.longitude = center[0], center[1]
+	return s, ok
+}
+
+// distanceKm returns the great-circle distance between two sightings.
+func distanceKm(a, b geoSighting) float64 {
+	lat1, lat2 := a.latitude*math.Pi/180, b.latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.longitude - a.longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// travel records a sighting of key and returns why reaching it from the previous one is
+// impossible, or an empty string.
+func (c *GeoVelocityConfig) travel(key string, current geoSighting) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	hashed := strconv.FormatUint(h.Sum64(), 16)
+	previous, ok := c.sightings.Get(hashed)
+	c.sightings.Set(hashed, current)
+	if !ok || previous.country == current.country {
+		return ""
+	}
+	distance := distanceKm(previous, current)
+	if distance < c.MinDistance {
+		return ""
+	}
+	elapsed := max(current.seen.Sub(previous.seen), time.Second)
+	speed := distance / elapsed.Hours()
+	if speed <= c.MaxSpeed {
+		return ""
+	}
+	return fmt.Sprintf("%s to %s, %.0f km in %s", previous.country, current.country, distance, elapsed.Round(time.Second))
+}
+
+// checkGeoVelocity compares the location of the request with the previous one of its
+// session or user, adding score or serving a challenge on impossible travel. It reports
+// whether the request was blocked or challenged.
+func (m *Middleware) checkGeoVelocity(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.GeoVelocity
+	if config == nil || config.sightings == nil {
+		return false
+	}
+	key, err := m.extractTarget(config.Key, r, nil, state)
+	if err != nil || key == "" {
+		return false
+	}
+	record, ok := m.lookupGeoRecord(state, r.RemoteAddr)
+	if !ok {
+		return false
+	}
+	current, ok := sighting(record, time.Now())
+	if !ok {
+		return false
+	}
+	reason := config.travel(m.scopedKey(r, key), current)
+	if reason == "" {
+		return false
+	}
+
+	m.geoVelocityHits.Add(1)
+	m.incrementRuleHitCount(RuleID(geoVelocityRuleID))
+	state.MatchedRules = append(state.MatchedRules, geoVelocityRuleID)
+	if config.Action == credentialActionChallenge {
+		return m.challenge(w, r, state, "impossible travel: "+reason, geoVelocityRuleID)
+	}
+	return m.applyDetection(w, r, state, config.Action, config.Score, http.StatusForbidden, "geo_velocity", geoVelocityRuleID,
+		"Impossible travel detected", zap.String("travel", reason))
+}
@@ -0,0 +1,87 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func countrySighting(t *testing.T, country string, seen time.Time) geoSighting {
+	t.Helper()
+	var record GeoIPRecord
+	record.Country.ISOCode = country
+	s, ok := sighting(record, seen)
+	require.True(t, ok, country)
+	return s
+}
+
+func TestDistanceKm(t *testing.T) {
+	paris := geoSighting{latitude: 48.86, longitude: 2.35}
+	newYork := geoSighting{latitude: 40.71, longitude: -74.01}
+	assert.InDelta(t, 5837, distanceKm(paris, newYork), 20)
+	assert.InDelta(t, 0, distanceKm(paris, paris), 0.001)
+}
+
+func TestSighting(t *testing.T) {
+	var record GeoIPRecord
+	record.Country.ISOCode = "FR"
+	record.Location.Latitude, record.Location.Longitude = 43.3, 5.4
+	s, ok := sighting(record, time.Now())
+	require.True(t, ok)
+	assert.Equal(t, 43.3, s.latitude, "the city location wins over the country center")
+
+	record.Location.Latitude, record.Location.Longitude = 0, 0
+	s, ok = sighting(record, time.Now())
+	require.True(t, ok)
+	assert.Equal(t, countryCentroids["FR"][0], s.latitude)
+
+	record.Country.ISOCode = "ZZ"
+	_, ok = sighting(record, time.Now())
+	assert.False(t, ok)
+}
+
+func TestGeoVelocity_Travel(t *testing.T) {
+	c := &GeoVelocityConfig{Key: "COOKIES:session", MinDistance: 600}
+	require.NoError(t, c.provision())
+	now := time.Now()
+
+	assert.Empty(t, c.travel("s1", countrySighting(t, "FR", now)), "first sighting")
+	assert.Empty(t, c.travel("s1", countrySighting(t, "FR", now.Add(time.Minute))), "same country")
+	assert.Empty(t, c.travel("s1", countrySighting(t, "BE", now.Add(2*time.Minute))), "neighbouring countries are below min_distance")
+	assert.Contains(t, c.travel("s1", countrySighting(t, "AU", now.Add(time.Hour))), "BE to AU")
+	assert.Empty(t, c.travel("s1", countrySighting(t, "US", now.Add(48*time.Hour))), "slow enough to fly")
+	assert.Empty(t, c.travel("s2", countrySighting(t, "JP", now.Add(48*time.Hour))), "keys are tracked separately")
+}
+
+func TestGeoVelocityConfig_Provision(t *testing.T) {
+	c := &GeoVelocityConfig{Key: "HEADERS:X-User-ID"}
+	require.NoError(t, c.provision())
+	assert.Equal(t, detectionActionScore, c.Action)
+	assert.Equal(t, float64(defaultGeoVelocitySpeed), c.MaxSpeed)
+	assert.Equal(t, defaultGeoVelocityTTL, c.TTL)
+
+	for _, config := range []GeoVelocityConfig{
+		{Key: "session"},
+		{Key: "COOKIES:"},
+		{Key: "COOKIES:session", Action: "block"},
+	} {
+		assert.Error(t, config.provision(), config.Key)
+	}
+}
+
+func TestCheckGeoVelocity_WithoutGeoIP(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		GeoVelocity:           &GeoVelocityConfig{Key: "COOKIES:session"},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	require.NoError(t, m.GeoVelocity.provision())
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	assert.False(t, m.checkGeoVelocity(httptest.NewRecorder(), req, &WAFState{}))
+}
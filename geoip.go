@@ -3,19 +3,23 @@ package caddywaf
 import (
 	"fmt"
 	"net"
+	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
 )
 
+const (
+	geoIPReloadDebounce = 2 * time.Second // Lets geoipupdate finish writing before reopening
+)
+
 // GeoIPHandler struct
 type GeoIPHandler struct {
 	logger                      *zap.Logger
-	geoIPCache                  map[string]GeoIPRecord
-	geoIPCacheMutex             sync.RWMutex
+	geoIPCache                  *lookupCache[GeoIPRecord]
 	geoIPCacheTTL               time.Duration // Configurable TTL for cache
 	geoIPLookupFallbackBehavior string        // "default", "none", or a specific country code
 }
@@ -28,10 +32,10 @@ func NewGeoIPHandler(logger *zap.Logger) *GeoIPHandler {
 	return &GeoIPHandler{logger: logger}
 }
 
-// WithGeoIPCache enables GeoIP lookup caching.
-func (gh *GeoIPHandler) WithGeoIPCache(ttl time.Duration) {
-	gh.geoIPCache = make(map[string]GeoIPRecord)
-	gh.geoIPCacheTTL = ttl
+// WithGeoIPCache enables caching of up to size GeoIP lookups for ttl; zero values use the defaults.
+func (gh *GeoIPHandler) WithGeoIPCache(ttl time.Duration, size int) {
+	gh.geoIPCache = newLookupCache[GeoIPRecord](size, ttl)
+	gh.geoIPCacheTTL = gh.geoIPCache.ttl
 }
 
 // WithGeoIPLookupFallbackBehavior configures the fallback behavior for GeoIP lookups.
@@ -100,12 +104,9 @@ func (gh *GeoIPHandler) GetCountryCode(remoteAddr string, geoIP *maxminddb.Reade
 func (gh *GeoIPHandler) isCountryInListWithCache(ip string, parsedIP net.IP, countryList []string, geoIP *maxminddb.Reader) (bool, error) {
 	// Check cache first
 	if gh.geoIPCache != nil {
-		gh.geoIPCacheMutex.RLock()
-		if record, ok := gh.geoIPCache[ip]; ok {
-			gh.geoIPCacheMutex.RUnlock()
+		if record, ok := gh.geoIPCache.Get(ip); ok {
 			return gh.isCountryInRecord(record, countryList), nil
 		}
-		gh.geoIPCacheMutex.RUnlock()
 	}
 
 	var record GeoIPRecord
@@ -117,7 +118,7 @@ func (gh *GeoIPHandler) isCountryInListWithCache(ip string, parsedIP net.IP, cou
 
 	// Cache the record
 	if gh.geoIPCache != nil {
-		gh.cacheGeoIPRecord(ip, record) // Helper function for caching
+		gh.geoIPCache.Set(ip, record)
 	}
 	return gh.isCountryInRecord(record, countryList), nil // Helper function for country check
 }
@@ -125,12 +126,9 @@ func (gh *GeoIPHandler) isCountryInListWithCache(ip string, parsedIP net.IP, cou
 func (gh *GeoIPHandler) getCountryCodeWithCache(ip string, parsedIP net.IP, geoIP *maxminddb.Reader) string {
 	// Check cache first for GetCountryCode as well for consistency and potential perf gain
 	if gh.geoIPCache != nil {
-		gh.geoIPCacheMutex.RLock()
-		if record, ok := gh.geoIPCache[ip]; ok {
-			gh.geoIPCacheMutex.RUnlock()
+		if record, ok := gh.geoIPCache.Get(ip); ok {
 			return record.Country.ISOCode
 		}
-		gh.geoIPCacheMutex.RUnlock()
 	}
 
 	var record GeoIPRecord
@@ -142,15 +140,37 @@ func (gh *GeoIPHandler) getCountryCodeWithCache(ip string, parsedIP net.IP, geoI
 
 	// Cache the record for GetCountryCode as well
 	if gh.geoIPCache != nil {
-		gh.cacheGeoIPRecord(ip, record)
+		gh.geoIPCache.Set(ip, record)
 	}
 
 	return record.Country.ISOCode
 }
 
+// GetRecord returns the GeoIP record of an IP, using the cache when enabled.
+func (gh *GeoIPHandler) GetRecord(remoteAddr string, geoIP *maxminddb.Reader) (GeoIPRecord, bool) {
+	ip := extractIP(remoteAddr)
+	parsedIP := net.ParseIP(ip)
+	if geoIP == nil || parsedIP == nil {
+		return GeoIPRecord{}, false
+	}
+	if gh.geoIPCache != nil {
+		if record, ok := gh.geoIPCache.Get(ip); ok {
+			return record, record.Country.ISOCode != ""
+		}
+	}
+	var record GeoIPRecord
+	if err := geoIP.Lookup(parsedIP, &record); err != nil {
+		gh.logger.Debug("GeoIP lookup failed for GetRecord", zap.String("ip", ip), zap.Error(err))
+		return GeoIPRecord{}, false
+	}
+	if gh.geoIPCache != nil {
+		gh.geoIPCache.Set(ip, record)
+	}
+	return record, record.Country.ISOCode != ""
+}
+
 // Helper function to check if the country in the record is in the country list
 func (gh *GeoIPHandler) isCountryInRecord(record GeoIPRecord, countryList []string) bool {
-	fmt.Println("isCountryInRecord", record.Country.ISOCode, countryList)
 	for _, country := range countryList {
 		if strings.EqualFold(record.Country.ISOCode, country) {
 			return true
@@ -183,18 +203,115 @@ func (gh *GeoIPHandler) handleGeoIPLookupError(err error, countryList []string)
 	}
 }
 
-// Helper function to cache GeoIP record
-func (gh *GeoIPHandler) cacheGeoIPRecord(ip string, record GeoIPRecord) {
-	gh.geoIPCacheMutex.Lock()
-	gh.geoIPCache[ip] = record
-	gh.geoIPCacheMutex.Unlock()
+// ClearCache drops all cached lookups, e.g. after the database changed.
+func (gh *GeoIPHandler) ClearCache() {
+	if gh.geoIPCache != nil {
+		gh.geoIPCache.Clear()
+	}
+}
 
-	// Invalidate cache entry after TTL
-	if gh.geoIPCacheTTL > 0 {
-		time.AfterFunc(gh.geoIPCacheTTL, func() {
-			gh.geoIPCacheMutex.Lock()
-			delete(gh.geoIPCache, ip)
-			gh.geoIPCacheMutex.Unlock()
-		})
+// requestGeoIP returns the GeoIP database of a request, loaded on first use and kept until
+// the request ends: a reload may replace the database meanwhile, and the replaced one stays
+// mapped until no request holds it.
+func (m *Middleware) requestGeoIP(state *WAFState) *maxminddb.Reader {
+	if state.geoIP == nil {
+		state.geoIP = m.CountryBlacklist.geoIP.Load()
+		if state.geoIP == nil {
+			state.geoIP = m.CountryWhitelist.geoIP.Load()
+		}
+	}
+	return state.geoIP
+}
+
+// lookupCountry returns the country code of the client, or an empty string if no GeoIP database is loaded.
+func (m *Middleware) lookupCountry(state *WAFState, remoteAddr string) string {
+	geoIP := m.requestGeoIP(state)
+	if geoIP == nil || m.geoIPHandler == nil {
+		return ""
+	}
+	if code := m.geoIPHandler.GetCountryCode(remoteAddr, geoIP); code != "N/A" {
+		return code
 	}
+	return ""
+}
+
+// lookupGeoRecord returns the GeoIP record of the client, if a GeoIP database is loaded
+// and knows the client's country.
+func (m *Middleware) lookupGeoRecord(state *WAFState, remoteAddr string) (GeoIPRecord, bool) {
+	if m.geoIPHandler == nil {
+		return GeoIPRecord{}, false
+	}
+	return m.geoIPHandler.GetRecord(remoteAddr, m.requestGeoIP(state))
+}
+
+// reloadGeoIP reopens the GeoIP database and swaps it in for country filtering. The replaced
+// reader isn't closed, as requests that loaded it may still use it: it is unmapped by its
+// finalizer once none of them holds it.
+func (m *Middleware) reloadGeoIP(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen GeoIP database: %w", err)
+	}
+
+	if m.CountryBlacklist.Enabled {
+		m.CountryBlacklist.geoIP.Store(reader)
+	}
+	if m.CountryWhitelist.Enabled {
+		m.CountryWhitelist.geoIP.Store(reader)
+	}
+
+	if m.geoIPHandler != nil {
+		m.geoIPHandler.ClearCache()
+	}
+	m.logger.Info("GeoIP database reloaded",
+		zap.String("path", path),
+		zap.Time("build_date", time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()),
+	)
+	return nil
+}
+
+// watchGeoIPDatabase reloads the GeoIP database when its file is written or
+// replaced. The directory is watched, since tools such as geoipupdate rename a
+// new file over the old one.
+func (m *Middleware) watchGeoIPDatabase(path string) {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		m.logger.Error("Failed to start GeoIP database watcher", zap.Error(err))
+		m.recordWatch(path, false, false, err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		m.logger.Error("Failed to watch GeoIP database", zap.String("path", path), zap.Error(err))
+		m.recordWatch(path, false, false, err)
+		return
+	}
+	m.recordWatch(path, true, false, nil)
+	m.geoIPWatchStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce = time.After(geoIPReloadDebounce)
+				}
+			case <-debounce:
+				debounce = nil
+				err := m.reloadGeoIP(path)
+				if err != nil {
+					m.logger.Error("Failed to reload GeoIP database", zap.String("path", path), zap.Error(err))
+				}
+				m.recordWatch(path, true, true, err)
+			case err := <-watcher.Errors:
+				m.logger.Error("GeoIP database watcher error", zap.Error(err))
+				m.recordWatch(path, true, false, err)
+			case <-stop:
+				return
+			}
+		}
+	}(m.geoIPWatchStop)
 }
@@ -1,10 +1,14 @@
 package caddywaf
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/oschwald/maxminddb-golang"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -25,7 +29,7 @@ func TestNewGeoIPHandler(t *testing.T) {
 func TestWithGeoIPCache(t *testing.T) {
 	handler := NewGeoIPHandler(nil)
 	ttl := 5 * time.Minute
-	handler.WithGeoIPCache(ttl)
+	handler.WithGeoIPCache(ttl, 0)
 
 	if handler.geoIPCache == nil {
 		t.Error("Cache not initialized")
@@ -136,3 +140,60 @@ func TestWithGeoIPLookupFallbackBehaviorSetup(t *testing.T) {
 	handler.WithGeoIPLookupFallbackBehavior("default")
 	assert.Equal(t, "default", handler.geoIPLookupFallbackBehavior)
 }
+
+func TestBuildTestMMDB(t *testing.T) {
+	reader, err := maxminddb.FromBytes(buildTestMMDB(1700000000))
+	require.NoError(t, err)
+	assert.Equal(t, uint(1700000000), reader.Metadata.BuildEpoch)
+}
+
+func TestReloadGeoIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	require.NoError(t, os.WriteFile(path, buildTestMMDB(1), 0o600))
+	old, err := maxminddb.Open(path)
+	require.NoError(t, err)
+
+	m := &Middleware{logger: zap.NewNop(), geoIPHandler: NewGeoIPHandler(nil)}
+	m.geoIPHandler.WithGeoIPCache(time.Minute, 0)
+	m.geoIPHandler.geoIPCache.Set("1.1.1.1", GeoIPRecord{})
+	m.CountryBlacklist = CountryAccessFilter{Enabled: true}
+	m.CountryBlacklist.geoIP.Store(old)
+	state := &WAFState{}
+	assert.Same(t, old, m.requestGeoIP(state))
+
+	require.NoError(t, os.WriteFile(path, buildTestMMDB(2), 0o600))
+	require.NoError(t, m.reloadGeoIP(path))
+	assert.Equal(t, uint(2), m.CountryBlacklist.geoIP.Load().Metadata.BuildEpoch)
+	assert.Nil(t, m.CountryWhitelist.geoIP.Load(), "disabled filters are left alone")
+	assert.Same(t, old, m.requestGeoIP(state), "requests keep the database they started with")
+	assert.Equal(t, uint(1), old.Metadata.BuildEpoch)
+	assert.Zero(t, m.geoIPHandler.geoIPCache.Stats().Entries, "cached lookups are dropped")
+	assert.NotPanics(t, func() { m.geoIPHandler.GetRecord("1.1.1.1:80", m.requestGeoIP(state)) }, "the replaced database is still mapped")
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	assert.Error(t, m.reloadGeoIP(path))
+	assert.Equal(t, uint(2), m.CountryBlacklist.geoIP.Load().Metadata.BuildEpoch, "a broken file keeps the current reader")
+}
+
+func TestWatchGeoIPDatabase_Replace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country.mmdb")
+	require.NoError(t, os.WriteFile(path, buildTestMMDB(1), 0o600))
+	reader, err := maxminddb.Open(path)
+	require.NoError(t, err)
+
+	m := &Middleware{logger: zap.NewNop()}
+	m.CountryWhitelist = CountryAccessFilter{Enabled: true}
+	m.CountryWhitelist.geoIP.Store(reader)
+	m.watchGeoIPDatabase(path)
+	defer close(m.geoIPWatchStop)
+
+	// geoipupdate writes a temporary file and renames it over the database
+	tmp := filepath.Join(dir, "country.mmdb.tmp")
+	require.NoError(t, os.WriteFile(tmp, buildTestMMDB(2), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+
+	require.Eventually(t, func() bool {
+		return m.CountryWhitelist.geoIP.Load().Metadata.BuildEpoch == 2
+	}, 10*time.Second, 50*time.Millisecond)
+}
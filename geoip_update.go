@@ -0,0 +1,290 @@
+package caddywaf
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var maxMindDownloadURL = "https://download.maxmind.com/geoip/databases"
+
+const (
+	defaultGeoIPUpdateInterval = 24 * time.Hour
+	defaultGeoIPEdition        = "GeoLite2-Country"
+	geoIPUpdateRetryInterval   = time.Hour
+	maxGeoIPArchiveSize        = 512 << 20
+)
+
+// GeoIPUpdateConfig configures scheduled downloads of MaxMind databases.
+type GeoIPUpdateConfig struct {
+	AccountID  string        `json:"account_id"`
+	LicenseKey string        `json:"license_key"`
+	Editions   []string      `json:"editions,omitempty"`  // Default GeoLite2-Country
+	Interval   time.Duration `json:"interval,omitempty"`  // Default 24h
+	CacheDir   string        `json:"cache_dir,omitempty"` // Receives <edition>.mmdb, defaults to a directory in Caddy's data dir
+}
+
+// GeoIPUpdateStatus reports the last download attempt of an edition.
+type GeoIPUpdateStatus struct {
+	Path        string     `json:"path"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastUpdate  *time.Time `json:"last_update,omitempty"` // Last time a new database was written
+	LastSuccess *time.Time `json:"-"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// GeoIPUpdater downloads MaxMind editions into a cache directory on a schedule.
+// A database is only replaced when the published SHA-256 differs from the last
+// download and the downloaded archive matches it.
+type GeoIPUpdater struct {
+	logger *zap.Logger
+	config GeoIPUpdateConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	status map[string]*GeoIPUpdateStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewGeoIPUpdater validates the config, applies defaults and creates the cache directory.
+func NewGeoIPUpdater(logger *zap.Logger, config GeoIPUpdateConfig) (*GeoIPUpdater, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.AccountID == "" || config.LicenseKey == "" {
+		return nil, fmt.Errorf("geoip_update requires account_id and license_key")
+	}
+	if len(config.Editions) == 0 {
+		config.Editions = []string{defaultGeoIPEdition}
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultGeoIPUpdateInterval
+	}
+	if config.CacheDir == "" {
+		config.CacheDir = filepath.Join(caddy.AppDataDir(), "caddy-waf", "geoip")
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create geoip_update cache_dir %s: %w", config.CacheDir, err)
+	}
+	gu := &GeoIPUpdater{
+		logger: logger,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Minute},
+		status: make(map[string]*GeoIPUpdateStatus),
+	}
+	for _, edition := range config.Editions {
+		gu.status[edition] = &GeoIPUpdateStatus{Path: gu.Path(edition)}
+	}
+	return gu, nil
+}
+
+// Path returns the cache file of an edition.
+func (gu *GeoIPUpdater) Path(edition string) string {
+	return filepath.Join(gu.config.CacheDir, edition+".mmdb")
+}
+
+// UpdateMissing downloads the editions that have no cache file yet, so they can
+// be loaded during provisioning.
+func (gu *GeoIPUpdater) UpdateMissing(ctx context.Context) {
+	for _, edition := range gu.config.Editions {
+		if !fileExists(gu.Path(edition)) {
+			gu.update(ctx, edition)
+		}
+	}
+}
+
+// Start checks every edition for updates on the configured interval.
+func (gu *GeoIPUpdater) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	gu.cancel = cancel
+	gu.done = make(chan struct{})
+	go func() {
+		defer close(gu.done)
+		for {
+			wait := gu.config.Interval
+			for _, edition := range gu.config.Editions {
+				if !gu.update(ctx, edition) && geoIPUpdateRetryInterval < wait {
+					wait = geoIPUpdateRetryInterval
+				}
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the update schedule.
+func (gu *GeoIPUpdater) Stop() {
+	if gu.cancel == nil {
+		return
+	}
+	gu.cancel()
+	<-gu.done
+}
+
+// update checks an edition and downloads it if it changed. It reports whether the check succeeded.
+func (gu *GeoIPUpdater) update(ctx context.Context, edition string) bool {
+	updated, err := gu.download(ctx, edition)
+	now := time.Now()
+
+	gu.mu.Lock()
+	defer gu.mu.Unlock()
+	s := gu.status[edition]
+	s.LastCheck = &now
+	if err != nil {
+		if ctx.Err() == nil {
+			gu.logger.Error("GeoIP database update failed", zap.String("edition", edition), zap.Error(err))
+		}
+		s.LastError = err.Error()
+		return false
+	}
+	s.LastError = ""
+	s.LastSuccess = &now
+	if updated {
+		s.LastUpdate = &now
+		gu.logger.Info("GeoIP database updated", zap.String("edition", edition), zap.String("path", s.Path))
+	} else {
+		gu.logger.Debug("GeoIP database is up to date", zap.String("edition", edition))
+	}
+	return true
+}
+
+// download fetches the published checksum and, if it changed, the archive of an edition.
+func (gu *GeoIPUpdater) download(ctx context.Context, edition string) (bool, error) {
+	checksumPath := filepath.Join(gu.config.CacheDir, edition+".sha256")
+	body, err := gu.get(ctx, edition, "tar.gz.sha256")
+	if err != nil {
+		return false, err
+	}
+	checksumLine, err := io.ReadAll(io.LimitReader(body, 1024))
+	body.Close()
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(checksumLine))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return false, fmt.Errorf("invalid checksum response for %s", edition)
+	}
+	expected := strings.ToLower(fields[0])
+	if previous, err := os.ReadFile(checksumPath); err == nil && strings.TrimSpace(string(previous)) == expected && fileExists(gu.Path(edition)) {
+		return false, nil
+	}
+
+	body, err = gu.get(ctx, edition, "tar.gz")
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	archive, err := os.CreateTemp(gu.config.CacheDir, edition+".*.tar.gz")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(archive, hash), io.LimitReader(body, maxGeoIPArchiveSize)); err != nil {
+		return false, fmt.Errorf("failed to download %s: %w", edition, err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return false, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", edition, expected, actual)
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := gu.extract(archive, edition); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(checksumPath, []byte(expected+"\n")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// get requests a file of an edition from the download API.
+func (gu *GeoIPUpdater) get(ctx context.Context, edition, suffix string) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s/%s/download?suffix=%s", maxMindDownloadURL, edition, suffix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(gu.config.AccountID, gu.config.LicenseKey)
+	resp, err := gu.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download of %s (%s) returned status %s", edition, suffix, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// extract writes the .mmdb file of a tar.gz archive to the edition's cache file.
+func (gu *GeoIPUpdater) extract(archive io.Reader, edition string) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("invalid archive for %s: %w", edition, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("archive for %s contains no %s.mmdb", edition, edition)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive for %s: %w", edition, err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != edition+".mmdb" {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxGeoIPArchiveSize))
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(gu.Path(edition), data)
+	}
+}
+
+// Status returns the update state of every edition.
+func (gu *GeoIPUpdater) Status() map[string]GeoIPUpdateStatus {
+	gu.mu.Lock()
+	defer gu.mu.Unlock()
+	status := make(map[string]GeoIPUpdateStatus, len(gu.status))
+	for edition, s := range gu.status {
+		status[edition] = *s
+	}
+	return status
+}
+
+// stale reports whether an edition has not been checked successfully for two intervals.
+func (gu *GeoIPUpdater) stale(s GeoIPUpdateStatus, now time.Time) bool {
+	if s.LastCheck == nil {
+		return false
+	}
+	if s.LastSuccess == nil {
+		return s.LastError != ""
+	}
+	return now.Sub(*s.LastSuccess) > 2*gu.config.Interval
+}
@@ -0,0 +1,166 @@
+package caddywaf
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// buildTestArchive packs an .mmdb file the way MaxMind's download API does.
+func buildTestArchive(t *testing.T, edition string, mmdb []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{edition + "_20250101/COPYRIGHT.txt", []byte("test")},
+		{edition + "_20250101/" + edition + ".mmdb", mmdb},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(f.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// fakeMaxMind serves one archive per edition and counts the archive downloads.
+type fakeMaxMind struct {
+	archive   atomic.Value // []byte
+	checksum  atomic.Value // string, overrides the archive checksum when set
+	downloads atomic.Int64
+}
+
+func newFakeMaxMind(t *testing.T, archive []byte) *fakeMaxMind {
+	f := &fakeMaxMind{}
+	f.archive.Store(archive)
+	f.checksum.Store("")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "12345" || pass != "key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/GeoLite2-Country/download" {
+			http.NotFound(w, r)
+			return
+		}
+		archive := f.archive.Load().([]byte)
+		switch r.URL.Query().Get("suffix") {
+		case "tar.gz.sha256":
+			checksum := f.checksum.Load().(string)
+			if checksum == "" {
+				sum := sha256.Sum256(archive)
+				checksum = hex.EncodeToString(sum[:])
+			}
+			_, _ = w.Write([]byte(checksum + "  GeoLite2-Country_20250101.tar.gz\n"))
+		case "tar.gz":
+			f.downloads.Add(1)
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	previous := maxMindDownloadURL
+	maxMindDownloadURL = srv.URL
+	t.Cleanup(func() { maxMindDownloadURL = previous })
+	return f
+}
+
+func TestGeoIPUpdater_Download(t *testing.T) {
+	mm := newFakeMaxMind(t, buildTestArchive(t, "GeoLite2-Country", buildTestMMDB(1000)))
+	gu, err := NewGeoIPUpdater(zap.NewNop(), GeoIPUpdateConfig{AccountID: "12345", LicenseKey: "key", CacheDir: t.TempDir()})
+	require.NoError(t, err)
+
+	gu.UpdateMissing(context.Background())
+	reader, err := maxminddb.Open(gu.Path("GeoLite2-Country"))
+	require.NoError(t, err)
+	assert.Equal(t, uint(1000), reader.Metadata.BuildEpoch)
+	reader.Close()
+	status := gu.Status()["GeoLite2-Country"]
+	assert.Empty(t, status.LastError)
+	require.NotNil(t, status.LastUpdate)
+
+	// Present databases are not downloaded again at startup
+	gu.UpdateMissing(context.Background())
+	assert.Equal(t, int64(1), mm.downloads.Load())
+
+	// An unchanged checksum skips the download
+	assert.True(t, gu.update(context.Background(), "GeoLite2-Country"))
+	assert.Equal(t, int64(1), mm.downloads.Load())
+	assert.Equal(t, *status.LastUpdate, *gu.Status()["GeoLite2-Country"].LastUpdate)
+
+	// A new release replaces the database
+	mm.archive.Store(buildTestArchive(t, "GeoLite2-Country", buildTestMMDB(2000)))
+	assert.True(t, gu.update(context.Background(), "GeoLite2-Country"))
+	assert.Equal(t, int64(2), mm.downloads.Load())
+	reader, err = maxminddb.Open(gu.Path("GeoLite2-Country"))
+	require.NoError(t, err)
+	assert.Equal(t, uint(2000), reader.Metadata.BuildEpoch)
+	reader.Close()
+}
+
+func TestGeoIPUpdater_ChecksumMismatch(t *testing.T) {
+	mm := newFakeMaxMind(t, buildTestArchive(t, "GeoLite2-Country", buildTestMMDB(1000)))
+	gu, err := NewGeoIPUpdater(zap.NewNop(), GeoIPUpdateConfig{AccountID: "12345", LicenseKey: "key", CacheDir: t.TempDir()})
+	require.NoError(t, err)
+	require.True(t, gu.update(context.Background(), "GeoLite2-Country"))
+	original, err := os.ReadFile(gu.Path("GeoLite2-Country"))
+	require.NoError(t, err)
+
+	mm.archive.Store(buildTestArchive(t, "GeoLite2-Country", buildTestMMDB(2000)))
+	mm.checksum.Store(hex.EncodeToString(make([]byte, sha256.Size)))
+	assert.False(t, gu.update(context.Background(), "GeoLite2-Country"))
+	assert.Contains(t, gu.Status()["GeoLite2-Country"].LastError, "checksum mismatch")
+
+	current, err := os.ReadFile(gu.Path("GeoLite2-Country"))
+	require.NoError(t, err)
+	assert.Equal(t, original, current, "a corrupt download must not replace the database")
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(gu.Path("GeoLite2-Country")), "*.tar.gz"))
+	assert.Empty(t, matches, "temporary archives are removed")
+}
+
+func TestGeoIPUpdater_Errors(t *testing.T) {
+	newFakeMaxMind(t, buildTestArchive(t, "GeoLite2-Country", buildTestMMDB(1000)))
+
+	gu, err := NewGeoIPUpdater(zap.NewNop(), GeoIPUpdateConfig{AccountID: "12345", LicenseKey: "wrong", CacheDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.False(t, gu.update(context.Background(), "GeoLite2-Country"))
+	assert.Contains(t, gu.Status()["GeoLite2-Country"].LastError, "401")
+	assert.False(t, fileExists(gu.Path("GeoLite2-Country")))
+
+	_, err = NewGeoIPUpdater(nil, GeoIPUpdateConfig{AccountID: "12345"})
+	assert.Error(t, err)
+}
+
+func TestGeoIPUpdater_Stale(t *testing.T) {
+	gu, err := NewGeoIPUpdater(nil, GeoIPUpdateConfig{AccountID: "12345", LicenseKey: "key", Interval: time.Hour, CacheDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultGeoIPEdition}, gu.config.Editions)
+	now := time.Now()
+	recent, old := now.Add(-time.Hour), now.Add(-3*time.Hour)
+
+	assert.False(t, gu.stale(GeoIPUpdateStatus{}, now), "never checked")
+	assert.True(t, gu.stale(GeoIPUpdateStatus{LastCheck: &now, LastError: "boom"}, now), "never succeeded")
+	assert.False(t, gu.stale(GeoIPUpdateStatus{LastCheck: &now, LastSuccess: &recent, LastError: "boom"}, now))
+	assert.True(t, gu.stale(GeoIPUpdateStatus{LastCheck: &now, LastSuccess: &old, LastError: "boom"}, now))
+}
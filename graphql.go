@@ -0,0 +1,163 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const graphQLRuleID = "graphql_rule"
+
+// defaultGraphQLPaths are the endpoints controlled when none are given.
+var defaultGraphQLPaths = []string{"/graphql"}
+
+// graphQLIntrospectionRegex matches the introspection meta-fields, but not __typename,
+// which clients routinely query.
+var graphQLIntrospectionRegex = regexp.MustCompile(`\b__(schema|type)\b`)
+
+// GraphQLConfig controls the queries sent to GraphQL endpoints, independently of the rules:
+// it blocks introspection, which maps the whole schema for attackers, and batches of more
+// operations than allowed, which multiply the cost of a request and the guesses of brute
+// force attempts.
+type GraphQLConfig struct {
+	Paths              []string `json:"paths,omitempty"`               // Endpoints, exact or prefixes ending in *, default /graphql
+	BlockIntrospection bool     `json:"block_introspection,omitempty"` // Blocks queries of __schema and __type
+	MaxOperations      int      `json:"max_operations,omitempty"`      // Operations allowed in a batched request, 0 for no limit
+}
+
+// graphQLOperation is an operation of a GraphQL request sent as JSON.
+type graphQLOperation struct {
+	Query string `json:"query"`
+}
+
+// provision validates the config and applies the defaults.
+func (c *GraphQLConfig) provision() error {
+	if !c.BlockIntrospection && c.MaxOperations <= 0 {
+		return fmt.Errorf("graphql requires block_introspection or max_operations")
+	}
+	if len(c.Paths) == 0 {
+		c.Paths = slices.Clone(defaultGraphQLPaths)
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("graphql path must start with /: %s", p)
+		}
+	}
+	return nil
+}
+
+// protects reports whether a path is a GraphQL endpoint.
+func (c *GraphQLConfig) protects(path string) bool {
+	return slices.ContainsFunc(c.Paths, func(p string) bool {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			return strings.HasPrefix(path, prefix)
+		}
+		return path == p
+	})
+}
+
+// graphQLQueries returns the queries of a GraphQL request: the query parameter, and the
+// body sent as application/graphql, or as JSON holding an operation or a batch of them.
+// Bodies that aren't valid JSON, such as bodies truncated by the inspection budget, are
+// left to the endpoint to reject.
+func (m *Middleware) graphQLQueries(r *http.Request, state *WAFState) []string {
+	queries := r.URL.Query()["query"]
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return queries
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil || body == "" {
+		return queries
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/graphql":
+		return append(queries, body)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var batch []graphQLOperation
+		if strings.HasPrefix(strings.TrimSpace(body), "[") {
+			if json.Unmarshal([]byte(body), &batch) != nil {
+				return queries
+			}
+		} else {
+			var operation graphQLOperation
+			if json.Unmarshal([]byte(body), &operation) != nil {
+				return queries
+			}
+			batch = append(batch, operation)
+		}
+		for _, operation := range batch {
+			queries = append(queries, operation.Query)
+		}
+	}
+	return queries
+}
+
+// stripGraphQLLiterals blanks out the strings, block strings and comments of a query, so
+// the names they mention aren't taken for fields.
+func stripGraphQLLiterals(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		switch {
+		case strings.HasPrefix(query[i:], `"""`):
+			end := strings.Index(query[i+3:], `"""`)
+			if end < 0 {
+				return b.String()
+			}
+			i += end + 5
+			b.WriteByte(' ')
+		case query[i] == '"':
+			for i++; i < len(query) && query[i] != '"' && query[i] != '\n'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			b.WriteByte(' ')
+		case query[i] == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(query[i])
+		}
+	}
+	return b.String()
+}
+
+// isGraphQLIntrospection reports whether a query selects an introspection meta-field.
+func isGraphQLIntrospection(query string) bool {
+	return strings.Contains(query, "__") && graphQLIntrospectionRegex.MatchString(stripGraphQLLiterals(query))
+}
+
+// checkGraphQL blocks in phase 2 the introspection queries and the batches of too many
+// operations sent to GraphQL endpoints. It reports whether the request was blocked.
+func (m *Middleware) checkGraphQL(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.GraphQL
+	if config == nil || !config.protects(r.URL.Path) {
+		return false
+	}
+	queries := m.graphQLQueries(r, state)
+	violation := ""
+	if config.MaxOperations > 0 && len(queries) > config.MaxOperations {
+		violation = "batch of " + strconv.Itoa(len(queries)) + " operations"
+	} else if config.BlockIntrospection && slices.ContainsFunc(queries, isGraphQLIntrospection) {
+		violation = "introspection"
+	}
+	if violation == "" {
+		return false
+	}
+	m.graphQLHits.Add(1)
+	m.blockRequest(w, r, state, http.StatusForbidden, "graphql", graphQLRuleID,
+		zap.String("message", "GraphQL request blocked"),
+		zap.String("violation", violation),
+	)
+	return true
+}
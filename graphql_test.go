@@ -0,0 +1,91 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestIsGraphQLIntrospection(t *testing.T) {
+	for query, introspection := range map[string]bool{
+		`{ __schema { types { name } } }`:                                 true,
+		`query IntrospectionQuery { __schema { queryType { name } } }`:    true,
+		`{ __type(name: "User") { fields { name } } }`:                    true,
+		"{ user(id: 1) { name }\n  t: __type (name: \"User\") { name } }": true,
+		`{ user(id: 1) { name __typename } }`:                             false,
+		`{ search(text: "__schema") { id } }`:                             false,
+		`{ search(text: """__type { name }""") { id } }`:                  false,
+		"{ user(id: 1) { name } # __schema\n }":                           false,
+		`{ search(text: "say \"__schema\"") { id } }`:                     false,
+	} {
+		assert.Equal(t, introspection, isGraphQLIntrospection(query), query)
+	}
+}
+
+func TestGraphQLConfig_Provision(t *testing.T) {
+	config := &GraphQLConfig{BlockIntrospection: true}
+	require.NoError(t, config.provision())
+	assert.Equal(t, []string{"/graphql"}, config.Paths)
+
+	for _, config := range []*GraphQLConfig{
+		{},
+		{Paths: []string{"/graphql"}},
+		{Paths: []string{"graphql"}, MaxOperations: 5},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckGraphQL(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.GraphQL = &GraphQLConfig{Paths: []string{"/graphql", "/api/graphql/*"}, BlockIntrospection: true, MaxOperations: 2}
+	require.NoError(t, m.GraphQL.provision())
+	introspection := `{"query": "{ __schema { types { name } } }"}`
+
+	for _, r := range []*http.Request{
+		testRequest("POST", "/graphql", "application/json", `{"query": "{ user(id: 1) { name __typename } }"}`),
+		testRequest("POST", "/graphql", "application/json", `[{"query": "{ a }"}, {"query": "{ b }"}]`),
+		testRequest("POST", "/graphql", "application/json", `{"query": "{ unterminated`),
+		testRequest("POST", "/rest/search", "application/json", introspection),
+	} {
+		assert.False(t, m.checkGraphQL(httptest.NewRecorder(), r, &WAFState{}))
+	}
+
+	r := testRequest("POST", "/graphql", "application/json", `{"query": "{ user(id: 1) { name } }"}`)
+	assert.False(t, m.checkGraphQL(httptest.NewRecorder(), r, &WAFState{}))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"query": "{ user(id: 1) { name } }"}`, string(body), "the upstream handler reads the body")
+
+	for _, r := range []*http.Request{
+		testRequest("POST", "/graphql", "application/json", introspection),
+		testRequest("POST", "/api/graphql/v2", "application/graphql", `{ __type(name: "User") { name } }`),
+		testRequest("GET", "/graphql?query="+url.QueryEscape(`{ __schema { types { name } } }`), "", ""),
+		testRequest("POST", "/graphql", "application/json", `[{"query": "{ a }"}, {"query": "{ __schema { types { name } } }"}]`),
+		testRequest("POST", "/graphql", "application/json", `[{"query": "{ a }"}, {"query": "{ b }"}, {"query": "{ c }"}]`),
+	} {
+		w := httptest.NewRecorder()
+		state := &WAFState{}
+		assert.True(t, m.checkGraphQL(w, r, state), r.URL.String())
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, graphQLRuleID, state.blockRuleID)
+	}
+	assert.Equal(t, int64(5), m.graphQLHits.Load())
+
+	m.GraphQL = &GraphQLConfig{MaxOperations: 2}
+	require.NoError(t, m.GraphQL.provision())
+	assert.False(t, m.checkGraphQL(httptest.NewRecorder(), testRequest("POST", "/graphql", "application/json", introspection), &WAFState{}),
+		"introspection is allowed without block_introspection")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -25,6 +26,9 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 	// Add panic recovery to catch and log panics
 	defer func() {
 		if rec := recover(); rec != nil {
+			if rec == http.ErrAbortHandler {
+				panic(rec) // Deliberate abort, let the server close the connection
+			}
 			m.logger.Error("PANIC in ServeHTTP",
 				zap.String("log_id", logID),
 				zap.Any("panic", rec),
@@ -49,10 +53,35 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 	ctx := context.WithValue(r.Context(), ContextKeyLogId("logID"), logID)
 	r = r.WithContext(ctx)
 
+	// Cluster peer messages are authenticated by signature and bypass inspection
+	if m.isClusterRequest(r) {
+		return m.handleClusterRequest(w, r)
+	}
+
 	m.incrementTotalRequestsMetric()
 
 	// Initialize WAF state for this request
 	state := m.initializeWAFState()
+	defer putWAFState(state)
+	state.overlay = m.hostOverlay(r)
+	defer m.recordTenantRequest(r, state)
+	defer m.recordIPType(r, state)
+
+	// Limit the requests a client has in flight at once
+	release, allowed := m.acquireConcurrency(w, r, state)
+	if !allowed {
+		return nil
+	}
+	defer release()
+
+	// Enforce the body deadline and minimum rate for every reader of the body
+	var body *slowBodyReader
+	if m.SlowClient != nil {
+		if body = newSlowBodyReader(w, r, m.SlowClient); body != nil {
+			r.Body = body
+			defer body.clearDeadline()
+		}
+	}
 
 	// Phase 1: Pre-request checks and blocking
 	if m.isPhaseBlocked(w, r, 1, state) {
@@ -63,28 +92,67 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 	if m.isPhaseBlocked(w, r, 2, state) {
 		return nil // Request blocked, short-circuit
 	}
+	if m.rejectSlowBody(w, r, state, body) {
+		return nil
+	}
+
+	// Admin API requests are served once they passed request inspection
+	if m.isAdminAPIRequest(r) {
+		if !m.authorizeEndpoint(w, r) {
+			return nil
+		}
+		return m.handleAdminAPIRequest(w, r)
+	}
+
+	// Streamed RPC responses are passed through as they are written, without the response phases
+	if rpcStreamsResponse(rpcProtocolOf(r)) {
+		m.incrementAllowedRequestsMetric()
+		m.logRequestCompletion(logID, state)
+		return next.ServeHTTP(w, r)
+	}
 
 	// Response capture and processing
-	recorder := NewResponseRecorder(w)
+	sample := m.learningSampleFor(r, state)
+	recorder := getResponseRecorder(w, m.ResponseBufferLimit)
+	recorder.decompressLimit = m.ResponseDecompressLimit
+	defer putResponseRecorder(recorder)
 	err := next.ServeHTTP(recorder, r)
+	recorder.seal()
+	m.recordLoginOutcome(r, recorder.StatusCode())
+	m.learnRequest(sample, recorder.StatusCode())
+	m.recordReplayOutcome(r, state, recorder.StatusCode())
+	if m.rejectSlowBody(w, r, state, body) {
+		return nil // The upstream response is discarded
+	}
 
 	// Phase 3: Response Header analysis
 	if m.isPhaseBlocked(recorder, r, 3, state) {
+		m.abortStreamedResponse(recorder, r)
 		return nil // Request blocked in Phase 3, short-circuit
 	}
 
 	// Phase 4: Response Body analysis (if not already blocked)
-	m.handleResponseBodyPhase(recorder, r, state)
+	r4, span := m.startPhaseSpan(r, 4)
+	start := m.startLatencyTimer()
+	if release, run := m.acquireInspection(recorder, r4, 4, state); run {
+		m.handleResponseBodyPhase(recorder, r4, state)
+		release()
+	}
+	m.observePhaseLatency(4, start)
+	m.endPhaseSpan(span, state)
 
 	if state.Blocked {
 		// Metrics and response handling if blocked after headers phase
 		m.incrementBlockedRequestsMetric()
-		m.writeCustomResponse(recorder, state.StatusCode)
+		m.abortStreamedResponse(recorder, r)
 		return nil
 	}
 
 	// Handle metrics request separately
 	if m.isMetricsRequest(r) {
+		if !m.authorizeEndpoint(w, r) {
+			return nil
+		}
 		return m.handleMetricsRequest(w, r)
 	}
 
@@ -101,7 +169,15 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 
 // isPhaseBlocked encapsulates the phase handling and blocking check logic.
 func (m *Middleware) isPhaseBlocked(w http.ResponseWriter, r *http.Request, phase int, state *WAFState) bool {
-	m.handlePhase(w, r, phase, state)
+	spanRequest, span := m.startPhaseSpan(r, phase)
+	start := m.startLatencyTimer()
+	if release, run := m.acquireInspection(w, spanRequest, phase, state); run {
+		m.handlePhase(w, spanRequest, phase, state)
+		release()
+	}
+	r.Body = spanRequest.Body // Replayed for the upstream handler once read by the phase
+	m.observePhaseLatency(phase, start)
+	m.endPhaseSpan(span, state)
 
 	if state.Blocked {
 		m.incrementBlockedRequestsMetric()
@@ -142,16 +218,17 @@ func (m *Middleware) incrementTotalRequestsMetric() {
 	m.muMetrics.Lock()
 	m.totalRequests++
 	m.muMetrics.Unlock()
+	if m.ruleCanary != nil {
+		m.ruleCanary.requests.Add(1)
+	}
+	if m.requestWindows != nil {
+		m.requestWindows.total.Add(time.Now(), 1)
+	}
 }
 
-// initializeWAFState initializes the WAF state.
+// initializeWAFState takes a fresh WAF state from the pool.
 func (m *Middleware) initializeWAFState() *WAFState {
-	return &WAFState{
-		TotalScore:      0,
-		Blocked:         false,
-		StatusCode:      http.StatusOK,
-		ResponseWritten: false,
-	}
+	return getWAFState()
 }
 
 // getLogID extracts the logID from the request context.
@@ -164,8 +241,6 @@ func getLogID(ctx context.Context) string {
 
 // handleResponseBodyPhase processes Phase 4 (response body).
 func (m *Middleware) handleResponseBodyPhase(recorder *responseRecorder, r *http.Request, state *WAFState) {
-	// No need to check if recorder.body is nil here, it's always initialized in NewResponseRecorder
-	body := recorder.BodyString()
 	logID := getLogID(r.Context())
 	if logID == "unknown" {
 		m.logger.Error("Log ID missing in context")
@@ -173,15 +248,26 @@ func (m *Middleware) handleResponseBodyPhase(recorder *responseRecorder, r *http
 	}
 	m.logger.Debug("Response body captured for Phase 4 analysis", zap.String("log_id", logID))
 
+	if m.checkICAPResponse(recorder, r, state) || m.runInspectors(recorder, r, 4, state) {
+		return
+	}
+
 	// Check if rules exist for Phase 4 before iterating
-	rules, ok := m.Rules[4]
+	rules, ok := m.rulesForPhase(state, 4)
 	if !ok || len(rules) == 0 {
 		m.logger.Debug("No rules found for Phase 4")
 		return
 	}
+	body := recorder.BodyString()
 
 	for _, rule := range rules {
-		if rule.regex.MatchString(body) {
+		if !m.withinBudget(recorder, r, state, true) {
+			return
+		}
+		ruleStart := m.startLatencyTimer()
+		matched := m.conditionHolds(&rule, recorder, r, state) && m.matchRule(&rule, body, state)
+		m.observeRuleLatency(rule.ID, ruleStart)
+		if matched {
 			if m.processRuleMatch(recorder, r, &rule, body, state) {
 				return
 			}
@@ -194,6 +280,9 @@ func (m *Middleware) incrementBlockedRequestsMetric() {
 	m.muMetrics.Lock()
 	m.blockedRequests++
 	m.muMetrics.Unlock()
+	if m.requestWindows != nil {
+		m.requestWindows.blocked.Add(time.Now(), 1)
+	}
 }
 
 // incrementAllowedRequestsMetric increments the allowed requests metric.
@@ -201,6 +290,9 @@ func (m *Middleware) incrementAllowedRequestsMetric() {
 	m.muMetrics.Lock()
 	m.allowedRequests++
 	m.muMetrics.Unlock()
+	if m.requestWindows != nil {
+		m.requestWindows.allowed.Add(time.Now(), 1)
+	}
 }
 
 // isMetricsRequest checks if it's a metrics request.
@@ -208,14 +300,21 @@ func (m *Middleware) isMetricsRequest(r *http.Request) bool {
 	return m.MetricsEndpoint != "" && r.URL.Path == m.MetricsEndpoint
 }
 
-// writeCustomResponse writes a custom response.
-func (m *Middleware) writeCustomResponse(w http.ResponseWriter, statusCode int) {
-	if customResponse, ok := m.CustomResponses[statusCode]; ok {
+// writeCustomResponse writes the custom response for the status code of a blocked request.
+func (m *Middleware) writeCustomResponse(w http.ResponseWriter, r *http.Request, state *WAFState) {
+	if customResponse, ok := m.customResponse(state.StatusCode); ok {
+		customResponse, lang := customResponse.localize(r.Header.Get("Accept-Language"))
 		for key, value := range customResponse.Headers {
 			w.Header().Set(key, value)
 		}
+		if customResponse.languages != nil {
+			w.Header().Add("Vary", "Accept-Language")
+			if lang != "" {
+				w.Header().Set("Content-Language", lang)
+			}
+		}
 		w.WriteHeader(customResponse.StatusCode)
-		if _, err := w.Write([]byte(customResponse.Body)); err != nil {
+		if _, err := w.Write(m.renderBody(customResponse, r, state)); err != nil {
 			m.logger.Error("Failed to write custom response body", zap.Error(err))
 		}
 	}
@@ -231,8 +330,24 @@ func (m *Middleware) logRequestCompletion(logID string, state *WAFState) {
 	)
 }
 
+// abortStreamedResponse aborts the connection when a blocked response was already partly
+// streamed to the client, so the client gets a truncated response rather than a complete one.
+func (m *Middleware) abortStreamedResponse(recorder *responseRecorder, r *http.Request) {
+	if !recorder.Streamed() {
+		return
+	}
+	m.logger.Warn("Blocked response was already streamed past the buffer limit, aborting the connection",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.Int64("buffer_limit", recorder.limit),
+	)
+	panic(http.ErrAbortHandler)
+}
+
 // copyResponse copies the captured response from the recorder to the original writer
 func (m *Middleware) copyResponse(w http.ResponseWriter, recorder *responseRecorder, r *http.Request) {
+	if recorder.Streamed() {
+		return // Headers and body were already streamed to the client
+	}
 	header := w.Header()
 	for key, values := range recorder.Header() {
 		for _, value := range values {
@@ -259,6 +374,41 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 	)
 
 	if phase == 1 {
+		// Requests bypassing the CDN never reach the other checks
+		if m.checkCDNOrigin(w, r, state) {
+			return
+		}
+
+		// Request smuggling indicators in the framing headers
+		if m.checkSmuggling(w, r, state) {
+			return
+		}
+
+		// Line breaks and null bytes injected in the path, query and headers
+		if m.checkCRLF(w, r, state) {
+			return
+		}
+
+		// Bodies over the size limit of their content type and path
+		if m.checkBodySize(w, r, state) {
+			return
+		}
+
+		// Static files embedded by other sites
+		if m.checkHotlink(w, r, state) {
+			return
+		}
+
+		// Protected paths requested without a valid URL signature
+		if m.checkSignedURL(w, r, state) {
+			return
+		}
+
+		// Metadata of gRPC, gRPC-Web and Connect calls
+		if m.checkRPC(w, r, state) {
+			return
+		}
+
 		// IP blacklisting - the highest priority
 		m.logger.Debug("Checking for IP blacklisting", zap.String("remote_addr", r.RemoteAddr)) // Added log for checking before to isIPBlacklisted call
 		xForwardedFor := r.Header.Get("X-Forwarded-For")
@@ -267,14 +417,12 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 			if len(ips) > 0 {
 				firstIP := strings.TrimSpace(ips[0])
 				m.logger.Debug("Checking IP blacklist with X-Forwarded-For", zap.String("remote_addr_xff", firstIP), zap.String("r.RemoteAddr", r.RemoteAddr))
-				if m.isIPBlacklisted(firstIP) {
+				if blacklisted, reason := m.ipBlacklistHit(firstIP); blacklisted {
 					m.logger.Debug("Starting IP blacklist phase")
 					m.blockRequest(w, r, state, http.StatusForbidden, "ip_blacklist", "ip_blacklist_rule",
 						zap.String("message", "Request blocked by IP blacklist"),
+						zap.String("blacklist_reason", reason),
 					)
-					if m.CustomResponses != nil {
-						m.writeCustomResponse(w, state.StatusCode)
-					}
 					return
 				}
 			} else {
@@ -282,18 +430,24 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 			}
 		} else {
 			m.logger.Debug("X-Forwarded-For header not present using r.RemoteAddr")
-			if m.isIPBlacklisted(r.RemoteAddr) {
+			if blacklisted, reason := m.ipBlacklistHit(r.RemoteAddr); blacklisted {
 				m.logger.Debug("Starting IP blacklist phase")
 				m.blockRequest(w, r, state, http.StatusForbidden, "ip_blacklist", "ip_blacklist_rule",
 					zap.String("message", "Request blocked by IP blacklist"),
+					zap.String("blacklist_reason", reason),
 				)
-				if m.CustomResponses != nil {
-					m.writeCustomResponse(w, state.StatusCode)
-				}
 				return
 			}
 		}
 
+		// Dynamic bans
+		if m.isBanned(r) {
+			m.blockRequest(w, r, state, http.StatusForbidden, "ban", banRuleID,
+				zap.String("message", "Request blocked by dynamic ban"),
+			)
+			return
+		}
+
 		// DNS blacklisting
 		if m.isDNSBlacklisted(r.Host) {
 			m.logger.Debug("Starting DNS blacklist phase")
@@ -301,34 +455,72 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 				zap.String("message", "Request blocked by DNS blacklist"),
 				zap.String("host", r.Host),
 			)
-			if m.CustomResponses != nil {
-				m.writeCustomResponse(w, state.StatusCode)
-			}
+			return
+		}
+
+		// Path blacklisting
+		if entry, blacklisted := m.isPathBlacklisted(r.URL.Path); blacklisted {
+			m.blockRequest(w, r, state, http.StatusForbidden, "path_blacklist", "path_blacklist_rule",
+				zap.String("message", "Request blocked by path blacklist"),
+				zap.String("entry", entry),
+			)
+			return
+		}
+
+		// Client certificate blacklisting
+		if fingerprint, blacklisted := m.isCertBlacklisted(r); blacklisted {
+			m.blockRequest(w, r, state, http.StatusForbidden, "cert_blacklist", certBlacklistRuleID,
+				zap.String("message", "Request blocked by certificate blacklist"),
+				zap.String("fingerprint", fingerprint),
+			)
 			return
 		}
 
 		// Rate limiting
-		if m.rateLimiter != nil {
+		if m.rateLimiter != nil && m.scheduleActive(m.RateLimit.schedule) {
 			m.logger.Debug("Starting rate limiting phase")
-			ip := extractIP(r.RemoteAddr) // Pass the logger here
-			path := r.URL.Path            // Get the request path
+			// Rate-limit buckets are per tenant in multi-tenant mode
+			ip := m.scopedKey(r, extractIP(r.RemoteAddr))
+			path := r.URL.Path // Get the request path
 			if m.rateLimiter.isRateLimited(ip, path) {
 				m.incrementRateLimiterBlockedRequestsMetric() // Increment the counter in the Middleware
 				m.blockRequest(w, r, state, http.StatusTooManyRequests, "rate_limit", "rate_limit_rule",
 					zap.String("message", "Request blocked by rate limit"),
 				)
-				if m.CustomResponses != nil {
-					m.writeCustomResponse(w, state.StatusCode)
-				}
 				return
 			}
 			m.logger.Debug("Rate limiting phase completed - not blocked")
 		}
 
+		// Lockdown rate limit and challenge
+		if m.checkLockdown(w, r, state) {
+			return
+		}
+
+		// Endpoint cost budgets
+		if m.checkCostLimit(w, r, state) {
+			return
+		}
+
+		// API key quotas
+		if m.checkQuota(w, r, state) {
+			return
+		}
+
+		// Bot score threshold
+		if m.checkBotScore(w, r, state) {
+			return
+		}
+
+		// IP reputation
+		if m.checkReputation(w, r, state) {
+			return
+		}
+
 		// Whitelisting
-		if m.CountryWhitelist.Enabled {
+		if m.CountryWhitelist.Enabled && m.scheduleActive(m.CountryWhitelist.schedule) {
 			m.logger.Debug("Starting country whitelisting phase")
-			allowed, err := m.isCountryInList(r.RemoteAddr, m.CountryWhitelist.CountryList, m.CountryWhitelist.geoIP)
+			allowed, err := m.isCountryInList(r.RemoteAddr, m.CountryWhitelist.CountryList, m.requestGeoIP(state))
 			if err != nil {
 				m.logRequest(zapcore.ErrorLevel, "Failed to check country whitelist",
 					r,
@@ -338,25 +530,22 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 					zap.String("message", "Request blocked due to internal error"),
 				)
 				m.logger.Debug("Country whitelisting phase completed - blocked due to error")
-				m.incrementGeoIPRequestsMetric(false) // Increment with false for error
+				m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, false) // Increment with false for error
 				return
 			} else if !allowed {
 				m.blockRequest(w, r, state, http.StatusForbidden, "country_block", "country_block_rule",
 					zap.String("message", "Request blocked by country"))
-				m.incrementGeoIPRequestsMetric(true) // Increment with true for blocked
-				if m.CustomResponses != nil {
-					m.writeCustomResponse(w, state.StatusCode)
-				}
+				m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, true) // Increment with true for blocked
 				return
 			}
 			m.logger.Debug("Country whitelisting phase completed - not blocked")
-			m.incrementGeoIPRequestsMetric(false) // Increment with false for no block
+			m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, false) // Increment with false for no block
 		}
 
 		// Blacklisting
-		if m.CountryBlacklist.Enabled {
+		if m.CountryBlacklist.Enabled && m.scheduleActive(m.CountryBlacklist.schedule) {
 			m.logger.Debug("Starting country blacklisting phase")
-			blocked, err := m.isCountryInList(r.RemoteAddr, m.CountryBlacklist.CountryList, m.CountryBlacklist.geoIP)
+			blocked, err := m.isCountryInList(r.RemoteAddr, m.CountryBlacklist.CountryList, m.requestGeoIP(state))
 			if err != nil {
 				m.logRequest(zapcore.ErrorLevel, "Failed to check country blacklisting",
 					r,
@@ -366,23 +555,124 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 					zap.String("message", "Request blocked due to internal error"),
 				)
 				m.logger.Debug("Country blacklisting phase completed - blocked due to error")
-				m.incrementGeoIPRequestsMetric(false) // Increment with false for error
+				m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, false) // Increment with false for error
 				return
 			} else if blocked {
 				m.blockRequest(w, r, state, http.StatusForbidden, "country_block", "country_block_rule",
 					zap.String("message", "Request blocked by country"))
-				m.incrementGeoIPRequestsMetric(true) // Increment with true for blocked
-				if m.CustomResponses != nil {
-					m.writeCustomResponse(w, state.StatusCode)
-				}
+				m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, true) // Increment with true for blocked
 				return
 			}
 			m.logger.Debug("Country blacklisting phase completed - not blocked")
-			m.incrementGeoIPRequestsMetric(false) // Increment with false for no block
+			m.incrementGeoIPRequestsMetric(state, r.RemoteAddr, false) // Increment with false for no block
 		}
 	}
 
-	rules, ok := m.Rules[phase]
+	// Bodies of unknown length running past their size limit
+	if phase == 2 && m.checkStreamedBodySize(w, r, state) {
+		return
+	}
+
+	// RPC messages over their size limit
+	if phase == 2 && m.checkRPCMessages(w, r, state) {
+		return
+	}
+
+	// Unsigned or stale requests to the API paths requiring signatures
+	if phase == 2 && m.checkRequestSigning(w, r, state) {
+		return
+	}
+
+	// Encoded request bodies are decompressed for the checks and rules reading the body
+	if phase == 2 && m.checkRequestEncoding(w, r, state) {
+		return
+	}
+
+	// Positive security model: the parameters must match the schema of their path
+	if phase == 2 && m.checkParamSchema(w, r, state) {
+		return
+	}
+
+	// Requests must match their operation in the OpenAPI spec
+	if phase == 2 && m.checkOpenAPI(w, r, state) {
+		return
+	}
+
+	// Parameters deviating from their learned baseline
+	if phase == 2 && m.checkParamAnomaly(w, r, state) {
+		return
+	}
+
+	// JSON bodies must match the schema of their path
+	if phase == 2 && m.checkJSONSchema(w, r, state) {
+		return
+	}
+
+	// Clients trying many usernames or failing most of their logins
+	if phase == 2 && m.checkCredentialStuffing(w, r, state) {
+		return
+	}
+
+	// Sessions and users traveling faster than possible
+	if phase == 2 && m.checkGeoVelocity(w, r, state) {
+		return
+	}
+
+	// Duplicates of a request seen within the TTL
+	if phase == 2 && m.checkReplay(w, r, state) {
+		return
+	}
+
+	// Serialized Java, PHP and .NET objects
+	if phase == 2 && m.checkDeserialization(w, r, state) {
+		return
+	}
+
+	// External entities and entity expansion in XML bodies
+	if phase == 2 && m.checkXXE(w, r, state) {
+		return
+	}
+
+	// URLs and hosts pointing at internal destinations
+	if phase == 2 && m.checkSSRF(w, r, state) {
+		return
+	}
+
+	// Redirect URLs to hosts that are neither the request host nor allowed
+	if phase == 2 && m.checkOpenRedirect(w, r, state) {
+		return
+	}
+
+	// GraphQL introspection queries and oversized batches
+	if phase == 2 && m.checkGraphQL(w, r, state) {
+		return
+	}
+
+	// Uploads breaking the upload policy
+	if phase == 2 && m.checkUploadPolicy(w, r, state) {
+		return
+	}
+
+	// Bodies flagged by the ICAP REQMOD service
+	if phase == 2 && m.checkICAP(w, r, state) {
+		return
+	}
+
+	// Uploads carrying malware
+	if phase == 2 && m.checkClamAV(w, r, state) {
+		return
+	}
+
+	// Bodies and uploads matching the YARA rules
+	if phase == 2 && m.checkYARA(w, r, state) {
+		return
+	}
+
+	if m.runInspectors(w, r, phase, state) {
+		return
+	}
+
+	rules, ok := m.rulesForPhase(state, phase)
 	if !ok {
 		m.logger.Debug("No rules found for phase", zap.Int("phase", phase))
 		// Don't block on empty rules. There may be no rules specified
@@ -391,27 +681,40 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 
 	m.logger.Debug("Starting rule evaluation for phase", zap.Int("phase", phase), zap.Int("rule_count", len(rules)))
 
+	// The rules see copies of the request carrying their ID: the body replayed after a rule
+	// read it goes back to the caller's request, for the upstream handler
+	defer func(caller *http.Request) { caller.Body = r.Body }(r)
+
 	for _, rule := range rules {
+		if !m.withinBudget(w, r, state, true) {
+			break
+		}
 		m.logger.Debug("Processing rule", zap.String("rule_id", rule.ID), zap.Int("target_count", len(rule.Targets)))
 
 		// Use the custom type as the key
 		ctx := context.WithValue(r.Context(), ContextKeyRule("rule_id"), rule.ID)
 		r = r.WithContext(ctx)
 
-		for _, target := range rule.Targets {
+		ruleStart := m.startLatencyTimer()
+		if !m.conditionHolds(&rule, w, r, state) {
+			m.logger.Debug("Rule condition does not hold", zap.String("rule_id", rule.ID))
+			m.observeRuleLatency(rule.ID, ruleStart)
+			continue
+		}
+		for _, target := range ruleTargets(&rule) {
 			m.logger.Debug("Extracting value for target", zap.String("target", target), zap.String("rule_id", rule.ID))
 			var value string
 			var err error
 
 			if phase == 3 || phase == 4 {
 				if recorder, ok := w.(*responseRecorder); ok {
-					value, err = m.extractValue(target, r, recorder)
+					value, err = m.extractTarget(target, r, recorder, state)
 				} else {
 					m.logger.Error("response recorder is not available in phase 3 or 4 when required")
-					value, err = m.extractValue(target, r, nil)
+					value, err = m.extractTarget(target, r, nil, state)
 				}
 			} else {
-				value, err = m.extractValue(target, r, nil)
+				value, err = m.extractTarget(target, r, nil, state)
 			}
 
 			if err != nil {
@@ -429,7 +732,8 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 				zap.String("value", value),
 			)
 
-			if rule.regex.MatchString(value) {
+			if matched, ok := m.matchRuleDecoded(&rule, target, value, state); ok {
+				value = matched
 				m.logger.Debug("Rule matched",
 					zap.String("rule_id", rule.ID),
 					zap.String("target", target),
@@ -457,9 +761,7 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 						zap.Bool("blocked", state.Blocked),
 					)
 
-					if m.CustomResponses != nil {
-						m.writeCustomResponse(w, state.StatusCode)
-					}
+					m.observeRuleLatency(rule.ID, ruleStart)
 					return
 				}
 			} else {
@@ -470,6 +772,13 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 				)
 			}
 		}
+		m.observeRuleLatency(rule.ID, ruleStart)
+	}
+
+	// A budget exceeded by the last rule, or by a truncated body, still blocks when failing closed
+	m.withinBudget(w, r, state, false)
+	if state.Blocked {
+		return
 	}
 
 	m.logger.Debug("Rule evaluation completed for phase", zap.Int("phase", phase))
@@ -504,11 +813,46 @@ func (m *Middleware) incrementRateLimiterBlockedRequestsMetric() {
 	m.rateLimiterBlockedRequests++
 }
 
-// incrementGeoIPRequestsMetric increments the GeoIP requests metric.
-func (m *Middleware) incrementGeoIPRequestsMetric(blocked bool) {
+// incrementGeoIPRequestsMetric records a GeoIP decision for the client's country.
+func (m *Middleware) incrementGeoIPRequestsMetric(state *WAFState, remoteAddr string, blocked bool) {
+	country := m.lookupCountry(state, remoteAddr)
+	if country == "" {
+		country = "unknown"
+	}
 	m.muMetrics.Lock()
 	defer m.muMetrics.Unlock()
+	if m.geoIPStats == nil {
+		m.geoIPStats = make(map[string]int64)
+	}
+	m.geoIPStats[country]++
 	if blocked {
 		m.geoIPBlocked++
+		if m.geoIPBlockedByCountry == nil {
+			m.geoIPBlockedByCountry = make(map[string]int64)
+		}
+		m.geoIPBlockedByCountry[country]++
+	}
+}
+
+// getGeoIPStats returns the GeoIP decisions per country, split into blocked and allowed.
+func (m *Middleware) getGeoIPStats() map[string]interface{} {
+	m.muMetrics.RLock()
+	defer m.muMetrics.RUnlock()
+	var total int64
+	blocked := make(map[string]int64, len(m.geoIPBlockedByCountry))
+	allowed := make(map[string]int64, len(m.geoIPStats))
+	for country, count := range m.geoIPStats {
+		total += count
+		if b := m.geoIPBlockedByCountry[country]; b > 0 {
+			blocked[country] = b
+		}
+		if a := count - m.geoIPBlockedByCountry[country]; a > 0 {
+			allowed[country] = a
+		}
+	}
+	return map[string]interface{}{
+		"total_lookups":      total,
+		"blocked_by_country": blocked,
+		"allowed_by_country": allowed,
 	}
 }
@@ -55,7 +55,7 @@ func TestBlockedRequestPhase1_DNSBlacklist(t *testing.T) {
 		// Verify that the request was blocked
 		assert.True(t, state.Blocked, "Request should be blocked")
 		assert.Equal(t, http.StatusForbidden, w.Code, "Expected status code 403")
-		assert.Contains(t, w.Body.String(), "Access Denied", "Response body should contain 'Access Denied'")
+		assert.Equal(t, 1, strings.Count(w.Body.String(), "Access Denied"), "The custom response should be written once")
 	})
 }
 
@@ -75,7 +75,6 @@ func TestBlockedRequestPhase1_GeoIPBlocking(t *testing.T) {
 			Enabled:     true,
 			CountryList: []string{"US", "RU"},
 			GeoIPDBPath: geoIPdata, // Path to a test GeoIP database
-			geoIP:       geoIPBlock,
 		},
 		CustomResponses: customResponse,
 	}
@@ -88,7 +87,6 @@ func TestBlockedRequestPhase1_GeoIPBlocking(t *testing.T) {
 			Enabled:     true,
 			CountryList: []string{"BR"},
 			GeoIPDBPath: geoIPdata, // Path to a test GeoIP database
-			geoIP:       geoIPBlock,
 		},
 		CustomResponses: customResponse,
 	}
@@ -101,16 +99,17 @@ func TestBlockedRequestPhase1_GeoIPBlocking(t *testing.T) {
 			Enabled:     true,
 			CountryList: []string{"BR"},
 			GeoIPDBPath: geoIPdata, // Path to a test GeoIP database
-			geoIP:       geoIPBlock,
 		},
 		CountryBlacklist: CountryAccessFilter{
 			Enabled:     true,
 			CountryList: []string{"US", "RU"},
 			GeoIPDBPath: geoIPdata, // Path to a test GeoIP database
-			geoIP:       geoIPBlock,
 		},
 		CustomResponses: customResponse,
 	}
+	for _, filter := range []*CountryAccessFilter{&blMiddleware.CountryBlacklist, &wlMiddleware.CountryWhitelist, &blackWhiteMw.CountryWhitelist, &blackWhiteMw.CountryBlacklist} {
+		filter.geoIP.Store(geoIPBlock)
+	}
 
 	req := httptest.NewRequest("GET", testURL, nil)
 
@@ -1920,3 +1919,64 @@ func TestBlockedRequestPhase1_RateLimiting_MatchAllPaths(t *testing.T) {
 	assert.True(t, state3.Blocked, "Second request to /some-other-path should be rate-limited because MatchAllPaths=true")
 	assert.Equal(t, http.StatusTooManyRequests, w3.Code, "Expected status code 429")
 }
+
+func TestIncrementGeoIPRequestsMetric_ByCountry(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+
+	// Without a GeoIP database the country cannot be resolved
+	m.incrementGeoIPRequestsMetric(&WAFState{}, "192.0.2.1:1234", true)
+	m.incrementGeoIPRequestsMetric(&WAFState{}, "192.0.2.2:1234", false)
+	m.incrementGeoIPRequestsMetric(&WAFState{}, "192.0.2.3:1234", false)
+
+	stats := m.getGeoIPStats()
+	assert.Equal(t, int64(3), stats["total_lookups"])
+	assert.Equal(t, map[string]int64{"unknown": 1}, stats["blocked_by_country"])
+	assert.Equal(t, map[string]int64{"unknown": 2}, stats["allowed_by_country"])
+	assert.Equal(t, 1, m.geoIPBlocked)
+}
+
+func TestServeHTTP_ResponseBufferLimit(t *testing.T) {
+	logger := zap.NewNop()
+	middleware := &Middleware{
+		logger: logger,
+		Rules: map[int][]Rule{
+			4: {
+				{
+					ID:      "rule4_secret",
+					Pattern: "secret",
+					Targets: []string{"RESPONSE_BODY"},
+					Phase:   4,
+					Score:   5,
+					Action:  "block",
+					regex:   regexp.MustCompile("secret"),
+				},
+			},
+		},
+		AnomalyThreshold:      5,
+		ResponseBufferLimit:   16,
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	serve := func(body string) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write([]byte(body))
+			return err
+		})
+	}
+
+	// A large download is streamed past the limit
+	large := strings.Repeat("a", 64) + "secret"
+	w := httptest.NewRecorder()
+	err := middleware.ServeHTTP(w, httptest.NewRequest("GET", testURL, nil), serve(large))
+	assert.NoError(t, err)
+	assert.Equal(t, large, w.Body.String(), "only the buffered prefix is inspected")
+
+	// A blocked response that was already streamed aborts the connection
+	w = httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		_ = middleware.ServeHTTP(w, httptest.NewRequest("GET", testURL, nil), serve("secret"+strings.Repeat("a", 64)))
+	})
+	assert.NotContains(t, w.Body.String(), "blocked")
+}
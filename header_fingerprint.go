@@ -0,0 +1,97 @@
+package caddywaf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// minClientHintsChrome is the first Chrome version sending the Sec-CH-UA client hints by default.
+const minClientHintsChrome = 89
+
+var chromeVersion = regexp.MustCompile(`Chrome/(\d+)`)
+
+// clientHintPlatforms maps the Sec-CH-UA-Platform values to the User-Agent token of the platform.
+var clientHintPlatforms = map[string]string{
+	"Windows":   "Windows",
+	"macOS":     "Macintosh",
+	"Linux":     "Linux",
+	"Android":   "Android",
+	"Chrome OS": "CrOS",
+}
+
+// headerNames returns the lowercased names of the request headers, sorted and
+// comma-separated. Go's HTTP server parses headers into a map, so the order in which the
+// client sent them is not available; the set of names a client sends is fingerprinted instead.
+func headerNames(r *http.Request) string {
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// headerFingerprint returns a short hash of the header names of a request, equal for
+// clients sending the same set of headers.
+func headerFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(headerNames(r)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sendsClientHints reports whether a browser with the User-Agent sends the Sec-CH-UA
+// client hints by default: Chromium-based browsers from version 89, except on iOS.
+func sendsClientHints(userAgent string) bool {
+	if strings.Contains(userAgent, "CriOS") || strings.Contains(userAgent, "EdgiOS") {
+		return false // Browsers on iOS are WebKit whatever their brand
+	}
+	match := chromeVersion.FindStringSubmatch(userAgent)
+	if match == nil {
+		return false
+	}
+	version, err := strconv.Atoi(match[1])
+	return err == nil && version >= minClientHintsChrome
+}
+
+// clientHintsMismatch reports whether the client hints of a request contradict its
+// User-Agent: a Chromium browser without hints, hints from a browser that doesn't send
+// them, or a mobile flag or platform other than the User-Agent's.
+func clientHintsMismatch(r *http.Request) bool {
+	userAgent := r.UserAgent()
+	if !strings.HasPrefix(userAgent, "Mozilla/") {
+		return false // Not claiming to be a browser
+	}
+	hints := r.Header.Get("Sec-CH-UA")
+	if hints == "" {
+		// Client hints are only sent to secure origins
+		return r.TLS != nil && sendsClientHints(userAgent)
+	}
+	if !strings.Contains(userAgent, "Chrome/") {
+		return true
+	}
+	switch r.Header.Get("Sec-CH-UA-Mobile") {
+	case "?0":
+		if strings.Contains(userAgent, "Mobile") {
+			return true
+		}
+	case "?1":
+		if !strings.Contains(userAgent, "Mobile") {
+			return true
+		}
+	}
+	platform := strings.Trim(r.Header.Get("Sec-CH-UA-Platform"), `"`)
+	if token, ok := clientHintPlatforms[platform]; ok && !strings.Contains(userAgent, token) {
+		return true
+	}
+	return false
+}
+
+// missingFetchMetadata reports whether a request claiming to come from a browser lacks the
+// Sec-Fetch-Mode header, which current browsers send to secure origins.
+func missingFetchMetadata(r *http.Request) bool {
+	return r.TLS != nil && strings.HasPrefix(r.UserAgent(), "Mozilla/") && r.Header.Get("Sec-Fetch-Mode") == ""
+}
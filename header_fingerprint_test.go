@@ -0,0 +1,92 @@
+package caddywaf
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const (
+	chromeUA  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+	firefoxUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0"
+)
+
+func TestHeaderFingerprint(t *testing.T) {
+	a := httptest.NewRequest(http.MethodGet, "/", nil)
+	a.Header.Set("User-Agent", "curl/8.0")
+	a.Header.Set("Accept", "*/*")
+	b := httptest.NewRequest(http.MethodGet, "/other", nil)
+	b.Header.Set("Accept", "text/html")
+	b.Header.Set("User-Agent", "Mozilla/5.0")
+
+	assert.Equal(t, "accept,user-agent", headerNames(a))
+	assert.Len(t, headerFingerprint(a), 16)
+	assert.Equal(t, headerFingerprint(a), headerFingerprint(b), "values and order don't matter")
+
+	b.Header.Set("Accept-Language", "en")
+	assert.NotEqual(t, headerFingerprint(a), headerFingerprint(b))
+
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	value, err := rve.ExtractValue(TargetHeaderNames, b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "accept,accept-language,user-agent", value)
+	value, err = rve.ExtractValue(TargetHeaderFingerprint, b, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, headerFingerprint(b), value)
+}
+
+func TestClientHintsMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		ua       string
+		https    bool
+		hints    map[string]string
+		mismatch bool
+	}{
+		{name: "chrome with hints", ua: chromeUA, https: true, hints: map[string]string{
+			"Sec-CH-UA": `"Chromium";v="124"`, "Sec-CH-UA-Mobile": "?0", "Sec-CH-UA-Platform": `"Windows"`,
+		}},
+		{name: "chrome without hints", ua: chromeUA, https: true, mismatch: true},
+		{name: "chrome without hints over http", ua: chromeUA},
+		{name: "old chrome without hints", ua: "Mozilla/5.0 (X11; Linux x86_64) Chrome/88.0 Safari/537.36", https: true},
+		{name: "chrome on ios", ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) CriOS/124.0 Mobile/15E148 Safari/604.1", https: true},
+		{name: "firefox", ua: firefoxUA, https: true},
+		{name: "firefox with hints", ua: firefoxUA, https: true, hints: map[string]string{"Sec-CH-UA": `"Chromium";v="124"`}, mismatch: true},
+		{name: "platform mismatch", ua: chromeUA, https: true, hints: map[string]string{
+			"Sec-CH-UA": `"Chromium";v="124"`, "Sec-CH-UA-Platform": `"macOS"`,
+		}, mismatch: true},
+		{name: "mobile mismatch", ua: chromeUA, https: true, hints: map[string]string{
+			"Sec-CH-UA": `"Chromium";v="124"`, "Sec-CH-UA-Mobile": "?1",
+		}, mismatch: true},
+		{name: "not a browser", ua: "python-requests/2.31", https: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", tt.ua)
+			for name, value := range tt.hints {
+				req.Header.Set(name, value)
+			}
+			if tt.https {
+				req.TLS = &tls.ConnectionState{}
+			}
+			assert.Equal(t, tt.mismatch, clientHintsMismatch(req))
+		})
+	}
+}
+
+func TestMissingFetchMetadata(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	assert.False(t, missingFetchMetadata(req), "not sent over http")
+
+	req.TLS = &tls.ConnectionState{}
+	assert.True(t, missingFetchMetadata(req))
+
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	assert.False(t, missingFetchMetadata(req))
+}
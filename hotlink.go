@@ -0,0 +1,140 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	hotlinkRuleID         = "hotlink_rule"
+	hotlinkActionRedirect = "redirect"
+	hotlinkEmptyAllow     = "allow"
+)
+
+// defaultHotlinkExtensions are the extensions of the files protected when none are given.
+var defaultHotlinkExtensions = []string{
+	"jpg", "jpeg", "png", "gif", "webp", "avif", "svg", "ico", "bmp",
+	"mp4", "webm", "mov", "mp3", "ogg", "wav", "pdf", "zip", "woff", "woff2",
+}
+
+// HotlinkConfig stops third-party sites from embedding or linking the static files of a
+// site, by the host of their Referer.
+type HotlinkConfig struct {
+	Extensions      []string `json:"extensions,omitempty"`       // Extensions of the protected files, default common images, media, documents and fonts
+	Paths           []string `json:"paths,omitempty"`            // Protected paths, exact or prefixes ending in *, default all
+	AllowedReferers []string `json:"allowed_referers,omitempty"` // Referer hosts allowed besides the request host, *.example.com for subdomains
+	EmptyReferer    string   `json:"empty_referer,omitempty"`    // allow (default) or block the requests without a Referer
+	Action          string   `json:"action,omitempty"`           // block (default) with 403, or redirect
+	RedirectURL     string   `json:"redirect_url,omitempty"`     // Where hotlinked files are redirected with redirect
+
+	extensions map[string]bool
+}
+
+// provision validates the config and applies the defaults.
+func (c *HotlinkConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock:
+	case hotlinkActionRedirect:
+		if c.RedirectURL == "" {
+			return fmt.Errorf("hotlink_protection action redirect requires a URL")
+		}
+	default:
+		return fmt.Errorf("invalid hotlink_protection action: %s, must be block or redirect", c.Action)
+	}
+	switch c.EmptyReferer {
+	case "":
+		c.EmptyReferer = hotlinkEmptyAllow
+	case hotlinkEmptyAllow, detectionActionBlock:
+	default:
+		return fmt.Errorf("invalid hotlink_protection empty_referer: %s, must be allow or block", c.EmptyReferer)
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("hotlink_protection path must start with /: %s", p)
+		}
+	}
+	for i, host := range c.AllowedReferers {
+		if strings.Trim(host, "*.") == "" || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("invalid hotlink_protection allowed referer: %s", host)
+		}
+		c.AllowedReferers[i] = strings.ToLower(host)
+	}
+	extensions := c.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultHotlinkExtensions
+	}
+	c.extensions = make(map[string]bool, len(extensions))
+	for _, extension := range extensions {
+		c.extensions[strings.ToLower(strings.TrimPrefix(extension, "."))] = true
+	}
+	return nil
+}
+
+// protects reports whether the file requested is protected: its extension is protected and,
+// with paths, its path is one of them.
+func (c *HotlinkConfig) protects(r *http.Request) bool {
+	if !c.extensions[strings.ToLower(strings.TrimPrefix(path.Ext(r.URL.Path), "."))] {
+		return false
+	}
+	return len(c.Paths) == 0 || slices.ContainsFunc(c.Paths, func(p string) bool {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			return strings.HasPrefix(r.URL.Path, prefix)
+		}
+		return r.URL.Path == p
+	})
+}
+
+// refererAllowed reports whether a Referer comes from the request host or an allowed host.
+func (c *HotlinkConfig) refererAllowed(referer, requestHost string) bool {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	return host == strings.ToLower(requestHost) || hostAllowed(host, c.AllowedReferers)
+}
+
+// checkHotlink blocks or redirects in phase 1 the requests for protected files whose
+// Referer is another site. It reports whether the request was stopped.
+func (m *Middleware) checkHotlink(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.Hotlink
+	if config == nil || !config.protects(r) {
+		return false
+	}
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		if config.EmptyReferer == hotlinkEmptyAllow {
+			return false
+		}
+	} else if config.refererAllowed(referer, r.Host) {
+		return false
+	}
+
+	m.hotlinkHits.Add(1)
+	fields := []zap.Field{
+		zap.String("message", "Request blocked for hotlinking"),
+		zap.String("referer", referer),
+	}
+	if config.Action != hotlinkActionRedirect {
+		m.blockRequest(w, r, state, http.StatusForbidden, "hotlink", hotlinkRuleID, fields...)
+		return true
+	}
+	m.recordBlock(r, state, http.StatusFound, "hotlink", hotlinkRuleID, fields...)
+	http.Redirect(w, r, config.RedirectURL, http.StatusFound)
+	return true
+}
@@ -0,0 +1,87 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func hotlinkRequest(target, referer string) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	req.Host = "shop.example.com:443"
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	return req
+}
+
+func TestHotlinkConfig_Protects(t *testing.T) {
+	config := &HotlinkConfig{}
+	require.NoError(t, config.provision())
+	assert.True(t, config.protects(hotlinkRequest("/img/logo.PNG", "")))
+	assert.False(t, config.protects(hotlinkRequest("/index.html", "")))
+
+	config = &HotlinkConfig{Extensions: []string{".mp4"}, Paths: []string{"/videos/*", "/intro.mp4"}}
+	require.NoError(t, config.provision())
+	assert.True(t, config.protects(hotlinkRequest("/videos/launch.mp4", "")))
+	assert.True(t, config.protects(hotlinkRequest("/intro.mp4", "")))
+	assert.False(t, config.protects(hotlinkRequest("/public/launch.mp4", "")))
+	assert.False(t, config.protects(hotlinkRequest("/videos/poster.jpg", "")))
+
+	for _, config := range []*HotlinkConfig{
+		{Action: "redirect"},
+		{Action: "challenge"},
+		{EmptyReferer: "score"},
+		{Paths: []string{"videos"}},
+		{AllowedReferers: []string{"https://partner.com"}},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestHotlinkConfig_RefererAllowed(t *testing.T) {
+	config := &HotlinkConfig{AllowedReferers: []string{"*.Partner.com", "news.example.org"}}
+	require.NoError(t, config.provision())
+	for referer, allowed := range map[string]bool{
+		"https://shop.example.com/products":  true,
+		"https://SHOP.example.com:8443/":     true,
+		"https://cdn.partner.com/page":       true,
+		"https://news.example.org/article":   true,
+		"https://partner.com/":               false,
+		"https://evil.com/?shop.example.com": false,
+		"https://shop.example.com.evil.com/": false,
+		"android-app://com.example":          false,
+		"not a url":                          false,
+	} {
+		assert.Equal(t, allowed, config.refererAllowed(referer, "shop.example.com:443"), referer)
+	}
+}
+
+func TestCheckHotlink(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), Hotlink: &HotlinkConfig{}}
+	require.NoError(t, m.Hotlink.provision())
+
+	assert.False(t, m.checkHotlink(httptest.NewRecorder(), hotlinkRequest("/logo.png", "https://shop.example.com/"), &WAFState{}))
+	assert.False(t, m.checkHotlink(httptest.NewRecorder(), hotlinkRequest("/logo.png", ""), &WAFState{}), "empty referers are allowed by default")
+	assert.False(t, m.checkHotlink(httptest.NewRecorder(), hotlinkRequest("/", "https://evil.com/"), &WAFState{}), "pages are not protected")
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkHotlink(w, hotlinkRequest("/logo.png", "https://evil.com/"), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, hotlinkRuleID, state.blockRuleID)
+
+	m.Hotlink = &HotlinkConfig{EmptyReferer: "block", Action: "redirect", RedirectURL: "https://shop.example.com/hotlink.html"}
+	require.NoError(t, m.Hotlink.provision())
+	w = httptest.NewRecorder()
+	state = &WAFState{}
+	assert.True(t, m.checkHotlink(w, hotlinkRequest("/logo.png", ""), state))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://shop.example.com/hotlink.html", w.Header().Get("Location"))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, int64(2), m.hotlinkHits.Load())
+}
@@ -0,0 +1,281 @@
+package caddywaf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	icapRuleID         = "icap_rule"
+	defaultICAPPort    = "1344"
+	defaultICAPTimeout = 5 * time.Second
+)
+
+// icapInfectionHeaders are the ICAP response headers scanners report threats with.
+var icapInfectionHeaders = []string{"X-Infection-Found", "X-Virus-ID", "X-Violations-Found"}
+
+// ICAPConfig forwards request bodies, and optionally response bodies, to an ICAP service
+// (RFC 3507) such as an antivirus or DLP appliance, blocking the requests it flags.
+type ICAPConfig struct {
+	URL         string        `json:"url"`                    // REQMOD service, icap:// or icaps://
+	ResponseURL string        `json:"response_url,omitempty"` // RESPMOD service scanning responses, if set
+	Timeout     time.Duration `json:"timeout,omitempty"`      // Time allowed per scan, default 5s
+	FailClosed  bool          `json:"fail_closed,omitempty"`  // Block when the service can't be reached
+
+	requestService  *url.URL
+	responseService *url.URL
+	dialer          net.Dialer
+}
+
+// icapVerdict is the answer of an ICAP service on a message.
+type icapVerdict struct {
+	blocked bool
+	status  int    // Status of the response the service replaced the message with, if any
+	threat  string // Value of the infection header, if any
+}
+
+// provision validates the service URLs and applies the defaults.
+func (c *ICAPConfig) provision() error {
+	var err error
+	if c.requestService, err = parseICAPURL(c.URL); err != nil {
+		return err
+	}
+	if c.ResponseURL != "" {
+		if c.responseService, err = parseICAPURL(c.ResponseURL); err != nil {
+			return err
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultICAPTimeout
+	}
+	return nil
+}
+
+// parseICAPURL parses an icap:// or icaps:// service URL.
+func parseICAPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "icap" && u.Scheme != "icaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid icap url: %s, must be icap://host[:port]/service", raw)
+	}
+	return u, nil
+}
+
+// scanRequest asks the REQMOD service for its verdict on a request and its body.
+func (c *ICAPConfig) scanRequest(ctx context.Context, r *http.Request, body string) (icapVerdict, error) {
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.Host)
+	if err := r.Header.Write(&header); err != nil {
+		return icapVerdict{}, err
+	}
+	header.WriteString("\r\n")
+	return c.scan(ctx, "REQMOD", c.requestService, []icapSection{{"req-hdr", header.Bytes()}}, "req-body", body, 0)
+}
+
+// scanResponse asks the RESPMOD service for its verdict on a response and its body.
+func (c *ICAPConfig) scanResponse(ctx context.Context, r *http.Request, recorder *responseRecorder) (icapVerdict, error) {
+	var reqHeader bytes.Buffer
+	fmt.Fprintf(&reqHeader, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", r.Method, r.URL.RequestURI(), r.Host)
+	var resHeader bytes.Buffer
+	status := recorder.StatusCode()
+	fmt.Fprintf(&resHeader, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if err := recorder.Header().Write(&resHeader); err != nil {
+		return icapVerdict{}, err
+	}
+	resHeader.WriteString("\r\n")
+	sections := []icapSection{{"req-hdr", reqHeader.Bytes()}, {"res-hdr", resHeader.Bytes()}}
+	return c.scan(ctx, "RESPMOD", c.responseService, sections, "res-body", recorder.BodyString(), status)
+}
+
+// icapSection is an encapsulated HTTP header block.
+type icapSection struct {
+	name string
+	data []byte
+}
+
+// scan sends an ICAP request encapsulating the header sections and the body, and reads the
+// verdict. A 204 answer means the message is clean. A 200 answer replacing a request with
+// a response, replacing a response with an error, or reporting an infection means it is
+// flagged; other modifications are not applied.
+func (c *ICAPConfig) scan(ctx context.Context, method string, service *url.URL, sections []icapSection, bodyName, body string, originalStatus int) (icapVerdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	conn, err := c.dial(ctx, service)
+	if err != nil {
+		return icapVerdict{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var encapsulated []string
+	offset := 0
+	for _, section := range sections {
+		encapsulated = append(encapsulated, section.name+"="+strconv.Itoa(offset))
+		offset += len(section.data)
+	}
+	if body == "" {
+		encapsulated = append(encapsulated, "null-body="+strconv.Itoa(offset))
+	} else {
+		encapsulated = append(encapsulated, bodyName+"="+strconv.Itoa(offset))
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nConnection: close\r\nEncapsulated: %s\r\n\r\n",
+		method, service.String(), service.Host, strings.Join(encapsulated, ", "))
+	for _, section := range sections {
+		w.Write(section.data)
+	}
+	if body != "" {
+		fmt.Fprintf(w, "%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	}
+	if err := w.Flush(); err != nil {
+		return icapVerdict{}, err
+	}
+
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return icapVerdict{}, fmt.Errorf("reading icap response: %w", err)
+	}
+	proto, statusText, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(statusText, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return icapVerdict{}, fmt.Errorf("invalid icap status line: %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return icapVerdict{}, fmt.Errorf("reading icap headers: %w", err)
+	}
+
+	switch code {
+	case "204":
+		return icapVerdict{}, nil
+	case "200":
+	default:
+		return icapVerdict{}, fmt.Errorf("icap service answered %s", statusText)
+	}
+
+	var verdict icapVerdict
+	for _, name := range icapInfectionHeaders {
+		if threat := header.Get(name); threat != "" {
+			verdict = icapVerdict{blocked: true, threat: threat}
+			break
+		}
+	}
+	offsets := parseEncapsulated(header.Get("Encapsulated"))
+	if resOffset, ok := offsets["res-hdr"]; ok {
+		if _, err := reader.Discard(resOffset); err == nil {
+			if resp, err := http.ReadResponse(reader, nil); err == nil {
+				verdict.status = resp.StatusCode
+				_, hadRequest := offsets["req-hdr"]
+				if method == "REQMOD" && !hadRequest {
+					verdict.blocked = true // The request was answered in place of the server
+				}
+				if method == "RESPMOD" && resp.StatusCode >= 400 && originalStatus < 400 {
+					verdict.blocked = true
+				}
+			}
+		}
+	}
+	return verdict, nil
+}
+
+// dial connects to an ICAP service, over TLS for icaps.
+func (c *ICAPConfig) dial(ctx context.Context, service *url.URL) (net.Conn, error) {
+	port := service.Port()
+	if port == "" {
+		port = defaultICAPPort
+	}
+	address := net.JoinHostPort(service.Hostname(), port)
+	if service.Scheme == "icaps" {
+		dialer := &tls.Dialer{NetDialer: &c.dialer, Config: &tls.Config{ServerName: service.Hostname()}}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	return c.dialer.DialContext(ctx, "tcp", address)
+}
+
+// parseEncapsulated parses the Encapsulated header into the offsets of its sections.
+func parseEncapsulated(value string) map[string]int {
+	offsets := make(map[string]int)
+	for _, part := range strings.Split(value, ",") {
+		name, offset, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(offset); err == nil && n >= 0 {
+			offsets[name] = n
+		}
+	}
+	return offsets
+}
+
+// checkICAP scans the body of the request with the REQMOD service in phase 2, blocking the
+// requests it flags. It reports whether the request was blocked.
+func (m *Middleware) checkICAP(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if m.ICAP == nil || m.ICAP.requestService == nil || r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil {
+		return false
+	}
+	verdict, err := m.ICAP.scanRequest(r.Context(), r, body)
+	return m.applyICAPVerdict(w, r, state, "request", verdict, err)
+}
+
+// checkICAPResponse scans the response with the RESPMOD service in phase 4, blocking the
+// responses it flags. It reports whether the response was blocked.
+func (m *Middleware) checkICAPResponse(recorder *responseRecorder, r *http.Request, state *WAFState) bool {
+	if m.ICAP == nil || m.ICAP.responseService == nil || recorder.Streamed() {
+		return false
+	}
+	verdict, err := m.ICAP.scanResponse(r.Context(), r, recorder)
+	return m.applyICAPVerdict(recorder, r, state, "response", verdict, err)
+}
+
+// applyICAPVerdict blocks a flagged message, or one the service failed to scan when
+// failing closed. It reports whether the message was blocked.
+func (m *Middleware) applyICAPVerdict(w http.ResponseWriter, r *http.Request, state *WAFState, scanned string, verdict icapVerdict, err error) bool {
+	if err != nil {
+		m.logger.Warn("ICAP scan failed",
+			zap.String("log_id", getLogID(r.Context())),
+			zap.String("scanned", scanned),
+			zap.Error(err),
+		)
+		if !m.ICAP.FailClosed {
+			return false
+		}
+		verdict = icapVerdict{blocked: true, status: http.StatusServiceUnavailable, threat: "scan failed"}
+	}
+	if !verdict.blocked {
+		return false
+	}
+
+	status := verdict.status
+	if status < 400 {
+		status = http.StatusForbidden
+	}
+	m.icapHits.Add(1)
+	m.incrementRuleHitCount(RuleID(icapRuleID))
+	state.MatchedRules = append(state.MatchedRules, icapRuleID)
+	m.blockRequest(w, r, state, status, "icap", icapRuleID,
+		zap.String("message", "Request blocked by ICAP "+scanned+" scan"),
+		zap.String("threat", verdict.threat),
+	)
+	return true
+}
@@ -0,0 +1,165 @@
+package caddywaf
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeICAPServer answers ICAP requests with the response returned by answer, given the
+// ICAP request line and the encapsulated data.
+func fakeICAPServer(t *testing.T, answer func(line, data string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				if _, err := tp.ReadMIMEHeader(); err != nil {
+					return
+				}
+				var data strings.Builder
+				for {
+					chunk, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					data.WriteString(chunk + "\n")
+					if chunk == "0" {
+						break
+					}
+				}
+				_, _ = io.WriteString(conn, answer(line, data.String()))
+			}()
+		}
+	}()
+	return "icap://" + listener.Addr().String()
+}
+
+func TestICAPConfig_Provision(t *testing.T) {
+	config := &ICAPConfig{URL: "icap://av.internal/reqmod"}
+	require.NoError(t, config.provision())
+	assert.Equal(t, defaultICAPTimeout, config.Timeout)
+	assert.Nil(t, config.responseService)
+
+	for _, config := range []*ICAPConfig{
+		{},
+		{URL: "http://av.internal/reqmod"},
+		{URL: "icap://av.internal/reqmod", ResponseURL: "icap:///respmod"},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckICAP(t *testing.T) {
+	var request atomic.Value
+	base := fakeICAPServer(t, func(line, data string) string {
+		request.Store(line + "\n" + data)
+		if strings.Contains(data, "EICAR") {
+			return "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=EICAR-Test;\r\n" +
+				"Encapsulated: res-hdr=0, null-body=38\r\n\r\n" +
+				"HTTP/1.1 403 Forbidden\r\nServer: av\r\n\r\n"
+		}
+		return "ICAP/1.0 204 No Content\r\n\r\n"
+	})
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ICAP:                  &ICAPConfig{URL: base + "/reqmod"},
+	}
+	require.NoError(t, m.ICAP.provision())
+
+	clean := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	assert.False(t, m.checkICAP(httptest.NewRecorder(), clean, &WAFState{}))
+	sent := request.Load().(string)
+	assert.True(t, strings.HasPrefix(sent, "REQMOD "+base+"/reqmod ICAP/1.0"))
+	assert.Contains(t, sent, "POST /upload HTTP/1.1")
+	assert.Contains(t, sent, "5\nhello\n0\n")
+
+	infected := httptest.NewRequest("POST", "/upload", strings.NewReader("X5O!P%@AP EICAR"))
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkICAP(w, infected, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{icapRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.icapHits.Load())
+
+	// Requests without a body are not scanned
+	request.Store("")
+	assert.False(t, m.checkICAP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), &WAFState{}))
+	assert.Empty(t, request.Load())
+}
+
+func TestCheckICAP_Failure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ICAP:                  &ICAPConfig{URL: "icap://" + address + "/reqmod"},
+	}
+	require.NoError(t, m.ICAP.provision())
+	assert.False(t, m.checkICAP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("a")), &WAFState{}), "fails open")
+
+	m.ICAP.FailClosed = true
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkICAP(w, httptest.NewRequest("POST", "/", strings.NewReader("a")), &WAFState{}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestICAPScanResponse(t *testing.T) {
+	base := fakeICAPServer(t, func(line, data string) string {
+		if strings.Contains(data, "4111-1111-1111-1111") {
+			return "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=40\r\n\r\n" +
+				"HTTP/1.1 451 Unavailable\r\nServer: dlp\r\n\r\n"
+		}
+		return "ICAP/1.0 204 No Content\r\n\r\n"
+	})
+	config := &ICAPConfig{URL: base + "/reqmod", ResponseURL: base + "/respmod"}
+	require.NoError(t, config.provision())
+
+	req := httptest.NewRequest("GET", "/account", nil)
+	recorder := NewResponseRecorder(httptest.NewRecorder())
+	recorder.WriteHeader(http.StatusOK)
+	_, _ = recorder.Write([]byte("card 4111-1111-1111-1111"))
+	verdict, err := config.scanResponse(context.Background(), req, recorder)
+	require.NoError(t, err)
+	assert.True(t, verdict.blocked)
+	assert.Equal(t, 451, verdict.status)
+
+	recorder = NewResponseRecorder(httptest.NewRecorder())
+	_, _ = recorder.Write([]byte("nothing to see"))
+	verdict, err = config.scanResponse(context.Background(), req, recorder)
+	require.NoError(t, err)
+	assert.False(t, verdict.blocked)
+}
+
+func TestParseEncapsulated(t *testing.T) {
+	assert.Equal(t, map[string]int{"req-hdr": 0, "res-hdr": 45, "res-body": 120},
+		parseEncapsulated("req-hdr=0, res-hdr=45, res-body=120"))
+	assert.Empty(t, parseEncapsulated(""))
+}
@@ -0,0 +1,149 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInspectionQueueTimeout  = 100 * time.Millisecond
+	defaultInspectionBodyThreshold = 64 << 10
+	inspectionFallbackAllow        = "allow"
+	inspectionFallbackBlock        = "block"
+	inspectionPoolRuleID           = "inspection_pool_rule"
+)
+
+// InspectionPoolConfig caps the number of expensive inspections running at once.
+type InspectionPoolConfig struct {
+	Workers       int           `json:"workers,omitempty"`        // Default GOMAXPROCS
+	QueueTimeout  time.Duration `json:"queue_timeout,omitempty"`  // Default 100ms
+	Fallback      string        `json:"fallback,omitempty"`       // allow (skip the inspection) or block, default allow
+	BodyThreshold int64         `json:"body_threshold,omitempty"` // Request bodies above this many bytes are expensive, default 64KiB
+}
+
+// InspectionPoolStats reports the usage of the pool.
+type InspectionPoolStats struct {
+	Workers  int   `json:"workers"`
+	Busy     int   `json:"busy"`
+	Acquired int64 `json:"acquired"`
+	Timeouts int64 `json:"timeouts"`
+}
+
+// InspectionPool hands out a fixed number of slots to expensive inspections.
+// Callers that can't get a slot within the queue timeout apply the fallback action.
+type InspectionPool struct {
+	config   InspectionPoolConfig
+	slots    chan struct{}
+	acquired atomic.Int64
+	timeouts atomic.Int64
+}
+
+// NewInspectionPool validates the config, applies defaults and creates the pool.
+func NewInspectionPool(config InspectionPoolConfig) (*InspectionPool, error) {
+	if config.Workers <= 0 {
+		config.Workers = runtime.GOMAXPROCS(0)
+	}
+	if config.QueueTimeout <= 0 {
+		config.QueueTimeout = defaultInspectionQueueTimeout
+	}
+	if config.BodyThreshold <= 0 {
+		config.BodyThreshold = defaultInspectionBodyThreshold
+	}
+	switch config.Fallback {
+	case "":
+		config.Fallback = inspectionFallbackAllow
+	case inspectionFallbackAllow, inspectionFallbackBlock:
+	default:
+		return nil, fmt.Errorf("invalid inspection_pool fallback %q, must be allow or block", config.Fallback)
+	}
+	return &InspectionPool{
+		config: config,
+		slots:  make(chan struct{}, config.Workers),
+	}, nil
+}
+
+// Acquire waits up to the queue timeout for a slot. It reports whether a slot was
+// acquired, in which case Release must be called once the inspection is done.
+func (p *InspectionPool) Acquire(r *http.Request) bool {
+	select {
+	case p.slots <- struct{}{}:
+		p.acquired.Add(1)
+		return true
+	default:
+	}
+	timer := time.NewTimer(p.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		p.acquired.Add(1)
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	p.timeouts.Add(1)
+	return false
+}
+
+// Release returns a slot to the pool.
+func (p *InspectionPool) Release() {
+	<-p.slots
+}
+
+// Stats returns the pool usage counters.
+func (p *InspectionPool) Stats() InspectionPoolStats {
+	return InspectionPoolStats{
+		Workers:  p.config.Workers,
+		Busy:     len(p.slots),
+		Acquired: p.acquired.Load(),
+		Timeouts: p.timeouts.Load(),
+	}
+}
+
+// isExpensiveInspection reports whether a phase has to run inside the inspection pool:
+// request phases with a large or unknown-length body, and the response body phase when
+// the request's host has response body rules.
+func (m *Middleware) isExpensiveInspection(r *http.Request, phase int, state *WAFState) bool {
+	if m.inspectionPool == nil {
+		return false
+	}
+	switch phase {
+	case 2:
+		if r.Body == nil || r.Body == http.NoBody {
+			return false
+		}
+		return r.ContentLength < 0 || r.ContentLength > m.inspectionPool.config.BodyThreshold
+	case 4:
+		rules, _ := m.rulesForPhase(state, 4)
+		return len(rules) > 0
+	}
+	return false
+}
+
+// acquireInspection reserves a pool slot for an expensive phase. When none frees up in
+// time, the fallback action is applied: the phase is skipped, or the request is blocked
+// with 503. It reports whether the phase should run; if so, release must be called after.
+func (m *Middleware) acquireInspection(w http.ResponseWriter, r *http.Request, phase int, state *WAFState) (release func(), run bool) {
+	if !m.isExpensiveInspection(r, phase, state) {
+		return func() {}, true
+	}
+	if m.inspectionPool.Acquire(r) {
+		return m.inspectionPool.Release, true
+	}
+	if m.inspectionPool.config.Fallback == inspectionFallbackBlock {
+		m.blockRequest(w, r, state, http.StatusServiceUnavailable, "inspection_overload", inspectionPoolRuleID,
+			zap.String("message", "Request blocked because the inspection pool is saturated"),
+			zap.Int("phase", phase),
+		)
+		return nil, false
+	}
+	m.logRequest(zap.WarnLevel, "Inspection pool saturated, skipping phase", r,
+		zap.Int("phase", phase),
+		zap.Duration("queue_timeout", m.inspectionPool.config.QueueTimeout),
+	)
+	return nil, false
+}
@@ -0,0 +1,113 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewInspectionPool(t *testing.T) {
+	pool, err := NewInspectionPool(InspectionPoolConfig{})
+	require.NoError(t, err)
+	assert.Positive(t, pool.config.Workers)
+	assert.Equal(t, defaultInspectionQueueTimeout, pool.config.QueueTimeout)
+	assert.Equal(t, inspectionFallbackAllow, pool.config.Fallback)
+	assert.Equal(t, int64(defaultInspectionBodyThreshold), pool.config.BodyThreshold)
+
+	_, err = NewInspectionPool(InspectionPoolConfig{Fallback: "queue"})
+	assert.Error(t, err)
+}
+
+func TestInspectionPool_AcquireTimeout(t *testing.T) {
+	pool, err := NewInspectionPool(InspectionPoolConfig{Workers: 1, QueueTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	r := httptest.NewRequest("POST", "/", nil)
+
+	require.True(t, pool.Acquire(r))
+	assert.Equal(t, 1, pool.Stats().Busy)
+	assert.False(t, pool.Acquire(r), "the only slot is taken")
+
+	// A slot released while waiting is handed to the waiter
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		pool.Release()
+	}()
+	pool.config.QueueTimeout = time.Second
+	assert.True(t, pool.Acquire(r))
+	pool.Release()
+
+	stats := pool.Stats()
+	assert.Equal(t, 0, stats.Busy)
+	assert.Equal(t, int64(2), stats.Acquired)
+	assert.Equal(t, int64(1), stats.Timeouts)
+}
+
+func TestIsExpensiveInspection(t *testing.T) {
+	pool, err := NewInspectionPool(InspectionPoolConfig{BodyThreshold: 10})
+	require.NoError(t, err)
+	m := &Middleware{
+		logger:         zap.NewNop(),
+		inspectionPool: pool,
+		Rules: map[int][]Rule{4: {
+			{ID: "leak", Phase: 4, Pattern: "secret", Targets: []string{"RESPONSE_BODY"}},
+		}},
+	}
+
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("POST", "/", strings.NewReader("small")), 2, &WAFState{}))
+	assert.True(t, m.isExpensiveInspection(httptest.NewRequest("POST", "/", strings.NewReader("a body over ten bytes")), 2, &WAFState{}))
+	chunked := httptest.NewRequest("POST", "/", strings.NewReader("x"))
+	chunked.ContentLength = -1
+	assert.True(t, m.isExpensiveInspection(chunked, 2, &WAFState{}), "bodies of unknown length are expensive")
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("GET", "/", nil), 2, &WAFState{}))
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("POST", "/", strings.NewReader("a body over ten bytes")), 1, &WAFState{}))
+	assert.True(t, m.isExpensiveInspection(httptest.NewRequest("GET", "/", nil), 4, &WAFState{}))
+
+	overlay := &HostOverlay{rules: map[int][]Rule{}}
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("GET", "/", nil), 4, &WAFState{overlay: overlay}), "rules disabled by the host overlay")
+	m.Rules = map[int][]Rule{}
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("GET", "/", nil), 4, &WAFState{}), "no response body rules")
+	m.inspectionPool = nil
+	assert.False(t, m.isExpensiveInspection(httptest.NewRequest("POST", "/", strings.NewReader("a body over ten bytes")), 2, &WAFState{}))
+}
+
+func TestAcquireInspection_Fallback(t *testing.T) {
+	large := func() *http.Request {
+		return httptest.NewRequest("POST", "/upload", strings.NewReader("a body over ten bytes"))
+	}
+
+	pool, err := NewInspectionPool(InspectionPoolConfig{Workers: 1, QueueTimeout: 10 * time.Millisecond, BodyThreshold: 10})
+	require.NoError(t, err)
+	m := &Middleware{logger: zap.NewNop(), inspectionPool: pool}
+	release, run := m.acquireInspection(httptest.NewRecorder(), large(), 2, &WAFState{})
+	require.True(t, run)
+
+	state := &WAFState{}
+	_, run = m.acquireInspection(httptest.NewRecorder(), large(), 2, state)
+	assert.False(t, run, "saturated pool skips the phase")
+	assert.False(t, state.Blocked)
+
+	_, run = m.acquireInspection(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), 2, state)
+	assert.True(t, run, "cheap phases don't use the pool")
+	release()
+
+	pool, err = NewInspectionPool(InspectionPoolConfig{Workers: 1, QueueTimeout: 10 * time.Millisecond, Fallback: inspectionFallbackBlock, BodyThreshold: 10})
+	require.NoError(t, err)
+	m = &Middleware{logger: zap.NewNop(), inspectionPool: pool}
+	release, run = m.acquireInspection(httptest.NewRecorder(), large(), 2, &WAFState{})
+	require.True(t, run)
+	defer release()
+
+	state = &WAFState{}
+	w := httptest.NewRecorder()
+	_, run = m.acquireInspection(w, large(), 2, state)
+	assert.False(t, run)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusServiceUnavailable, state.StatusCode)
+	assert.Equal(t, int64(2), m.inspectionPool.Stats().Timeouts+m.inspectionPool.Stats().Acquired)
+}
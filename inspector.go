@@ -0,0 +1,226 @@
+package caddywaf
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"plugin"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	inspectorRuleID         = "inspector_rule"
+	inspectorPluginSymbol   = "NewInspector"
+	defaultInspectorTimeout = 100 * time.Millisecond
+)
+
+// Inspector is a custom detector invoked at the phases it is configured for. It can add to
+// the anomaly score of the request, set variables readable by rules or block the request.
+type Inspector interface {
+	Inspect(ctx context.Context, in *Inspection) (InspectionResult, error)
+}
+
+// InspectorFactory creates an inspector from its option values. Go plugins loaded by the
+// inspector directive export one as NewInspector.
+type InspectorFactory func(options map[string]string) (Inspector, error)
+
+// Inspection is what an inspector sees of a request.
+type Inspection struct {
+	Phase          int
+	Request        *http.Request     // Its body must not be read, use Body instead
+	Body           string            // Request body in phase 2, response body in phase 4
+	ResponseStatus int               // Phases 3 and 4
+	ResponseHeader http.Header       // Phases 3 and 4
+	Score          int               // Anomaly score so far
+	MatchedRules   []string          // IDs of the rules matched so far
+	Vars           map[string]string // Variables set so far
+}
+
+// InspectionResult is the verdict of an inspector on a request.
+type InspectionResult struct {
+	Score  int               // Added to the anomaly score of the request
+	Vars   map[string]string // Set on the request, readable by rules as TX:<name> targets
+	Block  bool              // Blocks the request
+	Status int               // Status of the block, default 403
+	Reason string            // Logged with the block
+}
+
+var (
+	inspectorsMu sync.RWMutex
+	inspectors   = map[string]InspectorFactory{}
+)
+
+// RegisterInspector makes an inspector available to the inspector directive. It is meant
+// to be called from the init function of the package implementing the inspector, and
+// panics if the name is taken.
+func RegisterInspector(name string, factory InspectorFactory) {
+	inspectorsMu.Lock()
+	defer inspectorsMu.Unlock()
+	if _, exists := inspectors[name]; exists {
+		panic("inspector already registered: " + name)
+	}
+	inspectors[name] = factory
+}
+
+// InspectorConfig invokes a registered inspector, or one loaded from a Go plugin, at some
+// phases of the requests.
+type InspectorConfig struct {
+	Name       string            `json:"name"`                  // Registered name, or label of a plugin inspector
+	Plugin     string            `json:"plugin,omitempty"`      // Path of a Go plugin exporting NewInspector
+	Phases     []int             `json:"phases,omitempty"`      // Phases invoked at, default 1
+	Options    map[string]string `json:"options,omitempty"`     // Passed to the inspector factory
+	Timeout    time.Duration     `json:"timeout,omitempty"`     // Time allowed per invocation, default 100ms
+	FailClosed bool              `json:"fail_closed,omitempty"` // Block requests the inspector fails on
+
+	inspector Inspector
+}
+
+// provision validates the config, applies the defaults and creates the inspector.
+func (c *InspectorConfig) provision() error {
+	if c.Name == "" {
+		return fmt.Errorf("inspector requires a name")
+	}
+	if len(c.Phases) == 0 {
+		c.Phases = []int{1}
+	}
+	for _, phase := range c.Phases {
+		if phase < 1 || phase > 4 {
+			return fmt.Errorf("invalid inspector %s phase %d, must be between 1 and 4", c.Name, phase)
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultInspectorTimeout
+	}
+
+	var factory InspectorFactory
+	if c.Plugin != "" {
+		var err error
+		if factory, err = openInspectorPlugin(c.Plugin); err != nil {
+			return fmt.Errorf("failed to load inspector %s: %w", c.Name, err)
+		}
+	} else {
+		inspectorsMu.RLock()
+		registered, ok := inspectors[c.Name]
+		inspectorsMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown inspector: %s", c.Name)
+		}
+		factory = registered
+	}
+	inspector, err := factory(c.Options)
+	if err != nil {
+		return fmt.Errorf("failed to create inspector %s: %w", c.Name, err)
+	}
+	c.inspector = inspector
+	return nil
+}
+
+// openInspectorPlugin returns the NewInspector factory of a Go plugin. Plugins must be
+// built with the same Go version and module versions as Caddy.
+func openInspectorPlugin(path string) (InspectorFactory, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup(inspectorPluginSymbol)
+	if err != nil {
+		return nil, err
+	}
+	switch factory := symbol.(type) {
+	case func(map[string]string) (Inspector, error):
+		return factory, nil
+	case *InspectorFactory:
+		return *factory, nil
+	}
+	return nil, fmt.Errorf("plugin %s symbol %s is a %T, not an InspectorFactory", path, inspectorPluginSymbol, symbol)
+}
+
+// runInspectors invokes the inspectors configured for a phase, in order. It reports
+// whether the request was blocked.
+func (m *Middleware) runInspectors(w http.ResponseWriter, r *http.Request, phase int, state *WAFState) bool {
+	for _, config := range m.Inspectors {
+		if config.inspector == nil || !slices.Contains(config.Phases, phase) {
+			continue
+		}
+		if m.runInspector(config, w, r, phase, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// runInspector invokes an inspector and applies its result, reporting whether the request
+// was blocked.
+func (m *Middleware) runInspector(config *InspectorConfig, w http.ResponseWriter, r *http.Request, phase int, state *WAFState) bool {
+	in := &Inspection{
+		Phase:        phase,
+		Request:      r,
+		Score:        state.TotalScore,
+		MatchedRules: slices.Clone(state.MatchedRules),
+		Vars:         maps.Clone(state.vars),
+	}
+	if phase == 2 {
+		in.Body, _ = m.extractTarget(TargetBody, r, nil, state) // Shared with the rules reading the body
+	}
+	if recorder, ok := w.(*responseRecorder); ok && phase >= 3 {
+		in.ResponseStatus = recorder.StatusCode()
+		in.ResponseHeader = recorder.Header().Clone()
+		if phase == 4 {
+			in.Body = recorder.BodyString()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.Timeout)
+	defer cancel()
+	result, err := config.inspector.Inspect(ctx, in)
+	if err != nil {
+		m.logger.Warn("Inspector failed",
+			zap.String("log_id", getLogID(r.Context())),
+			zap.String("inspector", config.Name),
+			zap.Int("phase", phase),
+			zap.Error(err),
+		)
+		if !config.FailClosed {
+			return false
+		}
+		result = InspectionResult{Block: true, Reason: "inspector failure"}
+	}
+
+	if len(result.Vars) > 0 {
+		if state.vars == nil {
+			state.vars = make(map[string]string, len(result.Vars))
+		}
+		maps.Copy(state.vars, result.Vars)
+	}
+	if !result.Block && result.Score == 0 {
+		return false
+	}
+
+	m.inspectorHits.Add(1)
+	m.incrementRuleHitCount(RuleID(inspectorRuleID))
+	state.MatchedRules = append(state.MatchedRules, inspectorRuleID)
+	action, status := detectionActionScore, http.StatusForbidden
+	if result.Block {
+		action = detectionActionBlock
+		if result.Status != 0 {
+			status = result.Status
+		}
+	}
+	return m.applyDetection(w, r, state, action, result.Score, status, "inspector", inspectorRuleID,
+		"Inspector flagged request", zap.String("inspector", config.Name), zap.Int("phase", phase), zap.String("reason", result.Reason))
+}
+
+// varTarget returns the value of a TX:<name> target, the variable set by inspectors,
+// reporting whether target is one.
+func varTarget(target string, state *WAFState) (string, bool) {
+	if len(target) <= len(TargetVarPrefix) || !strings.EqualFold(target[:len(TargetVarPrefix)], TargetVarPrefix) {
+		return "", false
+	}
+	return state.vars[target[len(TargetVarPrefix):]], true
+}
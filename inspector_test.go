@@ -0,0 +1,130 @@
+package caddywaf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// inspectorFunc adapts a function to the Inspector interface.
+type inspectorFunc func(ctx context.Context, in *Inspection) (InspectionResult, error)
+
+func (f inspectorFunc) Inspect(ctx context.Context, in *Inspection) (InspectionResult, error) {
+	return f(ctx, in)
+}
+
+func init() {
+	RegisterInspector("test_fraud", func(options map[string]string) (Inspector, error) {
+		if options["fail"] != "" {
+			return nil, errors.New(options["fail"])
+		}
+		return inspectorFunc(func(context.Context, *Inspection) (InspectionResult, error) {
+			return InspectionResult{Vars: map[string]string{"mode": options["mode"]}}, nil
+		}), nil
+	})
+}
+
+func TestInspectorConfig_Provision(t *testing.T) {
+	config := &InspectorConfig{Name: "test_fraud", Options: map[string]string{"mode": "strict"}}
+	require.NoError(t, config.provision())
+	assert.Equal(t, []int{1}, config.Phases)
+	assert.Equal(t, defaultInspectorTimeout, config.Timeout)
+	result, err := config.inspector.Inspect(context.Background(), &Inspection{})
+	require.NoError(t, err)
+	assert.Equal(t, "strict", result.Vars["mode"])
+
+	for _, config := range []*InspectorConfig{
+		{},
+		{Name: "unknown"},
+		{Name: "test_fraud", Phases: []int{0}},
+		{Name: "test_fraud", Options: map[string]string{"fail": "no endpoint"}},
+		{Name: "custom", Plugin: filepath.Join(t.TempDir(), "missing.so")},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+
+	assert.Panics(t, func() { RegisterInspector("test_fraud", nil) })
+}
+
+func TestRunInspectors(t *testing.T) {
+	var seen *Inspection
+	score := func(_ context.Context, in *Inspection) (InspectionResult, error) {
+		seen = in
+		return InspectionResult{Score: 3, Vars: map[string]string{"risk": "high"}}, nil
+	}
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		AnomalyThreshold: 5,
+		Inspectors: []*InspectorConfig{
+			{Name: "scorer", Phases: []int{1}, Timeout: defaultInspectorTimeout, inspector: inspectorFunc(score)},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	state := &WAFState{TotalScore: 1}
+	assert.False(t, m.runInspectors(httptest.NewRecorder(), req, 1, state))
+	assert.Equal(t, 1, seen.Score)
+	assert.Equal(t, 4, state.TotalScore)
+	assert.Equal(t, []string{inspectorRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.inspectorHits.Load())
+
+	value, err := m.extractTarget("TX:risk", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "high", value)
+	value, err = m.extractTarget("tx:missing", req, nil, state)
+	require.NoError(t, err)
+	assert.Empty(t, value)
+
+	// Not configured for phase 2
+	assert.False(t, m.runInspectors(httptest.NewRecorder(), req, 2, state))
+	assert.Equal(t, 4, state.TotalScore)
+
+	// The second score reaches the anomaly threshold
+	w := httptest.NewRecorder()
+	assert.True(t, m.runInspectors(w, req, 1, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "high", seen.Vars["risk"])
+}
+
+func TestRunInspectors_BlockAndFailure(t *testing.T) {
+	block := func(context.Context, *Inspection) (InspectionResult, error) {
+		return InspectionResult{Block: true, Status: http.StatusTooManyRequests, Reason: "card testing"}, nil
+	}
+	failing := func(ctx context.Context, _ *Inspection) (InspectionResult, error) {
+		<-ctx.Done()
+		return InspectionResult{}, ctx.Err()
+	}
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 5, requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader(`{"card": "4111"}`))
+
+	m.Inspectors = []*InspectorConfig{{Name: "failing", Phases: []int{2}, Timeout: time.Millisecond, inspector: inspectorFunc(failing)}}
+	assert.False(t, m.runInspectors(httptest.NewRecorder(), req, 2, &WAFState{}), "fails open")
+
+	m.Inspectors[0].FailClosed = true
+	w := httptest.NewRecorder()
+	assert.True(t, m.runInspectors(w, req, 2, &WAFState{}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var body string
+	m.Inspectors = []*InspectorConfig{{Name: "cards", Phases: []int{2}, Timeout: defaultInspectorTimeout,
+		inspector: inspectorFunc(func(ctx context.Context, in *Inspection) (InspectionResult, error) {
+			body = in.Body
+			return block(ctx, in)
+		})}}
+	w = httptest.NewRecorder()
+	state := &WAFState{}
+	req = httptest.NewRequest("POST", "/checkout", strings.NewReader(`{"card": "4111"}`))
+	assert.True(t, m.runInspectors(w, req, 2, state))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, `{"card": "4111"}`, body)
+	assert.True(t, state.Blocked)
+}
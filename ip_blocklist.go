@@ -0,0 +1,474 @@
+package caddywaf
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+	"go.uber.org/zap"
+)
+
+// IPBlacklistLoadStats describes the last load of the IP blacklist.
+type IPBlacklistLoadStats struct {
+	TotalLines     int   `json:"total_lines"`
+	ValidEntries   int   `json:"valid_entries"`
+	InvalidEntries int   `json:"invalid_entries"`
+	ExpiredEntries int   `json:"expired_entries"`   // Entries skipped for an expiry in the past
+	Annotated      int   `json:"annotated_entries"` // Entries with a reason or an expiry
+	Ranges         int   `json:"ranges"`            // Address ranges left after merging overlapping and adjacent entries
+	Prefixes       int   `json:"prefixes"`          // CIDR prefixes inserted into the trie
+	DurationMS     int64 `json:"duration_ms"`
+}
+
+// uint128 is an IPv6 address as an unsigned integer.
+type uint128 struct{ hi, lo uint64 }
+
+func uint128From(addr netip.Addr) uint128 {
+	b := addr.As16()
+	var u uint128
+	for i := 0; i < 8; i++ {
+		u.hi = u.hi<<8 | uint64(b[i])
+		u.lo = u.lo<<8 | uint64(b[i+8])
+	}
+	return u
+}
+
+func (u uint128) addr() netip.Addr {
+	var b [16]byte
+	for i := 7; i >= 0; i-- {
+		b[i], b[i+8] = byte(u.hi>>(8*(7-i))), byte(u.lo>>(8*(7-i)))
+	}
+	return netip.AddrFrom16(b)
+}
+
+func (u uint128) cmp(v uint128) int {
+	if c := cmp.Compare(u.hi, v.hi); c != 0 {
+		return c
+	}
+	return cmp.Compare(u.lo, v.lo)
+}
+
+// add returns u+v and whether the addition overflowed.
+func (u uint128) add(v uint128) (uint128, bool) {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	hi, carry := bits.Add64(u.hi, v.hi, carry)
+	return uint128{hi, lo}, carry != 0
+}
+
+// ones returns the mask of the n low bits, for n <= 128.
+func ones(n int) uint128 {
+	if n < 64 {
+		return uint128{0, 1<<n - 1}
+	}
+	return uint128{1<<(n-64) - 1, ^uint64(0)}
+}
+
+// or returns the bitwise or of u and v.
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+type ipv4Range struct{ start, end uint32 }
+
+type ipv6Range struct{ start, end uint128 }
+
+// Prefix lengths blocked by single addresses in an IP blacklist, unless configured otherwise
+const (
+	defaultIPv4BlacklistPrefix = 32
+	defaultIPv6BlacklistPrefix = 64
+)
+
+// validateIPBlacklistPrefixes checks the prefix lengths blocked by single addresses, where
+// zero stands for the default.
+func validateIPBlacklistPrefixes(ipv4, ipv6 int) error {
+	if ipv4 < 0 || ipv4 > 32 {
+		return fmt.Errorf("invalid ip_blacklist_prefix ipv4 length: %d, must be between 1 and 32", ipv4)
+	}
+	if ipv6 < 0 || ipv6 > 128 {
+		return fmt.Errorf("invalid ip_blacklist_prefix ipv6 length: %d, must be between 1 and 128", ipv6)
+	}
+	return nil
+}
+
+// ipBlacklistBuilder collects IP blacklist entries as compact address ranges, so a list of
+// millions of entries costs 8 bytes per IPv4 and 32 bytes per IPv6 entry while loading.
+type ipBlacklistBuilder struct {
+	v4 []ipv4Range
+	v6 []ipv6Range
+
+	v4Bits int // Prefix length blocked by single IPv4 addresses, default 32
+	v6Bits int // Prefix length blocked by single IPv6 addresses, default 64
+}
+
+// add adds an IP, CIDR or start-end range entry. CIDR entries block their prefix whatever
+// its length, and single addresses the configured prefix around them, /32 for IPv4 and /64
+// for IPv6 by default. IPv4-mapped IPv6 addresses count as IPv4.
+func (b *ipBlacklistBuilder) add(entry string) error {
+	if first, last, ok := strings.Cut(entry, "-"); ok {
+		return b.addRange(entry, first, last)
+	}
+	var prefix netip.Prefix
+	var err error
+	if strings.Contains(entry, "/") {
+		prefix, err = netip.ParsePrefix(entry)
+	} else {
+		prefix, err = b.addressPrefix(entry)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid IP/CIDR entry in blacklist: %s", entry)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0)).Masked()
+	}
+
+	if prefix.Addr().Is4() {
+		start := uint32From(prefix.Addr())
+		size := uint32(1<<(32-prefix.Bits()) - 1)
+		b.v4 = append(b.v4, ipv4Range{start, start | size})
+		return nil
+	}
+	start := uint128From(prefix.Addr())
+	b.v6 = append(b.v6, ipv6Range{start, start.or(ones(128 - prefix.Bits()))})
+	return nil
+}
+
+// addRange adds the addresses from first to last, both included and of the same family.
+func (b *ipBlacklistBuilder) addRange(entry, first, last string) error {
+	start, err := netip.ParseAddr(strings.TrimSpace(first))
+	if err != nil || start.Zone() != "" {
+		return fmt.Errorf("invalid IP range in blacklist: %s", entry)
+	}
+	end, err := netip.ParseAddr(strings.TrimSpace(last))
+	if err != nil || end.Zone() != "" {
+		return fmt.Errorf("invalid IP range in blacklist: %s", entry)
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return fmt.Errorf("invalid IP range in blacklist: %s", entry)
+	}
+	if start.Is4() {
+		b.v4 = append(b.v4, ipv4Range{uint32From(start), uint32From(end)})
+	} else {
+		b.v6 = append(b.v6, ipv6Range{uint128From(start), uint128From(end)})
+	}
+	return nil
+}
+
+// addressPrefix returns the prefix blocked by a single address.
+func (b *ipBlacklistBuilder) addressPrefix(entry string) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("zoned address %s", entry)
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr.Prefix(cmp.Or(b.v4Bits, defaultIPv4BlacklistPrefix))
+	}
+	return addr.Prefix(cmp.Or(b.v6Bits, defaultIPv6BlacklistPrefix))
+}
+
+func uint32From(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// merge sorts the ranges and merges the ones that overlap or are adjacent.
+func (b *ipBlacklistBuilder) merge() {
+	slices.SortFunc(b.v4, func(x, y ipv4Range) int { return cmp.Compare(x.start, y.start) })
+	merged4 := b.v4[:0]
+	for _, r := range b.v4 {
+		if n := len(merged4); n > 0 && uint64(r.start) <= uint64(merged4[n-1].end)+1 {
+			merged4[n-1].end = max(merged4[n-1].end, r.end)
+			continue
+		}
+		merged4 = append(merged4, r)
+	}
+	b.v4 = slices.Clip(merged4)
+
+	slices.SortFunc(b.v6, func(x, y ipv6Range) int { return x.start.cmp(y.start) })
+	merged6 := b.v6[:0]
+	for _, r := range b.v6 {
+		if n := len(merged6); n > 0 {
+			last := &merged6[n-1]
+			next, overflow := last.end.add(uint128{0, 1})
+			if overflow || r.start.cmp(next) <= 0 {
+				if r.end.cmp(last.end) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged6 = append(merged6, r)
+	}
+	b.v6 = slices.Clip(merged6)
+}
+
+// entryPrefixes returns the prefixes blocked by an entry on its own, with the prefix
+// lengths of the builder.
+func (b *ipBlacklistBuilder) entryPrefixes(entry string) ([]netip.Prefix, error) {
+	single := ipBlacklistBuilder{v4Bits: b.v4Bits, v6Bits: b.v6Bits}
+	if err := single.add(entry); err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	single.prefixes(func(prefix netip.Prefix) { prefixes = append(prefixes, prefix) })
+	return prefixes, nil
+}
+
+// covers reports whether the merged ranges hold the whole prefix.
+func (b *ipBlacklistBuilder) covers(prefix netip.Prefix) bool {
+	if prefix.Addr().Is4() {
+		start := uint32From(prefix.Addr())
+		end := start | uint32(1<<(32-prefix.Bits())-1)
+		i, _ := slices.BinarySearchFunc(b.v4, start, func(r ipv4Range, addr uint32) int { return cmp.Compare(r.end, addr) })
+		return i < len(b.v4) && b.v4[i].start <= start && b.v4[i].end >= end
+	}
+	start := uint128From(prefix.Addr())
+	end := start.or(ones(128 - prefix.Bits()))
+	i, _ := slices.BinarySearchFunc(b.v6, start, func(r ipv6Range, addr uint128) int { return r.end.cmp(addr) })
+	return i < len(b.v6) && b.v6[i].start.cmp(start) <= 0 && b.v6[i].end.cmp(end) >= 0
+}
+
+// prefixes calls insert with the fewest CIDR prefixes covering the merged ranges, in address order.
+func (b *ipBlacklistBuilder) prefixes(insert func(netip.Prefix)) {
+	for _, r := range b.v4 {
+		for start := uint64(r.start); start <= uint64(r.end); {
+			size := min(bits.TrailingZeros64(start), 32)
+			for start+(1<<size)-1 > uint64(r.end) {
+				size--
+			}
+			addr := netip.AddrFrom4([4]byte{byte(start >> 24), byte(start >> 16), byte(start >> 8), byte(start)})
+			insert(netip.PrefixFrom(addr, 32-size))
+			start += 1 << size
+		}
+	}
+	for _, r := range b.v6 {
+		for start := r.start; ; {
+			size := start.trailingZeros()
+			for size > 0 && start.or(ones(size)).cmp(r.end) > 0 {
+				size--
+			}
+			insert(netip.PrefixFrom(start.addr(), 128-size))
+			last := start.or(ones(size))
+			if last.cmp(r.end) >= 0 {
+				break
+			}
+			start, _ = last.add(uint128{0, 1})
+		}
+	}
+}
+
+// ipBlacklistAnnotation is the reason and expiry given to a blacklist entry, stored as the
+// value of its prefixes in the blacklist trie.
+type ipBlacklistAnnotation struct {
+	Reason  string
+	Expires time.Time // Zero for no expiry
+}
+
+// expired reports whether the entry no longer blocks at the given time.
+func (a *ipBlacklistAnnotation) expired(now time.Time) bool {
+	return !a.Expires.IsZero() && !now.Before(a.Expires)
+}
+
+// annotatedEntry is an annotated blacklist entry, kept apart from the merged entries so its
+// prefixes carry its annotation.
+type annotatedEntry struct {
+	prefixes   []netip.Prefix
+	annotation *ipBlacklistAnnotation
+}
+
+// splitBlacklistLine splits a blacklist line into its fields, separated by spaces, keeping
+// the spaces of double-quoted values and dropping what follows a # outside of quotes.
+func splitBlacklistLine(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted, inField = !quoted, true
+		case quoted:
+			field.WriteRune(r)
+		case r == '#':
+			if inField {
+				fields = append(fields, field.String())
+			}
+			return fields, nil
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in blacklist line: %s", line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// parseBlacklistAnnotation parses the reason=<text> and expires=<time> fields following a
+// blacklist entry, where the expiry is an RFC 3339 time or a date, standing for midnight
+// UTC. It returns nil for an entry without annotations.
+func parseBlacklistAnnotation(fields []string) (*ipBlacklistAnnotation, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	annotation := &ipBlacklistAnnotation{}
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(key) {
+		case "reason":
+			annotation.Reason = value
+		case "expires":
+			expires, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				if expires, err = time.Parse(time.DateOnly, value); err != nil {
+					return nil, fmt.Errorf("invalid blacklist expiry: %s", value)
+				}
+			}
+			annotation.Expires = expires
+		default:
+			return nil, fmt.Errorf("unknown blacklist annotation: %s", field)
+		}
+	}
+	return annotation, nil
+}
+
+// ipBlacklistLookup reports whether a blacklist trie holds an address at the given time,
+// with the annotation of the entry holding it, if any.
+func ipBlacklistLookup(trie *iptrie.Trie, addr netip.Addr, now time.Time) (bool, *ipBlacklistAnnotation) {
+	if annotation, ok := trie.Find(addr).(*ipBlacklistAnnotation); ok {
+		if annotation.expired(now) {
+			return false, nil
+		}
+		return true, annotation
+	}
+	return trie.Contains(addr), nil
+}
+
+// readIPBlacklist streams an IP blacklist into a trie, merging overlapping and adjacent
+// entries into as few prefixes as possible. Comments may also follow an entry on its line,
+// and so may a reason and an expiry: entries expired already are skipped, and the others
+// are kept unmerged, with their annotation as the value of their prefixes.
+func (bl *BlacklistLoader) readIPBlacklist(r io.Reader, path string) (*iptrie.Trie, IPBlacklistLoadStats, error) {
+	began := time.Now()
+	var stats IPBlacklistLoadStats
+	builder := ipBlacklistBuilder{v4Bits: bl.ipv4Prefix, v6Bits: bl.ipv6Prefix}
+	var annotated []annotatedEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		stats.TotalLines++
+		fields, err := splitBlacklistLine(scanner.Text())
+		if err == nil && len(fields) == 0 {
+			continue // Skip empty lines and comments
+		}
+		var annotation *ipBlacklistAnnotation
+		if err == nil {
+			annotation, err = parseBlacklistAnnotation(fields[1:])
+		}
+		switch {
+		case err != nil:
+		case annotation == nil:
+			err = builder.add(fields[0])
+		case annotation.expired(began):
+			stats.ExpiredEntries++
+			continue
+		default:
+			var prefixes []netip.Prefix
+			if prefixes, err = builder.entryPrefixes(fields[0]); err == nil {
+				annotated = append(annotated, annotatedEntry{prefixes, annotation})
+				stats.Annotated++
+			}
+		}
+		if err != nil {
+			bl.logger.Warn("Invalid IP/CIDR entry in blacklist file",
+				zap.String("path", path),
+				zap.Int("line", stats.TotalLines),
+				zap.String("entry", strings.TrimSpace(scanner.Text())),
+				zap.Error(err),
+			)
+			stats.InvalidEntries++
+			continue
+		}
+		stats.ValidEntries++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, stats, fmt.Errorf("error reading IP blacklist file: %w", err)
+	}
+
+	builder.merge()
+	stats.Ranges = len(builder.v4) + len(builder.v6)
+	trie := iptrie.NewTrie()
+	loader := iptrie.NewTrieLoader(trie)
+	builder.prefixes(func(prefix netip.Prefix) {
+		loader.Insert(prefix, struct{}{})
+		stats.Prefixes++
+	})
+	// Annotated prefixes within merged entries block for good, so only their reason counts
+	for _, entry := range annotated {
+		for _, prefix := range entry.prefixes {
+			annotation := entry.annotation
+			if !annotation.Expires.IsZero() && builder.covers(prefix) {
+				annotation = &ipBlacklistAnnotation{Reason: annotation.Reason}
+			}
+			trie.Insert(prefix, annotation)
+			stats.Prefixes++
+		}
+	}
+	stats.DurationMS = time.Since(began).Milliseconds()
+	return trie, stats, nil
+}
+
+// LoadIPBlacklist loads an IP blacklist file into a new trie, returning its load statistics.
+func (bl *BlacklistLoader) LoadIPBlacklist(path string) (*iptrie.Trie, IPBlacklistLoadStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, IPBlacklistLoadStats{}, fmt.Errorf("failed to open IP blacklist file: %w", err)
+	}
+	defer file.Close()
+
+	trie, stats, err := bl.readIPBlacklist(file, path)
+	if err != nil {
+		return nil, stats, err
+	}
+	bl.logger.Info("IP blacklist loaded",
+		zap.String("path", path),
+		zap.Int("valid_entries", stats.ValidEntries),
+		zap.Int("invalid_entries", stats.InvalidEntries),
+		zap.Int("expired_entries", stats.ExpiredEntries),
+		zap.Int("annotated_entries", stats.Annotated),
+		zap.Int("total_lines", stats.TotalLines),
+		zap.Int("ranges", stats.Ranges),
+		zap.Int("prefixes", stats.Prefixes),
+		zap.Int64("duration_ms", stats.DurationMS),
+	)
+	return trie, stats, nil
+}
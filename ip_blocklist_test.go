@@ -0,0 +1,248 @@
+package caddywaf
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func builderPrefixes(t *testing.T, entries ...string) []string {
+	t.Helper()
+	var b ipBlacklistBuilder
+	for _, entry := range entries {
+		require.NoError(t, b.add(entry))
+	}
+	b.merge()
+	var prefixes []string
+	b.prefixes(func(prefix netip.Prefix) { prefixes = append(prefixes, prefix.String()) })
+	return prefixes
+}
+
+func TestIPBlacklistBuilder_Aggregates(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+	}{
+		{"duplicates", []string{"192.0.2.1", "192.0.2.1", "192.0.2.1/32"}, []string{"192.0.2.1/32"}},
+		{"adjacent addresses", []string{"192.0.2.0", "192.0.2.1", "192.0.2.2", "192.0.2.3"}, []string{"192.0.2.0/30"}},
+		{"contained", []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.3.4"}, []string{"10.0.0.0/8"}},
+		{"adjacent ranges", []string{"10.0.1.0/24", "10.0.0.0/24"}, []string{"10.0.0.0/23"}},
+		{"unaligned", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{"10.0.0.1/32", "10.0.0.2/31"}},
+		{"unmasked", []string{"10.0.0.7/24"}, []string{"10.0.0.0/24"}},
+		{"whole space", []string{"0.0.0.0/1", "128.0.0.0/1", "255.255.255.255"}, []string{"0.0.0.0/0"}},
+		{"ipv6 address blocks its /64", []string{"2001:db8::1", "2001:db8::2"}, []string{"2001:db8::/64"}},
+		{"ipv6 adjacent", []string{"2001:db8::/33", "2001:db8:8000::/33"}, []string{"2001:db8::/32"}},
+		{"ipv6 whole space", []string{"::/1", "8000::/1"}, []string{"::/0"}},
+		{"ipv4-mapped", []string{"::ffff:192.0.2.0/120", "192.0.2.1"}, []string{"192.0.2.0/24"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, builderPrefixes(t, tt.entries...))
+		})
+	}
+}
+
+func TestIPBlacklistBuilder_ExplicitPrefixes(t *testing.T) {
+	assert.Equal(t, []string{"2001:db8:1::/48"}, builderPrefixes(t, "2001:db8:1::/48"))
+	assert.Equal(t, []string{"2001:db8:2:100::/56"}, builderPrefixes(t, "2001:db8:2:1ff::/56"))
+	assert.Equal(t, []string{"2001:db8::1/128"}, builderPrefixes(t, "2001:db8::1/128"))
+	assert.Equal(t, []string{"192.0.2.1/32"}, builderPrefixes(t, "::ffff:192.0.2.1"), "IPv4-mapped addresses block their IPv4 address")
+}
+
+func TestIPBlacklistBuilder_DefaultPrefixes(t *testing.T) {
+	b := ipBlacklistBuilder{v4Bits: 24, v6Bits: 128}
+	for _, entry := range []string{"192.0.2.77", "2001:db8::1", "2001:db8::3", "2001:db8:1::/48"} {
+		require.NoError(t, b.add(entry))
+	}
+	b.merge()
+	var prefixes []string
+	b.prefixes(func(prefix netip.Prefix) { prefixes = append(prefixes, prefix.String()) })
+	assert.Equal(t, []string{"192.0.2.0/24", "2001:db8::1/128", "2001:db8::3/128", "2001:db8:1::/48"}, prefixes)
+}
+
+func TestIPBlacklistBuilder_Ranges(t *testing.T) {
+	assert.Equal(t, []string{"192.0.2.0/24"}, builderPrefixes(t, "192.0.2.0-192.0.2.255"))
+	assert.Equal(t, []string{"10.0.0.5/32", "10.0.0.6/31", "10.0.0.8/30"}, builderPrefixes(t, "10.0.0.5 - 10.0.0.11"))
+	assert.Equal(t, []string{"2001:db8::/127"}, builderPrefixes(t, "2001:db8::-2001:db8::1"))
+	assert.Equal(t, []string{"192.0.2.1/32"}, builderPrefixes(t, "::ffff:192.0.2.1-192.0.2.1"))
+}
+
+func TestIPBlacklistBuilder_InvalidEntry(t *testing.T) {
+	var b ipBlacklistBuilder
+	assert.Error(t, b.add("not-an-ip"))
+	assert.Error(t, b.add("10.0.0.0/33"))
+	assert.Error(t, b.add("fe80::1%eth0"))
+	assert.Error(t, b.add("10.0.0.9-10.0.0.1"), "reversed range")
+	assert.Error(t, b.add("10.0.0.1-2001:db8::1"), "mixed families")
+	assert.Error(t, b.add("10.0.0.1-"))
+}
+
+func TestSplitBlacklistLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   # comment", nil},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{"10.0.0.1# comment", []string{"10.0.0.1"}},
+		{"10.0.0.1\treason=scanner expires=2030-01-01", []string{"10.0.0.1", "reason=scanner", "expires=2030-01-01"}},
+		{`10.0.0.1 reason="brute force # 3" # comment`, []string{"10.0.0.1", "reason=brute force # 3"}},
+	}
+	for _, tt := range tests {
+		fields, err := splitBlacklistLine(tt.line)
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.want, fields, tt.line)
+	}
+
+	_, err := splitBlacklistLine(`10.0.0.1 reason="unterminated`)
+	assert.Error(t, err)
+}
+
+func TestParseBlacklistAnnotation(t *testing.T) {
+	annotation, err := parseBlacklistAnnotation(nil)
+	require.NoError(t, err)
+	assert.Nil(t, annotation)
+
+	annotation, err = parseBlacklistAnnotation([]string{"reason=credential stuffing", "expires=2030-06-01T12:00:00+02:00"})
+	require.NoError(t, err)
+	assert.Equal(t, "credential stuffing", annotation.Reason)
+	assert.True(t, annotation.Expires.Equal(time.Date(2030, 6, 1, 10, 0, 0, 0, time.UTC)))
+
+	annotation, err = parseBlacklistAnnotation([]string{"expires=2030-06-01"})
+	require.NoError(t, err)
+	assert.True(t, annotation.Expires.Equal(time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, annotation.expired(time.Date(2030, 5, 31, 23, 59, 0, 0, time.UTC)))
+	assert.True(t, annotation.expired(time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)))
+
+	_, err = parseBlacklistAnnotation([]string{"expires=soon"})
+	assert.Error(t, err)
+	_, err = parseBlacklistAnnotation([]string{"owner=ops"})
+	assert.Error(t, err)
+}
+
+func TestReadIPBlacklist_Annotations(t *testing.T) {
+	list := strings.Join([]string{
+		`192.0.2.10 reason="credential stuffing"`,
+		`198.51.100.0-198.51.100.127 reason=scanner expires=2999-01-01`,
+		`203.0.113.0/24 reason=old expires=2000-01-01`,
+		`10.0.0.0/8`,
+		`10.1.2.3 reason=inside expires=2999-01-01`,
+		`10.2.0.0 reason=bad expires=tomorrow`,
+	}, "\n")
+
+	bl := NewBlacklistLoader(zap.NewNop())
+	trie, stats, err := bl.readIPBlacklist(strings.NewReader(list), "test")
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.ValidEntries)
+	assert.Equal(t, 3, stats.Annotated)
+	assert.Equal(t, 1, stats.ExpiredEntries)
+	assert.Equal(t, 1, stats.InvalidEntries)
+
+	now := time.Now()
+	blacklisted, annotation := ipBlacklistLookup(trie, netip.MustParseAddr("192.0.2.10"), now)
+	assert.True(t, blacklisted)
+	assert.Equal(t, "credential stuffing", annotation.Reason)
+
+	blacklisted, annotation = ipBlacklistLookup(trie, netip.MustParseAddr("198.51.100.77"), now)
+	assert.True(t, blacklisted)
+	assert.Equal(t, "scanner", annotation.Reason)
+	blacklisted, _ = ipBlacklistLookup(trie, netip.MustParseAddr("198.51.100.77"), time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.False(t, blacklisted, "entries stop blocking when they expire")
+
+	blacklisted, _ = ipBlacklistLookup(trie, netip.MustParseAddr("203.0.113.1"), now)
+	assert.False(t, blacklisted, "expired entries are skipped")
+
+	blacklisted, annotation = ipBlacklistLookup(trie, netip.MustParseAddr("10.1.2.3"), time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.True(t, blacklisted, "an entry within a permanent one keeps blocking after its expiry")
+	assert.Equal(t, "inside", annotation.Reason)
+
+	blacklisted, annotation = ipBlacklistLookup(trie, netip.MustParseAddr("10.9.9.9"), now)
+	assert.True(t, blacklisted)
+	assert.Nil(t, annotation)
+}
+
+func TestIPBlacklistHit_Reason(t *testing.T) {
+	bl := NewBlacklistLoader(zap.NewNop())
+	trie, _, err := bl.readIPBlacklist(strings.NewReader("192.0.2.10 reason=\"credential stuffing\"\n198.51.100.1\n"), "test")
+	require.NoError(t, err)
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		ipBlacklist:      trie,
+		ipBlacklistCache: newLookupCache[ipBlacklistVerdict](10, time.Minute),
+	}
+
+	for i := 0; i < 2; i++ {
+		blacklisted, reason := m.ipBlacklistHit("192.0.2.10:1234")
+		assert.True(t, blacklisted)
+		assert.Equal(t, "credential stuffing", reason, "the reason survives the lookup cache")
+	}
+	blacklisted, reason := m.ipBlacklistHit("198.51.100.1:1234")
+	assert.True(t, blacklisted)
+	assert.Empty(t, reason)
+	assert.Equal(t, int64(3), m.IPBlacklistBlockCount)
+}
+
+func TestBlacklistLoader_WithIPPrefixes(t *testing.T) {
+	bl := NewBlacklistLoader(zap.NewNop())
+	require.NoError(t, bl.WithIPPrefixes(0, 128))
+	trie, _, err := bl.readIPBlacklist(strings.NewReader("2001:db8::1\n192.0.2.1\n"), "test")
+	require.NoError(t, err)
+	assert.True(t, trie.Contains(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, trie.Contains(netip.MustParseAddr("2001:db8::2")), "a /128 default blocks the address only")
+	assert.False(t, trie.Contains(netip.MustParseAddr("192.0.2.2")), "the IPv4 default stays /32")
+
+	assert.Error(t, bl.WithIPPrefixes(33, 0))
+	assert.Error(t, bl.WithIPPrefixes(0, 129))
+}
+
+func TestReadIPBlacklist(t *testing.T) {
+	list := strings.Join([]string{
+		"# FireHOL style header",
+		"",
+		"10.0.0.0/24",
+		"10.0.1.0/24 # adjacent",
+		"10.0.0.5",
+		"bogus",
+		"2001:db8::/32",
+	}, "\n")
+
+	bl := NewBlacklistLoader(zap.NewNop())
+	trie, stats, err := bl.readIPBlacklist(strings.NewReader(list), "test")
+	require.NoError(t, err)
+	assert.Equal(t, 7, stats.TotalLines)
+	assert.Equal(t, 4, stats.ValidEntries)
+	assert.Equal(t, 1, stats.InvalidEntries)
+	assert.Equal(t, 2, stats.Ranges)
+	assert.Equal(t, 2, stats.Prefixes)
+
+	assert.True(t, trie.Contains(netip.MustParseAddr("10.0.1.200")))
+	assert.True(t, trie.Contains(netip.MustParseAddr("2001:db8:1::1")))
+	assert.False(t, trie.Contains(netip.MustParseAddr("10.0.2.1")))
+}
+
+func TestLoadIPBlacklist_Middleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_blacklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.0/25\n192.0.2.128/25\n198.51.100.7\n"), 0o600))
+
+	m := &Middleware{logger: zap.NewNop(), blacklistLoader: NewBlacklistLoader(zap.NewNop())}
+	trie, err := m.loadIPBlacklist(path)
+	require.NoError(t, err)
+	assert.True(t, trie.Contains(netip.MustParseAddr("192.0.2.200")))
+	assert.True(t, trie.Contains(netip.MustParseAddr("198.51.100.7")))
+	assert.Equal(t, int64(2), m.ipBlacklistEntries.Load())
+	require.NotNil(t, m.ipBlacklistLoad.Load())
+	assert.Equal(t, 3, m.ipBlacklistLoad.Load().ValidEntries)
+
+	trie, err = m.loadIPBlacklist(filepath.Join(t.TempDir(), "missing.txt"))
+	require.NoError(t, err)
+	assert.False(t, trie.Contains(netip.MustParseAddr("192.0.2.1")), "a missing file loads an empty blacklist")
+}
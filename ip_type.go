@@ -0,0 +1,338 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/phemmer/go-iptrie"
+	"go.uber.org/zap"
+)
+
+// IP types, from the most to the least specific.
+const (
+	IPTypeTor         = "tor"
+	IPTypeVPN         = "vpn"
+	IPTypeDatacenter  = "datacenter"
+	IPTypeResidential = "residential" // Listed by no feed nor provider
+)
+
+var ipTypes = []string{IPTypeTor, IPTypeVPN, IPTypeDatacenter, IPTypeResidential}
+
+const (
+	defaultIPTypeRefresh         = 24 * time.Hour
+	defaultIPTypeProviderTimeout = 500 * time.Millisecond
+	defaultIPTypeCacheTTL        = time.Hour
+	ipTypeCacheSize              = 100000
+	maxIPTypeFeedSize            = 64 << 20
+	ipTypeFeedHTTPTimeout        = time.Minute
+)
+
+// IPTypeProvider classifies the IPs no feed lists, typically by querying a commercial IP
+// intelligence service. It returns one of the IPTypeX constants, or an empty string for
+// IPs it doesn't know. Providers are Caddy modules in the http.handlers.waf.ip_type
+// namespace, configured like the reputation providers.
+type IPTypeProvider interface {
+	IPType(ctx context.Context, ip netip.Addr) (string, error)
+}
+
+// IPTypeConfig classifies client IPs as residential, datacenter, VPN or Tor from
+// downloadable range feeds, falling back to a provider module for IPs no feed lists.
+type IPTypeConfig struct {
+	Feeds           []IPTypeFeed    `json:"feeds,omitempty"`
+	Refresh         time.Duration   `json:"refresh,omitempty"` // Reload interval of the feeds, default 24h
+	ProviderRaw     json.RawMessage `json:"provider,omitempty" caddy:"namespace=http.handlers.waf.ip_type inline_key=provider"`
+	ProviderTimeout time.Duration   `json:"provider_timeout,omitempty"` // Timeout of a provider lookup, default 500ms
+	CacheTTL        time.Duration   `json:"cache_ttl,omitempty"`        // How long provider answers are cached, default 1h
+
+	logger       *zap.Logger
+	client       *http.Client
+	provider     IPTypeProvider
+	providerName string
+	cache        *lookupCache[string]
+	mu           sync.RWMutex
+	tries        map[string]*iptrie.Trie
+	requests     map[string]*atomic.Int64
+	blocked      map[string]*atomic.Int64
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+// IPTypeFeed is a list of the IPs and CIDR ranges of a type, one per line.
+type IPTypeFeed struct {
+	Type   string `json:"type"`             // datacenter, vpn or tor
+	Source string `json:"source,omitempty"` // File path or http(s) URL, default the Tor exit list for tor
+}
+
+// IPTypeMetrics counts the requests of an IP type.
+type IPTypeMetrics struct {
+	Requests int64 `json:"requests"`
+	Blocked  int64 `json:"blocked"`
+}
+
+// provision validates the config, applies the defaults, loads the provider module and the feeds.
+func (c *IPTypeConfig) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if len(c.Feeds) == 0 && len(c.ProviderRaw) == 0 {
+		return fmt.Errorf("ip_type requires a feed or a provider")
+	}
+	for i, feed := range c.Feeds {
+		switch feed.Type {
+		case IPTypeTor:
+			if feed.Source == "" {
+				c.Feeds[i].Source = torExitNodeURL
+			}
+		case IPTypeVPN, IPTypeDatacenter:
+			if feed.Source == "" {
+				return fmt.Errorf("ip_type %s feed requires a source", feed.Type)
+			}
+		default:
+			return fmt.Errorf("invalid ip_type feed type: %s, must be datacenter, vpn or tor", feed.Type)
+		}
+	}
+	if c.Refresh <= 0 {
+		c.Refresh = defaultIPTypeRefresh
+	}
+	if c.ProviderTimeout <= 0 {
+		c.ProviderTimeout = defaultIPTypeProviderTimeout
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultIPTypeCacheTTL
+	}
+	if len(c.ProviderRaw) > 0 {
+		mod, name, err := loadProviderModule(ctx, "http.handlers.waf.ip_type", c.ProviderRaw)
+		if err != nil {
+			return fmt.Errorf("loading ip_type provider: %w", err)
+		}
+		provider, ok := mod.(IPTypeProvider)
+		if !ok {
+			return fmt.Errorf("module %s is not an ip_type provider", name)
+		}
+		c.provider = provider
+		c.providerName = name
+		c.cache = newLookupCache[string](ipTypeCacheSize, c.CacheTTL)
+	}
+	c.logger = logger
+	c.client = &http.Client{Timeout: ipTypeFeedHTTPTimeout}
+	c.requests = make(map[string]*atomic.Int64, len(ipTypes))
+	c.blocked = make(map[string]*atomic.Int64, len(ipTypes))
+	for _, ipType := range ipTypes {
+		c.requests[ipType] = &atomic.Int64{}
+		c.blocked[ipType] = &atomic.Int64{}
+	}
+	return c.reload(context.Background())
+}
+
+// reload reads every feed into a trie per type, keeping the current tries on failure.
+func (c *IPTypeConfig) reload(ctx context.Context) error {
+	loader := NewBlacklistLoader(c.logger)
+	lists := make(map[string]*bytes.Buffer)
+	for _, feed := range c.Feeds {
+		data, err := c.read(ctx, feed.Source)
+		if err != nil {
+			return fmt.Errorf("failed to read ip_type %s feed %s: %w", feed.Type, feed.Source, err)
+		}
+		if lists[feed.Type] == nil {
+			lists[feed.Type] = &bytes.Buffer{}
+		}
+		lists[feed.Type].Write(data)
+		lists[feed.Type].WriteByte('\n')
+	}
+	tries := make(map[string]*iptrie.Trie, len(lists))
+	for ipType, data := range lists {
+		trie, stats, err := loader.readIPBlacklist(data, ipType+" feed")
+		if err != nil {
+			return fmt.Errorf("failed to load ip_type %s feeds: %w", ipType, err)
+		}
+		tries[ipType] = trie
+		c.logger.Info("IP type feeds loaded",
+			zap.String("type", ipType),
+			zap.Int("valid_entries", stats.ValidEntries),
+			zap.Int("invalid_entries", stats.InvalidEntries),
+			zap.Int("prefixes", stats.Prefixes),
+		)
+	}
+	c.mu.Lock()
+	c.tries = tries
+	c.mu.Unlock()
+	return nil
+}
+
+// read returns the content of a feed source.
+func (c *IPTypeConfig) read(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxIPTypeFeedSize))
+}
+
+// Start reloads the feeds every Refresh until Stop is called.
+func (c *IPTypeConfig) Start() {
+	if len(c.Feeds) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.reload(ctx); err != nil && ctx.Err() == nil {
+					c.logger.Error("Failed to reload IP type feeds, keeping the current ranges", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reloads started by Start.
+func (c *IPTypeConfig) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel = nil
+}
+
+// classify returns the type of an IP: the most specific type of the feeds listing it, else
+// the answer of the provider, else residential.
+func (c *IPTypeConfig) classify(ctx context.Context, ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return IPTypeResidential
+	}
+	addr = addr.Unmap()
+	c.mu.RLock()
+	tries := c.tries
+	c.mu.RUnlock()
+	for _, ipType := range ipTypes {
+		if trie := tries[ipType]; trie != nil {
+			if listed, _ := ipBlacklistLookup(trie, addr, time.Now()); listed {
+				return ipType
+			}
+		}
+	}
+	if c.provider == nil {
+		return IPTypeResidential
+	}
+
+	if ipType, ok := c.cache.Get(ip); ok {
+		return ipType
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.ProviderTimeout)
+	defer cancel()
+	ipType, err := c.provider.IPType(ctx, addr)
+	if err != nil {
+		c.logger.Warn("IP type provider lookup failed", zap.String("provider", c.providerName), zap.String("ip", ip), zap.Error(err))
+		return IPTypeResidential // Not cached, so the lookup is retried
+	}
+	if _, known := c.requests[ipType]; !known {
+		ipType = IPTypeResidential
+	}
+	c.cache.Set(ip, ipType)
+	return ipType
+}
+
+// count records a request of an IP type.
+func (c *IPTypeConfig) count(ipType string, blocked bool) {
+	if counter, ok := c.requests[ipType]; ok {
+		counter.Add(1)
+		if blocked {
+			c.blocked[ipType].Add(1)
+		}
+	}
+}
+
+// Metrics returns the requests counted per IP type.
+func (c *IPTypeConfig) Metrics() map[string]IPTypeMetrics {
+	metrics := make(map[string]IPTypeMetrics, len(ipTypes))
+	for _, ipType := range ipTypes {
+		metrics[ipType] = IPTypeMetrics{Requests: c.requests[ipType].Load(), Blocked: c.blocked[ipType].Load()}
+	}
+	return metrics
+}
+
+// resetMetrics clears the request counters.
+func (c *IPTypeConfig) resetMetrics() {
+	for _, ipType := range ipTypes {
+		c.requests[ipType].Store(0)
+		c.blocked[ipType].Store(0)
+	}
+}
+
+// listing returns the most specific type of the feeds listing an address, with the most
+// specific prefix listing it.
+func (c *IPTypeConfig) listing(addr netip.Addr, now time.Time) (string, netip.Prefix, bool) {
+	c.mu.RLock()
+	tries := c.tries
+	c.mu.RUnlock()
+	for _, ipType := range ipTypes {
+		if trie := tries[ipType]; trie != nil {
+			if listed, _ := ipBlacklistLookup(trie, addr, now); listed {
+				return ipType, trieMatch(trie, addr), true
+			}
+		}
+	}
+	return "", netip.Prefix{}, false
+}
+
+// ipType returns the type of the client IP, memoized as the IP_TYPE target, or an empty
+// string without the ip_type directive.
+func (m *Middleware) ipType(r *http.Request, state *WAFState) string {
+	if m.IPType == nil || m.IPType.requests == nil {
+		return ""
+	}
+	if cached, ok := state.targets[TargetIPType]; ok {
+		return cached.value
+	}
+	ipType := m.IPType.classify(r.Context(), extractIP(r.RemoteAddr))
+	if state.targets == nil {
+		state.targets = make(map[string]extractedTarget)
+	}
+	state.targets[TargetIPType] = extractedTarget{value: ipType}
+	return ipType
+}
+
+// ipTypeTarget returns the value of the IP_TYPE target, reporting whether target is it.
+func (m *Middleware) ipTypeTarget(target string, r *http.Request, state *WAFState) (string, bool) {
+	if !strings.EqualFold(target, TargetIPType) {
+		return "", false
+	}
+	return m.ipType(r, state), true
+}
+
+// recordIPType counts the request under the type of its client IP.
+func (m *Middleware) recordIPType(r *http.Request, state *WAFState) {
+	if m.IPType == nil || m.IPType.requests == nil {
+		return
+	}
+	m.IPType.count(m.ipType(r, state), state.Blocked)
+}
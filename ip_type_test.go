@@ -0,0 +1,184 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// staticIPType is an IP type provider answering from a map, failing for 198.51.100.99.
+type staticIPType struct {
+	Types map[string]string `json:"types,omitempty"`
+}
+
+var staticIPTypeLookups atomic.Int64
+
+func init() {
+	caddy.RegisterModule(&staticIPType{})
+}
+
+func (*staticIPType) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.ip_type.static",
+		New: func() caddy.Module { return &staticIPType{} },
+	}
+}
+
+func (s *staticIPType) IPType(_ context.Context, ip netip.Addr) (string, error) {
+	staticIPTypeLookups.Add(1)
+	if ip.String() == "198.51.100.99" {
+		return "", errors.New("quota exhausted")
+	}
+	return s.Types[ip.String()], nil
+}
+
+// UnmarshalCaddyfile reads "<ip> <type>" lines from the provider block.
+func (s *staticIPType) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Provider name
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		ip := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if s.Types == nil {
+			s.Types = make(map[string]string)
+		}
+		s.Types[ip] = d.Val()
+	}
+	return nil
+}
+
+func writeFeed(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "feed.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestIPTypeConfig_Classify(t *testing.T) {
+	tor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer tor.Close()
+
+	config := &IPTypeConfig{Feeds: []IPTypeFeed{
+		{Type: IPTypeDatacenter, Source: writeFeed(t, "# cloud ranges\n203.0.113.0/24\n2001:db8::/32\nnot-an-ip\n")},
+		{Type: IPTypeVPN, Source: writeFeed(t, "192.0.2.0/28\n")},
+		{Type: IPTypeTor, Source: tor.URL},
+	}}
+	require.NoError(t, config.provision(caddy.Context{}, zap.NewNop()))
+
+	ctx := context.Background()
+	assert.Equal(t, IPTypeDatacenter, config.classify(ctx, "203.0.113.1"))
+	assert.Equal(t, IPTypeTor, config.classify(ctx, "203.0.113.7"), "the most specific type wins")
+	assert.Equal(t, IPTypeVPN, config.classify(ctx, "192.0.2.15"))
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "192.0.2.16"))
+	assert.Equal(t, IPTypeDatacenter, config.classify(ctx, "2001:db8::1"))
+	assert.Equal(t, IPTypeDatacenter, config.classify(ctx, "::ffff:203.0.113.1"))
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "unknown"))
+}
+
+func TestIPTypeConfig_Provider(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	config := &IPTypeConfig{ProviderRaw: json.RawMessage(`{"provider": "missing"}`)}
+	assert.Error(t, config.provision(ctx, zap.NewNop()))
+	config = &IPTypeConfig{ProviderRaw: caddyconfig.JSONModuleObject(&HTTPReputation{URL: "https://intel.example.com/{ip}"}, "provider", "http", nil)}
+	assert.Error(t, config.provision(ctx, zap.NewNop()), "reputation providers are another namespace")
+
+	provider := &staticIPType{Types: map[string]string{"198.51.100.1": IPTypeVPN, "198.51.100.2": "mobile"}}
+	config = &IPTypeConfig{
+		Feeds:       []IPTypeFeed{{Type: IPTypeDatacenter, Source: writeFeed(t, "198.51.100.0/31\n")}},
+		ProviderRaw: caddyconfig.JSONModuleObject(provider, "provider", "static", nil),
+	}
+	require.NoError(t, config.provision(ctx, zap.NewNop()))
+	before := staticIPTypeLookups.Load()
+
+	assert.Equal(t, IPTypeDatacenter, config.classify(ctx, "198.51.100.1"), "feeds take precedence")
+	assert.Equal(t, before, staticIPTypeLookups.Load())
+
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "198.51.100.2"), "unknown types are residential")
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "198.51.100.3"))
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "198.51.100.3"))
+	assert.Equal(t, before+2, staticIPTypeLookups.Load(), "answers are cached")
+
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "198.51.100.99"))
+	assert.Equal(t, IPTypeResidential, config.classify(ctx, "198.51.100.99"))
+	assert.Equal(t, before+4, staticIPTypeLookups.Load(), "failures are not cached")
+}
+
+func TestIPTypeConfig_Provision(t *testing.T) {
+	for _, config := range []*IPTypeConfig{
+		{},
+		{Feeds: []IPTypeFeed{{Type: "mobile", Source: "/tmp/mobile.txt"}}},
+		{Feeds: []IPTypeFeed{{Type: IPTypeVPN}}},
+		{Feeds: []IPTypeFeed{{Type: IPTypeVPN, Source: filepath.Join(t.TempDir(), "missing.txt")}}},
+	} {
+		assert.Error(t, config.provision(caddy.Context{}, zap.NewNop()), "%+v", config.Feeds)
+	}
+}
+
+func TestIPTypeConfig_Reload(t *testing.T) {
+	path := writeFeed(t, "192.0.2.1\n")
+	config := &IPTypeConfig{Feeds: []IPTypeFeed{{Type: IPTypeDatacenter, Source: path}}}
+	require.NoError(t, config.provision(caddy.Context{}, zap.NewNop()))
+	assert.Equal(t, IPTypeDatacenter, config.classify(context.Background(), "192.0.2.1"))
+
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.2\n"), 0o600))
+	require.NoError(t, config.reload(context.Background()))
+	assert.Equal(t, IPTypeResidential, config.classify(context.Background(), "192.0.2.1"))
+	assert.Equal(t, IPTypeDatacenter, config.classify(context.Background(), "192.0.2.2"))
+
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, config.reload(context.Background()))
+	assert.Equal(t, IPTypeDatacenter, config.classify(context.Background(), "192.0.2.2"), "kept on failure")
+}
+
+func TestIPTypeTargetAndMetrics(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), IPType: &IPTypeConfig{
+		Feeds: []IPTypeFeed{{Type: IPTypeTor, Source: writeFeed(t, "192.0.2.1\n")}},
+	}}
+	require.NoError(t, m.IPType.provision(caddy.Context{}, zap.NewNop()))
+
+	req := browserRequest()
+	state := &WAFState{}
+	value, err := m.extractTarget("ip_type", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, IPTypeTor, value)
+
+	_, signals := m.botScore(req, state)
+	assert.Contains(t, signals, "tor_ip")
+
+	state.Blocked = true
+	m.recordIPType(req, state)
+	other := browserRequest()
+	other.RemoteAddr = "198.51.100.1:1234"
+	m.recordIPType(other, &WAFState{})
+	metrics := m.IPType.Metrics()
+	assert.Equal(t, IPTypeMetrics{Requests: 1, Blocked: 1}, metrics[IPTypeTor])
+	assert.Equal(t, IPTypeMetrics{Requests: 1}, metrics[IPTypeResidential])
+	assert.Equal(t, IPTypeMetrics{}, metrics[IPTypeVPN])
+
+	m.IPType.resetMetrics()
+	assert.Zero(t, m.IPType.Metrics()[IPTypeTor].Requests)
+
+	m.IPType = nil
+	value, err = m.extractTarget("IP_TYPE", req, nil, &WAFState{})
+	require.NoError(t, err)
+	assert.Empty(t, value)
+}
@@ -0,0 +1,213 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const jsonSchemaRuleID = "json_schema_rule"
+
+// jsonSchemaDefaultMethods are the methods a JSON schema applies to when none are given.
+var jsonSchemaDefaultMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+// JSONSchemaConfig validates the JSON bodies of requests to a path against a JSON Schema.
+type JSONSchemaConfig struct {
+	Path        string   `json:"path"`                   // Exact path, or a prefix ending in *
+	Methods     []string `json:"methods,omitempty"`      // Methods the schema applies to, default POST, PUT and PATCH
+	Schema      string   `json:"schema"`                 // Path to the JSON or YAML schema
+	StatusCode  int      `json:"status_code,omitempty"`  // Status of the block response, default 400
+	ContentType string   `json:"content_type,omitempty"` // Content type of the block response body
+	Body        string   `json:"body,omitempty"`         // Block response body, {violations} is replaced by a JSON array of the violations
+
+	schema *jsonSchema
+	refs   schemaRefs
+}
+
+// jsonSchemaViolation is a validation error, logged as a structured object.
+type jsonSchemaViolation struct {
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+func (v jsonSchemaViolation) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("location", v.Location)
+	enc.AddString("message", v.Message)
+	return nil
+}
+
+// jsonSchemaViolations is a list of validation errors, logged as an array of objects.
+type jsonSchemaViolations []jsonSchemaViolation
+
+func (vs jsonSchemaViolations) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, v := range vs {
+		if err := enc.AppendObject(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provision validates the config and loads the schema.
+func (c *JSONSchemaConfig) provision() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("json_schema path must start with /: %s", c.Path)
+	}
+	if c.StatusCode == 0 {
+		c.StatusCode = http.StatusBadRequest
+	}
+	if c.StatusCode < 400 || c.StatusCode > 599 {
+		return fmt.Errorf("invalid json_schema status code %d, must be between 400 and 599", c.StatusCode)
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = slices.Clone(jsonSchemaDefaultMethods)
+	}
+	for i := range c.Methods {
+		c.Methods[i] = strings.ToUpper(c.Methods[i])
+	}
+	schema, refs, err := loadJSONSchema(c.Schema)
+	if err != nil {
+		return err
+	}
+	c.schema, c.refs = schema, refs
+	return nil
+}
+
+// loadJSONSchema reads and compiles a JSON Schema in JSON or YAML. References may point
+// to the root ("#") or to its "$defs" and "definitions".
+func loadJSONSchema(path string) (*jsonSchema, schemaRefs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read JSON schema: %w", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse JSON schema %s: %w", path, err)
+		}
+		if data, err = json.Marshal(jsonCompatible(document)); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse JSON schema %s: %w", path, err)
+		}
+	}
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse JSON schema %s: %w", path, err)
+	}
+
+	refs := schemaRefs{"#": schema}
+	for name, definition := range schema.Defs {
+		refs["#/$defs/"+name] = definition
+	}
+	for name, definition := range schema.Definitions {
+		refs["#/definitions/"+name] = definition
+	}
+	if err := refs.compile(schema, make(map[*jsonSchema]bool)); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON schema %s: %w", path, err)
+	}
+	return schema, refs, nil
+}
+
+// matches reports whether the schema applies to a request.
+func (c *JSONSchemaConfig) matches(r *http.Request) bool {
+	if !slices.Contains(c.Methods, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(c.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == c.Path
+}
+
+// jsonSchemaFor returns the first JSON schema applying to the request, or nil.
+func (m *Middleware) jsonSchemaFor(r *http.Request) *JSONSchemaConfig {
+	for i := range m.JSONSchemas {
+		if m.JSONSchemas[i].matches(r) {
+			return &m.JSONSchemas[i]
+		}
+	}
+	return nil
+}
+
+// validateJSONBody returns the violations of the request body against the schema.
+// The body is read through the memoized BODY target.
+func (m *Middleware) validateJSONBody(r *http.Request, state *WAFState, config *JSONSchemaConfig) []string {
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return []string{"body: missing"}
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return []string{"body: content type must be application/json"}
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return []string{"body: invalid JSON"}
+	}
+	violations := config.refs.validate(config.schema, value, "body", 0)
+	slices.Sort(violations)
+	return violations
+}
+
+// checkJSONSchema validates the request body against the JSON schema of its path, blocking
+// the request when it fails. It reports whether the request was blocked.
+func (m *Middleware) checkJSONSchema(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.jsonSchemaFor(r)
+	if config == nil {
+		return false
+	}
+	violations := m.validateJSONBody(r, state, config)
+	if len(violations) == 0 {
+		return false
+	}
+
+	structured := make(jsonSchemaViolations, len(violations))
+	for i, violation := range violations {
+		location, message, _ := strings.Cut(violation, ": ")
+		structured[i] = jsonSchemaViolation{Location: location, Message: message}
+	}
+	m.logger.Info("JSON schema validation failed",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("schema", config.Schema),
+		zap.Array("violations", structured),
+	)
+
+	m.incrementRuleHitCount(RuleID(jsonSchemaRuleID))
+	state.MatchedRules = append(state.MatchedRules, jsonSchemaRuleID)
+	if config.Body == "" {
+		m.blockRequest(w, r, state, config.StatusCode, "json_schema", jsonSchemaRuleID,
+			zap.Strings("violations", violations),
+		)
+		return true
+	}
+
+	m.recordBlock(r, state, config.StatusCode, "json_schema", jsonSchemaRuleID,
+		zap.Strings("violations", violations),
+	)
+	body := config.Body
+	if strings.Contains(body, "{violations}") {
+		encoded, _ := json.Marshal(violations)
+		body = strings.ReplaceAll(body, "{violations}", string(encoded))
+	}
+	if config.ContentType != "" {
+		w.Header().Set("Content-Type", config.ContentType)
+	}
+	w.WriteHeader(config.StatusCode)
+	if _, err := w.Write([]byte(body)); err != nil {
+		m.logger.Error("Failed to write JSON schema block response", zap.Error(err))
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testJSONSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["name", "address"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 2},
+		"address": {"$ref": "#/$defs/Address"},
+		"previous": {"type": "array", "items": {"$ref": "#/definitions/LegacyAddress"}}
+	},
+	"$defs": {
+		"Address": {
+			"type": "object",
+			"required": ["zip"],
+			"properties": {"zip": {"type": "string", "pattern": "^[0-9]{5}$"}}
+		}
+	},
+	"definitions": {
+		"LegacyAddress": {"type": "string", "maxLength": 10}
+	}
+}`
+
+func writeJSONSchema(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(path, []byte(testJSONSchema), 0o600))
+	return path
+}
+
+func TestValidateJSONBody(t *testing.T) {
+	config := &JSONSchemaConfig{Path: "/users", Schema: writeJSONSchema(t)}
+	require.NoError(t, config.provision())
+	m := &Middleware{logger: zap.NewNop(), requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+	}{
+		{"valid", "application/json", `{"name":"Ada","address":{"zip":"12345"},"previous":["old"]}`, nil},
+		{"vendor json", "application/vnd.api+json", `{"name":"Ada","address":{"zip":"12345"}}`, nil},
+		{"violations", "application/json", `{"name":"A","address":{"zip":"abc"},"previous":["far too long"],"admin":true}`, []string{
+			"body.address.zip: does not match pattern",
+			"body.admin: unknown property",
+			"body.name: shorter than minLength",
+			"body.previous[0]: longer than maxLength",
+		}},
+		{"missing fields", "application/json", `{"address":{}}`, []string{"body.address.zip: missing", "body.name: missing"}},
+		{"missing body", "application/json", "", []string{"body: missing"}},
+		{"content type", "text/plain", "name=Ada", []string{"body: content type must be application/json"}},
+		{"invalid json", "application/json", "{", []string{"body: invalid JSON"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(http.MethodPost, "/users", tt.contentType, tt.body)
+			assert.Equal(t, tt.want, m.validateJSONBody(req, &WAFState{}, config))
+		})
+	}
+}
+
+func TestJSONSchemaConfig_Matches(t *testing.T) {
+	schema := writeJSONSchema(t)
+	m := &Middleware{logger: zap.NewNop(), JSONSchemas: []JSONSchemaConfig{
+		{Path: "/api/orders/*", Methods: []string{"put"}, Schema: schema},
+		{Path: "/users", Schema: schema},
+	}}
+	for i := range m.JSONSchemas {
+		require.NoError(t, m.JSONSchemas[i].provision())
+	}
+	assert.Equal(t, &m.JSONSchemas[0], m.jsonSchemaFor(httptest.NewRequest(http.MethodPut, "/api/orders/7", nil)))
+	assert.Nil(t, m.jsonSchemaFor(httptest.NewRequest(http.MethodPost, "/api/orders/7", nil)))
+	assert.Equal(t, &m.JSONSchemas[1], m.jsonSchemaFor(httptest.NewRequest(http.MethodPatch, "/users", nil)))
+	assert.Nil(t, m.jsonSchemaFor(httptest.NewRequest(http.MethodGet, "/users", nil)), "GET is not validated by default")
+	assert.Nil(t, m.jsonSchemaFor(httptest.NewRequest(http.MethodPost, "/users/1", nil)))
+}
+
+func TestCheckJSONSchema_Response(t *testing.T) {
+	schema := writeJSONSchema(t)
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		JSONSchemas:           []JSONSchemaConfig{{Path: "/users", Schema: schema}},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	require.NoError(t, m.JSONSchemas[0].provision())
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkJSONSchema(w, testRequest(http.MethodPost, "/users", "application/json", `{"name":"Ada"}`), state))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, []string{jsonSchemaRuleID}, state.MatchedRules)
+	assert.Contains(t, w.Body.String(), "json_schema")
+
+	m.JSONSchemas[0] = JSONSchemaConfig{
+		Path:        "/users",
+		Schema:      schema,
+		StatusCode:  http.StatusUnprocessableEntity,
+		ContentType: "application/json",
+		Body:        `{"errors":{violations}}`,
+	}
+	require.NoError(t, m.JSONSchemas[0].provision())
+	w = httptest.NewRecorder()
+	assert.True(t, m.checkJSONSchema(w, testRequest(http.MethodPost, "/users", "application/json", `{"name":"Ada"}`), &WAFState{}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"errors":["body.address: missing"]}`, w.Body.String())
+
+	state = &WAFState{}
+	assert.False(t, m.checkJSONSchema(httptest.NewRecorder(), testRequest(http.MethodPost, "/users", "application/json", `{"name":"Ada","address":{"zip":"12345"}}`), state))
+	assert.False(t, state.Blocked)
+}
+
+func TestLoadJSONSchema_Errors(t *testing.T) {
+	dir := t.TempDir()
+	for name, schema := range map[string]string{
+		"badref.json":  `{"properties": {"a": {"$ref": "#/$defs/Missing"}}}`,
+		"remote.json":  `{"$ref": "https://example.com/schema.json"}`,
+		"pattern.json": `{"type": "string", "pattern": "("}`,
+		"invalid.yaml": "type: [",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(schema), 0o600))
+		_, _, err := loadJSONSchema(path)
+		assert.Error(t, err, name)
+	}
+	_, _, err := loadJSONSchema(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	config := JSONSchemaConfig{Path: "users", Schema: filepath.Join(dir, "missing.json")}
+	assert.Error(t, config.provision())
+}
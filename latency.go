@@ -0,0 +1,291 @@
+package caddywaf
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyBucketCount = 32
+	latencyBucketBase  = 250 * time.Nanosecond // Upper bound of the first bucket, doubled for each following bucket
+)
+
+// LatencyHistogram is a lock-free histogram with exponentially sized buckets.
+type LatencyHistogram struct {
+	buckets [latencyBucketCount]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64 // Nanoseconds
+}
+
+// LatencySummary is the JSON representation of a histogram.
+type LatencySummary struct {
+	Count   int64   `json:"count"`
+	TotalMs float64 `json:"total_ms"`
+	AvgUs   float64 `json:"avg_us"`
+	P50Us   float64 `json:"p50_us"`
+	P95Us   float64 `json:"p95_us"`
+	P99Us   float64 `json:"p99_us"`
+}
+
+// bucketUpperBound returns the upper bound of bucket i.
+func bucketUpperBound(i int) time.Duration {
+	return latencyBucketBase << i
+}
+
+// Observe records a single duration.
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < latencyBucketCount-1 && d > bucketUpperBound(i) {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Count returns the number of observations.
+func (h *LatencyHistogram) Count() int64 {
+	return h.count.Load()
+}
+
+// Total returns the sum of all observations.
+func (h *LatencyHistogram) Total() time.Duration {
+	return time.Duration(h.sum.Load())
+}
+
+// Quantile estimates the q-th quantile (0 < q <= 1) by linear interpolation within buckets.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	var counts [latencyBucketCount]int64
+	var total int64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var cumulative int64
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if float64(cumulative+c) >= rank {
+			lower := time.Duration(0)
+			if i > 0 {
+				lower = bucketUpperBound(i - 1)
+			}
+			upper := bucketUpperBound(i)
+			fraction := (rank - float64(cumulative)) / float64(c)
+			return lower + time.Duration(fraction*float64(upper-lower))
+		}
+		cumulative += c
+	}
+	return bucketUpperBound(latencyBucketCount - 1)
+}
+
+// Reset clears all observations.
+func (h *LatencyHistogram) Reset() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+	h.count.Store(0)
+	h.sum.Store(0)
+}
+
+// Summary returns the count, total, average and p50/p95/p99 of the histogram.
+func (h *LatencyHistogram) Summary() LatencySummary {
+	count := h.Count()
+	total := h.Total()
+	summary := LatencySummary{
+		Count:   count,
+		TotalMs: float64(total) / float64(time.Millisecond),
+		P50Us:   durationToMicros(h.Quantile(0.50)),
+		P95Us:   durationToMicros(h.Quantile(0.95)),
+		P99Us:   durationToMicros(h.Quantile(0.99)),
+	}
+	if count > 0 {
+		summary.AvgUs = durationToMicros(total) / float64(count)
+	}
+	return summary
+}
+
+// durationToMicros converts a duration to fractional microseconds.
+func durationToMicros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// ruleLatency holds the evaluation histogram and match count of a rule.
+type ruleLatency struct {
+	LatencyHistogram
+	matches atomic.Int64
+}
+
+// LatencyTracker records evaluation time per phase and per rule.
+type LatencyTracker struct {
+	phases [5]LatencyHistogram // Indexed by phase number, index 0 unused
+	rules  sync.Map            // Rule ID -> *ruleLatency
+
+	mu    sync.RWMutex
+	since time.Time // Start of the current measurement period
+}
+
+// NewLatencyTracker creates an empty LatencyTracker.
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{since: time.Now()}
+}
+
+// Since returns the start of the current measurement period.
+func (lt *LatencyTracker) Since() time.Time {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	return lt.since
+}
+
+// ObservePhase records the evaluation time of a phase.
+func (lt *LatencyTracker) ObservePhase(phase int, d time.Duration) {
+	if phase < 1 || phase >= len(lt.phases) {
+		return
+	}
+	lt.phases[phase].Observe(d)
+}
+
+// ObserveRule records the evaluation time of a rule.
+func (lt *LatencyTracker) ObserveRule(ruleID string, d time.Duration) {
+	lt.ruleHistogram(ruleID).Observe(d)
+}
+
+// RecordMatch counts a match of a rule.
+func (lt *LatencyTracker) RecordMatch(ruleID string) {
+	lt.ruleHistogram(ruleID).matches.Add(1)
+}
+
+// ruleHistogram returns the latency record for a rule, creating it if needed.
+func (lt *LatencyTracker) ruleHistogram(ruleID string) *ruleLatency {
+	if h, ok := lt.rules.Load(ruleID); ok {
+		return h.(*ruleLatency)
+	}
+	h, _ := lt.rules.LoadOrStore(ruleID, &ruleLatency{})
+	return h.(*ruleLatency)
+}
+
+// PhaseSummaries returns latency summaries keyed by phase number.
+func (lt *LatencyTracker) PhaseSummaries() map[string]LatencySummary {
+	summaries := make(map[string]LatencySummary)
+	for phase := 1; phase < len(lt.phases); phase++ {
+		if lt.phases[phase].Count() > 0 {
+			summaries[strconv.Itoa(phase)] = lt.phases[phase].Summary()
+		}
+	}
+	return summaries
+}
+
+// RuleSummaries returns latency summaries keyed by rule ID.
+func (lt *LatencyTracker) RuleSummaries() map[string]LatencySummary {
+	summaries := make(map[string]LatencySummary)
+	lt.rules.Range(func(key, value interface{}) bool {
+		summaries[key.(string)] = value.(*ruleLatency).Summary()
+		return true
+	})
+	return summaries
+}
+
+// Reset clears all phase and rule observations.
+func (lt *LatencyTracker) Reset() {
+	for i := range lt.phases {
+		lt.phases[i].Reset()
+	}
+	lt.rules.Range(func(key, _ interface{}) bool {
+		lt.rules.Delete(key)
+		return true
+	})
+	lt.mu.Lock()
+	lt.since = time.Now()
+	lt.mu.Unlock()
+}
+
+// RuleProfile is the evaluation cost of a single rule.
+type RuleProfile struct {
+	RuleID      string  `json:"rule_id"`
+	Evaluations int64   `json:"evaluations"`
+	Matches     int64   `json:"matches"`
+	TotalMs     float64 `json:"total_ms"`
+	AvgUs       float64 `json:"avg_us"`
+	P99Us       float64 `json:"p99_us"`
+}
+
+// Profile returns the rules sorted by the given key ("total", "avg" or "p99"), slowest first.
+func (lt *LatencyTracker) Profile(sortBy string, limit int) []RuleProfile {
+	profiles := make([]RuleProfile, 0)
+	lt.rules.Range(func(key, value interface{}) bool {
+		rl := value.(*ruleLatency)
+		summary := rl.Summary()
+		profiles = append(profiles, RuleProfile{
+			RuleID:      key.(string),
+			Evaluations: summary.Count,
+			Matches:     rl.matches.Load(),
+			TotalMs:     summary.TotalMs,
+			AvgUs:       summary.AvgUs,
+			P99Us:       summary.P99Us,
+		})
+		return true
+	})
+
+	sortValue := func(p RuleProfile) float64 {
+		switch sortBy {
+		case "avg":
+			return p.AvgUs
+		case "p99":
+			return p.P99Us
+		default:
+			return p.TotalMs
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		vi, vj := sortValue(profiles[i]), sortValue(profiles[j])
+		if vi != vj {
+			return vi > vj
+		}
+		return profiles[i].RuleID < profiles[j].RuleID
+	})
+	if limit > 0 && len(profiles) > limit {
+		profiles = profiles[:limit]
+	}
+	return profiles
+}
+
+// startLatencyTimer returns the current time when latency metrics are enabled.
+func (m *Middleware) startLatencyTimer() time.Time {
+	if m.latencyTracker == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observePhaseLatency records the time elapsed since start for a phase.
+func (m *Middleware) observePhaseLatency(phase int, start time.Time) {
+	if m.latencyTracker == nil || start.IsZero() {
+		return
+	}
+	m.latencyTracker.ObservePhase(phase, time.Since(start))
+}
+
+// observeRuleLatency records the time elapsed since start for a rule.
+func (m *Middleware) observeRuleLatency(ruleID string, start time.Time) {
+	if m.latencyTracker == nil || start.IsZero() {
+		return
+	}
+	m.latencyTracker.ObserveRule(ruleID, time.Since(start))
+}
+
+// recordRuleMatch counts a rule match for profiling and rule coverage.
+func (m *Middleware) recordRuleMatch(ruleID string) {
+	if m.latencyTracker != nil {
+		m.latencyTracker.RecordMatch(ruleID)
+	}
+	m.recordRuleCoverage(ruleID)
+}
@@ -0,0 +1,60 @@
+package caddywaf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram_Quantiles(t *testing.T) {
+	h := &LatencyHistogram{}
+	assert.Equal(t, time.Duration(0), h.Quantile(0.5), "empty histogram should report zero")
+
+	for i := 0; i < 90; i++ {
+		h.Observe(10 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(100), h.Count())
+	p50 := h.Quantile(0.50)
+	p99 := h.Quantile(0.99)
+	assert.True(t, p50 > 5*time.Microsecond && p50 <= 16*time.Microsecond, "p50 should be near 10µs, got %s", p50)
+	assert.True(t, p99 > 5*time.Millisecond && p99 <= 17*time.Millisecond, "p99 should be near 10ms, got %s", p99)
+
+	summary := h.Summary()
+	assert.InDelta(t, 100.9, summary.TotalMs, 0.01)
+
+	h.Reset()
+	assert.Equal(t, int64(0), h.Count())
+}
+
+func TestLatencyTracker(t *testing.T) {
+	lt := NewLatencyTracker()
+	lt.ObservePhase(1, time.Millisecond)
+	lt.ObservePhase(7, time.Millisecond) // ignored, invalid phase
+	lt.ObserveRule("sqli", 2*time.Millisecond)
+	lt.ObserveRule("sqli", 4*time.Millisecond)
+
+	phases := lt.PhaseSummaries()
+	assert.Len(t, phases, 1)
+	assert.Equal(t, int64(1), phases["1"].Count)
+
+	rules := lt.RuleSummaries()
+	assert.Equal(t, int64(2), rules["sqli"].Count)
+	assert.InDelta(t, 3000, rules["sqli"].AvgUs, 0.01)
+
+	lt.Reset()
+	assert.Empty(t, lt.PhaseSummaries())
+	assert.Empty(t, lt.RuleSummaries())
+}
+
+func TestMiddlewareLatencyTimer_Disabled(t *testing.T) {
+	m := &Middleware{}
+	start := m.startLatencyTimer()
+	assert.True(t, start.IsZero())
+	m.observePhaseLatency(1, start) // must not panic without a tracker
+	m.observeRuleLatency("rule", start)
+}
@@ -0,0 +1,432 @@
+package caddywaf
+
+import (
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLearningDuration  = 24 * time.Hour
+	defaultLearningMaxPaths  = 1000
+	defaultLearningMaxParams = 100
+	learningLengthBuckets    = 14 // Lengths 0, 1, 2-3, 4-7 ... 4096 and above
+)
+
+// LearningConfig observes the traffic the WAF lets through for a period and builds a
+// model of the paths, methods and parameters of legitimate requests, drafted as
+// param_schema blocks to review and enforce.
+type LearningConfig struct {
+	Duration  time.Duration `json:"duration,omitempty"`   // Observation period, default 24h
+	Output    string        `json:"output,omitempty"`     // File the draft policy is written to at the end of the period
+	MaxPaths  int           `json:"max_paths,omitempty"`  // Distinct paths learned, default 1000
+	MaxParams int           `json:"max_params,omitempty"` // Distinct parameters learned per path, default 100
+
+	logger *zap.Logger
+	model  *learningModel
+	timer  *time.Timer
+}
+
+// learningModel is the traffic observed so far.
+type learningModel struct {
+	mu       sync.Mutex
+	since    time.Time
+	until    time.Time
+	requests int64
+	dropped  int64 // Requests to paths past MaxPaths
+	paths    map[string]*learnedPath
+}
+
+// learnedPath is the traffic observed on a path.
+type learnedPath struct {
+	requests int64
+	methods  map[string]int64
+	params   map[string]*learnedParam
+}
+
+// learnedParam is the values observed for a parameter of a path.
+type learnedParam struct {
+	seen           int64 // Requests sending the parameter
+	minLen, maxLen int
+	lengths        [learningLengthBuckets]int64
+	isInt, isFloat bool // Whether every value parsed as the type
+	isBool         bool
+	numeric        bool    // Whether min and max were set
+	min, max       float64 // Bounds of the numeric values
+	digit, hex     bool    // Whether every value was in the charset
+	alpha, alnum   bool
+	printable      bool
+}
+
+// LearnedModel is the learned model reported by the admin API.
+type LearnedModel struct {
+	Active   bool          `json:"active"`
+	Since    time.Time     `json:"since"`
+	Until    time.Time     `json:"until"`
+	Requests int64         `json:"requests"`
+	Dropped  int64         `json:"dropped,omitempty"`
+	Paths    []LearnedPath `json:"paths"`
+}
+
+// LearnedPath is a path of the learned model.
+type LearnedPath struct {
+	Path     string           `json:"path"`
+	Requests int64            `json:"requests"`
+	Methods  map[string]int64 `json:"methods"`
+	Params   []LearnedParam   `json:"params,omitempty"`
+}
+
+// LearnedParam is a parameter of a learned path.
+type LearnedParam struct {
+	Name      string           `json:"name"`
+	Seen      int64            `json:"seen"`
+	Type      string           `json:"type"`
+	Charset   string           `json:"charset,omitempty"`
+	MinLength int              `json:"min_length"`
+	MaxLength int              `json:"max_length"`
+	Lengths   map[string]int64 `json:"lengths"` // Values per length range
+	Min       *float64         `json:"min,omitempty"`
+	Max       *float64         `json:"max,omitempty"`
+}
+
+// learningSample is the path, method and parameters of a request, learned once its
+// response shows it was legitimate.
+type learningSample struct {
+	path   string
+	method string
+	params url.Values
+}
+
+// provision applies the defaults and starts the observation period.
+func (c *LearningConfig) provision(logger *zap.Logger) {
+	if c.Duration <= 0 {
+		c.Duration = defaultLearningDuration
+	}
+	if c.MaxPaths <= 0 {
+		c.MaxPaths = defaultLearningMaxPaths
+	}
+	if c.MaxParams <= 0 {
+		c.MaxParams = defaultLearningMaxParams
+	}
+	c.logger = logger
+	now := time.Now()
+	c.model = &learningModel{since: now, until: now.Add(c.Duration), paths: make(map[string]*learnedPath)}
+	c.timer = time.AfterFunc(c.Duration, c.finish)
+}
+
+// stop ends the observation period early, without writing the draft policy.
+func (c *LearningConfig) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// active reports whether the observation period is running.
+func (c *LearningConfig) active(now time.Time) bool {
+	return now.Before(c.model.until)
+}
+
+// finish writes the draft policy at the end of the observation period.
+func (c *LearningConfig) finish() {
+	model := c.model.snapshot(time.Now())
+	c.logger.Info("Learning period over",
+		zap.Int64("requests", model.Requests),
+		zap.Int("paths", len(model.Paths)),
+	)
+	if c.Output == "" {
+		return
+	}
+	if err := os.WriteFile(c.Output, []byte(model.Policy()), 0o644); err != nil {
+		c.logger.Error("Failed to write the learned policy", zap.String("output", c.Output), zap.Error(err))
+		return
+	}
+	c.logger.Info("Learned policy written for review", zap.String("output", c.Output))
+}
+
+// learningPath returns the path a request is learned under: its path up to the first
+// segment looking like an identifier, such as a number or UUID, as a prefix with *.
+func learningPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifierSegment(segment) {
+			return strings.Join(segments[:i], "/") + "/*"
+		}
+	}
+	return path
+}
+
+// isIdentifierSegment reports whether a path segment looks like a numeric, UUID or long
+// hexadecimal identifier.
+func isIdentifierSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	if isCharset(segment, isDigitByte) {
+		return true
+	}
+	if len(segment) == 36 && strings.Count(segment, "-") == 4 {
+		return isCharset(strings.ReplaceAll(segment, "-", ""), isHexByte)
+	}
+	return len(segment) >= 16 && isCharset(segment, isHexByte)
+}
+
+func isDigitByte(b byte) bool { return b >= '0' && b <= '9' }
+func isAlphaByte(b byte) bool { return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') }
+func isHexByte(b byte) bool {
+	return isDigitByte(b) || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+func isAlnumByte(b byte) bool     { return isDigitByte(b) || isAlphaByte(b) }
+func isPrintableByte(b byte) bool { return b >= ' ' && b <= '~' }
+
+// isCharset reports whether every byte of s is in a charset.
+func isCharset(s string, in func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !in(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lengthBucket returns the bucket of a value length.
+func lengthBucket(n int) int {
+	return min(bits.Len(uint(n)), learningLengthBuckets-1)
+}
+
+// lengthBucketName returns the range of lengths of a bucket.
+func lengthBucketName(bucket int) string {
+	switch {
+	case bucket <= 1:
+		return strconv.Itoa(bucket)
+	case bucket == learningLengthBuckets-1:
+		return strconv.Itoa(1<<(bucket-1)) + "+"
+	default:
+		return strconv.Itoa(1<<(bucket-1)) + "-" + strconv.Itoa(1<<bucket-1)
+	}
+}
+
+// observe adds a value to the parameter.
+func (p *learnedParam) observe(value string) {
+	n := len(value)
+	if p.seen == 0 || n < p.minLen {
+		p.minLen = n
+	}
+	p.maxLen = max(p.maxLen, n)
+	p.lengths[lengthBucket(n)]++
+	p.digit = p.digit && isCharset(value, isDigitByte)
+	p.hex = p.hex && isCharset(value, isHexByte)
+	p.alpha = p.alpha && isCharset(value, isAlphaByte)
+	p.alnum = p.alnum && isCharset(value, isAlnumByte)
+	p.printable = p.printable && isCharset(value, isPrintableByte)
+	if _, err := strconv.ParseBool(value); err != nil {
+		p.isBool = false
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		p.isInt = false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.isFloat = false
+		return
+	}
+	if !p.numeric || number < p.min {
+		p.min = number
+	}
+	if !p.numeric || number > p.max {
+		p.max = number
+	}
+	p.numeric = true
+}
+
+// learn adds a request to the model.
+func (lm *learningModel) learn(sample *learningSample, maxPaths, maxParams int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.requests++
+	path, ok := lm.paths[sample.path]
+	if !ok {
+		if len(lm.paths) >= maxPaths {
+			lm.dropped++
+			return
+		}
+		path = &learnedPath{methods: make(map[string]int64), params: make(map[string]*learnedParam)}
+		lm.paths[sample.path] = path
+	}
+	path.requests++
+	path.methods[sample.method]++
+	for name, values := range sample.params {
+		param, ok := path.params[name]
+		if !ok {
+			if len(path.params) >= maxParams {
+				continue
+			}
+			param = &learnedParam{isInt: true, isFloat: true, isBool: true, digit: true, hex: true, alpha: true, alnum: true, printable: true}
+			path.params[name] = param
+		}
+		for _, value := range values {
+			param.observe(value)
+		}
+		param.seen++
+	}
+}
+
+// snapshot returns the model observed so far, sorted by path and parameter name.
+func (lm *learningModel) snapshot(now time.Time) LearnedModel {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	model := LearnedModel{
+		Active:   now.Before(lm.until),
+		Since:    lm.since,
+		Until:    lm.until,
+		Requests: lm.requests,
+		Dropped:  lm.dropped,
+		Paths:    make([]LearnedPath, 0, len(lm.paths)),
+	}
+	for name, path := range lm.paths {
+		lp := LearnedPath{Path: name, Requests: path.requests, Methods: make(map[string]int64, len(path.methods))}
+		for method, count := range path.methods {
+			lp.Methods[method] = count
+		}
+		for paramName, param := range path.params {
+			lp.Params = append(lp.Params, param.report(paramName))
+		}
+		slices.SortFunc(lp.Params, func(a, b LearnedParam) int { return strings.Compare(a.Name, b.Name) })
+		model.Paths = append(model.Paths, lp)
+	}
+	slices.SortFunc(model.Paths, func(a, b LearnedPath) int { return strings.Compare(a.Path, b.Path) })
+	return model
+}
+
+// report returns the type, charset and length distribution inferred for a parameter.
+func (p *learnedParam) report(name string) LearnedParam {
+	lp := LearnedParam{Name: name, Seen: p.seen, Type: "string", MinLength: p.minLen, MaxLength: p.maxLen, Lengths: make(map[string]int64)}
+	for bucket, count := range p.lengths {
+		if count > 0 {
+			lp.Lengths[lengthBucketName(bucket)] = count
+		}
+	}
+	switch {
+	case p.isBool && !p.digit:
+		lp.Type = "bool"
+	case p.isInt:
+		lp.Type = "int"
+	case p.isFloat:
+		lp.Type = "float"
+	}
+	if lp.Type == "int" || lp.Type == "float" {
+		lp.Min, lp.Max = &p.min, &p.max
+		return lp
+	}
+	if lp.Type == "string" {
+		switch {
+		case p.digit:
+			lp.Charset = "digit"
+		case p.alpha:
+			lp.Charset = "alpha"
+		case p.hex:
+			lp.Charset = "hex"
+		case p.alnum:
+			lp.Charset = "alnum"
+		case p.printable:
+			lp.Charset = "printable"
+		}
+	}
+	return lp
+}
+
+// Policy drafts a param_schema block per learned path, in Caddyfile syntax. Parameters
+// sent by every request to a path are required; the schemas score violations, to be
+// reviewed before they are switched to blocking.
+func (model LearnedModel) Policy() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Draft positive security policy learned from %d requests between %s and %s.\n",
+		model.Requests, model.Since.Format(time.RFC3339), model.Until.Format(time.RFC3339))
+	b.WriteString("# Review every schema before enforcing it.\n")
+	for _, path := range model.Paths {
+		methods := make([]string, 0, len(path.Methods))
+		for method := range path.Methods {
+			methods = append(methods, method)
+		}
+		slices.Sort(methods)
+		fmt.Fprintf(&b, "\n# %d requests\nparam_schema %s {\n", path.Requests, caddyfileToken(path.Path))
+		fmt.Fprintf(&b, "\tmethods %s\n", strings.Join(methods, " "))
+		for _, param := range path.Params {
+			fmt.Fprintf(&b, "\tparam %s %s", caddyfileToken(param.Name), param.Type)
+			if param.Seen == path.Requests {
+				b.WriteString(" required")
+			}
+			if param.Min != nil {
+				fmt.Fprintf(&b, " min %s max %s", strconv.FormatFloat(*param.Min, 'f', -1, 64), strconv.FormatFloat(*param.Max, 'f', -1, 64))
+			}
+			if param.MinLength > 0 {
+				fmt.Fprintf(&b, " min_length %d", param.MinLength)
+			}
+			fmt.Fprintf(&b, " max_length %d", max(param.MaxLength, 1))
+			if param.Charset != "" {
+				fmt.Fprintf(&b, " charset %s", param.Charset)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\taction score\n}\n")
+	}
+	return b.String()
+}
+
+// caddyfileToken quotes a learned path or parameter name that would not parse as a single
+// Caddyfile token.
+func caddyfileToken(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"{}#`\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// learningSampleFor collects the sample of a request while the learning period runs. It
+// is taken before the request is handed upstream, which consumes the body.
+func (m *Middleware) learningSampleFor(r *http.Request, state *WAFState) *learningSample {
+	if m.Learning == nil || !m.Learning.active(time.Now()) {
+		return nil
+	}
+	params, err := m.requestParams(r, state)
+	if err != nil {
+		return nil
+	}
+	return &learningSample{path: learningPath(r.URL.Path), method: r.Method, params: params}
+}
+
+// learnRequest adds a sample to the model if the upstream response shows the request was
+// legitimate, neither a client nor a server error.
+func (m *Middleware) learnRequest(sample *learningSample, statusCode int) {
+	if sample == nil || statusCode >= http.StatusBadRequest {
+		return
+	}
+	m.Learning.model.learn(sample, m.Learning.MaxPaths, m.Learning.MaxParams)
+}
+
+// handleLearningRequest reports the learned model.
+func (m *Middleware) handleLearningRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.Learning == nil {
+		return writeJSONError(w, http.StatusConflict, "learning requires the learning directive")
+	}
+	return writeJSON(w, http.StatusOK, m.Learning.model.snapshot(time.Now()))
+}
+
+// handleLearningPolicyRequest returns the draft policy of the learned model.
+func (m *Middleware) handleLearningPolicyRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.Learning == nil {
+		return writeJSONError(w, http.StatusConflict, "learning requires the learning directive")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(m.Learning.model.snapshot(time.Now()).Policy()))
+	return err
+}
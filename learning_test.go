@@ -0,0 +1,159 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLearningPath(t *testing.T) {
+	assert.Equal(t, "/api/users", learningPath("/api/users"))
+	assert.Equal(t, "/api/users/*", learningPath("/api/users/42/orders"))
+	assert.Equal(t, "/orders/*", learningPath("/orders/3f2c1a9e-8b7d-4c6e-9a1b-2d3e4f5a6b7c"))
+	assert.Equal(t, "/blobs/*", learningPath("/blobs/0123456789abcdef0123"))
+	assert.Equal(t, "/blog/cafe", learningPath("/blog/cafe"), "short hex words are not identifiers")
+}
+
+func TestLengthBucketName(t *testing.T) {
+	assert.Equal(t, "0", lengthBucketName(lengthBucket(0)))
+	assert.Equal(t, "1", lengthBucketName(lengthBucket(1)))
+	assert.Equal(t, "4-7", lengthBucketName(lengthBucket(5)))
+	assert.Equal(t, "4096+", lengthBucketName(lengthBucket(100000)))
+}
+
+func TestLearningModel(t *testing.T) {
+	config := &LearningConfig{MaxPaths: 2, MaxParams: 3}
+	config.provision(zap.NewNop())
+	defer config.stop()
+	assert.Equal(t, defaultLearningDuration, config.Duration)
+	assert.True(t, config.active(time.Now()))
+
+	learn := func(path, method, query string) {
+		params, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		config.model.learn(&learningSample{path: path, method: method, params: params}, config.MaxPaths, config.MaxParams)
+	}
+	learn("/search", "GET", "q=shoes&page=1&debug=true")
+	learn("/search", "GET", "q=red+shoes&page=12&debug=false")
+	learn("/search", "POST", "q=hats&price=9.5")
+	learn("/search", "GET", "q=x&extra=1")
+	learn("/cart", "GET", "")
+	learn("/overflow", "GET", "")
+
+	model := config.model.snapshot(time.Now())
+	assert.True(t, model.Active)
+	assert.Equal(t, int64(6), model.Requests)
+	assert.Equal(t, int64(1), model.Dropped, "max_paths reached")
+	require.Len(t, model.Paths, 2)
+	assert.Equal(t, "/cart", model.Paths[0].Path)
+
+	search := model.Paths[1]
+	assert.Equal(t, map[string]int64{"GET": 3, "POST": 1}, search.Methods)
+	require.Len(t, search.Params, 3, "max_params reached")
+	debug, page, q := search.Params[0], search.Params[1], search.Params[2]
+	assert.Equal(t, "bool", debug.Type)
+	assert.Equal(t, "int", page.Type)
+	assert.Equal(t, 1.0, *page.Min)
+	assert.Equal(t, 12.0, *page.Max)
+	assert.Equal(t, "string", q.Type)
+	assert.Equal(t, "printable", q.Charset)
+	assert.Equal(t, int64(4), q.Seen)
+	assert.Equal(t, 1, q.MinLength)
+	assert.Equal(t, 9, q.MaxLength)
+	assert.Equal(t, map[string]int64{"1": 1, "4-7": 2, "8-15": 1}, q.Lengths)
+
+	policy := model.Policy()
+	assert.Contains(t, policy, "param_schema /search {\n\tmethods GET POST\n")
+	assert.Contains(t, policy, "\tparam page int min 1 max 12 min_length 1 max_length 2\n")
+	assert.Contains(t, policy, "\tparam q string required min_length 1 max_length 9 charset printable\n")
+
+	// The draft policy parses as param_schema blocks
+	cl := NewConfigLoader(zap.NewNop())
+	d := caddyfile.NewTestDispenser(policy)
+	m := &Middleware{}
+	for d.Next() {
+		require.NoError(t, cl.parseParamSchema(d, m))
+	}
+	assert.Len(t, m.ParamSchemas, 2)
+}
+
+func TestLearningConfig_Finish(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "policy.caddyfile")
+	config := &LearningConfig{Duration: time.Hour, Output: output}
+	config.provision(zap.NewNop())
+	config.stop()
+	config.model.learn(&learningSample{path: "/login", method: "POST", params: url.Values{"user": {"alice"}}}, 10, 10)
+
+	config.finish()
+	policy, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Contains(t, string(policy), "param_schema /login {")
+	assert.Contains(t, string(policy), "\tparam user string required min_length 5 max_length 5 charset alpha\n")
+}
+
+func TestLearnRequest(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.Learning = &LearningConfig{}
+	m.Learning.provision(m.logger)
+	defer m.Learning.stop()
+
+	r := httptest.NewRequest("POST", "/api/items/7?view=full", strings.NewReader(`{"name": "lamp", "qty": 2}`))
+	r.Header.Set("Content-Type", "application/json")
+	state := &WAFState{}
+	sample := m.learningSampleFor(r, state)
+	require.NotNil(t, sample)
+	assert.Equal(t, "/api/items/*", sample.path)
+	assert.Equal(t, url.Values{"view": {"full"}, "name": {"lamp"}, "qty": {"2"}}, sample.params)
+
+	m.learnRequest(sample, http.StatusNotFound)
+	m.learnRequest(nil, http.StatusOK)
+	assert.Equal(t, int64(0), m.Learning.model.snapshot(time.Now()).Requests, "errors are not learned")
+	m.learnRequest(sample, http.StatusCreated)
+	assert.Equal(t, int64(1), m.Learning.model.snapshot(time.Now()).Requests)
+
+	m.Learning.model.until = time.Now()
+	assert.Nil(t, m.learningSampleFor(r, state), "the learning period is over")
+}
+
+func TestHandleLearningRequests(t *testing.T) {
+	m := newAPITestMiddleware()
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/learning", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	m.Learning = &LearningConfig{}
+	m.Learning.provision(zap.NewNop())
+	defer m.Learning.stop()
+	m.Learning.model.learn(&learningSample{path: "/", method: "GET", params: url.Values{}}, 10, 10)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/learning", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var model LearnedModel
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &model))
+	assert.True(t, model.Active)
+	require.Len(t, model.Paths, 1)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/learning/policy", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "param_schema / {\n\tmethods GET\n\taction score\n}\n")
+}
@@ -0,0 +1,87 @@
+package caddywaf
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/text/language"
+)
+
+// ResponseVariant is a localized body of a custom response.
+type ResponseVariant struct {
+	Body     string
+	File     string           // File the body is read from, reloaded when it changes
+	template responseTemplate // Parsed Body, if it has template actions
+}
+
+// responseLanguages matches the Accept-Language header against the languages of a response.
+type responseLanguages struct {
+	matcher language.Matcher
+	tags    []string // Language of each matcher entry after the first, the default body
+}
+
+// loadLanguages reads the localized bodies from their files, parses their templates and
+// builds the language matcher.
+func (c *CustomBlockResponse) loadLanguages() error {
+	c.languages = nil
+	if len(c.Languages) == 0 {
+		return nil
+	}
+	languages := &responseLanguages{}
+	variants := make(map[string]ResponseVariant, len(c.Languages))
+	supported := []language.Tag{language.Und} // Matched when no language fits
+	for lang, variant := range c.Languages {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return fmt.Errorf("invalid custom_response %d language %s: %w", c.StatusCode, lang, err)
+		}
+		if variant.File != "" {
+			content, err := os.ReadFile(variant.File)
+			if err != nil {
+				return fmt.Errorf("could not read custom response file '%s': %w", variant.File, err)
+			}
+			variant.Body = string(content)
+		}
+		variant.template, err = parseResponseTemplate(fmt.Sprintf("custom_response_%d_%s", c.StatusCode, lang), variant.Body, c.Headers["Content-Type"])
+		if err != nil {
+			return fmt.Errorf("invalid custom_response %d %s body template: %w", c.StatusCode, lang, err)
+		}
+		variants[lang] = variant
+		supported = append(supported, tag)
+		languages.tags = append(languages.tags, lang)
+	}
+	languages.matcher = language.NewMatcher(supported)
+	c.Languages, c.languages = variants, languages
+	return nil
+}
+
+// localize returns the response with the body of the language best matching the
+// Accept-Language header, and that language. Without a match the default body is kept and
+// the language is empty.
+func (c CustomBlockResponse) localize(acceptLanguage string) (CustomBlockResponse, string) {
+	if c.languages == nil || acceptLanguage == "" {
+		return c, ""
+	}
+	_, index := language.MatchStrings(c.languages.matcher, acceptLanguage)
+	if index == 0 {
+		return c, ""
+	}
+	lang := c.languages.tags[index-1]
+	variant := c.Languages[lang]
+	c.Body, c.template = variant.Body, variant.template
+	return c, lang
+}
+
+// files returns the files the bodies of the response are read from.
+func (c CustomBlockResponse) files() []string {
+	var files []string
+	if c.File != "" {
+		files = append(files, c.File)
+	}
+	for _, variant := range c.Languages {
+		if variant.File != "" {
+			files = append(files, variant.File)
+		}
+	}
+	return files
+}
@@ -0,0 +1,82 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCustomBlockResponse_Localize(t *testing.T) {
+	resp := CustomBlockResponse{
+		StatusCode: http.StatusForbidden,
+		Headers:    map[string]string{"Content-Type": "text/html"},
+		Body:       "<p>Access denied</p>",
+		Languages: map[string]ResponseVariant{
+			"fr":    {Body: "<p>Accès refusé</p>"},
+			"de":    {Body: "<p>Zugriff verweigert</p>"},
+			"pt-BR": {Body: "<p>Acesso negado {{.TransactionID}}</p>"},
+		},
+	}
+	require.NoError(t, resp.load())
+
+	for _, tc := range []struct {
+		acceptLanguage string
+		lang           string
+		body           string
+	}{
+		{"", "", "<p>Access denied</p>"},
+		{"en-US,en;q=0.9", "", "<p>Access denied</p>"},
+		{"fr-CA,fr;q=0.9,en;q=0.8", "fr", "<p>Accès refusé</p>"},
+		{"en;q=0.5, de", "de", "<p>Zugriff verweigert</p>"},
+		{"pt-BR", "pt-BR", "<p>Acesso negado {{.TransactionID}}</p>"},
+		{"ja", "", "<p>Access denied</p>"},
+	} {
+		localized, lang := resp.localize(tc.acceptLanguage)
+		assert.Equal(t, tc.lang, lang, tc.acceptLanguage)
+		assert.Equal(t, tc.body, localized.Body, tc.acceptLanguage)
+	}
+	assert.Equal(t, "<p>Access denied</p>", resp.Body, "localizing leaves the response unchanged")
+}
+
+func TestWriteCustomResponse_Localized(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		CustomResponses: map[int]CustomBlockResponse{
+			http.StatusForbidden: {
+				StatusCode: http.StatusForbidden,
+				Headers:    map[string]string{"Content-Type": "text/html"},
+				Body:       "<p>Access denied: {{.TransactionID}}</p>",
+				Languages:  map[string]ResponseVariant{"fr": {Body: "<p>Accès refusé : {{.TransactionID}}</p>"}},
+			},
+		},
+	}
+	require.NoError(t, m.loadCustomResponses())
+
+	req := testRequest("GET", "/", "", "")
+	req.Header.Set("Accept-Language", "fr-FR,fr;q=0.9")
+	w := httptest.NewRecorder()
+	m.blockRequest(w, req, &WAFState{}, http.StatusForbidden, "ban", "ban")
+	assert.Equal(t, "<p>Accès refusé : test</p>", w.Body.String())
+	assert.Equal(t, "fr", w.Header().Get("Content-Language"))
+	assert.Equal(t, "Accept-Language", w.Header().Get("Vary"))
+
+	w = httptest.NewRecorder()
+	m.blockRequest(w, testRequest("GET", "/", "", ""), &WAFState{}, http.StatusForbidden, "ban", "ban")
+	assert.Equal(t, "<p>Access denied: test</p>", w.Body.String())
+	assert.Empty(t, w.Header().Get("Content-Language"))
+}
+
+func TestCustomBlockResponse_LoadLanguagesErrors(t *testing.T) {
+	for _, variants := range []map[string]ResponseVariant{
+		{"not a tag": {Body: "x"}},
+		{"fr": {Body: "{{.TransactionID"}},
+		{"fr": {File: "/nonexistent/blocked.fr.html"}},
+	} {
+		resp := CustomBlockResponse{StatusCode: http.StatusForbidden, Body: "x", Languages: variants}
+		assert.Error(t, resp.load(), "%v", variants)
+	}
+}
@@ -0,0 +1,178 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	lockdownRuleID            = "lockdown_rule"
+	defaultLockdownRateWindow = time.Minute
+)
+
+// LockdownConfig is the stricter preset applied while the site is under attack: every
+// client without a solved challenge is challenged, requests are rate limited per IP across
+// all paths and the anomaly threshold is lowered. It is switched on and off at runtime
+// through the admin API, without a config reload.
+type LockdownConfig struct {
+	Enabled          bool          `json:"enabled,omitempty"`           // Start in lockdown
+	AnomalyThreshold int           `json:"anomaly_threshold,omitempty"` // Threshold in lockdown, default half the global one
+	RateLimit        int           `json:"rate_limit,omitempty"`        // Requests per RateWindow and IP, default half the rate_limit requests
+	RateWindow       time.Duration `json:"rate_window,omitempty"`       // Default the rate_limit window, else 1m
+	NoChallenge      bool          `json:"no_challenge,omitempty"`      // Don't challenge new clients
+
+	active  atomic.Bool
+	since   atomic.Int64 // Unix nanoseconds of the last switch on
+	limiter *RateLimiter
+}
+
+// LockdownStatus is the response of the lockdown admin API routes.
+type LockdownStatus struct {
+	Active bool       `json:"active"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// provision derives the defaults from the global anomaly threshold and rate limit, and
+// creates the lockdown rate limiter.
+func (c *LockdownConfig) provision(m *Middleware) error {
+	if c.AnomalyThreshold <= 0 {
+		c.AnomalyThreshold = max(m.AnomalyThreshold/2, 1)
+	}
+	if c.RateWindow <= 0 {
+		c.RateWindow = defaultLockdownRateWindow
+		if m.RateLimit.Window > 0 {
+			c.RateWindow = m.RateLimit.Window
+		}
+	}
+	if c.RateLimit <= 0 && m.RateLimit.Requests > 0 {
+		c.RateLimit = max(m.RateLimit.Requests/2, 1)
+	}
+	if c.RateLimit > 0 {
+		limiter, err := NewRateLimiter(RateLimit{
+			Requests:        c.RateLimit,
+			Window:          c.RateWindow,
+			CleanupInterval: c.RateWindow,
+			MatchAllPaths:   true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create lockdown rate limiter: %w", err)
+		}
+		c.limiter = limiter
+		c.limiter.startCleanup()
+	}
+	c.set(c.Enabled, time.Now())
+	return nil
+}
+
+// stop stops the rate limiter cleanup.
+func (c *LockdownConfig) stop() {
+	if c.limiter != nil {
+		c.limiter.signalStopCleanup()
+	}
+}
+
+// set switches the lockdown on or off, reporting whether its state changed.
+func (c *LockdownConfig) set(active bool, now time.Time) bool {
+	if c.active.Swap(active) == active {
+		return false
+	}
+	if active {
+		c.since.Store(now.UnixNano())
+	}
+	return true
+}
+
+// Status returns whether the lockdown is active, and since when.
+func (c *LockdownConfig) Status() LockdownStatus {
+	status := LockdownStatus{Active: c.active.Load()}
+	if status.Active {
+		since := time.Unix(0, c.since.Load())
+		status.Since = &since
+	}
+	return status
+}
+
+// lockdownActive reports whether the lockdown preset applies.
+func (m *Middleware) lockdownActive() bool {
+	return m.Lockdown != nil && m.Lockdown.active.Load()
+}
+
+// checkLockdown rate limits, then challenges, the requests of clients without a solved
+// challenge while the lockdown is active, reporting whether the request was ended. The
+// admin API and metrics endpoint are exempt, so that the lockdown can be switched off.
+func (m *Middleware) checkLockdown(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if !m.lockdownActive() || m.isAdminAPIRequest(r) || m.isMetricsRequest(r) {
+		return false
+	}
+	if limiter := m.Lockdown.limiter; limiter != nil && limiter.isRateLimited(m.scopedKey(r, extractIP(r.RemoteAddr)), r.URL.Path) {
+		m.lockdownHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusTooManyRequests, "lockdown", lockdownRuleID,
+			zap.String("message", "Request blocked by the lockdown rate limit"),
+		)
+		return true
+	}
+	if !m.Lockdown.NoChallenge && m.challenge(w, r, state, "lockdown", lockdownRuleID) {
+		m.lockdownHits.Add(1)
+		return true
+	}
+	return false
+}
+
+// setLockdown switches the lockdown on or off and logs the change.
+func (m *Middleware) setLockdown(active bool, reason string) {
+	if !m.Lockdown.set(active, time.Now()) {
+		return
+	}
+	if active {
+		m.logger.Warn("Lockdown enabled", zap.String("reason", reason))
+	} else {
+		m.logger.Info("Lockdown disabled", zap.String("reason", reason))
+	}
+}
+
+// lockdownRequest is the optional JSON body of POST /lockdown.
+type lockdownRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handleLockdownRequest reports the lockdown state.
+func (m *Middleware) handleLockdownRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.Lockdown == nil {
+		return writeJSONError(w, http.StatusConflict, "lockdown requires the lockdown directive")
+	}
+	return writeJSON(w, http.StatusOK, m.Lockdown.Status())
+}
+
+// handleLockdownEnableRequest switches the lockdown on.
+func (m *Middleware) handleLockdownEnableRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.Lockdown == nil {
+		return writeJSONError(w, http.StatusConflict, "lockdown requires the lockdown directive")
+	}
+	var req lockdownRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			return writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		}
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "enabled via admin API"
+	}
+	m.setLockdown(true, reason)
+	return writeJSON(w, http.StatusOK, m.Lockdown.Status())
+}
+
+// handleLockdownDisableRequest switches the lockdown off.
+func (m *Middleware) handleLockdownDisableRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.Lockdown == nil {
+		return writeJSONError(w, http.StatusConflict, "lockdown requires the lockdown directive")
+	}
+	m.setLockdown(false, "disabled via admin API")
+	return writeJSON(w, http.StatusOK, m.Lockdown.Status())
+}
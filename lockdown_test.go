@@ -0,0 +1,104 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockdownConfig_Provision(t *testing.T) {
+	m := &Middleware{AnomalyThreshold: 20, RateLimit: RateLimit{Requests: 100, Window: 30 * time.Second}}
+	config := &LockdownConfig{}
+	require.NoError(t, config.provision(m))
+	defer config.stop()
+	assert.Equal(t, 10, config.AnomalyThreshold)
+	assert.Equal(t, 50, config.RateLimit)
+	assert.Equal(t, 30*time.Second, config.RateWindow)
+	assert.NotNil(t, config.limiter)
+	assert.False(t, config.Status().Active)
+
+	config = &LockdownConfig{Enabled: true, AnomalyThreshold: 3}
+	require.NoError(t, config.provision(&Middleware{AnomalyThreshold: 1}))
+	assert.Equal(t, 3, config.AnomalyThreshold)
+	assert.Equal(t, defaultLockdownRateWindow, config.RateWindow)
+	assert.Nil(t, config.limiter, "no rate limit to tighten")
+	assert.True(t, config.Status().Active)
+	assert.NotNil(t, config.Status().Since)
+}
+
+func TestCheckLockdown(t *testing.T) {
+	m := newAPITestMiddleware()
+	m.AnomalyThreshold = 20
+	m.Challenge = &ChallengeConfig{Difficulty: 1}
+	require.NoError(t, m.Challenge.provision())
+	m.Lockdown = &LockdownConfig{RateLimit: 1}
+	require.NoError(t, m.Lockdown.provision(m))
+	defer m.Lockdown.stop()
+
+	request := func(path string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		return r
+	}
+	assert.False(t, m.checkLockdown(httptest.NewRecorder(), request("/"), &WAFState{}), "lockdown off")
+	assert.Equal(t, 20, m.anomalyThreshold(&WAFState{}))
+
+	m.setLockdown(true, "test")
+	assert.Equal(t, 10, m.anomalyThreshold(&WAFState{}))
+	assert.Equal(t, 5, m.anomalyThreshold(&WAFState{overlay: &HostOverlay{AnomalyThreshold: 5}}), "lower overlay threshold")
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkLockdown(w, request("/"), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Checking your browser")
+	assert.False(t, m.checkLockdown(httptest.NewRecorder(), request("/waf/api/lockdown"), &WAFState{}), "admin API is exempt")
+
+	w = httptest.NewRecorder()
+	assert.True(t, m.checkLockdown(w, request("/other"), &WAFState{}))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the lockdown rate limit covers all paths")
+	assert.Equal(t, int64(2), m.lockdownHits.Load())
+
+	m.setLockdown(false, "test")
+	assert.False(t, m.checkLockdown(httptest.NewRecorder(), request("/"), &WAFState{}))
+}
+
+func TestHandleLockdownRequests(t *testing.T) {
+	m := newAPITestMiddleware()
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/lockdown", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	m.Lockdown = &LockdownConfig{}
+	require.NoError(t, m.Lockdown.provision(m))
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/lockdown", strings.NewReader(`{"reason": "layer 7 flood"}`))))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status LockdownStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.True(t, status.Active)
+	assert.NotNil(t, status.Since)
+	assert.True(t, m.lockdownActive())
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/lockdown", strings.NewReader(`{`))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/lockdown", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"active":true`)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("DELETE", "/waf/api/lockdown", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"active": false}`, w.Body.String())
+	assert.False(t, m.lockdownActive())
+}
@@ -0,0 +1,200 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLogDedupWindow     = time.Minute
+	defaultLogDedupLimit      = 10
+	defaultLogDedupIPv4Prefix = 24
+	defaultLogDedupIPv6Prefix = 64
+	logDedupUnlimited         = -1 // Severity limit logging every entry
+)
+
+// LogDedupConfig collapses the log entries of rules matching very often: past Limit entries
+// of a rule in a window, its matches are only counted per client network and logged as one
+// aggregate entry per network at the end of the window.
+type LogDedupConfig struct {
+	Window     time.Duration  `json:"window,omitempty"`      // Aggregation window, default 1m
+	Limit      int            `json:"limit,omitempty"`       // Entries of a rule logged per window, default 10
+	Severities map[string]int `json:"severities,omitempty"`  // Limit per rule severity, -1 for no limit
+	IPv4Prefix int            `json:"ipv4_prefix,omitempty"` // Network of IPv4 clients, default /24
+	IPv6Prefix int            `json:"ipv6_prefix,omitempty"` // Network of IPv6 clients, default /64
+}
+
+// logDeduper counts the log entries of the current window.
+type logDeduper struct {
+	config   LogDedupConfig
+	logger   *zap.Logger
+	severity func(ruleID string) string
+
+	mu         sync.Mutex
+	rules      map[string]*logDedupRule
+	suppressed map[logDedupKey]int
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// logDedupRule is the state of a rule in the current window.
+type logDedupRule struct {
+	severity string
+	limit    int
+	logged   int
+}
+
+// logDedupKey identifies the aggregate entry of a rule and client network.
+type logDedupKey struct {
+	ruleID  string
+	network string
+}
+
+// provision applies the defaults and validates the severities.
+func (c *LogDedupConfig) provision() error {
+	if c.Window <= 0 {
+		c.Window = defaultLogDedupWindow
+	}
+	if c.Limit <= 0 {
+		c.Limit = defaultLogDedupLimit
+	}
+	if c.IPv4Prefix <= 0 || c.IPv4Prefix > 32 {
+		c.IPv4Prefix = defaultLogDedupIPv4Prefix
+	}
+	if c.IPv6Prefix <= 0 || c.IPv6Prefix > 128 {
+		c.IPv6Prefix = defaultLogDedupIPv6Prefix
+	}
+	severities := make(map[string]int, len(c.Severities))
+	for severity, limit := range c.Severities {
+		severity = strings.ToUpper(severity)
+		if _, ok := severityLevels[severity]; !ok {
+			return fmt.Errorf("invalid log_dedup severity: %s, must be LOW, MEDIUM, HIGH or CRITICAL", severity)
+		}
+		severities[severity] = limit
+	}
+	c.Severities = severities
+	return nil
+}
+
+// newLogDeduper creates a deduper looking rule severities up with severity.
+func newLogDeduper(config LogDedupConfig, logger *zap.Logger, severity func(ruleID string) string) *logDeduper {
+	return &logDeduper{
+		config:     config,
+		logger:     logger,
+		severity:   severity,
+		rules:      make(map[string]*logDedupRule),
+		suppressed: make(map[logDedupKey]int),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start flushes the aggregate entries at the end of every window.
+func (ld *logDeduper) Start() {
+	go func() {
+		defer close(ld.done)
+		ticker := time.NewTicker(ld.config.Window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ld.flush()
+			case <-ld.stop:
+				ld.flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop flushes the current window and stops the flushes.
+func (ld *logDeduper) Stop() {
+	ld.stopOnce.Do(func() {
+		close(ld.stop)
+		<-ld.done
+	})
+}
+
+// allow reports whether an entry of the rule for a client IP may be logged, counting it
+// in the aggregate entry of the client network otherwise.
+func (ld *logDeduper) allow(ruleID, ip string) bool {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	rule, ok := ld.rules[ruleID]
+	if !ok {
+		rule = &logDedupRule{severity: strings.ToUpper(ld.severity(ruleID)), limit: ld.config.Limit}
+		if limit, ok := ld.config.Severities[rule.severity]; ok {
+			rule.limit = limit
+		}
+		ld.rules[ruleID] = rule
+	}
+	if rule.limit < 0 || rule.logged < rule.limit {
+		rule.logged++
+		return true
+	}
+	ld.suppressed[logDedupKey{ruleID: ruleID, network: ld.network(ip)}]++
+	return false
+}
+
+// network returns the client network of an IP, or the IP as is if it doesn't parse.
+func (ld *logDeduper) network(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := ld.config.IPv6Prefix
+	if addr.Is4() {
+		bits = ld.config.IPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// flush logs an aggregate entry per rule and network with suppressed entries, then starts
+// a new window.
+func (ld *logDeduper) flush() {
+	ld.mu.Lock()
+	suppressed, rules := ld.suppressed, ld.rules
+	ld.suppressed = make(map[logDedupKey]int)
+	ld.rules = make(map[string]*logDedupRule)
+	ld.mu.Unlock()
+
+	keys := make([]logDedupKey, 0, len(suppressed))
+	for key := range suppressed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ruleID != keys[j].ruleID {
+			return keys[i].ruleID < keys[j].ruleID
+		}
+		return keys[i].network < keys[j].network
+	})
+	for _, key := range keys {
+		ld.logger.Warn("Rule log entries aggregated",
+			zap.String("rule_id", key.ruleID),
+			zap.String("severity", rules[key.ruleID].severity),
+			zap.String("network", key.network),
+			zap.Int("matches", suppressed[key]),
+			zap.Duration("window", ld.config.Window),
+		)
+	}
+}
+
+// allowRuleLog reports whether the log entry of a rule match may be written, always true
+// without the log_dedup directive.
+func (m *Middleware) allowRuleLog(r *http.Request, ruleID string) bool {
+	return m.logDeduper == nil || m.logDeduper.allow(ruleID, extractIP(r.RemoteAddr))
+}
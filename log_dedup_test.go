@@ -0,0 +1,76 @@
+package caddywaf
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogDedupConfig_Provision(t *testing.T) {
+	config := &LogDedupConfig{Severities: map[string]int{"critical": logDedupUnlimited}}
+	require.NoError(t, config.provision())
+	assert.Equal(t, defaultLogDedupWindow, config.Window)
+	assert.Equal(t, defaultLogDedupLimit, config.Limit)
+	assert.Equal(t, defaultLogDedupIPv4Prefix, config.IPv4Prefix)
+	assert.Equal(t, defaultLogDedupIPv6Prefix, config.IPv6Prefix)
+	assert.Equal(t, map[string]int{"CRITICAL": logDedupUnlimited}, config.Severities)
+
+	assert.Error(t, (&LogDedupConfig{Severities: map[string]int{"urgent": 1}}).provision())
+}
+
+func TestLogDeduper(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	config := LogDedupConfig{Limit: 2, Severities: map[string]int{"HIGH": 0, "CRITICAL": logDedupUnlimited}}
+	require.NoError(t, config.provision())
+	severities := map[string]string{"1002": "MEDIUM", "ip_blacklist_rule": "HIGH", "942100": "critical"}
+	ld := newLogDeduper(config, zap.New(core), func(ruleID string) string { return severities[ruleID] })
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, i < 2, ld.allow("1002", "1.2.3.4"), "entry %d", i)
+		assert.False(t, ld.allow("ip_blacklist_rule", "2001:db8::1"), "HIGH entries are only aggregated")
+		assert.True(t, ld.allow("942100", "1.2.3.4"), "CRITICAL entries are always logged")
+	}
+	assert.False(t, ld.allow("1002", "1.2.3.200"))
+	assert.False(t, ld.allow("1002", "5.6.7.8"))
+	assert.False(t, ld.allow("1002", "not-an-ip"))
+
+	ld.flush()
+	entries := logs.TakeAll()
+	require.Len(t, entries, 4)
+	var aggregates []string
+	for _, entry := range entries {
+		fields := entry.ContextMap()
+		aggregates = append(aggregates, fields["rule_id"].(string)+" "+fields["network"].(string))
+		if fields["network"] == "1.2.3.0/24" {
+			assert.Equal(t, int64(4), fields["matches"])
+			assert.Equal(t, "MEDIUM", fields["severity"])
+			assert.Equal(t, time.Minute, fields["window"])
+		}
+	}
+	assert.Equal(t, []string{"1002 1.2.3.0/24", "1002 5.6.7.0/24", "1002 not-an-ip", "ip_blacklist_rule 2001:db8::/64"}, aggregates)
+
+	// A new window logs entries again
+	assert.True(t, ld.allow("1002", "1.2.3.4"))
+	ld.flush()
+	assert.Empty(t, logs.TakeAll())
+}
+
+func TestAllowRuleLog(t *testing.T) {
+	m := &Middleware{}
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.True(t, m.allowRuleLog(r, "1002"), "always without log_dedup")
+
+	config := LogDedupConfig{Limit: 1}
+	require.NoError(t, config.provision())
+	m.logDeduper = newLogDeduper(config, zap.NewNop(), m.ruleSeverity)
+	m.logDeduper.Start()
+	assert.True(t, m.allowRuleLog(r, "1002"))
+	assert.False(t, m.allowRuleLog(r, "1002"))
+	m.logDeduper.Stop()
+	m.logDeduper.Stop()
+}
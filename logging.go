@@ -94,19 +94,77 @@ func (m *Middleware) logRequest(level zapcore.Level, msg string, r *http.Request
 	allFields := m.prepareLogFields(r, fields) // Prepare all fields in one function
 
 	// Send the log entry to the buffered channel
+	entry := LogEntry{Level: level, Message: msg, Fields: allFields}
 	select {
-	case m.logChan <- LogEntry{Level: level, Message: msg, Fields: allFields}:
+	case <-m.logDone:
+		m.logger.Log(level, msg, allFields...) // The worker has stopped
+		return
+	default:
+	}
+	select {
+	case m.logChan <- entry:
 		// Log entry successfully queued
+	default:
+		m.handleLogOverflow(entry)
+	}
+}
+
+// handleLogOverflow applies the log_overflow policy to an entry that didn't fit in the buffer.
+func (m *Middleware) handleLogOverflow(entry LogEntry) {
+	switch m.LogOverflow {
+	case logOverflowDropNew:
+		m.dropLogEntry(entry)
+	case logOverflowDropOldest:
+		select {
+		case oldest := <-m.logChan:
+			m.dropLogEntry(oldest)
+		default:
+		}
+		select {
+		case m.logChan <- entry:
+		default:
+			m.dropLogEntry(entry) // Other writers took the freed slot
+		}
+	case logOverflowBlock:
+		timeout := m.LogOverflowTimeout
+		if timeout <= 0 {
+			timeout = defaultLogOverflowTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case m.logChan <- entry:
+		case <-timer.C:
+			m.dropLogEntry(entry)
+		}
 	default:
 		// If the channel is full, fall back to synchronous logging
 		m.logger.Warn("Log buffer full, falling back to synchronous logging",
-			zap.String("message", msg),
-			zap.Any("fields", allFields),
+			zap.String("message", entry.Message),
+			zap.Any("fields", entry.Fields),
 		)
-		m.logger.Log(level, msg, allFields...)
+		m.logger.Log(entry.Level, entry.Message, entry.Fields...)
 	}
 }
 
+// dropLogEntry counts a dropped log entry, warning on the first drop and every 1000 after it
+// so losses are visible even when the buffer stays full.
+func (m *Middleware) dropLogEntry(entry LogEntry) {
+	dropped := m.logDropped.Add(1)
+	if dropped == 1 || dropped%1000 == 0 {
+		m.logger.Warn("Log buffer full, dropping log entries",
+			zap.String("policy", m.LogOverflow),
+			zap.String("message", entry.Message),
+			zap.Int64("dropped_total", dropped),
+		)
+	}
+}
+
+// LogDropped returns the number of log entries dropped because the log buffer was full.
+func (m *Middleware) LogDropped() int64 {
+	return m.logDropped.Load()
+}
+
 // redactSensitiveFields redacts sensitive information in the log fields.
 func (m *Middleware) redactSensitiveFields(fields []zap.Field) []zap.Field {
 	redactedFields := make([]zap.Field, len(fields))
@@ -228,24 +286,62 @@ type LogEntry struct {
 	Fields  []zap.Field
 }
 
+// Policies applied when the log buffer is full.
+const (
+	logOverflowSync       = "sync"               // Log synchronously on the request goroutine
+	logOverflowDropOldest = "drop_oldest"        // Drop the oldest queued entry
+	logOverflowDropNew    = "drop_new"           // Drop the new entry
+	logOverflowBlock      = "block_with_timeout" // Wait for room, dropping the entry after a timeout
+
+	defaultLogOverflowTimeout = 100 * time.Millisecond
+)
+
+// isLogOverflowPolicy reports whether policy is a known log_overflow policy.
+func isLogOverflowPolicy(policy string) bool {
+	switch policy {
+	case logOverflowSync, logOverflowDropOldest, logOverflowDropNew, logOverflowBlock:
+		return true
+	}
+	return false
+}
+
 // StartLogWorker initializes the background logging worker.
 func (m *Middleware) StartLogWorker() {
 	if m.LogBuffer == 0 {
 		m.LogBuffer = 1000 // Setting default log buffer
 	}
 	m.logChan = make(chan LogEntry, m.LogBuffer) // Buffer size can be adjusted
+	m.logStop = make(chan struct{})
 	m.logDone = make(chan struct{})
 
 	go func() {
-		for entry := range m.logChan {
-			m.logger.Log(entry.Level, entry.Message, entry.Fields...)
+		defer close(m.logDone) // Signal that the worker has finished
+		for {
+			select {
+			case entry := <-m.logChan:
+				m.logger.Log(entry.Level, entry.Message, entry.Fields...)
+			case <-m.logStop:
+				// Flush the queued entries; later ones are logged synchronously
+				for {
+					select {
+					case entry := <-m.logChan:
+						m.logger.Log(entry.Level, entry.Message, entry.Fields...)
+					default:
+						return
+					}
+				}
+			}
 		}
-		close(m.logDone) // Signal that the worker has finished
 	}()
 }
 
-// StopLogWorker stops the background logging worker.
+// StopLogWorker stops the background logging worker, if it was started. The channel is left
+// open, so requests finishing after the worker stopped don't panic.
 func (m *Middleware) StopLogWorker() {
-	close(m.logChan) // Close the channel to stop the worker
-	<-m.logDone      // Wait for the worker to finish processing
+	if m.logStop == nil {
+		return
+	}
+	close(m.logStop)
+	<-m.logDone // Wait for the worker to finish processing
+	m.logStop = nil
 }
@@ -154,3 +154,57 @@ func TestLogWorker(t *testing.T) {
 	// Allow some time for async processing
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestLogOverflowPolicies(t *testing.T) {
+	newFull := func(policy string) *Middleware {
+		m := &Middleware{
+			logger:             zap.NewNop(),
+			logLevel:           zapcore.DebugLevel,
+			logChan:            make(chan LogEntry, 1),
+			LogOverflow:        policy,
+			LogOverflowTimeout: 10 * time.Millisecond,
+		}
+		m.logRequest(zapcore.InfoLevel, "first", nil)
+		return m
+	}
+
+	m := newFull(logOverflowDropNew)
+	m.logRequest(zapcore.InfoLevel, "second", nil)
+	if entry := <-m.logChan; entry.Message != "first" {
+		t.Errorf("drop_new: expected the queued entry to be kept, got %q", entry.Message)
+	}
+	if m.LogDropped() != 1 {
+		t.Errorf("drop_new: expected 1 dropped entry, got %d", m.LogDropped())
+	}
+
+	m = newFull(logOverflowDropOldest)
+	m.logRequest(zapcore.InfoLevel, "second", nil)
+	if entry := <-m.logChan; entry.Message != "second" {
+		t.Errorf("drop_oldest: expected the new entry to be queued, got %q", entry.Message)
+	}
+	if m.LogDropped() != 1 {
+		t.Errorf("drop_oldest: expected 1 dropped entry, got %d", m.LogDropped())
+	}
+
+	m = newFull(logOverflowBlock)
+	start := time.Now()
+	m.logRequest(zapcore.InfoLevel, "second", nil)
+	if time.Since(start) < m.LogOverflowTimeout || m.LogDropped() != 1 {
+		t.Errorf("block_with_timeout: expected the entry to be dropped after the timeout, dropped %d", m.LogDropped())
+	}
+	go func() {
+		time.Sleep(2 * time.Millisecond)
+		<-m.logChan
+	}()
+	m.LogOverflowTimeout = time.Second
+	m.logRequest(zapcore.InfoLevel, "third", nil)
+	if entry := <-m.logChan; entry.Message != "third" || m.LogDropped() != 1 {
+		t.Errorf("block_with_timeout: expected the entry to be queued once room was made, got %q", entry.Message)
+	}
+
+	m = newFull(logOverflowSync)
+	m.logRequest(zapcore.InfoLevel, "second", nil)
+	if m.LogDropped() != 0 {
+		t.Errorf("sync: expected no dropped entries, got %d", m.LogDropped())
+	}
+}
@@ -0,0 +1,139 @@
+package caddywaf
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLookupCacheSize = 10000
+	defaultLookupCacheTTL  = 10 * time.Minute
+)
+
+// LookupCacheConfig sizes the caches of per-IP GeoIP and IP blacklist lookups.
+type LookupCacheConfig struct {
+	Size int           `json:"size,omitempty"` // Entries per cache, default 10000
+	TTL  time.Duration `json:"ttl,omitempty"`  // Lifetime of an entry, default 10m
+}
+
+// LookupCacheStats reports the usage of a lookup cache.
+type LookupCacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// lookupCache is a size-bounded LRU cache whose entries expire after a TTL.
+type lookupCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // Most recently used at the front
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+type lookupCacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// newLookupCache creates a cache of at most size entries living for ttl; zero values use the defaults.
+func newLookupCache[V any](size int, ttl time.Duration) *lookupCache[V] {
+	if size <= 0 {
+		size = defaultLookupCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultLookupCacheTTL
+	}
+	return &lookupCache[V]{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the cached value for key, if present and not expired.
+func (c *lookupCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lookupCacheEntry[V])
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.hits.Add(1)
+			return entry.value, true
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.misses.Add(1)
+	var zero V
+	return zero, false
+}
+
+// Set caches value for key, evicting the least recently used entry when the cache is full.
+func (c *lookupCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(key, value)
+}
+
+// setLocked caches value for key. The caller must hold c.mu.
+func (c *lookupCache[V]) setLocked(key string, value V) {
+	expires := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lookupCacheEntry[V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupCacheEntry[V]).key)
+	}
+	c.entries[key] = c.order.PushFront(&lookupCacheEntry[V]{key: key, value: value, expires: expires})
+}
+
+// Add caches value for key unless a live entry exists, reporting whether it was added.
+func (c *lookupCache[V]) Add(key string, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok && time.Now().Before(elem.Value.(*lookupCacheEntry[V]).expires) {
+		return false
+	}
+	c.setLocked(key, value)
+	return true
+}
+
+// Delete drops the entry of key.
+func (c *lookupCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// Clear drops all entries.
+func (c *lookupCache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Stats returns the number of entries, hits and misses of the cache.
+func (c *lookupCache[V]) Stats() LookupCacheStats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return LookupCacheStats{Entries: entries, Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
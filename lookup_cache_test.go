@@ -0,0 +1,90 @@
+package caddywaf
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLookupCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLookupCache[string](2, time.Minute)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	_, ok := c.Get("a") // a is now more recently used than b
+	assert.True(t, ok)
+	c.Set("c", "3")
+
+	_, ok = c.Get("b")
+	assert.False(t, ok, "least recently used entry is evicted")
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+
+	c.Clear()
+	assert.Zero(t, c.Stats().Entries)
+}
+
+func TestLookupCache_Expires(t *testing.T) {
+	c := newLookupCache[bool](0, 10*time.Millisecond)
+	assert.Equal(t, defaultLookupCacheSize, c.size)
+	c.Set("ip", true)
+	_, ok := c.Get("ip")
+	assert.True(t, ok)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok = c.Get("ip")
+	assert.False(t, ok, "expired entries are not returned")
+	assert.Zero(t, c.Stats().Entries)
+}
+
+func TestIPBlacklistContains_Cached(t *testing.T) {
+	blacklist := iptrie.NewTrie()
+	blacklist.Insert(netip.MustParsePrefix("10.0.0.0/8"), nil)
+	m := &Middleware{
+		logger:           zap.NewNop(),
+		ipBlacklist:      blacklist,
+		ipBlacklistCache: newLookupCache[ipBlacklistVerdict](10, time.Minute),
+	}
+
+	assert.True(t, m.isIPBlacklisted("10.1.2.3:1234"))
+	assert.True(t, m.isIPBlacklisted("10.1.2.3:5678"))
+	assert.False(t, m.isIPBlacklisted("192.0.2.1:1234"))
+	assert.Equal(t, int64(1), m.ipBlacklistCache.Stats().Hits)
+	assert.Equal(t, int64(2), m.IPBlacklistBlockCount, "cached hits are still counted")
+
+	// A reloaded blacklist invalidates the verdicts made against the old one
+	m.ipBlacklist = iptrie.NewTrie()
+	m.ipBlacklist.Insert(netip.MustParsePrefix("192.0.2.0/24"), nil)
+	assert.False(t, m.isIPBlacklisted("10.1.2.3:1234"))
+	assert.True(t, m.isIPBlacklisted("192.0.2.1:1234"))
+
+	// Addresses that aren't IPs, such as forged X-Forwarded-For values, are neither blacklisted nor cached
+	entries := m.ipBlacklistCache.Stats().Entries
+	assert.NotPanics(t, func() { assert.False(t, m.isIPBlacklisted("not-an-ip")) })
+	assert.Equal(t, entries, m.ipBlacklistCache.Stats().Entries)
+}
+
+func TestLookupCache_AddDelete(t *testing.T) {
+	c := newLookupCache[int](10, 10*time.Millisecond)
+	assert.True(t, c.Add("key", 1))
+	assert.False(t, c.Add("key", 2), "live entries are kept")
+	value, _ := c.Get("key")
+	assert.Equal(t, 1, value)
+
+	c.Delete("key")
+	assert.True(t, c.Add("key", 3))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, c.Add("key", 4), "expired entries are replaced")
+	c.Delete("missing")
+	assert.Equal(t, 1, c.Stats().Entries)
+}
@@ -0,0 +1,198 @@
+package caddywaf
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const windowedCounterSlots = 3600 // One slot per second covers the longest reported window
+
+// metricsWindows are the rolling windows reported by the metrics endpoint.
+var metricsWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// WindowedCounter counts events in one-second slots over the last hour.
+type WindowedCounter struct {
+	mu     sync.Mutex
+	counts [windowedCounterSlots]int64
+	stamps [windowedCounterSlots]int64 // Unix second the slot belongs to
+}
+
+// Add records n events at the given time.
+func (wc *WindowedCounter) Add(now time.Time, n int64) {
+	sec := now.Unix()
+	slot := sec % windowedCounterSlots
+	wc.mu.Lock()
+	if wc.stamps[slot] != sec {
+		wc.stamps[slot] = sec
+		wc.counts[slot] = 0
+	}
+	wc.counts[slot] += n
+	wc.mu.Unlock()
+}
+
+// Count returns the number of events within window before now.
+func (wc *WindowedCounter) Count(now time.Time, window time.Duration) int64 {
+	sec := now.Unix()
+	oldest := sec - int64(window/time.Second)
+	var total int64
+	wc.mu.Lock()
+	for i := range wc.stamps {
+		if wc.stamps[i] > oldest && wc.stamps[i] <= sec {
+			total += wc.counts[i]
+		}
+	}
+	wc.mu.Unlock()
+	return total
+}
+
+// Reset clears all slots.
+func (wc *WindowedCounter) Reset() {
+	wc.mu.Lock()
+	wc.counts = [windowedCounterSlots]int64{}
+	wc.stamps = [windowedCounterSlots]int64{}
+	wc.mu.Unlock()
+}
+
+// WindowStats are the request counts and rates within a rolling window.
+type WindowStats struct {
+	TotalRequests     int64   `json:"total_requests"`
+	BlockedRequests   int64   `json:"blocked_requests"`
+	AllowedRequests   int64   `json:"allowed_requests"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	BlockedPerSecond  float64 `json:"blocked_per_second"`
+	BlockRatio        float64 `json:"block_ratio"`
+}
+
+// RequestWindows keeps rolling counters of total, blocked and allowed requests.
+type RequestWindows struct {
+	total   WindowedCounter
+	blocked WindowedCounter
+	allowed WindowedCounter
+}
+
+// NewRequestWindows creates empty request windows.
+func NewRequestWindows() *RequestWindows {
+	return &RequestWindows{}
+}
+
+// Stats returns the counts and rates for each reported window.
+func (rw *RequestWindows) Stats(now time.Time) map[string]WindowStats {
+	stats := make(map[string]WindowStats, len(metricsWindows))
+	for _, window := range metricsWindows {
+		s := WindowStats{
+			TotalRequests:   rw.total.Count(now, window.duration),
+			BlockedRequests: rw.blocked.Count(now, window.duration),
+			AllowedRequests: rw.allowed.Count(now, window.duration),
+		}
+		seconds := window.duration.Seconds()
+		s.RequestsPerSecond = float64(s.TotalRequests) / seconds
+		s.BlockedPerSecond = float64(s.BlockedRequests) / seconds
+		if s.TotalRequests > 0 {
+			s.BlockRatio = float64(s.BlockedRequests) / float64(s.TotalRequests)
+		}
+		stats[window.name] = s
+	}
+	return stats
+}
+
+// Reset clears all windows.
+func (rw *RequestWindows) Reset() {
+	rw.total.Reset()
+	rw.blocked.Reset()
+	rw.allowed.Reset()
+}
+
+// resetMetrics clears all counters reported by the metrics endpoint.
+func (m *Middleware) resetMetrics() {
+	m.muMetrics.Lock()
+	m.totalRequests = 0
+	m.blockedRequests = 0
+	m.allowedRequests = 0
+	m.ruleHitsByPhase = make(map[int]int64)
+	m.geoIPStats = make(map[string]int64)
+	m.geoIPBlockedByCountry = make(map[string]int64)
+	m.geoIPBlocked = 0
+	m.muMetrics.Unlock()
+
+	m.ruleHits.Range(func(key, _ interface{}) bool {
+		m.ruleHits.Delete(key)
+		return true
+	})
+
+	m.muIPBlacklistMetrics.Lock()
+	m.IPBlacklistBlockCount = 0
+	m.muIPBlacklistMetrics.Unlock()
+
+	m.muDNSBlacklistMetrics.Lock()
+	m.DNSBlacklistBlockCount = 0
+	m.muDNSBlacklistMetrics.Unlock()
+	m.pathBlacklistHits.Store(0)
+	m.certBlacklistHits.Store(0)
+	m.stuffingHits.Store(0)
+	m.challengesIssued.Store(0)
+	m.geoVelocityHits.Store(0)
+	m.slowBodyHits.Store(0)
+	m.concurrencyHits.Store(0)
+	m.replayHits.Store(0)
+	m.quotaHits.Store(0)
+	m.costLimitHits.Store(0)
+	m.botScoreHits.Store(0)
+	m.reputationHits.Store(0)
+	m.inspectorHits.Store(0)
+	m.icapHits.Store(0)
+	m.malwareBlocked.Store(0)
+	m.yaraHits.Store(0)
+	m.directOriginBlocked.Store(0)
+	m.lockdownHits.Store(0)
+	m.fpReports.Store(0)
+	m.paramAnomalies.Store(0)
+	m.decodedMatches.Store(0)
+	m.deserializationHits.Store(0)
+	m.ssrfHits.Store(0)
+	m.openRedirectHits.Store(0)
+	m.smugglingHits.Store(0)
+	m.crlfHits.Store(0)
+	m.requestEncodingHits.Store(0)
+	m.uploadPolicyHits.Store(0)
+	m.bodySizeHits.Store(0)
+	m.hotlinkHits.Store(0)
+	m.signedURLHits.Store(0)
+	m.requestSigningHits.Store(0)
+	m.graphQLHits.Store(0)
+	m.rpcHits.Store(0)
+	m.xxeHits.Store(0)
+	if m.IPType != nil && m.IPType.requests != nil {
+		m.IPType.resetMetrics()
+	}
+
+	m.muRateLimiterMetrics.Lock()
+	m.rateLimiterBlockedRequests = 0
+	m.muRateLimiterMetrics.Unlock()
+
+	if m.rateLimiter != nil {
+		m.rateLimiter.resetMetrics()
+	}
+	if m.requestWindows != nil {
+		m.requestWindows.Reset()
+	}
+	if m.tenants != nil {
+		m.tenants.Reset()
+	}
+}
+
+// handleMetricsResetRequest clears all metrics counters.
+func (m *Middleware) handleMetricsResetRequest(w http.ResponseWriter, r *http.Request) error {
+	m.resetMetrics()
+	m.logger.Info("Metrics reset", zap.String("remote_addr", r.RemoteAddr))
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+}
@@ -0,0 +1,78 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWindowedCounter(t *testing.T) {
+	var wc WindowedCounter
+	now := time.Unix(1_700_000_000, 0)
+
+	wc.Add(now.Add(-2*time.Hour), 100) // Outside every window
+	wc.Add(now.Add(-30*time.Minute), 5)
+	wc.Add(now.Add(-2*time.Minute), 3)
+	wc.Add(now.Add(-10*time.Second), 2)
+	wc.Add(now, 1)
+
+	assert.Equal(t, int64(3), wc.Count(now, time.Minute))
+	assert.Equal(t, int64(6), wc.Count(now, 5*time.Minute))
+	assert.Equal(t, int64(11), wc.Count(now, time.Hour))
+
+	wc.Reset()
+	assert.Equal(t, int64(0), wc.Count(now, time.Hour))
+}
+
+func TestWindowedCounter_SlotReuse(t *testing.T) {
+	var wc WindowedCounter
+	now := time.Unix(1_700_000_000, 0)
+
+	wc.Add(now.Add(-time.Hour), 7) // Same slot as now, one cycle earlier
+	wc.Add(now, 1)
+	assert.Equal(t, int64(1), wc.Count(now, time.Hour))
+}
+
+func TestRequestWindows_Stats(t *testing.T) {
+	rw := NewRequestWindows()
+	now := time.Now()
+	for i := 0; i < 60; i++ {
+		rw.total.Add(now, 1)
+	}
+	rw.blocked.Add(now, 15)
+	rw.allowed.Add(now, 45)
+
+	stats := rw.Stats(now)
+	assert.Equal(t, int64(60), stats["1m"].TotalRequests)
+	assert.InDelta(t, 1.0, stats["1m"].RequestsPerSecond, 0.0001)
+	assert.InDelta(t, 0.25, stats["1m"].BlockRatio, 0.0001)
+	assert.Equal(t, int64(15), stats["1h"].BlockedRequests)
+}
+
+func TestHandleMetricsResetRequest(t *testing.T) {
+	m := &Middleware{
+		logger:         zap.NewNop(),
+		AdminAPI:       defaultAdminAPIPrefix,
+		requestWindows: NewRequestWindows(),
+	}
+	m.apiRoutes = m.registerAPIRoutes()
+
+	m.incrementTotalRequestsMetric()
+	m.incrementBlockedRequestsMetric()
+	m.incrementRuleHitCount("rule1")
+	m.IPBlacklistBlockCount = 3
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/metrics/reset", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, int64(0), m.totalRequests)
+	assert.Equal(t, int64(0), m.blockedRequests)
+	assert.Equal(t, int64(0), m.IPBlacklistBlockCount)
+	assert.Empty(t, m.getRuleHitStats())
+	assert.Equal(t, int64(0), m.requestWindows.Stats(time.Now())["1m"].TotalRequests)
+}
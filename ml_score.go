@@ -0,0 +1,212 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	mlScoreInspectorName    = "ml_score"
+	maxMLScoreResponseBytes = 64 << 10
+)
+
+// MLFeatureNames are the names of the values of RequestFeatures.Vector, in order.
+var MLFeatureNames = []string{
+	"phase", "method_get", "method_post", "path_length", "path_depth", "query_length", "query_params",
+	"header_count", "body_length", "entropy", "digit_ratio", "letter_ratio", "symbol_ratio",
+	"control_ratio", "percent_encoded", "score", "matched_rules",
+}
+
+// RequestFeatures is a normalized summary of a request, sent to the ml_score service. ONNX
+// or other local models can be run by an inspector plugin from its Vector.
+type RequestFeatures struct {
+	Phase          int      `json:"phase"`
+	Method         string   `json:"method"`
+	Path           string   `json:"path"`
+	PathLength     int      `json:"path_length"`
+	PathDepth      int      `json:"path_depth"`
+	QueryLength    int      `json:"query_length"`
+	QueryParams    int      `json:"query_params"`
+	HeaderCount    int      `json:"header_count"`
+	UserAgent      string   `json:"user_agent"`
+	ContentType    string   `json:"content_type"`
+	BodyLength     int      `json:"body_length"`
+	Entropy        float64  `json:"entropy"`     // Shannon entropy of the query and body, in bits per byte
+	DigitRatio     float64  `json:"digit_ratio"` // Share of the query and body bytes, like the next two
+	LetterRatio    float64  `json:"letter_ratio"`
+	SymbolRatio    float64  `json:"symbol_ratio"`
+	ControlRatio   float64  `json:"control_ratio"`   // Control characters and non-ASCII bytes
+	PercentEncoded int      `json:"percent_encoded"` // Percent-encoded bytes in the path and query
+	Score          int      `json:"score"`           // Anomaly score so far
+	MatchedRules   []string `json:"matched_rules"`
+}
+
+// NewRequestFeatures summarizes the request of an inspection.
+func NewRequestFeatures(in *Inspection) RequestFeatures {
+	r := in.Request
+	f := RequestFeatures{
+		Phase:          in.Phase,
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		PathLength:     len(r.URL.Path),
+		PathDepth:      strings.Count(strings.Trim(r.URL.Path, "/"), "/") + 1,
+		QueryLength:    len(r.URL.RawQuery),
+		HeaderCount:    len(r.Header),
+		UserAgent:      r.UserAgent(),
+		ContentType:    r.Header.Get("Content-Type"),
+		BodyLength:     len(in.Body),
+		PercentEncoded: strings.Count(r.URL.EscapedPath(), "%") + strings.Count(r.URL.RawQuery, "%"),
+		Score:          in.Score,
+		MatchedRules:   in.MatchedRules,
+	}
+	if f.Path == "" || f.Path == "/" {
+		f.PathDepth = 0
+	}
+	if query, err := url.ParseQuery(r.URL.RawQuery); err == nil {
+		f.QueryParams = len(query)
+	}
+
+	content := r.URL.RawQuery + in.Body
+	if len(content) == 0 {
+		return f
+	}
+	var digits, letters, symbols, controls int
+	for i := 0; i < len(content); i++ {
+		b := content[i]
+		switch {
+		case isDigitByte(b):
+			digits++
+		case isAlphaByte(b):
+			letters++
+		case b == ' ' || b == '\t':
+		case isPrintableByte(b):
+			symbols++
+		default:
+			controls++
+		}
+	}
+	total := float64(len(content))
+	f.Entropy = shannonEntropy(content)
+	f.DigitRatio = float64(digits) / total
+	f.LetterRatio = float64(letters) / total
+	f.SymbolRatio = float64(symbols) / total
+	f.ControlRatio = float64(controls) / total
+	return f
+}
+
+// Vector returns the numeric features, in the order of MLFeatureNames.
+func (f RequestFeatures) Vector() []float64 {
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return []float64{
+		float64(f.Phase), boolean(f.Method == http.MethodGet), boolean(f.Method == http.MethodPost),
+		float64(f.PathLength), float64(f.PathDepth), float64(f.QueryLength), float64(f.QueryParams),
+		float64(f.HeaderCount), float64(f.BodyLength), f.Entropy, f.DigitRatio, f.LetterRatio, f.SymbolRatio,
+		f.ControlRatio, float64(f.PercentEncoded), float64(f.Score), float64(len(f.MatchedRules)),
+	}
+}
+
+// mlScoreRequest is the JSON body posted to the scoring service.
+type mlScoreRequest struct {
+	Features RequestFeatures `json:"features"`
+	Vector   []float64       `json:"vector"`
+}
+
+// mlScoreResponse is the JSON response of the scoring service.
+type mlScoreResponse struct {
+	Score  *float64 `json:"score"` // Risk score of the request
+	Reason string   `json:"reason,omitempty"`
+}
+
+// mlScoreInspector posts the features of requests to an HTTP scoring service and adds the
+// risk score it returns, multiplied by scale and capped at maxScore, to the anomaly score.
+type mlScoreInspector struct {
+	url      string
+	token    string
+	scale    float64
+	maxScore int
+	client   *http.Client
+}
+
+func init() {
+	RegisterInspector(mlScoreInspectorName, newMLScoreInspector)
+}
+
+// newMLScoreInspector creates the ml_score inspector from its options: url, required, and
+// token, scale and max_score.
+func newMLScoreInspector(options map[string]string) (Inspector, error) {
+	in := &mlScoreInspector{url: options["url"], token: options["token"], scale: 1, client: &http.Client{}}
+	if in.url == "" {
+		return nil, fmt.Errorf("ml_score requires the url option")
+	}
+	if u, err := url.Parse(in.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid ml_score url: %s", in.url)
+	}
+	if scale, ok := options["scale"]; ok {
+		var err error
+		if in.scale, err = strconv.ParseFloat(scale, 64); err != nil || in.scale <= 0 {
+			return nil, fmt.Errorf("invalid ml_score scale: %s, must be a positive number", scale)
+		}
+	}
+	if maxScore, ok := options["max_score"]; ok {
+		var err error
+		if in.maxScore, err = strconv.Atoi(maxScore); err != nil || in.maxScore <= 0 {
+			return nil, fmt.Errorf("invalid ml_score max_score: %s, must be a positive integer", maxScore)
+		}
+	}
+	return in, nil
+}
+
+// Inspect scores a request with the service, within the inspector timeout.
+func (s *mlScoreInspector) Inspect(ctx context.Context, in *Inspection) (InspectionResult, error) {
+	features := NewRequestFeatures(in)
+	payload, err := json.Marshal(mlScoreRequest{Features: features, Vector: features.Vector()})
+	if err != nil {
+		return InspectionResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return InspectionResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return InspectionResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return InspectionResult{}, fmt.Errorf("scoring service returned %s", resp.Status)
+	}
+	var scored mlScoreResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMLScoreResponseBytes)).Decode(&scored); err != nil {
+		return InspectionResult{}, fmt.Errorf("invalid scoring service response: %w", err)
+	}
+	if scored.Score == nil {
+		return InspectionResult{}, fmt.Errorf("scoring service response has no score")
+	}
+
+	score := max(int(math.Round(*scored.Score*s.scale)), 0)
+	if s.maxScore > 0 {
+		score = min(score, s.maxScore)
+	}
+	reason := "ml risk score " + strconv.FormatFloat(*scored.Score, 'f', -1, 64)
+	if scored.Reason != "" {
+		reason += ": " + scored.Reason
+	}
+	return InspectionResult{Score: score, Reason: reason}, nil
+}
@@ -0,0 +1,95 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewRequestFeatures(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/items?id=1%27&x=a", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	f := NewRequestFeatures(&Inspection{Phase: 2, Request: r, Body: "ab\x00", Score: 4, MatchedRules: []string{"sqli"}})
+	assert.Equal(t, 3, f.PathDepth)
+	assert.Equal(t, 2, f.QueryParams)
+	assert.Equal(t, 1, f.PercentEncoded)
+	assert.Equal(t, "curl/8.0", f.UserAgent)
+	assert.Equal(t, 3, f.BodyLength)
+	assert.InDelta(t, 3.0/14, f.DigitRatio, 1e-9) // "id=1%27&x=aab\x00"
+	assert.InDelta(t, 1.0/14, f.ControlRatio, 1e-9)
+	assert.Greater(t, f.Entropy, 3.0)
+
+	vector := f.Vector()
+	require.Len(t, vector, len(MLFeatureNames))
+	assert.Equal(t, []float64{2, 0, 1}, vector[:3])
+	assert.Equal(t, 1.0, vector[len(vector)-1])
+
+	assert.Zero(t, NewRequestFeatures(&Inspection{Request: httptest.NewRequest("GET", "/", nil)}).PathDepth)
+}
+
+func TestNewMLScoreInspector(t *testing.T) {
+	for _, options := range []map[string]string{
+		{},
+		{"url": "ftp://scorer"},
+		{"url": "http://scorer", "scale": "-1"},
+		{"url": "http://scorer", "max_score": "lots"},
+	} {
+		_, err := newMLScoreInspector(options)
+		assert.Error(t, err, "%v", options)
+	}
+}
+
+func TestMLScoreInspector(t *testing.T) {
+	var received mlScoreRequest
+	response := `{"score": 0.87, "reason": "sqli-like"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	config := &InspectorConfig{Name: mlScoreInspectorName, Phases: []int{2}, Options: map[string]string{
+		"url": server.URL, "token": "secret", "scale": "10", "max_score": "8",
+	}}
+	require.NoError(t, config.provision())
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 20, Inspectors: []*InspectorConfig{config}, requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+
+	r := httptest.NewRequest("GET", "/search?q=1", nil)
+	state := &WAFState{}
+	assert.False(t, m.runInspectors(httptest.NewRecorder(), r, 2, state))
+	assert.Equal(t, 8, state.TotalScore, "0.87 scaled to 9, capped at 8")
+	assert.Equal(t, "/search", received.Features.Path)
+	assert.Len(t, received.Vector, len(MLFeatureNames))
+
+	for _, invalid := range []string{`{"reason": "no score"}`, `not json`} {
+		response = invalid
+		_, err := config.inspector.Inspect(context.Background(), &Inspection{Request: r})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMLScoreInspector_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	config := &InspectorConfig{Name: mlScoreInspectorName, Phases: []int{2}, Timeout: 20 * time.Millisecond, Options: map[string]string{"url": server.URL}}
+	require.NoError(t, config.provision())
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 5, Inspectors: []*InspectorConfig{config}, requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+
+	start := time.Now()
+	state := &WAFState{}
+	assert.False(t, m.runInspectors(httptest.NewRecorder(), httptest.NewRequest("GET", "/", strings.NewReader("")), 2, state), "failures are skipped")
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+	assert.Zero(t, state.TotalScore)
+}
@@ -0,0 +1,390 @@
+package caddywaf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Supported notifier types
+const (
+	NotifierSlack    = "slack"
+	NotifierDiscord  = "discord"
+	NotifierTelegram = "telegram"
+)
+
+// Event kinds emitted to notifiers and other event consumers
+const (
+	EventKindBlock      = "block"
+	EventKindBan        = "ban"
+	EventKindRuleCanary = "rule_canary" // A rule failed its canary
+)
+
+var telegramAPIURL = "https://api.telegram.org"
+
+const defaultNotifyTemplate = `[caddy-waf] {{.Kind}}: {{.Reason}} (rule {{.RuleID}}, severity {{.Severity}}) from {{.ClientIP}} on {{.Host}}{{.Path}} - {{.BlockRate}} blocks in the last minute`
+
+// severityLevels maps rule severities to comparable levels.
+var severityLevels = map[string]int{
+	"LOW":      1,
+	"MEDIUM":   2,
+	"HIGH":     3,
+	"CRITICAL": 4,
+}
+
+// builtinRuleSeverity assigns a severity to blocks that don't originate from a rule file.
+var builtinRuleSeverity = map[string]string{
+	"ip_blacklist_rule":        "HIGH",
+	"dns_blacklist_rule":       "HIGH",
+	"path_blacklist_rule":      "HIGH",
+	"param_schema_rule":        "MEDIUM",
+	"openapi_rule":             "MEDIUM",
+	"json_schema_rule":         "MEDIUM",
+	"credential_stuffing_rule": "HIGH",
+	"geo_velocity_rule":        "MEDIUM",
+	"slow_body_rule":           "MEDIUM",
+	"concurrency_limit_rule":   "MEDIUM",
+	"replay_rule":              "MEDIUM",
+	"quota_rule":               "LOW",
+	"cost_limit_rule":          "MEDIUM",
+	"bot_score_rule":           "MEDIUM",
+	"reputation_rule":          "HIGH",
+	"inspector_rule":           "HIGH",
+	"icap_rule":                "HIGH",
+	"malware_rule":             "HIGH",
+	"yara_rule":                "HIGH",
+	"cdn_origin_rule":          "MEDIUM",
+	"lockdown_rule":            "MEDIUM",
+	"country_block_rule":       "MEDIUM",
+	"rate_limit_rule":          "MEDIUM",
+	"ban_rule":                 "HIGH",
+	"inspection_pool_rule":     "MEDIUM",
+	"inspection_budget_rule":   "MEDIUM",
+}
+
+// BlockEvent describes a single blocked request.
+type BlockEvent struct {
+	Kind       string    `json:"kind"`
+	Timestamp  time.Time `json:"timestamp"`
+	LogID      string    `json:"log_id"`
+	ClientIP   string    `json:"client_ip"`
+	Country    string    `json:"country,omitempty"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	UserAgent  string    `json:"user_agent"`
+	RuleID     string    `json:"rule_id"`
+	Reason     string    `json:"reason"`
+	Severity   string    `json:"severity"`
+	Score      int       `json:"score"`
+	StatusCode int       `json:"status_code"`
+}
+
+// NotifierConfig configures a chat notification target.
+type NotifierConfig struct {
+	Type        string        `json:"type"`
+	WebhookURL  string        `json:"webhook_url,omitempty"`
+	BotToken    string        `json:"bot_token,omitempty"`
+	ChatID      string        `json:"chat_id,omitempty"`
+	Template    string        `json:"template,omitempty"`
+	MinSeverity string        `json:"min_severity,omitempty"` // LOW, MEDIUM, HIGH or CRITICAL
+	Events      []string      `json:"events,omitempty"`       // Event kinds to notify on, all if empty
+	BlockRate   int           `json:"block_rate,omitempty"`   // Only notify when blocks per minute exceed this value
+	Cooldown    time.Duration `json:"cooldown,omitempty"`     // Minimum time between two notifications
+	Timeout     time.Duration `json:"timeout,omitempty"`
+}
+
+// notifier holds the runtime state of a single configured notifier.
+type notifier struct {
+	config   NotifierConfig
+	tmpl     *template.Template
+	lastSent time.Time
+}
+
+// NotificationManager dispatches block events to the configured notifiers.
+type NotificationManager struct {
+	logger    *zap.Logger
+	notifiers []*notifier
+	client    *http.Client
+	events    chan BlockEvent
+	done      chan struct{}
+
+	mu          sync.Mutex
+	rateBuckets [60]int64 // Blocks per second over the last minute
+	rateSeconds [60]int64
+}
+
+// notifyMessage is the payload handed to notifier templates.
+type notifyMessage struct {
+	BlockEvent
+	BlockRate int64
+}
+
+// NewNotificationManager creates a NotificationManager for the given notifier configurations.
+func NewNotificationManager(logger *zap.Logger, configs []NotifierConfig) (*NotificationManager, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	nm := &NotificationManager{
+		logger: logger,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan BlockEvent, 256),
+		done:   make(chan struct{}),
+	}
+	for i, cfg := range configs {
+		if err := validateNotifierConfig(&cfg); err != nil {
+			return nil, fmt.Errorf("notifier %d: %w", i, err)
+		}
+		text := cfg.Template
+		if text == "" {
+			text = defaultNotifyTemplate
+		}
+		tmpl, err := template.New(cfg.Type).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: invalid template: %w", i, err)
+		}
+		nm.notifiers = append(nm.notifiers, &notifier{config: cfg, tmpl: tmpl})
+	}
+	return nm, nil
+}
+
+// validateNotifierConfig checks that a notifier has the settings required by its type.
+func validateNotifierConfig(cfg *NotifierConfig) error {
+	cfg.Type = strings.ToLower(cfg.Type)
+	cfg.MinSeverity = strings.ToUpper(cfg.MinSeverity)
+	switch cfg.Type {
+	case NotifierSlack, NotifierDiscord:
+		if cfg.WebhookURL == "" {
+			return fmt.Errorf("%s notifier requires a webhook_url", cfg.Type)
+		}
+	case NotifierTelegram:
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return fmt.Errorf("telegram notifier requires bot_token and chat_id")
+		}
+	default:
+		return fmt.Errorf("unsupported notifier type '%s'", cfg.Type)
+	}
+	if _, ok := severityLevels[cfg.MinSeverity]; cfg.MinSeverity != "" && !ok {
+		return fmt.Errorf("invalid min_severity '%s'", cfg.MinSeverity)
+	}
+	return nil
+}
+
+// Start launches the background dispatch worker.
+func (nm *NotificationManager) Start() {
+	go func() {
+		for ev := range nm.events {
+			nm.dispatch(ev)
+		}
+		close(nm.done)
+	}()
+}
+
+// Stop stops the dispatch worker after pending events are processed.
+func (nm *NotificationManager) Stop() {
+	close(nm.events)
+	<-nm.done
+}
+
+// Notify records an event and queues it for dispatch without blocking the request.
+func (nm *NotificationManager) Notify(ev BlockEvent) {
+	nm.recordBlock(ev.Timestamp)
+	select {
+	case nm.events <- ev:
+	default:
+		nm.logger.Warn("Notification queue full, dropping event", zap.String("rule_id", ev.RuleID))
+	}
+}
+
+// Alert queues an event that is not a block, such as a failed rule canary, for dispatch.
+func (nm *NotificationManager) Alert(ev BlockEvent) {
+	select {
+	case nm.events <- ev:
+	default:
+		nm.logger.Warn("Notification queue full, dropping event", zap.String("rule_id", ev.RuleID))
+	}
+}
+
+// recordBlock adds a block to the per-second rate buckets.
+func (nm *NotificationManager) recordBlock(ts time.Time) {
+	sec := ts.Unix()
+	idx := sec % 60
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.rateSeconds[idx] != sec {
+		nm.rateSeconds[idx] = sec
+		nm.rateBuckets[idx] = 0
+	}
+	nm.rateBuckets[idx]++
+}
+
+// blockRate returns the number of blocks recorded during the minute before now.
+func (nm *NotificationManager) blockRate(now time.Time) int64 {
+	cutoff := now.Unix() - 60
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	var total int64
+	for i, sec := range nm.rateSeconds {
+		if sec > cutoff {
+			total += nm.rateBuckets[i]
+		}
+	}
+	return total
+}
+
+// dispatch sends an event to every notifier whose thresholds it meets.
+func (nm *NotificationManager) dispatch(ev BlockEvent) {
+	rate := nm.blockRate(ev.Timestamp)
+	for _, n := range nm.notifiers {
+		if !n.accepts(ev, rate) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := n.tmpl.Execute(&buf, notifyMessage{BlockEvent: ev, BlockRate: rate}); err != nil {
+			nm.logger.Error("Failed to render notification template", zap.String("type", n.config.Type), zap.Error(err))
+			continue
+		}
+		if err := nm.send(n.config, buf.String()); err != nil {
+			nm.logger.Error("Failed to send notification", zap.String("type", n.config.Type), zap.Error(err))
+			continue
+		}
+		n.lastSent = ev.Timestamp
+	}
+}
+
+// accepts reports whether the notifier's severity, event, rate and cooldown thresholds allow the event.
+func (n *notifier) accepts(ev BlockEvent, rate int64) bool {
+	if len(n.config.Events) > 0 {
+		found := false
+		for _, kind := range n.config.Events {
+			if strings.EqualFold(kind, ev.Kind) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if n.config.MinSeverity != "" && severityLevels[strings.ToUpper(ev.Severity)] < severityLevels[n.config.MinSeverity] {
+		return false
+	}
+	if n.config.BlockRate > 0 && rate <= int64(n.config.BlockRate) {
+		return false
+	}
+	if n.config.Cooldown > 0 && !n.lastSent.IsZero() && ev.Timestamp.Sub(n.lastSent) < n.config.Cooldown {
+		return false
+	}
+	return true
+}
+
+// send delivers a rendered message to the notifier's service.
+func (nm *NotificationManager) send(cfg NotifierConfig, text string) error {
+	var url string
+	var payload map[string]string
+	switch cfg.Type {
+	case NotifierSlack:
+		url, payload = cfg.WebhookURL, map[string]string{"text": text}
+	case NotifierDiscord:
+		url, payload = cfg.WebhookURL, map[string]string{"content": text}
+	case NotifierTelegram:
+		url = fmt.Sprintf("%s/bot%s/sendMessage", telegramAPIURL, cfg.BotToken)
+		payload = map[string]string{"chat_id": cfg.ChatID, "text": text}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification payload: %w", err)
+	}
+
+	client := nm.client
+	if cfg.Timeout > 0 {
+		client = &http.Client{Timeout: cfg.Timeout}
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification endpoint returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// ruleSeverity returns the severity of the rule with the given ID.
+func (m *Middleware) ruleSeverity(ruleID string) string {
+	if severity, ok := builtinRuleSeverity[ruleID]; ok {
+		return severity
+	}
+	for _, rules := range m.Rules {
+		for _, rule := range rules {
+			if rule.ID == ruleID {
+				return strings.ToUpper(rule.Severity)
+			}
+		}
+	}
+	return ""
+}
+
+// newBlockEvent builds a BlockEvent from a blocked request.
+func (m *Middleware) newBlockEvent(r *http.Request, state *WAFState, statusCode int, reason, ruleID string) BlockEvent {
+	return BlockEvent{
+		Kind:       EventKindBlock,
+		Timestamp:  time.Now(),
+		LogID:      getLogID(r.Context()),
+		ClientIP:   extractIP(r.RemoteAddr),
+		Country:    m.lookupCountry(state, r.RemoteAddr),
+		Host:       r.Host,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		UserAgent:  r.UserAgent(),
+		RuleID:     ruleID,
+		Reason:     reason,
+		Severity:   m.ruleSeverity(ruleID),
+		Score:      state.TotalScore,
+		StatusCode: statusCode,
+	}
+}
+
+// hasEventConsumers reports whether any component consumes block events.
+func (m *Middleware) hasEventConsumers() bool {
+	return m.notificationManager != nil || m.emailAlerter != nil || m.siemWriter != nil || m.fail2banWriter != nil || m.offenderTracker != nil || m.eventStore != nil
+}
+
+// emitBlockEvent builds a block event for a blocked request and publishes it.
+func (m *Middleware) emitBlockEvent(r *http.Request, state *WAFState, statusCode int, reason, ruleID string) {
+	if !m.hasEventConsumers() {
+		return
+	}
+	m.publishEvent(m.newBlockEvent(r, state, statusCode, reason, ruleID))
+}
+
+// publishEvent hands an event to the configured event consumers.
+func (m *Middleware) publishEvent(ev BlockEvent) {
+	if m.notificationManager != nil {
+		m.notificationManager.Notify(ev)
+	}
+	if m.emailAlerter != nil && ev.Kind != EventKindBan {
+		m.emailAlerter.Record(ev)
+	}
+	if m.siemWriter != nil {
+		m.siemWriter.Write(ev)
+	}
+	if m.fail2banWriter != nil {
+		m.fail2banWriter.Write(ev)
+	}
+	if m.offenderTracker != nil && ev.Kind != EventKindBan {
+		m.offenderTracker.Record(ev)
+	}
+	if m.eventStore != nil {
+		m.eventStore.Record(ev)
+	}
+}
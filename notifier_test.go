@@ -0,0 +1,86 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestNewNotificationManager_Validation(t *testing.T) {
+	_, err := NewNotificationManager(zap.NewNop(), []NotifierConfig{{Type: "slack"}})
+	assert.Error(t, err, "slack notifier without webhook_url should be rejected")
+
+	_, err = NewNotificationManager(zap.NewNop(), []NotifierConfig{{Type: "telegram", BotToken: "token"}})
+	assert.Error(t, err, "telegram notifier without chat_id should be rejected")
+
+	_, err = NewNotificationManager(zap.NewNop(), []NotifierConfig{{Type: "pager"}})
+	assert.Error(t, err, "unknown notifier type should be rejected")
+
+	_, err = NewNotificationManager(zap.NewNop(), []NotifierConfig{{Type: "discord", WebhookURL: "http://localhost", Template: "{{.Broken"}})
+	assert.Error(t, err, "invalid template should be rejected")
+}
+
+func TestNotifier_Accepts(t *testing.T) {
+	now := time.Now()
+	ev := BlockEvent{Kind: EventKindBlock, Severity: "MEDIUM", Timestamp: now}
+
+	n := &notifier{config: NotifierConfig{MinSeverity: "HIGH"}}
+	assert.False(t, n.accepts(ev, 0), "MEDIUM event should not pass a HIGH threshold")
+
+	n = &notifier{config: NotifierConfig{MinSeverity: "LOW"}}
+	assert.True(t, n.accepts(ev, 0))
+
+	n = &notifier{config: NotifierConfig{BlockRate: 10}}
+	assert.False(t, n.accepts(ev, 10))
+	assert.True(t, n.accepts(ev, 11))
+
+	n = &notifier{config: NotifierConfig{Events: []string{"ban"}}}
+	assert.False(t, n.accepts(ev, 0))
+
+	n = &notifier{config: NotifierConfig{Cooldown: time.Minute}, lastSent: now.Add(-30 * time.Second)}
+	assert.False(t, n.accepts(ev, 0))
+}
+
+func TestNotificationManager_Dispatch(t *testing.T) {
+	received := make(chan map[string]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+	}))
+	defer server.Close()
+
+	nm, err := NewNotificationManager(zap.NewNop(), []NotifierConfig{{
+		Type:       NotifierSlack,
+		WebhookURL: server.URL,
+		Template:   "{{.RuleID}} from {{.ClientIP}}",
+	}})
+	assert.NoError(t, err)
+	nm.Start()
+
+	nm.Notify(BlockEvent{Kind: EventKindBlock, RuleID: "sqli", ClientIP: "10.0.0.1", Timestamp: time.Now()})
+	nm.Stop()
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, "sqli from 10.0.0.1", payload["text"])
+	default:
+		t.Fatal("expected the slack webhook to receive a notification")
+	}
+}
+
+func TestNotificationManager_BlockRate(t *testing.T) {
+	nm, err := NewNotificationManager(zap.NewNop(), nil)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	nm.recordBlock(now.Add(-90 * time.Second))
+	nm.recordBlock(now.Add(-10 * time.Second))
+	nm.recordBlock(now)
+	assert.Equal(t, int64(2), nm.blockRate(now))
+}
@@ -0,0 +1,103 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	for input, expected := range map[string]string{
+		"https://evil.com/login":             "evil.com",
+		"HTTP://Evil.COM.":                   "evil.com",
+		"//evil.com":                         "evil.com",
+		`/\evil.com`:                         "evil.com",
+		`\\evil.com`:                         "evil.com",
+		" \t//evil.com":                      "evil.com",
+		"/\t/evil.com":                       "evil.com",
+		"https:evil.com":                     "evil.com",
+		"https:/evil.com":                    "evil.com",
+		"https://example.com@evil.com/":      "evil.com",
+		"https://evil.com:8443/?next=/home":  "evil.com",
+		"javascript:alert(document.domain)":  "",
+		"https://[2001:db8::1]/":             "2001:db8::1",
+		"https://example.com/?u=https://x.y": "example.com",
+	} {
+		host, ok := redirectTarget(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, host, input)
+	}
+	for _, input := range []string{"/dashboard", "dashboard?tab=1", "mailto:a@example.com", "ftp://files.example.com/", "https:", ""} {
+		_, ok := redirectTarget(input)
+		assert.False(t, ok, input)
+	}
+}
+
+func TestIsOpenRedirect(t *testing.T) {
+	allowed := []string{"example.com", "*.example.org"}
+	assert.False(t, isOpenRedirect("https://example.com/home", allowed))
+	assert.False(t, isOpenRedirect("https://login.example.org/", allowed))
+	assert.False(t, isOpenRedirect("/home", allowed))
+	assert.True(t, isOpenRedirect("https://example.org/", allowed), "*. only allows subdomains")
+	assert.True(t, isOpenRedirect("https://www.example.com/", allowed))
+	assert.True(t, isOpenRedirect("https://evilexample.org/", allowed))
+	assert.True(t, isOpenRedirect("https://example.com.evil.com/", allowed))
+	assert.True(t, isOpenRedirect("javascript:alert(1)", allowed))
+}
+
+func TestOpenRedirectConfig_Provision(t *testing.T) {
+	config := &OpenRedirectConfig{AllowedHosts: []string{"Example.COM"}}
+	require.NoError(t, config.provision())
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+	assert.Equal(t, []string{"example.com"}, config.AllowedHosts)
+
+	assert.Error(t, (&OpenRedirectConfig{Action: "drop"}).provision())
+	assert.Error(t, (&OpenRedirectConfig{AllowedHosts: []string{"*."}}).provision())
+	assert.Error(t, (&OpenRedirectConfig{AllowedHosts: []string{"https://example.com"}}).provision())
+}
+
+func TestCheckOpenRedirect(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	assert.False(t, m.checkOpenRedirect(httptest.NewRecorder(), testRequest("GET", "/?next=//evil.com", "", ""), &WAFState{}))
+
+	m.OpenRedirect = &OpenRedirectConfig{AllowedHosts: []string{"*.example.com"}, Action: detectionActionScore, Score: 4}
+	require.NoError(t, m.OpenRedirect.provision())
+	state := &WAFState{}
+	r := testRequest("POST", "/login?next=https://app.example.com/&back=http://shop.test/cart&to=%2F%5Cevil.com",
+		"application/x-www-form-urlencoded", "return=https://evil.com/")
+	r.Host = "shop.test:8080"
+	assert.False(t, m.checkOpenRedirect(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 8, state.TotalScore, "to and return")
+	assert.Equal(t, []string{openRedirectRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.openRedirectHits.Load())
+
+	m.OpenRedirect = &OpenRedirectConfig{Params: []string{"next"}}
+	require.NoError(t, m.OpenRedirect.provision())
+	assert.False(t, m.checkOpenRedirect(httptest.NewRecorder(), testRequest("GET", "/?website=https://evil.com/", "", ""), &WAFState{}), "only next is inspected")
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkOpenRedirect(w, testRequest("GET", "/?next=https://evil.com/", "", ""), &WAFState{}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestConditionHolds_OpenRedirect(t *testing.T) {
+	m := conditionMiddleware()
+	program, err := compileRuleCondition(`open_redirect(request.args["next"], ["example.com", "*.Example.com"])`)
+	assert.NoError(t, err)
+	rule := &Rule{ID: "c1", Phase: 1, condition: program}
+
+	req := httptest.NewRequest("GET", "/?next=https://evil.com/", nil)
+	assert.True(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+	req = httptest.NewRequest("GET", "/?next=https://www.example.com/", nil)
+	assert.False(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+}
@@ -0,0 +1,737 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	openAPIRuleID         = "openapi_rule"
+	maxOpenAPISchemaDepth = 64 // Guards against self-referencing schemas
+)
+
+var (
+	openAPIUUIDPattern  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	openAPIEmailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// OpenAPIConfig validates requests against an OpenAPI 3 specification.
+type OpenAPIConfig struct {
+	Spec     string `json:"spec"`                // Path to the JSON or YAML specification
+	BasePath string `json:"base_path,omitempty"` // Prefix stripped from request paths before matching the spec's paths
+	Action   string `json:"action,omitempty"`    // block (default) or score
+	Score    int    `json:"score,omitempty"`     // Score added per violation with the score action, default 5
+
+	spec *openAPISpec
+}
+
+// openAPISpec is the part of an OpenAPI 3 document used to validate requests.
+type openAPISpec struct {
+	OpenAPI    string                      `json:"openapi"`
+	Paths      map[string]*openAPIPathItem `json:"paths"`
+	Components struct {
+		Schemas       map[string]*jsonSchema         `json:"schemas"`
+		Parameters    map[string]*openAPIParameter   `json:"parameters"`
+		RequestBodies map[string]*openAPIRequestBody `json:"requestBodies"`
+	} `json:"components"`
+
+	routes  []*openAPIRoute
+	schemas schemaRefs
+}
+
+type openAPIPathItem struct {
+	Parameters []*openAPIParameter `json:"parameters"`
+	Get        *openAPIOperation   `json:"get"`
+	Put        *openAPIOperation   `json:"put"`
+	Post       *openAPIOperation   `json:"post"`
+	Delete     *openAPIOperation   `json:"delete"`
+	Options    *openAPIOperation   `json:"options"`
+	Head       *openAPIOperation   `json:"head"`
+	Patch      *openAPIOperation   `json:"patch"`
+	Trace      *openAPIOperation   `json:"trace"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *openAPIRequestBody `json:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref      string      `json:"$ref"`
+	Name     string      `json:"name"`
+	In       string      `json:"in"` // path, query, header or cookie
+	Required bool        `json:"required"`
+	Schema   *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string `json:"$ref"`
+	Required bool   `json:"required"`
+	Content  map[string]struct {
+		Schema *jsonSchema `json:"schema"`
+	} `json:"content"`
+}
+
+// openAPIRoute is a path template of the spec with its operations by method.
+type openAPIRoute struct {
+	template   string
+	segments   []string // Literal segments, or "" for a {parameter}
+	names      []string // Parameter names, by segment
+	literals   int
+	operations map[string]*openAPIOperation
+	parameters []*openAPIParameter // Path item parameters, shared by its operations
+}
+
+// jsonSchema is the subset of the OpenAPI schema object and JSON Schema used for validation.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 schemaTypes            `json:"type"`
+	Format               string                 `json:"format"`
+	Nullable             bool                   `json:"nullable"`
+	Enum                 []any                  `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+
+	pattern      *regexp.Regexp
+	additional   *jsonSchema // Schema of additional properties, if one is given
+	noAdditional bool
+}
+
+// schemaTypes is a schema type, a single name in OpenAPI 3.0 and possibly a list in 3.1.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("schema type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// provision loads the specification.
+func (c *OpenAPIConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid openapi action: %s, must be block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	spec, err := loadOpenAPISpec(c.Spec)
+	if err != nil {
+		return err
+	}
+	c.spec = spec
+	return nil
+}
+
+// loadOpenAPISpec reads and compiles an OpenAPI 3 specification in JSON or YAML.
+func loadOpenAPISpec(path string) (*openAPISpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI spec: %w", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("failed to parse OpenAPI spec %s: %w", path, err)
+		}
+		if data, err = json.Marshal(jsonCompatible(document)); err != nil {
+			return nil, fmt.Errorf("failed to parse OpenAPI spec %s: %w", path, err)
+		}
+	}
+	spec := &openAPISpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI spec %s: %w", path, err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q in %s, must be 3.x", spec.OpenAPI, path)
+	}
+	if err := spec.compile(); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// jsonCompatible converts YAML mappings with non-string keys, such as response codes,
+// to mappings JSON can encode.
+func jsonCompatible(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = jsonCompatible(value)
+		}
+		return v
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, value := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return converted
+	case []any:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	}
+	return v
+}
+
+// compile resolves references, compiles patterns and builds the routes of the spec.
+func (s *openAPISpec) compile() error {
+	s.schemas = make(schemaRefs, len(s.Components.Schemas))
+	for name, schema := range s.Components.Schemas {
+		s.schemas["#/components/schemas/"+name] = schema
+	}
+	compiled := make(map[*jsonSchema]bool)
+	for name, schema := range s.Components.Schemas {
+		if err := s.schemas.compile(schema, compiled); err != nil {
+			return fmt.Errorf("schema %s: %w", name, err)
+		}
+	}
+
+	for template, item := range s.Paths {
+		if item == nil {
+			continue
+		}
+		route := &openAPIRoute{template: template, operations: make(map[string]*openAPIOperation)}
+		for _, segment := range strings.Split(strings.Trim(template, "/"), "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				route.segments = append(route.segments, "")
+				route.names = append(route.names, segment[1:len(segment)-1])
+				continue
+			}
+			route.segments = append(route.segments, segment)
+			route.names = append(route.names, "")
+			route.literals++
+		}
+		params, err := s.resolveParameters(item.Parameters, compiled)
+		if err != nil {
+			return fmt.Errorf("path %s: %w", template, err)
+		}
+		route.parameters = params
+		for method, operation := range map[string]*openAPIOperation{
+			http.MethodGet: item.Get, http.MethodPut: item.Put, http.MethodPost: item.Post,
+			http.MethodDelete: item.Delete, http.MethodOptions: item.Options, http.MethodHead: item.Head,
+			http.MethodPatch: item.Patch, http.MethodTrace: item.Trace,
+		} {
+			if operation == nil {
+				continue
+			}
+			if operation.Parameters, err = s.resolveParameters(operation.Parameters, compiled); err != nil {
+				return fmt.Errorf("%s %s: %w", method, template, err)
+			}
+			if operation.RequestBody, err = s.resolveRequestBody(operation.RequestBody, compiled); err != nil {
+				return fmt.Errorf("%s %s: %w", method, template, err)
+			}
+			route.operations[method] = operation
+		}
+		s.routes = append(s.routes, route)
+	}
+
+	// Concrete paths take precedence over templated ones, as the OpenAPI specification requires
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		if s.routes[i].literals != s.routes[j].literals {
+			return s.routes[i].literals > s.routes[j].literals
+		}
+		return s.routes[i].template < s.routes[j].template
+	})
+	return nil
+}
+
+// resolveRef returns the component a local reference points to.
+func resolveRef[T any](ref, kind string, components map[string]*T) (*T, error) {
+	name, ok := strings.CutPrefix(ref, "#/components/"+kind+"/")
+	if !ok {
+		return nil, fmt.Errorf("unsupported reference %s", ref)
+	}
+	component, ok := components[name]
+	if !ok || component == nil {
+		return nil, fmt.Errorf("unresolved reference %s", ref)
+	}
+	return component, nil
+}
+
+func (s *openAPISpec) resolveParameters(params []*openAPIParameter, compiled map[*jsonSchema]bool) ([]*openAPIParameter, error) {
+	resolved := make([]*openAPIParameter, 0, len(params))
+	for _, param := range params {
+		for depth := 0; param != nil && param.Ref != ""; depth++ {
+			if depth > maxOpenAPISchemaDepth {
+				return nil, fmt.Errorf("reference cycle at %s", param.Ref)
+			}
+			var err error
+			if param, err = resolveRef(param.Ref, "parameters", s.Components.Parameters); err != nil {
+				return nil, err
+			}
+		}
+		if param == nil {
+			continue
+		}
+		if param.Name == "" || !slices.Contains([]string{"path", "query", "header", "cookie"}, param.In) {
+			return nil, fmt.Errorf("invalid parameter %q in %q", param.Name, param.In)
+		}
+		if err := s.schemas.compile(param.Schema, compiled); err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", param.Name, err)
+		}
+		resolved = append(resolved, param)
+	}
+	return resolved, nil
+}
+
+func (s *openAPISpec) resolveRequestBody(body *openAPIRequestBody, compiled map[*jsonSchema]bool) (*openAPIRequestBody, error) {
+	for depth := 0; body != nil && body.Ref != ""; depth++ {
+		if depth > maxOpenAPISchemaDepth {
+			return nil, fmt.Errorf("reference cycle at %s", body.Ref)
+		}
+		var err error
+		if body, err = resolveRef(body.Ref, "requestBodies", s.Components.RequestBodies); err != nil {
+			return nil, err
+		}
+	}
+	if body == nil {
+		return nil, nil
+	}
+	for mediaType, content := range body.Content {
+		if err := s.schemas.compile(content.Schema, compiled); err != nil {
+			return nil, fmt.Errorf("request body %s: %w", mediaType, err)
+		}
+	}
+	return body, nil
+}
+
+// schemaRefs maps the local references of a document, such as "#/components/schemas/User"
+// or "#/$defs/User", to the schemas they point to.
+type schemaRefs map[string]*jsonSchema
+
+// resolve returns the schema a reference points to.
+func (refs schemaRefs) resolve(ref string) (*jsonSchema, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported reference %s", ref)
+	}
+	schema, ok := refs[ref]
+	if !ok || schema == nil {
+		return nil, fmt.Errorf("unresolved reference %s", ref)
+	}
+	return schema, nil
+}
+
+// compile checks the references and compiles the patterns of a schema and its subschemas.
+func (refs schemaRefs) compile(schema *jsonSchema, compiled map[*jsonSchema]bool) error {
+	if schema == nil || compiled[schema] {
+		return nil
+	}
+	compiled[schema] = true
+	if schema.Ref != "" {
+		if _, err := refs.resolve(schema.Ref); err != nil {
+			return err
+		}
+	}
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", schema.Pattern, err)
+		}
+		schema.pattern = pattern
+	}
+	if len(schema.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowed); err == nil {
+			schema.noAdditional = !allowed
+		} else {
+			schema.additional = &jsonSchema{}
+			if err := json.Unmarshal(schema.AdditionalProperties, schema.additional); err != nil {
+				return fmt.Errorf("invalid additionalProperties: %w", err)
+			}
+		}
+	}
+	subschemas := []*jsonSchema{schema.Items, schema.additional}
+	subschemas = append(subschemas, schema.AllOf...)
+	subschemas = append(subschemas, schema.AnyOf...)
+	subschemas = append(subschemas, schema.OneOf...)
+	for _, property := range schema.Properties {
+		subschemas = append(subschemas, property)
+	}
+	for _, definition := range schema.Defs {
+		subschemas = append(subschemas, definition)
+	}
+	for _, definition := range schema.Definitions {
+		subschemas = append(subschemas, definition)
+	}
+	for _, subschema := range subschemas {
+		if err := refs.compile(subschema, compiled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns the route and path parameters matching a request path.
+func (s *openAPISpec) match(requestPath string) (*openAPIRoute, map[string]string) {
+	segments := strings.Split(strings.Trim(requestPath, "/"), "/")
+	for _, route := range s.routes {
+		if len(route.segments) != len(segments) {
+			continue
+		}
+		var params map[string]string
+		matched := true
+		for i, segment := range route.segments {
+			if segment == "" {
+				if segments[i] == "" {
+					matched = false
+					break
+				}
+				if params == nil {
+					params = make(map[string]string)
+				}
+				params[route.names[i]] = segments[i]
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route, params
+		}
+	}
+	return nil, nil
+}
+
+// validate returns the violations of a value against a schema, located at "at".
+func (refs schemaRefs) validate(schema *jsonSchema, value any, at string, depth int) []string {
+	if schema == nil {
+		return nil
+	}
+	if depth > maxOpenAPISchemaDepth {
+		return []string{at + ": schema nested too deeply"}
+	}
+	if schema.Ref != "" {
+		resolved, err := refs.resolve(schema.Ref)
+		if err != nil {
+			return []string{at + ": " + err.Error()}
+		}
+		return refs.validate(resolved, value, at, depth+1)
+	}
+
+	if value == nil {
+		if schema.Nullable || slices.Contains(schema.Type, "null") || len(schema.Type) == 0 {
+			return nil
+		}
+		return []string{at + ": must not be null"}
+	}
+	if len(schema.Type) > 0 && !slices.ContainsFunc(schema.Type, func(t string) bool { return schemaTypeMatches(t, value) }) {
+		return []string{fmt.Sprintf("%s: must be of type %s", at, strings.Join(schema.Type, " or "))}
+	}
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		return []string{at + ": not one of the allowed values"}
+	}
+
+	var violations []string
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			violations = append(violations, at+": shorter than minLength")
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			violations = append(violations, at+": longer than maxLength")
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(v) {
+			violations = append(violations, at+": does not match pattern")
+		}
+		if !formatValid(schema.Format, v) {
+			violations = append(violations, at+": not a valid "+schema.Format)
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			violations = append(violations, at+": below minimum")
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			violations = append(violations, at+": above maximum")
+		}
+	case []any:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			violations = append(violations, at+": fewer than minItems")
+		}
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			violations = append(violations, at+": more than maxItems")
+		}
+		for i, item := range v {
+			violations = append(violations, refs.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i), depth+1)...)
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, at+"."+name+": missing")
+			}
+		}
+		for name, property := range v {
+			if propertySchema, ok := schema.Properties[name]; ok {
+				violations = append(violations, refs.validate(propertySchema, property, at+"."+name, depth+1)...)
+			} else if schema.noAdditional {
+				violations = append(violations, at+"."+name+": unknown property")
+			} else if schema.additional != nil {
+				violations = append(violations, refs.validate(schema.additional, property, at+"."+name, depth+1)...)
+			}
+		}
+	}
+
+	for _, subschema := range schema.AllOf {
+		violations = append(violations, refs.validate(subschema, value, at, depth+1)...)
+	}
+	if len(schema.AnyOf) > 0 && !slices.ContainsFunc(schema.AnyOf, func(sub *jsonSchema) bool {
+		return len(refs.validate(sub, value, at, depth+1)) == 0
+	}) {
+		violations = append(violations, at+": matches none of anyOf")
+	}
+	if len(schema.OneOf) > 0 {
+		matches := 0
+		for _, subschema := range schema.OneOf {
+			if len(refs.validate(subschema, value, at, depth+1)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			violations = append(violations, at+": must match exactly one of oneOf")
+		}
+	}
+	return violations
+}
+
+func schemaTypeMatches(schemaType string, value any) bool {
+	switch v := value.(type) {
+	case string:
+		return schemaType == "string"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && v == math.Trunc(v))
+	case bool:
+		return schemaType == "boolean"
+	case []any:
+		return schemaType == "array"
+	case map[string]any:
+		return schemaType == "object"
+	}
+	return false
+}
+
+// formatValid checks the string formats worth enforcing at the edge; others are accepted.
+func formatValid(format, value string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "date":
+		_, err := time.Parse(time.DateOnly, value)
+		return err == nil
+	case "uuid":
+		return openAPIUUIDPattern.MatchString(value)
+	case "email":
+		return openAPIEmailPattern.MatchString(value)
+	case "ipv4":
+		ip := net.ParseIP(value)
+		return ip != nil && ip.To4() != nil && !strings.Contains(value, ":")
+	case "ipv6":
+		ip := net.ParseIP(value)
+		return ip != nil && strings.Contains(value, ":")
+	}
+	return true
+}
+
+// parameterValue converts the raw values of a parameter to the type its schema declares,
+// so they can be validated like JSON values.
+func (s *openAPISpec) parameterValue(schema *jsonSchema, raw []string) any {
+	for depth := 0; schema != nil && schema.Ref != "" && depth <= maxOpenAPISchemaDepth; depth++ {
+		schema, _ = s.schemas.resolve(schema.Ref)
+	}
+	if schema == nil || len(raw) == 0 {
+		return nil
+	}
+	if slices.Contains(schema.Type, "array") {
+		if len(raw) == 1 {
+			raw = strings.Split(raw[0], ",")
+		}
+		items := make([]any, len(raw))
+		for i, value := range raw {
+			items[i] = value
+			if schema.Items != nil {
+				items[i] = s.parameterValue(schema.Items, []string{value})
+			}
+		}
+		return items
+	}
+	value := raw[0]
+	for _, schemaType := range schema.Type {
+		switch schemaType {
+		case "integer":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return float64(n)
+			}
+		case "number":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				return n
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(value); err == nil {
+				return b
+			}
+		}
+	}
+	return value
+}
+
+// validateOpenAPI returns the violations of a request against the spec.
+func (m *Middleware) validateOpenAPI(r *http.Request, state *WAFState) []string {
+	spec := m.OpenAPI.spec
+	requestPath, ok := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(m.OpenAPI.BasePath, "/"))
+	if !ok {
+		return nil // Outside the API
+	}
+	route, pathParams := spec.match(requestPath)
+	if route == nil {
+		return []string{"path: not defined in the spec"}
+	}
+	operation, ok := route.operations[r.Method]
+	if !ok {
+		return []string{fmt.Sprintf("method: %s not defined for %s", r.Method, route.template)}
+	}
+
+	var violations []string
+	params := make(map[string]*openAPIParameter)
+	for _, param := range slices.Concat(route.parameters, operation.Parameters) {
+		params[param.In+"."+param.Name] = param // Operation parameters override path item parameters
+	}
+	query := r.URL.Query()
+	for key, param := range params {
+		var raw []string
+		switch param.In {
+		case "path":
+			if value, ok := pathParams[param.Name]; ok {
+				raw = []string{value}
+			}
+		case "query":
+			raw = query[param.Name]
+		case "header":
+			raw = r.Header.Values(param.Name)
+		case "cookie":
+			if cookie, err := r.Cookie(param.Name); err == nil {
+				raw = []string{cookie.Value}
+			}
+		}
+		if len(raw) == 0 {
+			if param.Required || param.In == "path" {
+				violations = append(violations, key+": missing")
+			}
+			continue
+		}
+		violations = append(violations, spec.schemas.validate(param.Schema, spec.parameterValue(param.Schema, raw), key, 0)...)
+	}
+	violations = append(violations, m.validateOpenAPIBody(r, state, operation.RequestBody)...)
+	slices.Sort(violations)
+	return violations
+}
+
+// validateOpenAPIBody checks the content type of the request body, and validates JSON bodies
+// against their schema. The body is read through the memoized BODY target.
+func (m *Middleware) validateOpenAPIBody(r *http.Request, state *WAFState, requestBody *openAPIRequestBody) []string {
+	if requestBody == nil {
+		return nil
+	}
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		if requestBody.Required {
+			return []string{"body: missing"}
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return []string{"body: invalid content type"}
+	}
+	var schema *jsonSchema
+	found := false
+	for _, candidate := range []string{mediaType, strings.Split(mediaType, "/")[0] + "/*", "*/*"} {
+		if content, ok := requestBody.Content[candidate]; ok {
+			schema, found = content.Schema, true
+			break
+		}
+	}
+	if !found {
+		return []string{fmt.Sprintf("body: content type %s not allowed", mediaType)}
+	}
+	if schema == nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return []string{"body: invalid JSON"}
+	}
+	return m.OpenAPI.spec.schemas.validate(schema, value, "body", 0)
+}
+
+// checkOpenAPI validates the request against the OpenAPI spec, blocking or adding score
+// for each violation. It reports whether the request was blocked.
+func (m *Middleware) checkOpenAPI(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if m.OpenAPI == nil || m.OpenAPI.spec == nil {
+		return false
+	}
+	violations := m.validateOpenAPI(r, state)
+	if len(violations) == 0 {
+		return false
+	}
+	return m.enforceSchema(w, r, state, openAPIRuleID, "openapi", m.OpenAPI.Action, m.OpenAPI.Score, violations)
+}
+
+// reloadOpenAPI reloads the OpenAPI spec, keeping the current one when the file is invalid.
+// The caller must hold m.mu.
+func (m *Middleware) reloadOpenAPI() error {
+	spec, err := loadOpenAPISpec(m.OpenAPI.Spec)
+	if err != nil {
+		return err
+	}
+	m.OpenAPI.spec = spec
+	m.logger.Info("OpenAPI spec reloaded", zap.String("spec", m.OpenAPI.Spec), zap.Int("paths", len(spec.routes)))
+	return nil
+}
@@ -0,0 +1,198 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testOpenAPISpec = `openapi: 3.0.3
+info:
+  title: Users
+  version: "1"
+paths:
+  /users:
+    get:
+      parameters:
+        - name: limit
+          in: query
+          schema: {type: integer, minimum: 1, maximum: 100}
+        - name: tags
+          in: query
+          schema: {type: array, items: {type: string, enum: [admin, user]}}
+      responses:
+        200: {description: ok}
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema: {$ref: '#/components/schemas/User'}
+      responses:
+        201: {description: created}
+  /users/{id}:
+    parameters:
+      - $ref: '#/components/parameters/UserID'
+    get:
+      responses:
+        200: {description: ok}
+  /users/me:
+    get:
+      parameters:
+        - name: X-Request-ID
+          in: header
+          required: true
+          schema: {type: string, format: uuid}
+      responses:
+        200: {description: ok}
+components:
+  parameters:
+    UserID:
+      name: id
+      in: path
+      required: true
+      schema: {type: integer}
+  schemas:
+    User:
+      type: object
+      required: [name, email]
+      additionalProperties: false
+      properties:
+        name: {type: string, minLength: 2, maxLength: 32, pattern: '^[A-Za-z ]+$'}
+        email: {type: string, format: email}
+        age: {type: integer, minimum: 0, nullable: true}
+        roles:
+          type: array
+          maxItems: 2
+          items: {type: string}
+`
+
+func writeOpenAPISpec(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "openapi.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testOpenAPISpec), 0o600))
+	return path
+}
+
+func TestValidateOpenAPI(t *testing.T) {
+	config := &OpenAPIConfig{Spec: writeOpenAPISpec(t), BasePath: "/api"}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		AnomalyThreshold:      10,
+		OpenAPI:               config,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header map[string]string
+		body   string
+		want   []string
+	}{
+		{"valid query", "GET", "/api/users?limit=10&tags=admin,user", nil, "", nil},
+		{"query type", "GET", "/api/users?limit=ten", nil, "", []string{"query.limit: must be of type integer"}},
+		{"query bounds", "GET", "/api/users?limit=500", nil, "", []string{"query.limit: above maximum"}},
+		{"query enum", "GET", "/api/users?tags=root", nil, "", []string{"query.tags[0]: not one of the allowed values"}},
+		{"path parameter", "GET", "/api/users/42", nil, "", nil},
+		{"path parameter type", "GET", "/api/users/abc", nil, "", []string{"path.id: must be of type integer"}},
+		{"literal path wins", "GET", "/api/users/me", map[string]string{"X-Request-ID": "0b5c1a3e-8e8f-4f1e-9a47-3f3d2b1c0a99"}, "", nil},
+		{"header format", "GET", "/api/users/me", map[string]string{"X-Request-ID": "1"}, "", []string{"header.X-Request-ID: not a valid uuid"}},
+		{"missing header", "GET", "/api/users/me", nil, "", []string{"header.X-Request-ID: missing"}},
+		{"unknown path", "GET", "/api/admin", nil, "", []string{"path: not defined in the spec"}},
+		{"unknown method", "DELETE", "/api/users", nil, "", []string{"method: DELETE not defined for /users"}},
+		{"outside base path", "GET", "/health", nil, "", nil},
+		{"valid body", "POST", "/api/users", map[string]string{"Content-Type": "application/json"}, `{"name":"Ada","email":"ada@example.com","age":null,"roles":["a"]}`, nil},
+		{"body violations", "POST", "/api/users", map[string]string{"Content-Type": "application/json"}, `{"name":"1","age":-1,"roles":["a","b","c"],"admin":true}`, []string{
+			"body.admin: unknown property",
+			"body.age: below minimum",
+			"body.email: missing",
+			"body.name: does not match pattern",
+			"body.name: shorter than minLength",
+			"body.roles: more than maxItems",
+		}},
+		{"missing body", "POST", "/api/users", nil, "", []string{"body: missing"}},
+		{"content type", "POST", "/api/users", map[string]string{"Content-Type": "text/plain"}, "name=Ada", []string{"body: content type text/plain not allowed"}},
+		{"invalid json", "POST", "/api/users", map[string]string{"Content-Type": "application/json"}, "{", []string{"body: invalid JSON"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(tt.method, tt.target, "", tt.body)
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			assert.Equal(t, tt.want, m.validateOpenAPI(req, &WAFState{}))
+		})
+	}
+}
+
+func TestCheckOpenAPI_Actions(t *testing.T) {
+	config := &OpenAPIConfig{Spec: writeOpenAPISpec(t)}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		AnomalyThreshold:      10,
+		OpenAPI:               config,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkOpenAPI(w, testRequest("GET", "/users?limit=0", "", ""), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{openAPIRuleID}, state.MatchedRules)
+
+	config = &OpenAPIConfig{Spec: writeOpenAPISpec(t), Action: detectionActionScore, Score: 3}
+	require.NoError(t, config.provision())
+	m = &Middleware{
+		logger:                zap.NewNop(),
+		AnomalyThreshold:      10,
+		OpenAPI:               config,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	state = &WAFState{}
+	assert.False(t, m.checkOpenAPI(httptest.NewRecorder(), testRequest("GET", "/users?limit=0", "", ""), state))
+	assert.Equal(t, 3, state.TotalScore)
+	assert.False(t, state.Blocked)
+}
+
+func TestLoadOpenAPISpec_Errors(t *testing.T) {
+	dir := t.TempDir()
+	for name, spec := range map[string]string{
+		"swagger.json":  `{"swagger": "2.0", "paths": {}}`,
+		"badref.json":   `{"openapi": "3.0.0", "paths": {"/a": {"get": {"parameters": [{"$ref": "#/components/parameters/Missing"}]}}}}`,
+		"pattern.json":  `{"openapi": "3.1.0", "paths": {}, "components": {"schemas": {"A": {"type": "string", "pattern": "("}}}}`,
+		"invalid.yaml":  "openapi: [",
+		"badparam.json": `{"openapi": "3.0.0", "paths": {"/a": {"get": {"parameters": [{"name": "a", "in": "body"}]}}}}`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(spec), 0o600))
+		_, err := loadOpenAPISpec(path)
+		assert.Error(t, err, name)
+	}
+	_, err := loadOpenAPISpec(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestLoadOpenAPISpec_JSONAndTypeLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "openapi.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"openapi": "3.1.0", "paths": {"/items": {"post": {
+		"requestBody": {"content": {"application/*": {"schema": {"type": ["object", "null"],
+			"properties": {"count": {"type": ["integer", "string"]}},
+			"additionalProperties": {"type": "boolean"}}}}}}}}}`), 0o600))
+	spec, err := loadOpenAPISpec(path)
+	require.NoError(t, err)
+
+	m := &Middleware{logger: zap.NewNop(), OpenAPI: &OpenAPIConfig{spec: spec}, requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+	valid := testRequest("POST", "/items", "application/merge-patch+json", `{"count":"3","flag":true}`)
+	assert.Empty(t, m.validateOpenAPI(valid, &WAFState{}))
+	invalid := testRequest("POST", "/items", "application/json", `{"count":1.5,"flag":"yes"}`)
+	assert.Equal(t, []string{"body.count: must be of type integer or string", "body.flag: must be of type boolean"}, m.validateOpenAPI(invalid, &WAFState{}))
+}
@@ -0,0 +1,179 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// HostOverlay adjusts the rules and anomaly threshold for requests to specific hosts.
+type HostOverlay struct {
+	Hosts            []string `json:"hosts"`                       // Exact hosts or "*.example.com" wildcards
+	AnomalyThreshold int      `json:"anomaly_threshold,omitempty"` // Overrides the global threshold when > 0
+	RuleFiles        []string `json:"rule_files,omitempty"`        // Rules added to, or replacing by ID, the global rules
+	DisabledRules    []string `json:"disabled_rules,omitempty"`    // Global rule IDs not evaluated for these hosts
+
+	rules map[int][]Rule // Effective rules by phase, rebuilt whenever the rules are loaded
+}
+
+// matchesHost reports whether the overlay applies to a normalized host.
+func (o *HostOverlay) matchesHost(host string) bool {
+	for _, pattern := range o.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOverlay returns the first overlay matching the request host, or nil.
+func (m *Middleware) hostOverlay(r *http.Request) *HostOverlay {
+	if len(m.HostOverlays) == 0 {
+		return nil
+	}
+	host := tenantHost(r.Host)
+	for i := range m.HostOverlays {
+		if m.HostOverlays[i].matchesHost(host) {
+			return &m.HostOverlays[i]
+		}
+	}
+	return nil
+}
+
+// overlayHosts returns the exact, non-wildcard hosts named by the host overlays.
+func (m *Middleware) overlayHosts() []string {
+	var hosts []string
+	for _, overlay := range m.HostOverlays {
+		for _, pattern := range overlay.Hosts {
+			if !strings.HasPrefix(pattern, "*") {
+				hosts = append(hosts, pattern)
+			}
+		}
+	}
+	return hosts
+}
+
+// rulesForPhase returns the rules to evaluate in a phase, honoring the request's host overlay.
+func (m *Middleware) rulesForPhase(state *WAFState, phase int) ([]Rule, bool) {
+	if state.overlay != nil && state.overlay.rules != nil {
+		rules, ok := state.overlay.rules[phase]
+		return rules, ok
+	}
+	rules, ok := m.Rules[phase]
+	return rules, ok
+}
+
+// anomalyThreshold returns the anomaly threshold for the request, honoring its host overlay
+// and, when lower, the lockdown threshold.
+func (m *Middleware) anomalyThreshold(state *WAFState) int {
+	threshold := m.AnomalyThreshold
+	if state.overlay != nil && state.overlay.AnomalyThreshold > 0 {
+		threshold = state.overlay.AnomalyThreshold
+	}
+	if m.lockdownActive() {
+		threshold = min(threshold, m.Lockdown.AnomalyThreshold)
+	}
+	return threshold
+}
+
+// buildHostOverlays computes the effective rules of every overlay from the global rules.
+// The caller must hold m.mu.
+func (m *Middleware) buildHostOverlays() error {
+	for i := range m.HostOverlays {
+		overlay := &m.HostOverlays[i]
+		rules, err := m.overlayRules(overlay)
+		if err != nil {
+			return fmt.Errorf("host overlay %s: %w", strings.Join(overlay.Hosts, ","), err)
+		}
+		overlay.rules = rules
+		m.logger.Debug("Host overlay rules built",
+			zap.Strings("hosts", overlay.Hosts),
+			zap.Int("anomaly_threshold", overlay.AnomalyThreshold),
+			zap.Int("disabled_rules", len(overlay.DisabledRules)),
+		)
+	}
+	return nil
+}
+
+// overlayRules merges the global rules with an overlay: disabled rules are
+// dropped, overlay rules replace global rules with the same ID, and new rules
+// are added to their phase.
+func (m *Middleware) overlayRules(overlay *HostOverlay) (map[int][]Rule, error) {
+	disabled := make(map[string]bool, len(overlay.DisabledRules))
+	for _, id := range overlay.DisabledRules {
+		disabled[id] = true
+	}
+
+	overrides := make(map[string]Rule)
+	var added []Rule
+	for _, path := range overlay.RuleFiles {
+		fileRules, err := m.loadOverlayRuleFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range fileRules {
+			if _, exists := overrides[rule.ID]; exists {
+				return nil, fmt.Errorf("duplicate rule ID '%s' in overlay rule files", rule.ID)
+			}
+			overrides[rule.ID] = rule
+			added = append(added, rule)
+		}
+	}
+
+	merged := make(map[int][]Rule)
+	for phase, rules := range m.Rules {
+		for _, rule := range rules {
+			if disabled[rule.ID] {
+				continue
+			}
+			if override, ok := overrides[rule.ID]; ok && override.Phase == phase {
+				merged[phase] = append(merged[phase], override)
+				delete(overrides, rule.ID)
+				continue
+			} else if ok {
+				continue // Moved to another phase, added below
+			}
+			merged[phase] = append(merged[phase], rule)
+		}
+	}
+	for _, rule := range added {
+		if _, pending := overrides[rule.ID]; pending && !disabled[rule.ID] {
+			merged[rule.Phase] = append(merged[rule.Phase], rule)
+		}
+	}
+	return merged, nil
+}
+
+// loadOverlayRuleFile reads and validates an overlay rule file. Regexes are shared
+// with the global rules through the pattern-keyed rule cache.
+func (m *Middleware) loadOverlayRuleFile(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay rule file: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal overlay rules from %s: %w", path, err)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+	for i := range rules {
+		if err := validateRule(&rules[i]); err != nil {
+			return nil, fmt.Errorf("invalid overlay rule at index %d in %s: %w", i, path, err)
+		}
+		if err := m.compileRule(&rules[i]); err != nil {
+			return nil, fmt.Errorf("overlay rule '%s': %w", rules[i].ID, err)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,146 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeOverlayRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "overlay_rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestHostOverlay_MatchesHost(t *testing.T) {
+	o := &HostOverlay{Hosts: []string{"api.example.com", "*.internal.example.com"}}
+	assert.True(t, o.matchesHost("api.example.com"))
+	assert.True(t, o.matchesHost("db.internal.example.com"))
+	assert.False(t, o.matchesHost("internal.example.com"))
+	assert.False(t, o.matchesHost("www.example.com"))
+}
+
+func TestHostOverlay_OverlayRules(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		Rules: map[int][]Rule{
+			1: {{ID: "keep", Phase: 1}, {ID: "drop", Phase: 1}, {ID: "replace", Phase: 1, Pattern: "old"}},
+			2: {{ID: "move", Phase: 2}},
+		},
+	}
+	path := writeOverlayRules(t, `[
+		{"id": "replace", "phase": 1, "pattern": "new", "targets": ["URI"], "score": 5},
+		{"id": "move", "phase": 3, "pattern": "x", "targets": ["RESPONSE_HEADERS"], "score": 1},
+		{"id": "extra", "phase": 2, "pattern": "y", "targets": ["BODY"], "score": 1}
+	]`)
+	m.HostOverlays = []HostOverlay{{Hosts: []string{"api.example.com"}, RuleFiles: []string{path}, DisabledRules: []string{"drop"}}}
+
+	require.NoError(t, m.buildHostOverlays())
+	rules := m.HostOverlays[0].rules
+
+	ids := func(phase int) []string {
+		var out []string
+		for _, r := range rules[phase] {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"keep", "replace"}, ids(1))
+	assert.Equal(t, "new", rules[1][1].Pattern)
+	assert.NotNil(t, rules[1][1].regex)
+	assert.Equal(t, []string{"extra"}, ids(2))
+	assert.Equal(t, []string{"move"}, ids(3))
+
+	// The global rules are left untouched
+	assert.Len(t, m.Rules[1], 3)
+}
+
+func TestHostOverlay_InvalidRuleFile(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+	m.HostOverlays = []HostOverlay{{Hosts: []string{"a"}, RuleFiles: []string{writeOverlayRules(t, `[{"id": "x", "phase": 9}]`)}}}
+	assert.Error(t, m.buildHostOverlays())
+
+	m.HostOverlays = []HostOverlay{{Hosts: []string{"a"}, RuleFiles: []string{"/nonexistent.json"}}}
+	assert.Error(t, m.buildHostOverlays())
+}
+
+func TestHostOverlay_ServeHTTP(t *testing.T) {
+	logger := zap.NewNop()
+	m := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 10,
+		Rules: map[int][]Rule{
+			1: {{
+				ID: "admin-path", Phase: 1, Pattern: "admin", Targets: []string{"URI"}, Score: 5,
+				regex: regexp.MustCompile("admin"),
+			}},
+		},
+		HostOverlays: []HostOverlay{
+			{Hosts: []string{"api.example.com"}, AnomalyThreshold: 5},
+			{Hosts: []string{"www.example.com"}, DisabledRules: []string{"admin-path"}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	require.NoError(t, m.buildHostOverlays())
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	send := func(host string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/admin", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("api.example.com"), "strict threshold for api")
+	assert.Equal(t, http.StatusOK, send("other.example.com"), "global threshold not reached")
+	assert.Equal(t, http.StatusOK, send("www.example.com"), "rule disabled for www")
+}
+
+func TestHostOverlay_ResponseBodyPhase(t *testing.T) {
+	logger := zap.NewNop()
+	m := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{
+			4: {{ID: "leak", Targets: []string{"RESPONSE_BODY"}, Phase: 4, Score: 5, Action: "block", regex: regexp.MustCompile("secret")}},
+		},
+		HostOverlays: []HostOverlay{
+			{Hosts: []string{"www.example.com"}, DisabledRules: []string{"leak"}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	require.NoError(t, m.buildHostOverlays())
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("the secret is out"))
+		return err
+	})
+	send := func(host string) string {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Body.String()
+	}
+
+	assert.NotContains(t, send("api.example.com"), "secret", "global response body rule")
+	assert.Equal(t, "the secret is out", send("www.example.com"), "response body rule disabled for www")
+}
@@ -0,0 +1,186 @@
+package caddywaf
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultParamAnomalyMinSamples = 100
+	defaultParamAnomalyDeviation  = 4.0
+	defaultParamAnomalyScore      = 5
+	defaultParamAnomalyMaxParams  = 10000
+	paramAnomalyRareShare         = 0.01 // Share of the baseline values under which a trait is unusual
+	paramAnomalyRuleID            = "param_anomaly_rule"
+)
+
+// Character classes of a parameter value
+const (
+	charClassDigit = iota
+	charClassLetter
+	charClassSpace
+	charClassSymbol  // Printable ASCII punctuation and symbols
+	charClassControl // Control characters and non-ASCII bytes
+	charClassCount
+)
+
+var charClassNames = [charClassCount]string{"digit", "letter", "space", "symbol", "control or non-ASCII"}
+
+// ParamAnomalyConfig learns a baseline of the values of each parameter of each path, their
+// length, character classes and whether they are numeric, and scores the values deviating
+// sharply from it.
+type ParamAnomalyConfig struct {
+	MinSamples int     `json:"min_samples,omitempty"` // Values learned before the baseline of a parameter applies, default 100
+	Deviation  float64 `json:"deviation,omitempty"`   // Standard deviations above the mean length that are anomalous, default 4
+	Score      int     `json:"score,omitempty"`       // Score added per anomalous parameter, default 5
+	MaxParams  int     `json:"max_params,omitempty"`  // Parameters tracked across paths, default 10000
+
+	mu        sync.Mutex
+	baselines map[string]*paramBaseline // By path and parameter name
+}
+
+// paramBaseline is the values learned for a parameter.
+type paramBaseline struct {
+	samples int64
+	mean    float64 // Running mean of the lengths
+	m2      float64 // Running sum of the squared deviations of the lengths from the mean
+	numeric int64   // Values parsing as numbers
+	classes [charClassCount]int64
+}
+
+// provision applies the defaults.
+func (c *ParamAnomalyConfig) provision() {
+	if c.MinSamples <= 0 {
+		c.MinSamples = defaultParamAnomalyMinSamples
+	}
+	if c.Deviation <= 0 {
+		c.Deviation = defaultParamAnomalyDeviation
+	}
+	if c.Score <= 0 {
+		c.Score = defaultParamAnomalyScore
+	}
+	if c.MaxParams <= 0 {
+		c.MaxParams = defaultParamAnomalyMaxParams
+	}
+	c.baselines = make(map[string]*paramBaseline)
+}
+
+// charClasses returns the character classes present in a value.
+func charClasses(value string) [charClassCount]bool {
+	var classes [charClassCount]bool
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case isDigitByte(b):
+			classes[charClassDigit] = true
+		case isAlphaByte(b):
+			classes[charClassLetter] = true
+		case b == ' ' || b == '\t':
+			classes[charClassSpace] = true
+		case isPrintableByte(b):
+			classes[charClassSymbol] = true
+		default:
+			classes[charClassControl] = true
+		}
+	}
+	return classes
+}
+
+func isNumeric(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// add learns a value.
+func (b *paramBaseline) add(value string) {
+	b.samples++
+	delta := float64(len(value)) - b.mean
+	b.mean += delta / float64(b.samples)
+	b.m2 += delta * (float64(len(value)) - b.mean)
+	if isNumeric(value) {
+		b.numeric++
+	}
+	for class, present := range charClasses(value) {
+		if present {
+			b.classes[class]++
+		}
+	}
+}
+
+// deviations returns how a value deviates from the baseline: much longer than the values
+// learned, not numeric when they are, or containing a character class they rarely do.
+func (b *paramBaseline) deviations(value string, deviation float64) []string {
+	var reasons []string
+	stddev := math.Sqrt(b.m2 / float64(b.samples))
+	if float64(len(value)) > b.mean+deviation*max(stddev, 1) {
+		reasons = append(reasons, fmt.Sprintf("length %d, baseline %.0f±%.0f", len(value), b.mean, stddev))
+	}
+	rare := paramAnomalyRareShare * float64(b.samples)
+	if float64(b.samples-b.numeric) < rare && !isNumeric(value) {
+		reasons = append(reasons, "not numeric")
+	}
+	for class, present := range charClasses(value) {
+		if present && float64(b.classes[class]) < rare {
+			reasons = append(reasons, "unusual "+charClassNames[class]+" characters")
+		}
+	}
+	return reasons
+}
+
+// observe checks a value of a parameter against its baseline once it has MinSamples, and
+// learns it unless it deviates, so that attacks don't skew the baseline. It returns the
+// deviations of the value.
+func (c *ParamAnomalyConfig) observe(key, value string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.baselines[key]
+	if !ok {
+		if len(c.baselines) >= c.MaxParams {
+			return nil
+		}
+		b = &paramBaseline{}
+		c.baselines[key] = b
+	}
+	var reasons []string
+	if b.samples >= int64(c.MinSamples) {
+		reasons = b.deviations(value, c.Deviation)
+	}
+	if len(reasons) == 0 {
+		b.add(value)
+	}
+	return reasons
+}
+
+// checkParamAnomaly adds score for each parameter of the request deviating from its
+// baseline, blocking the request once it reaches the anomaly threshold. It reports whether
+// the request was blocked.
+func (m *Middleware) checkParamAnomaly(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if m.ParamAnomaly == nil {
+		return false
+	}
+	params, err := m.requestParams(r, state)
+	if err != nil {
+		return false
+	}
+	path := learningPath(r.URL.Path)
+	var violations []string
+	for name, values := range params {
+		for _, value := range values {
+			if reasons := m.ParamAnomaly.observe(path+" "+name, value); len(reasons) > 0 {
+				violations = append(violations, name+": "+strings.Join(reasons, ", "))
+				break
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return false
+	}
+	sort.Strings(violations)
+	m.paramAnomalies.Add(int64(len(violations)))
+	return m.enforceSchema(w, r, state, paramAnomalyRuleID, "param_anomaly", detectionActionScore, m.ParamAnomaly.Score, violations)
+}
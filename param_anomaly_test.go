@@ -0,0 +1,67 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCharClasses(t *testing.T) {
+	assert.Equal(t, [charClassCount]bool{true, true, false, false, false}, charClasses("abc123"))
+	assert.Equal(t, [charClassCount]bool{false, false, true, true, true}, charClasses(" '\x00é"))
+}
+
+func TestParamAnomalyConfig_Observe(t *testing.T) {
+	config := &ParamAnomalyConfig{MinSamples: 20, MaxParams: 2}
+	config.provision()
+	assert.Equal(t, defaultParamAnomalyDeviation, config.Deviation)
+	assert.Equal(t, defaultParamAnomalyScore, config.Score)
+
+	for i := 0; i < 20; i++ {
+		assert.Empty(t, config.observe("/item id", fmt.Sprintf("%010d", i*7919)))
+	}
+	assert.Empty(t, config.observe("/item id", "0000012345"))
+	assert.Empty(t, config.observe("/item id", "12345"), "shorter values are not anomalous")
+	assert.Equal(t, []string{"length 4096, baseline 10±1", "not numeric", "unusual symbol characters"},
+		config.observe("/item id", strings.Repeat("'", 4096)))
+	assert.Equal(t, []string{"not numeric", "unusual letter characters"}, config.observe("/item id", "abc"))
+	assert.Equal(t, int64(22), config.baselines["/item id"].samples, "anomalous values are not learned")
+
+	assert.Empty(t, config.observe("/item other", "x"))
+	assert.Empty(t, config.observe("/item third", strings.Repeat("x", 100)), "max_params reached")
+	assert.Len(t, config.baselines, 2)
+}
+
+func TestCheckParamAnomaly(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.ParamAnomaly = &ParamAnomalyConfig{MinSamples: 10, Score: 10}
+	m.ParamAnomaly.provision()
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/users/%d?q=name%d", i, i), nil)
+		assert.False(t, m.checkParamAnomaly(httptest.NewRecorder(), r, &WAFState{}))
+	}
+
+	state := &WAFState{}
+	r := httptest.NewRequest("GET", "/users/99?q=name1&sort=asc", nil)
+	assert.False(t, m.checkParamAnomaly(httptest.NewRecorder(), r, state))
+	assert.Zero(t, state.TotalScore, "a new parameter has no baseline yet")
+
+	w := httptest.NewRecorder()
+	r = testRequest("GET", "/users/7?q="+strings.Repeat("%3C", 200), "", "")
+	assert.True(t, m.checkParamAnomaly(w, r, state), "the anomaly threshold is reached")
+	assert.Equal(t, 10, state.TotalScore)
+	assert.Equal(t, []string{paramAnomalyRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.paramAnomalies.Load())
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,281 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const paramSchemaRuleID = "param_schema_rule"
+
+// paramCharsets are the named character sets a parameter can be restricted to.
+var paramCharsets = map[string]string{
+	"alpha":     "[A-Za-z]",
+	"alnum":     "[A-Za-z0-9]",
+	"digit":     "[0-9]",
+	"hex":       "[0-9A-Fa-f]",
+	"printable": "[ -~]",
+}
+
+// ParamSchema declares the query and body parameters a path accepts. Requests with
+// undeclared parameters or values breaking their spec are blocked or scored.
+type ParamSchema struct {
+	Path         string      `json:"path"`                    // Exact path, or a prefix ending in *
+	Methods      []string    `json:"methods,omitempty"`       // Methods the schema applies to, default all
+	Params       []ParamSpec `json:"params,omitempty"`        // Declared parameters
+	AllowUnknown bool        `json:"allow_unknown,omitempty"` // Accept parameters that aren't declared
+	Action       string      `json:"action,omitempty"`        // block (default) or score
+	Score        int         `json:"score,omitempty"`         // Score added per violation with the score action, default 5
+}
+
+// ParamSpec describes one parameter of a ParamSchema.
+type ParamSpec struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type,omitempty"` // string (default), int, float or bool
+	Required  bool     `json:"required,omitempty"`
+	MinLength int      `json:"min_length,omitempty"`
+	MaxLength int      `json:"max_length,omitempty"`
+	Min       *float64 `json:"min,omitempty"`     // Lower bound of int and float values
+	Max       *float64 `json:"max,omitempty"`     // Upper bound of int and float values
+	Charset   string   `json:"charset,omitempty"` // alpha, alnum, digit, hex, printable or a class like [a-z0-9_-]
+	Pattern   string   `json:"pattern,omitempty"` // Regexp the whole value must match
+
+	charset *regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+// provision validates the schema and compiles its charsets and patterns.
+func (s *ParamSchema) provision() error {
+	if !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("param_schema path must start with /: %s", s.Path)
+	}
+	switch s.Action {
+	case "":
+		s.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid param_schema action: %s, must be block or score", s.Action)
+	}
+	if s.Score <= 0 {
+		s.Score = defaultDetectionScore
+	}
+	for i := range s.Methods {
+		s.Methods[i] = strings.ToUpper(s.Methods[i])
+	}
+	for i := range s.Params {
+		if err := s.Params[i].provision(); err != nil {
+			return fmt.Errorf("param_schema %s: %w", s.Path, err)
+		}
+	}
+	return nil
+}
+
+func (p *ParamSpec) provision() error {
+	if p.Name == "" {
+		return fmt.Errorf("parameter name must not be empty")
+	}
+	switch p.Type {
+	case "":
+		p.Type = "string"
+	case "string", "int", "float", "bool":
+	default:
+		return fmt.Errorf("invalid type %s for parameter %s, must be string, int, float or bool", p.Type, p.Name)
+	}
+	if p.MinLength < 0 || p.MaxLength < 0 || (p.MaxLength > 0 && p.MinLength > p.MaxLength) {
+		return fmt.Errorf("invalid length bounds for parameter %s", p.Name)
+	}
+	if p.Charset != "" {
+		class, ok := paramCharsets[p.Charset]
+		if !ok {
+			if !strings.HasPrefix(p.Charset, "[") || !strings.HasSuffix(p.Charset, "]") {
+				return fmt.Errorf("invalid charset %s for parameter %s", p.Charset, p.Name)
+			}
+			class = p.Charset
+		}
+		charset, err := regexp.Compile("^" + class + "*$")
+		if err != nil {
+			return fmt.Errorf("invalid charset %s for parameter %s: %w", p.Charset, p.Name, err)
+		}
+		p.charset = charset
+	}
+	if p.Pattern != "" {
+		pattern, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern for parameter %s: %w", p.Name, err)
+		}
+		p.pattern = pattern
+	}
+	return nil
+}
+
+// matches reports whether the schema applies to a request.
+func (s *ParamSchema) matches(r *http.Request) bool {
+	if len(s.Methods) > 0 && !slices.Contains(s.Methods, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(s.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == s.Path
+}
+
+// check returns the reason a value breaks the spec, or an empty string.
+func (p *ParamSpec) check(value string) string {
+	switch p.Type {
+	case "int", "float":
+		var number float64
+		var err error
+		if p.Type == "int" {
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 64)
+			number = float64(n)
+		} else {
+			number, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return "not a valid " + p.Type
+		}
+		if p.Min != nil && number < *p.Min {
+			return "below minimum"
+		}
+		if p.Max != nil && number > *p.Max {
+			return "above maximum"
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "not a valid bool"
+		}
+	}
+	if len(value) < p.MinLength {
+		return "shorter than min_length"
+	}
+	if p.MaxLength > 0 && len(value) > p.MaxLength {
+		return "longer than max_length"
+	}
+	if p.charset != nil && !p.charset.MatchString(value) {
+		return "characters outside charset"
+	}
+	if p.pattern != nil && !p.pattern.MatchString(value) {
+		return "does not match pattern"
+	}
+	return ""
+}
+
+// validate returns the violations of a request's parameters against the schema.
+func (s *ParamSchema) validate(params url.Values) []string {
+	var violations []string
+	declared := make(map[string]struct{}, len(s.Params))
+	for i := range s.Params {
+		spec := &s.Params[i]
+		declared[spec.Name] = struct{}{}
+		values, ok := params[spec.Name]
+		if !ok {
+			if spec.Required {
+				violations = append(violations, fmt.Sprintf("%s: missing", spec.Name))
+			}
+			continue
+		}
+		for _, value := range values {
+			if reason := spec.check(value); reason != "" {
+				violations = append(violations, fmt.Sprintf("%s: %s", spec.Name, reason))
+				break
+			}
+		}
+	}
+	if !s.AllowUnknown {
+		for name := range params {
+			if _, ok := declared[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: unknown parameter", name))
+			}
+		}
+	}
+	slices.Sort(violations)
+	return violations
+}
+
+// requestParams collects the query parameters and the URL-encoded form or top-level JSON
+// object fields of the body. The body is read through the memoized BODY target.
+func (m *Middleware) requestParams(r *http.Request, state *WAFState) (url.Values, error) {
+	params := r.URL.Query()
+	if r.ContentLength == 0 {
+		return params, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" {
+		return params, nil
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil || body == "" {
+		return params, nil
+	}
+
+	if mediaType == "application/json" {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(body), &fields); err != nil {
+			return params, fmt.Errorf("body is not a JSON object")
+		}
+		for name, raw := range fields {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				value = string(raw) // Numbers, bools and nested values keep their JSON text
+			}
+			params.Add(name, value)
+		}
+		return params, nil
+	}
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		m.logger.Debug("Failed to parse form body for param_schema", zap.Error(err))
+	}
+	for name, values := range form {
+		params[name] = append(params[name], values...)
+	}
+	return params, nil
+}
+
+// paramSchemaFor returns the first schema applying to the request, or nil.
+func (m *Middleware) paramSchemaFor(r *http.Request) *ParamSchema {
+	for i := range m.ParamSchemas {
+		if m.ParamSchemas[i].matches(r) {
+			return &m.ParamSchemas[i]
+		}
+	}
+	return nil
+}
+
+// checkParamSchema validates the request's parameters against the schema of its path,
+// blocking or adding score for each violation. It reports whether the request was blocked.
+func (m *Middleware) checkParamSchema(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	schema := m.paramSchemaFor(r)
+	if schema == nil {
+		return false
+	}
+	params, err := m.requestParams(r, state)
+	violations := schema.validate(params)
+	if err != nil {
+		violations = append(violations, err.Error())
+	}
+	if len(violations) == 0 {
+		return false
+	}
+
+	return m.enforceSchema(w, r, state, paramSchemaRuleID, "param_schema", schema.Action, schema.Score, violations)
+}
+
+// enforceSchema blocks a request violating a schema, or with the score action adds score
+// per violation and blocks once the anomaly threshold is reached. It reports whether the
+// request was blocked.
+func (m *Middleware) enforceSchema(w http.ResponseWriter, r *http.Request, state *WAFState, ruleID, reason, action string, score int, violations []string) bool {
+	m.incrementRuleHitCount(RuleID(ruleID))
+	state.MatchedRules = append(state.MatchedRules, ruleID)
+	return m.applyDetection(w, r, state, action, score*len(violations), http.StatusForbidden, reason, ruleID,
+		"Schema violations detected", zap.String("path", r.URL.Path), zap.Strings("violations", violations))
+}
@@ -0,0 +1,134 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+
+func TestParamSchema_Validate(t *testing.T) {
+	schema := ParamSchema{
+		Path: "/api/users",
+		Params: []ParamSpec{
+			{Name: "name", Required: true, MinLength: 2, MaxLength: 8, Charset: "alnum"},
+			{Name: "age", Type: "int", Min: float64Ptr(0), Max: float64Ptr(150)},
+			{Name: "admin", Type: "bool"},
+			{Name: "tag", Charset: "[a-z-]"},
+			{Name: "zip", Pattern: `\d{5}`},
+		},
+	}
+	require.NoError(t, schema.provision())
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"name=alice&age=30&admin=true&tag=a-b&zip=12345", nil},
+		{"age=30", []string{"name: missing"}},
+		{"name=a", []string{"name: shorter than min_length"}},
+		{"name=al_b", []string{"name: characters outside charset"}},
+		{"name=alice&age=thirty", []string{"age: not a valid int"}},
+		{"name=alice&age=200", []string{"age: above maximum"}},
+		{"name=alice&admin=maybe", []string{"admin: not a valid bool"}},
+		{"name=alice&zip=123456", []string{"zip: does not match pattern"}},
+		{"name=alice&debug=1", []string{"debug: unknown parameter"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/users?"+tt.query, nil)
+			assert.Equal(t, tt.want, schema.validate(req.URL.Query()))
+		})
+	}
+
+	schema.AllowUnknown = true
+	assert.Empty(t, schema.validate(httptest.NewRequest("GET", "/api/users?name=alice&debug=1", nil).URL.Query()))
+}
+
+func TestParamSchema_Provision(t *testing.T) {
+	for _, schema := range []ParamSchema{
+		{Path: "api"},
+		{Path: "/api", Action: "drop"},
+		{Path: "/api", Params: []ParamSpec{{Name: "id", Type: "uuid"}}},
+		{Path: "/api", Params: []ParamSpec{{Name: "id", Charset: "letters"}}},
+		{Path: "/api", Params: []ParamSpec{{Name: "id", MinLength: 5, MaxLength: 2}}},
+		{Path: "/api", Params: []ParamSpec{{Name: "id", Pattern: "("}}},
+	} {
+		assert.Error(t, schema.provision(), "%+v", schema)
+	}
+}
+
+func TestCheckParamSchema_Body(t *testing.T) {
+	schema := ParamSchema{
+		Path:    "/login",
+		Methods: []string{"post"},
+		Params: []ParamSpec{
+			{Name: "user", Required: true, MaxLength: 16},
+			{Name: "remember", Type: "bool"},
+		},
+	}
+	require.NoError(t, schema.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		ParamSchemas:          []ParamSchema{schema},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+
+	state := &WAFState{}
+	req := testRequest("POST", "/login", "application/x-www-form-urlencoded", "user=alice&remember=true")
+	assert.False(t, m.checkParamSchema(httptest.NewRecorder(), req, state))
+
+	state = &WAFState{}
+	req = testRequest("POST", "/login", "application/json", `{"user":"alice","remember":true}`)
+	assert.False(t, m.checkParamSchema(httptest.NewRecorder(), req, state))
+
+	state = &WAFState{}
+	req = testRequest("POST", "/login", "application/json", `{"user":"alice","role":"admin"}`)
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkParamSchema(w, req, state))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	state = &WAFState{}
+	req = testRequest("POST", "/login", "application/json", `["alice"]`)
+	assert.True(t, m.checkParamSchema(httptest.NewRecorder(), req, state), "a body that isn't an object is a violation")
+
+	state = &WAFState{}
+	req = testRequest("GET", "/login?role=admin", "", "")
+	assert.False(t, m.checkParamSchema(httptest.NewRecorder(), req, state), "other methods are not checked")
+}
+
+func TestCheckParamSchema_Score(t *testing.T) {
+	schema := ParamSchema{
+		Path:   "/search*",
+		Action: detectionActionScore,
+		Score:  4,
+		Params: []ParamSpec{{Name: "q"}},
+	}
+	require.NoError(t, schema.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		ParamSchemas:          []ParamSchema{schema},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+
+	state := &WAFState{}
+	assert.False(t, m.checkParamSchema(httptest.NewRecorder(), testRequest("GET", "/search/all?q=x&debug=1", "", ""), state))
+	assert.False(t, state.Blocked)
+	assert.Equal(t, 4, state.TotalScore)
+	assert.Equal(t, []string{paramSchemaRuleID}, state.MatchedRules)
+
+	state = &WAFState{}
+	assert.True(t, m.checkParamSchema(httptest.NewRecorder(), testRequest("GET", "/search?a=1&b=2&c=3", "", ""), state))
+	assert.True(t, state.Blocked, "violations adding up to the threshold block")
+}
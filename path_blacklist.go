@@ -0,0 +1,158 @@
+package caddywaf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// pathBlacklist matches request paths against exact paths, prefixes and globs.
+// Exact paths and prefixes are looked up in maps, so only globs are tried one by one.
+type pathBlacklist struct {
+	exact      map[string]struct{}
+	prefixes   map[string]struct{}
+	prefixLens []int // Distinct prefix lengths, ascending
+	globs      []string
+}
+
+// add adds a path blacklist entry. An entry ending in * with no other wildcard is a prefix
+// ("/.git/*" blocks everything below /.git/), an entry with wildcards elsewhere is a
+// path.Match glob whose wildcards stay within a segment, and anything else is an exact path.
+func (pb *pathBlacklist) add(entry string) error {
+	if !strings.HasPrefix(entry, "/") {
+		return fmt.Errorf("path blacklist entry must start with /: %s", entry)
+	}
+	if prefix, ok := strings.CutSuffix(entry, "*"); ok && !strings.ContainsAny(prefix, "*?[\\") {
+		if _, exists := pb.prefixes[prefix]; !exists {
+			pb.prefixes[prefix] = struct{}{}
+			if !slices.Contains(pb.prefixLens, len(prefix)) {
+				pb.prefixLens = append(pb.prefixLens, len(prefix))
+				slices.Sort(pb.prefixLens)
+			}
+		}
+		return nil
+	}
+	if strings.ContainsAny(entry, "*?[\\") {
+		if _, err := path.Match(entry, "/"); err != nil {
+			return fmt.Errorf("invalid path blacklist glob %s: %w", entry, err)
+		}
+		pb.globs = append(pb.globs, entry)
+		return nil
+	}
+	pb.exact[entry] = struct{}{}
+	return nil
+}
+
+// match returns the entry matching a request path, if any. The path is cleaned first,
+// so dot segments and repeated slashes don't get around an entry.
+func (pb *pathBlacklist) match(requestPath string) (string, bool) {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	cleaned := path.Clean(requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if _, ok := pb.exact[cleaned]; ok {
+		return cleaned, true
+	}
+	for _, n := range pb.prefixLens {
+		if n > len(cleaned) {
+			break
+		}
+		if _, ok := pb.prefixes[cleaned[:n]]; ok {
+			return cleaned[:n] + "*", true
+		}
+	}
+	for _, glob := range pb.globs {
+		if ok, _ := path.Match(glob, cleaned); ok {
+			return glob, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of entries.
+func (pb *pathBlacklist) Len() int {
+	return len(pb.exact) + len(pb.prefixes) + len(pb.globs)
+}
+
+// readPathBlacklist reads a path blacklist, skipping empty lines, comments and invalid entries.
+func (bl *BlacklistLoader) readPathBlacklist(r io.Reader, filePath string) (*pathBlacklist, error) {
+	pb := &pathBlacklist{exact: make(map[string]struct{}), prefixes: make(map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	validEntries, invalidEntries, totalLines := 0, 0, 0
+	for scanner.Scan() {
+		totalLines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // Skip empty lines and comments
+		}
+		if err := pb.add(line); err != nil {
+			bl.logger.Warn("Invalid entry in path blacklist file",
+				zap.String("path", filePath),
+				zap.Int("line", totalLines),
+				zap.Error(err),
+			)
+			invalidEntries++
+			continue
+		}
+		validEntries++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading path blacklist file: %w", err)
+	}
+
+	bl.logger.Info("Path blacklist loaded",
+		zap.String("path", filePath),
+		zap.Int("valid_entries", validEntries),
+		zap.Int("invalid_entries", invalidEntries),
+		zap.Int("total_lines", totalLines),
+	)
+	return pb, nil
+}
+
+// loadPathBlacklistFromFile loads a path blacklist file.
+func (bl *BlacklistLoader) loadPathBlacklistFromFile(filePath string) (*pathBlacklist, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open path blacklist file: %w", err)
+	}
+	defer file.Close()
+	return bl.readPathBlacklist(file, filePath)
+}
+
+// isPathBlacklisted checks if the request path is in the path blacklist.
+func (m *Middleware) isPathBlacklisted(requestPath string) (string, bool) {
+	m.mu.RLock()
+	blacklist := m.pathBlacklist
+	m.mu.RUnlock()
+	if blacklist == nil {
+		return "", false
+	}
+	entry, ok := blacklist.match(requestPath)
+	if ok {
+		m.pathBlacklistHits.Add(1)
+		m.logger.Debug("Path blacklist hit", zap.String("path", requestPath), zap.String("entry", entry))
+	}
+	return entry, ok
+}
+
+// loadPathBlacklist loads the path blacklist file. A missing file loads no blacklist.
+func (m *Middleware) loadPathBlacklist(filePath string) (*pathBlacklist, error) {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		m.logger.Warn("Skipping path blacklist load, file does not exist", zap.String("file", filePath))
+		return nil, nil
+	}
+	blacklist, err := m.blacklistLoader.loadPathBlacklistFromFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load path blacklist: %w", err)
+	}
+	return blacklist, nil
+}
@@ -0,0 +1,85 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPathBlacklist_Match(t *testing.T) {
+	list := strings.Join([]string{
+		"# Forbidden paths",
+		"/backup.zip",
+		"/.git/*",
+		"/wp-admin*",
+		"/*.sql",
+		"/config/*.bak",
+		"relative/path",
+		"/[invalid",
+	}, "\n")
+	pb, err := NewBlacklistLoader(zap.NewNop()).readPathBlacklist(strings.NewReader(list), "test")
+	require.NoError(t, err)
+	assert.Equal(t, 5, pb.Len())
+
+	tests := []struct {
+		path  string
+		entry string
+	}{
+		{"/backup.zip", "/backup.zip"},
+		{"/backup.zip.txt", ""},
+		{"/.git/config", "/.git/*"},
+		{"/.git/", "/.git/*"},
+		{"/static/../.git/HEAD", "/.git/*"},
+		{"//.git//config", "/.git/*"},
+		{"/.github/workflows", ""},
+		{"/wp-admin/install.php", "/wp-admin*"},
+		{"/dump.sql", "/*.sql"},
+		{"/db/dump.sql", ""},
+		{"/config/app.bak", "/config/*.bak"},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			entry, ok := pb.match(tt.path)
+			assert.Equal(t, tt.entry != "", ok)
+			assert.Equal(t, tt.entry, entry)
+		})
+	}
+}
+
+func TestBlockedRequestPhase1_PathBlacklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paths.txt")
+	require.NoError(t, os.WriteFile(path, []byte("/.env\n/.git/*\n"), 0o600))
+
+	m := &Middleware{
+		logger:          zap.NewNop(),
+		blacklistLoader: NewBlacklistLoader(zap.NewNop()),
+		ipBlacklist:     iptrie.NewTrie(),
+	}
+	var err error
+	m.pathBlacklist, err = m.loadPathBlacklist(path)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, httptest.NewRequest("GET", "http://example.com/.git/config", nil), 1, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusForbidden, state.StatusCode)
+	assert.Equal(t, int64(1), m.pathBlacklistHits.Load())
+
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/index.html", nil), 1, state)
+	assert.False(t, state.Blocked)
+
+	blacklist, err := m.loadPathBlacklist(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NoError(t, err)
+	assert.Nil(t, blacklist)
+}
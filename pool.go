@@ -0,0 +1,71 @@
+package caddywaf
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxPooledBufferSize is the largest buffer returned to a pool, so that a few huge
+// bodies don't pin their memory for the lifetime of the process.
+const maxPooledBufferSize = 1 << 20
+
+var (
+	wafStatePool = sync.Pool{New: func() any { return new(WAFState) }}
+	recorderPool = sync.Pool{New: func() any { return &responseRecorder{body: new(bytes.Buffer)} }}
+	bufferPool   = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// getWAFState returns a zeroed WAFState from the pool. The matched rules slice and
+// the target map keep their capacity from earlier requests.
+func getWAFState() *WAFState {
+	state := wafStatePool.Get().(*WAFState)
+	*state = WAFState{
+		StatusCode:   http.StatusOK,
+		MatchedRules: state.MatchedRules[:0],
+		targets:      state.targets, // Cleared by putWAFState
+	}
+	return state
+}
+
+// putWAFState returns a state to the pool. It must not be used afterwards.
+func putWAFState(state *WAFState) {
+	state.overlay = nil
+	state.geoIP = nil // Lets a replaced GeoIP database be unmapped
+	clear(state.targets)
+	wafStatePool.Put(state)
+}
+
+// getResponseRecorder returns a recorder from the pool wrapping w.
+func getResponseRecorder(w http.ResponseWriter, limit int64) *responseRecorder {
+	recorder := recorderPool.Get().(*responseRecorder)
+	recorder.ResponseWriter = w
+	recorder.limit = limit
+	return recorder
+}
+
+// putResponseRecorder resets a recorder and returns it to the pool, unless its body
+// buffer grew too large to keep. It must not be used afterwards.
+func putResponseRecorder(recorder *responseRecorder) {
+	if recorder.body.Cap() > maxPooledBufferSize {
+		return
+	}
+	recorder.body.Reset()
+	*recorder = responseRecorder{body: recorder.body}
+	recorderPool.Put(recorder)
+}
+
+// readAllPooled reads r to the end through a pooled buffer, allocating only the
+// returned string.
+func readAllPooled(r io.Reader) (string, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			buf.Reset()
+			bufferPool.Put(buf)
+		}
+	}()
+	_, err := buf.ReadFrom(r)
+	return buf.String(), err
+}
@@ -0,0 +1,77 @@
+package caddywaf
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAFStatePool_Reset(t *testing.T) {
+	state := getWAFState()
+	state.TotalScore = 10
+	state.Blocked = true
+	state.MatchedRules = append(state.MatchedRules, "rule1")
+	state.overlay = &HostOverlay{}
+	state.targets = map[string]extractedTarget{"URI": {value: "/"}}
+	state.budget.rules = 3
+	putWAFState(state)
+	assert.Empty(t, state.targets, "extracted values are released")
+	assert.Nil(t, state.overlay)
+
+	// Whichever state the pool hands out next, it must be fresh
+	next := getWAFState()
+	assert.Equal(t, 0, next.TotalScore)
+	assert.False(t, next.Blocked)
+	assert.Equal(t, http.StatusOK, next.StatusCode)
+	assert.Empty(t, next.MatchedRules)
+	assert.Empty(t, next.targets)
+	assert.Zero(t, next.budget)
+	putWAFState(next)
+}
+
+func TestResponseRecorderPool_Reset(t *testing.T) {
+	w := httptest.NewRecorder()
+	recorder := getResponseRecorder(w, 4)
+	_, err := recorder.Write([]byte("streamed body"))
+	require.NoError(t, err)
+	require.True(t, recorder.Streamed())
+	putResponseRecorder(recorder)
+
+	next := getResponseRecorder(httptest.NewRecorder(), 0)
+	assert.Empty(t, next.BodyString())
+	assert.False(t, next.Streamed())
+	assert.Equal(t, http.StatusOK, next.StatusCode())
+	assert.Equal(t, int64(0), next.limit)
+	putResponseRecorder(next)
+
+	// Oversized buffers are left to the garbage collector
+	large := getResponseRecorder(httptest.NewRecorder(), 0)
+	large.body = bytes.NewBuffer(make([]byte, 0, 2*maxPooledBufferSize))
+	putResponseRecorder(large)
+	assert.Equal(t, 2*maxPooledBufferSize, large.body.Cap(), "oversized recorders are not reset for reuse")
+}
+
+func TestReadAllPooled(t *testing.T) {
+	body, err := readAllPooled(strings.NewReader("first body"))
+	require.NoError(t, err)
+	assert.Equal(t, "first body", body)
+
+	// The returned string doesn't share memory with the reused buffer
+	second, err := readAllPooled(strings.NewReader("other"))
+	require.NoError(t, err)
+	assert.Equal(t, "other", second)
+	assert.Equal(t, "first body", body)
+}
+
+func TestWAFStatePool_Allocations(t *testing.T) {
+	putWAFState(getWAFState())
+	allocs := testing.AllocsPerRun(100, func() {
+		putWAFState(getWAFState())
+	})
+	assert.Zero(t, allocs, "pooled states are reused")
+}
@@ -0,0 +1,273 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	quotaRuleID            = "quota_rule"
+	defaultQuotaHeader     = "X-API-Key"
+	defaultQuotaRefresh    = 5 * time.Minute
+	maxQuotaSourceSize     = 16 << 20
+	quotaSourceHTTPTimeout = 30 * time.Second
+)
+
+// QuotaConfig enforces hourly and daily request budgets per API key. Unlike the rate
+// limiter, which throttles bursts per IP, quotas meter the usage of each key wherever its
+// requests come from. Budgets are loaded from a JSON file or URL mapping each key to its
+// budgets, such as {"key": {"hourly": 1000, "daily": 10000}}; zero is unlimited.
+type QuotaConfig struct {
+	Header  string        `json:"header,omitempty"`  // Header holding the API key, default X-API-Key
+	Source  string        `json:"source,omitempty"`  // File path or http(s) URL of the budgets per key
+	Refresh time.Duration `json:"refresh,omitempty"` // Reload interval of the source, default 5m
+	Hourly  int64         `json:"hourly,omitempty"`  // Hourly budget of keys missing from the source, 0 for no limit
+	Daily   int64         `json:"daily,omitempty"`   // Daily budget of keys missing from the source, 0 for no limit
+
+	logger  *zap.Logger
+	client  *http.Client
+	mu      sync.Mutex
+	budgets map[string]QuotaBudget
+	usage   map[string]*quotaUsage
+	pruned  time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// QuotaBudget holds the budgets of an API key.
+type QuotaBudget struct {
+	Hourly int64 `json:"hourly,omitempty"`
+	Daily  int64 `json:"daily,omitempty"`
+}
+
+// quotaUsage counts the requests of a key in the current hour and day, in UTC.
+type quotaUsage struct {
+	hour, day           time.Time
+	hourCount, dayCount int64
+}
+
+// quotaState describes the tightest window of a key after a request.
+type quotaState struct {
+	limit     int64
+	remaining int64
+	reset     time.Time
+	window    string
+}
+
+// provision validates the config, applies the defaults and loads the budgets.
+func (c *QuotaConfig) provision(logger *zap.Logger) error {
+	if c.Source == "" && c.Hourly <= 0 && c.Daily <= 0 {
+		return fmt.Errorf("quota requires a source or a default hourly or daily budget")
+	}
+	if c.Header == "" {
+		c.Header = defaultQuotaHeader
+	}
+	if c.Refresh <= 0 {
+		c.Refresh = defaultQuotaRefresh
+	}
+	c.logger = logger
+	c.client = &http.Client{Timeout: quotaSourceHTTPTimeout}
+	c.usage = make(map[string]*quotaUsage)
+	if c.Source == "" {
+		return nil
+	}
+	return c.reload(context.Background())
+}
+
+// reload reads the budgets from the source, keeping the current ones on failure.
+func (c *QuotaConfig) reload(ctx context.Context) error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(c.Source, "http://") || strings.HasPrefix(c.Source, "https://") {
+		data, err = c.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(c.Source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quota source %s: %w", c.Source, err)
+	}
+	var budgets map[string]QuotaBudget
+	if err := json.Unmarshal(data, &budgets); err != nil {
+		return fmt.Errorf("invalid quota source %s: %w", c.Source, err)
+	}
+	c.mu.Lock()
+	c.budgets = budgets
+	c.mu.Unlock()
+	return nil
+}
+
+// fetch downloads the budgets from a URL source.
+func (c *QuotaConfig) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxQuotaSourceSize))
+}
+
+// Start reloads the budgets from the source every Refresh until Stop is called.
+func (c *QuotaConfig) Start() {
+	if c.Source == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.reload(ctx); err != nil && ctx.Err() == nil {
+					c.logger.Error("Failed to reload quotas, keeping the current budgets", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reloads started by Start.
+func (c *QuotaConfig) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel = nil
+}
+
+// budget returns the budgets of an API key.
+func (c *QuotaConfig) budget(apiKey string) QuotaBudget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if budget, ok := c.budgets[apiKey]; ok {
+		return budget
+	}
+	return QuotaBudget{Hourly: c.Hourly, Daily: c.Daily}
+}
+
+// use counts a request of key against budget unless a window is exhausted. It reports
+// whether the request was counted, and the state of the tightest window.
+func (c *QuotaConfig) use(key string, budget QuotaBudget, now time.Time) (quotaState, bool) {
+	now = now.UTC()
+	hour := now.Truncate(time.Hour)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(day)
+	u, ok := c.usage[key]
+	if !ok {
+		u = &quotaUsage{}
+		c.usage[key] = u
+	}
+	if !u.hour.Equal(hour) {
+		u.hour, u.hourCount = hour, 0
+	}
+	if !u.day.Equal(day) {
+		u.day, u.dayCount = day, 0
+	}
+
+	windows := []quotaState{
+		{limit: budget.Hourly, remaining: budget.Hourly - u.hourCount, reset: hour.Add(time.Hour), window: "hourly"},
+		{limit: budget.Daily, remaining: budget.Daily - u.dayCount, reset: day.AddDate(0, 0, 1), window: "daily"},
+	}
+	var tightest quotaState
+	for _, w := range windows {
+		if w.limit <= 0 {
+			continue
+		}
+		if w.remaining <= 0 {
+			return quotaState{limit: w.limit, reset: w.reset, window: w.window}, false
+		}
+		if tightest.limit == 0 || w.remaining < tightest.remaining {
+			tightest = w
+		}
+	}
+	u.hourCount++
+	u.dayCount++
+	tightest.remaining = max(tightest.remaining-1, 0)
+	return tightest, true
+}
+
+// pruneLocked drops the usage of keys idle since before today. The caller must hold c.mu.
+func (c *QuotaConfig) pruneLocked(day time.Time) {
+	if !day.After(c.pruned) {
+		return
+	}
+	c.pruned = day
+	for key, u := range c.usage {
+		if u.day.Before(day) {
+			delete(c.usage, key)
+		}
+	}
+}
+
+// setQuotaHeaders reports the state of a quota window in the response headers.
+func setQuotaHeaders(h http.Header, state quotaState, now time.Time) {
+	if state.limit <= 0 {
+		return
+	}
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(state.limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(state.remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(state.reset.Unix(), 10))
+	if state.remaining == 0 {
+		h.Set("Retry-After", strconv.FormatInt(int64(state.reset.Sub(now).Seconds()+1), 10))
+	}
+}
+
+// checkQuota counts the request against the budgets of its API key, blocking it with 429
+// once one is exhausted. Requests without an API key are not metered. It reports whether
+// the request was blocked.
+func (m *Middleware) checkQuota(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.Quota
+	if config == nil {
+		return false
+	}
+	apiKey := r.Header.Get(config.Header)
+	if apiKey == "" {
+		return false
+	}
+	budget := config.budget(apiKey)
+	if budget.Hourly <= 0 && budget.Daily <= 0 {
+		return false
+	}
+	now := time.Now()
+	quota, ok := config.use(m.scopedKey(r, apiKey), budget, now)
+	setQuotaHeaders(w.Header(), quota, now)
+	if ok {
+		return false
+	}
+
+	m.quotaHits.Add(1)
+	m.incrementRuleHitCount(RuleID(quotaRuleID))
+	state.MatchedRules = append(state.MatchedRules, quotaRuleID)
+	m.blockRequest(w, r, state, http.StatusTooManyRequests, "quota", quotaRuleID,
+		zap.String("message", "Request blocked by API key quota"),
+		zap.String("window", quota.window),
+		zap.Int64("limit", quota.limit),
+	)
+	return true
+}
@@ -0,0 +1,112 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeQuotaSource(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestQuotaConfig_Use(t *testing.T) {
+	c := &QuotaConfig{Hourly: 1}
+	require.NoError(t, c.provision(zap.NewNop()))
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	budget := QuotaBudget{Hourly: 2, Daily: 3}
+
+	state, ok := c.use("k", budget, now)
+	assert.True(t, ok)
+	assert.Equal(t, quotaState{limit: 2, remaining: 1, reset: now.Truncate(time.Hour).Add(time.Hour), window: "hourly"}, state)
+	_, ok = c.use("k", budget, now)
+	assert.True(t, ok)
+	state, ok = c.use("k", budget, now)
+	assert.False(t, ok, "hourly budget exhausted")
+	assert.Equal(t, "hourly", state.window)
+
+	state, ok = c.use("k", budget, now.Add(time.Hour))
+	assert.True(t, ok, "a new hour")
+	assert.Equal(t, "daily", state.window)
+	assert.Zero(t, state.remaining)
+	state, ok = c.use("k", budget, now.Add(time.Hour))
+	assert.False(t, ok, "daily budget exhausted")
+	assert.Equal(t, time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), state.reset)
+
+	_, ok = c.use("k", budget, now.Add(24*time.Hour))
+	assert.True(t, ok, "a new day")
+	_, ok = c.use("other", budget, now)
+	assert.True(t, ok, "keys are counted separately")
+}
+
+func TestCheckQuota(t *testing.T) {
+	config := &QuotaConfig{Source: writeQuotaSource(t, `{"gold": {"hourly": 2}, "free": {}}`), Daily: 1}
+	require.NoError(t, config.provision(zap.NewNop()))
+	m := &Middleware{logger: zap.NewNop(), Quota: config}
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		m.checkQuota(w, req, &WAFState{})
+		return w
+	}
+
+	w := send("gold")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	send("gold")
+	w = send("gold")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.NotEmpty(t, w.Header().Get("X-RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, send("unknown").Code, "default daily budget")
+	assert.Equal(t, http.StatusTooManyRequests, send("unknown").Code)
+	for range 3 {
+		w = send("free")
+		assert.Equal(t, http.StatusOK, w.Code, "empty budgets are unlimited")
+		assert.Empty(t, w.Header().Get("X-RateLimit-Limit"))
+	}
+	assert.Equal(t, http.StatusOK, send("").Code, "requests without a key are not metered")
+	assert.Equal(t, int64(2), m.quotaHits.Load())
+}
+
+func TestQuotaConfig_Reload(t *testing.T) {
+	var budgets atomic.Value
+	budgets.Store(`{"a": {"daily": 5}}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(budgets.Load().(string)))
+	}))
+	defer server.Close()
+
+	config := &QuotaConfig{Source: server.URL, Refresh: 10 * time.Millisecond}
+	require.NoError(t, config.provision(zap.NewNop()))
+	assert.Equal(t, QuotaBudget{Daily: 5}, config.budget("a"))
+
+	config.Start()
+	defer config.Stop()
+	budgets.Store("not json")
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, QuotaBudget{Daily: 5}, config.budget("a"), "invalid sources keep the current budgets")
+}
+
+func TestQuotaConfig_ProvisionErrors(t *testing.T) {
+	assert.Error(t, (&QuotaConfig{}).provision(zap.NewNop()))
+	assert.Error(t, (&QuotaConfig{Source: filepath.Join(t.TempDir(), "missing.json")}).provision(zap.NewNop()))
+	assert.Error(t, (&QuotaConfig{Source: writeQuotaSource(t, `["a"]`)}).provision(zap.NewNop()))
+}
@@ -22,6 +22,9 @@ type RateLimit struct {
 	Paths           []string         `json:"paths,omitempty"` // Optional paths to apply rate limit
 	PathRegexes     []*regexp.Regexp `json:"-"`               // Compiled regexes for the given paths
 	MatchAllPaths   bool             `json:"match_all_paths,omitempty"`
+	ActiveHours     string           `json:"active_hours,omitempty"` // Times of day the rate limit applies
+	ActiveDays      []string         `json:"active_days,omitempty"`  // Days the rate limit applies
+	schedule        *timeWindow
 }
 
 // RateLimiter struct
@@ -29,10 +32,30 @@ type RateLimiter struct {
 	sync.RWMutex
 	requests        map[string]map[string]*requestCounter // Nested map for path-based rate limiting
 	config          RateLimit
-	stopCleanup     chan struct{} // Channel to signal cleanup goroutine to stop
-	totalRequests   int64         // Total requests received by this rate limiter
-	blockedRequests int64         // Total requests blocked by this rate limiter
-	muMetrics       sync.RWMutex  // Mutex to protect metrics access
+	stopCleanup     chan struct{}    // Channel to signal cleanup goroutine to stop
+	totalRequests   int64            // Total requests received by this rate limiter
+	blockedRequests int64            // Total requests blocked by this rate limiter
+	zoneRequests    map[string]int64 // Requests per configured path (zone)
+	zoneBlocked     map[string]int64 // Blocked requests per configured path (zone)
+	muMetrics       sync.RWMutex     // Mutex to protect metrics access
+
+	deltas map[string]map[string]int // Local increments not yet shared with the cluster, nil unless clustered
+}
+
+// RateLimitDelta is the number of requests a node counted for a key since its last cluster sync.
+type RateLimitDelta struct {
+	IP    string `json:"ip"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// allPathsZone is the zone label used when the rate limit is not restricted to paths.
+const allPathsZone = "*"
+
+// ZoneMetrics are the rate limiter counters of a single path zone.
+type ZoneMetrics struct {
+	Requests int64 `json:"requests"`
+	Blocked  int64 `json:"blocked"`
 }
 
 // NewRateLimiter creates a new RateLimiter instance.
@@ -50,9 +73,11 @@ func NewRateLimiter(config RateLimit) (*RateLimiter, error) {
 	}
 
 	return &RateLimiter{
-		requests:    make(map[string]map[string]*requestCounter),
-		config:      config,
-		stopCleanup: make(chan struct{}), // Initialize the stopCleanup channel
+		requests:     make(map[string]map[string]*requestCounter),
+		config:       config,
+		stopCleanup:  make(chan struct{}), // Initialize the stopCleanup channel
+		zoneRequests: make(map[string]int64),
+		zoneBlocked:  make(map[string]int64),
 	}, nil
 }
 
@@ -66,15 +91,17 @@ func (rl *RateLimiter) isRateLimited(ip, path string) bool {
 	rl.incrementTotalRequestsMetric() // Increment the total requests received
 
 	var key string
+	zone := allPathsZone
 	if rl.config.MatchAllPaths {
 		key = ip
 	} else {
 		// Check if path is matching
 		if len(rl.config.PathRegexes) > 0 {
 			matched := false
-			for _, regex := range rl.config.PathRegexes {
+			for i, regex := range rl.config.PathRegexes {
 				if regex.MatchString(path) {
 					matched = true
+					zone = rl.config.Paths[i]
 					break
 				}
 			}
@@ -84,6 +111,13 @@ func (rl *RateLimiter) isRateLimited(ip, path string) bool {
 		}
 		key = ip + path
 	}
+	rl.incrementZoneMetric(zone, false)
+	if rl.deltas != nil {
+		if _, exists := rl.deltas[ip]; !exists {
+			rl.deltas[ip] = make(map[string]int)
+		}
+		rl.deltas[ip][key]++
+	}
 
 	// Initialize the nested map if it doesn't exist
 	if _, exists := rl.requests[ip]; !exists {
@@ -103,6 +137,7 @@ func (rl *RateLimiter) isRateLimited(ip, path string) bool {
 		counter.count++
 		if counter.count > rl.config.Requests {
 			rl.incrementBlockedRequestsMetric() // Increment if the request is going to be blocked.
+			rl.incrementZoneMetric(zone, true)
 			return true
 		}
 		return false
@@ -167,6 +202,50 @@ func (rl *RateLimiter) signalStopCleanup() {
 	}
 }
 
+// enableDeltas starts recording local increments for cluster synchronization.
+func (rl *RateLimiter) enableDeltas() {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.deltas == nil {
+		rl.deltas = make(map[string]map[string]int)
+	}
+}
+
+// drainDeltas returns and clears the increments recorded since the last call.
+func (rl *RateLimiter) drainDeltas() []RateLimitDelta {
+	rl.Lock()
+	defer rl.Unlock()
+	var deltas []RateLimitDelta
+	for ip, keys := range rl.deltas {
+		for key, count := range keys {
+			deltas = append(deltas, RateLimitDelta{IP: ip, Key: key, Count: count})
+		}
+		delete(rl.deltas, ip)
+	}
+	return deltas
+}
+
+// applyRemoteDeltas adds the requests counted by other nodes to the local counters.
+func (rl *RateLimiter) applyRemoteDeltas(deltas []RateLimitDelta) {
+	now := time.Now()
+	rl.Lock()
+	defer rl.Unlock()
+	for _, d := range deltas {
+		if d.Count <= 0 {
+			continue
+		}
+		if _, exists := rl.requests[d.IP]; !exists {
+			rl.requests[d.IP] = make(map[string]*requestCounter)
+		}
+		counter, exists := rl.requests[d.IP][d.Key]
+		if !exists || now.Sub(counter.window) > rl.config.Window {
+			rl.requests[d.IP][d.Key] = &requestCounter{count: d.Count, window: now}
+			continue
+		}
+		counter.count += d.Count
+	}
+}
+
 // GetTotalRequests returns the total number of requests received by this rate limiter.
 func (rl *RateLimiter) GetTotalRequests() int64 {
 	rl.muMetrics.RLock()
@@ -181,6 +260,42 @@ func (rl *RateLimiter) GetBlockedRequests() int64 {
 	return rl.blockedRequests
 }
 
+// GetZoneMetrics returns the request and blocked counters per configured path.
+func (rl *RateLimiter) GetZoneMetrics() map[string]ZoneMetrics {
+	rl.muMetrics.RLock()
+	defer rl.muMetrics.RUnlock()
+	zones := make(map[string]ZoneMetrics, len(rl.zoneRequests))
+	for zone, requests := range rl.zoneRequests {
+		zones[zone] = ZoneMetrics{Requests: requests, Blocked: rl.zoneBlocked[zone]}
+	}
+	return zones
+}
+
+// resetMetrics clears the request counters.
+func (rl *RateLimiter) resetMetrics() {
+	rl.muMetrics.Lock()
+	defer rl.muMetrics.Unlock()
+	rl.totalRequests = 0
+	rl.blockedRequests = 0
+	rl.zoneRequests = make(map[string]int64)
+	rl.zoneBlocked = make(map[string]int64)
+}
+
+// incrementZoneMetric counts a rate-limited or blocked request for a path zone.
+func (rl *RateLimiter) incrementZoneMetric(zone string, blocked bool) {
+	rl.muMetrics.Lock()
+	defer rl.muMetrics.Unlock()
+	if rl.zoneRequests == nil {
+		rl.zoneRequests = make(map[string]int64)
+		rl.zoneBlocked = make(map[string]int64)
+	}
+	if blocked {
+		rl.zoneBlocked[zone]++
+		return
+	}
+	rl.zoneRequests[zone]++
+}
+
 // incrementTotalRequestsMetric increments the total requests counter
 func (rl *RateLimiter) incrementTotalRequestsMetric() {
 	rl.muMetrics.Lock()
@@ -421,3 +421,64 @@ func TestBlockedRequestPhase1_RateLimiting(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, w2.Code, "Expected status code 429")
 	assert.Contains(t, w2.Body.String(), "Rate limit exceeded", "Response body should contain 'Rate limit exceeded'")
 }
+
+func TestRateLimiter_ZoneMetrics(t *testing.T) {
+	config := RateLimit{
+		Requests:        1,
+		Window:          time.Minute,
+		CleanupInterval: time.Minute,
+		Paths:           []string{"/api/.*", "/login"},
+	}
+
+	rl, err := NewRateLimiter(config)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+
+	rl.isRateLimited("192.168.1.1", "/api/a")
+	rl.isRateLimited("192.168.1.1", "/api/a") // Blocked
+	rl.isRateLimited("192.168.1.1", "/login")
+	rl.isRateLimited("192.168.1.1", "/other") // Not rate limited, not counted
+
+	zones := rl.GetZoneMetrics()
+	assert.Equal(t, ZoneMetrics{Requests: 2, Blocked: 1}, zones["/api/.*"])
+	assert.Equal(t, ZoneMetrics{Requests: 1, Blocked: 0}, zones["/login"])
+	assert.Len(t, zones, 2)
+
+	rl.resetMetrics()
+	assert.Empty(t, rl.GetZoneMetrics())
+}
+
+func TestRateLimiter_ZoneMetrics_MatchAllPaths(t *testing.T) {
+	rl, err := NewRateLimiter(RateLimit{Requests: 1, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+
+	rl.isRateLimited("192.168.1.1", "/a")
+	rl.isRateLimited("192.168.1.1", "/b")
+	assert.Equal(t, ZoneMetrics{Requests: 2, Blocked: 1}, rl.GetZoneMetrics()[allPathsZone])
+}
+
+func TestRateLimiter_Deltas(t *testing.T) {
+	rl, err := NewRateLimiter(RateLimit{Requests: 3, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	rl.isRateLimited("192.168.1.1", "/")
+	assert.Empty(t, rl.drainDeltas(), "deltas are only recorded when enabled")
+
+	rl.enableDeltas()
+	rl.isRateLimited("192.168.1.1", "/")
+	rl.isRateLimited("192.168.1.1", "/")
+	assert.Equal(t, []RateLimitDelta{{IP: "192.168.1.1", Key: "192.168.1.1", Count: 2}}, rl.drainDeltas())
+	assert.Empty(t, rl.drainDeltas())
+
+	// Requests counted by other nodes count toward the local limit
+	other, err := NewRateLimiter(RateLimit{Requests: 3, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	other.applyRemoteDeltas([]RateLimitDelta{{IP: "192.168.1.1", Key: "192.168.1.1", Count: 3}})
+	assert.True(t, other.isRateLimited("192.168.1.1", "/"))
+}
@@ -0,0 +1,187 @@
+package caddywaf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	replayRuleID         = "replay_rule"
+	defaultReplayTTL     = 5 * time.Minute
+	defaultReplayMaxKeys = 100000
+)
+
+// ReplayConfig detects duplicates of requests to a path, such as a payment or webhook
+// delivery submitted twice. Requests are identified by a client-supplied nonce header, or
+// by a hash of their method, URI and body.
+type ReplayConfig struct {
+	Path        string        `json:"path"`                   // Exact path or a prefix ending in *
+	Methods     []string      `json:"methods,omitempty"`      // Methods checked, default POST
+	NonceHeader string        `json:"nonce_header,omitempty"` // Header identifying a request, requests without it are hashed
+	TTL         time.Duration `json:"ttl,omitempty"`          // How long a request is remembered, default 5m
+	MaxKeys     int           `json:"max_keys,omitempty"`     // Requests remembered at most, default 100000
+	Action      string        `json:"action,omitempty"`       // block (default) or score
+	Score       int           `json:"score,omitempty"`        // Score added with the score action, default 5
+
+	RequireNonce bool               `json:"require_nonce,omitempty"` // Block the requests without nonce_header with 400
+	Redis        *ReplayRedisConfig `json:"redis,omitempty"`         // Remembers the requests in Redis, shared by all instances
+
+	seen *lookupCache[struct{}]
+}
+
+// provision validates the config and applies the defaults.
+func (c *ReplayConfig) provision() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("replay path must start with /: %s", c.Path)
+	}
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid replay action: %s, must be block or score", c.Action)
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{http.MethodPost}
+	}
+	for i := range c.Methods {
+		c.Methods[i] = strings.ToUpper(c.Methods[i])
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultReplayTTL
+	}
+	if c.MaxKeys <= 0 {
+		c.MaxKeys = defaultReplayMaxKeys
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	if c.RequireNonce && c.NonceHeader == "" {
+		return fmt.Errorf("replay require_nonce requires a nonce_header")
+	}
+	if c.Redis != nil {
+		if err := c.Redis.provision(); err != nil {
+			return err
+		}
+	}
+	c.seen = newLookupCache[struct{}](c.MaxKeys, c.TTL)
+	return nil
+}
+
+// matches reports whether a request is checked for replays.
+func (c *ReplayConfig) matches(r *http.Request) bool {
+	if !slices.Contains(c.Methods, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(c.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == c.Path
+}
+
+// remember remembers a request key, reporting whether it was not seen yet. With Redis, the
+// local cache stands in while Redis fails, unless failing closed, which returns the error.
+func (c *ReplayConfig) remember(key string, logger *zap.Logger) (bool, error) {
+	if c.Redis != nil {
+		added, err := c.Redis.add(key, c.TTL)
+		if err == nil {
+			return added, nil
+		}
+		if c.Redis.FailClosed {
+			return false, err
+		}
+		logger.Warn("Replay store unavailable, using the local cache", zap.String("address", c.Redis.Address), zap.Error(err))
+	}
+	return c.seen.Add(key, struct{}{}), nil
+}
+
+// forget forgets a request key.
+func (c *ReplayConfig) forget(key string, logger *zap.Logger) {
+	c.seen.Delete(key)
+	if c.Redis != nil {
+		if err := c.Redis.delete(key); err != nil {
+			logger.Warn("Failed to forget a replayed request", zap.String("address", c.Redis.Address), zap.Error(err))
+		}
+	}
+}
+
+// replayFor returns the first replay config matching the request, or nil.
+func (m *Middleware) replayFor(r *http.Request) *ReplayConfig {
+	for _, config := range m.Replay {
+		if config.matches(r) {
+			return config
+		}
+	}
+	return nil
+}
+
+// replayKey returns the key identifying a request: its nonce, or the digest of its method,
+// URI and body.
+func (m *Middleware) replayKey(r *http.Request, state *WAFState, config *ReplayConfig) string {
+	if config.NonceHeader != "" {
+		if nonce := r.Header.Get(config.NonceHeader); nonce != "" {
+			return m.scopedKey(r, "nonce:"+nonce)
+		}
+	}
+	body, _ := m.extractTarget(TargetBody, r, nil, state)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write([]byte(body))
+	return m.scopedKey(r, "sha256:"+hex.EncodeToString(h.Sum(nil)))
+}
+
+// checkReplay remembers the request and acts on duplicates of a request seen within the
+// TTL. It reports whether the request was blocked.
+func (m *Middleware) checkReplay(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.replayFor(r)
+	if config == nil || config.seen == nil {
+		return false
+	}
+	if config.RequireNonce && r.Header.Get(config.NonceHeader) == "" {
+		m.replayHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusBadRequest, "replay", replayRuleID,
+			zap.String("message", "Request blocked for missing its nonce"),
+			zap.String("nonce_header", config.NonceHeader),
+		)
+		return true
+	}
+	key := m.replayKey(r, state, config)
+	added, err := config.remember(key, m.logger)
+	if err != nil {
+		m.replayHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusServiceUnavailable, "replay", replayRuleID,
+			zap.String("message", "Request blocked as the replay store is unavailable"),
+			zap.String("address", config.Redis.Address),
+			zap.Error(err),
+		)
+		return true
+	}
+	if added {
+		state.replayKey = key
+		return false
+	}
+
+	m.replayHits.Add(1)
+	m.incrementRuleHitCount(RuleID(replayRuleID))
+	state.MatchedRules = append(state.MatchedRules, replayRuleID)
+	return m.applyDetection(w, r, state, config.Action, config.Score, http.StatusConflict, "replay", replayRuleID,
+		"Replayed request detected", zap.String("path", r.URL.Path))
+}
+
+// recordReplayOutcome forgets a request the upstream failed to handle, so that the client
+// can retry it.
+func (m *Middleware) recordReplayOutcome(r *http.Request, state *WAFState, statusCode int) {
+	if state.replayKey == "" || statusCode < http.StatusInternalServerError {
+		return
+	}
+	if config := m.replayFor(r); config != nil {
+		config.forget(state.replayKey, m.logger)
+	}
+}
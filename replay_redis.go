@@ -0,0 +1,104 @@
+package caddywaf
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplayRedisPrefix = "caddy-waf:replay:" // Prefixes the keys of the requests remembered in Redis
+	replayRedisMaxIdle       = 8                   // Idle connections kept for the next commands
+)
+
+// ReplayRedisConfig shares the requests remembered by replay between the instances of the
+// WAF through Redis, so a webhook delivery replayed to another instance is caught too.
+type ReplayRedisConfig struct {
+	Address    string `json:"address"`               // Redis host:port
+	Password   string `json:"password,omitempty"`    // Redis AUTH password
+	Prefix     string `json:"prefix,omitempty"`      // Prefix of the keys, default caddy-waf:replay:
+	FailClosed bool   `json:"fail_closed,omitempty"` // Block the requests while Redis fails, rather than use the local cache
+
+	mu     sync.Mutex
+	idle   []*redisConn // Connections between commands, each used by one command at a time
+	closed bool
+}
+
+// provision applies the defaults.
+func (c *ReplayRedisConfig) provision() error {
+	if c.Address == "" {
+		return fmt.Errorf("replay redis requires an address")
+	}
+	if c.Prefix == "" {
+		c.Prefix = defaultReplayRedisPrefix
+	}
+	return nil
+}
+
+// command runs a Redis command on an idle connection, or a new one. A connection that fails
+// is dropped, the next command dialing again. The command isn't retried, as SET NX could have
+// been applied before the failure.
+func (c *ReplayRedisConfig) command(args ...string) (interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.command(args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, nil
+}
+
+// get takes an idle connection, or dials one.
+func (c *ReplayRedisConfig) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+	return connectRedis(c.Address, c.Password)
+}
+
+// put keeps a connection for the next commands, closing it past replayRedisMaxIdle.
+func (c *ReplayRedisConfig) put(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= replayRedisMaxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// add remembers a key for ttl, reporting whether it was not remembered yet.
+func (c *ReplayRedisConfig) add(key string, ttl time.Duration) (bool, error) {
+	reply, err := c.command("SET", c.Prefix+key, "1", "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil // Redis replies nil when the key exists
+}
+
+// delete forgets a key.
+func (c *ReplayRedisConfig) delete(key string) error {
+	_, err := c.command("DEL", c.Prefix+key)
+	return err
+}
+
+// close closes the idle connections, and the others once their command completes.
+func (c *ReplayRedisConfig) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	c.closed = true
+}
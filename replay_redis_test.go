@@ -0,0 +1,99 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCheckReplay_Redis(t *testing.T) {
+	broker := newFakeBroker(t, serveRedis)
+	instance := func() *Middleware {
+		config := &ReplayConfig{Path: "/webhook", NonceHeader: "X-Delivery-ID", Redis: &ReplayRedisConfig{Address: broker.ln.Addr().String(), Password: "pw"}}
+		require.NoError(t, config.provision())
+		return &Middleware{
+			logger:                zap.NewNop(),
+			Replay:                []*ReplayConfig{config},
+			requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		}
+	}
+	first, second := instance(), instance()
+	deliver := func(m *Middleware, nonce string) (*http.Request, *WAFState, bool) {
+		req := testRequest(http.MethodPost, "/webhook", "application/json", `{"event":1}`)
+		req.Header.Set("X-Delivery-ID", nonce)
+		state := &WAFState{}
+		return req, state, m.checkReplay(httptest.NewRecorder(), req, state)
+	}
+
+	_, _, blocked := deliver(first, "d1")
+	assert.False(t, blocked)
+	_, _, blocked = deliver(second, "d1")
+	assert.True(t, blocked, "a delivery replayed to another instance")
+	assert.Equal(t, "pw", broker.auth)
+
+	req, state, blocked := deliver(second, "d2")
+	require.False(t, blocked)
+	second.recordReplayOutcome(req, state, http.StatusServiceUnavailable)
+	_, _, blocked = deliver(first, "d2")
+	assert.False(t, blocked, "a failed delivery is forgotten by all instances")
+
+	for _, config := range first.Replay {
+		config.Redis.close()
+	}
+	broker.ln.Close()
+	_, _, blocked = deliver(first, "d3")
+	assert.False(t, blocked)
+	_, _, blocked = deliver(first, "d3")
+	assert.True(t, blocked, "the local cache stands in while Redis fails")
+}
+
+func TestCheckReplay_RedisFailClosed(t *testing.T) {
+	broker := newFakeBroker(t, serveRedis)
+	config := &ReplayConfig{Path: "/webhook", NonceHeader: "X-Delivery-ID", Redis: &ReplayRedisConfig{Address: broker.ln.Addr().String(), FailClosed: true}}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		Replay:                []*ReplayConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	deliver := func(nonce string) (*httptest.ResponseRecorder, bool) {
+		req := testRequest(http.MethodPost, "/webhook", "application/json", `{"event":1}`)
+		req.Header.Set("X-Delivery-ID", nonce)
+		w := httptest.NewRecorder()
+		return w, m.checkReplay(w, req, &WAFState{})
+	}
+
+	// Concurrent deliveries share the pooled connections
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, blocked := deliver("c" + strconv.Itoa(i))
+			assert.False(t, blocked)
+		}()
+	}
+	wg.Wait()
+	config.Redis.mu.Lock()
+	assert.LessOrEqual(t, len(config.Redis.idle), replayRedisMaxIdle)
+	config.Redis.mu.Unlock()
+
+	config.Redis.close()
+	broker.ln.Close()
+	w, blocked := deliver("d1")
+	assert.True(t, blocked, "requests are blocked while Redis fails")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestReplayRedisConfig_Provision(t *testing.T) {
+	config := &ReplayRedisConfig{Address: "127.0.0.1:6379"}
+	require.NoError(t, config.provision())
+	assert.Equal(t, defaultReplayRedisPrefix, config.Prefix)
+	assert.Error(t, (&ReplayRedisConfig{}).provision())
+}
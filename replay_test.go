@@ -0,0 +1,125 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCheckReplay_BodyHash(t *testing.T) {
+	config := &ReplayConfig{Path: "/payments/*"}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		Replay:                []*ReplayConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	send := func(target, body string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		return w, m.checkReplay(w, testRequest(http.MethodPost, target, "application/json", body), &WAFState{})
+	}
+
+	_, blocked := send("/payments/charge", `{"amount":10}`)
+	assert.False(t, blocked)
+	w, blocked := send("/payments/charge", `{"amount":10}`)
+	assert.True(t, blocked, "exact duplicate")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	_, blocked = send("/payments/charge", `{"amount":11}`)
+	assert.False(t, blocked, "different body")
+	_, blocked = send("/payments/charge?retry=1", `{"amount":10}`)
+	assert.False(t, blocked, "different query")
+	_, blocked = send("/orders", `{"amount":10}`)
+	assert.False(t, blocked, "other paths are not checked")
+	assert.False(t, m.checkReplay(httptest.NewRecorder(), testRequest(http.MethodGet, "/payments/charge", "", ""), &WAFState{}))
+	assert.Equal(t, int64(1), m.replayHits.Load())
+}
+
+func TestCheckReplay_Nonce(t *testing.T) {
+	config := &ReplayConfig{Path: "/webhook", NonceHeader: "X-Nonce", Action: detectionActionScore, Score: 3}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		Replay:                []*ReplayConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.AnomalyThreshold = 5
+	send := func(nonce, body string, state *WAFState) bool {
+		req := testRequest(http.MethodPost, "/webhook", "application/json", body)
+		req.Header.Set("X-Nonce", nonce)
+		return m.checkReplay(httptest.NewRecorder(), req, state)
+	}
+
+	assert.False(t, send("n1", `{"event":1}`, &WAFState{}))
+	assert.False(t, send("n2", `{"event":1}`, &WAFState{}), "same body with a new nonce")
+
+	state := &WAFState{}
+	assert.False(t, send("n1", `{"event":2}`, state), "below the anomaly threshold")
+	assert.Equal(t, 3, state.TotalScore)
+	assert.Equal(t, []string{replayRuleID}, state.MatchedRules)
+
+	state = &WAFState{TotalScore: 2}
+	assert.True(t, send("n1", `{"event":3}`, state))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusConflict, state.StatusCode)
+}
+
+func TestRecordReplayOutcome(t *testing.T) {
+	config := &ReplayConfig{Path: "/payments", TTL: time.Minute}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		Replay:                []*ReplayConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	attempt := func(status int) bool {
+		req := testRequest(http.MethodPost, "/payments", "application/json", `{"amount":10}`)
+		state := &WAFState{}
+		if m.checkReplay(httptest.NewRecorder(), req, state) {
+			return false
+		}
+		m.recordReplayOutcome(req, state, status)
+		return true
+	}
+
+	assert.True(t, attempt(http.StatusBadGateway))
+	assert.True(t, attempt(http.StatusOK), "a failed request can be retried")
+	assert.False(t, attempt(http.StatusOK), "a handled request can't")
+}
+
+func TestReplayConfig_Provision(t *testing.T) {
+	config := &ReplayConfig{Path: "/pay", Methods: []string{"put"}}
+	require.NoError(t, config.provision())
+	assert.Equal(t, []string{http.MethodPut}, config.Methods)
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultReplayTTL, config.TTL)
+
+	assert.Error(t, (&ReplayConfig{Path: "pay"}).provision())
+	assert.Error(t, (&ReplayConfig{Path: "/pay", Action: "challenge"}).provision())
+}
+
+func TestCheckReplay_RequireNonce(t *testing.T) {
+	config := &ReplayConfig{Path: "/webhook", NonceHeader: "X-Delivery-ID", RequireNonce: true}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		Replay:                []*ReplayConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkReplay(w, testRequest(http.MethodPost, "/webhook", "application/json", `{"event":1}`), state))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, replayRuleID, state.blockRuleID)
+
+	req := testRequest(http.MethodPost, "/webhook", "application/json", `{"event":1}`)
+	req.Header.Set("X-Delivery-ID", "d1")
+	assert.False(t, m.checkReplay(httptest.NewRecorder(), req, &WAFState{}))
+
+	assert.Error(t, (&ReplayConfig{Path: "/webhook", RequireNonce: true}).provision())
+}
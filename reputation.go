@@ -0,0 +1,248 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	reputationRuleID           = "reputation_rule"
+	maxReputationScore         = 100
+	defaultReputationTimeout   = 500 * time.Millisecond
+	defaultReputationCacheTTL  = 10 * time.Minute
+	defaultReputationCacheSize = 100000
+)
+
+// ReputationProvider looks up the reputation of an IP, typically in a threat intelligence
+// service. Providers are Caddy modules in the http.handlers.waf.reputation namespace, so
+// they can be compiled in with xcaddy and configured like the built-in ones.
+type ReputationProvider interface {
+	Lookup(ctx context.Context, ip netip.Addr) (Reputation, error)
+}
+
+// Reputation is the verdict of a provider on an IP.
+type Reputation struct {
+	Score      int      `json:"score"`                // 0 (clean) to 100 (malicious)
+	Categories []string `json:"categories,omitempty"` // Such as botnet, scanner or spam
+}
+
+// ReputationConfig queries reputation providers for client IPs, exposing their verdict to
+// rules and acting on IPs whose score reaches a threshold or that are in a category.
+type ReputationConfig struct {
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=http.handlers.waf.reputation inline_key=provider"`
+	Timeout      time.Duration     `json:"timeout,omitempty"`    // Time allowed for the lookups of a request, default 500ms
+	CacheTTL     time.Duration     `json:"cache_ttl,omitempty"`  // How long verdicts are cached, default 10m
+	CacheSize    int               `json:"cache_size,omitempty"` // Verdicts cached at most, default 100000
+	Threshold    int               `json:"threshold,omitempty"`  // Score acted on, 0 to only expose the targets
+	Categories   []string          `json:"categories,omitempty"` // Categories acted on whatever the score
+	Action       string            `json:"action,omitempty"`     // block (default), score or challenge
+	Score        int               `json:"score,omitempty"`      // Score added with the score action, default 5
+
+	logger    *zap.Logger
+	providers []ReputationProvider
+	cache     *lookupCache[Reputation]
+}
+
+// provision validates the config, applies the defaults and loads the provider modules.
+func (c *ReputationConfig) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if len(c.ProvidersRaw) == 0 {
+		return fmt.Errorf("reputation requires a provider")
+	}
+	if c.Threshold < 0 || c.Threshold > maxReputationScore {
+		return fmt.Errorf("invalid reputation threshold %d, must be between 0 and %d", c.Threshold, maxReputationScore)
+	}
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore, credentialActionChallenge:
+	default:
+		return fmt.Errorf("invalid reputation action: %s, must be block, score or challenge", c.Action)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultReputationTimeout
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultReputationCacheTTL
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = defaultReputationCacheSize
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	for i := range c.Categories {
+		c.Categories[i] = strings.ToLower(c.Categories[i])
+	}
+
+	c.providers = c.providers[:0]
+	for i, raw := range c.ProvidersRaw {
+		provider, err := loadReputationProvider(ctx, raw)
+		if err != nil {
+			return fmt.Errorf("loading reputation provider %d: %w", i, err)
+		}
+		c.providers = append(c.providers, provider)
+	}
+	c.logger = logger
+	c.cache = newLookupCache[Reputation](c.CacheSize, c.CacheTTL)
+	return nil
+}
+
+// loadReputationProvider loads a reputation provider module from its JSON config.
+func loadReputationProvider(ctx caddy.Context, raw json.RawMessage) (ReputationProvider, error) {
+	mod, name, err := loadProviderModule(ctx, "http.handlers.waf.reputation", raw)
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := mod.(ReputationProvider)
+	if !ok {
+		return nil, fmt.Errorf("module %s is not a reputation provider", name)
+	}
+	return provider, nil
+}
+
+// loadProviderModule loads a module of a namespace from its JSON config, named by its
+// provider key. Modules are loaded by ID rather than with ctx.LoadModule, whose reflection
+// doesn't recognize json.RawMessage when it is an alias of jsontext.Value, as in Go 1.27.
+func loadProviderModule(ctx caddy.Context, namespace string, raw json.RawMessage) (any, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, "", err
+	}
+	var name string
+	if err := json.Unmarshal(fields["provider"], &name); err != nil || name == "" {
+		return nil, "", fmt.Errorf("missing provider name")
+	}
+	delete(fields, "provider")
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	mod, err := ctx.LoadModuleByID(namespace+"."+name, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	return mod, name, nil
+}
+
+// lookup returns the combined verdict of the providers on ip: the highest score and all
+// the categories. Failing providers are skipped, and the verdict is only cached when at
+// least one provider answered.
+func (c *ReputationConfig) lookup(ctx context.Context, ip string) Reputation {
+	if cached, ok := c.cache.Get(ip); ok {
+		return cached
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Reputation{}
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var combined Reputation
+	answered := false
+	for _, provider := range c.providers {
+		reputation, err := provider.Lookup(ctx, addr.Unmap())
+		if err != nil {
+			c.logger.Warn("Reputation lookup failed",
+				zap.String("provider", fmt.Sprintf("%T", provider)),
+				zap.String("ip", ip),
+				zap.Error(err),
+			)
+			continue
+		}
+		answered = true
+		combined.Score = max(combined.Score, min(max(reputation.Score, 0), maxReputationScore))
+		for _, category := range reputation.Categories {
+			category = strings.ToLower(category)
+			if !slices.Contains(combined.Categories, category) {
+				combined.Categories = append(combined.Categories, category)
+			}
+		}
+	}
+	slices.Sort(combined.Categories)
+	if answered {
+		c.cache.Set(ip, combined)
+	}
+	return combined
+}
+
+// flagged reports whether a verdict is acted on, and why.
+func (c *ReputationConfig) flagged(reputation Reputation) (string, bool) {
+	if c.Threshold > 0 && reputation.Score >= c.Threshold {
+		return "score " + strconv.Itoa(reputation.Score), true
+	}
+	for _, category := range reputation.Categories {
+		if slices.Contains(c.Categories, category) {
+			return "category " + category, true
+		}
+	}
+	return "", false
+}
+
+// reputation returns the verdict on the client IP, memoized as the REPUTATION_SCORE and
+// REPUTATION_CATEGORIES targets.
+func (m *Middleware) reputation(r *http.Request, state *WAFState) Reputation {
+	if m.Reputation == nil || m.Reputation.cache == nil {
+		return Reputation{}
+	}
+	if cached, ok := state.targets[TargetReputationScore]; ok {
+		score, _ := strconv.Atoi(cached.value)
+		categories := state.targets[TargetReputationCategories].value
+		if categories == "" {
+			return Reputation{Score: score}
+		}
+		return Reputation{Score: score, Categories: strings.Split(categories, ",")}
+	}
+	reputation := m.Reputation.lookup(r.Context(), extractIP(r.RemoteAddr))
+	if state.targets == nil {
+		state.targets = make(map[string]extractedTarget)
+	}
+	state.targets[TargetReputationScore] = extractedTarget{value: strconv.Itoa(reputation.Score)}
+	state.targets[TargetReputationCategories] = extractedTarget{value: strings.Join(reputation.Categories, ",")}
+	return reputation
+}
+
+// reputationTarget returns the value of the REPUTATION_SCORE and REPUTATION_CATEGORIES
+// targets, reporting whether target is one of them.
+func (m *Middleware) reputationTarget(target string, r *http.Request, state *WAFState) (string, bool) {
+	switch strings.ToUpper(target) {
+	case TargetReputationScore:
+		return strconv.Itoa(m.reputation(r, state).Score), true
+	case TargetReputationCategories:
+		return strings.Join(m.reputation(r, state).Categories, ","), true
+	}
+	return "", false
+}
+
+// checkReputation acts on clients whose reputation score reaches the threshold or that are
+// in a listed category. It reports whether the request was blocked or challenged.
+func (m *Middleware) checkReputation(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.Reputation
+	if config == nil || config.cache == nil || (config.Threshold <= 0 && len(config.Categories) == 0) {
+		return false
+	}
+	reputation := m.reputation(r, state)
+	reason, flagged := config.flagged(reputation)
+	if !flagged {
+		return false
+	}
+
+	m.reputationHits.Add(1)
+	m.incrementRuleHitCount(RuleID(reputationRuleID))
+	state.MatchedRules = append(state.MatchedRules, reputationRuleID)
+	if config.Action == credentialActionChallenge {
+		return m.challenge(w, r, state, "reputation "+reason, reputationRuleID)
+	}
+	return m.applyDetection(w, r, state, config.Action, config.Score, http.StatusForbidden, "reputation", reputationRuleID,
+		"Client IP has a bad reputation, "+reason, zap.Int("reputation_score", reputation.Score), zap.Strings("categories", reputation.Categories))
+}
@@ -0,0 +1,124 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const maxReputationResponseSize = 1 << 20
+
+func init() {
+	caddy.RegisterModule(&HTTPReputation{})
+}
+
+// Interface guards
+var (
+	_ ReputationProvider    = (*HTTPReputation)(nil)
+	_ caddy.Provisioner     = (*HTTPReputation)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPReputation)(nil)
+)
+
+// HTTPReputation is a reputation provider querying an HTTP service that answers with a
+// Reputation in JSON, such as {"score": 90, "categories": ["botnet"]}. Unknown IPs may be
+// answered with 404.
+type HTTPReputation struct {
+	URL     string            `json:"url"`               // Lookup URL, {ip} is replaced with the client IP
+	Headers map[string]string `json:"headers,omitempty"` // Request headers, such as Authorization
+
+	client *http.Client
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HTTPReputation) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.reputation.http",
+		New: func() caddy.Module { return &HTTPReputation{} },
+	}
+}
+
+// Provision validates the lookup URL.
+func (h *HTTPReputation) Provision(_ caddy.Context) error {
+	if !strings.Contains(h.URL, "{ip}") {
+		return fmt.Errorf("reputation http url must contain the {ip} placeholder: %s", h.URL)
+	}
+	if u, err := url.Parse(strings.ReplaceAll(h.URL, "{ip}", "0.0.0.0")); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid reputation http url: %s", h.URL)
+	}
+	h.client = &http.Client{} // Lookups are bounded by the context deadline
+	return nil
+}
+
+// Lookup fetches the reputation of ip.
+func (h *HTTPReputation) Lookup(ctx context.Context, ip netip.Addr) (Reputation, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(h.URL, "{ip}", url.PathEscape(ip.String())), nil)
+	if err != nil {
+		return Reputation{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return Reputation{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Reputation{}, nil
+	default:
+		return Reputation{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var reputation Reputation
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReputationResponseSize)).Decode(&reputation); err != nil {
+		return Reputation{}, fmt.Errorf("invalid reputation response: %w", err)
+	}
+	return reputation, nil
+}
+
+// UnmarshalCaddyfile sets up the provider from Caddyfile tokens:
+//
+//	http [<url>] {
+//	    url <url>
+//	    header <name> <value>
+//	}
+func (h *HTTPReputation) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Provider name
+	if d.NextArg() {
+		h.URL = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			h.URL = d.Val()
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if h.Headers == nil {
+				h.Headers = make(map[string]string)
+			}
+			h.Headers[args[0]] = args[1]
+		default:
+			return d.Errf("unrecognized reputation http option: %s", d.Val())
+		}
+	}
+	if h.URL == "" {
+		return d.Err("reputation http requires a url")
+	}
+	return nil
+}
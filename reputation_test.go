@@ -0,0 +1,185 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// staticReputation is a reputation provider answering from a map, failing for unlisted IPs
+// when Strict.
+type staticReputation struct {
+	Verdicts map[string]Reputation `json:"verdicts"`
+	Strict   bool                  `json:"strict"`
+}
+
+var staticLookups atomic.Int64
+
+func init() {
+	caddy.RegisterModule(&staticReputation{})
+}
+
+func (*staticReputation) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.waf.reputation.static",
+		New: func() caddy.Module { return &staticReputation{} },
+	}
+}
+
+func (s *staticReputation) Lookup(_ context.Context, ip netip.Addr) (Reputation, error) {
+	staticLookups.Add(1)
+	verdict, ok := s.Verdicts[ip.String()]
+	if !ok && s.Strict {
+		return Reputation{}, errors.New("unknown ip")
+	}
+	return verdict, nil
+}
+
+func reputationConfig(t *testing.T, config *ReputationConfig, providers ...caddy.Module) *ReputationConfig {
+	t.Helper()
+	for _, provider := range providers {
+		name := provider.CaddyModule().ID.Name()
+		config.ProvidersRaw = append(config.ProvidersRaw, caddyconfig.JSONModuleObject(provider, "provider", name, nil))
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	require.NoError(t, config.provision(ctx, zap.NewNop()))
+	return config
+}
+
+func TestReputationConfig_Lookup(t *testing.T) {
+	config := reputationConfig(t, &ReputationConfig{Threshold: 80, Categories: []string{"Botnet"}},
+		&staticReputation{Verdicts: map[string]Reputation{
+			"192.0.2.1": {Score: 60, Categories: []string{"scanner"}},
+			"192.0.2.2": {Score: 150},
+		}},
+		&staticReputation{Strict: true, Verdicts: map[string]Reputation{
+			"192.0.2.1": {Score: 40, Categories: []string{"Botnet", "scanner"}},
+		}},
+	)
+	assert.Len(t, config.providers, 2)
+	ctx := context.Background()
+
+	reputation := config.lookup(ctx, "192.0.2.1")
+	assert.Equal(t, Reputation{Score: 60, Categories: []string{"botnet", "scanner"}}, reputation, "highest score and all categories")
+	reason, flagged := config.flagged(reputation)
+	assert.True(t, flagged)
+	assert.Equal(t, "category botnet", reason)
+
+	reputation = config.lookup(ctx, "192.0.2.2")
+	assert.Equal(t, maxReputationScore, reputation.Score, "clamped")
+	reason, flagged = config.flagged(reputation)
+	assert.True(t, flagged)
+	assert.Equal(t, "score 100", reason)
+
+	_, flagged = config.flagged(config.lookup(ctx, "192.0.2.3"))
+	assert.False(t, flagged)
+
+	before := staticLookups.Load()
+	config.lookup(ctx, "192.0.2.1")
+	assert.Equal(t, before, staticLookups.Load(), "cached")
+}
+
+func TestReputationConfig_AllProvidersFail(t *testing.T) {
+	config := reputationConfig(t, &ReputationConfig{}, &staticReputation{Strict: true})
+	before := staticLookups.Load()
+	assert.Equal(t, Reputation{}, config.lookup(context.Background(), "192.0.2.1"))
+	assert.Equal(t, Reputation{}, config.lookup(context.Background(), "192.0.2.1"))
+	assert.Equal(t, before+2, staticLookups.Load(), "failures are not cached")
+}
+
+func TestReputationConfig_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	provider := caddyconfig.JSONModuleObject(&staticReputation{}, "provider", "static", nil)
+	for _, config := range []*ReputationConfig{
+		{},
+		{ProvidersRaw: []json.RawMessage{provider}, Threshold: 101},
+		{ProvidersRaw: []json.RawMessage{provider}, Action: "ban"},
+		{ProvidersRaw: []json.RawMessage{json.RawMessage(`{"provider": "missing"}`)}},
+		{ProvidersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(&HTTPReputation{URL: "https://intel.example.com/"}, "provider", "http", nil)}},
+	} {
+		assert.Error(t, config.provision(ctx, zap.NewNop()))
+	}
+}
+
+func TestCheckReputation(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 20, Reputation: &ReputationConfig{Threshold: 50}}
+	reputationConfig(t, m.Reputation, &staticReputation{Verdicts: map[string]Reputation{
+		"192.0.2.1": {Score: 90, Categories: []string{"spam"}},
+	}})
+
+	req := browserRequest()
+	state := &WAFState{}
+	value, err := m.extractTarget("REPUTATION_CATEGORIES", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "spam", value)
+	value, err = m.extractTarget("reputation_score", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "90", value)
+
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkReputation(w, req, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, state.MatchedRules, reputationRuleID)
+	assert.Equal(t, int64(1), m.reputationHits.Load())
+
+	clean := browserRequest()
+	clean.RemoteAddr = "198.51.100.1:1234"
+	w = httptest.NewRecorder()
+	assert.False(t, m.checkReputation(w, clean, &WAFState{}))
+
+	m.Reputation.Action = detectionActionScore
+	state = &WAFState{}
+	assert.False(t, m.checkReputation(httptest.NewRecorder(), browserRequest(), state), "below the anomaly threshold")
+	assert.Equal(t, m.Reputation.Score, state.TotalScore)
+}
+
+func TestHTTPReputation(t *testing.T) {
+	var auth atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/ip/192.0.2.1":
+			_, _ = w.Write([]byte(`{"score": 75, "categories": ["proxy"]}`))
+		case "/ip/192.0.2.2":
+			http.NotFound(w, r)
+		case "/ip/192.0.2.3":
+			_, _ = w.Write([]byte(`not json`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	h := &HTTPReputation{URL: server.URL + "/ip/{ip}", Headers: map[string]string{"Authorization": "Bearer token"}}
+	require.NoError(t, h.Provision(caddy.Context{}))
+	ctx := context.Background()
+
+	reputation, err := h.Lookup(ctx, netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, Reputation{Score: 75, Categories: []string{"proxy"}}, reputation)
+	assert.Equal(t, "Bearer token", auth.Load())
+
+	reputation, err = h.Lookup(ctx, netip.MustParseAddr("192.0.2.2"))
+	require.NoError(t, err)
+	assert.Equal(t, Reputation{}, reputation, "unknown IPs are clean")
+
+	_, err = h.Lookup(ctx, netip.MustParseAddr("192.0.2.3"))
+	assert.Error(t, err)
+	_, err = h.Lookup(ctx, netip.MustParseAddr("192.0.2.4"))
+	assert.Error(t, err)
+
+	assert.Error(t, (&HTTPReputation{URL: "ftp://intel.example.com/{ip}"}).Provision(caddy.Context{}))
+}
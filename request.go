@@ -39,9 +39,26 @@ const (
 	TargetJSONPathPrefix        = "JSON_PATH:"
 	TargetContentType           = "CONTENT_TYPE"
 	TargetURL                   = "URL"
-	TargetCookiesPrefix         = "COOKIES:"          // Dynamic cookie extraction prefix
-	TargetHeadersPrefix         = "HEADERS:"          // Dynamic header extraction prefix
-	TargetResponseHeadersPrefix = "RESPONSE_HEADERS:" // Dynamic response header extraction prefix
+	TargetCookiesPrefix         = "COOKIES:"           // Dynamic cookie extraction prefix
+	TargetHeadersPrefix         = "HEADERS:"           // Dynamic header extraction prefix
+	TargetResponseHeadersPrefix = "RESPONSE_HEADERS:"  // Dynamic response header extraction prefix
+	TargetBotScore              = "BOT_SCORE"          // Composite bot score, 0 to 100
+	TargetBotSignals            = "BOT_SIGNALS"        // Names of the bot signals present, comma-separated
+	TargetHeaderNames           = "HEADER_NAMES"       // Lowercased request header names, sorted and comma-separated
+	TargetHeaderFingerprint     = "HEADER_FINGERPRINT" // Hash of the request header names
+	TargetIPType                = "IP_TYPE"            // residential, datacenter, vpn or tor
+
+	// Verdict of the reputation providers on the client IP
+	TargetReputationScore      = "REPUTATION_SCORE"      // Highest score, 0 to 100
+	TargetReputationCategories = "REPUTATION_CATEGORIES" // Categories, comma-separated
+
+	// Bearer token of the request as answered by the token introspection endpoint
+	TargetTokenActive   = "TOKEN_ACTIVE"    // true, false, or empty without a token
+	TargetTokenScope    = "TOKEN_SCOPE"     // Space-separated scopes of an active token
+	TargetTokenClientID = "TOKEN_CLIENT_ID" // Client an active token was issued to
+
+	TargetVarPrefix = "TX:"  // Variable set by inspectors
+	TargetTLSPrefix = "TLS:" // Attribute of the TLS connection, such as TLS:VERSION
 )
 
 var sensitiveTargets = []string{"password", "token", "apikey", "authorization", "secret"} // Define sensitive targets for redaction as package variable
@@ -83,46 +100,8 @@ func (rve *RequestValueExtractor) extractSingleValue(target string, r *http.Requ
 	var unredactedValue string
 	var err error
 
-	// Optimization: Use a map for target extraction logic
-	extractionLogic := map[string]func() (string, error){
-		TargetMethod:   func() (string, error) { return r.Method, nil },
-		TargetRemoteIP: func() (string, error) { return r.RemoteAddr, nil },
-		TargetProtocol: func() (string, error) { return r.Proto, nil },
-		TargetHost:     func() (string, error) { return r.Host, nil },
-		TargetArgs: func() (string, error) {
-			return r.URL.RawQuery, rve.checkEmpty(r.URL.RawQuery, target, "Query string is empty")
-		},
-		TargetUserAgent: func() (string, error) {
-			value := r.UserAgent()
-			rve.logIfEmpty(value, target, "User-Agent is empty")
-			return value, nil
-		},
-		TargetPath: func() (string, error) {
-			value := r.URL.Path
-			rve.logIfEmpty(value, target, "Request path is empty")
-			return value, nil
-		},
-		TargetURI: func() (string, error) {
-			value := r.URL.RequestURI()
-			rve.logIfEmpty(value, target, "Request URI is empty")
-			return value, nil
-		},
-		TargetBody:            func() (string, error) { return rve.extractBody(r, target) },                                     // Separate body extraction
-		TargetHeaders:         func() (string, error) { return rve.extractAllHeaders(r.Header, "Request headers", target) },     // Helper for headers
-		TargetResponseHeaders: func() (string, error) { return rve.extractAllHeaders(w.Header(), "Response headers", target) },  // Helper for response headers
-		TargetResponseBody:    func() (string, error) { return rve.extractResponseBody(w, target) },                             // Helper for response body
-		TargetFileName:        func() (string, error) { return rve.extractFileName(r, target) },                                 // Helper for filename
-		TargetFileMIMEType:    func() (string, error) { return rve.extractFileMIMEType(r, target) },                             // Helper for mime type
-		TargetCookies:         func() (string, error) { return rve.extractAllCookies(r.Cookies(), "No cookies found", target) }, // Helper for cookies
-		TargetContentType: func() (string, error) {
-			return r.Header.Get("Content-Type"), rve.checkEmpty(r.Header.Get("Content-Type"), target, "Content-Type header not found")
-		},
-		TargetURL: func() (string, error) {
-			return r.URL.String(), rve.checkEmpty(r.URL.String(), target, "URL could not be extracted")
-		},
-	}
-
-	if extractor, exists := extractionLogic[targetUpper]; exists {
+	// Only the requested target is evaluated
+	if extractor := rve.fixedTargetExtractor(targetUpper, target, r, w); extractor != nil {
 		unredactedValue, err = extractor()
 		if err != nil {
 			return "", err // Return error from extractor
@@ -154,6 +133,11 @@ func (rve *RequestValueExtractor) extractSingleValue(target string, r *http.Requ
 		if err != nil {
 			return "", err
 		}
+	} else if strings.HasPrefix(targetUpper, TargetTLSPrefix) {
+		unredactedValue, err = tlsAttribute(r, targetUpper[len(TargetTLSPrefix):])
+		if err != nil {
+			return "", err
+		}
 	} else if strings.HasPrefix(targetUpper, TargetJSONPathPrefix) {
 		jsonPath := strings.TrimPrefix(origTarget, TargetJSONPathPrefix)
 		unredactedValue, err = rve.extractValueForJSONPath(r, jsonPath, target)
@@ -178,6 +162,69 @@ func (rve *RequestValueExtractor) extractSingleValue(target string, r *http.Requ
 	return unredactedValue, nil
 }
 
+// fixedTargetExtractor returns the extractor of a target without an argument, or nil.
+func (rve *RequestValueExtractor) fixedTargetExtractor(targetUpper, target string, r *http.Request, w http.ResponseWriter) func() (string, error) {
+	switch targetUpper {
+	case TargetMethod:
+		return func() (string, error) { return r.Method, nil }
+	case TargetRemoteIP:
+		return func() (string, error) { return r.RemoteAddr, nil }
+	case TargetProtocol:
+		return func() (string, error) { return r.Proto, nil }
+	case TargetHost:
+		return func() (string, error) { return r.Host, nil }
+	case TargetArgs:
+		return func() (string, error) {
+			return r.URL.RawQuery, rve.checkEmpty(r.URL.RawQuery, target, "Query string is empty")
+		}
+	case TargetUserAgent:
+		return func() (string, error) {
+			value := r.UserAgent()
+			rve.logIfEmpty(value, target, "User-Agent is empty")
+			return value, nil
+		}
+	case TargetPath:
+		return func() (string, error) {
+			value := r.URL.Path
+			rve.logIfEmpty(value, target, "Request path is empty")
+			return value, nil
+		}
+	case TargetURI:
+		return func() (string, error) {
+			value := r.URL.RequestURI()
+			rve.logIfEmpty(value, target, "Request URI is empty")
+			return value, nil
+		}
+	case TargetBody:
+		return func() (string, error) { return rve.extractBody(r, target) }
+	case TargetHeaders:
+		return func() (string, error) { return rve.extractAllHeaders(r.Header, "Request headers", target) }
+	case TargetResponseHeaders:
+		return func() (string, error) { return rve.extractAllHeaders(w.Header(), "Response headers", target) }
+	case TargetResponseBody:
+		return func() (string, error) { return rve.extractResponseBody(w, target) }
+	case TargetFileName:
+		return func() (string, error) { return rve.extractFileName(r, target) }
+	case TargetFileMIMEType:
+		return func() (string, error) { return rve.extractFileMIMEType(r, target) }
+	case TargetCookies:
+		return func() (string, error) { return rve.extractAllCookies(r.Cookies(), "No cookies found", target) }
+	case TargetContentType:
+		return func() (string, error) {
+			return r.Header.Get("Content-Type"), rve.checkEmpty(r.Header.Get("Content-Type"), target, "Content-Type header not found")
+		}
+	case TargetURL:
+		return func() (string, error) {
+			return r.URL.String(), rve.checkEmpty(r.URL.String(), target, "URL could not be extracted")
+		}
+	case TargetHeaderNames:
+		return func() (string, error) { return headerNames(r), nil }
+	case TargetHeaderFingerprint:
+		return func() (string, error) { return headerFingerprint(r), nil }
+	}
+	return nil
+}
+
 // Helper function to check for empty value and log debug message if empty
 func (rve *RequestValueExtractor) checkEmpty(value string, target, message string) error {
 	if value == "" {
@@ -204,13 +251,26 @@ func (rve *RequestValueExtractor) extractBody(r *http.Request, target string) (s
 		rve.logger.Debug("Request body is empty", zap.String("target", target))
 		return "", fmt.Errorf("request body is empty for target: %s", target)
 	}
-	bodyBytes, err := io.ReadAll(r.Body)
+	body, err := readAllPooled(r.Body)
+	r.Body = newReplayBody(body, r.Body) // The next reader, such as the upstream handler, reads it again
 	if err != nil {
 		rve.logger.Error("Failed to read request body", zap.Error(err))
 		return "", fmt.Errorf("failed to read request body for target %s: %w", target, err)
 	}
-	r.Body = http.NoBody // Reset body for next read - using http.NoBody
-	return string(bodyBytes), nil
+	return body, nil
+}
+
+// replayBody is a request body whose first bytes were read for inspection: they are read
+// again, followed by the unread rest of the original body, so that a chunked or streamed
+// body reaches the upstream handler whole.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// newReplayBody returns the body replaying the bytes read from original.
+func newReplayBody(read string, original io.ReadCloser) io.ReadCloser {
+	return replayBody{Reader: io.MultiReader(strings.NewReader(read), original), Closer: original}
 }
 
 // Helper function to extract all headers
@@ -334,15 +394,15 @@ func (rve *RequestValueExtractor) extractValueForJSONPath(r *http.Request, jsonP
 		return "", fmt.Errorf("request body is empty for target: %s", target)
 	}
 
-	bodyBytes, err := io.ReadAll(r.Body)
+	body, err := readAllPooled(r.Body)
+	r.Body = newReplayBody(body, r.Body) // Reset body for next read
 	if err != nil {
 		rve.logger.Error("Failed to read request body", zap.Error(err))
 		return "", fmt.Errorf("failed to read request body for JSON_PATH target %s: %w", target, err)
 	}
-	r.Body = http.NoBody // Reset body for next read
 
 	// Use helper method to dynamically extract value based on JSON path (e.g., 'data.items.0.name').
-	unredactedValue, err := rve.extractJSONPath(string(bodyBytes), jsonPath)
+	unredactedValue, err := rve.extractJSONPath(body, jsonPath)
 	if err != nil {
 		rve.logger.Debug("Failed to extract value from JSON path", zap.String("target", target), zap.String("path", jsonPath), zap.Error(err))
 		return "", fmt.Errorf("failed to extract from JSON path '%s': %w", jsonPath, err)
@@ -0,0 +1,146 @@
+package caddywaf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	requestEncodingRuleID          = "request_encoding_rule"
+	defaultRequestDecompressLimit  = 10 << 20
+	defaultRequestDecompressRatio  = 100
+	requestDecompressRatioMinBytes = 64 << 10 // Decompressed bytes below which the ratio is not checked
+)
+
+// Actions on request bodies with an unsupported or stacked Content-Encoding
+const (
+	requestEncodingBlock = "block" // Block the request with 415
+	requestEncodingAllow = "allow" // Inspect the body as sent
+)
+
+// errDecompressionRatio reports a body expanding past the decompression ratio.
+var errDecompressionRatio = errors.New("decompression ratio exceeded")
+
+// RequestDecompressConfig decompresses request bodies sent with a gzip, deflate or zstd
+// Content-Encoding, so the checks and rules reading the body see its content, or rejects
+// encoded request bodies.
+type RequestDecompressConfig struct {
+	Limit    int64 `json:"limit,omitempty"`     // Decompressed bytes inspected, default 10 MiB
+	MaxRatio int   `json:"max_ratio,omitempty"` // Decompressed to compressed size ratio blocked as a decompression bomb, default 100
+	Reject   bool  `json:"reject,omitempty"`    // Block encoded request bodies with 415 instead
+
+	// Action on bodies with an unsupported or stacked encoding, block (default) or allow
+	OnUnsupported string `json:"on_unsupported,omitempty"`
+}
+
+// provision validates the config and applies the defaults.
+func (c *RequestDecompressConfig) provision() error {
+	if c.Limit <= 0 {
+		c.Limit = defaultRequestDecompressLimit
+	}
+	if c.MaxRatio <= 0 {
+		c.MaxRatio = defaultRequestDecompressRatio
+	}
+	switch c.OnUnsupported {
+	case "":
+		c.OnUnsupported = requestEncodingBlock
+	case requestEncodingBlock, requestEncodingAllow:
+	default:
+		return fmt.Errorf("invalid request_decompress on_unsupported %q, must be block or allow", c.OnUnsupported)
+	}
+	return nil
+}
+
+// decompressRequestBody decompresses a request body up to the limit. A body expanding
+// more than maxRatio times its compressed size fails with errDecompressionRatio; ok is false
+// when the encoding is not supported.
+func decompressRequestBody(encoding string, body []byte, limit int64, maxRatio int) (decoded string, ok bool, err error) {
+	if strings.Contains(encoding, ",") {
+		return "", false, nil // Stacked encodings are not decoded
+	}
+	reader, closeReader, err := contentDecoder(encoding, body)
+	if err != nil {
+		return "", true, fmt.Errorf("invalid %s request body: %w", encoding, err)
+	}
+	if reader == nil {
+		return "", false, nil
+	}
+	defer closeReader()
+
+	// Read one byte past the ratio, so a bomb is told apart from a body ending at it
+	maxBytes := max(int64(len(body))*int64(maxRatio), requestDecompressRatioMinBytes)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(reader, min(limit, maxBytes+1)))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", true, fmt.Errorf("invalid %s request body: %w", encoding, err)
+	}
+	if n > maxBytes {
+		return "", true, errDecompressionRatio
+	}
+	return buf.String(), true, nil
+}
+
+// checkRequestEncoding handles request bodies with a Content-Encoding in phase 2: it
+// blocks them with reject, or else replaces the body seen by the checks and rules with its
+// decompressed content, blocking bodies that fail to decompress or expand past the ratio,
+// and those with an unsupported encoding unless on_unsupported allows them. It reports
+// whether the request was blocked.
+func (m *Middleware) checkRequestEncoding(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.RequestDecompress
+	encoding := r.Header.Get("Content-Encoding")
+	if config == nil || encoding == "" || strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if config.Reject {
+		m.requestEncodingHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusUnsupportedMediaType, "request_encoding", requestEncodingRuleID,
+			zap.String("message", "Request blocked for its encoded body"),
+			zap.String("content_encoding", encoding),
+		)
+		return true
+	}
+
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil || body == "" {
+		return false
+	}
+	decoded, ok, err := decompressRequestBody(encoding, []byte(body), config.Limit, config.MaxRatio)
+	if !ok {
+		if config.OnUnsupported == requestEncodingAllow {
+			return false // Inspected as sent
+		}
+		m.requestEncodingHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusUnsupportedMediaType, "request_encoding", requestEncodingRuleID,
+			zap.String("message", "Request blocked for an unsupported encoding"),
+			zap.String("content_encoding", encoding),
+		)
+		return true
+	}
+	if err != nil {
+		m.requestEncodingHits.Add(1)
+		statusCode := http.StatusBadRequest
+		if errors.Is(err, errDecompressionRatio) {
+			statusCode = http.StatusRequestEntityTooLarge
+		}
+		m.blockRequest(w, r, state, statusCode, "request_encoding", requestEncodingRuleID,
+			zap.String("message", "Request blocked for its encoded body"),
+			zap.String("content_encoding", encoding),
+			zap.Error(err),
+		)
+		return true
+	}
+	state.targets[TargetBody] = extractedTarget{value: m.truncateBody(decoded, state)}
+	m.logger.Debug("Request body decompressed",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("content_encoding", encoding),
+		zap.Int("compressed_bytes", len(body)),
+		zap.Int("decompressed_bytes", len(decoded)),
+	)
+	return false
+}
@@ -0,0 +1,109 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressRequestBody(t *testing.T) {
+	body := `{"query": "1 union select password from users"}`
+	decoded, ok, err := decompressRequestBody("gzip", compressBody(t, "gzip", body), defaultRequestDecompressLimit, defaultRequestDecompressRatio)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, body, decoded)
+
+	bomb := compressBody(t, "gzip", strings.Repeat("0", 4<<20))
+	_, ok, err = decompressRequestBody("gzip", bomb, defaultRequestDecompressLimit, defaultRequestDecompressRatio)
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, errDecompressionRatio)
+
+	decoded, _, err = decompressRequestBody("gzip", bomb, 1024, defaultRequestDecompressRatio)
+	assert.NoError(t, err, "the limit stops decompression before the ratio")
+	assert.Len(t, decoded, 1024)
+
+	_, ok, err = decompressRequestBody("br", []byte(body), defaultRequestDecompressLimit, defaultRequestDecompressRatio)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func encodedRequest(t *testing.T, encoding, body string) *http.Request {
+	t.Helper()
+	req := testRequest("POST", "/search", "application/json", string(compressBody(t, encoding, body)))
+	req.Header.Set("Content-Encoding", encoding)
+	return req
+}
+
+func TestCheckRequestEncoding(t *testing.T) {
+	m := newExplainMiddleware()
+	m.Rules[2] = append(m.Rules[2], Rule{ID: "sqli-body", Targets: []string{"BODY"}, Phase: 2, Score: 10, Action: "block", regex: regexp.MustCompile(`union select`)})
+	m.RequestDecompress = &RequestDecompressConfig{}
+	require.NoError(t, m.RequestDecompress.provision())
+	state := &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), encodedRequest(t, "gzip", `{"query": "1 union select password"}`), 2, state)
+	assert.True(t, state.Blocked, "the rule matches the decompressed body")
+	assert.Equal(t, []string{"sqli-body"}, state.MatchedRules)
+
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), encodedRequest(t, "deflate", `{"query": "shoes"}`), 2, state)
+	assert.False(t, state.Blocked)
+
+	w := httptest.NewRecorder()
+	state = &WAFState{}
+	m.handlePhase(w, encodedRequest(t, "gzip", strings.Repeat("0", 4<<20)), 2, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "decompression bombs are blocked")
+
+	w = httptest.NewRecorder()
+	req := testRequest("POST", "/search", "application/json", "not gzip")
+	req.Header.Set("Content-Encoding", "gzip")
+	m.handlePhase(w, req, 2, &WAFState{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, int64(2), m.requestEncodingHits.Load())
+}
+
+func TestCheckRequestEncoding_Reject(t *testing.T) {
+	m := newExplainMiddleware()
+	m.RequestDecompress = &RequestDecompressConfig{Reject: true}
+	require.NoError(t, m.RequestDecompress.provision())
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, encodedRequest(t, "gzip", `{"query": "shoes"}`), 2, state)
+	assert.True(t, state.Blocked)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), testRequest("POST", "/search", "application/json", `{"query": "shoes"}`), 2, state)
+	assert.False(t, state.Blocked, "plain bodies are not affected")
+}
+
+func TestCheckRequestEncoding_Unsupported(t *testing.T) {
+	m := newExplainMiddleware()
+	m.RequestDecompress = &RequestDecompressConfig{}
+	require.NoError(t, m.RequestDecompress.provision())
+	for _, encoding := range []string{"br", "gzip, gzip"} {
+		w := httptest.NewRecorder()
+		req := testRequest("POST", "/search", "application/json", "1 union select password")
+		req.Header.Set("Content-Encoding", encoding)
+		state := &WAFState{}
+		m.handlePhase(w, req, 2, state)
+		assert.True(t, state.Blocked, "bodies with a %s encoding are blocked", encoding)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	}
+
+	m = newExplainMiddleware()
+	m.RequestDecompress = &RequestDecompressConfig{OnUnsupported: requestEncodingAllow}
+	require.NoError(t, m.RequestDecompress.provision())
+	req := testRequest("POST", "/search", "application/json", `{"query": "shoes"}`)
+	req.Header.Set("Content-Encoding", "br")
+	state := &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), req, 2, state)
+	assert.False(t, state.Blocked, "with on_unsupported allow, they are inspected as sent")
+
+	assert.Error(t, (&RequestDecompressConfig{OnUnsupported: "inspect"}).provision())
+}
@@ -0,0 +1,101 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func signedRequest(method, target, body, keyID, secret string, at time.Time) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set("X-Key-Id", keyID)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signRequest(secret, canonicalRequest(method, req.URL.RequestURI(), body, timestamp)))
+	return req
+}
+
+func TestRequestSigningConfig_Verify(t *testing.T) {
+	config := &RequestSigningConfig{Paths: []string{"/api/*"}, Keys: map[string]string{"client-a": "secret-a", "client-b": "secret-b"}}
+	require.NoError(t, config.provision())
+	now := time.Unix(1767225600, 0)
+	body := `{"amount": 100}`
+
+	req := signedRequest("POST", "/api/payments?currency=EUR", body, "client-a", "secret-a", now)
+	assert.Empty(t, config.verify(req, body, now))
+	assert.Empty(t, config.verify(req, body, now.Add(4*time.Minute)), "within the clock skew")
+	assert.Equal(t, signatureStale, config.verify(req, body, now.Add(6*time.Minute)))
+	assert.Equal(t, signatureStale, config.verify(req, body, now.Add(-6*time.Minute)))
+	assert.Equal(t, signatureInvalid, config.verify(req, `{"amount": 10000}`, now), "the body is signed")
+
+	req = signedRequest("POST", "/api/payments?currency=EUR", body, "client-b", "secret-a", now)
+	assert.Equal(t, signatureInvalid, config.verify(req, body, now), "each key has its own secret")
+
+	req = signedRequest("POST", "/api/payments?currency=USD", body, "client-a", "secret-a", now)
+	req.URL.RawQuery = "currency=GBP"
+	assert.Equal(t, signatureInvalid, config.verify(req, body, now), "the query is signed")
+
+	req = signedRequest("POST", "/api/payments", body, "client-c", "secret-c", now)
+	assert.Equal(t, signatureUnknownKey, config.verify(req, body, now))
+
+	req.Header.Del("X-Timestamp")
+	assert.Equal(t, signatureMissing, config.verify(req, body, now))
+
+	for _, config := range []*RequestSigningConfig{
+		{Keys: map[string]string{"a": "s"}},
+		{Paths: []string{"api"}, Keys: map[string]string{"a": "s"}},
+		{Paths: []string{"/api/*"}},
+		{Paths: []string{"/api/*"}, Keys: map[string]string{"a": ""}},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckRequestSigning(t *testing.T) {
+	config := &RequestSigningConfig{Paths: []string{"/api/*"}, Keys: map[string]string{"client-a": "secret-a"}}
+	require.NoError(t, config.provision())
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		RequestSigning:        []*RequestSigningConfig{config},
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	body := `{"amount": 100}`
+
+	req := signedRequest("POST", "/api/payments", body, "client-a", "secret-a", time.Now())
+	assert.False(t, m.checkRequestSigning(httptest.NewRecorder(), req, &WAFState{}))
+	replayed, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(replayed), "the upstream handler reads the body hashed")
+
+	req = signedRequest("GET", "/api/balance", "", "client-a", "secret-a", time.Now())
+	assert.False(t, m.checkRequestSigning(httptest.NewRecorder(), req, &WAFState{}))
+	assert.False(t, m.checkRequestSigning(httptest.NewRecorder(), httptest.NewRequest("GET", "/public", nil), &WAFState{}))
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkRequestSigning(w, httptest.NewRequest("POST", "/api/payments", strings.NewReader(body)), state))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, requestSigningRuleID, state.blockRuleID)
+
+	req = signedRequest("POST", "/api/payments", body, "client-a", "secret-a", time.Now().Add(-time.Hour))
+	assert.True(t, m.checkRequestSigning(httptest.NewRecorder(), req, &WAFState{}), "stale")
+	assert.Equal(t, int64(2), m.requestSigningHits.Load())
+
+	// Bodies are read within the inspection budget, past which they can't be verified
+	m.InspectionBudget = &InspectionBudget{MaxBodyBytes: 8}
+	w = httptest.NewRecorder()
+	req = signedRequest("POST", "/api/payments", body, "client-a", "secret-a", time.Now())
+	assert.True(t, m.checkRequestSigning(w, req, &WAFState{}))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	replayed, err = io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(replayed), "the upstream handler still gets the whole body")
+}
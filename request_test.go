@@ -4,19 +4,24 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/phemmer/go-iptrie"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 func TestExtractValue(t *testing.T) {
@@ -295,6 +300,50 @@ func TestExtractValue_Body(t *testing.T) {
 	assert.Equal(t, "test body", value)
 }
 
+func TestExtractValue_BodyReplayed(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+
+	value, err := rve.ExtractValue("BODY", req, httptest.NewRecorder())
+	require.NoError(t, err)
+	assert.Equal(t, "chunked body", value)
+	replayed, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "chunked body", string(replayed), "the body is readable again for the upstream handler")
+}
+
+func TestServeHTTP_StreamedBodyReachesUpstream(t *testing.T) {
+	m := newExplainMiddleware()
+	m.Rules[2] = append(m.Rules[2], Rule{ID: "body-attack", Targets: []string{"BODY"}, Phase: 2, Score: 20, Action: "block", regex: regexp.MustCompile(`attack`)})
+	m.InspectionBudget = &InspectionBudget{MaxBodyBytes: 64 << 10}
+	body := strings.Repeat("0123456789abcdef", 16<<10) // 256 KiB, past the body budget
+
+	var received []byte
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		var err error
+		received, err = io.ReadAll(r.Body)
+		return err
+	})
+	req := httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(body[:1000]), strings.NewReader(body[1000:])))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	w := httptest.NewRecorder()
+	require.NoError(t, m.ServeHTTP(w, req, next))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, len(body), len(received))
+	assert.True(t, body == string(received), "the upstream handler reads the whole body after inspection")
+
+	received = nil
+	req = httptest.NewRequest("POST", "/upload", strings.NewReader("an attack"))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	require.NoError(t, m.ServeHTTP(w, req, next))
+	assert.Equal(t, http.StatusForbidden, w.Code, "streamed bodies are inspected")
+	assert.Nil(t, received)
+}
+
 func TestExtractValue_Headers(t *testing.T) {
 	logger := zap.NewNop()
 	rve := NewRequestValueExtractor(logger, false)
@@ -538,3 +587,51 @@ func TestParseAnomalyThreshold_Invalid(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid syntax")
 }
+
+func TestExtractTarget_Memoized(t *testing.T) {
+	m := &Middleware{requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+	r := httptest.NewRequest("POST", "/api?id=1", bytes.NewBufferString(`{"user": {"name": "admin"}}`))
+	r.Header.Set("X-Test", "first")
+	state := &WAFState{}
+
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"user": {"name": "admin"}}`, body)
+
+	// The body was consumed, JSON_PATH targets reuse the extracted value
+	name, err := m.extractTarget("JSON_PATH:user.name", r, nil, state)
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", name)
+	body, err = m.extractTarget(TargetBody, r, nil, state)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, body)
+
+	value, err := m.extractTarget("HEADERS:X-Test", r, nil, state)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", value)
+	r.Header.Set("X-Test", "second")
+	value, _ = m.extractTarget("HEADERS:X-Test", r, nil, state)
+	assert.Equal(t, "first", value, "targets are extracted once per request")
+
+	_, err = m.extractTarget("HEADERS:Missing", r, nil, state)
+	assert.Error(t, err)
+	_, err = m.extractTarget("HEADERS:Missing", r, nil, state)
+	assert.Error(t, err, "extraction errors are memoized too")
+	assert.Len(t, state.targets, 4)
+}
+
+func TestExtractTarget_ResponseTargets(t *testing.T) {
+	m := &Middleware{requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false)}
+	r := httptest.NewRequest("GET", "/", nil)
+	state := &WAFState{}
+
+	_, err := m.extractTarget(TargetResponseBody, r, nil, state)
+	assert.Error(t, err)
+	assert.Empty(t, state.targets, "response targets aren't memoized before the response exists")
+
+	recorder := NewResponseRecorder(httptest.NewRecorder())
+	_, _ = recorder.Write([]byte("secret"))
+	value, err := m.extractTarget(TargetResponseBody, r, recorder, state)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", value)
+}
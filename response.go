@@ -17,44 +17,71 @@ func (m *Middleware) allowRequest(state *WAFState) {
 	m.incrementAllowedRequestsMetric()
 }
 
-// blockRequest handles blocking a request and logging the details.
+// blockRequest handles blocking a request and logging the details. The status code is
+// replaced according to block_status.
 func (m *Middleware) blockRequest(recorder http.ResponseWriter, r *http.Request, state *WAFState, statusCode int, reason, ruleID string, fields ...zap.Field) {
+	statusCode = m.blockStatus(reason, statusCode)
+	m.recordBlock(r, state, statusCode, reason, ruleID, fields...)
+
+	if _, ok := m.customResponse(statusCode); ok {
+		m.writeCustomResponse(recorder, r, state)
+		return
+	}
+
+	// Write a simple text response for blocked requests
+	recorder.Header().Set("Content-Type", "text/plain")
+	recorder.WriteHeader(statusCode)
+	message := fmt.Sprintf("Request blocked by WAF. Reason: %s", reason)
+	if _, err := recorder.Write([]byte(message)); err != nil {
+		m.logger.Error("Failed to write blocked response", zap.Error(err))
+	}
+}
+
+// recordBlock marks the request as blocked, logs it and updates the metrics, events and
+// violation counts, leaving the response to the caller.
+func (m *Middleware) recordBlock(r *http.Request, state *WAFState, statusCode int, reason, ruleID string, fields ...zap.Field) {
 	// CRITICAL FIX: Set these flags before any other operations
 	state.Blocked = true
 	state.StatusCode = statusCode
 	state.ResponseWritten = true
+	state.blockReason = reason
+	state.blockRuleID = ruleID
 
 	// CRITICAL FIX: Log at WARN level for visibility
-	m.logger.Warn("REQUEST BLOCKED BY WAF", append(fields,
-		zap.String("rule_id", ruleID),
-		zap.String("reason", reason),
-		zap.Int("status_code", statusCode),
-		zap.String("remote_addr", r.RemoteAddr),
-		zap.Int("total_score", state.TotalScore))...)
+	if m.allowRuleLog(r, ruleID) {
+		m.logger.Warn("REQUEST BLOCKED BY WAF", append(fields,
+			zap.String("rule_id", ruleID),
+			zap.String("reason", reason),
+			zap.Int("status_code", statusCode),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Int("total_score", state.TotalScore))...)
+	}
 
 	// CRITICAL FIX: Increment blocked metrics immediately
 	m.incrementBlockedRequestsMetric()
 
-	// Write a simple text response for blocked requests
-	recorder.Header().Set("Content-Type", "text/plain")
-	recorder.WriteHeader(statusCode)
-
-	if m.CustomResponses != nil {
-		m.writeCustomResponse(recorder, state.StatusCode)
-	} else {
-		message := fmt.Sprintf("Request blocked by WAF. Reason: %s", reason)
-		if _, err := recorder.Write([]byte(message)); err != nil {
-			m.logger.Error("Failed to write blocked response", zap.Error(err))
-		}
-	}
+	m.emitBlockEvent(r, state, statusCode, reason, ruleID)
+	m.recordTransaction(r, state, statusCode, reason, ruleID)
+	m.recordViolation(r, ruleID)
 }
 
+// defaultResponseBufferLimit is how much of a response body is buffered for inspection by default.
+const defaultResponseBufferLimit = 4 << 20
+
 // responseRecorder captures the response status code, headers, and body.
+// Once more than limit bytes of body are written, the buffered prefix is flushed and the
+// remainder is streamed to the client, so only the prefix is inspected.
 type responseRecorder struct {
 	http.ResponseWriter
 	body       *bytes.Buffer
 	statusCode int
-	written    bool // To track if a write to the original writer has been done.
+	written    bool  // To track if a write to the original writer has been done.
+	limit      int64 // Body bytes buffered before streaming, zero for no limit
+	streamed   bool  // The body went past the limit and was sent to the client
+	sealed     bool  // The handler finished, so writes to a streamed response are dropped
+
+	decompressLimit int64   // Decompressed body bytes inspected, zero to inspect the raw body
+	decoded         *string // Inspected body, once computed
 }
 
 // NewResponseRecorder creates a new responseRecorder.
@@ -69,6 +96,9 @@ func NewResponseRecorder(w http.ResponseWriter) *responseRecorder {
 
 // WriteHeader captures the response status code.
 func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.streamed {
+		return // The status line is already on its way to the client
+	}
 	r.statusCode = statusCode
 	r.ResponseWriter.WriteHeader(statusCode)
 }
@@ -78,9 +108,22 @@ func (r *responseRecorder) Header() http.Header {
 	return r.ResponseWriter.Header()
 }
 
-// BodyString returns the captured response body as a string.
+// BodyString returns the captured response body as a string, as inspected: a body with a
+// supported Content-Encoding is decompressed, while the bytes sent to the client are not
+// changed.
 func (r *responseRecorder) BodyString() string {
-	return r.body.String()
+	if r.decoded != nil {
+		return *r.decoded
+	}
+	body := r.body.String()
+	if encoding := r.Header().Get("Content-Encoding"); r.decompressLimit > 0 && encoding != "" {
+		decoded, ok, err := decompressResponseBody(encoding, r.body.Bytes(), r.decompressLimit)
+		if ok && (err == nil || decoded != "") {
+			body = decoded
+		}
+	}
+	r.decoded = &body
+	return body
 }
 
 // StatusCode returns the captured status code.
@@ -91,12 +134,42 @@ func (r *responseRecorder) StatusCode() int {
 	return r.statusCode
 }
 
-// Write captures the response body and writes to the buffer only.
+// Streamed reports whether the response body went past the buffer limit and was
+// streamed to the client.
+func (r *responseRecorder) Streamed() bool {
+	return r.streamed
+}
+
+// seal marks the end of the handler's response. Writes to a streamed response after it,
+// such as a block message, are dropped.
+func (r *responseRecorder) seal() {
+	r.sealed = true
+}
+
+// Write captures the response body and writes to the buffer only, until the buffer limit
+// is reached; past it, the buffered body and all further writes go to the client.
 func (r *responseRecorder) Write(b []byte) (int, error) {
 	if r.statusCode == 0 && !r.written {
 		r.WriteHeader(http.StatusOK) // Default to 200 if not set
 	}
-	n, err := r.body.Write(b)
 	r.written = true
-	return n, err
+	if r.streamed {
+		if r.sealed {
+			return len(b), nil
+		}
+		return r.ResponseWriter.Write(b)
+	}
+	if r.limit <= 0 || int64(r.body.Len()+len(b)) <= r.limit {
+		return r.body.Write(b)
+	}
+
+	// Keep the body up to the limit for inspection, then stream it all out
+	buffered := int(r.limit) - r.body.Len()
+	r.body.Write(b[:buffered])
+	r.streamed = true
+	if _, err := r.ResponseWriter.Write(r.body.Bytes()); err != nil {
+		return 0, err
+	}
+	n, err := r.ResponseWriter.Write(b[buffered:])
+	return buffered + n, err
 }
@@ -0,0 +1,69 @@
+package caddywaf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultResponseDecompressLimit is how many decompressed bytes of a compressed response
+// body are inspected by default.
+const defaultResponseDecompressLimit = 16 << 20
+
+// contentDecoder returns a reader decompressing a request or response body of the given
+// Content-Encoding, or nil if the encoding is not supported.
+func contentDecoder(encoding string, body []byte) (io.Reader, func(), error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	case "deflate":
+		// deflate is zlib wrapped, though some servers send raw deflate
+		if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return reader, func() { reader.Close() }, nil
+		}
+		reader := flate.NewReader(bytes.NewReader(body))
+		return reader, func() { reader.Close() }, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, decoder.Close, nil
+	}
+	return nil, nil, nil
+}
+
+// decompressResponseBody decompresses a response body encoded with gzip, deflate or zstd
+// up to limit bytes. A truncated body, such as the prefix of a response streamed past the
+// buffer limit, is decompressed as far as it goes. ok is false when the encoding is not
+// supported.
+func decompressResponseBody(encoding string, body []byte, limit int64) (decoded string, ok bool, err error) {
+	if strings.Contains(encoding, ",") {
+		return "", false, nil // Stacked encodings are not decoded
+	}
+	reader, closeReader, err := contentDecoder(encoding, body)
+	if err != nil {
+		return "", true, fmt.Errorf("invalid %s response body: %w", encoding, err)
+	}
+	if reader == nil {
+		return "", false, nil
+	}
+	defer closeReader()
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, io.LimitReader(reader, limit))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return buf.String(), true, fmt.Errorf("invalid %s response body: %w", encoding, err)
+	}
+	return buf.String(), true, nil
+}
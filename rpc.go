@@ -0,0 +1,298 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	rpcRuleID                = "rpc_rule"
+	defaultRPCMaxMessageSize = 4 << 20 // The default receive limit of gRPC servers
+	rpcFrameHeaderSize       = 5       // Flags byte and big-endian message length
+	rpcFrameCompressed       = 0x01    // Flag of a compressed message
+	rpcFrameTrailers         = 0x80    // Flag of the gRPC-Web trailers frame
+)
+
+// RPC protocols recognized by the content type of requests
+const (
+	rpcGRPC          = "grpc"           // application/grpc, over HTTP/2
+	rpcGRPCWeb       = "grpc-web"       // application/grpc-web, +proto or +json
+	rpcGRPCWebText   = "grpc-web-text"  // application/grpc-web-text, frames encoded in base64
+	rpcConnect       = "connect"        // Connect unary call, application/proto or application/json
+	rpcConnectStream = "connect-stream" // Connect streaming call, application/connect+proto or +json
+)
+
+var (
+	grpcTimeoutRegex    = regexp.MustCompile(`^\d{1,8}[HMSmun]$`)
+	connectTimeoutRegex = regexp.MustCompile(`^\d{1,10}$`)
+)
+
+// RPCConfig checks the gRPC, gRPC-Web and Connect calls: the size of their messages,
+// decoded from their framing, and their metadata.
+type RPCConfig struct {
+	MaxMessageSize  int64 `json:"max_message_size,omitempty"`  // Largest message accepted, default 4MiB
+	MaxMetadataSize int64 `json:"max_metadata_size,omitempty"` // Largest total size of the metadata headers, 0 for no limit
+}
+
+// provision applies the defaults.
+func (c *RPCConfig) provision() error {
+	if c.MaxMessageSize < 0 || c.MaxMetadataSize < 0 {
+		return fmt.Errorf("rpc sizes must not be negative")
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = defaultRPCMaxMessageSize
+	}
+	return nil
+}
+
+// rpcProtocolOf returns the RPC protocol of a request, or an empty string for other requests.
+func rpcProtocolOf(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.RawQuery, "connect=v1") && r.URL.Query().Get("connect") == "v1" {
+			return rpcConnect
+		}
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/grpc-web-text" || strings.HasPrefix(mediaType, "application/grpc-web-text+"):
+		return rpcGRPCWebText
+	case mediaType == "application/grpc-web" || strings.HasPrefix(mediaType, "application/grpc-web+"):
+		return rpcGRPCWeb
+	case mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+"):
+		return rpcGRPC
+	case strings.HasPrefix(mediaType, "application/connect+"):
+		return rpcConnectStream
+	case r.Header.Get("Connect-Protocol-Version") != "":
+		return rpcConnect
+	}
+	return ""
+}
+
+// rpcStreamsRequest reports whether the requests of a protocol may stream their body, which
+// is then left unread: inspecting it would wait for the end of the call.
+func rpcStreamsRequest(protocol string) bool {
+	return protocol == rpcGRPC || protocol == rpcConnectStream
+}
+
+// rpcStreamsResponse reports whether the responses of a protocol may be streamed, which are
+// then passed through unbuffered.
+func rpcStreamsResponse(protocol string) bool {
+	return protocol == rpcGRPC || protocol == rpcGRPCWeb || protocol == rpcGRPCWebText || protocol == rpcConnectStream
+}
+
+// decodeRPCBody returns the messages of an RPC request body as inspected, and the size of the
+// largest message. Framed bodies are unframed, after decoding gRPC-Web text from base64, and
+// their messages joined by line feeds; compressed messages and trailers are left out. The
+// size of a message is the one its frame declares, even when the body is truncated.
+func decodeRPCBody(protocol, body string) (string, int64) {
+	switch protocol {
+	case "":
+		return body, 0
+	case rpcConnect:
+		return body, int64(len(body))
+	case rpcGRPCWebText:
+		decoded, err := decodeGRPCWebText(body)
+		if err != nil {
+			return body, 0
+		}
+		body = decoded
+	}
+
+	var messages []string
+	var largest int64
+	for len(body) >= rpcFrameHeaderSize {
+		flags := body[0]
+		size := int64(binary.BigEndian.Uint32([]byte(body[1:rpcFrameHeaderSize])))
+		body = body[rpcFrameHeaderSize:]
+		message := body[:min(size, int64(len(body)))]
+		body = body[len(message):]
+		if flags&rpcFrameTrailers != 0 {
+			continue
+		}
+		largest = max(largest, size)
+		if flags&rpcFrameCompressed == 0 {
+			messages = append(messages, message)
+		}
+	}
+	return strings.Join(messages, "\n"), largest
+}
+
+// decodeGRPCWebText decodes a gRPC-Web text body, whose frames may be encoded in base64
+// separately, each with its own padding.
+func decodeGRPCWebText(body string) (string, error) {
+	body = strings.Join(strings.Fields(body), "")
+	var decoded strings.Builder
+	for body != "" {
+		end := strings.IndexByte(body, '=')
+		if end < 0 {
+			end = len(body)
+		}
+		for end < len(body) && body[end] == '=' {
+			end++
+		}
+		chunk, err := base64.StdEncoding.DecodeString(body[:end])
+		if err != nil {
+			return "", err
+		}
+		decoded.Write(chunk)
+		body = body[end:]
+	}
+	return decoded.String(), nil
+}
+
+// rpcMessageTooLargeError is returned by an rpcFrameReader for a message over the limit.
+type rpcMessageTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *rpcMessageTooLargeError) Error() string {
+	return fmt.Sprintf("rpc message of %d bytes over the limit of %d bytes", e.Size, e.Limit)
+}
+
+// rpcFrameReader follows the frames of a streamed RPC body as it is read, failing the read
+// of a message over the limit, so streams are checked without being buffered.
+type rpcFrameReader struct {
+	io.ReadCloser
+	limit    int64
+	exceeded func(size int64) // Called once, for the first message over the limit
+
+	header    [rpcFrameHeaderSize]byte
+	headerLen int   // Bytes of the current frame header read so far
+	remaining int64 // Bytes of the current message left to read
+	err       error
+}
+
+// Read reads the body, following the frame headers.
+func (f *rpcFrameReader) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.ReadCloser.Read(p)
+	for data := p[:n]; len(data) > 0; {
+		if f.remaining > 0 {
+			skipped := min(f.remaining, int64(len(data)))
+			f.remaining -= skipped
+			data = data[skipped:]
+			continue
+		}
+		copied := copy(f.header[f.headerLen:], data)
+		f.headerLen += copied
+		data = data[copied:]
+		if f.headerLen < rpcFrameHeaderSize {
+			continue
+		}
+		f.headerLen = 0
+		f.remaining = int64(binary.BigEndian.Uint32(f.header[1:]))
+		if f.header[0]&rpcFrameTrailers == 0 && f.remaining > f.limit {
+			f.err = &rpcMessageTooLargeError{Size: f.remaining, Limit: f.limit}
+			f.exceeded(f.remaining)
+			return 0, f.err
+		}
+	}
+	return n, err
+}
+
+// rpcMetadataSize returns the total size of the request headers, which carry the metadata
+// of RPC calls.
+func rpcMetadataSize(header http.Header) int64 {
+	var size int64
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// metadataViolation returns why the metadata of an RPC call is rejected, or an empty
+// string.
+func (c *RPCConfig) metadataViolation(r *http.Request) string {
+	if c.MaxMetadataSize > 0 && rpcMetadataSize(r.Header) > c.MaxMetadataSize {
+		return "metadata_size"
+	}
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" && !grpcTimeoutRegex.MatchString(timeout) {
+		return "timeout"
+	}
+	if timeout := r.Header.Get("Connect-Timeout-Ms"); timeout != "" && !connectTimeoutRegex.MatchString(timeout) {
+		return "timeout"
+	}
+	return ""
+}
+
+// checkRPC checks in phase 1 the metadata of RPC calls, blocking those over the size limit
+// or with a malformed timeout. The messages of streamed calls are checked as the upstream
+// handler reads them, the call failing at the first message over the size limit. It reports
+// whether the request was blocked.
+func (m *Middleware) checkRPC(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.RPC
+	if config == nil {
+		return false
+	}
+	protocol := rpcProtocolOf(r)
+	if protocol == "" {
+		return false
+	}
+	if violation := config.metadataViolation(r); violation != "" {
+		m.rpcHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusBadRequest, "rpc", rpcRuleID,
+			zap.String("message", "RPC call blocked for its metadata"),
+			zap.String("protocol", protocol),
+			zap.String("violation", violation),
+		)
+		return true
+	}
+	if rpcStreamsRequest(protocol) && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &rpcFrameReader{ReadCloser: r.Body, limit: config.MaxMessageSize, exceeded: func(size int64) {
+			m.rpcHits.Add(1)
+			m.logger.Warn("RPC stream failed for a message over the size limit",
+				zap.String("log_id", getLogID(r.Context())),
+				zap.String("protocol", protocol),
+				zap.Int64("message_size", size),
+				zap.Int64("max_message_size", config.MaxMessageSize),
+			)
+		}}
+	}
+	return false
+}
+
+// checkRPCMessages blocks in phase 2 the RPC calls whose body, read through the BODY target,
+// holds a message over the size limit. It reports whether the request was blocked.
+func (m *Middleware) checkRPCMessages(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.RPC
+	if config == nil || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	protocol := rpcProtocolOf(r)
+	if protocol == "" || rpcStreamsRequest(protocol) {
+		return false
+	}
+	if _, err := m.extractTarget(TargetBody, r, nil, state); err != nil {
+		return false
+	}
+	size := state.rpcMessageSize
+	if protocol == rpcConnect {
+		size = max(size, r.ContentLength) // The message is the body, maybe truncated
+	}
+	if size <= config.MaxMessageSize {
+		return false
+	}
+	m.rpcHits.Add(1)
+	m.blockRequest(w, r, state, http.StatusRequestEntityTooLarge, "rpc", rpcRuleID,
+		zap.String("message", "RPC call blocked for a message over the size limit"),
+		zap.String("protocol", protocol),
+		zap.Int64("message_size", size),
+		zap.Int64("max_message_size", config.MaxMessageSize),
+	)
+	return true
+}
@@ -0,0 +1,222 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// rpcFrame frames a message as gRPC, gRPC-Web and Connect streams do.
+func rpcFrame(flags byte, message string) string {
+	header := make([]byte, rpcFrameHeaderSize)
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	return string(header) + message
+}
+
+func rpcRequest(method, target, contentType, body string) *http.Request {
+	req := testRequest(method, target, contentType, body)
+	if contentType == "application/proto" || contentType == "application/json" {
+		req.Header.Set("Connect-Protocol-Version", "1")
+	}
+	return req
+}
+
+func TestRPCProtocolOf(t *testing.T) {
+	for contentType, protocol := range map[string]string{
+		"application/grpc":                "grpc",
+		"application/grpc+proto":          "grpc",
+		"application/grpc-web":            "grpc-web",
+		"application/grpc-web+proto":      "grpc-web",
+		"application/grpc-web+json":       "grpc-web",
+		"application/grpc-web-text":       "grpc-web-text",
+		"application/grpc-web-text+proto": "grpc-web-text",
+		"application/connect+proto":       "connect-stream",
+		"application/connect+json":        "connect-stream",
+		"application/proto":               "connect",
+		"application/json":                "connect",
+	} {
+		assert.Equal(t, protocol, rpcProtocolOf(rpcRequest("POST", "/acme.v1.Service/Method", contentType, "")), contentType)
+	}
+	assert.Empty(t, rpcProtocolOf(testRequest("POST", "/api/users", "application/json", "")), "JSON without the Connect header")
+	assert.Equal(t, "connect", rpcProtocolOf(testRequest("GET", "/acme.v1.Service/Method?connect=v1&encoding=json&message=%7B%7D", "", "")))
+	assert.Empty(t, rpcProtocolOf(testRequest("GET", "/search?q=connect=v1", "", "")))
+}
+
+func TestDecodeRPCBody(t *testing.T) {
+	body := rpcFrame(0, `{"name": "a"}`) + rpcFrame(0, `{"name": "bb"}`) + rpcFrame(rpcFrameCompressed, "\x1f\x8b") + rpcFrame(rpcFrameTrailers, "grpc-status: 0\r\n")
+	messages, largest := decodeRPCBody(rpcGRPCWeb, body)
+	assert.Equal(t, "{\"name\": \"a\"}\n{\"name\": \"bb\"}", messages, "compressed messages and trailers are left out")
+	assert.Equal(t, int64(14), largest)
+
+	text := base64.StdEncoding.EncodeToString([]byte(rpcFrame(0, "hello"))) + base64.StdEncoding.EncodeToString([]byte(rpcFrame(0, "world!")))
+	messages, largest = decodeRPCBody(rpcGRPCWebText, text)
+	assert.Equal(t, "hello\nworld!", messages, "frames encoded separately")
+	assert.Equal(t, int64(6), largest)
+
+	messages, largest = decodeRPCBody(rpcConnectStream, rpcFrame(0, strings.Repeat("a", 1000))[:20])
+	assert.Equal(t, strings.Repeat("a", 15), messages)
+	assert.Equal(t, int64(1000), largest, "as declared by a truncated frame")
+
+	messages, largest = decodeRPCBody(rpcConnect, `{"name": "a"}`)
+	assert.Equal(t, `{"name": "a"}`, messages, "unary Connect bodies are unframed")
+	assert.Equal(t, int64(13), largest)
+
+	messages, _ = decodeRPCBody(rpcGRPCWebText, "not base64!")
+	assert.Equal(t, "not base64!", messages)
+	messages, _ = decodeRPCBody("", "plain")
+	assert.Equal(t, "plain", messages)
+}
+
+func TestRPCFrameReader(t *testing.T) {
+	var exceeded []int64
+	stream := rpcFrame(0, "small") + rpcFrame(rpcFrameTrailers, strings.Repeat("t", 20)) + rpcFrame(0, "tiny")
+	reader := &rpcFrameReader{ReadCloser: io.NopCloser(iotest.OneByteReader(strings.NewReader(stream))), limit: 8,
+		exceeded: func(size int64) { exceeded = append(exceeded, size) }}
+	read, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, stream, string(read), "trailers aren't limited")
+	assert.Empty(t, exceeded)
+
+	stream = rpcFrame(0, "small") + rpcFrame(0, strings.Repeat("a", 9))
+	reader = &rpcFrameReader{ReadCloser: io.NopCloser(strings.NewReader(stream)), limit: 8,
+		exceeded: func(size int64) { exceeded = append(exceeded, size) }}
+	_, err = io.ReadAll(reader)
+	var tooLarge *rpcMessageTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	assert.Equal(t, int64(9), tooLarge.Size)
+	_, err = reader.Read(make([]byte, 10))
+	assert.Error(t, err)
+	assert.Equal(t, []int64{9}, exceeded)
+}
+
+func TestCheckRPC(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.RPC = &RPCConfig{MaxMessageSize: 16, MaxMetadataSize: 100}
+	require.NoError(t, m.RPC.provision())
+
+	req := rpcRequest("POST", "/acme.v1.Chat/Stream", "application/connect+proto", rpcFrame(0, strings.Repeat("a", 17)))
+	req.Header.Set("Connect-Timeout-Ms", "5000")
+	assert.False(t, m.checkRPC(httptest.NewRecorder(), req, &WAFState{}))
+	_, err := io.ReadAll(req.Body)
+	assert.Error(t, err, "streamed messages are checked as they are read")
+	assert.Equal(t, int64(1), m.rpcHits.Load())
+
+	assert.False(t, m.checkRPC(httptest.NewRecorder(), testRequest("POST", "/api", "application/json", ""), &WAFState{}), "not an RPC call")
+
+	req = rpcRequest("POST", "/acme.v1.Users/Get", "application/grpc-web+proto", "")
+	req.Header.Set("Grpc-Timeout", "soon")
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkRPC(w, req, state))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, rpcRuleID, state.blockRuleID)
+
+	req = rpcRequest("POST", "/acme.v1.Users/Get", "application/proto", "")
+	req.Header.Set("X-Metadata", strings.Repeat("m", 100))
+	assert.True(t, m.checkRPC(httptest.NewRecorder(), req, &WAFState{}), "metadata over the limit")
+	assert.Equal(t, int64(3), m.rpcHits.Load())
+
+	for _, config := range []*RPCConfig{{MaxMessageSize: -1}, {MaxMetadataSize: -1}} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckRPCMessages(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	m.RPC = &RPCConfig{MaxMessageSize: 16}
+	require.NoError(t, m.RPC.provision())
+
+	body := rpcFrame(0, `{"id": "42"}`)
+	req := rpcRequest("POST", "/acme.v1.Users/Get", "application/grpc-web+json", body)
+	state := &WAFState{}
+	assert.False(t, m.checkRPCMessages(httptest.NewRecorder(), req, state))
+	inspected, err := m.extractTarget("JSON_PATH:id", req, nil, state)
+	require.NoError(t, err)
+	assert.Equal(t, "42", inspected, "rules see the message")
+	replayed, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(replayed), "the upstream handler reads the framed body")
+
+	for _, req := range []*http.Request{
+		rpcRequest("POST", "/acme.v1.Users/Create", "application/grpc-web+proto", rpcFrame(0, strings.Repeat("a", 17))),
+		rpcRequest("POST", "/acme.v1.Users/Create", "application/grpc-web-text", base64.StdEncoding.EncodeToString([]byte(rpcFrame(0, strings.Repeat("a", 17))))),
+		rpcRequest("POST", "/acme.v1.Users/Create", "application/json", `{"name": "`+strings.Repeat("a", 17)+`"}`),
+	} {
+		w := httptest.NewRecorder()
+		state := &WAFState{}
+		assert.True(t, m.checkRPCMessages(w, req, state), req.Header.Get("Content-Type"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal(t, rpcRuleID, state.blockRuleID)
+	}
+	assert.Equal(t, int64(3), m.rpcHits.Load())
+}
+
+func TestServeHTTP_RPCStreaming(t *testing.T) {
+	logger := zap.NewNop()
+	m := &Middleware{
+		logger: logger,
+		Rules: map[int][]Rule{
+			2: {{ID: "body", Targets: []string{"BODY"}, Phase: 2, Score: 5, Action: "block", regex: regexp.MustCompile("attack")}},
+			4: {{ID: "response", Targets: []string{"RESPONSE_BODY"}, Phase: 4, Score: 5, Action: "block", regex: regexp.MustCompile("secret")}},
+		},
+		AnomalyThreshold:      5,
+		SlowClient:            &SlowClientConfig{MinRate: 1 << 20, Grace: time.Millisecond},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+
+	// The client keeps its stream open: the WAF must not wait for its end
+	body, client := io.Pipe()
+	defer client.Close()
+	go client.Write([]byte(rpcFrame(0, "hello")))
+	req := httptest.NewRequest("POST", "/acme.v1.Chat/Converse", body)
+	req.Header.Set("Content-Type", "application/connect+proto")
+	w := httptest.NewRecorder()
+	done := make(chan error, 1)
+	go func() {
+		done <- m.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			message := make([]byte, len(rpcFrame(0, "hello")))
+			if _, err := io.ReadFull(r.Body, message); err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "application/connect+proto")
+			_, err := w.Write([]byte(rpcFrame(0, "secret")))
+			w.(http.Flusher).Flush()
+			return err
+		}))
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the WAF waited for the end of the stream")
+	}
+	assert.Equal(t, rpcFrame(0, "secret"), w.Body.String(), "streamed responses are passed through")
+	assert.True(t, w.Flushed)
+}
@@ -0,0 +1,185 @@
+package caddywaf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+// ruleBundleMagic starts every rule bundle, so bundles and JSON rule files can share rule_file.
+var ruleBundleMagic = []byte("CADDYWAF-RULES\x00")
+
+const ruleBundleVersion uint16 = 1
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "waf",
+		Usage: "<command>",
+		Short: "Tools for the WAF module",
+		CobraFunc: func(cmd *cobra.Command) {
+			compile := &cobra.Command{
+				Use:   "compile [--output <file>] <rule files...>",
+				Short: "Validates rule files and writes them as a precompiled bundle",
+				Long: `
+Validates the rule files, drops duplicates and resolves priorities, then writes
+the result as a binary bundle. Point rule_file at the bundle to skip JSON
+decoding and validation at startup and on reload; its regular expressions are
+compiled in parallel when it is loaded.
+
+Compilation fails if any rule is invalid.`,
+				Args: cobra.MinimumNArgs(1),
+				RunE: func(cmd *cobra.Command, args []string) error {
+					output, _ := cmd.Flags().GetString("output")
+					bundle, err := BuildRuleBundle(args)
+					if err != nil {
+						return err
+					}
+					if err := bundle.WriteFile(output); err != nil {
+						return err
+					}
+					fmt.Fprintf(cmd.OutOrStdout(), "Compiled %d rules from %d files into %s\n", len(bundle.Rules), len(args), output)
+					return nil
+				},
+			}
+			compile.Flags().StringP("output", "o", "rules.wafrb", "Bundle file to write")
+			cmd.AddCommand(compile)
+		},
+	})
+}
+
+// RuleBundle is a set of validated rules, in evaluation order within each phase.
+type RuleBundle struct {
+	Created time.Time
+	Sources []string // Rule files the bundle was compiled from
+	Rules   []Rule
+}
+
+// BuildRuleBundle loads and validates rule files the same way rule_file does.
+// It fails if any file or rule is invalid.
+func BuildRuleBundle(paths []string) (*RuleBundle, error) {
+	m := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	bundle := &RuleBundle{Created: time.Now().UTC(), Sources: paths}
+	ruleIDs := make(map[string]bool)
+	for _, path := range paths {
+		fileRules, invalidRules, err := m.loadRulesFromFile(path, ruleIDs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(invalidRules) > 0 {
+			return nil, fmt.Errorf("%s: %d invalid rules: %v", path, len(invalidRules), invalidRules)
+		}
+		for phase := 1; phase <= 4; phase++ {
+			bundle.Rules = append(bundle.Rules, fileRules[phase]...)
+		}
+	}
+	if len(bundle.Rules) == 0 {
+		return nil, fmt.Errorf("no rules found")
+	}
+	return bundle, nil
+}
+
+// WriteFile writes the bundle atomically: magic, version, SHA-256 of the payload, then the gob payload.
+func (b *RuleBundle) WriteFile(path string) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(b); err != nil {
+		return fmt.Errorf("failed to encode rule bundle: %w", err)
+	}
+	sum := sha256.Sum256(payload.Bytes())
+
+	var out bytes.Buffer
+	out.Write(ruleBundleMagic)
+	_ = binary.Write(&out, binary.BigEndian, ruleBundleVersion)
+	out.Write(sum[:])
+	out.Write(payload.Bytes())
+	return writeFileAtomic(path, out.Bytes())
+}
+
+// isRuleBundle reports whether file content is a rule bundle rather than JSON.
+func isRuleBundle(content []byte) bool {
+	return bytes.HasPrefix(content, ruleBundleMagic)
+}
+
+// decodeRuleBundle verifies and decodes the content of a bundle file.
+func decodeRuleBundle(content []byte) (*RuleBundle, error) {
+	header := len(ruleBundleMagic) + 2 + sha256.Size
+	if !isRuleBundle(content) || len(content) < header {
+		return nil, fmt.Errorf("not a rule bundle")
+	}
+	version := binary.BigEndian.Uint16(content[len(ruleBundleMagic):])
+	if version != ruleBundleVersion {
+		return nil, fmt.Errorf("unsupported rule bundle version %d, recompile it with this version of the WAF", version)
+	}
+	payload := content[header:]
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], content[header-sha256.Size:header]) {
+		return nil, fmt.Errorf("rule bundle checksum mismatch")
+	}
+	var bundle RuleBundle
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("failed to decode rule bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// loadRuleBundle loads the rules of a bundle file. Rules were validated when the bundle
+// was compiled, so only duplicate IDs across files are checked; regexes are compiled in parallel.
+func (m *Middleware) loadRuleBundle(path string, content []byte, ruleIDs map[string]bool) (map[int][]Rule, []string, error) {
+	bundle, err := decodeRuleBundle(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var invalidRules []string
+	rules := make([]Rule, 0, len(bundle.Rules))
+	for i, rule := range bundle.Rules {
+		if ruleIDs[rule.ID] {
+			invalidRules = append(invalidRules, fmt.Sprintf("Duplicate rule ID '%s' at index %d", rule.ID, i))
+			continue
+		}
+		ruleIDs[rule.ID] = true
+		rules = append(rules, rule)
+	}
+
+	errs := make([]error, len(rules))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = m.compileRule(&rules[i])
+			}
+		}()
+	}
+	for i := range rules {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	validRules := make(map[int][]Rule)
+	for i, rule := range rules {
+		if errs[i] != nil {
+			invalidRules = append(invalidRules, fmt.Sprintf("Rule '%s': %v", rule.ID, errs[i]))
+			continue
+		}
+		validRules[rule.Phase] = append(validRules[rule.Phase], rule)
+	}
+	m.logger.Debug("Rules loaded from bundle",
+		zap.String("file", path),
+		zap.Int("rules", len(rules)),
+		zap.Strings("sources", bundle.Sources),
+		zap.Time("compiled", bundle.Created),
+	)
+	return validRules, invalidRules, nil
+}
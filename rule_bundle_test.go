@@ -0,0 +1,101 @@
+package caddywaf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeBundleTestRules(t *testing.T, dir string) []string {
+	first := filepath.Join(dir, "first.json")
+	require.NoError(t, os.WriteFile(first, []byte(`[
+		{"id": "low", "phase": 2, "pattern": "low", "targets": ["URI"], "score": 1, "mode": "log", "Priority": 1},
+		{"id": "high", "phase": 2, "pattern": "high", "targets": ["URI"], "score": 5, "mode": "block", "Priority": 10},
+		{"id": "ua", "phase": 1, "pattern": "(?i)sqlmap", "targets": ["HEADERS:User-Agent"], "score": 3}
+	]`), 0o644))
+	second := filepath.Join(dir, "second.json")
+	require.NoError(t, os.WriteFile(second, []byte(`[
+		{"id": "leak", "phase": 4, "pattern": "password", "targets": ["RESPONSE_BODY"], "score": 5, "mode": "block"}
+	]`), 0o644))
+	return []string{first, second}
+}
+
+func TestRuleBundle_LoadsLikeJSON(t *testing.T) {
+	dir := t.TempDir()
+	sources := writeBundleTestRules(t, dir)
+
+	bundle, err := BuildRuleBundle(sources)
+	require.NoError(t, err)
+	require.Len(t, bundle.Rules, 4)
+	bundlePath := filepath.Join(dir, "rules.wafrb")
+	require.NoError(t, bundle.WriteFile(bundlePath))
+
+	fromJSON := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	require.NoError(t, fromJSON.loadRules(sources))
+	fromBundle := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	require.NoError(t, fromBundle.loadRules([]string{bundlePath}))
+
+	for phase := 1; phase <= 4; phase++ {
+		require.Len(t, fromBundle.Rules[phase], len(fromJSON.Rules[phase]), "phase %d", phase)
+		for i, rule := range fromJSON.Rules[phase] {
+			loaded := fromBundle.Rules[phase][i]
+			assert.Equal(t, rule.ID, loaded.ID)
+			assert.Equal(t, rule.Action, loaded.Action)
+			assert.Equal(t, rule.Priority, loaded.Priority)
+			require.NotNil(t, loaded.regex)
+			assert.Equal(t, rule.Pattern, loaded.regex.String())
+		}
+	}
+	assert.Equal(t, "high", fromBundle.Rules[2][0].ID, "priority order is kept")
+
+	// Bundles and JSON files can be mixed, with duplicate IDs still rejected
+	mixed := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	require.NoError(t, mixed.loadRules([]string{sources[0], bundlePath}))
+	assert.Len(t, mixed.Rules[4], 1)
+	assert.Len(t, mixed.Rules[2], 2)
+}
+
+func TestBuildRuleBundle_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`[
+		{"id": "ok", "phase": 1, "pattern": "a", "targets": ["URI"]},
+		{"id": "broken", "phase": 1, "pattern": "(", "targets": ["URI"]}
+	]`), 0o644))
+	_, err := BuildRuleBundle([]string{invalid})
+	assert.ErrorContains(t, err, "1 invalid rules")
+
+	_, err = BuildRuleBundle([]string{filepath.Join(dir, "missing.json")})
+	assert.Error(t, err)
+}
+
+func TestDecodeRuleBundle_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	bundle, err := BuildRuleBundle(writeBundleTestRules(t, dir))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "rules.wafrb")
+	require.NoError(t, bundle.WriteFile(path))
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	decoded, err := decodeRuleBundle(content)
+	require.NoError(t, err)
+	assert.Equal(t, bundle.Sources, decoded.Sources)
+
+	corrupt := append([]byte(nil), content...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	_, err = decodeRuleBundle(corrupt)
+	assert.ErrorContains(t, err, "checksum")
+
+	future := append([]byte(nil), content...)
+	future[len(ruleBundleMagic)+1] = 99
+	_, err = decodeRuleBundle(future)
+	assert.ErrorContains(t, err, "version")
+
+	_, err = decodeRuleBundle(ruleBundleMagic)
+	assert.Error(t, err)
+}
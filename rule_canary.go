@@ -0,0 +1,300 @@
+package caddywaf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCanaryDuration        = time.Hour
+	defaultCanaryMaxMatchPercent = 1.0
+	maxCanaryCheckInterval       = time.Minute
+)
+
+// Canary states of a rule
+const (
+	CanaryStateCanary   = "canary"   // Log-only until the end of its canary period
+	CanaryStateShadowed = "shadowed" // Matched too often during its canary, kept log-only
+)
+
+// RuleCanaryConfig runs the rules that a reload adds or changes in log-only mode for a
+// canary period, then enforces them if they matched at most MaxMatchPercent of the
+// requests, or alerts and keeps them log-only.
+type RuleCanaryConfig struct {
+	Duration        time.Duration `json:"duration,omitempty"`          // Canary period, default 1h
+	MaxMatchPercent float64       `json:"max_match_percent,omitempty"` // Match rate promoting a rule, default 1%
+}
+
+// CanaryStatus is a rule in canary or shadowed, as listed by the admin API.
+type CanaryStatus struct {
+	RuleID   string    `json:"rule_id"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Matches  int64     `json:"matches"`
+	Requests int64     `json:"requests"`
+}
+
+// canaryRule is the state of a rule in canary or shadowed.
+type canaryRule struct {
+	state    string
+	since    time.Time
+	requests int64 // Requests counted when the canary started
+	matches  int64
+}
+
+// canaryResult is a rule whose canary period ended.
+type canaryResult struct {
+	ruleID    string
+	promoted  bool
+	matches   int64
+	requests  int64
+	matchRate float64 // Percentage of the requests the rule matched
+}
+
+// ruleCanary tracks the rules in canary across reloads.
+type ruleCanary struct {
+	config   RuleCanaryConfig
+	requests atomic.Int64 // Requests since provisioning
+
+	mu           sync.Mutex
+	fingerprints map[string]string // Fingerprint of the loaded rules by ID, nil before the first load
+	rules        map[string]*canaryRule
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newRuleCanary applies the defaults and creates the canary tracker.
+func newRuleCanary(config RuleCanaryConfig) (*ruleCanary, error) {
+	if config.Duration <= 0 {
+		config.Duration = defaultCanaryDuration
+	}
+	if config.MaxMatchPercent == 0 {
+		config.MaxMatchPercent = defaultCanaryMaxMatchPercent
+	}
+	if config.MaxMatchPercent < 0 || config.MaxMatchPercent > 100 {
+		return nil, fmt.Errorf("invalid rule_canary max_match_percent %v, must be between 0 and 100", config.MaxMatchPercent)
+	}
+	return &ruleCanary{
+		config: config,
+		rules:  make(map[string]*canaryRule),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// ruleFingerprint identifies the content of a rule, to tell changed rules apart.
+func ruleFingerprint(rule Rule) string {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// observe records the loaded rules and starts the canary of the rules added or changed since
+// the previous load, returning their IDs. The rules of the first load are enforced at once.
+func (rc *ruleCanary) observe(rules map[int][]Rule, now time.Time) []string {
+	fingerprints := make(map[string]string)
+	for _, phaseRules := range rules {
+		for _, rule := range phaseRules {
+			fingerprints[rule.ID] = ruleFingerprint(rule)
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var started []string
+	if rc.fingerprints != nil {
+		for id, fingerprint := range fingerprints {
+			if previous, ok := rc.fingerprints[id]; ok && previous == fingerprint {
+				continue
+			}
+			rc.rules[id] = &canaryRule{state: CanaryStateCanary, since: now, requests: rc.requests.Load()}
+			started = append(started, id)
+		}
+	}
+	for id := range rc.rules {
+		if _, ok := fingerprints[id]; !ok {
+			delete(rc.rules, id)
+		}
+	}
+	rc.fingerprints = fingerprints
+	sort.Strings(started)
+	return started
+}
+
+// match counts a match of a rule and reports whether the rule is log-only, in canary or
+// shadowed.
+func (rc *ruleCanary) match(ruleID string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rule, ok := rc.rules[ruleID]
+	if ok {
+		rule.matches++
+	}
+	return ok
+}
+
+// evaluate ends the canary of the rules whose period is over, promoting those below the
+// match rate and shadowing the others.
+func (rc *ruleCanary) evaluate(now time.Time) []canaryResult {
+	requests := rc.requests.Load()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var results []canaryResult
+	for id, rule := range rc.rules {
+		if rule.state != CanaryStateCanary || now.Sub(rule.since) < rc.config.Duration {
+			continue
+		}
+		result := canaryResult{ruleID: id, matches: rule.matches, requests: requests - rule.requests}
+		result.matchRate = 100 * float64(result.matches) / float64(max(result.requests, 1))
+		result.promoted = result.matchRate <= rc.config.MaxMatchPercent
+		if result.promoted {
+			delete(rc.rules, id)
+		} else {
+			rule.state = CanaryStateShadowed
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ruleID < results[j].ruleID })
+	return results
+}
+
+// promote enforces a rule in canary or shadowed, reporting whether it was.
+func (rc *ruleCanary) promote(ruleID string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	_, ok := rc.rules[ruleID]
+	delete(rc.rules, ruleID)
+	return ok
+}
+
+// statuses lists the rules in canary or shadowed, sorted by ID.
+func (rc *ruleCanary) statuses() []CanaryStatus {
+	requests := rc.requests.Load()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	statuses := make([]CanaryStatus, 0, len(rc.rules))
+	for id, rule := range rc.rules {
+		statuses = append(statuses, CanaryStatus{
+			RuleID:   id,
+			State:    rule.state,
+			Since:    rule.since,
+			Matches:  rule.matches,
+			Requests: requests - rule.requests,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].RuleID < statuses[j].RuleID })
+	return statuses
+}
+
+// Start calls check periodically to end the canary periods.
+func (rc *ruleCanary) Start(check func(now time.Time)) {
+	interval := min(rc.config.Duration, maxCanaryCheckInterval)
+	go func() {
+		defer close(rc.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				check(now)
+			case <-rc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic checks.
+func (rc *ruleCanary) Stop() {
+	rc.stopOnce.Do(func() {
+		close(rc.stop)
+		<-rc.done
+	})
+}
+
+// startRuleCanaries starts the canary of the rules added or changed by a load. The caller
+// must hold m.mu.
+func (m *Middleware) startRuleCanaries(rules map[int][]Rule) {
+	if m.ruleCanary == nil {
+		return
+	}
+	for _, id := range m.ruleCanary.observe(rules, time.Now()) {
+		m.logger.Info("Rule in canary, only logging its matches",
+			zap.String("rule_id", id),
+			zap.Duration("duration", m.ruleCanary.config.Duration),
+		)
+	}
+}
+
+// inRuleCanary counts a match of a rule and reports whether it is log-only for its canary.
+func (m *Middleware) inRuleCanary(ruleID string) bool {
+	return m.ruleCanary != nil && m.ruleCanary.match(ruleID)
+}
+
+// checkRuleCanaries promotes the rules whose canary period ended below the match rate, and
+// alerts on the others, which stay log-only.
+func (m *Middleware) checkRuleCanaries(now time.Time) {
+	for _, result := range m.ruleCanary.evaluate(now) {
+		fields := []zap.Field{
+			zap.String("rule_id", result.ruleID),
+			zap.Int64("matches", result.matches),
+			zap.Int64("requests", result.requests),
+			zap.Float64("match_percent", result.matchRate),
+			zap.Float64("max_match_percent", m.ruleCanary.config.MaxMatchPercent),
+		}
+		if result.promoted {
+			m.logger.Info("Rule canary passed, enforcing the rule", fields...)
+			continue
+		}
+		m.logger.Warn("Rule canary failed, keeping the rule log-only", fields...)
+		if m.notificationManager != nil {
+			m.notificationManager.Alert(BlockEvent{
+				Kind:      EventKindRuleCanary,
+				Timestamp: now,
+				RuleID:    result.ruleID,
+				Reason: fmt.Sprintf("rule matched %.2f%% of %d requests during its canary, above %.2f%%, kept log-only",
+					result.matchRate, result.requests, m.ruleCanary.config.MaxMatchPercent),
+				Severity: m.ruleSeverity(result.ruleID),
+			})
+		}
+	}
+}
+
+// handleRuleCanaryRequest lists the rules in canary or shadowed.
+func (m *Middleware) handleRuleCanaryRequest(w http.ResponseWriter, _ *http.Request) error {
+	if m.ruleCanary == nil {
+		return writeJSONError(w, http.StatusConflict, "rule canaries require the rule_canary directive")
+	}
+	return writeJSON(w, http.StatusOK, m.ruleCanary.statuses())
+}
+
+// handleRuleCanaryPromoteRequest enforces the rule in canary or shadowed of the rule_id
+// query parameter.
+func (m *Middleware) handleRuleCanaryPromoteRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.ruleCanary == nil {
+		return writeJSONError(w, http.StatusConflict, "rule canaries require the rule_canary directive")
+	}
+	ruleID := r.URL.Query().Get("rule_id")
+	if ruleID == "" {
+		return writeJSONError(w, http.StatusBadRequest, "rule_id is required")
+	}
+	if !m.ruleCanary.promote(ruleID) {
+		return writeJSONError(w, http.StatusNotFound, "rule "+ruleID+" is not in canary")
+	}
+	m.logger.Info("Rule promoted via admin API, enforcing the rule", zap.String("rule_id", ruleID), zap.String("remote_addr", r.RemoteAddr))
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "promoted", "rule_id": ruleID})
+}
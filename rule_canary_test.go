@@ -0,0 +1,157 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewRuleCanary(t *testing.T) {
+	rc, err := newRuleCanary(RuleCanaryConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultCanaryDuration, rc.config.Duration)
+	assert.Equal(t, defaultCanaryMaxMatchPercent, rc.config.MaxMatchPercent)
+
+	_, err = newRuleCanary(RuleCanaryConfig{MaxMatchPercent: 101})
+	assert.Error(t, err)
+}
+
+func TestRuleCanary_Lifecycle(t *testing.T) {
+	rc, err := newRuleCanary(RuleCanaryConfig{Duration: time.Hour, MaxMatchPercent: 10})
+	require.NoError(t, err)
+	start := time.Now()
+
+	rules := map[int][]Rule{2: {{ID: "a", Pattern: "x"}, {ID: "b", Pattern: "y"}}}
+	assert.Empty(t, rc.observe(rules, start), "the first load is enforced")
+	assert.False(t, rc.match("a"))
+
+	rules = map[int][]Rule{
+		2: {{ID: "a", Pattern: "x"}, {ID: "b", Pattern: "changed"}},
+		3: {{ID: "c", Pattern: "z"}, {ID: "d", Pattern: "w"}},
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, rc.observe(rules, start))
+	assert.False(t, rc.match("a"), "unchanged rules stay enforced")
+
+	rc.requests.Add(100)
+	for i := 0; i < 5; i++ {
+		assert.True(t, rc.match("b"))
+	}
+	for i := 0; i < 20; i++ {
+		assert.True(t, rc.match("c"))
+	}
+	assert.Empty(t, rc.evaluate(start.Add(30*time.Minute)), "canary period not over")
+
+	results := rc.evaluate(start.Add(time.Hour))
+	require.Len(t, results, 3)
+	assert.Equal(t, canaryResult{ruleID: "b", promoted: true, matches: 5, requests: 100, matchRate: 5}, results[0])
+	assert.Equal(t, canaryResult{ruleID: "c", promoted: false, matches: 20, requests: 100, matchRate: 20}, results[1])
+	assert.True(t, results[2].promoted, "a rule that never matched is promoted")
+
+	assert.False(t, rc.match("b"))
+	assert.True(t, rc.match("c"), "shadowed rules stay log-only")
+	assert.Empty(t, rc.evaluate(start.Add(2*time.Hour)))
+	statuses := rc.statuses()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, CanaryStateShadowed, statuses[0].State)
+	assert.Equal(t, int64(21), statuses[0].Matches)
+
+	// Removing a shadowed rule forgets it, promoting it enforces it
+	assert.Empty(t, rc.observe(map[int][]Rule{2: {{ID: "a", Pattern: "x"}}}, start))
+	assert.Empty(t, rc.statuses())
+	assert.Equal(t, []string{"c"}, rc.observe(map[int][]Rule{3: {{ID: "c", Pattern: "z"}}}, start))
+	assert.True(t, rc.promote("c"))
+	assert.False(t, rc.promote("c"))
+	assert.False(t, rc.match("c"))
+}
+
+func TestReloadRules_Canary(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`[{"id": "a", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5, "mode": "block"}]`), 0o644))
+
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 10, RuleFiles: []string{ruleFile}}
+	m.ruleCanary, _ = newRuleCanary(RuleCanaryConfig{})
+	require.NoError(t, m.loadRules(m.RuleFiles))
+
+	require.NoError(t, os.WriteFile(ruleFile, []byte(`[
+		{"id": "a", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5, "mode": "block"},
+		{"id": "new", "phase": 1, "pattern": "y", "targets": ["URI"], "score": 5, "mode": "block"}
+	]`), 0o644))
+	require.NoError(t, m.ReloadRules())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ContextKeyLogId("logID"), "test-log-id"))
+	state := &WAFState{}
+	assert.True(t, m.processRuleMatch(httptest.NewRecorder(), r, &m.Rules[1][1], "y", state), "the new rule only logs")
+	assert.False(t, state.Blocked)
+	assert.False(t, m.processRuleMatch(httptest.NewRecorder(), r, &m.Rules[1][0], "x", state), "the unchanged rule blocks")
+	assert.True(t, state.Blocked)
+}
+
+func TestCheckRuleCanaries_Alert(t *testing.T) {
+	var alerts []BlockEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		alerts = append(alerts, BlockEvent{Reason: payload["text"]})
+	}))
+	defer server.Close()
+
+	nm, err := NewNotificationManager(zap.NewNop(), []NotifierConfig{{Type: NotifierSlack, WebhookURL: server.URL, Template: "{{.Kind}} {{.RuleID}}"}})
+	require.NoError(t, err)
+	nm.Start()
+
+	m := &Middleware{logger: zap.NewNop(), notificationManager: nm}
+	m.ruleCanary, _ = newRuleCanary(RuleCanaryConfig{Duration: time.Minute})
+	start := time.Now()
+	m.ruleCanary.observe(map[int][]Rule{}, start)
+	m.ruleCanary.observe(map[int][]Rule{2: {{ID: "noisy"}}}, start)
+	m.ruleCanary.requests.Add(10)
+	m.ruleCanary.match("noisy")
+
+	m.checkRuleCanaries(start.Add(time.Minute))
+	nm.Stop()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "rule_canary noisy", alerts[0].Reason)
+}
+
+func TestHandleRuleCanaryRequests(t *testing.T) {
+	m := newAPITestMiddleware()
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/rules/canary", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	m.ruleCanary, _ = newRuleCanary(RuleCanaryConfig{})
+	m.ruleCanary.observe(map[int][]Rule{}, time.Now())
+	m.ruleCanary.observe(map[int][]Rule{1: {{ID: "new"}}}, time.Now())
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/rules/canary", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var statuses []CanaryStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "new", statuses[0].RuleID)
+	assert.Equal(t, CanaryStateCanary, statuses[0].State)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/rules/canary/promote", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/rules/canary/promote?rule_id=new", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, m.inRuleCanary("new"))
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/rules/canary/promote?rule_id=new", nil)))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
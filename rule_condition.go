@@ -0,0 +1,305 @@
+package caddywaf
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+	"go.uber.org/zap"
+)
+
+// Names of the variables and functions of rule conditions. The target macro is rewritten
+// into a call of the hidden target function on the hidden request variable.
+const (
+	conditionRequestVar  = "request"
+	conditionTxVar       = "tx"
+	conditionTargetMacro = "target"
+	conditionWAFVar      = "waf_request"
+	conditionTargetFunc  = "waf_target"
+	conditionEntropyFunc = "entropy"
+	conditionSSRFFunc    = "ssrf"
+	conditionRedirFunc   = "open_redirect"
+)
+
+var conditionRequestType = cel.ObjectType("caddywaf.Request", traits.ReceiverType)
+
+var (
+	conditionEnvOnce sync.Once
+	conditionEnv     *cel.Env
+	conditionEnvErr  error
+)
+
+// ruleConditionEnv returns the CEL environment rule conditions are compiled in, shared by
+// all rules as it holds no per-request state.
+func ruleConditionEnv() (*cel.Env, error) {
+	conditionEnvOnce.Do(func() {
+		conditionEnv, conditionEnvErr = cel.NewEnv(
+			cel.Variable(conditionRequestVar, cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable(conditionTxVar, cel.MapType(cel.StringType, cel.DynType)),
+			cel.Variable(conditionWAFVar, conditionRequestType),
+			cel.Function(conditionTargetFunc,
+				cel.Overload(conditionTargetFunc+"_request_string",
+					[]*cel.Type{conditionRequestType, cel.StringType},
+					cel.StringType,
+					cel.BinaryBinding(conditionTarget),
+				),
+			),
+			cel.Function(conditionEntropyFunc,
+				cel.Overload(conditionEntropyFunc+"_string",
+					[]*cel.Type{cel.StringType},
+					cel.DoubleType,
+					cel.UnaryBinding(conditionEntropy),
+				),
+			),
+			cel.Function(conditionSSRFFunc,
+				cel.Overload(conditionSSRFFunc+"_string",
+					[]*cel.Type{cel.StringType},
+					cel.BoolType,
+					cel.UnaryBinding(conditionSSRF),
+				),
+			),
+			cel.Function(conditionRedirFunc,
+				cel.Overload(conditionRedirFunc+"_string_list",
+					[]*cel.Type{cel.StringType, cel.ListType(cel.StringType)},
+					cel.BoolType,
+					cel.BinaryBinding(conditionOpenRedirect),
+				),
+			),
+			cel.Macros(cel.GlobalMacro(conditionTargetMacro, 1, expandConditionTarget)),
+			ext.Strings(),
+		)
+	})
+	return conditionEnv, conditionEnvErr
+}
+
+// expandConditionTarget rewrites target(name) into waf_target(waf_request, name).
+func expandConditionTarget(eh cel.MacroExprFactory, _ ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+	return eh.NewCall(conditionTargetFunc, eh.NewIdent(conditionWAFVar), args[0]), nil
+}
+
+// compileRuleCondition compiles a rule condition, which must evaluate to a bool.
+func compileRuleCondition(condition string) (cel.Program, error) {
+	env, err := ruleConditionEnv()
+	if err != nil {
+		return nil, err
+	}
+	checked, issues := env.Compile(condition)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if checked.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("condition must evaluate to a bool, not %s", checked.OutputType())
+	}
+	return env.Program(checked, cel.EvalOptions(cel.OptOptimize))
+}
+
+// conditionHolds reports whether the condition of a rule holds for the request. Rules
+// outside their active hours and days, or disabled for their false positives, never hold,
+// rules without a condition otherwise always hold, and conditions failing to evaluate, such
+// as by indexing a missing header, don't.
+func (m *Middleware) conditionHolds(rule *Rule, w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	if !m.scheduleActive(rule.schedule) || m.ruleDisabled(rule.ID) {
+		return false
+	}
+	if rule.condition == nil {
+		return true
+	}
+	out, _, err := rule.condition.Eval(&conditionActivation{m: m, w: w, r: r, state: state, phase: rule.Phase})
+	if err != nil {
+		m.logger.Debug("Rule condition failed to evaluate",
+			zap.String("rule_id", rule.ID),
+			zap.Error(err),
+		)
+		return false
+	}
+	holds, ok := out.Value().(bool)
+	return ok && holds
+}
+
+// conditionOnlyTargets are the targets of rules with only a condition, which match once
+// with the URI as their value.
+var conditionOnlyTargets = []string{TargetURI}
+
+// ruleTargets returns the targets a rule is matched against.
+func ruleTargets(rule *Rule) []string {
+	if len(rule.Targets) == 0 {
+		return conditionOnlyTargets
+	}
+	return rule.Targets
+}
+
+// conditionActivation resolves the variables of a rule condition for a request. It is
+// also the value of the hidden request variable, giving the target function access to
+// the request.
+type conditionActivation struct {
+	m     *Middleware
+	w     http.ResponseWriter
+	r     *http.Request
+	state *WAFState
+	phase int
+
+	request map[string]any
+}
+
+// ResolveName returns the value of a variable, building the request attributes once.
+func (a *conditionActivation) ResolveName(name string) (any, bool) {
+	switch name {
+	case conditionRequestVar:
+		if a.request == nil {
+			a.request = a.requestAttributes()
+		}
+		return a.request, true
+	case conditionTxVar:
+		return map[string]any{
+			"score":             a.state.TotalScore,
+			"anomaly_threshold": a.m.anomalyThreshold(a.state),
+			"matched_rules":     append([]string{}, a.state.MatchedRules...),
+			"phase":             a.phase,
+			"vars":              maps.Clone(a.state.vars),
+		}, true
+	case conditionWAFVar:
+		return a, true
+	}
+	return nil, false
+}
+
+// Parent returns nil, as conditions have no enclosing scope.
+func (a *conditionActivation) Parent() interpreter.Activation {
+	return nil
+}
+
+// requestAttributes returns the request attributes exposed as the request variable.
+func (a *conditionActivation) requestAttributes() map[string]any {
+	r := a.r
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	args := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		args[name] = values[0]
+	}
+	cookies := make(map[string]string)
+	for _, cookie := range r.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return map[string]any{
+		"method":         r.Method,
+		"scheme":         scheme,
+		"host":           r.Host,
+		"path":           r.URL.Path,
+		"query":          r.URL.RawQuery,
+		"uri":            r.URL.RequestURI(),
+		"protocol":       r.Proto,
+		"remote_ip":      extractIP(r.RemoteAddr),
+		"country":        a.m.lookupCountry(a.state, r.RemoteAddr),
+		"user_agent":     r.UserAgent(),
+		"content_type":   r.Header.Get("Content-Type"),
+		"content_length": r.ContentLength,
+		"headers":        headers,
+		"args":           args,
+		"cookies":        cookies,
+	}
+}
+
+// conditionTarget implements target(name), returning the value of a WAF target or an
+// empty string if it can't be extracted.
+func conditionTarget(lhs, rhs ref.Val) ref.Val {
+	a, ok := lhs.(*conditionActivation)
+	if !ok {
+		return types.NewErr("target requires the request")
+	}
+	name, ok := rhs.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(rhs)
+	}
+	var w http.ResponseWriter // Response targets are only available once there is a response
+	if recorder, ok := a.w.(*responseRecorder); ok {
+		w = recorder
+	}
+	value, err := a.m.extractTarget(string(name), a.r, w, a.state)
+	if err != nil {
+		return types.String("")
+	}
+	return types.String(value)
+}
+
+// conditionEntropy implements entropy(value), returning the Shannon entropy of a string in
+// bits per byte.
+func conditionEntropy(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	return types.Double(shannonEntropy(string(s)))
+}
+
+// conditionSSRF implements ssrf(value), reporting whether a string holds a URL or host
+// pointing at an internal destination.
+func conditionSSRF(value ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	kind, _ := ssrfIndicator(string(s))
+	return types.Bool(kind != "")
+}
+
+// conditionOpenRedirect implements open_redirect(value, hosts), reporting whether a string
+// is a URL redirecting to a host not in the list, where *.example.com allows subdomains.
+func conditionOpenRedirect(value, hosts ref.Val) ref.Val {
+	s, ok := value.(types.String)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(value)
+	}
+	native, err := hosts.ConvertToNative(reflect.TypeOf([]string{}))
+	if err != nil {
+		return types.WrapErr(err)
+	}
+	allowed := native.([]string)
+	for i, host := range allowed {
+		allowed[i] = strings.ToLower(host)
+	}
+	return types.Bool(isOpenRedirect(string(s), allowed))
+}
+
+// ConvertToNative returns the activation itself.
+func (a *conditionActivation) ConvertToNative(reflect.Type) (any, error) {
+	return a, nil
+}
+
+// ConvertToType is not supported, as the request is only passed to the target function.
+func (a *conditionActivation) ConvertToType(ref.Type) ref.Val {
+	return types.NewErr("the request cannot be converted")
+}
+
+// Equal reports whether other is the same request.
+func (a *conditionActivation) Equal(other ref.Val) ref.Val {
+	o, ok := other.(*conditionActivation)
+	return types.Bool(ok && o == a)
+}
+
+// Type returns the CEL type of the request.
+func (a *conditionActivation) Type() ref.Type {
+	return conditionRequestType
+}
+
+// Value returns the activation itself.
+func (a *conditionActivation) Value() any {
+	return a
+}
@@ -0,0 +1,129 @@
+package caddywaf
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileRuleCondition(t *testing.T) {
+	_, err := compileRuleCondition(`request.path.startsWith("/api") && target("HEADERS:X-Test").contains("x")`)
+	assert.NoError(t, err)
+
+	_, err = compileRuleCondition(`request.path +`)
+	assert.Error(t, err)
+
+	_, err = compileRuleCondition(`request.path`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must evaluate to a bool")
+
+	_, err = compileRuleCondition(`undefined_variable == 1`)
+	assert.Error(t, err)
+}
+
+func TestConditionHolds(t *testing.T) {
+	m := conditionMiddleware()
+	req := httptest.NewRequest("POST", "http://example.com/api/users?id=7", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", "secret")
+
+	tests := []struct {
+		condition string
+		holds     bool
+	}{
+		{`request.method == "POST" && request.path.startsWith("/api")`, true},
+		{`request.path.startsWith("/admin")`, false},
+		{`request.args["id"] == "7" && request.query == "id=7"`, true},
+		{`request.headers["x-api-key"] == "secret"`, true},
+		{`request.headers["x-missing"] == "x"`, false}, // Evaluation error
+		{`"x-missing" in request.headers`, false},
+		{`request.remote_ip == "10.0.0.1" && request.country == ""`, true},
+		{`target("HEADERS:Content-Type").contains("json")`, true},
+		{`target("COOKIES:missing") == ""`, true},
+		{`tx.score > 3`, true},
+		{`tx.anomaly_threshold == 10 && "r1" in tx.matched_rules && tx.phase == 1`, true},
+		{`request.path.lowerAscii() == "/api/users"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			program, err := compileRuleCondition(tt.condition)
+			require.NoError(t, err)
+			rule := &Rule{ID: "c1", Phase: 1, Condition: tt.condition, condition: program}
+			state := &WAFState{TotalScore: 5, MatchedRules: []string{"r1"}}
+			assert.Equal(t, tt.holds, m.conditionHolds(rule, httptest.NewRecorder(), req, state))
+		})
+	}
+}
+
+func TestValidateRule_Condition(t *testing.T) {
+	assert.NoError(t, validateRule(&Rule{ID: "c1", Phase: 1, Condition: `request.method == "PUT"`}))
+	assert.NoError(t, validateRule(&Rule{ID: "c2", Phase: 1, Pattern: "x", Targets: []string{"URI"}, Condition: `tx.score > 0`}))
+
+	err := validateRule(&Rule{ID: "c3", Phase: 1, Targets: []string{"URI"}, Condition: `tx.score > 0`})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "empty pattern")
+}
+
+func TestHandlePhase_RuleCondition(t *testing.T) {
+	m := conditionMiddleware()
+	rules := []Rule{
+		{ID: "json-api", Phase: 1, Pattern: "(?i)select", Targets: []string{"ARGS"}, Score: 10, Action: "block",
+			Condition: `request.path.startsWith("/api") && target("HEADERS:Content-Type").contains("json")`},
+		{ID: "no-put", Phase: 1, Score: 10, Action: "block", Condition: `request.method == "PUT"`},
+	}
+	for i := range rules {
+		require.NoError(t, validateRule(&rules[i]))
+		require.NoError(t, m.compileRule(&rules[i]))
+	}
+	m.Rules[1] = rules
+
+	send := func(method, url, contentType string) *WAFState {
+		req := httptest.NewRequest(method, url, nil)
+		req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test-log-id"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		state := m.initializeWAFState()
+		m.handlePhase(httptest.NewRecorder(), req, 1, state)
+		return state
+	}
+
+	state := send("GET", "http://example.com/api?q=select", "application/json")
+	assert.True(t, state.Blocked)
+	assert.Equal(t, []string{"json-api"}, state.MatchedRules)
+
+	// The pattern matches but the condition doesn't hold
+	assert.False(t, send("GET", "http://example.com/api?q=select", "text/plain").Blocked)
+	assert.False(t, send("GET", "http://example.com/web?q=select", "application/json").Blocked)
+
+	// Condition-only rules match once when their condition holds
+	state = send("PUT", "http://example.com/web", "")
+	assert.True(t, state.Blocked)
+	assert.Equal(t, []string{"no-put"}, state.MatchedRules)
+	assert.False(t, send("GET", "http://example.com/web", "").Blocked)
+}
+
+func TestLoadRulesFromFile_Condition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	content := `[
+		{"id": "ok", "phase": 1, "condition": "request.method == \"PUT\"", "score": 5},
+		{"id": "bad", "phase": 1, "condition": "request.method", "score": 5}
+	]`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	m := conditionMiddleware()
+	rules, invalid, err := m.loadRulesFromFile(path, map[string]bool{})
+	require.NoError(t, err)
+	require.Len(t, rules[1], 1)
+	assert.Equal(t, "ok", rules[1][0].ID)
+	assert.NotNil(t, rules[1][0].condition)
+	require.Len(t, invalid, 1)
+	assert.Contains(t, invalid[0], "invalid condition")
+}
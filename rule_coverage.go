@@ -0,0 +1,206 @@
+package caddywaf
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultRuleCoverageLogInterval = 24 * time.Hour
+
+// RuleCoverageConfig tracks the rules that never matched since they were loaded, reported
+// by the admin API under GET /rules/coverage and logged every LogInterval.
+type RuleCoverageConfig struct {
+	LogInterval time.Duration `json:"log_interval,omitempty"` // Period of the coverage summary log, default 24h
+}
+
+// RuleCoverageEntry is a rule of the coverage report.
+type RuleCoverageEntry struct {
+	RuleID    string     `json:"rule_id"`
+	Phases    []int      `json:"phases"`
+	Matches   int64      `json:"matches"`
+	LastMatch *time.Time `json:"last_match,omitempty"`
+}
+
+// RuleCoverageReport lists the rules loaded, and those that never matched since.
+type RuleCoverageReport struct {
+	LoadedAt        time.Time           `json:"loaded_at"`
+	TotalRules      int                 `json:"total_rules"`
+	MatchedRules    int                 `json:"matched_rules"`
+	CoveragePercent float64             `json:"coverage_percent"`
+	Unmatched       []RuleCoverageEntry `json:"unmatched"`
+	Matched         []RuleCoverageEntry `json:"matched,omitempty"` // Only with all=true
+}
+
+// coverageRule counts the matches of a loaded rule.
+type coverageRule struct {
+	phases    []int
+	matches   atomic.Int64
+	lastMatch atomic.Int64 // Unix nanoseconds of the last match
+}
+
+// ruleCoverage tracks the matches of the rules since the last load.
+type ruleCoverage struct {
+	config RuleCoverageConfig
+
+	mu       sync.RWMutex
+	loadedAt time.Time
+	rules    map[string]*coverageRule
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newRuleCoverage applies the defaults and creates the coverage tracker.
+func newRuleCoverage(config RuleCoverageConfig) *ruleCoverage {
+	if config.LogInterval <= 0 {
+		config.LogInterval = defaultRuleCoverageLogInterval
+	}
+	return &ruleCoverage{
+		config: config,
+		rules:  make(map[string]*coverageRule),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// reset starts tracking a new set of rules, forgetting the matches of the previous load.
+func (rc *ruleCoverage) reset(ruleSets []map[int][]Rule, now time.Time) {
+	rules := make(map[string]*coverageRule)
+	for _, ruleSet := range ruleSets {
+		for phase, phaseRules := range ruleSet {
+			for _, rule := range phaseRules {
+				entry, ok := rules[rule.ID]
+				if !ok {
+					entry = &coverageRule{}
+					rules[rule.ID] = entry
+				}
+				if !slices.Contains(entry.phases, phase) {
+					entry.phases = append(entry.phases, phase)
+				}
+			}
+		}
+	}
+	for _, entry := range rules {
+		sort.Ints(entry.phases)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.loadedAt = now
+	rc.rules = rules
+}
+
+// match counts a match of a rule.
+func (rc *ruleCoverage) match(ruleID string, now time.Time) {
+	rc.mu.RLock()
+	entry, ok := rc.rules[ruleID]
+	rc.mu.RUnlock()
+	if !ok {
+		return
+	}
+	entry.matches.Add(1)
+	entry.lastMatch.Store(now.UnixNano())
+}
+
+// report builds the coverage report, listing the matched rules too when all is set. The
+// rules are sorted by ID.
+func (rc *ruleCoverage) report(all bool) RuleCoverageReport {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	report := RuleCoverageReport{LoadedAt: rc.loadedAt, TotalRules: len(rc.rules), Unmatched: []RuleCoverageEntry{}}
+	for id, rule := range rc.rules {
+		entry := RuleCoverageEntry{RuleID: id, Phases: rule.phases, Matches: rule.matches.Load()}
+		if entry.Matches == 0 {
+			report.Unmatched = append(report.Unmatched, entry)
+			continue
+		}
+		report.MatchedRules++
+		if all {
+			lastMatch := time.Unix(0, rule.lastMatch.Load())
+			entry.LastMatch = &lastMatch
+			report.Matched = append(report.Matched, entry)
+		}
+	}
+	if report.TotalRules > 0 {
+		report.CoveragePercent = float64(report.MatchedRules) / float64(report.TotalRules) * 100
+	}
+	sort.Slice(report.Unmatched, func(i, j int) bool { return report.Unmatched[i].RuleID < report.Unmatched[j].RuleID })
+	sort.Slice(report.Matched, func(i, j int) bool { return report.Matched[i].RuleID < report.Matched[j].RuleID })
+	return report
+}
+
+// Start calls summarize every log interval.
+func (rc *ruleCoverage) Start(summarize func()) {
+	go func() {
+		defer close(rc.done)
+		ticker := time.NewTicker(rc.config.LogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				summarize()
+			case <-rc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic summaries.
+func (rc *ruleCoverage) Stop() {
+	rc.stopOnce.Do(func() {
+		close(rc.stop)
+		<-rc.done
+	})
+}
+
+// resetRuleCoverage tracks the global and host overlay rules of a load. The caller must
+// hold m.mu.
+func (m *Middleware) resetRuleCoverage() {
+	if m.ruleCoverage == nil {
+		return
+	}
+	ruleSets := []map[int][]Rule{m.Rules}
+	for _, overlay := range m.HostOverlays {
+		ruleSets = append(ruleSets, overlay.rules)
+	}
+	m.ruleCoverage.reset(ruleSets, time.Now())
+}
+
+// recordRuleCoverage counts a rule match for the coverage report.
+func (m *Middleware) recordRuleCoverage(ruleID string) {
+	if m.ruleCoverage != nil {
+		m.ruleCoverage.match(ruleID, time.Now())
+	}
+}
+
+// logRuleCoverage logs the rules that never matched since the last load.
+func (m *Middleware) logRuleCoverage() {
+	report := m.ruleCoverage.report(false)
+	unmatched := make([]string, 0, len(report.Unmatched))
+	for _, entry := range report.Unmatched {
+		unmatched = append(unmatched, entry.RuleID)
+	}
+	m.logger.Info("Rule coverage summary",
+		zap.Time("loaded_at", report.LoadedAt),
+		zap.Int("total_rules", report.TotalRules),
+		zap.Int("matched_rules", report.MatchedRules),
+		zap.Float64("coverage_percent", report.CoveragePercent),
+		zap.Strings("unmatched_rules", unmatched),
+	)
+}
+
+// handleRuleCoverageRequest returns the coverage report, with the matched rules when the
+// all query parameter is true.
+func (m *Middleware) handleRuleCoverageRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.ruleCoverage == nil {
+		return writeJSONError(w, http.StatusConflict, "rule coverage requires the rule_coverage directive")
+	}
+	return writeJSON(w, http.StatusOK, m.ruleCoverage.report(r.URL.Query().Get("all") == "true"))
+}
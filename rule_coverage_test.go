@@ -0,0 +1,84 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleCoverage_Report(t *testing.T) {
+	rc := newRuleCoverage(RuleCoverageConfig{})
+	assert.Equal(t, defaultRuleCoverageLogInterval, rc.config.LogInterval)
+
+	loadedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rc.reset([]map[int][]Rule{
+		{1: {{ID: "ua-1"}}, 2: {{ID: "sqli-1"}, {ID: "xss-1"}}},
+		{2: {{ID: "sqli-1"}}, 3: {{ID: "sqli-1"}, {ID: "host-1"}}},
+	}, loadedAt)
+	rc.match("sqli-1", loadedAt.Add(time.Minute))
+	rc.match("sqli-1", loadedAt.Add(time.Hour))
+	rc.match("unknown", loadedAt.Add(time.Hour))
+
+	report := rc.report(false)
+	assert.Equal(t, loadedAt, report.LoadedAt)
+	assert.Equal(t, 4, report.TotalRules, "overlay rules with a global ID are counted once")
+	assert.Equal(t, 1, report.MatchedRules)
+	assert.InDelta(t, 25.0, report.CoveragePercent, 0.001)
+	assert.Equal(t, []RuleCoverageEntry{
+		{RuleID: "host-1", Phases: []int{3}},
+		{RuleID: "ua-1", Phases: []int{1}},
+		{RuleID: "xss-1", Phases: []int{2}},
+	}, report.Unmatched)
+	assert.Empty(t, report.Matched)
+
+	report = rc.report(true)
+	require.Len(t, report.Matched, 1)
+	assert.Equal(t, []int{2, 3}, report.Matched[0].Phases)
+	assert.Equal(t, int64(2), report.Matched[0].Matches)
+	require.NotNil(t, report.Matched[0].LastMatch)
+	assert.True(t, report.Matched[0].LastMatch.Equal(loadedAt.Add(time.Hour)))
+
+	rc.reset([]map[int][]Rule{{2: {{ID: "sqli-1"}}}}, loadedAt.Add(2*time.Hour))
+	assert.Equal(t, 0, rc.report(false).MatchedRules, "a load forgets the matches")
+}
+
+func TestRecordRuleMatch_Coverage(t *testing.T) {
+	m := newExplainMiddleware()
+	m.ruleCoverage = newRuleCoverage(RuleCoverageConfig{})
+	m.resetRuleCoverage()
+
+	req := testRequest("GET", "/items?id=1+union+select", "", "")
+	m.handlePhase(httptest.NewRecorder(), req, 2, &WAFState{})
+
+	report := m.ruleCoverage.report(false)
+	assert.Equal(t, 2, report.TotalRules)
+	assert.Equal(t, 1, report.MatchedRules)
+	require.Len(t, report.Unmatched, 1)
+	assert.Equal(t, "scanner-ua", report.Unmatched[0].RuleID)
+}
+
+func TestHandleRuleCoverageRequest(t *testing.T) {
+	m := newExplainMiddleware()
+	w := httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/rules/coverage", nil)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	m.ruleCoverage = newRuleCoverage(RuleCoverageConfig{})
+	m.resetRuleCoverage()
+	m.recordRuleMatch("sqli-1")
+
+	w = httptest.NewRecorder()
+	require.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/rules/coverage?all=true", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report RuleCoverageReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.TotalRules)
+	assert.Len(t, report.Unmatched, 1)
+	require.Len(t, report.Matched, 1)
+	assert.Equal(t, "sqli-1", report.Matched[0].RuleID)
+}
@@ -0,0 +1,110 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RuleHitsSnapshot is the content of the rule_hits_file.
+type RuleHitsSnapshot struct {
+	SavedAt         time.Time      `json:"saved_at"`
+	RuleHits        map[string]int `json:"rule_hits"`
+	RuleHitsByPhase map[int]int64  `json:"rule_hits_by_phase"`
+}
+
+// ruleHitsOwners holds, by rule_hits_file, the middleware instance whose hits are saved to
+// it. On a config reload the new instance is provisioned before the running one is cleaned
+// up: it takes over the counts of the running one, and only the owner saves the file.
+var ruleHitsOwners sync.Map
+
+// ruleHitsSnapshot copies the rule hit counters.
+func (m *Middleware) ruleHitsSnapshot(now time.Time) RuleHitsSnapshot {
+	snapshot := RuleHitsSnapshot{SavedAt: now, RuleHits: m.getRuleHitStats(), RuleHitsByPhase: make(map[int]int64)}
+	m.muMetrics.RLock()
+	for phase, hits := range m.ruleHitsByPhase {
+		snapshot.RuleHitsByPhase[phase] = hits
+	}
+	m.muMetrics.RUnlock()
+	return snapshot
+}
+
+// addRuleHits adds the counters of a snapshot to the rule hit counters.
+func (m *Middleware) addRuleHits(snapshot RuleHitsSnapshot) {
+	for ruleID, hits := range snapshot.RuleHits {
+		count := HitCount(hits)
+		if current, ok := m.ruleHits.Load(RuleID(ruleID)); ok {
+			count += current.(HitCount)
+		}
+		m.ruleHits.Store(RuleID(ruleID), count)
+	}
+	m.muMetrics.Lock()
+	if m.ruleHitsByPhase == nil {
+		m.ruleHitsByPhase = make(map[int]int64)
+	}
+	for phase, hits := range snapshot.RuleHitsByPhase {
+		m.ruleHitsByPhase[phase] += hits
+	}
+	m.muMetrics.Unlock()
+}
+
+// readRuleHitsFile reads a rule_hits_file. A missing file is an empty snapshot.
+func readRuleHitsFile(path string) (RuleHitsSnapshot, error) {
+	var snapshot RuleHitsSnapshot
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid rule hits file %s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// restoreRuleHits restores the rule hit counters from the instance running with the same
+// rule_hits_file, or else from the file, and makes m their owner. An unreadable file is
+// logged and replaced on the next save.
+func (m *Middleware) restoreRuleHits() {
+	if m.RuleHitsFile == "" {
+		return
+	}
+	if owner, ok := ruleHitsOwners.Load(m.RuleHitsFile); ok {
+		m.addRuleHits(owner.(*Middleware).ruleHitsSnapshot(time.Now()))
+		m.logger.Info("Rule hits taken over from the previous configuration", zap.String("file", m.RuleHitsFile))
+	} else if snapshot, err := readRuleHitsFile(m.RuleHitsFile); err != nil {
+		m.logger.Warn("Failed to restore rule hits, starting from zero", zap.String("file", m.RuleHitsFile), zap.Error(err))
+	} else {
+		m.addRuleHits(snapshot)
+		m.logger.Info("Rule hits restored",
+			zap.String("file", m.RuleHitsFile),
+			zap.Int("rules", len(snapshot.RuleHits)),
+			zap.Time("saved_at", snapshot.SavedAt),
+		)
+	}
+	ruleHitsOwners.Store(m.RuleHitsFile, m)
+}
+
+// saveRuleHits writes the rule hit counters to the rule_hits_file, if m still owns them.
+func (m *Middleware) saveRuleHits() error {
+	if m.RuleHitsFile == "" || !ruleHitsOwners.CompareAndDelete(m.RuleHitsFile, m) {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.ruleHitsSnapshot(time.Now()), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rule hits: %w", err)
+	}
+	if err := writeFileAtomic(m.RuleHitsFile, data); err != nil {
+		return fmt.Errorf("failed to save rule hits: %w", err)
+	}
+	m.logger.Info("Rule hits saved", zap.String("file", m.RuleHitsFile))
+	return nil
+}
@@ -0,0 +1,66 @@
+package caddywaf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRuleHitsFile_SaveAndRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rule_hits.json")
+	m := &Middleware{logger: zap.NewNop(), RuleHitsFile: file, ruleHitsByPhase: map[int]int64{}}
+	m.restoreRuleHits() // Missing file
+	m.incrementRuleHitCount("sqli-1")
+	m.incrementRuleHitCount("sqli-1")
+	m.incrementRuleHitsByPhaseMetric(2)
+	require.NoError(t, m.Cleanup())
+	_, err := os.Stat(file)
+	require.NoError(t, err)
+
+	restored := &Middleware{logger: zap.NewNop(), RuleHitsFile: file, ruleHitsByPhase: map[int]int64{}}
+	restored.restoreRuleHits()
+	defer ruleHitsOwners.Delete(file)
+	assert.Equal(t, map[string]int{"sqli-1": 2}, restored.getRuleHitStats())
+	assert.Equal(t, int64(1), restored.ruleHitsByPhase[2])
+}
+
+func TestRuleHitsFile_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rule_hits.json")
+	old := &Middleware{logger: zap.NewNop(), RuleHitsFile: file, ruleHitsByPhase: map[int]int64{}}
+	old.restoreRuleHits()
+	old.incrementRuleHitCount("xss-1")
+
+	// The new configuration takes over the counts before the old one is cleaned up
+	current := &Middleware{logger: zap.NewNop(), RuleHitsFile: file, ruleHitsByPhase: map[int]int64{}}
+	current.restoreRuleHits()
+	require.NoError(t, old.Cleanup())
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err), "only the owner saves the file")
+
+	current.incrementRuleHitCount("xss-1")
+	require.NoError(t, current.Cleanup())
+	snapshot, err := readRuleHitsFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"xss-1": 2}, snapshot.RuleHits)
+}
+
+func TestRuleHitsFile_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rule_hits.json")
+	require.NoError(t, os.WriteFile(file, []byte("not json"), 0o644))
+	_, err := readRuleHitsFile(file)
+	assert.Error(t, err)
+
+	m := &Middleware{logger: zap.NewNop(), RuleHitsFile: file, ruleHitsByPhase: map[int]int64{}}
+	m.restoreRuleHits()
+	assert.Empty(t, m.getRuleHitStats(), "an invalid file starts from zero")
+	require.NoError(t, m.Cleanup())
+	snapshot, err := readRuleHitsFile(file)
+	require.NoError(t, err, "the invalid file is replaced")
+	assert.Empty(t, snapshot.RuleHits)
+
+	assert.NoError(t, (&Middleware{}).Cleanup(), "cleanup of an unprovisioned middleware")
+}
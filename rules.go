@@ -4,6 +4,7 @@ package caddywaf
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"os"
 	"regexp"
@@ -16,6 +17,7 @@ import (
 
 func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, rule *Rule, value string, state *WAFState) bool {
 	logID := r.Context().Value(ContextKeyLogId("logID")).(string)
+	threshold := m.anomalyThreshold(state)
 
 	m.logRequest(zapcore.DebugLevel, "Rule Matched", r, // More concise log message
 		zap.String("rule_id", rule.ID),
@@ -23,25 +25,46 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 		zap.String("value", value),
 		zap.String("description", rule.Description),
 		zap.Int("score", rule.Score),
-		zap.Int("anomaly_threshold_config", m.AnomalyThreshold), // ADDED: Log configured anomaly threshold
-		zap.Int("current_anomaly_score", state.TotalScore),      // ADDED: Log current anomaly score before increment
+		zap.Int("anomaly_threshold_config", threshold),     // ADDED: Log configured anomaly threshold
+		zap.Int("current_anomaly_score", state.TotalScore), // ADDED: Log current anomaly score before increment
 	)
 
 	// Rule Hit Counter - Refactored for clarity
 	m.incrementRuleHitCount(RuleID(rule.ID))
+	state.MatchedRules = append(state.MatchedRules, rule.ID)
+	m.recordRuleMatch(rule.ID)
 
 	// Metrics for Rule Hits by Phase - Refactored for clarity
 	m.incrementRuleHitsByPhaseMetric(rule.Phase)
 
+	// During its canary or outside its rollout, a rule only logs its match
+	if canary := m.inRuleCanary(rule.ID); canary || !inRollout(rule, r) {
+		message := "Rule action: Log (outside rollout)"
+		if canary {
+			message = "Rule action: Log (canary)"
+		}
+		if m.allowRuleLog(r, rule.ID) {
+			m.logRequest(zapcore.InfoLevel, message, r,
+				zap.String("log_id", logID),
+				zap.String("rule_id", rule.ID),
+				zap.String("action", rule.Action),
+				zap.Intp("rollout_percent", rule.RolloutPercent),
+			)
+		}
+		m.traceRuleMatch(rule, value, state)
+		return true
+	}
+
 	oldScore := state.TotalScore
 	state.TotalScore += rule.Score
+	m.traceRuleMatch(rule, value, state)
 	m.logRequest(zapcore.DebugLevel, "Anomaly score increased", r, // Corrected argument order - 'r' is now the third argument
 		zap.String("log_id", logID),
 		zap.String("rule_id", rule.ID),
 		zap.Int("score_increase", rule.Score),
 		zap.Int("old_score", oldScore),
 		zap.Int("new_score", state.TotalScore),
-		zap.Int("anomaly_threshold", m.AnomalyThreshold),
+		zap.Int("anomaly_threshold", threshold),
 	)
 
 	// CRITICAL FIX: Check if "mode" field in rule doesn't match the required "action" field
@@ -54,11 +77,11 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 		zap.String("rule_id", rule.ID),
 		zap.String("action_field", rule.Action),
 		zap.Int("score", rule.Score),
-		zap.Int("threshold", m.AnomalyThreshold),
+		zap.Int("threshold", threshold),
 		zap.Int("total_score", state.TotalScore))
 
 	// CRITICAL FIX: Check if the request should be blocked
-	exceedsThreshold := !state.ResponseWritten && (state.TotalScore >= m.AnomalyThreshold)
+	exceedsThreshold := !state.ResponseWritten && (state.TotalScore >= threshold)
 	explicitBlock := !state.ResponseWritten && (actualAction == "block")
 	shouldBlock := exceedsThreshold || explicitBlock
 
@@ -79,7 +102,7 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 		// Block the request and write the response immediately
 		m.blockRequest(w, r, state, http.StatusForbidden, blockReason, rule.ID,
 			zap.Int("total_score", state.TotalScore),
-			zap.Int("anomaly_threshold", m.AnomalyThreshold),
+			zap.Int("anomaly_threshold", threshold),
 			zap.String("final_block_reason", blockReason),
 			zap.Bool("explicitly_blocked", explicitBlock),
 			zap.Bool("threshold_exceeded", exceedsThreshold),
@@ -89,12 +112,12 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 		return false
 	}
 
-	if rule.Action == "log" {
+	if rule.Action == "log" && m.allowRuleLog(r, rule.ID) {
 		m.logRequest(zapcore.InfoLevel, "Rule action: Log", r,
 			zap.String("log_id", logID),
 			zap.String("rule_id", rule.ID),
-			zap.Int("total_score", state.TotalScore),         // ADDED: Log total score for log action
-			zap.Int("anomaly_threshold", m.AnomalyThreshold), // ADDED: Log anomaly threshold for log action
+			zap.Int("total_score", state.TotalScore), // ADDED: Log total score for log action
+			zap.Int("anomaly_threshold", threshold),  // ADDED: Log anomaly threshold for log action
 		)
 	} else if !shouldBlock && !state.ResponseWritten {
 		m.logRequest(zapcore.DebugLevel, "Rule action: No Block", r,
@@ -102,7 +125,7 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 			zap.String("rule_id", rule.ID),
 			zap.String("action", rule.Action),
 			zap.Int("total_score", state.TotalScore),
-			zap.Int("anomaly_threshold", m.AnomalyThreshold),
+			zap.Int("anomaly_threshold", threshold),
 		)
 	}
 
@@ -137,12 +160,15 @@ func validateRule(rule *Rule) error {
 	if rule.ID == "" {
 		return fmt.Errorf("rule has an empty ID")
 	}
-	if rule.Pattern == "" {
+	if rule.Pattern == "" && rule.Condition == "" && rule.MinEntropy == 0 {
 		return fmt.Errorf("rule '%s' has an empty pattern", rule.ID)
 	}
-	if len(rule.Targets) == 0 {
+	if (rule.Pattern != "" || rule.MinEntropy != 0) && len(rule.Targets) == 0 {
 		return fmt.Errorf("rule '%s' has no targets", rule.ID)
 	}
+	if rule.Pattern == "" && rule.MinEntropy == 0 && len(rule.Targets) > 0 {
+		return fmt.Errorf("rule '%s' has targets but an empty pattern", rule.ID)
+	}
 	if rule.Phase < 1 || rule.Phase > 4 {
 		return fmt.Errorf("rule '%s' has an invalid phase: %d. Valid phases are 1 to 4", rule.ID, rule.Phase)
 	}
@@ -152,9 +178,30 @@ func validateRule(rule *Rule) error {
 	if rule.Action != "" && rule.Action != "block" && rule.Action != "log" {
 		return fmt.Errorf("rule '%s' has an invalid action: '%s'. Valid actions are 'block' or 'log'", rule.ID, rule.Action)
 	}
+	if rule.RolloutPercent != nil && (*rule.RolloutPercent < 1 || *rule.RolloutPercent > 100) {
+		return fmt.Errorf("rule '%s' has an invalid rollout_percent: %d. Valid values are 1 to 100", rule.ID, *rule.RolloutPercent)
+	}
+	if rule.MinEntropy < 0 || rule.MinEntropy > maxEntropy {
+		return fmt.Errorf("rule '%s' has an invalid min_entropy: %v. Valid values are 0 to 8", rule.ID, rule.MinEntropy)
+	}
 	return nil
 }
 
+// inRollout reports whether a rule is enforced on the client of a request: always for rules
+// without a rollout_percent, else for the clients whose IP hashes into the percentage, so
+// that a client is consistently in or out of the rollout. The hash is salted with the rule
+// ID, so that the rules rolled out don't all select the same clients.
+func inRollout(rule *Rule, r *http.Request) bool {
+	if rule.RolloutPercent == nil || *rule.RolloutPercent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(rule.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(extractIP(r.RemoteAddr)))
+	return int(h.Sum32()%100) < *rule.RolloutPercent
+}
+
 // loadRules updates the RuleCache and Rules map when rules are loaded and sorts rules by priority.
 // loadRules updates the RuleCache and Rules map when rules are loaded and sorts rules by priority.
 func (m *Middleware) loadRules(paths []string) error {
@@ -195,6 +242,13 @@ func (m *Middleware) loadRules(paths []string) error {
 	}
 
 	m.Rules = loadedRules // Atomically update m.Rules after loading all files
+	m.startRuleCanaries(loadedRules)
+
+	if err := m.buildHostOverlays(); err != nil {
+		return err
+	}
+	cachedPatterns := m.pruneRuleCache()
+	m.resetRuleCoverage()
 
 	if len(invalidFiles) > 0 {
 		m.logger.Error("Failed to load rule files", zap.Strings("files", invalidFiles)) // Error level for file loading failures
@@ -209,10 +263,69 @@ func (m *Middleware) loadRules(paths []string) error {
 		m.logger.Warn("No rule files specified, WAF will run without rules.") // Warn if no rule files and no rules loaded
 	}
 
-	m.logger.Info("WAF rules loaded successfully", zap.Int("total_rules", totalRules), zap.String("rule_counts", ruleCounts))
+	m.logger.Info("WAF rules loaded successfully",
+		zap.Int("total_rules", totalRules),
+		zap.Int("compiled_patterns", cachedPatterns),
+		zap.String("rule_counts", ruleCounts),
+	)
 	return nil
 }
 
+// compilePattern returns the compiled regex of a pattern, shared through the rule cache.
+func (m *Middleware) compilePattern(pattern string) (*regexp.Regexp, error) {
+	if m.ruleCache == nil {
+		return regexp.Compile(pattern)
+	}
+	return m.ruleCache.Compile(pattern)
+}
+
+// compileRule compiles the pattern, the condition and the schedule of a rule. Rules with a pattern that
+// is already compiled share its regex.
+func (m *Middleware) compileRule(rule *Rule) error {
+	if rule.Pattern != "" {
+		regex, err := m.compilePattern(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex pattern: %w", err)
+		}
+		rule.regex = regex
+	}
+	if rule.Condition != "" {
+		condition, err := compileRuleCondition(rule.Condition)
+		if err != nil {
+			return fmt.Errorf("invalid condition: %w", err)
+		}
+		rule.condition = condition
+	}
+	schedule, err := compileTimeWindow(rule.ActiveHours, rule.ActiveDays)
+	if err != nil {
+		return err
+	}
+	rule.schedule = schedule
+	return nil
+}
+
+// pruneRuleCache drops the cached patterns no longer used by the global or overlay rules
+// and returns the number of patterns left. The caller must hold m.mu.
+func (m *Middleware) pruneRuleCache() int {
+	if m.ruleCache == nil {
+		return 0
+	}
+	inUse := make(map[string]struct{})
+	for _, rules := range m.Rules {
+		for _, rule := range rules {
+			inUse[rule.Pattern] = struct{}{}
+		}
+	}
+	for _, overlay := range m.HostOverlays {
+		for _, rules := range overlay.rules {
+			for _, rule := range rules {
+				inUse[rule.Pattern] = struct{}{}
+			}
+		}
+	}
+	return m.ruleCache.Retain(inUse)
+}
+
 // loadRulesFromFile loads and validates rules from a single file.
 func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (validRules map[int][]Rule, invalidRules []string, err error) {
 	m.logger.Debug("Loading rules from file", zap.String("file", path)) // Log file being loaded
@@ -224,6 +337,11 @@ func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (va
 		return nil, nil, fmt.Errorf("failed to read rule file: %w", err)
 	}
 
+	// Precompiled bundles from "caddy waf compile" are already validated
+	if isRuleBundle(content) {
+		return m.loadRuleBundle(path, content, ruleIDs)
+	}
+
 	var rules []Rule
 	if err := json.Unmarshal(content, &rules); err != nil {
 		return nil, nil, fmt.Errorf("failed to unmarshal rules: %w", err)
@@ -246,17 +364,9 @@ func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (va
 		}
 		ruleIDs[rule.ID] = true // Track rule IDs to prevent duplicates
 
-		// RuleCache handling (compile and cache regex)
-		if cachedRegex, exists := m.ruleCache.Get(rule.ID); exists {
-			rule.regex = cachedRegex
-		} else {
-			compiledRegex, err := regexp.Compile(rule.Pattern)
-			if err != nil {
-				fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': invalid regex pattern: %v", rule.ID, err))
-				continue
-			}
-			rule.regex = compiledRegex
-			m.ruleCache.Set(rule.ID, compiledRegex) // Cache regex
+		if err := m.compileRule(&rule); err != nil {
+			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': %v", rule.ID, err))
+			continue
 		}
 
 		if _, ok := validRules[rule.Phase]; !ok {
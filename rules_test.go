@@ -2,6 +2,7 @@ package caddywaf
 
 import (
 	"context"
+	"fmt"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -11,6 +12,8 @@ import (
 	"go.uber.org/zap"
 )
 
+func intPtr(v int) *int { return &v }
+
 func TestValidateRule(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -70,6 +73,62 @@ func TestValidateRule(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Invalid Rollout Percent",
+			rule: Rule{
+				ID:             "test",
+				Pattern:        ".*",
+				Targets:        []string{"REQUEST_URI"},
+				Phase:          1,
+				Action:         "block",
+				RolloutPercent: intPtr(101),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Zero Rollout Percent",
+			rule: Rule{
+				ID:             "test",
+				Pattern:        ".*",
+				Targets:        []string{"REQUEST_URI"},
+				Phase:          1,
+				Action:         "block",
+				RolloutPercent: intPtr(0),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid Min Entropy",
+			rule: Rule{
+				ID:         "test",
+				Targets:    []string{"ARGS"},
+				Phase:      2,
+				Action:     "block",
+				MinEntropy: 9,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Min Entropy Without Pattern",
+			rule: Rule{
+				ID:         "test",
+				Targets:    []string{"ARGS"},
+				Phase:      2,
+				Action:     "block",
+				MinEntropy: 5.5,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Min Entropy Without Targets",
+			rule: Rule{
+				ID:         "test",
+				Phase:      2,
+				Action:     "block",
+				MinEntropy: 5.5,
+			},
+			wantErr: true,
+		},
 		{
 			name: "Valid Rule",
 			rule: Rule{
@@ -170,6 +229,58 @@ func TestProcessRuleMatch(t *testing.T) {
 	}
 }
 
+func TestInRollout(t *testing.T) {
+	rule := &Rule{ID: "rollout", Action: "block", RolloutPercent: intPtr(25)}
+	other := &Rule{ID: "rollout-2", Action: "block", RolloutPercent: intPtr(25)}
+	enforced, same := 0, 0
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		in := inRollout(rule, r)
+		if in {
+			enforced++
+		}
+		if inRollout(other, r) == in {
+			same++
+		}
+		r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4321", i/256, i%256)
+		if inRollout(rule, r) != in {
+			t.Errorf("inRollout() depends on more than the client IP %s", r.RemoteAddr)
+		}
+	}
+	if enforced < 200 || enforced > 300 {
+		t.Errorf("inRollout() enforced the rule on %d of 1000 clients, want about 250", enforced)
+	}
+	if same > 750 {
+		t.Errorf("inRollout() selected the same clients for %d of 1000 clients across rules, want them salted by rule ID", same)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if !inRollout(&Rule{}, r) || !inRollout(&Rule{RolloutPercent: intPtr(100)}, r) {
+		t.Error("inRollout() = false, want true without rollout_percent or at 100")
+	}
+}
+
+func TestProcessRuleMatch_OutsideRollout(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 10}
+	rule := &Rule{ID: "rollout", Action: "block", Score: 20, RolloutPercent: intPtr(1)}
+
+	r := httptest.NewRequest("GET", "/test", nil)
+	for i := 0; inRollout(rule, r); i++ {
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), ContextKeyLogId("logID"), "test-log-id"))
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	if !m.processRuleMatch(w, r, rule, "test-value", state) || state.Blocked {
+		t.Error("processRuleMatch() blocked the request outside the rollout")
+	}
+	if state.TotalScore != 0 || len(state.MatchedRules) != 1 {
+		t.Errorf("processRuleMatch() = score %d, matched %v, want only the match recorded", state.TotalScore, state.MatchedRules)
+	}
+}
+
 func TestLoadRules(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 
@@ -243,3 +354,48 @@ func TestLoadRules(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadRules_ReusesCompiledPatterns(t *testing.T) {
+	tmpDir := t.TempDir()
+	ruleFile := filepath.Join(tmpDir, "rules.json")
+	writeRules := func(content string) {
+		if err := os.WriteFile(ruleFile, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write rules: %v", err)
+		}
+	}
+	writeRules(`[
+		{"id": "a", "phase": 2, "pattern": "(?i)<script", "targets": ["URI"], "score": 5},
+		{"id": "b", "phase": 2, "pattern": "(?i)<script", "targets": ["BODY"], "score": 5},
+		{"id": "c", "phase": 1, "pattern": "sqlmap", "targets": ["HEADERS:User-Agent"], "score": 5}
+	]`)
+
+	m := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	if err := m.loadRules([]string{ruleFile}); err != nil {
+		t.Fatalf("loadRules() failed: %v", err)
+	}
+	if m.Rules[2][0].regex != m.Rules[2][1].regex {
+		t.Error("Rules with the same pattern don't share a regex")
+	}
+	if m.ruleCache.Len() != 2 {
+		t.Errorf("Cache holds %d patterns, want 2", m.ruleCache.Len())
+	}
+	script := m.Rules[2][0].regex
+
+	// A reload keeps unchanged patterns, even under a new ID, and drops removed ones
+	writeRules(`[
+		{"id": "renamed", "phase": 2, "pattern": "(?i)<script", "targets": ["URI"], "score": 5},
+		{"id": "c", "phase": 1, "pattern": "nikto", "targets": ["HEADERS:User-Agent"], "score": 5}
+	]`)
+	if err := m.loadRules([]string{ruleFile}); err != nil {
+		t.Fatalf("loadRules() failed: %v", err)
+	}
+	if m.Rules[2][0].regex != script {
+		t.Error("Reload recompiled an unchanged pattern")
+	}
+	if got := m.Rules[1][0].regex.String(); got != "nikto" {
+		t.Errorf("Rule with a changed pattern kept the old regex %q", got)
+	}
+	if _, exists := m.ruleCache.Get("sqlmap"); exists {
+		t.Error("Removed pattern is still cached")
+	}
+}
@@ -0,0 +1,249 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	runtimeStateVersion   = 1
+	maxRuntimeStateImport = 32 << 20 // Bytes of a state imported through the admin API
+)
+
+// RuntimeState is the dynamic state of the WAF, exported by GET /state and imported by
+// POST /state to survive planned restarts or move clients between nodes.
+type RuntimeState struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Bans       []Ban            `json:"bans"`        // Active bans
+	Strikes    []StrikeState    `json:"strikes"`     // Blocks of the clients counted toward a ban
+	RateLimits []RateLimitState `json:"rate_limits"` // rate_limit request counters
+	Costs      []CostState      `json:"costs"`       // cost_limit budget windows
+}
+
+// StrikeState is the number of blocks of a client within its current ban window.
+type StrikeState struct {
+	Key   string    `json:"key"`
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// RateLimitState is the request counter of a client for a rate_limit key.
+type RateLimitState struct {
+	IP    string    `json:"ip"`
+	Key   string    `json:"key"` // IP, or IP and path when the rate limit is per path
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// CostState is the cost a client spent within its current cost_limit window.
+type CostState struct {
+	Key   string    `json:"key"`
+	Start time.Time `json:"start"`
+	Spent int64     `json:"spent"`
+}
+
+// RuntimeStateImport counts the entries restored by an import. Expired entries and the
+// sections of features that are not configured are skipped.
+type RuntimeStateImport struct {
+	Bans       int `json:"bans"`
+	Strikes    int `json:"strikes"`
+	RateLimits int `json:"rate_limits"`
+	Costs      int `json:"costs"`
+	Skipped    int `json:"skipped"`
+}
+
+// exportState returns the active bans and the current strike windows.
+func (bl *BanList) exportState(now time.Time) ([]Ban, []StrikeState) {
+	bans := bl.List(now)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	strikes := make([]StrikeState, 0, len(bl.strikes))
+	for key, sw := range bl.strikes {
+		if now.Sub(sw.start) < bl.config.Window {
+			strikes = append(strikes, StrikeState{Key: key, Start: sw.start, Count: sw.count})
+		}
+	}
+	sort.Slice(strikes, func(i, j int) bool { return strikes[i].Key < strikes[j].Key })
+	return bans, strikes
+}
+
+// importState restores bans, keeping the longest of two bans of a key, and strike windows,
+// keeping the highest count. It returns the number of bans and strikes restored.
+func (bl *BanList) importState(bans []Ban, strikes []StrikeState, now time.Time) (int, int) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	banCount, strikeCount := 0, 0
+	for _, ban := range bans {
+		if ban.Key == "" || !now.Before(ban.Expires) {
+			continue
+		}
+		if current, ok := bl.bans[ban.Key]; ok && !ban.Expires.After(current.Expires) {
+			continue
+		}
+		bl.bans[ban.Key] = ban
+		delete(bl.strikes, ban.Key)
+		banCount++
+	}
+	for _, strike := range strikes {
+		if strike.Key == "" || strike.Count <= 0 || now.Sub(strike.Start) >= bl.config.Window {
+			continue
+		}
+		if _, banned := bl.bans[strike.Key]; banned {
+			continue
+		}
+		if sw, ok := bl.strikes[strike.Key]; ok && now.Sub(sw.start) < bl.config.Window && sw.count >= strike.Count {
+			continue
+		}
+		bl.strikes[strike.Key] = &strikeWindow{start: strike.Start, count: strike.Count}
+		strikeCount++
+	}
+	return banCount, strikeCount
+}
+
+// exportState returns the request counters of the current windows.
+func (rl *RateLimiter) exportState(now time.Time) []RateLimitState {
+	rl.RLock()
+	defer rl.RUnlock()
+	states := []RateLimitState{}
+	for ip, counters := range rl.requests {
+		for key, counter := range counters {
+			if now.Sub(counter.window) <= rl.config.Window {
+				states = append(states, RateLimitState{IP: ip, Key: key, Start: counter.window, Count: counter.count})
+			}
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// importState restores request counters, keeping the highest count of a key, and returns
+// the number restored.
+func (rl *RateLimiter) importState(states []RateLimitState, now time.Time) int {
+	rl.Lock()
+	defer rl.Unlock()
+	restored := 0
+	for _, state := range states {
+		if state.IP == "" || state.Key == "" || state.Count <= 0 || now.Sub(state.Start) > rl.config.Window {
+			continue
+		}
+		if _, exists := rl.requests[state.IP]; !exists {
+			rl.requests[state.IP] = make(map[string]*requestCounter)
+		}
+		if counter, ok := rl.requests[state.IP][state.Key]; ok && now.Sub(counter.window) <= rl.config.Window && counter.count >= state.Count {
+			continue
+		}
+		rl.requests[state.IP][state.Key] = &requestCounter{count: state.Count, window: state.Start}
+		restored++
+	}
+	return restored
+}
+
+// exportState returns the cost spent in the current windows.
+func (c *CostLimitConfig) exportState(now time.Time) []CostState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make([]CostState, 0, len(c.clients))
+	for key, cw := range c.clients {
+		if now.Sub(cw.start) < c.Window {
+			states = append(states, CostState{Key: key, Start: cw.start, Spent: cw.spent})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// importState restores cost windows, keeping the highest spending of a key, and returns
+// the number restored.
+func (c *CostLimitConfig) importState(states []CostState, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	restored := 0
+	for _, state := range states {
+		if state.Key == "" || state.Spent <= 0 || now.Sub(state.Start) >= c.Window {
+			continue
+		}
+		if cw, ok := c.clients[state.Key]; ok && now.Sub(cw.start) < c.Window && cw.spent >= state.Spent {
+			continue
+		}
+		c.clients[state.Key] = &costWindow{start: state.Start, spent: state.Spent}
+		restored++
+	}
+	return restored
+}
+
+// exportRuntimeState collects the dynamic state of the configured features.
+func (m *Middleware) exportRuntimeState(now time.Time) RuntimeState {
+	state := RuntimeState{
+		Version:    runtimeStateVersion,
+		ExportedAt: now,
+		Bans:       []Ban{},
+		Strikes:    []StrikeState{},
+		RateLimits: []RateLimitState{},
+		Costs:      []CostState{},
+	}
+	if m.banList != nil {
+		state.Bans, state.Strikes = m.banList.exportState(now)
+	}
+	if m.rateLimiter != nil {
+		state.RateLimits = m.rateLimiter.exportState(now)
+	}
+	if m.CostLimit != nil && m.CostLimit.clients != nil {
+		state.Costs = m.CostLimit.exportState(now)
+	}
+	return state
+}
+
+// importRuntimeState merges an exported state into the dynamic state of the configured
+// features.
+func (m *Middleware) importRuntimeState(state RuntimeState, now time.Time) (RuntimeStateImport, error) {
+	var result RuntimeStateImport
+	if state.Version != runtimeStateVersion {
+		return result, fmt.Errorf("unsupported version %d, expected %d", state.Version, runtimeStateVersion)
+	}
+	total := len(state.Bans) + len(state.Strikes) + len(state.RateLimits) + len(state.Costs)
+	if m.banList != nil {
+		result.Bans, result.Strikes = m.banList.importState(state.Bans, state.Strikes, now)
+	}
+	if m.rateLimiter != nil {
+		result.RateLimits = m.rateLimiter.importState(state.RateLimits, now)
+	}
+	if m.CostLimit != nil && m.CostLimit.clients != nil {
+		result.Costs = m.CostLimit.importState(state.Costs, now)
+	}
+	result.Skipped = total - result.Bans - result.Strikes - result.RateLimits - result.Costs
+	return result, nil
+}
+
+// handleStateExportRequest returns the dynamic state: bans, ban strikes, rate limit
+// counters and cost windows.
+func (m *Middleware) handleStateExportRequest(w http.ResponseWriter, _ *http.Request) error {
+	return writeJSON(w, http.StatusOK, m.exportRuntimeState(time.Now()))
+}
+
+// handleStateImportRequest merges the state of the request body, as returned by GET /state.
+func (m *Middleware) handleStateImportRequest(w http.ResponseWriter, r *http.Request) error {
+	var state RuntimeState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuntimeStateImport)).Decode(&state); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+	}
+	result, err := m.importRuntimeState(state, time.Now())
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid state: "+err.Error())
+	}
+	m.logger.Info("Runtime state imported via admin API",
+		zap.Int("bans", result.Bans),
+		zap.Int("strikes", result.Strikes),
+		zap.Int("rate_limits", result.RateLimits),
+		zap.Int("costs", result.Costs),
+		zap.Int("skipped", result.Skipped),
+		zap.Time("exported_at", state.ExportedAt),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	return writeJSON(w, http.StatusOK, result)
+}
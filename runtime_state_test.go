@@ -0,0 +1,114 @@
+package caddywaf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeState_ExportImport(t *testing.T) {
+	source := newAPITestMiddleware()
+	source.banList = NewBanList(BanConfig{Threshold: 5, Window: time.Minute})
+	rl, err := NewRateLimiter(RateLimit{Requests: 10, Window: time.Minute, MatchAllPaths: true})
+	require.NoError(t, err)
+	source.rateLimiter = rl
+	source.CostLimit = &CostLimitConfig{Budget: 100, Window: time.Hour}
+	require.NoError(t, source.CostLimit.provision())
+	now := time.Now()
+	source.banList.Add(Ban{Key: "203.0.113.7", Reason: "honeypot", Created: now, Expires: now.Add(time.Hour), Origin: "node-a"})
+	source.banList.Add(Ban{Key: "203.0.113.8", Created: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)})
+	source.banList.Strike("198.51.100.1", now)
+	source.banList.Strike("198.51.100.1", now)
+	for range 3 {
+		source.rateLimiter.isRateLimited("198.51.100.2", "/")
+	}
+	source.CostLimit.spend("198.51.100.3", 40, now)
+
+	state := source.exportRuntimeState(now)
+	assert.Equal(t, runtimeStateVersion, state.Version)
+	require.Len(t, state.Bans, 1, "expired bans are not exported")
+	assert.Equal(t, []StrikeState{{Key: "198.51.100.1", Start: now, Count: 2}}, state.Strikes)
+	require.Len(t, state.RateLimits, 1)
+	assert.Equal(t, 3, state.RateLimits[0].Count)
+	assert.Equal(t, []CostState{{Key: "198.51.100.3", Start: now, Spent: 40}}, state.Costs)
+
+	data, err := json.Marshal(state)
+	require.NoError(t, err)
+	var decoded RuntimeState
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	target := newAPITestMiddleware()
+	target.banList = NewBanList(BanConfig{Threshold: 5, Window: time.Minute})
+	rl, err = NewRateLimiter(RateLimit{Requests: 10, Window: time.Minute, MatchAllPaths: true})
+	require.NoError(t, err)
+	target.rateLimiter = rl
+	target.CostLimit = &CostLimitConfig{Budget: 100, Window: time.Hour}
+	require.NoError(t, target.CostLimit.provision())
+	result, err := target.importRuntimeState(decoded, now)
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeStateImport{Bans: 1, Strikes: 1, RateLimits: 1, Costs: 1}, result)
+
+	// Importing again changes nothing
+	again, err := target.importRuntimeState(decoded, now)
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeStateImport{Skipped: 4}, again)
+
+	ban, ok := target.banList.Get("203.0.113.7", now)
+	require.True(t, ok)
+	assert.Equal(t, "honeypot", ban.Reason)
+	assert.Equal(t, "node-a", ban.Origin, "bans keep the node that issued them")
+	target.banList.Strike("198.51.100.1", now)
+	target.banList.Strike("198.51.100.1", now)
+	assert.True(t, target.banList.Strike("198.51.100.1", now), "the imported strikes count toward the threshold")
+	_, charged := target.CostLimit.spend("198.51.100.3", 70, now)
+	assert.False(t, charged, "the imported cost counts toward the budget")
+}
+
+func TestRuntimeState_ImportSkipsUnconfigured(t *testing.T) {
+	now := time.Now()
+	m := newAPITestMiddleware()
+	result, err := m.importRuntimeState(RuntimeState{
+		Version: runtimeStateVersion,
+		Bans:    []Ban{{Key: "203.0.113.7", Expires: now.Add(time.Hour)}},
+		Costs:   []CostState{{Key: "203.0.113.7", Start: now, Spent: 1}},
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, RuntimeStateImport{Skipped: 2}, result)
+
+	_, err = m.importRuntimeState(RuntimeState{Version: 2}, now)
+	assert.Error(t, err)
+}
+
+func TestHandleStateRequests(t *testing.T) {
+	source := newAPITestMiddleware()
+	source.banList = NewBanList(BanConfig{})
+	now := time.Now()
+	source.banList.Add(Ban{Key: "203.0.113.7", Created: now, Expires: now.Add(time.Hour)})
+
+	w := httptest.NewRecorder()
+	require.NoError(t, source.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/state", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	target := newAPITestMiddleware()
+	target.banList = NewBanList(BanConfig{})
+	w2 := httptest.NewRecorder()
+	require.NoError(t, target.handleAdminAPIRequest(w2, httptest.NewRequest("POST", "/waf/api/state", bytes.NewReader(w.Body.Bytes()))))
+	assert.Equal(t, http.StatusOK, w2.Code)
+	var result RuntimeStateImport
+	require.NoError(t, json.Unmarshal(w2.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Bans)
+	assert.True(t, target.banList.Banned("203.0.113.7", now))
+
+	for _, body := range []string{"not json", `{"version": 9}`} {
+		w = httptest.NewRecorder()
+		require.NoError(t, target.handleAdminAPIRequest(w, httptest.NewRequest("POST", "/waf/api/state", strings.NewReader(body))))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
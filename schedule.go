@@ -0,0 +1,130 @@
+package caddywaf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps the day names accepted by active_days to their weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is the compiled form of the active_hours and active_days of a rule or filter.
+type timeWindow struct {
+	hours [][2]int              // Active minutes of the day, [start, end), end < start wrapping past midnight
+	days  map[time.Weekday]bool // Active days, every day if empty
+}
+
+// compileTimeWindow parses active hours, such as "09:00-18:00" or "22:00-06:00,12:00-13:00",
+// and active days, such as ["mon-fri"] or ["sat", "sun"]. It returns nil when both are
+// empty, for an always active rule or filter.
+func compileTimeWindow(hours string, days []string) (*timeWindow, error) {
+	if strings.TrimSpace(hours) == "" && len(days) == 0 {
+		return nil, nil
+	}
+	tw := &timeWindow{}
+	if strings.TrimSpace(hours) != "" {
+		for _, span := range strings.Split(hours, ",") {
+			from, to, ok := strings.Cut(strings.TrimSpace(span), "-")
+			if !ok {
+				return nil, fmt.Errorf("invalid active_hours %q, must be HH:MM-HH:MM", span)
+			}
+			start, err := parseClock(from)
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseClock(to)
+			if err != nil {
+				return nil, err
+			}
+			if start == end {
+				return nil, fmt.Errorf("invalid active_hours %q, the range is empty", span)
+			}
+			tw.hours = append(tw.hours, [2]int{start, end})
+		}
+	}
+	if len(days) > 0 {
+		tw.days = make(map[time.Weekday]bool)
+		for _, day := range days {
+			from, to, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(day)), "-")
+			first, ok := weekdays[from]
+			if !ok {
+				return nil, fmt.Errorf("invalid active_days %q, must be mon, tue, wed, thu, fri, sat, sun or a range such as mon-fri", day)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdays[to]; !ok {
+					return nil, fmt.Errorf("invalid active_days %q, must be mon, tue, wed, thu, fri, sat, sun or a range such as mon-fri", day)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				tw.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+	return tw, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, accepting "24:00" as the end of
+// the day.
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid active_hours time %q, must be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether t, in the configured timezone, is within the window. The day of
+// a range wrapping past midnight is the day t falls on.
+func (tw *timeWindow) active(t time.Time) bool {
+	if tw == nil {
+		return true
+	}
+	if len(tw.days) > 0 && !tw.days[t.Weekday()] {
+		return false
+	}
+	if len(tw.hours) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, span := range tw.hours {
+		start, end := span[0], span[1]
+		if start < end && minute >= start && minute < end {
+			return true
+		}
+		if start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleTime returns the current time in the timezone of the active hours and days, the
+// server's local one unless the timezone directive sets another.
+func (m *Middleware) scheduleTime() time.Time {
+	if m.location != nil {
+		return time.Now().In(m.location)
+	}
+	return time.Now()
+}
+
+// scheduleActive reports whether a rule or filter with a time window is active now.
+func (m *Middleware) scheduleActive(tw *timeWindow) bool {
+	return tw == nil || tw.active(m.scheduleTime())
+}
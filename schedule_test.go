@@ -0,0 +1,79 @@
+package caddywaf
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileTimeWindow(t *testing.T) {
+	tw, err := compileTimeWindow("", nil)
+	require.NoError(t, err)
+	assert.Nil(t, tw)
+	assert.True(t, tw.active(time.Now()), "no window is always active")
+
+	for _, invalid := range []struct {
+		hours string
+		days  []string
+	}{
+		{hours: "09:00"},
+		{hours: "9-17"},
+		{hours: "09:00-25:00"},
+		{hours: "09:00-09:00"},
+		{days: []string{"monday"}},
+		{days: []string{"mon-funday"}},
+	} {
+		_, err := compileTimeWindow(invalid.hours, invalid.days)
+		assert.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestTimeWindow_Active(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		require.NoError(t, err)
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+
+	office, err := compileTimeWindow("09:00-18:00", []string{"mon-fri"})
+	require.NoError(t, err)
+	assert.True(t, office.active(at(1, "09:00")))
+	assert.True(t, office.active(at(5, "17:59")))
+	assert.False(t, office.active(at(1, "18:00")), "the end is excluded")
+	assert.False(t, office.active(at(1, "08:59")))
+	assert.False(t, office.active(at(6, "12:00")), "saturday")
+
+	night, err := compileTimeWindow("22:00-06:00, 12:00-13:00", nil)
+	require.NoError(t, err)
+	assert.True(t, night.active(at(1, "23:30")))
+	assert.True(t, night.active(at(2, "05:59")))
+	assert.True(t, night.active(at(3, "12:30")))
+	assert.False(t, night.active(at(1, "06:00")))
+	assert.False(t, night.active(at(1, "21:59")))
+
+	weekend, err := compileTimeWindow("", []string{"fri-mon"})
+	require.NoError(t, err)
+	for day, active := range map[int]bool{1: true, 2: false, 4: false, 5: true, 6: true, 7: true} {
+		assert.Equal(t, active, weekend.active(at(day, "12:00")), "day %d", day)
+	}
+}
+
+func TestConditionHolds_Schedule(t *testing.T) {
+	now := time.Now().UTC()
+	start := now.Add(-time.Hour).Format("15:04")
+	end := now.Add(time.Hour).Format("15:04")
+
+	m := &Middleware{location: time.UTC}
+	active := &Rule{ID: "active", ActiveHours: start + "-" + end}
+	inactive := &Rule{ID: "inactive", ActiveHours: end + "-" + start}
+	require.NoError(t, m.compileRule(active))
+	require.NoError(t, m.compileRule(inactive))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.True(t, m.conditionHolds(active, httptest.NewRecorder(), r, &WAFState{}))
+	assert.False(t, m.conditionHolds(inactive, httptest.NewRecorder(), r, &WAFState{}))
+}
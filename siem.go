@@ -0,0 +1,186 @@
+package caddywaf
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Supported SIEM output formats
+const (
+	SIEMFormatCEF  = "cef"
+	SIEMFormatLEEF = "leef"
+)
+
+const (
+	siemVendor  = "caddy-waf"
+	siemProduct = "caddy-waf"
+)
+
+// cefSeverity maps rule severities to the CEF 0-10 severity scale.
+var cefSeverity = map[string]int{
+	"LOW":      3,
+	"MEDIUM":   5,
+	"HIGH":     8,
+	"CRITICAL": 10,
+}
+
+// SIEMOutputConfig configures the CEF/LEEF event output.
+type SIEMOutputConfig struct {
+	Format string `json:"format"` // cef or leef
+	Output string `json:"output"` // File path, or udp://host:port / tcp://host:port
+}
+
+// SIEMWriter encodes block events as CEF or LEEF lines and writes them to the configured output.
+type SIEMWriter struct {
+	logger *zap.Logger
+	format string
+	mu     sync.Mutex
+	out    io.WriteCloser
+}
+
+// NewSIEMWriter opens the output described by config.
+func NewSIEMWriter(logger *zap.Logger, config SIEMOutputConfig) (*SIEMWriter, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	format := strings.ToLower(config.Format)
+	if format != SIEMFormatCEF && format != SIEMFormatLEEF {
+		return nil, fmt.Errorf("unsupported SIEM format '%s', must be cef or leef", config.Format)
+	}
+	if config.Output == "" {
+		return nil, fmt.Errorf("SIEM output requires an output")
+	}
+
+	out, err := openEventOutput(config.Output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SIEM output %s: %w", config.Output, err)
+	}
+	return &SIEMWriter{logger: logger, format: format, out: out}, nil
+}
+
+// openEventOutput opens an event output: a file path appended to, a udp://host:port or
+// tcp://host:port collector, or a unix:/path socket.
+func openEventOutput(output string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(output, "udp://"), strings.HasPrefix(output, "tcp://"):
+		network, addr, _ := strings.Cut(output, "://")
+		return net.Dial(network, addr)
+	case strings.HasPrefix(output, "unix:"):
+		return net.Dial("unix", strings.TrimPrefix(output, "unix:"))
+	}
+	return os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+}
+
+// Write encodes and writes a single event.
+func (sw *SIEMWriter) Write(ev BlockEvent) {
+	var line string
+	if sw.format == SIEMFormatLEEF {
+		line = formatLEEF(ev)
+	} else {
+		line = formatCEF(ev)
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if _, err := io.WriteString(sw.out, line+"\n"); err != nil {
+		sw.logger.Error("Failed to write SIEM event", zap.Error(err))
+	}
+}
+
+// Close closes the underlying output.
+func (sw *SIEMWriter) Close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.out.Close()
+}
+
+// formatCEF encodes an event as an ArcSight CEF:0 line.
+func formatCEF(ev BlockEvent) string {
+	severity, ok := cefSeverity[strings.ToUpper(ev.Severity)]
+	if !ok {
+		severity = 5
+	}
+	ext := []string{
+		"rt=" + strconv.FormatInt(ev.Timestamp.UnixMilli(), 10),
+		"src=" + cefExtension(ev.ClientIP),
+		"dhost=" + cefExtension(ev.Host),
+		"request=" + cefExtension(ev.Path),
+		"requestMethod=" + cefExtension(ev.Method),
+		"requestClientApplication=" + cefExtension(ev.UserAgent),
+		"act=blocked",
+		"outcome=" + strconv.Itoa(ev.StatusCode),
+		"reason=" + cefExtension(ev.Reason),
+		"cs1Label=ruleId",
+		"cs1=" + cefExtension(ev.RuleID),
+		"cs2Label=logId",
+		"cs2=" + cefExtension(ev.LogID),
+		"cn1Label=anomalyScore",
+		"cn1=" + strconv.Itoa(ev.Score),
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefHeader(siemVendor), cefHeader(siemProduct), cefHeader(wafVersion),
+		cefHeader(ev.RuleID), cefHeader(ev.Reason), severity, strings.Join(ext, " "))
+}
+
+// formatLEEF encodes an event as a QRadar LEEF:1.0 line with tab-delimited attributes.
+func formatLEEF(ev BlockEvent) string {
+	sev, ok := cefSeverity[strings.ToUpper(ev.Severity)]
+	if !ok {
+		sev = 5
+	}
+	attrs := []string{
+		"devTime=" + leefValue(ev.Timestamp.Format("Jan 02 2006 15:04:05.000 MST")),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"src=" + leefValue(ev.ClientIP),
+		"dstHost=" + leefValue(ev.Host),
+		"url=" + leefValue(ev.Path),
+		"method=" + leefValue(ev.Method),
+		"userAgent=" + leefValue(ev.UserAgent),
+		"sev=" + strconv.Itoa(sev),
+		"action=blocked",
+		"status=" + strconv.Itoa(ev.StatusCode),
+		"reason=" + leefValue(ev.Reason),
+		"ruleId=" + leefValue(ev.RuleID),
+		"logId=" + leefValue(ev.LogID),
+		"score=" + strconv.Itoa(ev.Score),
+	}
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s",
+		leefHeader(siemVendor), leefHeader(siemProduct), leefHeader(wafVersion),
+		leefHeader(ev.RuleID), strings.Join(attrs, "\t"))
+}
+
+// cefHeader escapes a CEF header field.
+func cefHeader(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return stripNewlines(s)
+}
+
+// cefExtension escapes a CEF extension value.
+func cefExtension(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "=", `\=`)
+	s = strings.ReplaceAll(s, "\r", `\r`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// leefHeader escapes a LEEF header field.
+func leefHeader(s string) string {
+	return stripNewlines(strings.ReplaceAll(s, "|", `\|`))
+}
+
+// leefValue escapes a LEEF attribute value.
+func leefValue(s string) string {
+	return stripNewlines(strings.ReplaceAll(s, "\t", " "))
+}
+
+// stripNewlines replaces line breaks with spaces.
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,60 @@
+package caddywaf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+var siemTestEvent = BlockEvent{
+	Kind:       EventKindBlock,
+	Timestamp:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	LogID:      "abc",
+	ClientIP:   "10.0.0.1",
+	Host:       "example.com",
+	Method:     "GET",
+	Path:       "/a=b",
+	UserAgent:  "curl/8.0",
+	RuleID:     "sqli|1",
+	Reason:     "Rule action is 'block'",
+	Severity:   "HIGH",
+	Score:      7,
+	StatusCode: 403,
+}
+
+func TestFormatCEF(t *testing.T) {
+	line := formatCEF(siemTestEvent)
+	assert.True(t, strings.HasPrefix(line, `CEF:0|caddy-waf|caddy-waf|`+wafVersion+`|sqli\|1|Rule action is 'block'|8|`))
+	assert.Contains(t, line, "src=10.0.0.1")
+	assert.Contains(t, line, `request=/a\=b`)
+	assert.Contains(t, line, "rt=1704164645000")
+	assert.Contains(t, line, "cn1=7")
+}
+
+func TestFormatLEEF(t *testing.T) {
+	line := formatLEEF(siemTestEvent)
+	assert.True(t, strings.HasPrefix(line, `LEEF:1.0|caddy-waf|caddy-waf|`+wafVersion+`|sqli\|1|`))
+	assert.Contains(t, line, "\tsrc=10.0.0.1\t")
+	assert.Contains(t, line, "sev=8")
+}
+
+func TestSIEMWriter_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waf.cef")
+	sw, err := NewSIEMWriter(zap.NewNop(), SIEMOutputConfig{Format: "cef", Output: path})
+	assert.NoError(t, err)
+	sw.Write(siemTestEvent)
+	assert.NoError(t, sw.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "CEF:0|"))
+	assert.True(t, strings.HasSuffix(string(data), "\n"))
+
+	_, err = NewSIEMWriter(zap.NewNop(), SIEMOutputConfig{Format: "json", Output: path})
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package caddywaf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	signedURLRuleID                = "signed_url_rule"
+	defaultSignedURLSignatureParam = "signature"
+	defaultSignedURLExpiresParam   = "expires"
+)
+
+// Reasons a signed URL is rejected for
+const (
+	signedURLMissing = "missing"
+	signedURLExpired = "expired"
+	signedURLInvalid = "invalid"
+)
+
+// SignedURLConfig requires the requests to some paths to carry an unexpired HMAC-SHA256
+// signature in their query, as issued by the application for protected downloads. The
+// signature is the hex HMAC of the escaped path, followed by ? and the raw query without
+// the signature parameter, which must include the expiry in Unix seconds:
+//
+//	/downloads/report.pdf?user=42&expires=1767225600
+type SignedURLConfig struct {
+	Paths          []string `json:"paths"`                     // Protected paths, exact or prefixes ending in *
+	Secret         string   `json:"secret"`                    // HMAC key shared with the application signing the URLs
+	SignatureParam string   `json:"signature_param,omitempty"` // Query parameter of the signature, default signature
+	ExpiresParam   string   `json:"expires_param,omitempty"`   // Query parameter of the expiry, default expires
+}
+
+// provision validates the config and applies the defaults.
+func (c *SignedURLConfig) provision() error {
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("signed_url requires at least one path")
+	}
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("signed_url path must start with /: %s", p)
+		}
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("signed_url requires a secret")
+	}
+	if c.SignatureParam == "" {
+		c.SignatureParam = defaultSignedURLSignatureParam
+	}
+	if c.ExpiresParam == "" {
+		c.ExpiresParam = defaultSignedURLExpiresParam
+	}
+	return nil
+}
+
+// protects reports whether a path requires a signature.
+func (c *SignedURLConfig) protects(path string) bool {
+	return slices.ContainsFunc(c.Paths, func(p string) bool {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			return strings.HasPrefix(path, prefix)
+		}
+		return path == p
+	})
+}
+
+// sign returns the hex HMAC-SHA256 of a signed message.
+func (c *SignedURLConfig) sign(message string) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns why the URL of a request fails verification, or an empty string for a
+// valid URL.
+func (c *SignedURLConfig) verify(u *url.URL, now time.Time) string {
+	query := u.Query()
+	signature, expires := query.Get(c.SignatureParam), query.Get(c.ExpiresParam)
+	if signature == "" || expires == "" {
+		return signedURLMissing
+	}
+
+	// The query is signed as sent, in its order, without the signature
+	var signed []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && name == c.SignatureParam {
+			continue
+		}
+		signed = append(signed, param)
+	}
+	expected := c.sign(u.EscapedPath() + "?" + strings.Join(signed, "&"))
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return signedURLInvalid
+	}
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return signedURLInvalid
+	}
+	if now.Unix() >= expiry {
+		return signedURLExpired
+	}
+	return ""
+}
+
+// checkSignedURL blocks in phase 1 the requests to protected paths whose URL has a missing,
+// expired or invalid signature. It reports whether the request was blocked.
+func (m *Middleware) checkSignedURL(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	for _, config := range m.SignedURLs {
+		if !config.protects(r.URL.Path) {
+			continue
+		}
+		violation := config.verify(r.URL, time.Now())
+		if violation == "" {
+			return false
+		}
+		m.signedURLHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusForbidden, "signed_url", signedURLRuleID,
+			zap.String("message", "Request blocked for its URL signature"),
+			zap.String("violation", violation),
+		)
+		return true
+	}
+	return false
+}
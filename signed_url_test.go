@@ -0,0 +1,67 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSignedURLConfig_Verify(t *testing.T) {
+	config := &SignedURLConfig{Paths: []string{"/downloads/*"}, Secret: "s3cret"}
+	require.NoError(t, config.provision())
+	now := time.Unix(1767225000, 0)
+	signed := "/downloads/report%20Q4.pdf?user=42&expires=1767225600"
+	signature := config.sign(signed)
+
+	for target, violation := range map[string]string{
+		signed + "&signature=" + signature:                                                  "",
+		"/downloads/report%20Q4.pdf?signature=" + signature + "&user=42&expires=1767225600": "",
+		signed + "&signature=" + signature[:10]:                                             signedURLInvalid,
+		signed + "&signature=zz":                                                            signedURLInvalid,
+		"/downloads/report%20Q4.pdf?user=43&expires=1767225600&signature=" + signature:      signedURLInvalid,
+		"/downloads/report%20Q4.pdf?user=42&expires=1767229999&signature=" + signature:      signedURLInvalid,
+		"/downloads/other.pdf?user=42&expires=1767225600&signature=" + signature:            signedURLInvalid,
+		"/downloads/report%20Q4.pdf?user=42&expires=1767225600":                             signedURLMissing,
+		"/downloads/report%20Q4.pdf?signature=" + signature:                                 signedURLMissing,
+	} {
+		u, err := url.Parse(target)
+		require.NoError(t, err)
+		assert.Equal(t, violation, config.verify(u, now), target)
+	}
+
+	u, err := url.Parse(signed + "&signature=" + signature)
+	require.NoError(t, err)
+	assert.Equal(t, signedURLExpired, config.verify(u, time.Unix(1767225600, 0)))
+
+	for _, config := range []*SignedURLConfig{
+		{Secret: "s3cret"},
+		{Paths: []string{"downloads"}, Secret: "s3cret"},
+		{Paths: []string{"/downloads/*"}},
+	} {
+		assert.Error(t, config.provision(), "%+v", config)
+	}
+}
+
+func TestCheckSignedURL(t *testing.T) {
+	config := &SignedURLConfig{Paths: []string{"/downloads/*", "/invoice.pdf"}, Secret: "s3cret", SignatureParam: "sig", ExpiresParam: "exp"}
+	require.NoError(t, config.provision())
+	m := &Middleware{logger: zap.NewNop(), SignedURLs: []*SignedURLConfig{config}}
+
+	signed := "/downloads/app.zip?exp=" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	assert.False(t, m.checkSignedURL(httptest.NewRecorder(), httptest.NewRequest("GET", signed+"&sig="+config.sign(signed), nil), &WAFState{}))
+	assert.False(t, m.checkSignedURL(httptest.NewRecorder(), httptest.NewRequest("GET", "/public/app.zip", nil), &WAFState{}), "other paths are not protected")
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkSignedURL(w, httptest.NewRequest("GET", "/invoice.pdf", nil), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, signedURLRuleID, state.blockRuleID)
+	assert.Equal(t, int64(1), m.signedURLHits.Load())
+}
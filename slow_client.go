@@ -0,0 +1,149 @@
+package caddywaf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	slowBodyRuleID        = "slow_body_rule"
+	defaultSlowBodyGrace  = 5 * time.Second
+	minSlowBodyRateWindow = time.Second
+)
+
+// errSlowBody is returned by reads of a request body arriving too slowly.
+var errSlowBody = errors.New("request body arrived too slowly")
+
+// SlowClientConfig protects against clients trickling request bodies to hold connections
+// open, as in slowloris and slow POST attacks. Headers are read before the WAF runs, so
+// their deadline is Caddy's read_header timeout.
+type SlowClientConfig struct {
+	BodyTimeout time.Duration `json:"body_timeout,omitempty"` // Time to read the whole body, 0 for no limit
+	MinRate     int64         `json:"min_rate,omitempty"`     // Bytes per second the body must average after Grace, 0 for no limit
+	Grace       time.Duration `json:"grace,omitempty"`        // Time before MinRate applies, default 5s
+	BanDuration time.Duration `json:"ban_duration,omitempty"` // Ban slow clients for this long, 0 to only close the connection
+}
+
+// slowBodyReader enforces the body deadline and minimum rate of a request body. While the
+// connection supports read deadlines, a read blocks no longer than the rate allows.
+type slowBodyReader struct {
+	io.ReadCloser
+	config    *SlowClientConfig
+	rc        *http.ResponseController
+	start     time.Time
+	read      int64
+	deadlines bool   // A read deadline was set on the connection
+	reason    string // Why the body was cut off, empty while it arrives in time
+}
+
+// newSlowBodyReader wraps the body of a request, or returns nil if it has none.
+func newSlowBodyReader(w http.ResponseWriter, r *http.Request, config *SlowClientConfig) *slowBodyReader {
+	if r.Body == nil || r.Body == http.NoBody || rpcStreamsRequest(rpcProtocolOf(r)) {
+		return nil // Streamed RPC calls send their messages at the pace of the application
+	}
+	return &slowBodyReader{
+		ReadCloser: r.Body,
+		config:     config,
+		rc:         http.NewResponseController(w),
+		start:      time.Now(),
+	}
+}
+
+// deadline returns when the body is too late: past the body timeout, or once the bytes
+// read so far fall below the minimum rate.
+func (b *slowBodyReader) deadline() time.Time {
+	var deadline time.Time
+	if b.config.BodyTimeout > 0 {
+		deadline = b.start.Add(b.config.BodyTimeout)
+	}
+	if b.config.MinRate > 0 {
+		allowed := max(b.config.Grace, time.Duration(float64(b.read)/float64(b.config.MinRate)*float64(time.Second)))
+		if rateDeadline := b.start.Add(allowed); deadline.IsZero() || rateDeadline.Before(deadline) {
+			deadline = rateDeadline
+		}
+	}
+	return deadline
+}
+
+// check returns why the body is too slow at now, or an empty string.
+func (b *slowBodyReader) check(now time.Time) string {
+	elapsed := now.Sub(b.start)
+	if b.config.BodyTimeout > 0 && elapsed >= b.config.BodyTimeout {
+		return fmt.Sprintf("body not read within %s", b.config.BodyTimeout)
+	}
+	if b.config.MinRate > 0 && elapsed >= b.config.Grace && elapsed >= minSlowBodyRateWindow {
+		if rate := float64(b.read) / elapsed.Seconds(); rate < float64(b.config.MinRate) {
+			return fmt.Sprintf("body arrived at %.0f B/s, below %d B/s", rate, b.config.MinRate)
+		}
+	}
+	return ""
+}
+
+func (b *slowBodyReader) Read(p []byte) (int, error) {
+	if b.reason != "" {
+		return 0, errSlowBody
+	}
+	if err := b.rc.SetReadDeadline(b.deadline()); err == nil {
+		b.deadlines = true
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.clearDeadline()
+		return n, err
+	}
+	if reason := b.check(time.Now()); reason != "" || errors.Is(err, os.ErrDeadlineExceeded) {
+		if reason == "" {
+			reason = fmt.Sprintf("body stalled after %d bytes", b.read)
+		}
+		b.reason = reason
+		return n, errSlowBody
+	}
+	return n, err
+}
+
+func (b *slowBodyReader) Close() error {
+	b.clearDeadline()
+	return b.ReadCloser.Close()
+}
+
+// clearDeadline lifts the read deadline so it doesn't carry over to the next request of
+// the connection.
+func (b *slowBodyReader) clearDeadline() {
+	if b.deadlines {
+		_ = b.rc.SetReadDeadline(time.Time{})
+		b.deadlines = false
+	}
+}
+
+// rejectSlowBody answers a request whose body arrived too slowly with 408 and closes the
+// connection, banning the client if configured. It reports whether the request was rejected.
+func (m *Middleware) rejectSlowBody(w http.ResponseWriter, r *http.Request, state *WAFState, body *slowBodyReader) bool {
+	if body == nil || body.reason == "" {
+		return false
+	}
+	m.slowBodyHits.Add(1)
+	m.incrementRuleHitCount(RuleID(slowBodyRuleID))
+	state.MatchedRules = append(state.MatchedRules, slowBodyRuleID)
+	m.recordBlock(r, state, http.StatusRequestTimeout, "slow_body", slowBodyRuleID,
+		zap.String("detection", body.reason),
+		zap.Int64("bytes_read", body.read),
+	)
+	if m.SlowClient.BanDuration > 0 && m.banList != nil {
+		m.banClient(m.scopedKey(r, extractIP(r.RemoteAddr)), "slow body: "+body.reason, m.SlowClient.BanDuration)
+	}
+
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusRequestTimeout)
+	if _, err := w.Write([]byte("Request body timeout")); err != nil {
+		m.logger.Debug("Failed to write slow body response", zap.Error(err))
+	}
+	return true
+}
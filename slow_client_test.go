@@ -0,0 +1,119 @@
+package caddywaf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// trickleReader returns one byte per read.
+type trickleReader struct{ remaining int }
+
+func (t *trickleReader) Read(p []byte) (int, error) {
+	if t.remaining == 0 {
+		return 0, io.EOF
+	}
+	t.remaining--
+	p[0] = 'a'
+	return 1, nil
+}
+
+func TestSlowBodyReader_Check(t *testing.T) {
+	start := time.Now()
+	b := &slowBodyReader{config: &SlowClientConfig{BodyTimeout: 30 * time.Second, MinRate: 100, Grace: 5 * time.Second}, start: start}
+
+	assert.Empty(t, b.check(start.Add(2*time.Second)), "within the grace period")
+	assert.Contains(t, b.check(start.Add(6*time.Second)), "below 100 B/s")
+	b.read = 1000
+	assert.Empty(t, b.check(start.Add(6*time.Second)))
+	b.read = 1 << 20
+	assert.Contains(t, b.check(start.Add(30*time.Second)), "not read within 30s")
+}
+
+func TestSlowBodyReader_Deadline(t *testing.T) {
+	start := time.Now()
+	b := &slowBodyReader{config: &SlowClientConfig{BodyTimeout: 30 * time.Second, MinRate: 100, Grace: 5 * time.Second}, start: start}
+	assert.Equal(t, start.Add(5*time.Second), b.deadline(), "grace period first")
+	b.read = 1000
+	assert.Equal(t, start.Add(10*time.Second), b.deadline(), "1000 bytes at 100 B/s")
+	b.read = 1 << 20
+	assert.Equal(t, start.Add(30*time.Second), b.deadline(), "capped by the body timeout")
+
+	b.config = &SlowClientConfig{BodyTimeout: time.Minute}
+	assert.Equal(t, start.Add(time.Minute), b.deadline())
+}
+
+func TestSlowBodyReader_Read(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(&trickleReader{remaining: 10}))
+	b := newSlowBodyReader(httptest.NewRecorder(), req, &SlowClientConfig{MinRate: 100, Grace: time.Second})
+	require.NotNil(t, b)
+	b.start = time.Now().Add(-2 * time.Second) // Two seconds in, with nothing read
+
+	_, err := io.ReadAll(b)
+	assert.ErrorIs(t, err, errSlowBody)
+	assert.Contains(t, b.reason, "below 100 B/s")
+	_, err = b.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, errSlowBody, "reads stay cut off")
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 4096)))
+	b = newSlowBodyReader(httptest.NewRecorder(), req, &SlowClientConfig{MinRate: 100, Grace: time.Second})
+	body, err := io.ReadAll(b)
+	require.NoError(t, err)
+	assert.Len(t, body, 4096)
+	assert.Empty(t, b.reason)
+
+	assert.Nil(t, newSlowBodyReader(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), &SlowClientConfig{}))
+}
+
+func TestRejectSlowBody(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), SlowClient: &SlowClientConfig{BanDuration: time.Minute}, banList: NewBanList(BanConfig{})}
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.False(t, m.rejectSlowBody(httptest.NewRecorder(), req, &WAFState{}, &slowBodyReader{}))
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.rejectSlowBody(w, req, state, &slowBodyReader{reason: "body not read within 1s"}))
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+	assert.True(t, state.Blocked)
+	assert.Equal(t, int64(1), m.slowBodyHits.Load())
+	assert.True(t, m.isBanned(req))
+}
+
+func TestSlowBodyReader_StalledConnection(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), SlowClient: &SlowClientConfig{BodyTimeout: 200 * time.Millisecond}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := newSlowBodyReader(w, r, m.SlowClient)
+		r.Body = body
+		_, _ = io.ReadAll(r.Body)
+		if !m.rejectSlowBody(w, r, &WAFState{}, body) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// Announce a body and send only part of it
+	_, err = fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\npartial")
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, "the stalled read is cut off by the deadline")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
@@ -0,0 +1,212 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	smugglingRuleID    = "smuggling_rule"
+	smugglingActionOff = "off"
+)
+
+// Request smuggling checks
+const (
+	SmugglingConflictingLength = "conflicting_length"
+	SmugglingObfuscatedTE      = "obfuscated_te"
+	SmugglingGetWithBody       = "get_with_body"
+	SmugglingDuplicateLength   = "duplicate_length"
+)
+
+// smugglingChecks are the request smuggling checks, each returning a description of the
+// indicator found, or an empty string.
+var smugglingChecks = []struct {
+	name  string
+	check func(*http.Request) string
+}{
+	{SmugglingConflictingLength, conflictingLength},
+	{SmugglingObfuscatedTE, obfuscatedTransferEncoding},
+	{SmugglingGetWithBody, getWithBody},
+	{SmugglingDuplicateLength, duplicateLength},
+}
+
+// transferEncodingRegex matches the Transfer-Encoding values in the form clients send:
+// lowercase codings ending with chunked, separated by a comma and an optional space.
+var transferEncodingRegex = regexp.MustCompile(`^(?:(?:gzip|deflate|compress|x-gzip), ?)*chunked$`)
+
+// SmugglingCheck is the action taken by a request smuggling check.
+type SmugglingCheck struct {
+	Action string `json:"action,omitempty"` // block (default), score or off
+	Score  int    `json:"score,omitempty"`  // Score added with score, default 5
+}
+
+// SmugglingConfig checks the framing headers of requests in phase 1 for request smuggling
+// indicators: Content-Length with Transfer-Encoding, obfuscated Transfer-Encoding headers,
+// bodies on GET and HEAD requests, and duplicate Content-Length headers.
+type SmugglingConfig struct {
+	Checks map[string]*SmugglingCheck `json:"checks,omitempty"` // Actions by check, default block for all
+}
+
+// provision validates the checks and applies the defaults.
+func (c *SmugglingConfig) provision() error {
+	for name := range c.Checks {
+		if !isSmugglingCheck(name) {
+			return fmt.Errorf("unknown request_smuggling check: %s", name)
+		}
+	}
+	if c.Checks == nil {
+		c.Checks = make(map[string]*SmugglingCheck)
+	}
+	for _, s := range smugglingChecks {
+		check := c.Checks[s.name]
+		if check == nil {
+			check = &SmugglingCheck{}
+			c.Checks[s.name] = check
+		}
+		switch check.Action {
+		case "":
+			check.Action = detectionActionBlock
+		case detectionActionBlock, detectionActionScore, smugglingActionOff:
+		default:
+			return fmt.Errorf("invalid request_smuggling action for %s: %s, must be block, score or off", s.name, check.Action)
+		}
+		if check.Score <= 0 {
+			check.Score = defaultDetectionScore
+		}
+	}
+	return nil
+}
+
+// isSmugglingCheck reports whether a request smuggling check exists.
+func isSmugglingCheck(name string) bool {
+	for _, s := range smugglingChecks {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTransferEncoding reports whether a request declares a Transfer-Encoding, which Go's
+// server moves from the headers to TransferEncoding.
+func hasTransferEncoding(r *http.Request) bool {
+	return len(r.TransferEncoding) > 0 || len(r.Header.Values("Transfer-Encoding")) > 0
+}
+
+// conflictingLength flags a request with both Content-Length and Transfer-Encoding, which
+// servers disagreeing on the one to honor frame differently.
+func conflictingLength(r *http.Request) string {
+	if hasTransferEncoding(r) && len(r.Header.Values("Content-Length")) > 0 {
+		return "Content-Length with Transfer-Encoding"
+	}
+	return ""
+}
+
+// obfuscatedTransferEncoding flags Transfer-Encoding headers repeated, with values other
+// servers may not parse alike, such as Chunked, "chunked " or "chunked, identity", and
+// header names standing for Transfer-Encoding on some servers, such as Transfer_Encoding.
+func obfuscatedTransferEncoding(r *http.Request) string {
+	values := r.Header.Values("Transfer-Encoding")
+	if len(values) > 1 {
+		return fmt.Sprintf("%d Transfer-Encoding headers", len(values))
+	}
+	for _, value := range values {
+		if !transferEncodingRegex.MatchString(value) {
+			return fmt.Sprintf("Transfer-Encoding %q", value)
+		}
+	}
+	if name := headerAlias(r.Header, "transferencoding", "Transfer-Encoding"); name != "" {
+		return "header " + name
+	}
+	return ""
+}
+
+// getWithBody flags GET and HEAD requests with a body, which servers not expecting one
+// may take for the start of the next request.
+func getWithBody(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if r.ContentLength > 0 || hasTransferEncoding(r) {
+		return r.Method + " with a body"
+	}
+	return ""
+}
+
+// duplicateLength flags Content-Length headers repeated or listing several values, even
+// equal, and header names standing for Content-Length on some servers.
+func duplicateLength(r *http.Request) string {
+	values := r.Header.Values("Content-Length")
+	if len(values) > 1 {
+		return fmt.Sprintf("%d Content-Length headers", len(values))
+	}
+	if len(values) == 1 && strings.Contains(values[0], ",") {
+		return fmt.Sprintf("Content-Length %q", values[0])
+	}
+	if name := headerAlias(r.Header, "contentlength", "Content-Length"); name != "" {
+		return "header " + name
+	}
+	return ""
+}
+
+// headerAlias returns the name of a header other than canonical that reads as the given
+// lowercase name without its dashes and underscores, or an empty string.
+func headerAlias(header http.Header, stripped, canonical string) string {
+	for name := range header {
+		if name == canonical {
+			continue
+		}
+		normalized := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+		if strings.TrimSpace(normalized) == stripped {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkSmuggling runs the request smuggling checks in phase 1, blocking the request with
+// 400 if a block check flags it, and otherwise adding the score of each score check that
+// does. It reports whether the request was blocked.
+func (m *Middleware) checkSmuggling(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.Smuggling
+	if config == nil {
+		return false
+	}
+	var findings []string
+	block, score := false, 0
+	for _, s := range smugglingChecks {
+		check := config.Checks[s.name]
+		if check.Action == smugglingActionOff {
+			continue
+		}
+		indicator := s.check(r)
+		if indicator == "" {
+			continue
+		}
+		findings = append(findings, s.name+": "+indicator)
+		if check.Action == detectionActionBlock {
+			block = true
+		} else {
+			score += check.Score
+		}
+	}
+	if len(findings) == 0 {
+		return false
+	}
+	sort.Strings(findings)
+
+	m.smugglingHits.Add(1)
+	m.incrementRuleHitCount(RuleID(smugglingRuleID))
+	state.MatchedRules = append(state.MatchedRules, smugglingRuleID)
+	action := detectionActionScore
+	if block {
+		action = detectionActionBlock
+	}
+	return m.applyDetection(w, r, state, action, score, http.StatusBadRequest, "request_smuggling", smugglingRuleID,
+		"Request smuggling indicators detected", zap.Strings("findings", findings))
+}
@@ -0,0 +1,88 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func smugglingRequest(method string, header map[string][]string) *http.Request {
+	r := httptest.NewRequest(method, "/", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	return r
+}
+
+func TestSmugglingChecks(t *testing.T) {
+	chunked := httptest.NewRequest("POST", "/", strings.NewReader("0\r\n\r\n"))
+	chunked.TransferEncoding = []string{"chunked"}
+	assert.Empty(t, conflictingLength(chunked))
+	chunked.Header.Set("Content-Length", "5")
+	assert.Equal(t, "Content-Length with Transfer-Encoding", conflictingLength(chunked))
+	assert.NotEmpty(t, conflictingLength(smugglingRequest("POST", map[string][]string{"Transfer-Encoding": {"chunked"}, "Content-Length": {"4"}})))
+
+	for _, value := range []string{"chunked", "gzip, chunked", "gzip,chunked"} {
+		assert.Empty(t, obfuscatedTransferEncoding(smugglingRequest("POST", map[string][]string{"Transfer-Encoding": {value}})), value)
+	}
+	for _, value := range []string{"Chunked", "chunked ", " chunked", "chunked, identity", "xchunked", "chunked\t", `"chunked"`} {
+		assert.NotEmpty(t, obfuscatedTransferEncoding(smugglingRequest("POST", map[string][]string{"Transfer-Encoding": {value}})), value)
+	}
+	assert.Equal(t, "2 Transfer-Encoding headers", obfuscatedTransferEncoding(smugglingRequest("POST", map[string][]string{"Transfer-Encoding": {"chunked", "chunked"}})))
+	assert.Equal(t, "header Transfer_encoding", obfuscatedTransferEncoding(smugglingRequest("POST", map[string][]string{"Transfer_encoding": {"chunked"}})))
+
+	get := httptest.NewRequest("GET", "/", strings.NewReader("GET /admin HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "GET with a body", getWithBody(get))
+	assert.Empty(t, getWithBody(httptest.NewRequest("GET", "/", nil)))
+	assert.Empty(t, getWithBody(httptest.NewRequest("POST", "/", strings.NewReader("a=1"))))
+
+	assert.Empty(t, duplicateLength(smugglingRequest("POST", map[string][]string{"Content-Length": {"3"}})))
+	assert.Equal(t, "2 Content-Length headers", duplicateLength(smugglingRequest("POST", map[string][]string{"Content-Length": {"3", "3"}})))
+	assert.Equal(t, `Content-Length "3, 3"`, duplicateLength(smugglingRequest("POST", map[string][]string{"Content-Length": {"3, 3"}})))
+	assert.Equal(t, "header Content_length", duplicateLength(smugglingRequest("POST", map[string][]string{"Content_length": {"3"}})))
+}
+
+func TestSmugglingConfig_Provision(t *testing.T) {
+	config := &SmugglingConfig{}
+	require.NoError(t, config.provision())
+	assert.Len(t, config.Checks, 4)
+	assert.Equal(t, &SmugglingCheck{Action: detectionActionBlock, Score: defaultDetectionScore}, config.Checks[SmugglingObfuscatedTE])
+
+	assert.Error(t, (&SmugglingConfig{Checks: map[string]*SmugglingCheck{"chunked_body": {}}}).provision())
+	assert.Error(t, (&SmugglingConfig{Checks: map[string]*SmugglingCheck{SmugglingGetWithBody: {Action: "drop"}}}).provision())
+}
+
+func TestCheckSmuggling(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	r := smugglingRequest("GET", map[string][]string{"Content-Length": {"3", "3"}, "Transfer_Encoding": {"chunked"}})
+	assert.False(t, m.checkSmuggling(httptest.NewRecorder(), r, &WAFState{}))
+
+	m.Smuggling = &SmugglingConfig{Checks: map[string]*SmugglingCheck{
+		SmugglingObfuscatedTE:    {Action: detectionActionScore, Score: 3},
+		SmugglingDuplicateLength: {Action: detectionActionScore},
+		SmugglingGetWithBody:     {Action: smugglingActionOff},
+	}}
+	require.NoError(t, m.Smuggling.provision())
+	state := &WAFState{}
+	assert.False(t, m.checkSmuggling(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 8, state.TotalScore, "obfuscated_te and duplicate_length")
+	assert.Equal(t, []string{smugglingRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.smugglingHits.Load())
+
+	assert.False(t, m.checkSmuggling(httptest.NewRecorder(), httptest.NewRequest("GET", "/", strings.NewReader("body")), &WAFState{}), "get_with_body is off")
+	w := httptest.NewRecorder()
+	r = smugglingRequest("POST", map[string][]string{"Transfer-Encoding": {"chunked"}, "Content-Length": {"10"}})
+	assert.True(t, m.checkSmuggling(w, r, &WAFState{}), "conflicting_length blocks by default")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
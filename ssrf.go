@@ -0,0 +1,261 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const ssrfRuleID = "ssrf_rule"
+
+// Kinds of SSRF indicators
+const (
+	SSRFLoopback    = "loopback"
+	SSRFPrivate     = "private"
+	SSRFLinkLocal   = "link_local"
+	SSRFMetadata    = "metadata"
+	SSRFUnspecified = "unspecified"
+	SSRFScheme      = "scheme" // A scheme used to smuggle requests to internal services
+)
+
+var (
+	ssrfURLRegex = regexp.MustCompile(`(?i)(?:\b[a-z][a-z0-9+.-]*:)?//[^\s"'<>\\]+`)
+
+	// ssrfSchemes are schemes rarely legitimate in parameters, used to reach internal services.
+	ssrfSchemes = map[string]bool{"gopher": true, "dict": true, "file": true, "ldap": true, "tftp": true, "jar": true, "netdoc": true}
+
+	// ssrfMetadataHosts are the host names of cloud instance metadata services.
+	ssrfMetadataHosts = map[string]bool{
+		"metadata":                   true,
+		"metadata.google.internal":   true,
+		"metadata.goog":              true,
+		"instance-data":              true,
+		"instance-data.ec2.internal": true,
+		"metadata.azure.com":         true,
+	}
+
+	// ssrfMetadataAddrs are the addresses of cloud instance metadata services.
+	ssrfMetadataAddrs = map[netip.Addr]bool{
+		netip.MustParseAddr("169.254.169.254"): true, // AWS, GCP, Azure, OpenStack
+		netip.MustParseAddr("169.254.170.2"):   true, // AWS ECS task metadata
+		netip.MustParseAddr("100.100.100.200"): true, // Alibaba Cloud
+		netip.MustParseAddr("fd00:ec2::254"):   true, // AWS over IPv6
+	}
+
+	// ssrfWildcardDomains resolve names embedding an IP, such as 127.0.0.1.nip.io, to it.
+	ssrfWildcardDomains = []string{".nip.io", ".sslip.io", ".xip.io"}
+)
+
+// SSRFConfig flags request parameters holding URLs that point at internal destinations:
+// loopback, private and link-local ranges, and cloud metadata endpoints, including
+// addresses obfuscated in decimal, hexadecimal or octal.
+type SSRFConfig struct {
+	Action string `json:"action,omitempty"` // block (default) or score
+	Score  int    `json:"score,omitempty"`  // Score per parameter flagged, default 5
+}
+
+// provision validates the config and applies the defaults.
+func (c *SSRFConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid ssrf action: %s, must be block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	return nil
+}
+
+// parseObfuscatedIPv4 parses an IPv4 address in any of the forms inet_aton accepts, which
+// HTTP clients resolve: 1 to 4 parts, each decimal, hexadecimal with 0x or octal with a
+// leading 0, the last part filling the remaining bytes, such as 2130706433, 0x7f000001,
+// 0177.0.0.1 or 127.1.
+func parseObfuscatedIPv4(host string) (netip.Addr, bool) {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		base := 10
+		switch {
+		case len(part) > 2 && (part[:2] == "0x" || part[:2] == "0X"):
+			part, base = part[2:], 16
+		case len(part) > 1 && part[0] == '0':
+			part, base = part[1:], 8
+		}
+		value, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		values[i] = value
+	}
+	var ip uint64
+	for i, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return netip.Addr{}, false
+		}
+		ip |= value << (24 - 8*i)
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(8*(5-len(values))) {
+		return netip.Addr{}, false
+	}
+	ip |= last
+	return netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}), true
+}
+
+// classifyHost returns the kind of internal destination the host of a URL is, or an empty
+// string. Addresses may be obfuscated, as the HTTP clients of the upstream resolve them.
+func classifyHost(host string) string {
+	host = normalizeHost(host)
+	if kind := classifyName(host); kind != "" {
+		return kind
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		var ok bool
+		if addr, ok = parseObfuscatedIPv4(host); !ok {
+			return ""
+		}
+	}
+	return classifyAddr(addr)
+}
+
+// classifyBareHost returns the kind of internal destination a parameter holding a host,
+// optionally with a port, is, or an empty string. Unlike URL hosts, it only accepts
+// canonical addresses, as numbers such as 10.5 or 2130706433 are common parameter values.
+func classifyBareHost(value string) string {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	host := normalizeHost(value)
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return ""
+	}
+	if kind := classifyName(host); kind != "" {
+		return kind
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return classifyAddr(addr)
+	}
+	return ""
+}
+
+// normalizeHost lowercases a host and strips its IPv6 brackets and zone and trailing dot.
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// classifyName returns the kind of internal destination a host name is: a metadata
+// service, a loopback name, or a wildcard DNS name embedding an internal address.
+func classifyName(host string) string {
+	if ssrfMetadataHosts[host] {
+		return SSRFMetadata
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || host == "localtest.me" || strings.HasSuffix(host, ".localtest.me") {
+		return SSRFLoopback
+	}
+	for _, domain := range ssrfWildcardDomains {
+		if embedded, ok := strings.CutSuffix(host, domain); ok {
+			labels := strings.Split(strings.ReplaceAll(embedded, "-", "."), ".")
+			if len(labels) > 4 { // Any labels before the address, as in app.10.0.0.1.nip.io
+				labels = labels[len(labels)-4:]
+			}
+			if addr, err := netip.ParseAddr(strings.Join(labels, ".")); err == nil {
+				return classifyAddr(addr)
+			}
+		}
+	}
+	return ""
+}
+
+// classifyAddr returns the kind of internal destination an address is, or an empty string.
+func classifyAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	switch {
+	case ssrfMetadataAddrs[addr]:
+		return SSRFMetadata
+	case addr.IsLoopback():
+		return SSRFLoopback
+	case addr.IsUnspecified():
+		return SSRFUnspecified
+	case addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast():
+		return SSRFLinkLocal
+	case addr.IsPrivate():
+		return SSRFPrivate
+	}
+	return ""
+}
+
+// classifyURL returns the kind of SSRF indicator of a URL, or an empty string.
+func classifyURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if ssrfSchemes[strings.ToLower(u.Scheme)] {
+		return SSRFScheme
+	}
+	return classifyHost(u.Hostname())
+}
+
+// ssrfIndicator returns the first SSRF indicator of a value, as its kind and the URL or
+// host it was found in, or empty strings. The value may hold URLs or be a bare host.
+func ssrfIndicator(value string) (string, string) {
+	for _, candidate := range ssrfURLRegex.FindAllString(value, -1) {
+		if kind := classifyURL(candidate); kind != "" {
+			return kind, candidate
+		}
+	}
+	if kind := classifyBareHost(value); kind != "" {
+		return kind, strings.TrimSpace(value)
+	}
+	return "", ""
+}
+
+// checkSSRF flags the request parameters holding URLs or hosts pointing at internal
+// destinations in phase 2, blocking the request or adding score per parameter flagged.
+// It reports whether the request was blocked.
+func (m *Middleware) checkSSRF(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.SSRF
+	if config == nil {
+		return false
+	}
+	params, _ := m.requestParams(r, state)
+	var findings []string
+	for name, values := range params {
+		for _, value := range values {
+			if kind, found := ssrfIndicator(value); kind != "" {
+				findings = append(findings, fmt.Sprintf("%s: %s %s", name, kind, found))
+				break
+			}
+		}
+	}
+	if len(findings) == 0 {
+		return false
+	}
+	sort.Strings(findings)
+
+	m.ssrfHits.Add(1)
+	m.incrementRuleHitCount(RuleID(ssrfRuleID))
+	state.MatchedRules = append(state.MatchedRules, ssrfRuleID)
+	return m.applyDetection(w, r, state, config.Action, config.Score*len(findings), http.StatusForbidden, "ssrf", ssrfRuleID,
+		"SSRF indicators detected", zap.Strings("findings", findings))
+}
@@ -0,0 +1,125 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseObfuscatedIPv4(t *testing.T) {
+	for input, expected := range map[string]string{
+		"2130706433":      "127.0.0.1",
+		"0x7f000001":      "127.0.0.1",
+		"0177.0.0.1":      "127.0.0.1",
+		"0x7f.0x0.0x0.01": "127.0.0.1",
+		"127.1":           "127.0.0.1",
+		"10.0.258":        "10.0.1.2",
+		"0xa9fea9fe":      "169.254.169.254",
+		"025177524776":    "169.254.169.254",
+	} {
+		addr, ok := parseObfuscatedIPv4(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, netip.MustParseAddr(expected), addr, input)
+	}
+	for _, input := range []string{"", "example.com", "1.2.3.4.5", "256.0.0.1", "08.0.0.1", "1.2.65536", "4294967296"} {
+		_, ok := parseObfuscatedIPv4(input)
+		assert.False(t, ok, input)
+	}
+}
+
+func TestSSRFIndicator(t *testing.T) {
+	for input, expected := range map[string]string{
+		"http://169.254.169.254/latest/meta-data/":              SSRFMetadata,
+		"http://metadata.google.internal/computeMetadata/v1/":   SSRFMetadata,
+		"http://[fd00:ec2::254]/latest/":                        SSRFMetadata,
+		"https://2852039166/":                                   SSRFMetadata,
+		"http://0x7f000001:8080/admin":                          SSRFLoopback,
+		"http://0177.0.0.1/":                                    SSRFLoopback,
+		"http://[::ffff:127.0.0.1]/":                            SSRFLoopback,
+		"http://LOCALHOST./":                                    SSRFLoopback,
+		"http://admin.localhost/":                               SSRFLoopback,
+		"http://app.127-0-0-1.nip.io/":                          SSRFLoopback,
+		"see //10.1.2.3/share":                                  SSRFPrivate,
+		"http://user@192.168.0.1:8443/":                         SSRFPrivate,
+		"http://[fc00::1]/":                                     SSRFPrivate,
+		"http://169.254.1.1/":                                   SSRFLinkLocal,
+		"http://0.0.0.0:6379/":                                  SSRFUnspecified,
+		"gopher://example.com:6379/_SET":                        SSRFScheme,
+		"file:///etc/passwd":                                    SSRFScheme,
+		"redirect to https://example.com then http://10.0.0.1/": SSRFPrivate,
+		"127.0.0.1":       SSRFLoopback,
+		"192.168.1.10:22": SSRFPrivate,
+		"[::1]:8080":      SSRFLoopback,
+		"localhost":       SSRFLoopback,
+	} {
+		kind, found := ssrfIndicator(input)
+		assert.Equal(t, expected, kind, input)
+		assert.NotEmpty(t, found, input)
+	}
+	for _, input := range []string{
+		"https://example.com/callback",
+		"http://8.8.8.8/",
+		"http://93.184.216.34.nip.io/",
+		"2130706433", // Bare numbers are not taken for addresses
+		"10.5",
+		"0",
+		"a/b//c",
+		"",
+	} {
+		kind, _ := ssrfIndicator(input)
+		assert.Empty(t, kind, input)
+	}
+}
+
+func TestSSRFConfig_Provision(t *testing.T) {
+	config := &SSRFConfig{}
+	require.NoError(t, config.provision())
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+
+	assert.Error(t, (&SSRFConfig{Action: "drop"}).provision())
+}
+
+func TestCheckSSRF(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	assert.False(t, m.checkSSRF(httptest.NewRecorder(), testRequest("GET", "/?url=http://127.0.0.1/", "", ""), &WAFState{}))
+
+	m.SSRF = &SSRFConfig{Action: detectionActionScore, Score: 4}
+	require.NoError(t, m.SSRF.provision())
+	state := &WAFState{}
+	r := testRequest("POST", "/fetch?url=https://example.com/&next=http%3A%2F%2F2130706433%2F", "application/x-www-form-urlencoded", "webhook=http://169.254.169.254/latest/")
+	assert.False(t, m.checkSSRF(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 8, state.TotalScore, "next and webhook")
+	assert.Equal(t, []string{ssrfRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.ssrfHits.Load())
+
+	m.SSRF = &SSRFConfig{}
+	require.NoError(t, m.SSRF.provision())
+	assert.False(t, m.checkSSRF(httptest.NewRecorder(), testRequest("GET", "/fetch?url=https://example.com/", "", ""), &WAFState{}))
+	w := httptest.NewRecorder()
+	assert.True(t, m.checkSSRF(w, testRequest("GET", "/fetch?url=gopher://redis:6379/_FLUSHALL", "", ""), &WAFState{}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestConditionHolds_SSRF(t *testing.T) {
+	m := conditionMiddleware()
+	program, err := compileRuleCondition(`ssrf(request.args["url"])`)
+	assert.NoError(t, err)
+	rule := &Rule{ID: "c1", Phase: 1, condition: program}
+
+	req := httptest.NewRequest("GET", "/?url=http://0x7f.1/", nil)
+	assert.True(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+	req = httptest.NewRequest("GET", "/?url=https://example.com/", nil)
+	assert.False(t, m.conditionHolds(rule, httptest.NewRecorder(), req, &WAFState{}))
+}
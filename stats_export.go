@@ -0,0 +1,190 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatsExportInterval = time.Hour
+	defaultStatsExportTimeout  = 10 * time.Second
+)
+
+// StatsExportConfig periodically exports the rule hits, counters and top offenders, appended
+// as a JSON line to a file or POSTed to an http(s) URL.
+type StatsExportConfig struct {
+	Output   string            `json:"output"`             // File path, or http:// / https:// URL
+	Interval time.Duration     `json:"interval,omitempty"` // Time between two exports, default 1h
+	Top      int               `json:"top,omitempty"`      // Offenders of each kind exported, default 10
+	Headers  map[string]string `json:"headers,omitempty"`  // Headers of the POST requests
+	Timeout  time.Duration     `json:"timeout,omitempty"`  // Timeout of the POST requests, default 10s
+}
+
+// StatsSnapshot is an export of the statistics.
+type StatsSnapshot struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Metrics   map[string]interface{} `json:"metrics"`       // Counters of the metrics endpoint, rule hits included
+	Top       *TopOffenders          `json:"top,omitempty"` // Top offenders since the previous export, up to one hour
+}
+
+// StatsExporter periodically writes or pushes a snapshot of the statistics.
+type StatsExporter struct {
+	logger   *zap.Logger
+	config   StatsExportConfig
+	snapshot func(now time.Time) StatsSnapshot
+	client   *http.Client
+
+	mu sync.Mutex // Serializes the exports
+
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// isURLOutput reports whether the output is an http(s) URL rather than a file.
+func (c StatsExportConfig) isURLOutput() bool {
+	return strings.HasPrefix(c.Output, "http://") || strings.HasPrefix(c.Output, "https://")
+}
+
+// NewStatsExporter validates the config and applies its defaults. snapshot builds the
+// statistics exported.
+func NewStatsExporter(logger *zap.Logger, config StatsExportConfig, snapshot func(now time.Time) StatsSnapshot) (*StatsExporter, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Output == "" {
+		return nil, fmt.Errorf("stats_export requires a file or URL")
+	}
+	if len(config.Headers) > 0 && !config.isURLOutput() {
+		return nil, fmt.Errorf("stats_export headers require a URL output")
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultStatsExportInterval
+	}
+	if config.Top <= 0 {
+		config.Top = defaultOffenderTopN
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultStatsExportTimeout
+	}
+	return &StatsExporter{
+		logger:   logger,
+		config:   config,
+		snapshot: snapshot,
+		client:   &http.Client{Timeout: config.Timeout},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Start exports the statistics every interval.
+func (se *StatsExporter) Start() {
+	se.wg.Add(1)
+	go se.exportLoop()
+}
+
+// Stop stops the periodic exports, then exports the statistics one last time.
+func (se *StatsExporter) Stop() {
+	se.stopOnce.Do(func() {
+		close(se.stop)
+		se.wg.Wait()
+		se.exportAndLog(time.Now())
+	})
+}
+
+func (se *StatsExporter) exportLoop() {
+	defer se.wg.Done()
+	ticker := time.NewTicker(se.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			se.exportAndLog(now)
+		case <-se.stop:
+			return
+		}
+	}
+}
+
+func (se *StatsExporter) exportAndLog(now time.Time) {
+	if err := se.Export(now); err != nil {
+		se.logger.Error("Failed to export statistics", zap.String("output", se.config.Output), zap.Error(err))
+	}
+}
+
+// Export writes or pushes a snapshot of the statistics.
+func (se *StatsExporter) Export(now time.Time) error {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	data, err := json.Marshal(se.snapshot(now))
+	if err != nil {
+		return fmt.Errorf("failed to marshal statistics: %w", err)
+	}
+	if se.config.isURLOutput() {
+		err = se.push(data)
+	} else {
+		err = se.appendFile(data)
+	}
+	if err != nil {
+		return err
+	}
+	se.logger.Debug("Statistics exported", zap.String("output", se.config.Output), zap.Int("bytes", len(data)))
+	return nil
+}
+
+// appendFile appends a snapshot to the output file as a JSON line.
+func (se *StatsExporter) appendFile(data []byte) error {
+	f, err := os.OpenFile(se.config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open stats_export file: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write stats_export file: %w", err)
+	}
+	return f.Close()
+}
+
+// push POSTs a snapshot to the output URL.
+func (se *StatsExporter) push(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), se.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, se.config.Output, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create stats_export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range se.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := se.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push statistics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("stats_export endpoint returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// statsSnapshot collects the metrics and the top offenders of the last export interval,
+// between one minute and one hour.
+func (m *Middleware) statsSnapshot(now time.Time) StatsSnapshot {
+	snapshot := StatsSnapshot{Timestamp: now, Metrics: m.metricsSnapshot()}
+	if m.offenderTracker != nil && m.statsExporter != nil {
+		window := min(max(m.statsExporter.config.Interval, offenderBucketWidth), offenderBucketWidth*offenderBucketCount)
+		top := m.offenderTracker.Top(now, window, m.statsExporter.config.Top)
+		snapshot.Top = &top
+	}
+	return snapshot
+}
@@ -0,0 +1,97 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewStatsExporter(t *testing.T) {
+	se, err := NewStatsExporter(nil, StatsExportConfig{Output: "/tmp/stats.json"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultStatsExportInterval, se.config.Interval)
+	assert.Equal(t, defaultOffenderTopN, se.config.Top)
+	assert.Equal(t, defaultStatsExportTimeout, se.config.Timeout)
+
+	_, err = NewStatsExporter(nil, StatsExportConfig{}, nil)
+	assert.Error(t, err)
+	_, err = NewStatsExporter(nil, StatsExportConfig{Output: "/tmp/stats.json", Headers: map[string]string{"X-Token": "secret"}}, nil)
+	assert.Error(t, err, "headers need a URL output")
+}
+
+func TestStatsExporter_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stats.json")
+	m := &Middleware{logger: zap.NewNop(), ruleHitsByPhase: map[int]int64{}, offenderTracker: NewOffenderTracker(), totalRequests: 42}
+	m.ruleHits.Store(RuleID("sqli-1"), HitCount(3))
+	se, err := NewStatsExporter(m.logger, StatsExportConfig{Output: file, Top: 1}, m.statsSnapshot)
+	require.NoError(t, err)
+	m.statsExporter = se
+	now := time.Now()
+	m.offenderTracker.Record(BlockEvent{Timestamp: now, ClientIP: "203.0.113.7", RuleID: "sqli-1", Path: "/login"})
+	m.offenderTracker.Record(BlockEvent{Timestamp: now, ClientIP: "203.0.113.7", RuleID: "sqli-1", Path: "/login"})
+	m.offenderTracker.Record(BlockEvent{Timestamp: now, ClientIP: "198.51.100.1", RuleID: "xss-1", Path: "/search"})
+
+	require.NoError(t, m.statsExporter.Export(now))
+	require.NoError(t, m.statsExporter.Export(now.Add(time.Hour)))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2, "each export appends a JSON line")
+
+	var snapshot StatsSnapshot
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &snapshot))
+	assert.Equal(t, float64(42), snapshot.Metrics["total_requests"])
+	assert.Equal(t, map[string]interface{}{"sqli-1": float64(3)}, snapshot.Metrics["rule_hits"])
+	require.NotNil(t, snapshot.Top)
+	assert.Equal(t, "1h0m0s", snapshot.Top.Window)
+	assert.Equal(t, 3, snapshot.Top.Blocked)
+	require.Len(t, snapshot.Top.IPs, 1)
+	assert.Equal(t, "203.0.113.7", snapshot.Top.IPs[0].Key)
+}
+
+func TestStatsExporter_URL(t *testing.T) {
+	var received []byte
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("Authorization")
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	m := &Middleware{logger: zap.NewNop(), ruleHitsByPhase: map[int]int64{}, offenderTracker: NewOffenderTracker(), totalRequests: 42}
+	se, err := NewStatsExporter(m.logger, StatsExportConfig{Output: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}, m.statsSnapshot)
+	require.NoError(t, err)
+	m.statsExporter = se
+	m.statsExporter.Start()
+	m.statsExporter.Stop() // Exports one last time
+
+	assert.Equal(t, "Bearer secret", token)
+	var snapshot StatsSnapshot
+	require.NoError(t, json.Unmarshal(received, &snapshot))
+	assert.Equal(t, float64(42), snapshot.Metrics["total_requests"])
+}
+
+func TestStatsExporter_URLError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	m := &Middleware{logger: zap.NewNop(), ruleHitsByPhase: map[int]int64{}, offenderTracker: NewOffenderTracker()}
+	se, err := NewStatsExporter(m.logger, StatsExportConfig{Output: server.URL}, m.statsSnapshot)
+	require.NoError(t, err)
+	m.statsExporter = se
+	assert.ErrorContains(t, m.statsExporter.Export(time.Now()), "502")
+}
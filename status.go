@@ -0,0 +1,199 @@
+package caddywaf
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const logQueueDegradedRatio = 0.9 // Log queue fill ratio above which the WAF reports degraded
+
+// fileWatchStatus is the health of a single file watcher.
+type fileWatchStatus struct {
+	mu         sync.Mutex
+	active     bool
+	lastReload time.Time
+	lastError  string
+}
+
+// FileWatchStatus is the JSON representation of a file watcher's health.
+type FileWatchStatus struct {
+	Active     bool       `json:"active"`
+	LastReload *time.Time `json:"last_reload,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// GeoIPDatabaseStatus describes a loaded GeoIP database.
+type GeoIPDatabaseStatus struct {
+	DatabaseType string    `json:"database_type"`
+	BuildDate    time.Time `json:"build_date"`
+	AgeDays      int       `json:"age_days"`
+}
+
+// TorStatus describes the freshness of the Tor exit node list.
+type TorStatus struct {
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+	AgeSeconds  int64      `json:"age_seconds,omitempty"`
+	Stale       bool       `json:"stale"`
+}
+
+// WAFStatus is the response of the status endpoint.
+type WAFStatus struct {
+	Status            string                         `json:"status"` // ok or degraded
+	Problems          []string                       `json:"problems,omitempty"`
+	Version           string                         `json:"version"`
+	RulesByPhase      map[string]int                 `json:"rules_by_phase"`
+	IPBlacklistSize   int64                          `json:"ip_blacklist_entries"`
+	IPBlacklistLoad   *IPBlacklistLoadStats          `json:"ip_blacklist_load,omitempty"`
+	DNSBlacklistSize  int                            `json:"dns_blacklist_entries"`
+	PathBlacklistSize int                            `json:"path_blacklist_entries"`
+	CertBlacklistSize int                            `json:"cert_blacklist_entries"`
+	GeoIPDatabases    map[string]GeoIPDatabaseStatus `json:"geoip_databases,omitempty"`
+	GeoIPUpdates      map[string]GeoIPUpdateStatus   `json:"geoip_updates,omitempty"`
+	Tor               *TorStatus                     `json:"tor,omitempty"`
+	Lockdown          *LockdownStatus                `json:"lockdown,omitempty"`
+	FileWatchers      map[string]FileWatchStatus     `json:"file_watchers"`
+	LogQueueDepth     int                            `json:"log_queue_depth"`
+	LogQueueCapacity  int                            `json:"log_queue_capacity"`
+	LogDropped        int64                          `json:"log_dropped_events"`
+}
+
+// watchStatus returns the health record of a watched file, creating it if needed.
+func (m *Middleware) watchStatus(path string) *fileWatchStatus {
+	s, _ := m.fileWatchers.LoadOrStore(path, &fileWatchStatus{})
+	return s.(*fileWatchStatus)
+}
+
+// recordWatch updates the health record of a watched file.
+func (m *Middleware) recordWatch(path string, active bool, reloaded bool, err error) {
+	s := m.watchStatus(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = active
+	if reloaded {
+		s.lastReload = time.Now()
+	}
+	if err != nil {
+		s.lastError = err.Error()
+	} else if reloaded {
+		s.lastError = ""
+	}
+}
+
+// geoIPDatabaseStatus returns the metadata of a loaded GeoIP database.
+func geoIPDatabaseStatus(reader *maxminddb.Reader, now time.Time) GeoIPDatabaseStatus {
+	built := time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()
+	return GeoIPDatabaseStatus{
+		DatabaseType: reader.Metadata.DatabaseType,
+		BuildDate:    built,
+		AgeDays:      int(now.Sub(built).Hours() / 24),
+	}
+}
+
+// collectStatus gathers the health of the WAF's components.
+func (m *Middleware) collectStatus(now time.Time) WAFStatus {
+	status := WAFStatus{
+		Status:       "ok",
+		Version:      wafVersion,
+		RulesByPhase: make(map[string]int),
+		FileWatchers: make(map[string]FileWatchStatus),
+	}
+
+	m.mu.RLock()
+	for phase := 1; phase <= 4; phase++ {
+		status.RulesByPhase[strconv.Itoa(phase)] = len(m.Rules[phase])
+	}
+	status.DNSBlacklistSize = len(m.dnsBlacklist)
+	if m.dnsBlacklistIndex != nil {
+		status.DNSBlacklistSize = m.dnsBlacklistIndex.Len()
+	}
+	if m.pathBlacklist != nil {
+		status.PathBlacklistSize = m.pathBlacklist.Len()
+	}
+	status.CertBlacklistSize = len(m.certBlacklist)
+	m.mu.RUnlock()
+	status.IPBlacklistSize = m.ipBlacklistEntries.Load()
+	status.IPBlacklistLoad = m.ipBlacklistLoad.Load()
+
+	blacklistGeoIP, whitelistGeoIP := m.CountryBlacklist.geoIP.Load(), m.CountryWhitelist.geoIP.Load()
+	if blacklistGeoIP != nil || whitelistGeoIP != nil {
+		status.GeoIPDatabases = make(map[string]GeoIPDatabaseStatus)
+		if blacklistGeoIP != nil {
+			status.GeoIPDatabases["country_block"] = geoIPDatabaseStatus(blacklistGeoIP, now)
+		}
+		if whitelistGeoIP != nil {
+			status.GeoIPDatabases["country_whitelist"] = geoIPDatabaseStatus(whitelistGeoIP, now)
+		}
+	}
+
+	if m.geoIPUpdater != nil {
+		status.GeoIPUpdates = m.geoIPUpdater.Status()
+		for edition, s := range status.GeoIPUpdates {
+			if m.geoIPUpdater.stale(s, now) {
+				status.Problems = append(status.Problems, "geoip database "+edition+" updates are failing")
+			}
+		}
+	}
+
+	if m.Tor.Enabled {
+		status.Tor = &TorStatus{Stale: true}
+		if !m.Tor.lastUpdated.IsZero() {
+			lastUpdated := m.Tor.lastUpdated
+			status.Tor.LastUpdated = &lastUpdated
+			status.Tor.AgeSeconds = int64(now.Sub(lastUpdated).Seconds())
+			interval, err := time.ParseDuration(m.Tor.UpdateInterval)
+			status.Tor.Stale = err == nil && now.Sub(lastUpdated) > 2*interval
+		}
+		if status.Tor.Stale {
+			status.Problems = append(status.Problems, "tor exit node list is stale")
+		}
+	}
+
+	if m.Lockdown != nil {
+		lockdown := m.Lockdown.Status()
+		status.Lockdown = &lockdown
+	}
+
+	m.fileWatchers.Range(func(key, value interface{}) bool {
+		s := value.(*fileWatchStatus)
+		s.mu.Lock()
+		ws := FileWatchStatus{Active: s.active, LastError: s.lastError}
+		if !s.lastReload.IsZero() {
+			lastReload := s.lastReload
+			ws.LastReload = &lastReload
+		}
+		s.mu.Unlock()
+		status.FileWatchers[key.(string)] = ws
+		if !ws.Active {
+			status.Problems = append(status.Problems, "file watcher for "+key.(string)+" is not running")
+		}
+		return true
+	})
+
+	if m.logChan != nil {
+		status.LogQueueDepth = len(m.logChan)
+		status.LogQueueCapacity = cap(m.logChan)
+		status.LogDropped = m.LogDropped()
+		if status.LogQueueCapacity > 0 && float64(status.LogQueueDepth) >= logQueueDegradedRatio*float64(status.LogQueueCapacity) {
+			status.Problems = append(status.Problems, "log queue is almost full")
+		}
+	}
+
+	if len(status.Problems) > 0 {
+		status.Status = "degraded"
+	}
+	return status
+}
+
+// handleStatusRequest reports the health of the WAF. Degraded components yield a 503 for readiness probes.
+func (m *Middleware) handleStatusRequest(w http.ResponseWriter, r *http.Request) error {
+	status := m.collectStatus(time.Now())
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	return writeJSON(w, code, status)
+}
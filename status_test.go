@@ -0,0 +1,67 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCollectStatus(t *testing.T) {
+	m := &Middleware{
+		logger: zap.NewNop(),
+		Rules: map[int][]Rule{
+			1: {{ID: "a"}, {ID: "b"}},
+			2: {{ID: "c"}},
+		},
+		dnsBlacklist: map[string]struct{}{"evil.com": {}},
+		logChan:      make(chan LogEntry, 10),
+	}
+	m.ipBlacklistEntries.Store(3)
+	m.recordWatch("rules.json", true, true, nil)
+
+	status := m.collectStatus(time.Now())
+	assert.Equal(t, "ok", status.Status)
+	assert.Equal(t, map[string]int{"1": 2, "2": 1, "3": 0, "4": 0}, status.RulesByPhase)
+	assert.Equal(t, int64(3), status.IPBlacklistSize)
+	assert.Equal(t, 1, status.DNSBlacklistSize)
+	assert.Equal(t, 10, status.LogQueueCapacity)
+	assert.True(t, status.FileWatchers["rules.json"].Active)
+	assert.NotNil(t, status.FileWatchers["rules.json"].LastReload)
+}
+
+func TestCollectStatus_Degraded(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), logChan: make(chan LogEntry, 2)}
+	m.recordWatch("blacklist.txt", false, false, errors.New("too many open files"))
+	m.logChan <- LogEntry{}
+	m.logChan <- LogEntry{}
+	m.Tor = TorConfig{Enabled: true, UpdateInterval: "1h", lastUpdated: time.Now().Add(-3 * time.Hour)}
+
+	status := m.collectStatus(time.Now())
+	assert.Equal(t, "degraded", status.Status)
+	assert.Len(t, status.Problems, 3)
+	assert.Equal(t, "too many open files", status.FileWatchers["blacklist.txt"].LastError)
+	assert.True(t, status.Tor.Stale)
+}
+
+func TestHandleStatusRequest(t *testing.T) {
+	m := newAPITestMiddleware()
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/status", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var status WAFStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, wafVersion, status.Version)
+
+	m.recordWatch("rules.json", false, false, errors.New("watch failed"))
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/status", nil)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,165 @@
+package caddywaf
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	maxTenants     = 1000    // Hosts beyond this limit share the overflow tenant
+	overflowTenant = "other" // Tenant key for hosts beyond maxTenants
+)
+
+// tenantCounters are the request counters of a single tenant.
+type tenantCounters struct {
+	total    atomic.Int64
+	blocked  atomic.Int64
+	allowed  atomic.Int64
+	ruleHits sync.Map // Rule ID -> *atomic.Int64
+}
+
+// TenantMetrics is the JSON representation of a tenant's counters.
+type TenantMetrics struct {
+	TotalRequests   int64            `json:"total_requests"`
+	BlockedRequests int64            `json:"blocked_requests"`
+	AllowedRequests int64            `json:"allowed_requests"`
+	RuleHits        map[string]int64 `json:"rule_hits"`
+}
+
+// TenantRegistry keeps per-host state for multi-tenant operation.
+type TenantRegistry struct {
+	mu       sync.RWMutex
+	tenants  map[string]*tenantCounters
+	reserved map[string]struct{} // Configured hosts that are tenants even beyond maxTenants
+}
+
+// NewTenantRegistry creates an empty TenantRegistry. Reserved hosts always get
+// their own tenant, the others only while fewer than maxTenants are known.
+func NewTenantRegistry(reserved ...string) *TenantRegistry {
+	tr := &TenantRegistry{
+		tenants:  make(map[string]*tenantCounters),
+		reserved: make(map[string]struct{}, len(reserved)),
+	}
+	for _, host := range reserved {
+		tr.reserved[tenantHost(host)] = struct{}{}
+	}
+	return tr
+}
+
+// tenantHost normalizes a request host into a tenant key: lowercase, without port.
+func tenantHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return overflowTenant
+	}
+	return host
+}
+
+// admit returns the key and counters of a tenant, creating them if the tenant is
+// reserved or the tenant limit allows, and falling back to overflowTenant otherwise.
+func (tr *TenantRegistry) admit(tenant string) (string, *tenantCounters) {
+	tr.mu.RLock()
+	c, ok := tr.tenants[tenant]
+	tr.mu.RUnlock()
+	if ok {
+		return tenant, c
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if c, ok := tr.tenants[tenant]; ok {
+		return tenant, c
+	}
+	if _, reserved := tr.reserved[tenant]; !reserved && len(tr.tenants) >= maxTenants {
+		tenant = overflowTenant
+		if c, ok := tr.tenants[tenant]; ok {
+			return tenant, c
+		}
+	}
+	c = &tenantCounters{}
+	tr.tenants[tenant] = c
+	return tenant, c
+}
+
+// resolve returns the tenant key for a host: the host itself while it fits in
+// the registry, overflowTenant once maxTenants hosts are known.
+func (tr *TenantRegistry) resolve(host string) string {
+	tenant, _ := tr.admit(host)
+	return tenant
+}
+
+// Record counts a finished request and its matched rules for a tenant.
+func (tr *TenantRegistry) Record(tenant string, blocked bool, matchedRules []string) {
+	_, c := tr.admit(tenant)
+	c.total.Add(1)
+	if blocked {
+		c.blocked.Add(1)
+	} else {
+		c.allowed.Add(1)
+	}
+	for _, ruleID := range matchedRules {
+		hits, _ := c.ruleHits.LoadOrStore(ruleID, new(atomic.Int64))
+		hits.(*atomic.Int64).Add(1)
+	}
+}
+
+// Metrics returns the counters of all tenants keyed by host.
+func (tr *TenantRegistry) Metrics() map[string]TenantMetrics {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	metrics := make(map[string]TenantMetrics, len(tr.tenants))
+	for tenant, c := range tr.tenants {
+		tm := TenantMetrics{
+			TotalRequests:   c.total.Load(),
+			BlockedRequests: c.blocked.Load(),
+			AllowedRequests: c.allowed.Load(),
+			RuleHits:        make(map[string]int64),
+		}
+		c.ruleHits.Range(func(key, value interface{}) bool {
+			tm.RuleHits[key.(string)] = value.(*atomic.Int64).Load()
+			return true
+		})
+		metrics[tenant] = tm
+	}
+	return metrics
+}
+
+// Reset drops all tenant counters.
+func (tr *TenantRegistry) Reset() {
+	tr.mu.Lock()
+	tr.tenants = make(map[string]*tenantCounters)
+	tr.mu.Unlock()
+}
+
+// tenantKey returns the tenant of a request, or an empty string when multi-tenancy is disabled.
+// Hosts beyond the registry's limit share overflowTenant, so arbitrary Host headers
+// can't grow the per-tenant state without bound.
+func (m *Middleware) tenantKey(r *http.Request) string {
+	if !m.TenantByHost || m.tenants == nil {
+		return ""
+	}
+	return m.tenants.resolve(tenantHost(r.Host))
+}
+
+// scopedKey prefixes a per-client key with the request's tenant so state such as
+// rate-limit buckets is not shared between hosts.
+func (m *Middleware) scopedKey(r *http.Request, key string) string {
+	if tenant := m.tenantKey(r); tenant != "" {
+		return tenant + "|" + key
+	}
+	return key
+}
+
+// recordTenantRequest counts a finished request for its tenant.
+func (m *Middleware) recordTenantRequest(r *http.Request, state *WAFState) {
+	if m.tenants == nil {
+		return
+	}
+	m.tenants.Record(m.tenantKey(r), state.Blocked, state.MatchedRules)
+}
@@ -0,0 +1,113 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTenantHost(t *testing.T) {
+	assert.Equal(t, "example.com", tenantHost("Example.COM:8443"))
+	assert.Equal(t, "example.com", tenantHost("example.com."))
+	assert.Equal(t, "::1", tenantHost("[::1]:443"))
+	assert.Equal(t, overflowTenant, tenantHost(""))
+}
+
+func TestTenantRegistry_Record(t *testing.T) {
+	tr := NewTenantRegistry()
+	tr.Record("a.example.com", true, []string{"sqli", "xss"})
+	tr.Record("a.example.com", false, nil)
+	tr.Record("b.example.com", false, []string{"sqli"})
+
+	metrics := tr.Metrics()
+	assert.Equal(t, TenantMetrics{
+		TotalRequests: 2, BlockedRequests: 1, AllowedRequests: 1,
+		RuleHits: map[string]int64{"sqli": 1, "xss": 1},
+	}, metrics["a.example.com"])
+	assert.Equal(t, int64(1), metrics["b.example.com"].TotalRequests)
+
+	tr.Reset()
+	assert.Empty(t, tr.Metrics())
+}
+
+func TestTenantRegistry_Overflow(t *testing.T) {
+	tr := NewTenantRegistry()
+	for i := 0; i < maxTenants; i++ {
+		tr.Record(string(rune('a'+i%26))+time.Duration(i).String(), false, nil)
+	}
+	tr.Record("one-too-many.example.com", false, nil)
+
+	metrics := tr.Metrics()
+	assert.NotContains(t, metrics, "one-too-many.example.com")
+	assert.Equal(t, int64(1), metrics[overflowTenant].TotalRequests)
+}
+
+func TestScopedKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://api.example.com/", nil)
+
+	m := &Middleware{}
+	assert.Equal(t, "1.2.3.4", m.scopedKey(r, "1.2.3.4"))
+
+	m.TenantByHost = true
+	m.tenants = NewTenantRegistry()
+	assert.Equal(t, "api.example.com|1.2.3.4", m.scopedKey(r, "1.2.3.4"))
+}
+
+func TestScopedKey_Overflow(t *testing.T) {
+	m := &Middleware{TenantByHost: true, tenants: NewTenantRegistry("shop.example.com")}
+	for i := 0; i < maxTenants; i++ {
+		m.tenants.Record(fmt.Sprintf("host%d.example.com", i), false, nil)
+	}
+
+	r := httptest.NewRequest("GET", "http://random.example.com/", nil)
+	assert.Equal(t, overflowTenant+"|1.2.3.4", m.scopedKey(r, "1.2.3.4"), "unknown hosts share the overflow tenant")
+
+	r = httptest.NewRequest("GET", "http://host7.example.com/", nil)
+	assert.Equal(t, "host7.example.com|1.2.3.4", m.scopedKey(r, "1.2.3.4"))
+
+	r = httptest.NewRequest("GET", "http://Shop.Example.com:8443/", nil)
+	assert.Equal(t, "shop.example.com|1.2.3.4", m.scopedKey(r, "1.2.3.4"), "overlay hosts are always tenants")
+}
+
+func TestRateLimit_PerTenant(t *testing.T) {
+	rl, err := NewRateLimiter(RateLimit{Requests: 1, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+	assert.NoError(t, err)
+
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		rateLimiter:           rl,
+		TenantByHost:          true,
+		tenants:               NewTenantRegistry(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           iptrie.NewTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+	}
+
+	send := func(host string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		state := m.initializeWAFState()
+		m.handlePhase(w, req, 1, state)
+		m.recordTenantRequest(req, state)
+		if state.Blocked {
+			return state.StatusCode
+		}
+		return http.StatusOK
+	}
+
+	assert.Equal(t, http.StatusOK, send("a.example.com"))
+	assert.Equal(t, http.StatusTooManyRequests, send("a.example.com"))
+	assert.Equal(t, http.StatusOK, send("b.example.com"), "another tenant has its own bucket")
+
+	metrics := m.tenants.Metrics()
+	assert.Equal(t, int64(1), metrics["a.example.com"].BlockedRequests)
+	assert.Equal(t, int64(0), metrics["b.example.com"].BlockedRequests)
+}
@@ -0,0 +1,93 @@
+package caddywaf
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Attributes of the TLS connection exposed as TLS:<attribute> targets
+const (
+	TLSVersion = "VERSION" // Such as TLS 1.3
+	TLSCipher  = "CIPHER"  // Such as TLS_AES_128_GCM_SHA256
+	TLSSNI     = "SNI"     // Server name sent by the client
+	TLSALPN    = "ALPN"    // Negotiated application protocol, such as h2
+	TLSResumed = "RESUMED" // true for a resumed session
+
+	// Attributes of the client certificate, with mutual TLS
+	TLSClientSubject     = "CLIENT_SUBJECT"     // Distinguished name, such as CN=alice,O=Example
+	TLSClientIssuer      = "CLIENT_ISSUER"      // Distinguished name of the issuing CA
+	TLSClientSANs        = "CLIENT_SANS"        // Subject alternative names, comma-separated
+	TLSClientFingerprint = "CLIENT_FINGERPRINT" // SHA-256 of the DER certificate, lowercase hex
+)
+
+// tlsAttribute returns an attribute of the TLS connection of a request, empty for requests
+// not over TLS.
+func tlsAttribute(r *http.Request, name string) (string, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	switch name {
+	case TLSVersion, TLSCipher, TLSSNI, TLSALPN, TLSResumed:
+	case TLSClientSubject, TLSClientIssuer, TLSClientSANs, TLSClientFingerprint:
+		return clientCertAttribute(clientCertificate(r), name), nil
+	default:
+		return "", fmt.Errorf("unknown TLS attribute: %s", name)
+	}
+	state := r.TLS
+	if state == nil {
+		return "", nil
+	}
+	switch name {
+	case TLSVersion:
+		return tls.VersionName(state.Version), nil
+	case TLSCipher:
+		return tls.CipherSuiteName(state.CipherSuite), nil
+	case TLSSNI:
+		return state.ServerName, nil
+	case TLSALPN:
+		return state.NegotiatedProtocol, nil
+	}
+	return strconv.FormatBool(state.DidResume), nil
+}
+
+// clientCertificate returns the certificate the client authenticated with, or nil.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// clientCertAttribute returns an attribute of a client certificate, empty without one.
+func clientCertAttribute(cert *x509.Certificate, name string) string {
+	if cert == nil {
+		return ""
+	}
+	switch name {
+	case TLSClientSubject:
+		return cert.Subject.String()
+	case TLSClientIssuer:
+		return cert.Issuer.String()
+	case TLSClientSANs:
+		sans := append([]string{}, cert.DNSNames...)
+		sans = append(sans, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+		return strings.Join(sans, ",")
+	}
+	return certFingerprint(cert)
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a certificate, in lowercase hex.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
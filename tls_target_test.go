@@ -0,0 +1,117 @@
+package caddywaf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTLSAttribute(t *testing.T) {
+	r := httptest.NewRequest("GET", "https://api.example.com/", nil)
+	r.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS10,
+		CipherSuite:        tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		ServerName:         "api.example.com",
+		NegotiatedProtocol: "http/1.1",
+		DidResume:          true,
+	}
+	for name, expected := range map[string]string{
+		"VERSION": "TLS 1.0",
+		"cipher":  "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+		"SNI":     "api.example.com",
+		"ALPN":    "http/1.1",
+		"RESUMED": "true",
+	} {
+		value, err := tlsAttribute(r, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, value, name)
+	}
+	_, err := tlsAttribute(r, "JA3")
+	assert.Error(t, err)
+
+	value, err := tlsAttribute(httptest.NewRequest("GET", "/", nil), TLSVersion)
+	assert.NoError(t, err)
+	assert.Empty(t, value, "plain HTTP")
+}
+
+func TestExtractValue_TLS(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, NegotiatedProtocol: "h2"}
+
+	value, err := rve.ExtractValue("TLS:VERSION", r, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "TLS 1.3", value)
+	value, err = rve.ExtractValue("tls:alpn", r, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "h2", value)
+	_, err = rve.ExtractValue("TLS:UNKNOWN", r, nil)
+	assert.Error(t, err)
+}
+
+func TestHandlePhase_TLSVersionRule(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	rule := Rule{ID: "legacy-tls-api", Phase: 1, Pattern: `^(SSL 3\.0|TLS 1\.[01])$`, Targets: []string{"TLS:VERSION"}, Score: 10, Action: "block"}
+	m.compileRule(&rule)
+	m.Rules = map[int][]Rule{1: {rule}}
+
+	r := testRequest("GET", "/api/users", "", "")
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS10}
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	m.handlePhase(w, r, 1, state)
+	assert.True(t, state.Blocked)
+
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS12}
+	state = &WAFState{}
+	m.handlePhase(httptest.NewRecorder(), r, 1, state)
+	assert.False(t, state.Blocked)
+}
+
+func TestConditionHolds_TLSSNI(t *testing.T) {
+	m := conditionMiddleware()
+	program, err := compileRuleCondition(`target("TLS:SNI") != "" && target("TLS:SNI") != request.host.split(":")[0].lowerAscii()`)
+	assert.NoError(t, err)
+	rule := &Rule{ID: "c1", Phase: 1, condition: program}
+
+	r := httptest.NewRequest("GET", "https://App.example.com:8443/", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "app.example.com"}
+	assert.False(t, m.conditionHolds(rule, httptest.NewRecorder(), r, &WAFState{}))
+	r.Host = "admin.internal"
+	assert.True(t, m.conditionHolds(rule, httptest.NewRecorder(), r, &WAFState{}), "fronted domain")
+}
+
+func TestTLSAttribute_ClientCertificate(t *testing.T) {
+	cert := testClientCertificate(t, "alice")
+	r := httptest.NewRequest("GET", "https://api.example.com/", nil)
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: []*x509.Certificate{cert}}
+	for name, expected := range map[string]string{
+		"CLIENT_SUBJECT":     "CN=alice,O=Example",
+		"client_issuer":      "CN=alice,O=Example",
+		"CLIENT_SANS":        "billing.example.com,billing@example.com,10.0.0.7,spiffe://example.com/billing",
+		"CLIENT_FINGERPRINT": certFingerprint(cert),
+	} {
+		value, err := tlsAttribute(r, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, value, name)
+	}
+	assert.Len(t, certFingerprint(cert), 64)
+
+	r.TLS.PeerCertificates = nil
+	value, err := tlsAttribute(r, TLSClientSubject)
+	assert.NoError(t, err)
+	assert.Empty(t, value, "no client certificate")
+	value, err = tlsAttribute(httptest.NewRequest("GET", "/", nil), TLSClientFingerprint)
+	assert.NoError(t, err)
+	assert.Empty(t, value, "plain HTTP")
+}
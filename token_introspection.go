@@ -0,0 +1,172 @@
+package caddywaf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultIntrospectionTimeout   = time.Second
+	defaultIntrospectionCacheTTL  = time.Minute
+	defaultIntrospectionCacheSize = 10000
+	maxIntrospectionResponseSize  = 1 << 20
+)
+
+// TokenIntrospectionConfig validates the bearer tokens of requests with the introspection
+// endpoint of an OAuth2 authorization server (RFC 7662), exposing whether they are active,
+// their scope and their client ID to rules.
+type TokenIntrospectionConfig struct {
+	Endpoint     string        `json:"endpoint"`                // Introspection endpoint URL
+	ClientID     string        `json:"client_id,omitempty"`     // Client authenticating to the endpoint with basic auth
+	ClientSecret string        `json:"client_secret,omitempty"` // Secret of the client
+	Timeout      time.Duration `json:"timeout,omitempty"`       // Time allowed for an introspection, default 1s
+	CacheTTL     time.Duration `json:"cache_ttl,omitempty"`     // How long answers are cached, default 1m
+	CacheSize    int           `json:"cache_size,omitempty"`    // Answers cached at most, default 10000
+
+	logger *zap.Logger
+	client *http.Client
+	cache  *lookupCache[tokenIntrospection]
+}
+
+// tokenIntrospection is the part of an introspection response exposed to rules.
+type tokenIntrospection struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope,omitempty"`     // Space-separated scopes
+	ClientID string `json:"client_id,omitempty"` // Client the token was issued to
+	Exp      int64  `json:"exp,omitempty"`       // Expiry in Unix seconds
+}
+
+// provision validates the config and applies the defaults.
+func (c *TokenIntrospectionConfig) provision(logger *zap.Logger) error {
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid token_introspection endpoint: %s", c.Endpoint)
+	}
+	if c.ClientSecret != "" && c.ClientID == "" {
+		return fmt.Errorf("token_introspection client_secret requires a client_id")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultIntrospectionTimeout
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = defaultIntrospectionCacheTTL
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = defaultIntrospectionCacheSize
+	}
+	c.logger = logger
+	c.client = &http.Client{} // Introspections are bounded by the context deadline
+	c.cache = newLookupCache[tokenIntrospection](c.CacheSize, c.CacheTTL)
+	return nil
+}
+
+// introspect asks the authorization server about token. Answers are cached by a hash of
+// the token, so tokens aren't kept in memory, and tokens past their expiry are reported
+// inactive even when cached as active. It reports whether the server answered.
+func (c *TokenIntrospectionConfig) introspect(ctx context.Context, token string) (tokenIntrospection, bool) {
+	digest := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(digest[:])
+	result, ok := c.cache.Get(key)
+	if !ok {
+		var err error
+		if result, err = c.fetch(ctx, token); err != nil {
+			c.logger.Warn("Token introspection failed", zap.String("endpoint", c.Endpoint), zap.Error(err))
+			return tokenIntrospection{}, false
+		}
+		c.cache.Set(key, result)
+	}
+	if result.Active && result.Exp > 0 && time.Now().Unix() >= result.Exp {
+		result.Active = false
+	}
+	return result, true
+}
+
+// fetch posts token to the introspection endpoint.
+func (c *TokenIntrospectionConfig) fetch(ctx context.Context, token string) (tokenIntrospection, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenIntrospection{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return tokenIntrospection{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tokenIntrospection{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var result tokenIntrospection
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionResponseSize)).Decode(&result); err != nil {
+		return tokenIntrospection{}, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	return result, nil
+}
+
+// bearerToken returns the bearer token of the Authorization header of a request.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// introspectionTargets memoizes the TOKEN_ACTIVE, TOKEN_SCOPE and TOKEN_CLIENT_ID targets
+// of a request. They are all empty for requests without a bearer token, or whose token
+// the server didn't answer about.
+func (m *Middleware) introspectionTargets(r *http.Request, state *WAFState) {
+	if state.targets == nil {
+		state.targets = make(map[string]extractedTarget)
+	}
+	var active string
+	var result tokenIntrospection
+	if token := bearerToken(r); token != "" {
+		var ok bool
+		if result, ok = m.TokenIntrospection.introspect(r.Context(), token); ok {
+			active = strconv.FormatBool(result.Active)
+		}
+	}
+	if !result.Active {
+		result = tokenIntrospection{} // The claims of inactive tokens aren't trusted
+	}
+	state.targets[TargetTokenActive] = extractedTarget{value: active}
+	state.targets[TargetTokenScope] = extractedTarget{value: result.Scope}
+	state.targets[TargetTokenClientID] = extractedTarget{value: result.ClientID}
+}
+
+// introspectionTarget returns the value of the TOKEN_ACTIVE, TOKEN_SCOPE and
+// TOKEN_CLIENT_ID targets, empty without the token_introspection directive, reporting
+// whether target is one of them.
+func (m *Middleware) introspectionTarget(target string, r *http.Request, state *WAFState) (string, bool) {
+	target = strings.ToUpper(target)
+	switch target {
+	case TargetTokenActive, TargetTokenScope, TargetTokenClientID:
+	default:
+		return "", false
+	}
+	if m.TokenIntrospection == nil || m.TokenIntrospection.cache == nil {
+		return "", true
+	}
+	if _, ok := state.targets[target]; !ok {
+		m.introspectionTargets(r, state)
+	}
+	return state.targets[target].value, true
+}
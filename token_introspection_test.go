@@ -0,0 +1,105 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newIntrospectionServer answers for the tokens it knows, counting the introspections.
+func newIntrospectionServer(t *testing.T, tokens map[string]tokenIntrospection) (*httptest.Server, *atomic.Int64) {
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "waf" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "access_token", r.PostFormValue("token_type_hint"))
+		json.NewEncoder(w).Encode(tokens[r.PostFormValue("token")])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestTokenIntrospectionConfig_Introspect(t *testing.T) {
+	expired := time.Now().Add(-time.Minute).Unix()
+	server, calls := newIntrospectionServer(t, map[string]tokenIntrospection{
+		"good":    {Active: true, Scope: "read write", ClientID: "mobile-app"},
+		"expired": {Active: true, Scope: "read", Exp: expired},
+	})
+	config := &TokenIntrospectionConfig{Endpoint: server.URL, ClientID: "waf", ClientSecret: "s3cret"}
+	require.NoError(t, config.provision(zap.NewNop()))
+
+	result, ok := config.introspect(context.Background(), "good")
+	require.True(t, ok)
+	assert.Equal(t, tokenIntrospection{Active: true, Scope: "read write", ClientID: "mobile-app"}, result)
+	_, ok = config.introspect(context.Background(), "good")
+	require.True(t, ok)
+	assert.Equal(t, int64(1), calls.Load(), "answers are cached")
+
+	result, ok = config.introspect(context.Background(), "revoked")
+	require.True(t, ok)
+	assert.False(t, result.Active)
+	result, ok = config.introspect(context.Background(), "expired")
+	require.True(t, ok)
+	assert.False(t, result.Active, "past its exp")
+
+	config = &TokenIntrospectionConfig{Endpoint: server.URL, ClientID: "waf", ClientSecret: "wrong"}
+	require.NoError(t, config.provision(zap.NewNop()))
+	_, ok = config.introspect(context.Background(), "good")
+	assert.False(t, ok)
+	_, ok = config.introspect(context.Background(), "good")
+	assert.False(t, ok)
+	assert.Equal(t, int64(5), calls.Load(), "failures are not cached")
+
+	for _, config := range []*TokenIntrospectionConfig{
+		{},
+		{Endpoint: "auth.example.com/introspect"},
+		{Endpoint: "ftp://auth.example.com/introspect"},
+		{Endpoint: "https://auth.example.com/introspect", ClientSecret: "s3cret"},
+	} {
+		assert.Error(t, config.provision(zap.NewNop()), "%+v", config)
+	}
+}
+
+func TestIntrospectionTarget(t *testing.T) {
+	server, calls := newIntrospectionServer(t, map[string]tokenIntrospection{
+		"good":    {Active: true, Scope: "read", ClientID: "mobile-app"},
+		"revoked": {Active: false, Scope: "admin", ClientID: "mobile-app"},
+	})
+	config := &TokenIntrospectionConfig{Endpoint: server.URL, ClientID: "waf", ClientSecret: "s3cret"}
+	require.NoError(t, config.provision(zap.NewNop()))
+	m := &Middleware{logger: zap.NewNop(), TokenIntrospection: config}
+
+	targets := func(authorization string) []string {
+		req := httptest.NewRequest("GET", "/api/orders", nil)
+		req.Header.Set("Authorization", authorization)
+		state := &WAFState{}
+		var values []string
+		for _, target := range []string{"TOKEN_ACTIVE", "token_scope", "TOKEN_CLIENT_ID"} {
+			value, err := m.extractTarget(target, req, nil, state)
+			require.NoError(t, err)
+			values = append(values, value)
+		}
+		return values
+	}
+	assert.Equal(t, []string{"true", "read", "mobile-app"}, targets("Bearer good"))
+	assert.Equal(t, []string{"true", "read", "mobile-app"}, targets("bearer good"))
+	assert.Equal(t, []string{"false", "", ""}, targets("Bearer revoked"), "the claims of inactive tokens are dropped")
+	assert.Equal(t, []string{"", "", ""}, targets(""))
+	assert.Equal(t, []string{"", "", ""}, targets("Basic d2FmOnMzY3JldA=="))
+	assert.Equal(t, int64(2), calls.Load(), "one introspection per token")
+
+	value, err := (&Middleware{}).extractTarget("TOKEN_SCOPE", httptest.NewRequest("GET", "/", nil), nil, &WAFState{})
+	require.NoError(t, err)
+	assert.Empty(t, value, "without token_introspection")
+}
@@ -0,0 +1,132 @@
+package caddywaf
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	offenderBucketWidth   = time.Minute
+	offenderBucketCount   = 60 // Longest queryable window is one hour
+	defaultOffenderWindow = 15 * time.Minute
+	defaultOffenderTopN   = 10
+)
+
+// offenderBucket holds the counts of one minute of block events.
+type offenderBucket struct {
+	minute    int64
+	ips       map[string]int
+	rules     map[string]int
+	paths     map[string]int
+	countries map[string]int
+}
+
+// TopOffenders is the response of the top endpoint.
+type TopOffenders struct {
+	Window    string     `json:"window"`
+	Blocked   int        `json:"blocked"`
+	IPs       []keyCount `json:"ips"`
+	Rules     []keyCount `json:"rules"`
+	Paths     []keyCount `json:"paths"`
+	Countries []keyCount `json:"countries"`
+}
+
+// OffenderTracker counts block events per source IP, rule, path and country in one-minute buckets.
+type OffenderTracker struct {
+	mu      sync.Mutex
+	buckets [offenderBucketCount]offenderBucket
+}
+
+// NewOffenderTracker creates an empty OffenderTracker.
+func NewOffenderTracker() *OffenderTracker {
+	return &OffenderTracker{}
+}
+
+// Record counts a block event.
+func (ot *OffenderTracker) Record(ev BlockEvent) {
+	minute := ev.Timestamp.Unix() / int64(offenderBucketWidth/time.Second)
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	b := &ot.buckets[minute%offenderBucketCount]
+	if b.minute != minute || b.ips == nil {
+		*b = offenderBucket{
+			minute:    minute,
+			ips:       make(map[string]int),
+			rules:     make(map[string]int),
+			paths:     make(map[string]int),
+			countries: make(map[string]int),
+		}
+	}
+	b.ips[ev.ClientIP]++
+	if ev.RuleID != "" {
+		b.rules[ev.RuleID]++
+	}
+	b.paths[ev.Path]++
+	if ev.Country != "" {
+		b.countries[ev.Country]++
+	}
+}
+
+// Top returns the n most frequent offenders of each kind within window before now.
+func (ot *OffenderTracker) Top(now time.Time, window time.Duration, n int) TopOffenders {
+	current := now.Unix() / int64(offenderBucketWidth/time.Second)
+	oldest := current - int64(window/offenderBucketWidth)
+	ips := make(map[string]int)
+	rules := make(map[string]int)
+	paths := make(map[string]int)
+	countries := make(map[string]int)
+	blocked := 0
+
+	ot.mu.Lock()
+	for i := range ot.buckets {
+		b := &ot.buckets[i]
+		if b.ips == nil || b.minute <= oldest || b.minute > current {
+			continue
+		}
+		for k, c := range b.ips {
+			ips[k] += c
+			blocked += c
+		}
+		mergeCounts(rules, b.rules)
+		mergeCounts(paths, b.paths)
+		mergeCounts(countries, b.countries)
+	}
+	ot.mu.Unlock()
+
+	return TopOffenders{
+		Window:    window.String(),
+		Blocked:   blocked,
+		IPs:       topCounts(ips, n),
+		Rules:     topCounts(rules, n),
+		Paths:     topCounts(paths, n),
+		Countries: topCounts(countries, n),
+	}
+}
+
+// mergeCounts adds the counts of src to dst.
+func mergeCounts(dst, src map[string]int) {
+	for k, c := range src {
+		dst[k] += c
+	}
+}
+
+// handleTopRequest returns the top offenders over a rolling window.
+func (m *Middleware) handleTopRequest(w http.ResponseWriter, r *http.Request) error {
+	if m.offenderTracker == nil {
+		return writeJSONError(w, http.StatusConflict, "top offender tracking is not enabled")
+	}
+	window := defaultOffenderWindow
+	if value := r.URL.Query().Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < offenderBucketWidth || d > offenderBucketWidth*offenderBucketCount {
+			return writeJSONError(w, http.StatusBadRequest, "window must be a duration between 1m and 1h")
+		}
+		window = d
+	}
+	top := m.offenderTracker.Top(time.Now(), window, queryInt(r, "limit", defaultOffenderTopN))
+	m.logger.Debug("Serving top offenders", zap.String("window", top.Window), zap.Int("blocked", top.Blocked))
+	return writeJSON(w, http.StatusOK, top)
+}
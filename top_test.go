@@ -0,0 +1,72 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOffenderTracker_Top(t *testing.T) {
+	ot := NewOffenderTracker()
+	now := time.Now()
+
+	ot.Record(BlockEvent{Timestamp: now, ClientIP: "1.1.1.1", RuleID: "sqli", Path: "/login", Country: "RU"})
+	ot.Record(BlockEvent{Timestamp: now, ClientIP: "1.1.1.1", RuleID: "sqli", Path: "/login", Country: "RU"})
+	ot.Record(BlockEvent{Timestamp: now.Add(-2 * time.Minute), ClientIP: "2.2.2.2", RuleID: "xss", Path: "/search"})
+	ot.Record(BlockEvent{Timestamp: now.Add(-30 * time.Minute), ClientIP: "3.3.3.3", RuleID: "lfi", Path: "/etc"})
+
+	top := ot.Top(now, 15*time.Minute, 10)
+	assert.Equal(t, 3, top.Blocked)
+	assert.Equal(t, []keyCount{{Key: "1.1.1.1", Count: 2}, {Key: "2.2.2.2", Count: 1}}, top.IPs)
+	assert.Equal(t, "sqli", top.Rules[0].Key)
+	assert.Equal(t, "/login", top.Paths[0].Key)
+	assert.Equal(t, []keyCount{{Key: "RU", Count: 2}}, top.Countries)
+
+	top = ot.Top(now, time.Hour, 1)
+	assert.Equal(t, 4, top.Blocked)
+	assert.Len(t, top.IPs, 1)
+}
+
+func TestOffenderTracker_BucketReuse(t *testing.T) {
+	ot := NewOffenderTracker()
+	now := time.Now()
+
+	ot.Record(BlockEvent{Timestamp: now.Add(-time.Hour), ClientIP: "9.9.9.9"})
+	ot.Record(BlockEvent{Timestamp: now, ClientIP: "1.1.1.1"})
+
+	top := ot.Top(now, time.Hour, 10)
+	assert.Equal(t, 1, top.Blocked)
+	assert.Equal(t, "1.1.1.1", top.IPs[0].Key)
+}
+
+func TestHandleTopRequest(t *testing.T) {
+	m := newAPITestMiddleware()
+	m.offenderTracker = NewOffenderTracker()
+	m.offenderTracker.Record(BlockEvent{Timestamp: time.Now(), ClientIP: "1.1.1.1", RuleID: "sqli", Path: "/"})
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/top?window=5m", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var top TopOffenders
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &top))
+	assert.Equal(t, 1, top.Blocked)
+	assert.Equal(t, "5m0s", top.Window)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.handleAdminAPIRequest(w, httptest.NewRequest("GET", "/waf/api/top?window=2h", nil)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPublishEvent_RecordsOffenders(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), offenderTracker: NewOffenderTracker()}
+	assert.True(t, m.hasEventConsumers())
+
+	m.publishEvent(BlockEvent{Timestamp: time.Now(), ClientIP: "1.1.1.1"})
+	assert.Equal(t, 1, m.offenderTracker.Top(time.Now(), time.Minute, 10).Blocked)
+}
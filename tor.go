@@ -7,6 +7,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -25,6 +26,7 @@ type TorConfig struct {
 	RetryInterval        string `json:"retry_interval,omitempty"`   // Retry interval (e.g., "5m")
 	lastUpdated          time.Time
 	logger               *zap.Logger
+	exitNodes            atomic.Value // map[string]struct{} of the last exit node list fetched
 }
 
 // Provision sets up the Tor blocking configuration.
@@ -64,6 +66,12 @@ func (t *TorConfig) updateTorExitNodes() error {
 	}
 
 	torIPs := strings.Split(string(data), "\n")
+	exitNodes := make(map[string]struct{}, len(torIPs))
+	for _, ip := range torIPs {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			exitNodes[ip] = struct{}{}
+		}
+	}
 	existingIPs, err := t.readExistingBlacklist()
 	if err != nil {
 		return fmt.Errorf("failed to read existing blacklist file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
@@ -79,12 +87,20 @@ func (t *TorConfig) updateTorExitNodes() error {
 		return fmt.Errorf("failed to write updated blacklist to file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
 	}
 
+	t.exitNodes.Store(exitNodes)
 	t.lastUpdated = time.Now()
 	t.logger.Info("Tor exit nodes updated", zap.Int("count", len(uniqueIPs))) // Improved log message
 	t.logger.Debug("Tor exit node update completed successfully")             // Debug log at end of update
 	return nil
 }
 
+// isExitNode reports whether an IP is in the last Tor exit node list fetched.
+func (t *TorConfig) isExitNode(ip string) bool {
+	exitNodes, _ := t.exitNodes.Load().(map[string]struct{})
+	_, ok := exitNodes[ip]
+	return ok
+}
+
 // scheduleUpdates periodically updates the Tor exit node list.
 func (t *TorConfig) scheduleUpdates() {
 	interval, err := time.ParseDuration(t.UpdateInterval)
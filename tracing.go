@@ -0,0 +1,51 @@
+package caddywaf
+
+import (
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/fabriziosalmi/caddy-waf"
+
+// startPhaseSpan starts a span for a WAF inspection phase. When tracing is
+// disabled, or Caddy's tracing handler is not active for the request, the
+// returned span is a no-op. Spans are children of the span in the request
+// context, so they show up next to Caddy's upstream spans.
+func (m *Middleware) startPhaseSpan(r *http.Request, phase int) (*http.Request, trace.Span) {
+	if !m.Tracing {
+		return r, noop.Span{}
+	}
+	tracer := trace.SpanFromContext(r.Context()).TracerProvider().Tracer(tracerName)
+	ctx, span := tracer.Start(r.Context(), "waf.phase."+strconv.Itoa(phase),
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attribute.Int("waf.phase", phase)),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endPhaseSpan records the outcome of a phase on its span and ends it.
+func (m *Middleware) endPhaseSpan(span trace.Span, state *WAFState) {
+	if !span.IsRecording() {
+		span.End()
+		return
+	}
+	decision := "allow"
+	if state.Blocked {
+		decision = "block"
+	}
+	span.SetAttributes(
+		attribute.Int("waf.score", state.TotalScore),
+		attribute.Int("waf.anomaly_threshold", m.anomalyThreshold(state)),
+		attribute.StringSlice("waf.matched_rules", state.MatchedRules),
+		attribute.Bool("waf.blocked", state.Blocked),
+		attribute.String("waf.decision", decision),
+	)
+	if state.Blocked {
+		span.SetAttributes(attribute.Int("waf.status_code", state.StatusCode))
+	}
+	span.End()
+}
@@ -0,0 +1,61 @@
+package caddywaf
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestPhaseSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		AnomalyThreshold:      5,
+		Tracing:               true,
+		Rules: map[int][]Rule{
+			1: {{ID: "ua-block", Phase: 1, Targets: []string{"USER_AGENT"}, Score: 5, Action: "block", regex: regexp.MustCompile("sqlmap")}},
+		},
+	}
+
+	req := httptest.NewRequest("GET", testURL, nil).WithContext(ctx)
+	req.Header.Set("User-Agent", "sqlmap/1.0")
+	req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "trace-test"))
+
+	blocked := m.isPhaseBlocked(httptest.NewRecorder(), req, 1, m.initializeWAFState())
+	parent.End()
+	assert.True(t, blocked)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	phaseSpan := spans[0]
+	assert.Equal(t, "waf.phase.1", phaseSpan.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), phaseSpan.Parent().SpanID())
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range phaseSpan.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "block", attrs["waf.decision"].AsString())
+	assert.Equal(t, []string{"ua-block"}, attrs["waf.matched_rules"].AsStringSlice())
+}
+
+func TestPhaseSpans_Disabled(t *testing.T) {
+	m := &Middleware{}
+	req := httptest.NewRequest("GET", testURL, nil)
+	r, span := m.startPhaseSpan(req, 1)
+	assert.Same(t, req, r, "request should not be copied when tracing is disabled")
+	assert.False(t, span.IsRecording())
+}
@@ -3,6 +3,7 @@ package caddywaf
 import (
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oschwald/maxminddb-golang"
@@ -13,6 +14,7 @@ import (
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
 )
 
 // Package caddywaf is a Caddy module providing web application firewall functionality.
@@ -33,18 +35,22 @@ type (
 	HitCount int
 )
 
-// RuleCache caches compiled regex patterns for rules.
+// RuleCache caches compiled regexes by pattern, so rules sharing a pattern, and
+// rules left unchanged by a reload, reuse a single compiled regexp.
 type RuleCache struct {
 	mu    sync.RWMutex
-	rules map[string]*regexp.Regexp
+	rules map[string]*regexp.Regexp // Keyed by pattern
 }
 
 // CountryAccessFilter struct
 type CountryAccessFilter struct {
-	Enabled     bool              `json:"enabled"`
-	CountryList []string          `json:"country_list"`
-	GeoIPDBPath string            `json:"geoip_db_path"`
-	geoIP       *maxminddb.Reader `json:"-"` // Explicitly mark as not serialized
+	Enabled     bool                             `json:"enabled"`
+	CountryList []string                         `json:"country_list"`
+	GeoIPDBPath string                           `json:"geoip_db_path"`
+	ActiveHours string                           `json:"active_hours,omitempty"` // Times of day the filter applies
+	ActiveDays  []string                         `json:"active_days,omitempty"`  // Days the filter applies
+	geoIP       atomic.Pointer[maxminddb.Reader] // Swapped when the database file is replaced
+	schedule    *timeWindow
 }
 
 // GeoIPRecord struct
@@ -52,6 +58,10 @@ type GeoIPRecord struct {
 	Country struct {
 		ISOCode string `maxminddb:"iso_code"`
 	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"` // Only in city databases
 }
 
 // Rule struct
@@ -64,15 +74,32 @@ type Rule struct {
 	Score       int      `json:"score"`
 	Action      string   `json:"mode"` // CRITICAL FIX: This should map to the "mode" field in JSON
 	Description string   `json:"description"`
-	regex       *regexp.Regexp
-	Priority    int // New field for rule priority
+	Condition   string   `json:"condition,omitempty"`    // CEL expression the request must satisfy for the rule to apply
+	ActiveHours string   `json:"active_hours,omitempty"` // Times of day the rule applies, such as "18:00-09:00"
+	ActiveDays  []string `json:"active_days,omitempty"`  // Days the rule applies, such as ["mon-fri"]
+	// Shannon entropy, in bits per byte, a target value must reach for the rule to match,
+	// flagging encoded or obfuscated payloads. Without a pattern, any value reaching it matches.
+	MinEntropy float64 `json:"min_entropy,omitempty"`
+	// Percentage of clients, from 1 to 100, the rule is enforced on, by hash of their IP
+	// salted with the rule ID, only logging its matches for the others. Unset, it is
+	// enforced on all clients.
+	RolloutPercent *int `json:"rollout_percent,omitempty"`
+	regex          *regexp.Regexp
+	condition      cel.Program
+	schedule       *timeWindow
+	Priority       int // New field for rule priority
 }
 
 // CustomBlockResponse struct
 type CustomBlockResponse struct {
 	StatusCode int
 	Headers    map[string]string
-	Body       string
+	Body       string           // May use the fields of BlockResponseData, as in {{.TransactionID}}
+	File       string           // File the body is read from, reloaded when it changes
+	template   responseTemplate // Parsed Body, if it has template actions
+
+	Languages map[string]ResponseVariant // Localized bodies by language tag, picked by Accept-Language
+	languages *responseLanguages         // Matches Accept-Language against Languages
 }
 
 // WAFState struct
@@ -81,6 +108,35 @@ type WAFState struct {
 	Blocked         bool
 	StatusCode      int
 	ResponseWritten bool
+	MatchedRules    []string     // IDs of the rules matched so far
+	overlay         *HostOverlay // Host overlay applying to the request, if any
+	replayKey       string       // Key the request was remembered under by the replay detector
+	blockReason     string       // Reason the request was blocked for
+	blockRuleID     string       // Rule or check that blocked the request
+
+	targets map[string]extractedTarget // Target values extracted so far, shared by all rules and phases
+	decoded map[string]decodedTarget   // Decoded layers of the target values, with decode_layers
+	budget  budgetUsage                // Inspection work spent so far
+	vars    map[string]string          // Variables set by inspectors
+	trace   []TraceRule                // Rule matches, recorded with explain
+
+	bodySizeLimit *BodySizeLimit // Limit capping a body of unknown length
+
+	rpcMessageSize int64 // Largest message in the RPC body read, as its frame declares
+
+	geoIP *maxminddb.Reader // GeoIP database of the request, kept while a reload replaces it
+}
+
+// extractedTarget is the memoized result of a target extraction.
+type extractedTarget struct {
+	value string
+	err   error
+}
+
+// decodedTarget is the decoded layers of a target value.
+type decodedTarget struct {
+	value  string
+	layers []string
 }
 
 // Middleware is the main WAF middleware struct that implements Caddy's
@@ -100,32 +156,47 @@ type WAFState struct {
 type Middleware struct {
 	mu sync.RWMutex
 
-	RuleFiles        []string            `json:"rule_files"`
-	IPBlacklistFile  string              `json:"ip_blacklist_file"`
-	DNSBlacklistFile string              `json:"dns_blacklist_file"`
-	AnomalyThreshold int                 `json:"anomaly_threshold"`
-	CountryBlacklist CountryAccessFilter `json:"country_blacklist"`
-	CountryWhitelist CountryAccessFilter `json:"country_whitelist"`
-	Rules            map[int][]Rule      `json:"-"`
-	ipBlacklist      *iptrie.Trie        `json:"-"`
-	dnsBlacklist     map[string]struct{} `json:"-"` // Changed to map[string]struct{}
-	logger           *zap.Logger
-	LogSeverity      string `json:"log_severity,omitempty"`
-	LogJSON          bool   `json:"log_json,omitempty"`
-	logLevel         zapcore.Level
-	isShuttingDown   bool
+	RuleFiles         []string            `json:"rule_files"`
+	IPBlacklistFile   string              `json:"ip_blacklist_file"`
+	DNSBlacklistFile  string              `json:"dns_blacklist_file"`
+	PathBlacklistFile string              `json:"path_blacklist_file,omitempty"`
+	CertBlacklistFile string              `json:"cert_blacklist_file,omitempty"`
+	AnomalyThreshold  int                 `json:"anomaly_threshold"`
+	CountryBlacklist  CountryAccessFilter `json:"country_blacklist"`
+	CountryWhitelist  CountryAccessFilter `json:"country_whitelist"`
+	Rules             map[int][]Rule      `json:"-"`
+	ipBlacklist       *iptrie.Trie        `json:"-"`
+	dnsBlacklist      map[string]struct{} `json:"-"` // Changed to map[string]struct{}
+	pathBlacklist     *pathBlacklist
+	certBlacklist     map[string]struct{} // SHA-256 fingerprints of client certificates
+	logger            *zap.Logger
+	LogSeverity       string `json:"log_severity,omitempty"`
+	LogJSON           bool   `json:"log_json,omitempty"`
+	logLevel          zapcore.Level
+	isShuttingDown    bool
+
+	IPBlacklistIPv4Prefix int `json:"ip_blacklist_ipv4_prefix,omitempty"` // Prefix length blocked by single IPv4 addresses, default 32
+	IPBlacklistIPv6Prefix int `json:"ip_blacklist_ipv6_prefix,omitempty"` // Prefix length blocked by single IPv6 addresses, default 64
 
 	geoIPCacheTTL               time.Duration
 	geoIPLookupFallbackBehavior string
 
+	BlockStatus *BlockStatusConfig `json:"block_status,omitempty"` // Status codes of the blocked requests by category
+
 	CustomResponses     map[int]CustomBlockResponse `json:"custom_responses,omitempty"`
 	LogFilePath         string
-	LogBuffer           int  `json:"log_buffer,omitempty"` // Add the LogBuffer field
-	RedactSensitiveData bool `json:"redact_sensitive_data,omitempty"`
+	LogBuffer           int               `json:"log_buffer,omitempty"`           // Add the LogBuffer field
+	LogOverflow         string            `json:"log_overflow,omitempty"`         // Full log buffer policy: sync, drop_oldest, drop_new or block_with_timeout
+	LogOverflowTimeout  time.Duration     `json:"log_overflow_timeout,omitempty"` // Wait of block_with_timeout before dropping
+	LogDedup            *LogDedupConfig   `json:"log_dedup,omitempty"`            // Aggregates the log entries of rules matching very often
+	RuleCanary          *RuleCanaryConfig `json:"rule_canary,omitempty"`          // Log-only period of the rules added or changed by reloads
+	RedactSensitiveData bool              `json:"redact_sensitive_data,omitempty"`
 
 	ruleHits        sync.Map `json:"-"`
 	MetricsEndpoint string   `json:"metrics_endpoint,omitempty"`
 
+	RuleHitsFile string `json:"rule_hits_file,omitempty"` // Saves the rule hits on cleanup and restores them on provisioning
+
 	configLoader          *ConfigLoader
 	blacklistLoader       *BlacklistLoader
 	geoIPHandler          *GeoIPHandler
@@ -134,22 +205,34 @@ type Middleware struct {
 	RateLimit   RateLimit
 	rateLimiter *RateLimiter
 
+	Timezone string         `json:"timezone,omitempty"` // IANA timezone of active_hours and active_days, default the server's
+	location *time.Location // Loaded Timezone
+
 	totalRequests   int64
 	blockedRequests int64
 	allowedRequests int64
 	ruleHitsByPhase map[int]int64
 	geoIPStats      map[string]int64 // Key: country code, Value: count
 	muMetrics       sync.RWMutex     // Mutex for metrics synchronization
+	requestWindows  *RequestWindows  // Rolling 1m/5m/1h request counters
 
 	rateLimiterBlockedRequests int64        // Add rate limiter blocked requests metric
 	muRateLimiterMetrics       sync.RWMutex // Mutex to protect rate limiter metrics
 
-	geoIPBlocked int
+	geoIPBlocked          int
+	geoIPBlockedByCountry map[string]int64 // Key: country code, Value: blocked count
 
 	Tor TorConfig `json:"tor,omitempty"`
 
-	logChan chan LogEntry // Buffered channel for log entries
-	logDone chan struct{} // Signal to stop the logging worker
+	logChan    chan LogEntry // Buffered channel for log entries
+	logStop    chan struct{} // Signal to stop the logging worker
+	logDone    chan struct{} // Closed once the logging worker has stopped
+	logDropped atomic.Int64  // Log entries dropped by the overflow policy
+	logDeduper *logDeduper   // Counts rule log entries past the log_dedup limits
+	ruleCanary *ruleCanary   // Rules in canary or shadowed
+
+	RuleCoverage *RuleCoverageConfig `json:"rule_coverage,omitempty"` // Tracks the rules never matched since load
+	ruleCoverage *ruleCoverage
 
 	ruleCache *RuleCache // New field for RuleCache
 
@@ -157,6 +240,169 @@ type Middleware struct {
 	muIPBlacklistMetrics   sync.Mutex
 	DNSBlacklistBlockCount int64 `json:"dns_blacklist_hits"`
 	muDNSBlacklistMetrics  sync.Mutex
+	pathBlacklistHits      atomic.Int64
+	certBlacklistHits      atomic.Int64
+
+	Notifiers           []NotifierConfig `json:"notifiers,omitempty"`
+	notificationManager *NotificationManager
+
+	EmailAlert   *EmailAlertConfig `json:"email_alert,omitempty"`
+	emailAlerter *EmailAlerter
+
+	SIEMOutput *SIEMOutputConfig `json:"siem_output,omitempty"`
+	siemWriter *SIEMWriter
+
+	Fail2banOutput string `json:"fail2ban_output,omitempty"` // File or socket receiving block events in the fail2ban format
+	fail2banWriter *Fail2banWriter
+
+	Tracing bool `json:"tracing,omitempty"` // Emit OpenTelemetry spans for each inspection phase
+
+	LatencyMetrics bool `json:"latency_metrics,omitempty"` // Record per-phase and per-rule evaluation time
+	latencyTracker *LatencyTracker
+
+	AdminAPI  string `json:"admin_api,omitempty"` // Path prefix of the admin API, disabled if empty
+	apiRoutes map[string]apiHandler
+
+	Explain      *ExplainConfig `json:"explain,omitempty"` // Keeps the evaluation trace of the recent blocked requests
+	transactions *transactionLog
+
+	StatsExport   *StatsExportConfig `json:"stats_export,omitempty"` // Periodic export of the rule hits, counters and top offenders
+	statsExporter *StatsExporter
+
+	offenderTracker *OffenderTracker // Rolling top-N offenders, served by the admin API
+
+	fileWatchers       sync.Map     // File path -> *fileWatchStatus
+	ipBlacklistEntries atomic.Int64 // Number of entries in the loaded IP blacklist
+	ipBlacklistLoad    atomic.Pointer[IPBlacklistLoadStats]
+
+	EventStore *EventStoreConfig `json:"event_store,omitempty"`
+	eventStore *EventStore
+
+	TenantByHost bool `json:"tenant_by_host,omitempty"` // Scope counters and rate limits per request Host
+	tenants      *TenantRegistry
+
+	HostOverlays []HostOverlay `json:"host_overlays,omitempty"` // Per-host rule and threshold adjustments
+
+	ParamSchemas []ParamSchema      `json:"param_schemas,omitempty"` // Allowed parameters per path
+	OpenAPI      *OpenAPIConfig     `json:"openapi,omitempty"`       // Validates requests against an OpenAPI spec
+	JSONSchemas  []JSONSchemaConfig `json:"json_schemas,omitempty"`  // JSON Schemas of request bodies per path
+
+	CredentialStuffing  []*CredentialStuffingConfig `json:"credential_stuffing,omitempty"` // Username and failure tracking on login endpoints
+	stuffingHits        atomic.Int64
+	Challenge           *ChallengeConfig `json:"challenge,omitempty"` // JavaScript challenge served instead of some blocks
+	challengesIssued    atomic.Int64
+	GeoVelocity         *GeoVelocityConfig `json:"geo_velocity,omitempty"` // Impossible travel of sessions or users
+	geoVelocityHits     atomic.Int64
+	SlowClient          *SlowClientConfig `json:"slow_client,omitempty"` // Body deadline and minimum rate
+	slowBodyHits        atomic.Int64
+	ConcurrencyLimit    *ConcurrencyLimitConfig `json:"concurrency_limit,omitempty"` // In-flight requests per IP and connection
+	concurrencyHits     atomic.Int64
+	Replay              []*ReplayConfig `json:"replay,omitempty"` // Duplicate request detection per path
+	replayHits          atomic.Int64
+	Quota               *QuotaConfig `json:"quota,omitempty"` // Hourly and daily request budgets per API key
+	quotaHits           atomic.Int64
+	CostLimit           *CostLimitConfig `json:"cost_limit,omitempty"` // Rate limit by the cost of the requested endpoints
+	costLimitHits       atomic.Int64
+	BotScore            *BotScoreConfig `json:"bot_score,omitempty"` // Signal weights and threshold of the bot score
+	botScoreHits        atomic.Int64
+	IPType              *IPTypeConfig     `json:"ip_type,omitempty"`    // Residential, datacenter, VPN and Tor classification of client IPs
+	Reputation          *ReputationConfig `json:"reputation,omitempty"` // IP reputation providers and threshold
+	reputationHits      atomic.Int64
+	Inspectors          []*InspectorConfig `json:"inspectors,omitempty"` // Custom detectors invoked at configured phases
+	inspectorHits       atomic.Int64
+	ICAP                *ICAPConfig `json:"icap,omitempty"` // Antivirus or DLP scanning of bodies by an ICAP service
+	icapHits            atomic.Int64
+	ClamAV              *ClamAVConfig `json:"clamav,omitempty"` // Malware scanning of uploaded files by clamd
+	malwareBlocked      atomic.Int64
+	YARA                *YARAConfig `json:"yara,omitempty"` // YARA rules matched against bodies and uploaded files
+	yaraHits            atomic.Int64
+	CDNOrigin           *CDNOriginConfig `json:"cdn_origin,omitempty"` // Rejects requests not coming through the CDN
+	directOriginBlocked atomic.Int64
+	Lockdown            *LockdownConfig `json:"lockdown,omitempty"` // Stricter preset switched on at runtime under attack
+	lockdownHits        atomic.Int64
+	FalsePositives      *FalsePositiveConfig `json:"false_positives,omitempty"` // Block events reported as false positives by operators
+	fpReports           atomic.Int64
+	Learning            *LearningConfig     `json:"learning,omitempty"`      // Learns a draft positive security policy from the traffic
+	ParamAnomaly        *ParamAnomalyConfig `json:"param_anomaly,omitempty"` // Scores parameters deviating from their learned baseline
+	paramAnomalies      atomic.Int64
+	DecodeLayers        *DecodeLayersConfig `json:"decode_layers,omitempty"` // Matches rules against decoded layers of the target values
+	decodedMatches      atomic.Int64
+	Deserialization     *DeserializationConfig `json:"deserialization,omitempty"` // Detects Java, PHP and .NET serialized objects
+	deserializationHits atomic.Int64
+	SSRF                *SSRFConfig `json:"ssrf,omitempty"` // Detects URLs pointing at internal destinations
+	ssrfHits            atomic.Int64
+	OpenRedirect        *OpenRedirectConfig `json:"open_redirect,omitempty"` // Detects URLs redirecting to hosts not allowed
+	openRedirectHits    atomic.Int64
+	Smuggling           *SmugglingConfig `json:"request_smuggling,omitempty"` // Checks the framing headers for request smuggling indicators
+	smugglingHits       atomic.Int64
+	CRLF                *CRLFConfig `json:"crlf_injection,omitempty"` // Detects line breaks and null bytes injected in the path, query and headers
+	crlfHits            atomic.Int64
+
+	RequestDecompress   *RequestDecompressConfig `json:"request_decompress,omitempty"` // Decompresses or rejects encoded request bodies
+	requestEncodingHits atomic.Int64
+
+	UploadPolicy     *UploadPolicyConfig `json:"upload_policy,omitempty"` // Restricts uploaded files by name, extension and count
+	uploadPolicyHits atomic.Int64
+
+	BodySizeLimits []BodySizeLimit `json:"body_size_limits,omitempty"` // Request body size limits by content type and path
+	bodySizeHits   atomic.Int64
+
+	Hotlink     *HotlinkConfig `json:"hotlink_protection,omitempty"` // Stops other sites from embedding the static files
+	hotlinkHits atomic.Int64
+
+	SignedURLs    []*SignedURLConfig `json:"signed_urls,omitempty"` // Paths requiring HMAC-signed URLs
+	signedURLHits atomic.Int64
+
+	RequestSigning     []*RequestSigningConfig `json:"request_signing,omitempty"` // API paths requiring HMAC-signed requests
+	requestSigningHits atomic.Int64
+
+	GraphQL     *GraphQLConfig `json:"graphql,omitempty"` // Introspection and batching controls of GraphQL endpoints
+	graphQLHits atomic.Int64
+
+	RPC     *RPCConfig `json:"rpc,omitempty"` // Message size and metadata checks of gRPC, gRPC-Web and Connect calls
+	rpcHits atomic.Int64
+
+	XXE     *XXEConfig `json:"xxe,omitempty"` // Detects XXE and entity expansion constructs in XML bodies
+	xxeHits atomic.Int64
+
+	TokenIntrospection *TokenIntrospectionConfig `json:"token_introspection,omitempty"` // OAuth2 introspection of bearer tokens for rules
+
+	EndpointAuth *EndpointAuthConfig `json:"endpoint_auth,omitempty"` // Protects metrics_endpoint and admin_api
+
+	ConfigSource *ConfigSourceConfig `json:"config_source,omitempty"` // Consul KV or etcd source for rules and blacklists
+	configSource *ConfigSource
+
+	Bans          *BanConfig `json:"bans,omitempty"` // Dynamic bans of repeat offenders
+	banList       *BanList
+	banPropagator *BanPropagator
+	BanExport     *BanExportConfig `json:"ban_export,omitempty"` // nftables or ipset set mirroring the bans
+	banExporter   *BanExporter
+
+	Cluster *ClusterConfig `json:"cluster,omitempty"` // Synchronizes rate limits and bans between nodes
+	cluster *Cluster
+
+	geoIPWatchStop chan struct{} // Closed to stop the GeoIP database watcher
+
+	customResponseMu        sync.RWMutex  // Guards CustomResponses against the reloads of their files
+	customResponseWatchStop chan struct{} // Closed to stop the custom response file watcher
+
+	GeoIPUpdate  *GeoIPUpdateConfig `json:"geoip_update,omitempty"` // Scheduled MaxMind database downloads
+	geoIPUpdater *GeoIPUpdater
+
+	InspectionPool *InspectionPoolConfig `json:"inspection_pool,omitempty"` // Caps concurrent large-body and response-body inspections
+	inspectionPool *InspectionPool
+
+	InspectionBudget *InspectionBudget `json:"inspection_budget,omitempty"` // Per-request inspection limits
+	budgetStats      budgetStats
+
+	ResponseBufferLimit     int64 `json:"response_buffer_limit,omitempty"`     // Response body bytes buffered for inspection before streaming
+	ResponseDecompressLimit int64 `json:"response_decompress_limit,omitempty"` // Decompressed bytes of compressed response bodies inspected
+
+	LookupCache      *LookupCacheConfig `json:"lookup_cache,omitempty"` // Sizes the per-IP GeoIP and blacklist lookup caches
+	ipBlacklistCache *lookupCache[ipBlacklistVerdict]
+
+	DNSBlacklistIndex *DNSBlacklistIndexConfig `json:"dns_blacklist_index,omitempty"` // Keeps the DNS blacklist on disk behind a Bloom filter
+	dnsBlacklistIndex *dnsBlacklistIndex
 }
 
 // ==================== Constructors (New functions) ====================
@@ -170,17 +416,55 @@ func NewRuleCache() *RuleCache {
 
 // ==================== RuleCache Methods ====================
 
-// Get retrieves a compiled regex pattern from the cache.
-func (rc *RuleCache) Get(ruleID string) (*regexp.Regexp, bool) {
+// Get retrieves the compiled regex of a pattern from the cache.
+func (rc *RuleCache) Get(pattern string) (*regexp.Regexp, bool) {
 	rc.mu.RLock()
 	defer rc.mu.RUnlock()
-	regex, exists := rc.rules[ruleID]
+	regex, exists := rc.rules[pattern]
 	return regex, exists
 }
 
-// Set stores a compiled regex pattern in the cache.
-func (rc *RuleCache) Set(ruleID string, regex *regexp.Regexp) {
+// Set stores the compiled regex of a pattern in the cache.
+func (rc *RuleCache) Set(pattern string, regex *regexp.Regexp) {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
-	rc.rules[ruleID] = regex
+	rc.rules[pattern] = regex
+}
+
+// Compile returns the cached regex of a pattern, compiling and caching it on a miss.
+func (rc *RuleCache) Compile(pattern string) (*regexp.Regexp, error) {
+	if regex, exists := rc.Get(pattern); exists {
+		return regex, nil
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if cached, exists := rc.rules[pattern]; exists {
+		return cached, nil // Compiled concurrently, keep a single instance
+	}
+	rc.rules[pattern] = regex
+	return regex, nil
+}
+
+// Retain drops the patterns that are not in use, so patterns removed by a reload
+// don't stay in memory. It returns the number of cached patterns left.
+func (rc *RuleCache) Retain(inUse map[string]struct{}) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for pattern := range rc.rules {
+		if _, ok := inUse[pattern]; !ok {
+			delete(rc.rules, pattern)
+		}
+	}
+	return len(rc.rules)
+}
+
+// Len returns the number of cached patterns.
+func (rc *RuleCache) Len() int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return len(rc.rules)
 }
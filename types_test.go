@@ -37,3 +37,34 @@ func TestRuleCache_GetSet(t *testing.T) {
 		t.Error("RuleCache.Get() returned exists=true for non-existent rule")
 	}
 }
+
+func TestRuleCache_CompileSharesPatterns(t *testing.T) {
+	cache := NewRuleCache()
+	first, err := cache.Compile(`(?i)union\s+select`)
+	if err != nil {
+		t.Fatalf("Compile() failed: %v", err)
+	}
+	second, err := cache.Compile(`(?i)union\s+select`)
+	if err != nil {
+		t.Fatalf("Compile() failed: %v", err)
+	}
+	if first != second {
+		t.Error("Compile() returned a new regex for a cached pattern")
+	}
+	if _, err := cache.Compile(`(`); err == nil {
+		t.Error("Compile() accepted an invalid pattern")
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", cache.Len())
+	}
+
+	if _, err := cache.Compile(`other`); err != nil {
+		t.Fatalf("Compile() failed: %v", err)
+	}
+	if left := cache.Retain(map[string]struct{}{`other`: {}}); left != 1 {
+		t.Errorf("Retain() left %d patterns, want 1", left)
+	}
+	if _, exists := cache.Get(`(?i)union\s+select`); exists {
+		t.Error("Retain() kept an unused pattern")
+	}
+}
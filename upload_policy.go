@@ -0,0 +1,215 @@
+package caddywaf
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const uploadPolicyRuleID = "upload_policy_rule"
+
+// Violations of the upload policy
+const (
+	uploadTooManyFiles    = "too_many_files"
+	uploadFilename        = "filename"
+	uploadExtension       = "extension"
+	uploadDoubleExtension = "double_extension"
+	uploadContentType     = "content_type"
+)
+
+// uploadSniffBytes is how much of a file is read to sniff its content type.
+const uploadSniffBytes = 512
+
+// verifiableContentTypes are the content types told by their magic bytes, by
+// http.DetectContentType, with the aliases clients declare for them.
+var verifiableContentTypes = map[string]string{
+	"image/png":                    "image/png",
+	"image/jpeg":                   "image/jpeg",
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/gif":                    "image/gif",
+	"image/webp":                   "image/webp",
+	"image/bmp":                    "image/bmp",
+	"image/x-icon":                 "image/x-icon",
+	"image/vnd.microsoft.icon":     "image/x-icon",
+	"application/pdf":              "application/pdf",
+	"application/zip":              "application/zip",
+	"application/x-zip-compressed": "application/zip",
+	"application/gzip":             "application/x-gzip",
+	"application/x-gzip":           "application/x-gzip",
+}
+
+// executableExtensions are the extensions run by web servers or operating systems, looked
+// for before the last extension of a file name by double_extensions.
+var executableExtensions = []string{
+	"php", "php3", "php4", "php5", "php7", "phtml", "phar", "pht",
+	"asp", "aspx", "ascx", "ashx", "asmx", "cer", "jsp", "jspx", "shtml",
+	"cgi", "pl", "py", "rb", "sh", "exe", "dll", "bat", "cmd", "com", "ps1", "vbs", "jar", "war",
+}
+
+// UploadPolicyConfig restricts the files uploaded in multipart requests by name, extension
+// and count.
+type UploadPolicyConfig struct {
+	BlockedExtensions []string `json:"blocked_extensions,omitempty"`  // Extensions blocked, case insensitive
+	DoubleExtensions  bool     `json:"double_extensions,omitempty"`   // Block names with a blocked or executable extension before the last, such as shell.php.jpg
+	FilenamePattern   string   `json:"filename_pattern,omitempty"`    // Regex the whole file names must match
+	MaxFiles          int      `json:"max_files,omitempty"`           // Files allowed per request, 0 for no limit
+	VerifyContentType bool     `json:"verify_content_type,omitempty"` // Block files whose magic bytes contradict their declared type or extension
+
+	blocked  map[string]bool
+	inner    map[string]bool // Extensions blocked before the last one
+	filename *regexp.Regexp
+}
+
+// provision validates the config and builds the extension sets.
+func (c *UploadPolicyConfig) provision() error {
+	if c.MaxFiles < 0 {
+		return fmt.Errorf("invalid upload_policy max_files %d", c.MaxFiles)
+	}
+	c.filename = nil
+	if c.FilenamePattern != "" {
+		filename, err := regexp.Compile(c.FilenamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid upload_policy filename_pattern: %w", err)
+		}
+		c.filename = filename
+	}
+	c.blocked = make(map[string]bool, len(c.BlockedExtensions))
+	c.inner = make(map[string]bool, len(c.BlockedExtensions)+len(executableExtensions))
+	for _, extension := range c.BlockedExtensions {
+		extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+		c.blocked[extension] = true
+		c.inner[extension] = true
+	}
+	for _, extension := range executableExtensions {
+		c.inner[extension] = true
+	}
+	return nil
+}
+
+// fileExtensions returns the lowercased extensions of a file name, in order. The trailing
+// dots and spaces dropped by Windows are ignored, so shell.php. ends with php.
+func fileExtensions(name string) []string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.ToLower(strings.TrimRight(name, ". "))
+	parts := strings.Split(name, ".")
+	return parts[1:]
+}
+
+// violation returns the rule a file name breaks, or an empty string.
+func (c *UploadPolicyConfig) violation(name string) string {
+	if c.filename != nil && !c.filename.MatchString(name) {
+		return uploadFilename
+	}
+	extensions := fileExtensions(name)
+	if len(extensions) == 0 {
+		return ""
+	}
+	if c.blocked[extensions[len(extensions)-1]] {
+		return uploadExtension
+	}
+	if c.DoubleExtensions {
+		for _, extension := range extensions[:len(extensions)-1] {
+			if c.inner[extension] {
+				return uploadDoubleExtension
+			}
+		}
+	}
+	return ""
+}
+
+// contentTypeMismatch returns the content type sniffed from the first bytes of a file when
+// it contradicts the declared type or the type of the extension, or an empty string. Only
+// the types told by their magic bytes are verified: a PHP script declared as image/png is
+// caught, while a CSV declared as text/plain is not verified.
+func contentTypeMismatch(name, declared string, head []byte) string {
+	if len(head) == 0 {
+		return ""
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	claimed := []string{declared}
+	if extensions := fileExtensions(name); len(extensions) > 0 {
+		claimed = append(claimed, mime.TypeByExtension("."+extensions[len(extensions)-1]))
+	}
+	for _, contentType := range claimed {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			continue
+		}
+		if expected, ok := verifiableContentTypes[mediaType]; ok && expected != sniffed {
+			return sniffed
+		}
+	}
+	return ""
+}
+
+// uploadedFileName returns the file name of a multipart part as sent, with its directories
+// and characters that multipart.Part.FileName drops, or an empty string for form fields.
+func uploadedFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// checkUploadPolicy applies the upload policy to the files of multipart requests in phase 2,
+// blocking the requests breaking it. It reports whether the request was blocked.
+func (m *Middleware) checkUploadPolicy(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.UploadPolicy
+	if config == nil || r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	boundary := multipartBoundary(r)
+	if boundary == "" {
+		return false
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil {
+		return false
+	}
+
+	// Of a body truncated by the inspection budget, only the files before the cut are checked
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	files := 0
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return false
+		}
+		name := uploadedFileName(part)
+		if name == "" {
+			continue
+		}
+		files++
+		fields := []zap.Field{
+			zap.String("message", "Request blocked by the upload policy"),
+			zap.String("file_name", name),
+		}
+		violation := config.violation(name)
+		if config.MaxFiles > 0 && files > config.MaxFiles {
+			violation = uploadTooManyFiles
+		}
+		if violation == "" && config.VerifyContentType {
+			head, _ := io.ReadAll(io.LimitReader(part, uploadSniffBytes))
+			declared := part.Header.Get("Content-Type")
+			if sniffed := contentTypeMismatch(name, declared, head); sniffed != "" {
+				violation = uploadContentType
+				fields = append(fields, zap.String("declared_type", declared), zap.String("sniffed_type", sniffed))
+			}
+		}
+		if violation == "" {
+			continue
+		}
+		m.uploadPolicyHits.Add(1)
+		m.blockRequest(w, r, state, http.StatusForbidden, "upload_policy", uploadPolicyRuleID,
+			append(fields, zap.String("violation", violation))...)
+		return true
+	}
+}
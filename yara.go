@@ -0,0 +1,1036 @@
+package caddywaf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	yaraRuleID       = "yara_rule"
+	yaraMaxJump      = 1000 // Longest hex string jump, the repeat limit of Go regexps
+	yaraWordBoundary = `\b`
+)
+
+// YARAConfig matches request bodies and uploaded files against the YARA rules of a
+// directory.
+type YARAConfig struct {
+	Dir    string `json:"dir"`              // Directory of the .yar and .yara files
+	Action string `json:"action,omitempty"` // block (default) or score
+	Score  int    `json:"score,omitempty"`  // Score per matching YARA rule, default 5
+
+	rules []*yaraRule
+}
+
+// provision validates the config, applies the defaults and compiles the rules.
+func (c *YARAConfig) provision() error {
+	switch c.Action {
+	case "":
+		c.Action = detectionActionBlock
+	case detectionActionBlock, detectionActionScore:
+	default:
+		return fmt.Errorf("invalid yara_rules action: %s, must be block or score", c.Action)
+	}
+	if c.Score <= 0 {
+		c.Score = defaultDetectionScore
+	}
+	rules, err := loadYARARules(c.Dir)
+	if err != nil {
+		return err
+	}
+	c.rules = rules
+	return nil
+}
+
+// checkYARA matches the body of the request, and each file it uploads, against the YARA
+// rules in phase 2. It reports whether the request was blocked.
+func (m *Middleware) checkYARA(w http.ResponseWriter, r *http.Request, state *WAFState) bool {
+	config := m.YARA
+	if config == nil || len(config.rules) == 0 || r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	body, err := m.extractTarget(TargetBody, r, nil, state)
+	if err != nil || body == "" {
+		return false
+	}
+
+	matched := scanYARA(config.rules, body)
+	if boundary := multipartBoundary(r); boundary != "" {
+		for _, file := range uploadedFiles(body, boundary) {
+			for _, name := range scanYARA(config.rules, string(file.data)) {
+				if !slices.Contains(matched, name) {
+					matched = append(matched, name)
+				}
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return false
+	}
+
+	m.yaraHits.Add(1)
+	m.incrementRuleHitCount(RuleID(yaraRuleID))
+	state.MatchedRules = append(state.MatchedRules, yaraRuleID)
+	return m.applyDetection(w, r, state, config.Action, config.Score*len(matched), http.StatusForbidden, "yara", yaraRuleID,
+		"YARA rules matched", zap.Strings("yara_rules", matched))
+}
+
+// loadYARARules compiles the .yar and .yara files of a directory.
+func loadYARARules(dir string) ([]*yaraRule, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read yara_rules directory: %w", err)
+	}
+	var rules []*yaraRule
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yar" && ext != ".yara") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read YARA rules: %w", err)
+		}
+		compiled, err := compileYARA(path, string(src))
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range compiled {
+			if names[rule.name] {
+				return nil, fmt.Errorf("%s: duplicate YARA rule %s", path, rule.name)
+			}
+			names[rule.name] = true
+		}
+		rules = append(rules, compiled...)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no YARA rules found in %s", dir)
+	}
+	return rules, nil
+}
+
+// scanYARA returns the names of the rules matching data.
+func scanYARA(rules []*yaraRule, data string) []string {
+	s := newYARAScan(data)
+	var matched []string
+	for _, rule := range rules {
+		if rule.condition.eval(s) != 0 {
+			matched = append(matched, rule.name)
+		}
+	}
+	return matched
+}
+
+// yaraRule is a compiled YARA rule. The supported subset covers text, hex and regex
+// strings with the nocase, wide, ascii, fullword and private modifiers, and conditions
+// combining string references, match counts, "at" offsets, "of" sets, filesize and the
+// uintN functions with boolean, comparison and additive operators. Modules, includes,
+// rule references and loops are rejected.
+type yaraRule struct {
+	name      string
+	tags      []string
+	meta      map[string]string
+	strings   []*yaraString
+	condition yaraExpr
+}
+
+// yaraString is a string of a rule, compiled to a regexp matching the text of a yaraScan.
+type yaraString struct {
+	id string
+	re *regexp.Regexp
+}
+
+// yaraScan holds the data being scanned and the matches of the strings on it.
+type yaraScan struct {
+	data    string
+	text    string // data with each byte as a rune, so that regexps match bytes
+	ascii   bool   // text is data
+	matches map[*yaraString][][]int
+}
+
+func newYARAScan(data string) *yaraScan {
+	text := yaraText(data)
+	return &yaraScan{data: data, text: text, ascii: len(text) == len(data), matches: make(map[*yaraString][][]int)}
+}
+
+// find returns the matches of a string, finding them on first use.
+func (s *yaraScan) find(str *yaraString) [][]int {
+	matches, ok := s.matches[str]
+	if !ok {
+		matches = str.re.FindAllStringIndex(s.text, -1)
+		s.matches[str] = matches
+	}
+	return matches
+}
+
+// offset converts an index of text to an offset of data.
+func (s *yaraScan) offset(i int) int64 {
+	if s.ascii {
+		return int64(i)
+	}
+	return int64(utf8.RuneCountInString(s.text[:i]))
+}
+
+// yaraText maps each byte of data to the rune of the same value, Go regexps matching
+// runes rather than bytes.
+func yaraText(data string) string {
+	ascii := true
+	for i := 0; i < len(data) && ascii; i++ {
+		ascii = data[i] < utf8.RuneSelf
+	}
+	if ascii {
+		return data
+	}
+	var sb strings.Builder
+	sb.Grow(len(data) * 2)
+	for i := 0; i < len(data); i++ {
+		sb.WriteRune(rune(data[i]))
+	}
+	return sb.String()
+}
+
+// yaraExpr is a node of a condition. Booleans evaluate to 1 and 0.
+type yaraExpr interface {
+	eval(s *yaraScan) int64
+}
+
+type (
+	yaraInt      int64
+	yaraFilesize struct{}
+	yaraMatch    struct{ str *yaraString }
+	yaraCount    struct{ str *yaraString }
+	yaraNot      struct{ x yaraExpr }
+	yaraAt       struct {
+		str    *yaraString
+		offset yaraExpr
+	}
+	yaraUint struct {
+		size      int
+		bigEndian bool
+		offset    yaraExpr
+	}
+	yaraBinary struct {
+		op          string
+		left, right yaraExpr
+	}
+	yaraOf struct {
+		quantifier string // any, all, none or a number
+		need       int64
+		set        []*yaraString
+	}
+)
+
+func yaraBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (x yaraInt) eval(*yaraScan) int64       { return int64(x) }
+func (yaraFilesize) eval(s *yaraScan) int64  { return int64(len(s.data)) }
+func (x *yaraMatch) eval(s *yaraScan) int64  { return yaraBool(len(s.find(x.str)) > 0) }
+func (x *yaraCount) eval(s *yaraScan) int64  { return int64(len(s.find(x.str))) }
+func (x *yaraNot) eval(s *yaraScan) int64    { return yaraBool(x.x.eval(s) == 0) }
+func (x *yaraAt) eval(s *yaraScan) int64     { return yaraBool(s.matchesAt(x.str, x.offset.eval(s))) }
+func (x *yaraUint) eval(s *yaraScan) int64   { return s.readUint(x.offset.eval(s), x.size, x.bigEndian) }
+func (x *yaraOf) eval(s *yaraScan) int64     { return yaraBool(x.holds(s)) }
+func (x *yaraBinary) eval(s *yaraScan) int64 { return x.apply(s) }
+
+func (s *yaraScan) matchesAt(str *yaraString, offset int64) bool {
+	for _, match := range s.find(str) {
+		if s.offset(match[0]) == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// readUint reads an unsigned integer of data, or 0 past its end.
+func (s *yaraScan) readUint(offset int64, size int, bigEndian bool) int64 {
+	if offset < 0 || offset+int64(size) > int64(len(s.data)) {
+		return 0
+	}
+	b := []byte(s.data[offset : offset+int64(size)])
+	switch {
+	case size == 1:
+		return int64(b[0])
+	case size == 2 && bigEndian:
+		return int64(binary.BigEndian.Uint16(b))
+	case size == 2:
+		return int64(binary.LittleEndian.Uint16(b))
+	case bigEndian:
+		return int64(binary.BigEndian.Uint32(b))
+	}
+	return int64(binary.LittleEndian.Uint32(b))
+}
+
+func (x *yaraOf) holds(s *yaraScan) bool {
+	var count int64
+	for _, str := range x.set {
+		if len(s.find(str)) > 0 {
+			count++
+		}
+	}
+	switch x.quantifier {
+	case "all":
+		return count == int64(len(x.set))
+	case "none":
+		return count == 0
+	}
+	return count >= x.need
+}
+
+func (x *yaraBinary) apply(s *yaraScan) int64 {
+	left := x.left.eval(s)
+	switch x.op {
+	case "and":
+		return yaraBool(left != 0 && x.right.eval(s) != 0)
+	case "or":
+		return yaraBool(left != 0 || x.right.eval(s) != 0)
+	}
+	right := x.right.eval(s)
+	switch x.op {
+	case "==":
+		return yaraBool(left == right)
+	case "!=":
+		return yaraBool(left != right)
+	case "<":
+		return yaraBool(left < right)
+	case "<=":
+		return yaraBool(left <= right)
+	case ">":
+		return yaraBool(left > right)
+	case ">=":
+		return yaraBool(left >= right)
+	case "+":
+		return left + right
+	}
+	return left - right
+}
+
+// yaraIntFunctions are the supported functions reading integers of the data.
+var yaraIntFunctions = map[string]yaraUint{
+	"uint8":    {size: 1},
+	"uint16":   {size: 2},
+	"uint32":   {size: 4},
+	"uint8be":  {size: 1, bigEndian: true},
+	"uint16be": {size: 2, bigEndian: true},
+	"uint32be": {size: 4, bigEndian: true},
+}
+
+// yaraStringModifiers are the supported string modifiers.
+var yaraStringModifiers = map[string]bool{"nocase": true, "wide": true, "ascii": true, "fullword": true, "private": true}
+
+// yaraParser compiles the YARA rules of a file.
+type yaraParser struct {
+	file string
+	src  string
+	pos  int
+	rule *yaraRule
+}
+
+// compileYARA compiles the rules of a YARA file.
+func compileYARA(file, src string) ([]*yaraRule, error) {
+	p := &yaraParser{file: file, src: src}
+	var rules []*yaraRule
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return rules, nil
+		}
+		switch keyword := p.ident(); keyword {
+		case "rule":
+			rule, err := p.parseRule()
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		case "import", "include", "private", "global":
+			return nil, p.errorf("%s is not supported", keyword)
+		default:
+			return nil, p.errorf("expected rule")
+		}
+	}
+}
+
+func (p *yaraParser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("%s:%d: %s", p.file, line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips white space and comments.
+func (p *yaraParser) skipSpace() {
+	for p.pos < len(p.src) {
+		rest := p.src[p.pos:]
+		switch {
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			p.pos += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 4
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isYARAIdentByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// ident reads an identifier, or returns an empty string if there is none.
+func (p *yaraParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && isYARAIdentByte(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// peekByte returns the next byte after white space, or 0 at the end.
+func (p *yaraParser) peekByte() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *yaraParser) consume(c byte) bool {
+	if p.peekByte() != c || c == 0 {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *yaraParser) expect(c byte) error {
+	if !p.consume(c) {
+		return p.errorf("expected %q", c)
+	}
+	return nil
+}
+
+func (p *yaraParser) parseRule() (*yaraRule, error) {
+	rule := &yaraRule{name: p.ident(), meta: make(map[string]string)}
+	if rule.name == "" {
+		return nil, p.errorf("expected rule name")
+	}
+	if p.consume(':') {
+		for tag := p.ident(); tag != ""; tag = p.ident() {
+			rule.tags = append(rule.tags, tag)
+		}
+	}
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	p.rule = rule
+	for rule.condition == nil {
+		section := p.ident()
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		var err error
+		switch section {
+		case "meta":
+			err = p.parseMeta()
+		case "strings":
+			err = p.parseStrings()
+		case "condition":
+			rule.condition, err = p.parseOr()
+		default:
+			return nil, p.errorf("unknown section %q in rule %s", section, rule.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect('}'); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// parseMeta reads the key = value pairs up to the next section.
+func (p *yaraParser) parseMeta() error {
+	for {
+		start := p.pos
+		key := p.ident()
+		if key == "" || !p.consume('=') {
+			p.pos = start
+			return nil
+		}
+		if p.peekByte() == '"' {
+			p.pos++
+			value, err := p.readText()
+			if err != nil {
+				return err
+			}
+			p.rule.meta[key] = value
+			continue
+		}
+		value := p.token()
+		if value == "" {
+			return p.errorf("expected value of meta %s", key)
+		}
+		p.rule.meta[key] = value
+	}
+}
+
+// parseStrings reads the string definitions up to the next section.
+func (p *yaraParser) parseStrings() error {
+	for p.consume('$') {
+		id := "$" + p.ident()
+		if id == "$" {
+			return p.errorf("anonymous strings are not supported")
+		}
+		if p.findString(id) != nil {
+			return p.errorf("duplicate string %s", id)
+		}
+		if err := p.expect('='); err != nil {
+			return err
+		}
+
+		var pattern string
+		var text string
+		isText := false
+		switch p.peekByte() {
+		case '"':
+			p.pos++
+			value, err := p.readText()
+			if err != nil {
+				return err
+			}
+			text, isText = value, true
+		case '{':
+			p.pos++
+			hex, err := p.readHex()
+			if err != nil {
+				return err
+			}
+			pattern = "(?s)" + hex
+		case '/':
+			p.pos++
+			re, err := p.readRegex()
+			if err != nil {
+				return err
+			}
+			pattern = re
+		default:
+			return p.errorf("expected text, hex or regex string for %s", id)
+		}
+
+		modifiers := make(map[string]bool)
+		for {
+			start := p.pos
+			modifier := p.ident()
+			if modifier == "xor" || modifier == "base64" || modifier == "base64wide" {
+				return p.errorf("modifier %s is not supported", modifier)
+			}
+			if !yaraStringModifiers[modifier] {
+				p.pos = start
+				break
+			}
+			modifiers[modifier] = true
+		}
+		if isText {
+			pattern = yaraTextPattern(text, modifiers)
+		} else if modifiers["nocase"] {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return p.errorf("invalid string %s: %v", id, err)
+		}
+		p.rule.strings = append(p.rule.strings, &yaraString{id: id, re: re})
+	}
+	return nil
+}
+
+// readText reads a text string after its opening quote.
+func (p *yaraParser) readText() (string, error) {
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if p.pos >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			escaped := p.src[p.pos]
+			p.pos++
+			switch escaped {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'x':
+				if p.pos+2 > len(p.src) {
+					return "", p.errorf("invalid \\x escape")
+				}
+				b, err := strconv.ParseUint(p.src[p.pos:p.pos+2], 16, 8)
+				if err != nil {
+					return "", p.errorf("invalid \\x escape")
+				}
+				sb.WriteByte(byte(b))
+				p.pos += 2
+			default:
+				sb.WriteByte(escaped)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// yaraTextPattern returns the regexp of a text string.
+func yaraTextPattern(text string, modifiers map[string]bool) string {
+	var variants []string
+	if modifiers["ascii"] || !modifiers["wide"] {
+		variants = append(variants, regexp.QuoteMeta(yaraText(text)))
+	}
+	if modifiers["wide"] {
+		var sb strings.Builder
+		for i := 0; i < len(text); i++ {
+			sb.WriteString(regexp.QuoteMeta(string(rune(text[i]))))
+			sb.WriteString(`\x00`)
+		}
+		variants = append(variants, sb.String())
+	}
+	pattern := "(?:" + strings.Join(variants, "|") + ")"
+	if modifiers["fullword"] && text != "" {
+		if isYARAIdentByte(text[0]) {
+			pattern = yaraWordBoundary + pattern
+		}
+		if isYARAIdentByte(text[len(text)-1]) {
+			pattern += yaraWordBoundary
+		}
+	}
+	if modifiers["nocase"] {
+		pattern = "(?i)" + pattern
+	}
+	return pattern
+}
+
+// readHex reads a hex string after its opening brace, returning its regexp.
+func (p *yaraParser) readHex() (string, error) {
+	var re strings.Builder
+	for {
+		c := p.peekByte()
+		switch {
+		case c == 0:
+			return "", p.errorf("unterminated hex string")
+		case c == '}':
+			p.pos++
+			if re.Len() == 0 {
+				return "", p.errorf("empty hex string")
+			}
+			return re.String(), nil
+		case c == '(':
+			p.pos++
+			re.WriteString("(?:")
+		case c == '|' || c == ')':
+			p.pos++
+			re.WriteByte(c)
+		case c == '[':
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end < 0 {
+				return "", p.errorf("unterminated hex jump")
+			}
+			jump, err := yaraJump(p.src[p.pos+1 : p.pos+end])
+			if err != nil {
+				return "", p.errorf("%v", err)
+			}
+			re.WriteString(jump)
+			p.pos += end + 1
+		default:
+			negate := c == '~'
+			if negate {
+				p.pos++
+			}
+			if p.pos+2 > len(p.src) {
+				return "", p.errorf("unterminated hex string")
+			}
+			class, err := yaraHexByte(p.src[p.pos:p.pos+2], negate)
+			if err != nil {
+				return "", p.errorf("%v", err)
+			}
+			re.WriteString(class)
+			p.pos += 2
+		}
+	}
+}
+
+// yaraHexByte returns the regexp of a hex byte, where ? is a wildcard nibble.
+func yaraHexByte(token string, negate bool) (string, error) {
+	if token == "??" {
+		if negate {
+			return "", fmt.Errorf("~?? is not a valid hex byte")
+		}
+		return ".", nil
+	}
+	var nibbles [2]int
+	for i := range 2 {
+		c := token[i]
+		switch {
+		case c == '?':
+			nibbles[i] = -1
+		case '0' <= c && c <= '9':
+			nibbles[i] = int(c - '0')
+		case 'a' <= c && c <= 'f':
+			nibbles[i] = int(c-'a') + 10
+		case 'A' <= c && c <= 'F':
+			nibbles[i] = int(c-'A') + 10
+		default:
+			return "", fmt.Errorf("invalid hex byte %q", token)
+		}
+	}
+	if nibbles[0] >= 0 && nibbles[1] >= 0 && !negate {
+		return fmt.Sprintf(`\x{%02x}`, nibbles[0]<<4|nibbles[1]), nil
+	}
+	var class strings.Builder
+	class.WriteByte('[')
+	if negate {
+		class.WriteByte('^')
+	}
+	for b := range 256 {
+		if (nibbles[0] < 0 || b>>4 == nibbles[0]) && (nibbles[1] < 0 || b&0xf == nibbles[1]) {
+			fmt.Fprintf(&class, `\x{%02x}`, b)
+		}
+	}
+	class.WriteByte(']')
+	return class.String(), nil
+}
+
+// yaraJump returns the regexp of a hex string jump: [n], [n-m], [n-] or [-].
+func yaraJump(jump string) (string, error) {
+	lower, upper, ranged := strings.Cut(strings.ReplaceAll(jump, " ", ""), "-")
+	if lower == "" {
+		lower = "0"
+	}
+	low, err := strconv.Atoi(lower)
+	if err != nil || low < 0 || low > yaraMaxJump {
+		return "", fmt.Errorf("invalid hex jump [%s], bounds must be between 0 and %d", jump, yaraMaxJump)
+	}
+	if !ranged {
+		return fmt.Sprintf(".{%d}", low), nil
+	}
+	if upper == "" {
+		return fmt.Sprintf(".{%d,}", low), nil
+	}
+	high, err := strconv.Atoi(upper)
+	if err != nil || high < low || high > yaraMaxJump {
+		return "", fmt.Errorf("invalid hex jump [%s], bounds must be between 0 and %d", jump, yaraMaxJump)
+	}
+	return fmt.Sprintf(".{%d,%d}", low, high), nil
+}
+
+// readRegex reads a regex string after its opening slash, with its i and s flags.
+func (p *yaraParser) readRegex() (string, error) {
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			return "", p.errorf("unterminated regex")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		if c == '/' {
+			break
+		}
+		if c == '\\' && p.pos < len(p.src) && p.src[p.pos] == '/' {
+			c = '/'
+			p.pos++
+		} else if c == '\\' && p.pos < len(p.src) {
+			sb.WriteByte(c)
+			c = p.src[p.pos]
+			p.pos++
+		}
+		sb.WriteByte(c)
+	}
+	flags := ""
+	for p.pos < len(p.src) && (p.src[p.pos] == 'i' || p.src[p.pos] == 's') {
+		flags += p.src[p.pos : p.pos+1]
+		p.pos++
+	}
+	pattern := yaraText(sb.String())
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return pattern, nil
+}
+
+// token reads a token of a condition.
+func (p *yaraParser) token() string {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return ""
+	}
+	start := p.pos
+	rest := p.src[p.pos:]
+	switch c := rest[0]; {
+	case c == '$' || c == '#' || c == '@':
+		p.pos++
+		for p.pos < len(p.src) && isYARAIdentByte(p.src[p.pos]) {
+			p.pos++
+		}
+		if p.pos < len(p.src) && p.src[p.pos] == '*' {
+			p.pos++
+		}
+	case isYARAIdentByte(c):
+		p.ident()
+	case strings.HasPrefix(rest, "==") || strings.HasPrefix(rest, "!=") || strings.HasPrefix(rest, "<=") ||
+		strings.HasPrefix(rest, ">=") || strings.HasPrefix(rest, ".."):
+		p.pos += 2
+	default:
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// peek returns the next token of a condition without reading it.
+func (p *yaraParser) peek() string {
+	start := p.pos
+	tok := p.token()
+	p.pos = start
+	return tok
+}
+
+func (p *yaraParser) expectToken(want string) error {
+	if tok := p.token(); tok != want {
+		return p.errorf("expected %q, got %q", want, tok)
+	}
+	return nil
+}
+
+func (p *yaraParser) parseOr() (yaraExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "or" {
+		p.token()
+		var right yaraExpr
+		if right, err = p.parseAnd(); err == nil {
+			left = &yaraBinary{op: "or", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *yaraParser) parseAnd() (yaraExpr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.peek() == "and" {
+		p.token()
+		var right yaraExpr
+		if right, err = p.parseNot(); err == nil {
+			left = &yaraBinary{op: "and", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *yaraParser) parseNot() (yaraExpr, error) {
+	if p.peek() != "not" {
+		return p.parseComparison()
+	}
+	p.token()
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &yaraNot{x: x}, nil
+}
+
+func (p *yaraParser) parseComparison() (yaraExpr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.token()
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &yaraBinary{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *yaraParser) parseSum() (yaraExpr, error) {
+	left, err := p.parsePrimary()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.token()
+		var right yaraExpr
+		if right, err = p.parsePrimary(); err == nil {
+			left = &yaraBinary{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *yaraParser) parsePrimary() (yaraExpr, error) {
+	tok := p.token()
+	switch {
+	case tok == "(":
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expectToken(")")
+	case tok == "true":
+		return yaraInt(1), nil
+	case tok == "false":
+		return yaraInt(0), nil
+	case tok == "filesize":
+		return yaraFilesize{}, nil
+	case tok == "any" || tok == "all" || tok == "none":
+		return p.parseOf(tok, 0)
+	case strings.HasPrefix(tok, "$"):
+		str, err := p.lookupString(tok)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != "at" {
+			return &yaraMatch{str: str}, nil
+		}
+		p.token()
+		offset, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return &yaraAt{str: str, offset: offset}, nil
+	case strings.HasPrefix(tok, "#"):
+		str, err := p.lookupString("$" + tok[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &yaraCount{str: str}, nil
+	case tok != "" && tok[0] >= '0' && tok[0] <= '9':
+		n, err := parseYARANumber(tok)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if p.peek() == "of" {
+			return p.parseOf(tok, n)
+		}
+		return yaraInt(n), nil
+	}
+	if function, ok := yaraIntFunctions[tok]; ok {
+		if err := p.expectToken("("); err != nil {
+			return nil, err
+		}
+		offset, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		function.offset = offset
+		return &function, p.expectToken(")")
+	}
+	if tok == "" {
+		return nil, p.errorf("unexpected end of condition")
+	}
+	return nil, p.errorf("unsupported %q in condition of rule %s", tok, p.rule.name)
+}
+
+// parseOf reads the string set of an "of" expression.
+func (p *yaraParser) parseOf(quantifier string, need int64) (yaraExpr, error) {
+	if err := p.expectToken("of"); err != nil {
+		return nil, err
+	}
+	of := &yaraOf{quantifier: quantifier, need: need}
+	if quantifier == "any" {
+		of.need = 1
+	}
+	switch tok := p.token(); tok {
+	case "them":
+		of.set = p.rule.strings
+	case "(":
+		for {
+			pattern := p.token()
+			if !strings.HasPrefix(pattern, "$") {
+				return nil, p.errorf("expected string in set, got %q", pattern)
+			}
+			matched := false
+			for _, str := range p.rule.strings {
+				if str.id == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(str.id, strings.TrimSuffix(pattern, "*"))) {
+					of.set = append(of.set, str)
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, p.errorf("undefined string %s", pattern)
+			}
+			if sep := p.token(); sep == ")" {
+				break
+			} else if sep != "," {
+				return nil, p.errorf("expected \",\" or \")\" in set, got %q", sep)
+			}
+		}
+	default:
+		return nil, p.errorf("expected them or a string set, got %q", tok)
+	}
+	return of, nil
+}
+
+func (p *yaraParser) findString(id string) *yaraString {
+	for _, str := range p.rule.strings {
+		if str.id == id {
+			return str
+		}
+	}
+	return nil
+}
+
+func (p *yaraParser) lookupString(id string) (*yaraString, error) {
+	if str := p.findString(id); str != nil {
+		return str, nil
+	}
+	return nil, p.errorf("undefined string %s in rule %s", id, p.rule.name)
+}
+
+// parseYARANumber parses a decimal or 0x hexadecimal number, with an optional KB or MB
+// suffix.
+func parseYARANumber(tok string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(tok, "KB"):
+		tok, multiplier = strings.TrimSuffix(tok, "KB"), 1024
+	case strings.HasSuffix(tok, "MB"):
+		tok, multiplier = strings.TrimSuffix(tok, "MB"), 1024*1024
+	}
+	n, err := strconv.ParseInt(tok, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", tok)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,168 @@
+package caddywaf
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testYARARules = `
+/* Webshell signatures */
+rule php_webshell : webshell php {
+    meta:
+        author = "waf"
+        severity = 8
+    strings:
+        $php = "<?php" nocase
+        $eval = /(eval|assert)\s*\(\s*(base64_decode|gzinflate)\(/i
+        $cmd = "system" fullword
+    condition:
+        $php and ($eval or $cmd)
+}
+
+rule pe_executable {
+    strings:
+        $dos = "This program cannot be run in DOS mode"
+    condition:
+        uint16(0) == 0x5A4D and $dos
+}
+
+rule hex_payload {
+    strings:
+        $shellcode = { 90 90 [2-4] ( EB | E9 ) ?? C? ~00 }
+        $marker = "MARK" wide
+    condition:
+        any of them and filesize < 1KB
+}
+`
+
+func TestCompileYARA(t *testing.T) {
+	rules, err := compileYARA("test.yar", testYARARules)
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, "php_webshell", rules[0].name)
+	assert.Equal(t, []string{"webshell", "php"}, rules[0].tags)
+	assert.Equal(t, "waf", rules[0].meta["author"])
+
+	tests := []struct {
+		data    string
+		matched []string
+	}{
+		{`<?PHP eval(base64_decode("ZWNobyAx"));`, []string{"php_webshell"}},
+		{`<?php system($_GET["c"]);`, []string{"php_webshell"}},
+		{`<?php echo filesystem_status();`, nil},
+		{"MZ\x90\x00This program cannot be run in DOS mode", []string{"pe_executable"}},
+		{"XX This program cannot be run in DOS mode", nil},
+		{"\x90\x90\x01\x02\x03\xe9\xff\xc4\x01", []string{"hex_payload"}},
+		{"\x90\x90\x01\x02\x03\xe9\xff\xc4\x00", nil},
+		{"M\x00A\x00R\x00K\x00", []string{"hex_payload"}},
+		{"M\x00A\x00R\x00K\x00" + strings.Repeat("-", 1024), nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.matched, scanYARA(rules, tt.data), "%q", tt.data)
+	}
+}
+
+func TestCompileYARA_Conditions(t *testing.T) {
+	rules, err := compileYARA("test.yar", `
+rule counts {
+    strings:
+        $a1 = "alpha"
+        $a2 = "beta"
+        $b = "gamma"
+    condition:
+        #a1 >= 2 and 2 of ($a*) and none of ($b) and $a1 at 3 and not filesize > 100 + 20
+}`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"counts"}, scanYARA(rules, "-- alpha beta alpha"))
+	assert.Empty(t, scanYARA(rules, "alpha beta alpha"), "$a1 not at 3")
+	assert.Empty(t, scanYARA(rules, "-- alpha beta alpha gamma"))
+	assert.Empty(t, scanYARA(rules, "-- alpha beta"))
+
+	// Offsets count bytes, not runes
+	rules, err = compileYARA("test.yar", `rule offset { strings: $a = "x" condition: $a at 2 and uint8be(0) == 0xC3 }`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"offset"}, scanYARA(rules, "é x"[:2]+"x"))
+
+	for _, src := range []string{
+		`import "pe" rule a { condition: true }`,
+		`rule a { strings: $a = "x" }`,
+		`rule a { strings: $a = "x" xor condition: $a }`,
+		`rule a { strings: $a = "x" condition: $b }`,
+		`rule a { strings: $a = "x" $a = "y" condition: $a }`,
+		`rule a { strings: $a = { 4D [2000] 5A } condition: $a }`,
+		`rule a { strings: $a = { 4G } condition: $a }`,
+		`rule a { strings: $a = /(a)\1/ condition: $a }`,
+		`rule a { strings: $a = "x" condition: for any i in (1..#a): (@a[i] > 0) }`,
+		`rule a { strings: $a = "x" condition: $a in (0..10) }`,
+		`rule a { condition: b }`,
+	} {
+		_, err := compileYARA("test.yar", src)
+		assert.Error(t, err, src)
+	}
+}
+
+func TestYARAConfig_Provision(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "webshells.yar"), []byte(testYARARules), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not rules"), 0o644))
+	config := &YARAConfig{Dir: dir}
+	require.NoError(t, config.provision())
+	assert.Len(t, config.rules, 3)
+	assert.Equal(t, detectionActionBlock, config.Action)
+	assert.Equal(t, defaultDetectionScore, config.Score)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "more.yara"), []byte(`rule php_webshell { condition: true }`), 0o644))
+	assert.Error(t, (&YARAConfig{Dir: dir}).provision(), "duplicate rule")
+	assert.Error(t, (&YARAConfig{Dir: t.TempDir()}).provision(), "no rules")
+	assert.Error(t, (&YARAConfig{Dir: filepath.Join(dir, "missing")}).provision())
+	assert.Error(t, (&YARAConfig{Dir: dir, Action: "drop"}).provision())
+}
+
+func TestCheckYARA(t *testing.T) {
+	rules, err := compileYARA("test.yar", testYARARules)
+	require.NoError(t, err)
+	m := &Middleware{
+		logger:                zap.NewNop(),
+		requestValueExtractor: NewRequestValueExtractor(zap.NewNop(), false),
+		AnomalyThreshold:      10,
+		YARA:                  &YARAConfig{Action: detectionActionBlock, Score: defaultDetectionScore, rules: rules},
+	}
+
+	clean := httptest.NewRequest("POST", "/comment", strings.NewReader("nice post"))
+	assert.False(t, m.checkYARA(httptest.NewRecorder(), clean, &WAFState{}))
+
+	// The uploaded file is scanned on its own, so that uint16(0) reads its first bytes
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	file, err := writer.CreateFormFile("avatar", "avatar.png")
+	require.NoError(t, err)
+	_, _ = io.WriteString(file, "MZ\x90\x00This program cannot be run in DOS mode")
+	require.NoError(t, writer.Close())
+	upload := httptest.NewRequest("POST", "/upload", &body)
+	upload.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+	assert.True(t, m.checkYARA(w, upload, state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{yaraRuleID}, state.MatchedRules)
+	assert.Equal(t, int64(1), m.yaraHits.Load())
+
+	m.YARA.Action = detectionActionScore
+	state = &WAFState{}
+	webshell := httptest.NewRequest("POST", "/comment", strings.NewReader(`<?php system("id");`))
+	assert.False(t, m.checkYARA(httptest.NewRecorder(), webshell, state))
+	assert.Equal(t, defaultDetectionScore, state.TotalScore)
+	webshell = httptest.NewRequest("POST", "/comment", strings.NewReader(`<?php system("id");`))
+	assert.True(t, m.checkYARA(httptest.NewRecorder(), webshell, state), "reaches the anomaly threshold")
+}